@@ -4,6 +4,7 @@ go 1.18
 
 require (
 	github.com/georgysavva/scany v1.2.1
+	github.com/klauspost/compress v1.15.11
 	github.com/lib/pq v1.10.7
 )
 
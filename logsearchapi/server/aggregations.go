@@ -0,0 +1,1014 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/georgysavva/scany/sqlscan"
+)
+
+// aggregationColumns are the request_info columns that records may be grouped
+// by in aggregations.
+var aggregationColumns = map[string]bool{
+	"api_name":             true,
+	"access_key":           true,
+	"bucket":               true,
+	"object":               true,
+	"remote_host":          true,
+	"user_agent":           true,
+	"response_status":      true,
+	"response_status_code": true,
+}
+
+// GroupCount is the number of records in a group of an aggregation.
+type GroupCount struct {
+	Group string `json:"group"`
+	Count int64  `json:"count"`
+}
+
+// AuthBreakdown counts the request_info records matching s, split into
+// authenticated and anonymous requests. A request is anonymous when it has no
+// access key.
+func (c *DBClient) AuthBreakdown(ctx context.Context, s *SearchQuery) (authenticated, anonymous int64, err error) {
+	if err := c.checkOpen(); err != nil {
+		return 0, 0, err
+	}
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Search)
+	defer cancel()
+
+	const authBreakdownQuery QTemplate = `SELECT COUNT(*) FILTER (WHERE access_key IS NOT NULL AND access_key <> ''),
+                                                     COUNT(*) FILTER (WHERE access_key IS NULL OR access_key = '')
+                                                FROM %s
+                                               %s;`
+
+	whereClause, sqlArgs, _, err := c.reqInfoWhereClause(s, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	q := authBreakdownQuery.build(c.reqInfoTable().Name, whereClause)
+	if err := c.reader().QueryRowContext(ctx, q, sqlArgs...).Scan(&authenticated, &anonymous); err != nil {
+		return 0, 0, &QueryError{Op: "querying", Err: err}
+	}
+	return authenticated, anonymous, nil
+}
+
+// CountByGroup counts the request_info records matching s grouped by the
+// groupBy column, or by operation category if groupBy is
+// "operation_category", in decreasing order of count. Groups with fewer than
+// minCount records are left out. Records with a NULL or empty value are
+// counted in the group with an empty name. It is CountByColumns with a
+// single column.
+func (c *DBClient) CountByGroup(ctx context.Context, s *SearchQuery, groupBy string, minCount int64) ([]GroupCount, error) {
+	if groupBy == operationCategoryGroup {
+		return c.countByOperationCategory(ctx, s, minCount)
+	}
+
+	counts, err := c.CountByColumns(ctx, s, []string{groupBy}, minCount)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]GroupCount, len(counts))
+	for i, count := range counts {
+		groups[i] = GroupCount{Group: count.Groups[0], Count: count.Count}
+	}
+	return groups, nil
+}
+
+// countByOperationCategory counts records by API and adds up the counts of
+// the APIs of each operation category.
+func (c *DBClient) countByOperationCategory(ctx context.Context, s *SearchQuery, minCount int64) ([]GroupCount, error) {
+	apiCounts, err := c.CountByColumns(ctx, s, []string{"api_name"}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64)
+	for _, apiCount := range apiCounts {
+		counts[c.operationCategory(apiCount.Groups[0])] += apiCount.Count
+	}
+	groups := []GroupCount{}
+	for category, count := range counts {
+		if count >= minCount {
+			groups = append(groups, GroupCount{Group: category, Count: count})
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		return groups[i].Group < groups[j].Group
+	})
+	return groups, nil
+}
+
+// maxGroupByColumns is the maximum number of columns CountByColumns groups
+// records by, as the number of groups may grow with the product of the
+// numbers of values of the columns.
+const maxGroupByColumns = 3
+
+// GroupsCount is a group of records counted by CountByColumns, with the
+// values of its groupBy columns, in order, and its count.
+type GroupsCount struct {
+	Groups []string `json:"groups"`
+	Count  int64    `json:"count"`
+}
+
+// CountByColumns counts the request_info records matching s grouped by each
+// combination of values of the groupBy columns, e.g. by bucket and
+// response_status_code, in decreasing order of count, ties being ordered by
+// group. From 1 to maxGroupByColumns columns may be given. Groups with fewer
+// than minCount records are left out. Records with a NULL or empty value of a
+// column are counted in the groups with an empty value for it.
+func (c *DBClient) CountByColumns(ctx context.Context, s *SearchQuery, groupBy []string, minCount int64) ([]GroupsCount, error) {
+	if err := c.checkOpen(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Search)
+	defer cancel()
+
+	q, sqlArgs, err := c.countByColumnsQuery(s, groupBy, minCount)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := c.reader().QueryContext(ctx, q, sqlArgs...)
+	if err != nil {
+		return nil, &QueryError{Op: "querying", Err: err}
+	}
+	defer rows.Close()
+
+	counts := []GroupsCount{}
+	for rows.Next() {
+		count := GroupsCount{Groups: make([]string, len(groupBy))}
+		dest := make([]interface{}, 0, len(groupBy)+1)
+		for i := range count.Groups {
+			dest = append(dest, &count.Groups[i])
+		}
+		dest = append(dest, &count.Count)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, &QueryError{Op: "accessing", Err: err}
+		}
+		counts = append(counts, count)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &QueryError{Op: "accessing", Err: err}
+	}
+	return counts, nil
+}
+
+// countByColumnsQuery returns the query of CountByColumns with its
+// arguments.
+func (c *DBClient) countByColumnsQuery(s *SearchQuery, groupBy []string, minCount int64) (string, []interface{}, error) {
+	const countByColumnsQuery QTemplate = `SELECT %s,
+                                                      COUNT(*) AS count
+                                                 FROM %s
+                                                %s
+                                             GROUP BY %s
+                                                   %s
+                                             ORDER BY count DESC, %s;`
+
+	if len(groupBy) == 0 || len(groupBy) > maxGroupByColumns {
+		return "", nil, invalidQueryErrorf("Expected 1 to %d group by columns, got %d", maxGroupByColumns, len(groupBy))
+	}
+	selects := make([]string, len(groupBy))
+	positions := make([]string, len(groupBy))
+	orders := make([]string, len(groupBy))
+	seen := make(map[string]bool)
+	for i, col := range groupBy {
+		if !aggregationColumns[col] {
+			return "", nil, invalidQueryErrorf("Invalid group by column: %s", col)
+		}
+		if seen[col] {
+			return "", nil, invalidQueryErrorf("Duplicate group by column: %s", col)
+		}
+		seen[col] = true
+		selects[i] = fmt.Sprintf("COALESCE(%s::text, '') AS %s", col, col)
+		positions[i] = strconv.Itoa(i + 1)
+		orders[i] = positions[i] + " ASC"
+	}
+
+	if err := c.checkAggregatedColumns(s, groupBy...); err != nil {
+		return "", nil, err
+	}
+
+	whereClause, sqlArgs, dollarStart, err := c.reqInfoWhereClause(s, 1)
+	if err != nil {
+		return "", nil, err
+	}
+
+	havingClause := ""
+	if minCount > 1 {
+		havingClause = fmt.Sprintf("HAVING COUNT(*) >= $%d", dollarStart)
+		sqlArgs = append(sqlArgs, minCount)
+	}
+
+	q := countByColumnsQuery.build(strings.Join(selects, ", "), c.reqInfoTable().Name, whereClause,
+		strings.Join(positions, ", "), havingClause, strings.Join(orders, ", "))
+	return q, sqlArgs, nil
+}
+
+// distinctValueColumns are the request_info text columns whose distinct values
+// may be looked up, e.g. for autocompletion of filters.
+var distinctValueColumns = map[string]bool{
+	"api_name":        true,
+	"access_key":      true,
+	"bucket":          true,
+	"object":          true,
+	"remote_host":     true,
+	"request_id":      true,
+	"user_agent":      true,
+	"response_status": true,
+}
+
+// DistinctValues returns up to limit distinct non-empty values of the column
+// in the request_info records matching s, in ascending order.
+func (c *DBClient) DistinctValues(ctx context.Context, column string, s *SearchQuery, limit int) ([]string, error) {
+	if err := c.checkOpen(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Search)
+	defer cancel()
+
+	q, sqlArgs, err := c.distinctValuesQuery(column, s, limit)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := c.reader().QueryContext(ctx, q, sqlArgs...)
+	if err != nil {
+		return nil, &QueryError{Op: "querying", Err: err}
+	}
+	values := []string{}
+	if err := sqlscan.ScanAll(&values, rows); err != nil {
+		return nil, &QueryError{Op: "accessing", Err: err}
+	}
+	return values, nil
+}
+
+func (c *DBClient) distinctValuesQuery(column string, s *SearchQuery, limit int) (string, []interface{}, error) {
+	const distinctValuesQuery QTemplate = `SELECT DISTINCT %s
+                                                 FROM %s
+                                                %s
+                                             ORDER BY %s
+                                                LIMIT $%d;`
+
+	if !distinctValueColumns[column] {
+		return "", nil, invalidQueryErrorf("Invalid distinct values column: %s", column)
+	}
+	if limit <= 0 {
+		return "", nil, invalidQueryErrorf("Invalid distinct values limit: %d", limit)
+	}
+
+	if err := c.checkAggregatedColumns(s, column); err != nil {
+		return "", nil, err
+	}
+
+	whereClause, sqlArgs, dollarStart, err := c.reqInfoWhereClause(s, 1)
+	if err != nil {
+		return "", nil, err
+	}
+	nonEmpty := fmt.Sprintf("%s <> ''", column)
+	if whereClause == "" {
+		whereClause = "WHERE " + nonEmpty
+	} else {
+		whereClause += " AND " + nonEmpty
+	}
+	sqlArgs = append(sqlArgs, limit)
+
+	return distinctValuesQuery.build(column, c.reqInfoTable().Name, whereClause, column, dollarStart), sqlArgs, nil
+}
+
+// CountDistinct counts the distinct non-empty values of the column in the
+// request_info records matching s, e.g. of request_id to count unique
+// requests, as a request may be logged more than once. The column is one of
+// distinctValueColumns, or a *ColumnError is returned.
+func (c *DBClient) CountDistinct(ctx context.Context, column string, s *SearchQuery) (int64, error) {
+	if err := c.checkOpen(); err != nil {
+		return 0, err
+	}
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Search)
+	defer cancel()
+
+	q, sqlArgs, err := c.countDistinctQuery(column, s)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	if err := c.reader().QueryRowContext(ctx, q, sqlArgs...).Scan(&count); err != nil {
+		return 0, &QueryError{Op: "querying", Err: err}
+	}
+	return count, nil
+}
+
+func (c *DBClient) countDistinctQuery(column string, s *SearchQuery) (string, []interface{}, error) {
+	const countDistinctQuery QTemplate = `SELECT COUNT(DISTINCT NULLIF(%s, ''))
+                                                FROM %s
+                                               %s;`
+
+	if !distinctValueColumns[column] {
+		return "", nil, &ColumnError{Column: column, Op: "count distinct"}
+	}
+
+	whereClause, sqlArgs, _, err := c.reqInfoWhereClause(s, 1)
+	if err != nil {
+		return "", nil, err
+	}
+	return countDistinctQuery.build(column, c.reqInfoTable().Name, whereClause), sqlArgs, nil
+}
+
+// RequestGap is the median time between consecutive requests made with an
+// access key.
+type RequestGap struct {
+	AccessKey string        `json:"access_key"`
+	Requests  int64         `json:"requests"`
+	MedianGap time.Duration `json:"median_gap_ns"`
+}
+
+// MedianRequestGaps computes, for each access key with at least two
+// request_info records matching s, the median time between its consecutive
+// requests, in increasing order of the median. Steady automated clients have
+// small medians close to their request period, while interactive users have
+// large medians. Anonymous requests are left out.
+func (c *DBClient) MedianRequestGaps(ctx context.Context, s *SearchQuery) ([]RequestGap, error) {
+	if err := c.checkOpen(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Search)
+	defer cancel()
+
+	const medianGapsQuery QTemplate = `SELECT access_key,
+                                                  COUNT(*) AS requests,
+                                                  percentile_cont(0.5) WITHIN GROUP (ORDER BY gap_ns) AS median_gap_ns
+                                             FROM (SELECT access_key,
+                                                          (EXTRACT(EPOCH FROM time - lag(time) OVER (PARTITION BY access_key ORDER BY time)) * 1000000000)::float8 AS gap_ns
+                                                     FROM %s
+                                                    %s) AS gaps
+                                            WHERE access_key IS NOT NULL AND access_key <> ''
+                                         GROUP BY access_key
+                                           HAVING COUNT(*) > 1
+                                         ORDER BY median_gap_ns ASC, access_key ASC;`
+
+	if err := c.checkAggregatedColumns(s, "access_key"); err != nil {
+		return nil, err
+	}
+	whereClause, sqlArgs, _, err := c.reqInfoWhereClause(s, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	q := medianGapsQuery.build(c.reqInfoTable().Name, whereClause)
+	rows, err := c.reader().QueryContext(ctx, q, sqlArgs...)
+	if err != nil {
+		return nil, &QueryError{Op: "querying", Err: err}
+	}
+	defer rows.Close()
+
+	gaps := []RequestGap{}
+	for rows.Next() {
+		var (
+			gap      RequestGap
+			medianNs float64
+		)
+		if err := rows.Scan(&gap.AccessKey, &gap.Requests, &medianNs); err != nil {
+			return nil, &QueryError{Op: "accessing", Err: err}
+		}
+		gap.MedianGap = time.Duration(medianNs)
+		gaps = append(gaps, gap)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &QueryError{Op: "accessing", Err: err}
+	}
+	return gaps, nil
+}
+
+// rateBucketIntervals are the time bucket intervals accepted by
+// RateOffenders. They divide an hour evenly, so that buckets start at round
+// times.
+var rateBucketIntervals = []time.Duration{
+	time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+	10 * time.Minute,
+	15 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+}
+
+// RateOffender is the number of requests made with an access key in a time
+// bucket.
+type RateOffender struct {
+	AccessKey   string    `json:"access_key"`
+	BucketStart time.Time `json:"bucket_start"`
+	Count       int64     `json:"count"`
+}
+
+var rateOffenderColumns = []parquetColumn{
+	{Name: "access_key", Type: parquetString},
+	{Name: "bucket_start", Type: parquetTimestamp},
+	{Name: "count", Type: parquetInt64},
+}
+
+// RateOffenders writes to w the access keys that made more than threshold
+// requests in a time bucket of bucketInterval, e.g. a minute, among the
+// request_info records matching s: one RateOffender for each such access key
+// and bucket, in order of bucket and then of decreasing count. Anonymous
+// requests are left out. The bucketInterval is one of rateBucketIntervals.
+// The offenders are written in the export format of s, or as a JSON array if
+// it has none; the "count" format writes the number of offenders.
+func (c *DBClient) RateOffenders(ctx context.Context, s *SearchQuery, bucketInterval time.Duration, threshold int, w io.Writer) error {
+	if err := c.checkOpen(); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Search)
+	defer cancel()
+
+	q, sqlArgs, err := c.rateOffendersQuery(s, bucketInterval, threshold)
+	if err != nil {
+		return err
+	}
+	rows, err := c.reader().QueryContext(ctx, q, sqlArgs...)
+	if err != nil {
+		return &QueryError{Op: "querying", Err: err}
+	}
+	offenders := []RateOffender{}
+	if err := sqlscan.ScanAll(&offenders, rows); err != nil {
+		return &QueryError{Op: "accessing", Err: err}
+	}
+	for i := range offenders {
+		offenders[i].BucketStart = s.outputTime(offenders[i].BucketStart)
+	}
+
+	return writeAggregation(w, s, rateOffenderColumns, len(offenders), func(i int) []interface{} {
+		o := offenders[i]
+		return []interface{}{o.AccessKey, o.BucketStart, o.Count}
+	}, func(i int) interface{} {
+		return offenders[i]
+	})
+}
+
+func (c *DBClient) rateOffendersQuery(s *SearchQuery, bucketInterval time.Duration, threshold int) (string, []interface{}, error) {
+	const rateOffendersQuery QTemplate = `SELECT access_key,
+                                                     to_timestamp(floor(EXTRACT(EPOCH FROM time) / $%d) * $%d) AS bucket_start,
+                                                     COUNT(*) AS count
+                                                FROM %s
+                                               %s
+                                            GROUP BY 1, 2
+                                              HAVING COUNT(*) > $%d
+                                            ORDER BY bucket_start ASC, count DESC, access_key ASC;`
+
+	validInterval := false
+	for _, interval := range rateBucketIntervals {
+		validInterval = validInterval || bucketInterval == interval
+	}
+	if !validInterval {
+		return "", nil, invalidQueryErrorf("Invalid rate bucket interval: %s", bucketInterval)
+	}
+	if threshold < 0 {
+		return "", nil, invalidQueryErrorf("Invalid rate threshold: %d", threshold)
+	}
+
+	if err := c.checkAggregatedColumns(s, "access_key"); err != nil {
+		return "", nil, err
+	}
+
+	whereClause, sqlArgs, dollarStart, err := c.reqInfoWhereClause(s, 1)
+	if err != nil {
+		return "", nil, err
+	}
+	const authenticated = "access_key IS NOT NULL AND access_key <> ''"
+	if whereClause == "" {
+		whereClause = "WHERE " + authenticated
+	} else {
+		whereClause += " AND " + authenticated
+	}
+	sqlArgs = append(sqlArgs, int64(bucketInterval/time.Second), threshold)
+
+	return rateOffendersQuery.build(dollarStart, dollarStart, c.reqInfoTable().Name, whereClause, dollarStart+1), sqlArgs, nil
+}
+
+// maxLatencyPercentiles is the maximum number of percentiles computed by
+// LatencyPercentiles.
+const maxLatencyPercentiles = 10
+
+// latencyRow is a group of a LatencyPercentiles aggregation with its
+// percentiles, output as a JSON object with the fields in column order.
+type latencyRow struct {
+	group   string
+	columns []parquetColumn
+	values  []sql.NullInt64
+}
+
+func (r latencyRow) row() []interface{} {
+	row := make([]interface{}, 0, len(r.values)+1)
+	row = append(row, r.group)
+	for _, v := range r.values {
+		if v.Valid {
+			row = append(row, v.Int64)
+		} else {
+			row = append(row, nil)
+		}
+	}
+	return row
+}
+
+func (r latencyRow) MarshalJSON() ([]byte, error) {
+	return marshalJSONRow(r.columns, r.row())
+}
+
+// marshalJSONRow returns the JSON object of the row of an aggregation with
+// the given columns, with the fields in column order.
+func marshalJSONRow(columns []parquetColumn, row []interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	for i, v := range row {
+		if i == 0 {
+			buf.WriteByte('{')
+		} else {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(columns[i].Name)
+		value, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// percentileColumn is the name of the column of a percentile, e.g. p95_ns
+// for 0.95 or p99_9_ns for 0.999.
+func percentileColumn(p float64) string {
+	v := strings.TrimRight(strconv.FormatFloat(p*100, 'f', 4, 64), "0")
+	v = strings.TrimSuffix(v, ".")
+	return "p" + strings.ReplaceAll(v, ".", "_") + "_ns"
+}
+
+// LatencyPercentiles writes to w the percentiles of time_to_response_ns of
+// the request_info records matching s, grouped by the groupBy column, in
+// order of group. The percentiles are fractions between 0 and 1, e.g. 0.5,
+// 0.95 and 0.99 for the p50_ns, p95_ns and p99_ns columns, interpolated
+// between records and rounded to the nanosecond. Records without a response
+// time are left out, and a group with none of them has null percentiles. The
+// rows are written in the export format of s, or as a JSON array if it has
+// none; the "count" format writes the number of groups.
+func (c *DBClient) LatencyPercentiles(ctx context.Context, s *SearchQuery, groupBy string, percentiles []float64, w io.Writer) error {
+	if err := c.checkOpen(); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Search)
+	defer cancel()
+
+	q, sqlArgs, columns, err := c.latencyPercentilesQuery(s, groupBy, percentiles)
+	if err != nil {
+		return err
+	}
+	rows, err := c.reader().QueryContext(ctx, q, sqlArgs...)
+	if err != nil {
+		return &QueryError{Op: "querying", Err: err}
+	}
+	defer rows.Close()
+
+	var latencies []latencyRow
+	for rows.Next() {
+		r := latencyRow{columns: columns, values: make([]sql.NullInt64, len(percentiles))}
+		dest := []interface{}{&r.group}
+		for i := range r.values {
+			dest = append(dest, &r.values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return &QueryError{Op: "accessing", Err: err}
+		}
+		latencies = append(latencies, r)
+	}
+	if err := rows.Err(); err != nil {
+		return &QueryError{Op: "accessing", Err: err}
+	}
+
+	return writeAggregation(w, s, columns, len(latencies), func(i int) []interface{} {
+		return latencies[i].row()
+	}, func(i int) interface{} {
+		return latencies[i]
+	})
+}
+
+// latencyPercentilesQuery returns the query of LatencyPercentiles with its
+// arguments and output columns.
+func (c *DBClient) latencyPercentilesQuery(s *SearchQuery, groupBy string, percentiles []float64) (string, []interface{}, []parquetColumn, error) {
+	const latencyPercentilesQuery QTemplate = `SELECT COALESCE(%s::text, '') AS "group",
+                                                          %s
+                                                     FROM %s
+                                                    %s
+                                                 GROUP BY 1
+                                                 ORDER BY 1 ASC;`
+
+	if !aggregationColumns[groupBy] {
+		return "", nil, nil, invalidQueryErrorf("Invalid group by column: %s", groupBy)
+	}
+	if len(percentiles) == 0 || len(percentiles) > maxLatencyPercentiles {
+		return "", nil, nil, invalidQueryErrorf("Expected 1 to %d percentiles, got %d", maxLatencyPercentiles, len(percentiles))
+	}
+
+	if err := c.checkAggregatedColumns(s, groupBy); err != nil {
+		return "", nil, nil, err
+	}
+
+	whereClause, sqlArgs, dollarStart, err := c.reqInfoWhereClause(s, 1)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	columns := []parquetColumn{{Name: "group", Type: parquetString}}
+	seen := make(map[string]bool)
+	selects := make([]string, len(percentiles))
+	for i, p := range percentiles {
+		if !(p >= 0 && p <= 1) {
+			return "", nil, nil, invalidQueryErrorf("Invalid percentile: %v, expected a value between 0 and 1", p)
+		}
+		name := percentileColumn(p)
+		if seen[name] {
+			return "", nil, nil, invalidQueryErrorf("Duplicate percentile: %v", p)
+		}
+		seen[name] = true
+		columns = append(columns, parquetColumn{Name: name, Type: parquetInt64, Optional: true})
+		selects[i] = fmt.Sprintf("round(percentile_cont($%d::float8) WITHIN GROUP (ORDER BY time_to_response_ns::float8))::int8 AS %s", dollarStart+i, name)
+		sqlArgs = append(sqlArgs, p)
+	}
+
+	return latencyPercentilesQuery.build(groupBy, strings.Join(selects, ", "), c.reqInfoTable().Name, whereClause), sqlArgs, columns, nil
+}
+
+// maxTopObjects is the maximum number of objects returned by TopObjects.
+const maxTopObjects = 1000
+
+// ObjectCount is the number of requests made on an object.
+type ObjectCount struct {
+	Bucket string `json:"bucket"`
+	Object string `json:"object"`
+	Count  int64  `json:"count"`
+}
+
+var objectCountColumns = []parquetColumn{
+	{Name: "bucket", Type: parquetString},
+	{Name: "object", Type: parquetString},
+	{Name: "count", Type: parquetInt64},
+}
+
+// TopObjects writes to w the n objects with the most request_info records
+// matching s, e.g. the hottest objects of a bucket: one ObjectCount for each
+// object, in order of decreasing count. The records without an object, e.g.
+// of bucket operations, are left out. n must be from 1 to maxTopObjects. The
+// objects are written in the export format of s, or as a JSON array if it has
+// none; the "count" format writes the number of objects.
+func (c *DBClient) TopObjects(ctx context.Context, s *SearchQuery, n int, w io.Writer) error {
+	if err := c.checkOpen(); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Search)
+	defer cancel()
+
+	q, sqlArgs, err := c.topObjectsQuery(s, n)
+	if err != nil {
+		return err
+	}
+	rows, err := c.reader().QueryContext(ctx, q, sqlArgs...)
+	if err != nil {
+		return &QueryError{Op: "querying", Err: err}
+	}
+	objects := []ObjectCount{}
+	if err := sqlscan.ScanAll(&objects, rows); err != nil {
+		return &QueryError{Op: "accessing", Err: err}
+	}
+
+	return writeAggregation(w, s, objectCountColumns, len(objects), func(i int) []interface{} {
+		o := objects[i]
+		return []interface{}{o.Bucket, o.Object, o.Count}
+	}, func(i int) interface{} {
+		return objects[i]
+	})
+}
+
+func (c *DBClient) topObjectsQuery(s *SearchQuery, n int) (string, []interface{}, error) {
+	const topObjectsQuery QTemplate = `SELECT COALESCE(bucket, '') AS bucket,
+                                                  object,
+                                                  COUNT(*) AS count
+                                             FROM %s
+                                            %s
+                                         GROUP BY 1, 2
+                                         ORDER BY count DESC, bucket ASC, object ASC
+                                            LIMIT $%d;`
+
+	if n < 1 || n > maxTopObjects {
+		return "", nil, invalidQueryErrorf("Invalid number of top objects: %d (must be from 1 to %d)", n, maxTopObjects)
+	}
+
+	if err := c.checkAggregatedColumns(s, "bucket", "object"); err != nil {
+		return "", nil, err
+	}
+
+	whereClause, sqlArgs, dollarStart, err := c.reqInfoWhereClause(s, 1)
+	if err != nil {
+		return "", nil, err
+	}
+	const hasObject = "object IS NOT NULL AND object <> ''"
+	if whereClause == "" {
+		whereClause = "WHERE " + hasObject
+	} else {
+		whereClause += " AND " + hasObject
+	}
+	sqlArgs = append(sqlArgs, n)
+
+	return topObjectsQuery.build(c.reqInfoTable().Name, whereClause, dollarStart), sqlArgs, nil
+}
+
+// transferBucketIntervals are the time bucket intervals accepted by
+// BytesTransferred: those of RateOffenders, and days.
+var transferBucketIntervals = append(rateBucketIntervals[:len(rateBucketIntervals):len(rateBucketIntervals)], 24*time.Hour)
+
+// transferRow is a group of a BytesTransferred aggregation, output as a JSON
+// object with the fields in column order.
+type transferRow struct {
+	columns       []parquetColumn
+	key           interface{}
+	requestBytes  uint64
+	responseBytes uint64
+}
+
+func (r transferRow) row() []interface{} {
+	return []interface{}{r.key, r.requestBytes, r.responseBytes}
+}
+
+func (r transferRow) MarshalJSON() ([]byte, error) {
+	return marshalJSONRow(r.columns, r.row())
+}
+
+// BytesTransferred writes to w the total request and response content
+// lengths of the request_info records matching s, either in time buckets of
+// bucketInterval (one of transferBucketIntervals, e.g. an hour), or grouped
+// by the groupBy column (e.g. bucket), in order of bucket or group: exactly
+// one of them must be given. The rows have the bucket_start or group column,
+// followed by the total_request_bytes and total_response_bytes columns. The
+// records without a content length count as 0 bytes. The rows are written in
+// the export format of s, or as a JSON array if it has none; the "count"
+// format writes the number of rows.
+func (c *DBClient) BytesTransferred(ctx context.Context, s *SearchQuery, groupBy string, bucketInterval time.Duration, w io.Writer) error {
+	if err := c.checkOpen(); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Search)
+	defer cancel()
+
+	q, sqlArgs, columns, err := c.bytesTransferredQuery(s, groupBy, bucketInterval)
+	if err != nil {
+		return err
+	}
+	rows, err := c.reader().QueryContext(ctx, q, sqlArgs...)
+	if err != nil {
+		return &QueryError{Op: "querying", Err: err}
+	}
+	defer rows.Close()
+
+	var transfers []transferRow
+	for rows.Next() {
+		var (
+			group                   string
+			bucketStart             time.Time
+			requestSum, responseSum string
+		)
+		key := interface{}(&group)
+		if groupBy == "" {
+			key = &bucketStart
+		}
+		if err := rows.Scan(key, &requestSum, &responseSum); err != nil {
+			return &QueryError{Op: "accessing", Err: err}
+		}
+		r := transferRow{columns: columns, key: group}
+		if groupBy == "" {
+			r.key = s.outputTime(bucketStart)
+		}
+		// The sums are numeric, so as not to overflow in the DB, but
+		// they are output as unsigned 64-bit integers.
+		if r.requestBytes, err = strconv.ParseUint(requestSum, 10, 64); err != nil {
+			return fmt.Errorf("Total request bytes %s out of range, narrow the search (e.g. its time range)", requestSum)
+		}
+		if r.responseBytes, err = strconv.ParseUint(responseSum, 10, 64); err != nil {
+			return fmt.Errorf("Total response bytes %s out of range, narrow the search (e.g. its time range)", responseSum)
+		}
+		transfers = append(transfers, r)
+	}
+	if err := rows.Err(); err != nil {
+		return &QueryError{Op: "accessing", Err: err}
+	}
+
+	return writeAggregation(w, s, columns, len(transfers), func(i int) []interface{} {
+		return transfers[i].row()
+	}, func(i int) interface{} {
+		return transfers[i]
+	})
+}
+
+// bytesTransferredQuery returns the query of BytesTransferred with its
+// arguments and output columns.
+func (c *DBClient) bytesTransferredQuery(s *SearchQuery, groupBy string, bucketInterval time.Duration) (string, []interface{}, []parquetColumn, error) {
+	const bytesTransferredQuery QTemplate = `SELECT %s,
+                                                        SUM(COALESCE(request_content_length, 0)::numeric)::text AS total_request_bytes,
+                                                        SUM(COALESCE(response_content_length, 0)::numeric)::text AS total_response_bytes
+                                                   FROM %s
+                                                  %s
+                                               GROUP BY 1
+                                               ORDER BY 1 ASC;`
+
+	if (groupBy == "") == (bucketInterval == 0) {
+		return "", nil, nil, invalidQueryErrorf("Expected either a group by column or a time bucket interval")
+	}
+	if groupBy != "" && !aggregationColumns[groupBy] {
+		return "", nil, nil, invalidQueryErrorf("Invalid group by column: %s", groupBy)
+	}
+	if bucketInterval != 0 {
+		validInterval := false
+		for _, interval := range transferBucketIntervals {
+			validInterval = validInterval || bucketInterval == interval
+		}
+		if !validInterval {
+			return "", nil, nil, invalidQueryErrorf("Invalid time bucket interval: %s", bucketInterval)
+		}
+	}
+
+	if groupBy != "" {
+		if err := c.checkAggregatedColumns(s, groupBy); err != nil {
+			return "", nil, nil, err
+		}
+	}
+
+	whereClause, sqlArgs, dollarStart, err := c.reqInfoWhereClause(s, 1)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	var key string
+	var columns []parquetColumn
+	if groupBy != "" {
+		key = fmt.Sprintf(`COALESCE(%s::text, '') AS "group"`, groupBy)
+		columns = append(columns, parquetColumn{Name: "group", Type: parquetString})
+	} else {
+		key = fmt.Sprintf("to_timestamp(floor(EXTRACT(EPOCH FROM time) / $%d) * $%d) AS bucket_start", dollarStart, dollarStart)
+		columns = append(columns, parquetColumn{Name: "bucket_start", Type: parquetTimestamp})
+		sqlArgs = append(sqlArgs, int64(bucketInterval/time.Second))
+	}
+	columns = append(columns,
+		parquetColumn{Name: "total_request_bytes", Type: parquetUint64},
+		parquetColumn{Name: "total_response_bytes", Type: parquetUint64},
+	)
+
+	return bytesTransferredQuery.build(key, c.reqInfoTable().Name, whereClause), sqlArgs, columns, nil
+}
+
+// writeAggregation writes the n rows of an aggregation to w in the export
+// format of s, as the values returned by row for the given columns, or else
+// as a JSON array of the values returned by jsonValue. The "count" format
+// writes the number of rows, as `{"count": n}`.
+func writeAggregation(w io.Writer, s *SearchQuery, columns []parquetColumn, n int, row func(i int) []interface{}, jsonValue func(i int) interface{}) error {
+	header := make([]string, len(columns))
+	for j, col := range columns {
+		header[j] = col.Name
+	}
+
+	switch s.ExportFormat {
+	case "":
+		aw := &jsonArrayWriter{w: w}
+		for i := 0; i < n; i++ {
+			v, err := s.jsonValue(jsonValue(i))
+			if err != nil {
+				return err
+			}
+			if err := aw.Write(v); err != nil {
+				return err
+			}
+		}
+		if err := aw.Close(); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return &StreamWriteError{Err: err}
+		}
+		return nil
+
+	case "ndjson":
+		jw := json.NewEncoder(w)
+		for i := 0; i < n; i++ {
+			v, err := s.jsonValue(jsonValue(i))
+			if err != nil {
+				return err
+			}
+			if err := jw.Encode(v); err != nil {
+				return &StreamWriteError{Err: err}
+			}
+		}
+		return nil
+
+	case "csv", "tsv":
+		return writeCSV(w, s.csvOptions(), header, nil, func(cw *csvWriter) error {
+			for i := 0; i < n; i++ {
+				values := row(i)
+				record := make([]string, len(values))
+				for j, v := range values {
+					record[j] = aggregationCSVField(v, s.NullAs)
+				}
+				if err := cw.Write(record); err != nil {
+					return &StreamWriteError{Err: err}
+				}
+			}
+			return nil
+		})
+
+	case "parquet":
+		return writeParquet(w, columns, func(pw *parquetWriter) error {
+			for i := 0; i < n; i++ {
+				if err := pw.Write(row(i)); err != nil {
+					return &StreamWriteError{Err: err}
+				}
+			}
+			return nil
+		})
+
+	case "arrow":
+		return writeArrow(w, columns, func(aw *arrowWriter) error {
+			for i := 0; i < n; i++ {
+				if err := aw.Write(row(i)); err != nil {
+					return &StreamWriteError{Err: err}
+				}
+			}
+			return nil
+		})
+
+	case "xlsx":
+		if n > xlsxMaxRows-1 {
+			return invalidQueryErrorf("%d rows, more than the %d records of an xlsx export", n, xlsxMaxRows-1)
+		}
+		return writeXLSX(w, header, func(xw *xlsxWriter) error {
+			for i := 0; i < n; i++ {
+				if err := xw.Write(row(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+	case "count":
+		out := struct {
+			Count int64 `json:"count"`
+		}{int64(n)}
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			return &StreamWriteError{Err: err}
+		}
+		return nil
+	}
+	return invalidQueryErrorf("Unsupported export format: %s", s.ExportFormat)
+}
+
+// aggregationCSVField formats a value of an aggregation as a CSV field, with
+// nil values formatted as null.
+func aggregationCSVField(v interface{}, null string) string {
+	switch x := v.(type) {
+	case nil:
+		return null
+	case string:
+		return x
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	case int:
+		return strconv.Itoa(x)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case uint64:
+		return strconv.FormatUint(x, 10)
+	}
+	return fmt.Sprint(v)
+}
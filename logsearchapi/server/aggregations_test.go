@@ -0,0 +1,919 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setTestAccessKey sets the Authorization header of a test event, from
+// which its access key is parsed.
+func setTestAccessKey(ev map[string]interface{}, accessKey string) {
+	ev["requestHeader"] = map[string]string{
+		"Authorization": "AWS4-HMAC-SHA256 Credential=" + accessKey + "/20220101/us-east-1/s3/aws4_request",
+	}
+}
+
+func TestAuthBreakdown(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		ev := newTestEvent(now, bucket)
+		setTestAccessKey(ev, "minio")
+		insertTestEventMap(t, c, ev)
+	}
+	// Events without an Authorization header are stored with an empty
+	// access key.
+	for i := 0; i < 2; i++ {
+		insertTestEvent(t, c, now, bucket)
+	}
+	// Records predating the access_key column have a NULL access key.
+	ev := newTestEvent(now, bucket)
+	insertTestEventMap(t, c, ev)
+	const nullAccessKey QTemplate = `UPDATE %s SET access_key = NULL WHERE request_id = $1;`
+	if _, err := c.ExecContext(ctx, nullAccessKey.build(requestInfoTable.Name), ev["requestID"]); err != nil {
+		t.Fatal(err)
+	}
+
+	sq := SearchQuery{
+		Query:   reqInfoQ,
+		FParams: map[fParam][]string{"bucket": {bucket}},
+	}
+	authenticated, anonymous, err := c.AuthBreakdown(ctx, &sq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authenticated != 3 || anonymous != 3 {
+		t.Errorf("Expected 3 authenticated and 3 anonymous requests, got %d and %d", authenticated, anonymous)
+	}
+}
+
+func TestCountByGroup(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	now := time.Now()
+	seed := map[string]int{"GetObject": 5, "PutObject": 3, "HeadObject": 1}
+	for api, n := range seed {
+		for i := 0; i < n; i++ {
+			ev := newTestEvent(now, bucket)
+			ev["api"].(map[string]interface{})["name"] = api
+			insertTestEventMap(t, c, ev)
+		}
+	}
+
+	sq := SearchQuery{
+		Query:   reqInfoQ,
+		FParams: map[fParam][]string{"bucket": {bucket}},
+	}
+	testCases := []struct {
+		minCount int64
+		expected []GroupCount
+	}{
+		{0, []GroupCount{{"GetObject", 5}, {"PutObject", 3}, {"HeadObject", 1}}},
+		{3, []GroupCount{{"GetObject", 5}, {"PutObject", 3}}},
+		{4, []GroupCount{{"GetObject", 5}}},
+		{6, []GroupCount{}},
+	}
+	for _, testCase := range testCases {
+		groups, err := c.CountByGroup(ctx, &sq, "api_name", testCase.minCount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(groups, testCase.expected) {
+			t.Errorf("minCount %d: got %v, expected %v", testCase.minCount, groups, testCase.expected)
+		}
+	}
+}
+
+func TestCountByResponseStatus(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	now := time.Now()
+	seed := map[string]int{"NoSuchKey": 3, "AccessDenied": 2, "": 1}
+	for status, n := range seed {
+		for i := 0; i < n; i++ {
+			ev := newTestEvent(now, bucket)
+			ev["api"].(map[string]interface{})["status"] = status
+			insertTestEventMap(t, c, ev)
+		}
+	}
+	// A NULL status is grouped with the empty ones.
+	q := fmt.Sprintf("INSERT INTO %s (time, api_name, bucket) VALUES ($1, 'GetObject', $2)", c.reqInfoTable().Name)
+	if _, err := c.ExecContext(ctx, q, now, bucket); err != nil {
+		t.Fatal(err)
+	}
+
+	sq := SearchQuery{
+		Query:   reqInfoQ,
+		FParams: map[fParam][]string{"bucket": {bucket}},
+	}
+	groups, err := c.CountByGroup(ctx, &sq, "response_status", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []GroupCount{{"NoSuchKey", 3}, {"", 2}, {"AccessDenied", 2}}; !reflect.DeepEqual(groups, expected) {
+		t.Errorf("got %v, expected %v", groups, expected)
+	}
+
+	counts, err := c.CountByColumns(ctx, &sq, []string{"api_name", "response_status"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (GroupsCount{Groups: []string{"PutObject", "NoSuchKey"}, Count: 3}); len(counts) == 0 || !reflect.DeepEqual(counts[0], expected) {
+		t.Errorf("got %v, expected %v first", counts, expected)
+	}
+
+	values, err := c.DistinctValues(ctx, "response_status", &sq, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"AccessDenied", "NoSuchKey"}; !reflect.DeepEqual(values, expected) {
+		t.Errorf("got distinct values %v, expected %v", values, expected)
+	}
+}
+
+func TestCountByColumnsQuery(t *testing.T) {
+	c := &DBClient{}
+	sq := SearchQuery{
+		Query:   reqInfoQ,
+		FParams: map[fParam][]string{"bucket": {"photos"}},
+	}
+
+	q, args, err := c.countByColumnsQuery(&sq, []string{"bucket", "response_status_code"}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "SELECT COALESCE(bucket::text, '') AS bucket, " +
+		"COALESCE(response_status_code::text, '') AS response_status_code, COUNT(*) AS count " +
+		"FROM request_info WHERE bucket = $1 GROUP BY 1, 2 HAVING COUNT(*) >= $2 " +
+		"ORDER BY count DESC, 1 ASC, 2 ASC;"
+	if strings.Join(strings.Fields(q), " ") != expected {
+		t.Errorf("got %q, expected %q", q, expected)
+	}
+	if expected := []interface{}{"photos", int64(5)}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+
+	// A minimum count of 1 or less drops no groups.
+	q, args, err = c.countByColumnsQuery(&sq, []string{"api_name"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(q, "HAVING") || len(args) != 1 {
+		t.Errorf("Expected no HAVING clause in %q with args %v", q, args)
+	}
+
+	invalid := [][]string{
+		nil,
+		{"bucket", "time"},
+		{""},
+		{"time"},
+		{"api_name; DROP TABLE request_info"},
+		{operationCategoryGroup},
+		{"bucket", "bucket"},
+		{"bucket", "object", "api_name", "access_key"},
+	}
+	for _, groupBy := range invalid {
+		if _, _, err := c.countByColumnsQuery(&sq, groupBy, 0); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%q: got %v, expected an invalid query error", groupBy, err)
+		}
+	}
+}
+
+func TestCountByColumns(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	now := time.Now()
+	seed := []struct {
+		api    string
+		status int
+		n      int
+	}{
+		{"GetObject", 200, 4},
+		{"GetObject", 404, 2},
+		{"PutObject", 200, 2},
+		{"PutObject", 503, 1},
+	}
+	for _, group := range seed {
+		for i := 0; i < group.n; i++ {
+			ev := newTestEvent(now, bucket)
+			api := ev["api"].(map[string]interface{})
+			api["name"] = group.api
+			api["statusCode"] = group.status
+			insertTestEventMap(t, c, ev)
+		}
+	}
+
+	sq := SearchQuery{
+		Query:   reqInfoQ,
+		FParams: bucketFilter(reqInfoQ, bucket),
+	}
+	counts, err := c.CountByColumns(ctx, &sq, []string{"api_name", "response_status_code"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ties are ordered by group, and the groups with fewer than 2 records
+	// are left out.
+	expected := []GroupsCount{
+		{Groups: []string{"GetObject", "200"}, Count: 4},
+		{Groups: []string{"GetObject", "404"}, Count: 2},
+		{Groups: []string{"PutObject", "200"}, Count: 2},
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("got %v, expected %v", counts, expected)
+	}
+
+	counts, err = c.CountByColumns(ctx, &sq, []string{"bucket", "api_name"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []GroupsCount{
+		{Groups: []string{bucket, "GetObject"}, Count: 6},
+		{Groups: []string{bucket, "PutObject"}, Count: 3},
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("got %v, expected %v", counts, expected)
+	}
+}
+
+func TestDistinctValuesQuery(t *testing.T) {
+	c := &DBClient{}
+
+	q, args, err := c.distinctValuesQuery("bucket", &SearchQuery{Query: reqInfoQ}, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(q, "WHERE bucket <> ''") || !strings.Contains(q, "LIMIT $1") {
+		t.Errorf("Unexpected query %q", q)
+	}
+	if expected := []interface{}{20}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+
+	sq := SearchQuery{
+		Query:   reqInfoQ,
+		FParams: map[fParam][]string{"api_name": {"Put*"}},
+	}
+	q, args, err = c.distinctValuesQuery("bucket", &sq, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(q, "WHERE api_name LIKE $1 AND bucket <> ''") || !strings.Contains(q, "LIMIT $2") {
+		t.Errorf("Unexpected query %q", q)
+	}
+	if expected := []interface{}{"Put%", 20}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+
+	for _, column := range []string{"", "time", "response_status_code", "bucket; DROP TABLE request_info"} {
+		if _, _, err := c.distinctValuesQuery(column, &sq, 20); err == nil {
+			t.Errorf("Expected an error for column %q", column)
+		}
+	}
+	if _, _, err := c.distinctValuesQuery("bucket", &sq, 0); err == nil {
+		t.Errorf("Expected an error for a zero limit")
+	}
+}
+
+func TestDistinctValues(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	now := time.Now()
+	for _, api := range []string{"PutObject", "GetObject", "PutObject", "HeadObject"} {
+		ev := newTestEvent(now, bucket)
+		ev["api"].(map[string]interface{})["name"] = api
+		insertTestEventMap(t, c, ev)
+	}
+
+	sq := SearchQuery{
+		Query:   reqInfoQ,
+		FParams: map[fParam][]string{"bucket": {bucket}},
+	}
+	testCases := []struct {
+		limit    int
+		expected []string
+	}{
+		{10, []string{"GetObject", "HeadObject", "PutObject"}},
+		{2, []string{"GetObject", "HeadObject"}},
+	}
+	for _, testCase := range testCases {
+		values, err := c.DistinctValues(ctx, "api_name", &sq, testCase.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(values, testCase.expected) {
+			t.Errorf("limit %d: got %v, expected %v", testCase.limit, values, testCase.expected)
+		}
+	}
+}
+
+func TestCountDistinctQuery(t *testing.T) {
+	c := &DBClient{}
+
+	sq := SearchQuery{
+		Query:   reqInfoQ,
+		FParams: map[fParam][]string{"api_name": {"Put*"}},
+	}
+	q, args, err := c.countDistinctQuery("request_id", &sq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "SELECT COUNT(DISTINCT NULLIF(request_id, '')) FROM request_info WHERE api_name LIKE $1;"; strings.Join(strings.Fields(q), " ") != expected {
+		t.Errorf("got %q, expected %q", q, expected)
+	}
+	if expected := []interface{}{"Put%"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+
+	for _, column := range []string{"", "time", "request_id) FROM request_info; --"} {
+		_, _, err := c.countDistinctQuery(column, &sq)
+		var colErr *ColumnError
+		if !errors.As(err, &colErr) || colErr.Column != column || !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("column %q: got %v, expected a column error", column, err)
+		}
+	}
+}
+
+func TestCountDistinct(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	now := time.Now()
+	// A request may be logged more than once, with the same request ID.
+	for _, requestID := range []string{"16D8B3E5F0A1B001", "16D8B3E5F0A1B001", "16D8B3E5F0A1B002", "16D8B3E5F0A1B001", ""} {
+		ev := newTestEvent(now, bucket)
+		ev["requestID"] = requestID
+		insertTestEventMap(t, c, ev)
+	}
+
+	sq := SearchQuery{
+		Query:   reqInfoQ,
+		FParams: map[fParam][]string{"bucket": {bucket}},
+	}
+	testCases := []struct {
+		column   string
+		expected int64
+	}{
+		{"request_id", 2},
+		{"bucket", 1},
+		{"api_name", 1},
+	}
+	for _, testCase := range testCases {
+		count, err := c.CountDistinct(ctx, testCase.column, &sq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != testCase.expected {
+			t.Errorf("%s: got %d, expected %d", testCase.column, count, testCase.expected)
+		}
+	}
+}
+
+func TestMedianRequestGaps(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	start := time.Now().Add(-time.Hour)
+	// A steady client requesting every 10s, and a bursty one making a few
+	// requests a second apart, with long pauses in between.
+	seed := map[string][]time.Duration{
+		"steady": {0, 10 * time.Second, 20 * time.Second, 30 * time.Second, 40 * time.Second},
+		"bursty": {0, time.Second, 2 * time.Second, 10 * time.Minute, 10*time.Minute + time.Second, 30 * time.Minute},
+		"single": {0},
+	}
+	for accessKey, offsets := range seed {
+		for _, offset := range offsets {
+			ev := newTestEvent(start.Add(offset), bucket)
+			setTestAccessKey(ev, accessKey)
+			insertTestEventMap(t, c, ev)
+		}
+	}
+	// Anonymous requests are left out.
+	insertTestEvent(t, c, start, bucket)
+	insertTestEvent(t, c, start.Add(time.Minute), bucket)
+
+	sq := SearchQuery{
+		Query:   reqInfoQ,
+		FParams: map[fParam][]string{"bucket": {bucket}},
+	}
+	gaps, err := c.MedianRequestGaps(ctx, &sq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The bursty gaps are [1s, 1s, ~10m, 1s, ~20m].
+	expected := []RequestGap{
+		{AccessKey: "bursty", Requests: 6, MedianGap: time.Second},
+		{AccessKey: "steady", Requests: 5, MedianGap: 10 * time.Second},
+	}
+	if !reflect.DeepEqual(gaps, expected) {
+		t.Errorf("got %v, expected %v", gaps, expected)
+	}
+}
+
+func TestRateOffendersQuery(t *testing.T) {
+	c := &DBClient{}
+
+	sq := SearchQuery{
+		Query:   reqInfoQ,
+		FParams: map[fParam][]string{"bucket": {"photos"}},
+	}
+	q, args, err := c.rateOffendersQuery(&sq, time.Minute, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "SELECT access_key, to_timestamp(floor(EXTRACT(EPOCH FROM time) / $2) * $2) AS bucket_start, COUNT(*) AS count " +
+		"FROM request_info WHERE bucket = $1 AND access_key IS NOT NULL AND access_key <> '' " +
+		"GROUP BY 1, 2 HAVING COUNT(*) > $3 ORDER BY bucket_start ASC, count DESC, access_key ASC;"
+	if strings.Join(strings.Fields(q), " ") != expected {
+		t.Errorf("got %q, expected %q", q, expected)
+	}
+	if expected := []interface{}{"photos", int64(60), 100}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+
+	for _, interval := range []time.Duration{0, time.Millisecond, 7 * time.Second, 24 * time.Hour} {
+		if _, _, err := c.rateOffendersQuery(&sq, interval, 100); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("interval %s: got %v, expected an invalid query error", interval, err)
+		}
+	}
+	if _, _, err := c.rateOffendersQuery(&sq, time.Minute, -1); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got %v, expected an invalid query error", err)
+	}
+}
+
+func TestTopObjectsQuery(t *testing.T) {
+	c := &DBClient{}
+
+	sq := SearchQuery{
+		Query:   reqInfoQ,
+		FParams: map[fParam][]string{"bucket": {"photos"}},
+	}
+	q, args, err := c.topObjectsQuery(&sq, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "SELECT COALESCE(bucket, '') AS bucket, object, COUNT(*) AS count " +
+		"FROM request_info WHERE bucket = $1 AND object IS NOT NULL AND object <> '' " +
+		"GROUP BY 1, 2 ORDER BY count DESC, bucket ASC, object ASC LIMIT $2;"
+	if strings.Join(strings.Fields(q), " ") != expected {
+		t.Errorf("got %q, expected %q", q, expected)
+	}
+	if expected := []interface{}{"photos", 10}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+
+	for _, n := range []int{0, -1, maxTopObjects + 1} {
+		if _, _, err := c.topObjectsQuery(&sq, n); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("n %d: got %v, expected an invalid query error", n, err)
+		}
+	}
+}
+
+func TestLatencyPercentilesQuery(t *testing.T) {
+	c := &DBClient{}
+
+	sq := SearchQuery{
+		Query:   reqInfoQ,
+		FParams: map[fParam][]string{"bucket": {"photos"}},
+	}
+	q, args, columns, err := c.latencyPercentilesQuery(&sq, "api_name", []float64{0.5, 0.95, 0.999})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `SELECT COALESCE(api_name::text, '') AS "group", ` +
+		"round(percentile_cont($2::float8) WITHIN GROUP (ORDER BY time_to_response_ns::float8))::int8 AS p50_ns, " +
+		"round(percentile_cont($3::float8) WITHIN GROUP (ORDER BY time_to_response_ns::float8))::int8 AS p95_ns, " +
+		"round(percentile_cont($4::float8) WITHIN GROUP (ORDER BY time_to_response_ns::float8))::int8 AS p99_9_ns " +
+		"FROM request_info WHERE bucket = $1 GROUP BY 1 ORDER BY 1 ASC;"
+	if strings.Join(strings.Fields(q), " ") != expected {
+		t.Errorf("got %q, expected %q", q, expected)
+	}
+	if expected := []interface{}{"photos", 0.5, 0.95, 0.999}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+	var names []string
+	for _, col := range columns {
+		names = append(names, col.Name)
+	}
+	if expected := []string{"group", "p50_ns", "p95_ns", "p99_9_ns"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("got columns %v, expected %v", names, expected)
+	}
+
+	invalid := []struct {
+		groupBy     string
+		percentiles []float64
+	}{
+		{"time", []float64{0.5}},
+		{"api_name; DROP TABLE request_info", []float64{0.5}},
+		{operationCategoryGroup, []float64{0.5}},
+		{"api_name", nil},
+		{"api_name", []float64{-0.1}},
+		{"api_name", []float64{1.5}},
+		{"api_name", []float64{math.NaN()}},
+		{"api_name", []float64{0.5, 0.5}},
+		{"api_name", make([]float64, maxLatencyPercentiles+1)},
+	}
+	for _, testCase := range invalid {
+		if _, _, _, err := c.latencyPercentilesQuery(&sq, testCase.groupBy, testCase.percentiles); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%q %v: got %v, expected an invalid query error", testCase.groupBy, testCase.percentiles, err)
+		}
+	}
+}
+
+func TestBytesTransferredQuery(t *testing.T) {
+	c := &DBClient{}
+
+	sq := SearchQuery{
+		Query:   reqInfoQ,
+		FParams: map[fParam][]string{"bucket": {"photos"}},
+	}
+	q, args, columns, err := c.bytesTransferredQuery(&sq, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "SELECT to_timestamp(floor(EXTRACT(EPOCH FROM time) / $2) * $2) AS bucket_start, " +
+		"SUM(COALESCE(request_content_length, 0)::numeric)::text AS total_request_bytes, " +
+		"SUM(COALESCE(response_content_length, 0)::numeric)::text AS total_response_bytes " +
+		"FROM request_info WHERE bucket = $1 GROUP BY 1 ORDER BY 1 ASC;"
+	if strings.Join(strings.Fields(q), " ") != expected {
+		t.Errorf("got %q, expected %q", q, expected)
+	}
+	if expected := []interface{}{"photos", int64(3600)}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+	if columns[0].Name != "bucket_start" || columns[0].Type != parquetTimestamp {
+		t.Errorf("got key column %+v, expected bucket_start", columns[0])
+	}
+
+	q, args, columns, err = c.bytesTransferredQuery(&sq, "access_key", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix := `SELECT COALESCE(access_key::text, '') AS "group", `; !strings.HasPrefix(strings.Join(strings.Fields(q), " "), prefix) {
+		t.Errorf("got %q, expected it to start with %q", q, prefix)
+	}
+	if expected := []interface{}{"photos"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+	var names []string
+	for _, col := range columns {
+		names = append(names, col.Name)
+	}
+	if expected := []string{"group", "total_request_bytes", "total_response_bytes"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("got columns %v, expected %v", names, expected)
+	}
+
+	invalid := []struct {
+		groupBy        string
+		bucketInterval time.Duration
+	}{
+		{"", 0},
+		{"bucket", time.Hour},
+		{"time", 0},
+		{"bucket; DROP TABLE request_info", 0},
+		{"", 7 * time.Minute},
+		{"", -time.Hour},
+	}
+	for _, testCase := range invalid {
+		if _, _, _, err := c.bytesTransferredQuery(&sq, testCase.groupBy, testCase.bucketInterval); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%q %s: got %v, expected an invalid query error", testCase.groupBy, testCase.bucketInterval, err)
+		}
+	}
+}
+
+func TestLatencyRow(t *testing.T) {
+	columns := []parquetColumn{
+		{Name: "group", Type: parquetString},
+		{Name: "p99_ns", Type: parquetInt64, Optional: true},
+		{Name: "p50_ns", Type: parquetInt64, Optional: true},
+	}
+	rows := []latencyRow{
+		{group: "GetObject", columns: columns, values: []sql.NullInt64{{Int64: 900, Valid: true}, {Int64: 100, Valid: true}}},
+		{group: "PutObject", columns: columns, values: []sql.NullInt64{{}, {}}},
+	}
+	testCases := []struct {
+		format   string
+		expected string
+	}{
+		// The percentiles keep their order in JSON objects.
+		{"ndjson", `{"group":"GetObject","p99_ns":900,"p50_ns":100}` + "\n" + `{"group":"PutObject","p99_ns":null,"p50_ns":null}` + "\n"},
+		{"csv", "group,p99_ns,p50_ns\nGetObject,900,100\nPutObject,,\n"},
+	}
+	for _, testCase := range testCases {
+		var buf bytes.Buffer
+		sq := SearchQuery{Query: reqInfoQ, ExportFormat: testCase.format}
+		err := writeAggregation(&buf, &sq, columns, len(rows), func(i int) []interface{} {
+			return rows[i].row()
+		}, func(i int) interface{} {
+			return rows[i]
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", testCase.format, err)
+		}
+		if buf.String() != testCase.expected {
+			t.Errorf("%s: got %q, expected %q", testCase.format, buf.String(), testCase.expected)
+		}
+	}
+}
+
+func TestWriteAggregation(t *testing.T) {
+	bucketStart := time.Date(2022, time.March, 7, 1, 2, 0, 0, time.UTC)
+	offenders := []RateOffender{
+		{AccessKey: "minio", BucketStart: bucketStart, Count: 120},
+		{AccessKey: "backup", BucketStart: bucketStart, Count: 101},
+	}
+	row := func(i int) []interface{} {
+		o := offenders[i]
+		return []interface{}{o.AccessKey, o.BucketStart, o.Count}
+	}
+	jsonValue := func(i int) interface{} {
+		return offenders[i]
+	}
+
+	testCases := []struct {
+		format   string
+		expected string
+	}{
+		{"", `[{"access_key":"minio","bucket_start":"2022-03-07T01:02:00Z","count":120},{"access_key":"backup","bucket_start":"2022-03-07T01:02:00Z","count":101}]` + "\n"},
+		{"ndjson", `{"access_key":"minio","bucket_start":"2022-03-07T01:02:00Z","count":120}` + "\n" + `{"access_key":"backup","bucket_start":"2022-03-07T01:02:00Z","count":101}` + "\n"},
+		{"csv", "access_key,bucket_start,count\nminio,2022-03-07T01:02:00Z,120\nbackup,2022-03-07T01:02:00Z,101\n"},
+		{"tsv", "access_key\tbucket_start\tcount\nminio\t2022-03-07T01:02:00Z\t120\nbackup\t2022-03-07T01:02:00Z\t101\n"},
+		{"count", `{"count":2}` + "\n"},
+	}
+	for _, testCase := range testCases {
+		var buf bytes.Buffer
+		sq := SearchQuery{Query: reqInfoQ, ExportFormat: testCase.format}
+		if err := writeAggregation(&buf, &sq, rateOffenderColumns, len(offenders), row, jsonValue); err != nil {
+			t.Fatalf("%q: %v", testCase.format, err)
+		}
+		if buf.String() != testCase.expected {
+			t.Errorf("%q: got %q, expected %q", testCase.format, buf.String(), testCase.expected)
+		}
+	}
+
+	// The binary formats are written with the columns of the rows.
+	for _, format := range []string{"parquet", "arrow", "xlsx"} {
+		var buf bytes.Buffer
+		sq := SearchQuery{Query: reqInfoQ, ExportFormat: format}
+		if err := writeAggregation(&buf, &sq, rateOffenderColumns, len(offenders), row, jsonValue); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if buf.Len() == 0 {
+			t.Errorf("%s: nothing written", format)
+		}
+		if format == "arrow" {
+			msgs := readArrowStream(t, buf.Bytes())
+			if n := msgs[1].meta.int64Field(msgs[1].header, 0); n != 2 {
+				t.Errorf("got %d rows, expected 2", n)
+			}
+		}
+	}
+}
+
+func TestRateOffenders(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	minute := time.Now().UTC().Truncate(time.Hour).Add(-2*time.Hour + 10*time.Minute)
+	requests := []struct {
+		accessKey string
+		count     int
+		at        time.Time
+	}{
+		// Only minio makes more than 3 requests in a minute.
+		{"minio", 4, minute},
+		{"minio", 3, minute.Add(time.Minute)},
+		{"backup", 3, minute},
+		// Anonymous requests are left out.
+		{"", 5, minute},
+	}
+	for _, r := range requests {
+		for i := 0; i < r.count; i++ {
+			ev := newTestEvent(r.at.Add(time.Duration(i)*time.Second), bucket)
+			if r.accessKey != "" {
+				setTestAccessKey(ev, r.accessKey)
+			}
+			insertTestEventMap(t, c, ev)
+		}
+	}
+
+	sq := SearchQuery{
+		Query:        reqInfoQ,
+		FParams:      map[fParam][]string{"bucket": {bucket}},
+		ExportFormat: "ndjson",
+	}
+	var buf bytes.Buffer
+	if err := c.RateOffenders(ctx, &sq, time.Minute, 3, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var offender RateOffender
+	if err := json.Unmarshal(buf.Bytes(), &offender); err != nil {
+		t.Fatalf("got %q: %v", buf.String(), err)
+	}
+	expected := RateOffender{AccessKey: "minio", BucketStart: minute, Count: 4}
+	if offender.AccessKey != expected.AccessKey || !offender.BucketStart.Equal(expected.BucketStart) || offender.Count != expected.Count {
+		t.Errorf("got %+v, expected %+v", offender, expected)
+	}
+
+	// With a larger interval, both minutes fall in the same bucket.
+	sq.ExportFormat = "count"
+	buf.Reset()
+	if err := c.RateOffenders(ctx, &sq, time.Hour, 6, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != `{"count":1}`+"\n" {
+		t.Errorf("got %q, expected one offender", buf.String())
+	}
+}
+
+func TestTopObjects(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	now := time.Now()
+	for object, count := range map[string]int{"hot": 5, "warm": 3, "cool": 3, "cold": 1, "": 6} {
+		for i := 0; i < count; i++ {
+			ev := newTestEvent(now.Add(time.Duration(i)*time.Millisecond), bucket)
+			ev["api"].(map[string]interface{})["object"] = object
+			insertTestEventMap(t, c, ev)
+		}
+	}
+
+	sq := SearchQuery{Query: reqInfoQ, FParams: bucketFilter(reqInfoQ, bucket)}
+	var buf bytes.Buffer
+	if err := c.TopObjects(ctx, &sq, 3, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var objects []ObjectCount
+	if err := json.Unmarshal(buf.Bytes(), &objects); err != nil {
+		t.Fatalf("got %q: %v", buf.String(), err)
+	}
+	// Ties are ordered by name, and the records without an object are
+	// left out.
+	expected := []ObjectCount{
+		{Bucket: bucket, Object: "hot", Count: 5},
+		{Bucket: bucket, Object: "cool", Count: 3},
+		{Bucket: bucket, Object: "warm", Count: 3},
+	}
+	if !reflect.DeepEqual(objects, expected) {
+		t.Errorf("got %+v, expected %+v", objects, expected)
+	}
+
+	sq.ExportFormat = "csv"
+	buf.Reset()
+	if err := c.TopObjects(ctx, &sq, 1, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "bucket,object,count\n" + bucket + ",hot,5\n"; buf.String() != expected {
+		t.Errorf("got %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	now := time.Now()
+	// GetObject takes 1 to 100µs, PutObject always 1ms.
+	for i := 1; i <= 100; i++ {
+		ev := newTestEvent(now, bucket)
+		api := ev["api"].(map[string]interface{})
+		api["name"] = "GetObject"
+		api["timeToResponse"] = fmt.Sprintf("%dns", i*1000)
+		insertTestEventMap(t, c, ev)
+	}
+	for i := 0; i < 3; i++ {
+		ev := newTestEvent(now, bucket)
+		ev["api"].(map[string]interface{})["timeToResponse"] = "1000000ns"
+		insertTestEventMap(t, c, ev)
+	}
+
+	sq := SearchQuery{
+		Query:        reqInfoQ,
+		FParams:      bucketFilter(reqInfoQ, bucket),
+		ExportFormat: "ndjson",
+	}
+	var buf bytes.Buffer
+	if err := c.LatencyPercentiles(ctx, &sq, "api_name", []float64{0, 0.5, 0.99}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"group":"GetObject","p0_ns":1000,"p50_ns":50500,"p99_ns":99010}` + "\n" +
+		`{"group":"PutObject","p0_ns":1000000,"p50_ns":1000000,"p99_ns":1000000}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("got %q, expected %q", buf.String(), expected)
+	}
+
+	sq.ExportFormat = "count"
+	buf.Reset()
+	if err := c.LatencyPercentiles(ctx, &sq, "bucket", []float64{0.95}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != `{"count":1}`+"\n" {
+		t.Errorf("got %q, expected one group", buf.String())
+	}
+}
+
+func TestBytesTransferred(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	hour := time.Now().Add(-2 * time.Hour).Truncate(time.Hour)
+	// The sum of the large request lengths exceeds the maximum INT8.
+	const large = "4000000000000000000"
+	for i, lengths := range []struct {
+		request, response string
+	}{
+		{large, "10"},
+		{large, ""},
+		{"", ""},
+		{large, "5"},
+	} {
+		ev := newTestEvent(hour.Add(time.Duration(i)*20*time.Minute), bucket)
+		if lengths.request != "" {
+			ev["requestHeader"] = map[string]string{"Content-Length": lengths.request}
+		}
+		if lengths.response != "" {
+			ev["responseHeader"] = map[string]string{"Content-Length": lengths.response}
+		}
+		insertTestEventMap(t, c, ev)
+	}
+
+	sq := SearchQuery{
+		Query:        reqInfoQ,
+		FParams:      bucketFilter(reqInfoQ, bucket),
+		ExportFormat: "ndjson",
+	}
+	var buf bytes.Buffer
+	if err := c.BytesTransferred(ctx, &sq, "bucket", 0, &buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf(`{"group":%q,"total_request_bytes":12000000000000000000,"total_response_bytes":15}`, bucket) + "\n"
+	if buf.String() != expected {
+		t.Errorf("got %q, expected %q", buf.String(), expected)
+	}
+
+	sq.ExportFormat = "csv"
+	sq.DisplayTimeZone = "UTC"
+	buf.Reset()
+	if err := c.BytesTransferred(ctx, &sq, "", time.Hour, &buf); err != nil {
+		t.Fatal(err)
+	}
+	// The records without content lengths count as 0 bytes.
+	expected = "bucket_start,total_request_bytes,total_response_bytes\n" +
+		hour.UTC().Format(time.RFC3339Nano) + ",8000000000000000000,10\n" +
+		hour.Add(time.Hour).UTC().Format(time.RFC3339Nano) + ",4000000000000000000,5\n"
+	if buf.String() != expected {
+		t.Errorf("got %q, expected %q", buf.String(), expected)
+	}
+
+	// Sums beyond the range of the output are rejected.
+	for i := 0; i < 2; i++ {
+		ev := newTestEvent(hour, bucket)
+		ev["requestHeader"] = map[string]string{"Content-Length": large}
+		insertTestEventMap(t, c, ev)
+	}
+	if err := c.BytesTransferred(ctx, &sq, "bucket", 0, &buf); err == nil {
+		t.Errorf("expected an error for total request bytes beyond the maximum uint64")
+	}
+}
@@ -0,0 +1,522 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// This file implements a minimal writer of the Apache Arrow IPC streaming
+// format, for the flat schemas of search results. The columns are described
+// like those of parquet exports; strings and JSON documents are output as
+// utf8 columns, integers as int64 columns and times as UTC timestamps with
+// microsecond precision. Buffers are not compressed.
+
+const (
+	// arrowBatchSize is the number of rows buffered in memory before they
+	// are written out as a record batch.
+	arrowBatchSize = 10000
+	// arrowBatchMaxBytes is the size of the buffered values above which a
+	// record batch is written out before arrowBatchSize rows are buffered,
+	// to bound the memory used for large logs.
+	arrowBatchMaxBytes = 64 << 20
+)
+
+// Arrow metadata enum values, as defined in Schema.fbs and Message.fbs.
+const (
+	arrowMetadataV5 = 4
+
+	arrowHeaderSchema      = 1
+	arrowHeaderRecordBatch = 3
+
+	arrowTypeInt       = 2
+	arrowTypeUtf8      = 5
+	arrowTypeTimestamp = 10
+
+	arrowEndiannessLittle    = 0
+	arrowTimeUnitMicrosecond = 2
+)
+
+// arrowContinuation precedes the length of each message of a stream.
+const arrowContinuation = 0xffffffff
+
+func arrowIsUtf8(col parquetColumn) bool {
+	return col.Type == parquetString || col.Type == parquetJSON
+}
+
+// arrowType returns the type of the arrow field of col and the table
+// describing it.
+func arrowType(col parquetColumn) (byte, *fbTable) {
+	switch col.Type {
+	case parquetString, parquetJSON:
+		return arrowTypeUtf8, &fbTable{}
+	case parquetTimestamp:
+		return arrowTypeTimestamp, &fbTable{fields: []fbField{
+			fbInt16(arrowTimeUnitMicrosecond),
+			fbChild(fbString("UTC")),
+		}}
+	default:
+		return arrowTypeInt, &fbTable{fields: []fbField{
+			fbInt32(64),
+			fbBool(true),
+		}}
+	}
+}
+
+// arrowColumnBuffer holds the values of a column of the record batch being
+// written.
+type arrowColumnBuffer struct {
+	// present holds whether each value is not nil. It is used only for
+	// optional columns.
+	present   []bool
+	nullCount int64
+	// offsets holds the offsets of the values of utf8 columns in values.
+	offsets []int32
+	// values holds the values; nil values take the space of a zero value.
+	values bytes.Buffer
+}
+
+// arrowWriter writes rows to an io.Writer in the Arrow IPC streaming format.
+// Rows are buffered and written out in record batches; Close must be called
+// to write out the remaining rows and the end of the stream.
+type arrowWriter struct {
+	w       io.Writer
+	columns []parquetColumn
+
+	buffers []arrowColumnBuffer
+	numRows int64
+	closed  bool
+}
+
+func newArrowWriter(w io.Writer, columns []parquetColumn) (*arrowWriter, error) {
+	aw := &arrowWriter{
+		w:       w,
+		columns: columns,
+		buffers: make([]arrowColumnBuffer, len(columns)),
+	}
+	aw.resetBuffers()
+
+	fields := make(fbTableVector, len(columns))
+	for i, col := range columns {
+		typeType, typ := arrowType(col)
+		fields[i] = &fbTable{fields: []fbField{
+			fbChild(fbString(col.Name)),
+			fbBool(col.Optional),
+			fbUint8(typeType),
+			fbChild(typ),
+			{},
+			// Readers expect the children of the field, even if there are
+			// none.
+			fbChild(fbTableVector{}),
+		}}
+	}
+	schema := &fbTable{fields: []fbField{
+		fbInt16(arrowEndiannessLittle),
+		fbChild(fields),
+	}}
+	if err := aw.writeMessage(arrowHeaderSchema, schema, nil); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+func (aw *arrowWriter) resetBuffers() {
+	for i, col := range aw.columns {
+		buf := &aw.buffers[i]
+		buf.present = buf.present[:0]
+		buf.nullCount = 0
+		buf.values.Reset()
+		if arrowIsUtf8(col) {
+			buf.offsets = append(buf.offsets[:0], 0)
+		}
+	}
+}
+
+// writeMessage writes an encapsulated message with the given header and
+// body, which must be padded to a multiple of 8 bytes.
+func (aw *arrowWriter) writeMessage(headerType byte, header *fbTable, body []byte) error {
+	meta := encodeFlatbuffer(&fbTable{fields: []fbField{
+		fbInt16(arrowMetadataV5),
+		fbUint8(headerType),
+		fbChild(header),
+		fbInt64(int64(len(body))),
+	}})
+	var prefix [8]byte
+	binary.LittleEndian.PutUint32(prefix[:4], arrowContinuation)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(meta)))
+	for _, p := range [][]byte{prefix[:], meta, body} {
+		if _, err := aw.w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write buffers a row, holding a value for each column, and writes out a
+// record batch when enough rows are buffered.
+func (aw *arrowWriter) Write(row []interface{}) error {
+	if len(row) != len(aw.columns) {
+		return fmt.Errorf("arrow: got %d values for %d columns", len(row), len(aw.columns))
+	}
+	var size int
+	for i, v := range row {
+		if err := aw.appendValue(i, v); err != nil {
+			return err
+		}
+		size += aw.buffers[i].values.Len()
+	}
+	aw.numRows++
+	if aw.numRows >= arrowBatchSize || size >= arrowBatchMaxBytes {
+		return aw.flushBatch()
+	}
+	return nil
+}
+
+func (aw *arrowWriter) appendValue(i int, v interface{}) error {
+	col, buf := aw.columns[i], &aw.buffers[i]
+	if v == nil {
+		if !col.Optional {
+			return fmt.Errorf("arrow: nil value for required column %s", col.Name)
+		}
+		buf.present = append(buf.present, false)
+		buf.nullCount++
+		if arrowIsUtf8(col) {
+			buf.offsets = append(buf.offsets, int32(buf.values.Len()))
+		} else {
+			buf.appendInt64(0)
+		}
+		return nil
+	}
+	if col.Optional {
+		buf.present = append(buf.present, true)
+	}
+
+	switch x := v.(type) {
+	case string:
+		if !arrowIsUtf8(col) {
+			break
+		}
+		if buf.values.Len()+len(x) > math.MaxInt32 {
+			return fmt.Errorf("arrow: value of column %s is too large", col.Name)
+		}
+		buf.values.WriteString(x)
+		buf.offsets = append(buf.offsets, int32(buf.values.Len()))
+		return nil
+	case int:
+		if col.Type != parquetInt64 {
+			break
+		}
+		buf.appendInt64(int64(x))
+		return nil
+	case int64:
+		if col.Type != parquetInt64 {
+			break
+		}
+		buf.appendInt64(x)
+		return nil
+	case uint64:
+		if col.Type != parquetUint64 {
+			break
+		}
+		if x > math.MaxInt64 {
+			return fmt.Errorf("arrow: value %d of column %s is out of range", x, col.Name)
+		}
+		buf.appendInt64(int64(x))
+		return nil
+	case time.Time:
+		if col.Type != parquetTimestamp {
+			break
+		}
+		buf.appendInt64(x.UnixMicro())
+		return nil
+	}
+	return fmt.Errorf("arrow: invalid value of type %T for column %s", v, col.Name)
+}
+
+func (buf *arrowColumnBuffer) appendInt64(x int64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(x))
+	buf.values.Write(b[:])
+}
+
+// flushBatch writes out the buffered rows as a record batch.
+func (aw *arrowWriter) flushBatch() error {
+	if aw.numRows == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	var nodes, buffers []byte
+	addBuffer := func(p []byte) {
+		buffers = appendUint64(buffers, uint64(body.Len()))
+		buffers = appendUint64(buffers, uint64(len(p)))
+		body.Write(p)
+		for body.Len()%8 != 0 {
+			body.WriteByte(0)
+		}
+	}
+	for i, col := range aw.columns {
+		buf := &aw.buffers[i]
+		nodes = appendUint64(nodes, uint64(aw.numRows))
+		nodes = appendUint64(nodes, uint64(buf.nullCount))
+
+		// The validity bitmap may be left out when there are no nil
+		// values.
+		var validity []byte
+		if buf.nullCount > 0 {
+			validity = make([]byte, (len(buf.present)+7)/8)
+			for j, p := range buf.present {
+				if p {
+					validity[j/8] |= 1 << (j % 8)
+				}
+			}
+		}
+		addBuffer(validity)
+		if arrowIsUtf8(col) {
+			offsets := make([]byte, 0, 4*len(buf.offsets))
+			for _, o := range buf.offsets {
+				offsets = appendUint32(offsets, uint32(o))
+			}
+			addBuffer(offsets)
+		}
+		addBuffer(buf.values.Bytes())
+	}
+
+	batch := &fbTable{fields: []fbField{
+		fbInt64(aw.numRows),
+		fbChild(fbStructVector{n: len(aw.columns), data: nodes}),
+		fbChild(fbStructVector{n: len(buffers) / 16, data: buffers}),
+	}}
+	if err := aw.writeMessage(arrowHeaderRecordBatch, batch, body.Bytes()); err != nil {
+		return err
+	}
+	aw.resetBuffers()
+	aw.numRows = 0
+	return nil
+}
+
+// Close writes out the buffered rows and the end of the stream. It does not
+// close the underlying io.Writer. Calling Close more than once has no effect.
+func (aw *arrowWriter) Close() error {
+	if aw.closed {
+		return nil
+	}
+	aw.closed = true
+
+	if err := aw.flushBatch(); err != nil {
+		return err
+	}
+	var eos [8]byte
+	binary.LittleEndian.PutUint32(eos[:4], arrowContinuation)
+	_, err := aw.w.Write(eos[:])
+	return err
+}
+
+// writeArrow writes the rows written by writeRows to w as an Arrow IPC
+// stream with the given columns. The end of the stream is written even when
+// writeRows fails, so that the rows written before the failure are
+// readable.
+func writeArrow(w io.Writer, columns []parquetColumn, writeRows func(*arrowWriter) error) error {
+	aw, err := newArrowWriter(w, columns)
+	if err != nil {
+		return &StreamWriteError{Err: err}
+	}
+	err = writeRows(aw)
+	if cerr := aw.Close(); cerr != nil && err == nil {
+		err = &StreamWriteError{Err: cerr}
+	}
+	return err
+}
+
+// fbTable is a flatbuffers table to encode, as needed for the arrow
+// metadata. Its fields are in the order of their ids; absent fields are
+// zero fbFields.
+type fbTable struct {
+	fields []fbField
+}
+
+// fbField is a field of an fbTable: either a scalar, given by its little
+// endian encoding, or an offset to another object.
+type fbField struct {
+	scalar []byte
+	child  fbObject
+}
+
+// fbObject is a flatbuffers object referred to by an offset.
+type fbObject interface {
+	// encode appends the object to b and returns its position.
+	encode(b *fbBuilder) int
+}
+
+func fbUint8(v byte) fbField {
+	return fbField{scalar: []byte{v}}
+}
+
+func fbBool(v bool) fbField {
+	if v {
+		return fbUint8(1)
+	}
+	return fbUint8(0)
+}
+
+func fbInt16(v int16) fbField {
+	return fbField{scalar: appendUint16(nil, uint16(v))}
+}
+
+func fbInt32(v int32) fbField {
+	return fbField{scalar: appendUint32(nil, uint32(v))}
+}
+
+func fbInt64(v int64) fbField {
+	return fbField{scalar: appendUint64(nil, uint64(v))}
+}
+
+func fbChild(o fbObject) fbField {
+	return fbField{child: o}
+}
+
+func (f fbField) size() int {
+	if f.child != nil {
+		return 4
+	}
+	return len(f.scalar)
+}
+
+// fbBuilder encodes a flatbuffer front to back: objects are written before
+// the objects they refer to, so that all the offsets point forward.
+type fbBuilder struct {
+	buf []byte
+}
+
+// encodeFlatbuffer returns the flatbuffer with the given root table, padded
+// to a multiple of 8 bytes.
+func encodeFlatbuffer(root *fbTable) []byte {
+	b := &fbBuilder{buf: make([]byte, 4)}
+	b.putOffset(0, root.encode(b))
+	b.pad(8)
+	return b.buf
+}
+
+func (b *fbBuilder) pad(align int) {
+	for len(b.buf)%align != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+// putOffset sets the offset at position at to refer to the object at
+// position target.
+func (b *fbBuilder) putOffset(at, target int) {
+	binary.LittleEndian.PutUint32(b.buf[at:], uint32(target-at))
+}
+
+func (t *fbTable) encode(b *fbBuilder) int {
+	// The fields follow the offset to the vtable, each aligned to its
+	// size; the table itself is aligned to 8 bytes.
+	offsets := make([]int, len(t.fields))
+	size := 4
+	for i, f := range t.fields {
+		n := f.size()
+		if n == 0 {
+			continue
+		}
+		size = (size + n - 1) / n * n
+		offsets[i] = size
+		size += n
+	}
+
+	b.pad(2)
+	vtable := len(b.buf)
+	b.buf = appendUint16(b.buf, uint16(4+2*len(t.fields)))
+	b.buf = appendUint16(b.buf, uint16(size))
+	for _, o := range offsets {
+		b.buf = appendUint16(b.buf, uint16(o))
+	}
+
+	b.pad(8)
+	table := len(b.buf)
+	b.buf = append(b.buf, make([]byte, size)...)
+	binary.LittleEndian.PutUint32(b.buf[table:], uint32(int32(table-vtable)))
+	for i, f := range t.fields {
+		copy(b.buf[table+offsets[i]:], f.scalar)
+	}
+	for i, f := range t.fields {
+		if f.child != nil {
+			b.putOffset(table+offsets[i], f.child.encode(b))
+		}
+	}
+	return table
+}
+
+// fbString is a flatbuffers string.
+type fbString string
+
+func (s fbString) encode(b *fbBuilder) int {
+	b.pad(4)
+	pos := len(b.buf)
+	b.buf = appendUint32(b.buf, uint32(len(s)))
+	b.buf = append(append(b.buf, s...), 0)
+	return pos
+}
+
+// fbTableVector is a flatbuffers vector of tables.
+type fbTableVector []*fbTable
+
+func (v fbTableVector) encode(b *fbBuilder) int {
+	b.pad(4)
+	pos := len(b.buf)
+	b.buf = appendUint32(b.buf, uint32(len(v)))
+	elems := len(b.buf)
+	b.buf = append(b.buf, make([]byte, 4*len(v))...)
+	for i, t := range v {
+		b.putOffset(elems+4*i, t.encode(b))
+	}
+	return pos
+}
+
+// fbStructVector is a flatbuffers vector of n structs aligned to 8 bytes,
+// given by their encoding.
+type fbStructVector struct {
+	n    int
+	data []byte
+}
+
+func (v fbStructVector) encode(b *fbBuilder) int {
+	for (len(b.buf)+4)%8 != 0 {
+		b.buf = append(b.buf, 0)
+	}
+	pos := len(b.buf)
+	b.buf = appendUint32(b.buf, uint32(v.n))
+	b.buf = append(b.buf, v.data...)
+	return pos
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v)), uint32(v>>32))
+}
@@ -0,0 +1,252 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fbReader reads the fields of flatbuffers tables, for checking the arrow
+// metadata.
+type fbReader struct {
+	buf []byte
+}
+
+func (r fbReader) u32(pos int) int {
+	return int(binary.LittleEndian.Uint32(r.buf[pos:]))
+}
+
+// deref returns the position of the object referred to by the offset at pos.
+func (r fbReader) deref(pos int) int {
+	return pos + r.u32(pos)
+}
+
+// field returns the position of field id of the table at pos, or 0 if it is
+// absent.
+func (r fbReader) field(table, id int) int {
+	vtable := table - int(int32(r.u32(table)))
+	if 4+2*id >= int(binary.LittleEndian.Uint16(r.buf[vtable:])) {
+		return 0
+	}
+	if o := int(binary.LittleEndian.Uint16(r.buf[vtable+4+2*id:])); o != 0 {
+		return table + o
+	}
+	return 0
+}
+
+func (r fbReader) int64Field(table, id int) int64 {
+	if pos := r.field(table, id); pos != 0 {
+		return int64(binary.LittleEndian.Uint64(r.buf[pos:]))
+	}
+	return 0
+}
+
+func (r fbReader) stringField(table, id int) string {
+	pos := r.deref(r.field(table, id))
+	return string(r.buf[pos+4 : pos+4+r.u32(pos)])
+}
+
+// arrowMessage is a message read from an arrow stream.
+type arrowMessage struct {
+	headerType byte
+	header     int
+	meta       fbReader
+	body       []byte
+}
+
+// readArrowStream returns the messages of an arrow stream.
+func readArrowStream(t *testing.T, stream []byte) []arrowMessage {
+	var msgs []arrowMessage
+	for {
+		if len(stream) < 8 || binary.LittleEndian.Uint32(stream) != arrowContinuation {
+			t.Fatalf("Missing continuation marker")
+		}
+		metaLen := int(binary.LittleEndian.Uint32(stream[4:]))
+		if metaLen == 0 {
+			if len(stream) != 8 {
+				t.Fatalf("Got %d bytes after the end of the stream", len(stream)-8)
+			}
+			return msgs
+		}
+		if metaLen%8 != 0 {
+			t.Fatalf("Got metadata length %d, expected a multiple of 8", metaLen)
+		}
+		r := fbReader{buf: stream[8 : 8+metaLen]}
+		msg := r.deref(0)
+		if v := binary.LittleEndian.Uint16(r.buf[r.field(msg, 0):]); v != arrowMetadataV5 {
+			t.Fatalf("Got metadata version %d", v)
+		}
+		bodyLen := int(r.int64Field(msg, 3))
+		msgs = append(msgs, arrowMessage{
+			headerType: r.buf[r.field(msg, 1)],
+			header:     r.deref(r.field(msg, 2)),
+			meta:       r,
+			body:       stream[8+metaLen : 8+metaLen+bodyLen],
+		})
+		stream = stream[8+metaLen+bodyLen:]
+	}
+}
+
+// arrowBuffers returns the buffers of the columns of a record batch.
+func (m arrowMessage) arrowBuffers() [][]byte {
+	r := m.meta
+	vec := r.deref(r.field(m.header, 2))
+	buffers := make([][]byte, r.u32(vec))
+	for i := range buffers {
+		pos := vec + 4 + 16*i
+		offset := binary.LittleEndian.Uint64(r.buf[pos:])
+		length := binary.LittleEndian.Uint64(r.buf[pos+8:])
+		buffers[i] = m.body[offset : offset+length]
+	}
+	return buffers
+}
+
+func TestArrowWriter(t *testing.T) {
+	columns := []parquetColumn{
+		{Name: "time", Type: parquetTimestamp},
+		{Name: "bucket", Type: parquetString},
+		{Name: "status_code", Type: parquetInt64},
+		{Name: "length", Type: parquetUint64, Optional: true},
+	}
+	ts := time.Date(2022, time.March, 7, 1, 2, 3, 4000, time.UTC)
+	numRows := arrowBatchSize + 5
+
+	var buf bytes.Buffer
+	err := writeArrow(&buf, columns, func(aw *arrowWriter) error {
+		for i := 0; i < numRows; i++ {
+			var length interface{}
+			if i%2 == 0 {
+				length = uint64(i)
+			}
+			if err := aw.Write([]interface{}{ts, "photos", 200, length}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := readArrowStream(t, buf.Bytes())
+	if len(msgs) != 3 {
+		t.Fatalf("Got %d messages, expected 3", len(msgs))
+	}
+	schema := msgs[0]
+	if schema.headerType != arrowHeaderSchema {
+		t.Fatalf("Got header type %d, expected a schema", schema.headerType)
+	}
+	r := schema.meta
+	fields := r.deref(r.field(schema.header, 1))
+	if n := r.u32(fields); n != len(columns) {
+		t.Fatalf("Got %d fields, expected %d", n, len(columns))
+	}
+	for i, col := range columns {
+		field := r.deref(fields + 4 + 4*i)
+		if name := r.stringField(field, 0); name != col.Name {
+			t.Errorf("Got field name %s, expected %s", name, col.Name)
+		}
+		nullable := r.buf[r.field(field, 1)] == 1
+		if nullable != col.Optional {
+			t.Errorf("Got nullable %v for field %s", nullable, col.Name)
+		}
+		typeType, _ := arrowType(col)
+		if tt := r.buf[r.field(field, 2)]; tt != typeType {
+			t.Errorf("Got type %d for field %s, expected %d", tt, col.Name, typeType)
+		}
+	}
+
+	if msgs[1].headerType != arrowHeaderRecordBatch || msgs[2].headerType != arrowHeaderRecordBatch {
+		t.Fatalf("Expected record batches after the schema")
+	}
+	if n := msgs[1].meta.int64Field(msgs[1].header, 0); n != arrowBatchSize {
+		t.Errorf("Got %d rows in the first batch, expected %d", n, arrowBatchSize)
+	}
+
+	// Check the last batch, holding 5 rows.
+	batch := msgs[2]
+	if n := batch.meta.int64Field(batch.header, 0); n != 5 {
+		t.Fatalf("Got %d rows in the last batch, expected 5", n)
+	}
+	buffers := batch.arrowBuffers()
+	if len(buffers) != 9 {
+		t.Fatalf("Got %d buffers, expected 9", len(buffers))
+	}
+	for i := 0; i < 5; i++ {
+		micros := int64(binary.LittleEndian.Uint64(buffers[1][8*i:]))
+		if !time.UnixMicro(micros).Equal(ts) {
+			t.Errorf("Got time %s, expected %s", time.UnixMicro(micros), ts)
+		}
+	}
+	if offsets := buffers[3]; binary.LittleEndian.Uint32(offsets[4*5:]) != 5*6 {
+		t.Errorf("Got string offsets %v", offsets)
+	}
+	if s := string(buffers[4]); s != "photosphotosphotosphotosphotos" {
+		t.Errorf("Got string data %q", s)
+	}
+	// Only the rows with an even index have a length, starting at 10000.
+	if validity := buffers[7]; len(validity) != 1 || validity[0] != 0x15 {
+		t.Errorf("Got validity bitmap %v, expected [21]", validity)
+	}
+	if length := binary.LittleEndian.Uint64(buffers[8][16:]); length != arrowBatchSize+2 {
+		t.Errorf("Got length %d, expected %d", length, arrowBatchSize+2)
+	}
+
+	// Invalid values are rejected.
+	for _, row := range [][]interface{}{
+		{ts, "photos", 200},
+		{ts, nil, 200, nil},
+		{ts, "photos", "200", nil},
+		{ts, "photos", 200, uint64(1 << 63)},
+	} {
+		aw, err := newArrowWriter(&bytes.Buffer{}, columns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := aw.Write(row); err == nil {
+			t.Errorf("Expected an error writing %v", row)
+		}
+	}
+}
+
+func TestWriteArrowFailure(t *testing.T) {
+	columns := []parquetColumn{{Name: "bucket", Type: parquetString}}
+
+	// The end of the stream is written even if writing the rows fails.
+	var buf bytes.Buffer
+	failure := errors.New("scan failed")
+	err := writeArrow(&buf, columns, func(aw *arrowWriter) error {
+		if err := aw.Write([]interface{}{"photos"}); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("Got error %v, expected %v", err, failure)
+	}
+	msgs := readArrowStream(t, buf.Bytes())
+	if len(msgs) != 2 {
+		t.Fatalf("Got %d messages, expected 2", len(msgs))
+	}
+	if n := msgs[1].meta.int64Field(msgs[1].header, 0); n != 1 {
+		t.Errorf("Got %d rows, expected 1", n)
+	}
+}
@@ -0,0 +1,136 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// searchTable returns the table searched by the rawQ or reqInfoQ search s.
+func (c *DBClient) searchTable(s *SearchQuery) Table {
+	if s.Query == rawQ {
+		return c.logEventsTable()
+	}
+	return c.reqInfoTable()
+}
+
+// searchPartitions returns the partitions of the table searched by s that
+// may hold records in its time range, in the order of its results.
+func (c *DBClient) searchPartitions(ctx context.Context, s *SearchQuery) ([]PartitionInfo, error) {
+	partitions, err := c.ListPartitions(ctx, c.searchTable(s))
+	if err != nil {
+		return nil, err
+	}
+
+	var start, end *time.Time
+	if s.LastDuration != nil {
+		t := time.Now().Add(-*s.LastDuration)
+		start = &t
+	} else {
+		start, end = s.TimeStart, s.TimeEnd
+	}
+	var covered []PartitionInfo
+	for _, p := range partitions {
+		if start != nil && !p.EndDate.After(*start) {
+			continue
+		}
+		if end != nil && p.StartDate.After(*end) {
+			continue
+		}
+		covered = append(covered, p)
+	}
+	if !s.TimeAscending {
+		for i, j := 0, len(covered)-1; i < j; i, j = i+1, j-1 {
+			covered[i], covered[j] = covered[j], covered[i]
+		}
+	}
+	return covered, nil
+}
+
+// bestEffortRows returns the rows of the BestEffort search s, which are
+// read from each partition in turn. The partitions that fail to be read are
+// skipped and added to the SkippedPartitions of res.
+//
+// Since the partitions do not overlap and are read in the order of the
+// results, the rows are in order, as with a single query.
+func (c *DBClient) bestEffortRows(ctx context.Context, db querier, s *SearchQuery, res *SearchResult) (*limitedRows, error) {
+	_, whereClause, sqlArgs, dollarStart, err := c.searchSource(s)
+	if err != nil {
+		return nil, err
+	}
+	partitions, err := c.searchPartitions(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	skip := func(partition string, err error) {
+		c.logger().Warnf("Skipping partition %s of a best-effort search: %v", partition, err)
+		res.SkippedPartitions = append(res.SkippedPartitions, partition)
+	}
+	var i int
+	next := func(prevErr error) (*sql.Rows, error) {
+		if prevErr != nil {
+			if ctx.Err() != nil {
+				return nil, &QueryError{Op: "accessing", Err: prevErr}
+			}
+			skip(partitions[i-1].Name, prevErr)
+		}
+		for ; i < len(partitions); i++ {
+			// sqlArgs is not shared by the statements of the
+			// partitions, which append to it.
+			q, args, err := c.selectStatement(s, partitions[i].Name, whereClause, sqlArgs[:len(sqlArgs):len(sqlArgs)], dollarStart)
+			if err != nil {
+				return nil, err
+			}
+			rows, err := db.QueryContext(ctx, q, args...)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, &QueryError{Op: "querying", Err: err}
+				}
+				skip(partitions[i].Name, err)
+				continue
+			}
+			i++
+			return rows, nil
+		}
+		return nil, nil
+	}
+
+	rows := &limitedRows{next: next}
+	if s.ExportFormat != "" {
+		rows.max = int64(c.MaxExportRows)
+	}
+	first, err := next(nil)
+	if err != nil {
+		return nil, err
+	}
+	if first == nil {
+		// No partition could be read: the rows to iterate on are
+		// selected by a query reading no partition.
+		q, args, err := c.selectStatement(s, c.searchTable(s).Name, "WHERE false", nil, 1)
+		if err != nil {
+			return nil, err
+		}
+		if first, err = db.QueryContext(ctx, q, args...); err != nil {
+			return nil, &QueryError{Op: "querying", Err: err}
+		}
+	}
+	rows.Rows = first
+	return rows, nil
+}
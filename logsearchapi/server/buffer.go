@@ -0,0 +1,168 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// IngestBufferConfig configures the buffering of the events queued with
+// DBClient.QueueEvent, which smooths bursts of events by inserting them in
+// batches.
+type IngestBufferConfig struct {
+	// Size is the number of queued events triggering a flush. It also
+	// bounds the number of events queued while a flush is in progress:
+	// events queued beyond it are dropped.
+	Size int
+	// FlushInterval is the maximum time an event is queued before being
+	// flushed, when fewer than Size events are queued.
+	FlushInterval time.Duration
+}
+
+// DefaultIngestBufferConfig is a reasonable buffer configuration for
+// WithIngestBuffer.
+var DefaultIngestBufferConfig = IngestBufferConfig{
+	Size:          1000,
+	FlushInterval: time.Second,
+}
+
+func (b IngestBufferConfig) validate() error {
+	if b.Size <= 0 {
+		return fmt.Errorf("Invalid ingest buffer size: %d (must be positive)", b.Size)
+	}
+	if b.FlushInterval <= 0 {
+		return fmt.Errorf("Invalid ingest buffer flush interval: %s (must be positive)", b.FlushInterval)
+	}
+	return nil
+}
+
+// WithIngestBuffer enables buffering the events queued with QueueEvent, which
+// are then inserted in batches by a background worker started by
+// NewDBClient.
+func WithIngestBuffer(b IngestBufferConfig) DBClientOption {
+	return func(c *DBClient) {
+		c.buffer = &ingestBuffer{
+			cfg:  b,
+			full: make(chan struct{}, 1),
+		}
+	}
+}
+
+// ingestBuffer holds the events queued with QueueEvent until they are
+// flushed.
+type ingestBuffer struct {
+	cfg IngestBufferConfig
+
+	mu      sync.Mutex
+	pending [][]byte
+
+	// full is signaled when cfg.Size events are pending.
+	full chan struct{}
+
+	// flushMu serializes flushes, so that Flush waits for a flush in
+	// progress.
+	flushMu sync.Mutex
+}
+
+// QueueEvent queues the audit event eventBytes for insertion by the
+// background worker enabled with WithIngestBuffer, without waiting for it to
+// be inserted. eventBytes must not be modified afterwards. Events that cannot
+// be queued, e.g. when the buffer is full, or inserted are logged, like the
+// events InsertEvent fails to insert. Without buffering, the event is
+// inserted right away with InsertEvent.
+func (c *DBClient) QueueEvent(eventBytes []byte) {
+	b := c.buffer
+	if b == nil {
+		// InsertEvent logs the events it fails to insert.
+		_ = c.InsertEvent(context.Background(), eventBytes)
+		return
+	}
+	if err := c.checkOpen(); err != nil {
+		c.logger().Errorf("audit event not saved: %s (cause: %v)", string(eventBytes), err)
+		return
+	}
+
+	b.mu.Lock()
+	if len(b.pending) >= b.cfg.Size {
+		b.mu.Unlock()
+		c.logger().Errorf("audit event not saved: %s (cause: ingest buffer full)", string(eventBytes))
+		return
+	}
+	b.pending = append(b.pending, eventBytes)
+	full := len(b.pending) >= b.cfg.Size
+	b.mu.Unlock()
+
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Flush inserts the events queued with QueueEvent, after waiting for a flush
+// in progress, if any. It is called by Close, so that the queued events are
+// not lost on shutdown.
+func (c *DBClient) Flush(ctx context.Context) error {
+	if c.buffer == nil {
+		return nil
+	}
+	b := c.buffer
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	events := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	if len(events) == 0 {
+		return nil
+	}
+	return c.insertBatch(ctx, events)
+}
+
+// startFlusher starts the background worker flushing the ingest buffer, when
+// either its size or flush interval is reached, until the client is closed.
+func (c *DBClient) startFlusher() {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stopMaintainers = append(c.stopMaintainers, cancel)
+	c.maintainers.Add(1)
+
+	go func() {
+		defer c.maintainers.Done()
+		ticker := time.NewTicker(c.buffer.cfg.FlushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-c.buffer.full:
+			case <-ctx.Done():
+				return
+			}
+			// A flush in progress is not interrupted by Close, which
+			// waits for it: failures are logged by insertBatch.
+			_ = c.Flush(context.Background())
+		}
+	}()
+}
@@ -0,0 +1,145 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIngestBufferConfigValidate(t *testing.T) {
+	if err := DefaultIngestBufferConfig.validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, b := range []IngestBufferConfig{{Size: 0, FlushInterval: time.Second}, {Size: 10}} {
+		if err := b.validate(); err == nil {
+			t.Errorf("%+v: expected an error", b)
+		}
+	}
+}
+
+func TestQueueEventBufferFull(t *testing.T) {
+	c := &DBClient{}
+	WithIngestBuffer(IngestBufferConfig{Size: 2, FlushInterval: time.Hour})(c)
+
+	for i := 0; i < 3; i++ {
+		c.QueueEvent([]byte(fmt.Sprintf(`{"requestID": "%d"}`, i)))
+	}
+	if len(c.buffer.pending) != 2 {
+		t.Errorf("expected 2 queued events, got %d", len(c.buffer.pending))
+	}
+	select {
+	case <-c.buffer.full:
+	default:
+		t.Error("expected a flush to be triggered")
+	}
+}
+
+// countBucketEvents returns the number of request_info records of the bucket.
+func countBucketEvents(t *testing.T, c *DBClient, bucket string) string {
+	t.Helper()
+	sq := SearchQuery{Query: reqInfoQ, ExportFormat: "count", FParams: bucketFilter(reqInfoQ, bucket)}
+	var buf bytes.Buffer
+	if err := c.Search(context.Background(), &sq, &buf); err != nil {
+		t.Fatalf("search failed: %v", err)
+	}
+	return buf.String()
+}
+
+func TestInsertEvents(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	var events [][]byte
+	for i := 0; i < 3; i++ {
+		ev, err := json.Marshal(newTestEvent(time.Now(), bucket))
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	// Invalid and empty events are skipped.
+	events = append(events, []byte("not json"), []byte("{}"))
+	if err := c.InsertEvents(context.Background(), events); err != nil {
+		t.Fatalf("InsertEvents failed: %v", err)
+	}
+
+	if got := countBucketEvents(t, c, bucket); got != "{\"count\":3}\n" {
+		t.Errorf("got %q, expected 3 records", got)
+	}
+	for _, q := range []qType{rawQ, joinedQ} {
+		sq := SearchQuery{Query: q, ExportFormat: "count", FParams: bucketFilter(q, bucket)}
+		var buf bytes.Buffer
+		if err := c.Search(context.Background(), &sq, &buf); err != nil {
+			t.Fatalf("%s: search failed: %v", q, err)
+		}
+		if buf.String() != "{\"count\":3}\n" {
+			t.Errorf("%s: got %q, expected 3 records", q, buf.String())
+		}
+	}
+}
+
+func TestIngestBuffer(t *testing.T) {
+	c := newTestDBClient(t, WithIngestBuffer(IngestBufferConfig{Size: 2, FlushInterval: time.Hour}))
+
+	bucket := testBucketName()
+	queue := func() {
+		ev, err := json.Marshal(newTestEvent(time.Now(), bucket))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.QueueEvent(ev)
+	}
+
+	// Reaching the buffer size triggers a flush.
+	queue()
+	queue()
+	deadline := time.Now().Add(10 * time.Second)
+	for countBucketEvents(t, c, bucket) != "{\"count\":2}\n" {
+		if time.Now().After(deadline) {
+			t.Fatal("queued events were not flushed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	queue()
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := countBucketEvents(t, c, bucket); got != "{\"count\":3}\n" {
+		t.Errorf("got %q after Flush, expected 3 records", got)
+	}
+
+	// Close flushes the queued events.
+	queue()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewDBClient(context.Background(), os.Getenv(testPgConnStrEnv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if got := countBucketEvents(t, other, bucket); got != "{\"count\":4}\n" {
+		t.Errorf("got %q after Close, expected 4 records", got)
+	}
+}
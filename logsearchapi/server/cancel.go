@@ -0,0 +1,84 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+)
+
+// minCancelTokenLen and maxCancelTokenLen bound the length of the tokens
+// searches are registered with, which should be hard to guess, as any
+// client of the server knowing a token may cancel its search.
+const (
+	minCancelTokenLen = 16
+	maxCancelTokenLen = 64
+)
+
+// validateCancelToken checks the token a search is registered with.
+func validateCancelToken(token string) error {
+	if len(token) < minCancelTokenLen || len(token) > maxCancelTokenLen {
+		return invalidQueryErrorf("Invalid cancel token: must have %d to %d characters", minCancelTokenLen, maxCancelTokenLen)
+	}
+	for _, r := range token {
+		if !isIDChar(r) {
+			return invalidQueryErrorf("Invalid cancel token: invalid character %q", r)
+		}
+	}
+	return nil
+}
+
+// RegisterSearch returns a context derived from ctx, for a search that may
+// then be canceled with CancelSearch(token), e.g. by another request of the
+// client, which also cancels its running query on the DB side. done must be
+// called once the search is over, to deregister it and release the context.
+// Tokens are chosen by the clients, and may only be used by one search at a
+// time: ErrCancelTokenInUse is returned otherwise.
+func (c *DBClient) RegisterSearch(ctx context.Context, token string) (_ context.Context, done func(), err error) {
+	if err := validateCancelToken(token); err != nil {
+		return nil, nil, err
+	}
+
+	c.cancelsMu.Lock()
+	defer c.cancelsMu.Unlock()
+	if _, ok := c.cancels[token]; ok {
+		return nil, nil, ErrCancelTokenInUse
+	}
+	if c.cancels == nil {
+		c.cancels = make(map[string]context.CancelFunc)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c.cancels[token] = cancel
+	return ctx, func() {
+		c.cancelsMu.Lock()
+		delete(c.cancels, token)
+		c.cancelsMu.Unlock()
+		cancel()
+	}, nil
+}
+
+// CancelSearch cancels the search registered with the token by
+// RegisterSearch, returning false if there is none, e.g. as it is over.
+func (c *DBClient) CancelSearch(token string) bool {
+	c.cancelsMu.Lock()
+	cancel, ok := c.cancels[token]
+	delete(c.cancels, token)
+	c.cancelsMu.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok
+}
@@ -0,0 +1,109 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRegisterSearch(t *testing.T) {
+	const token = "0123456789abcdef"
+	c := &DBClient{}
+
+	ctx, done, err := c.RegisterSearch(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.RegisterSearch(context.Background(), token); !errors.Is(err, ErrCancelTokenInUse) || !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("expected ErrCancelTokenInUse, got %v", err)
+	}
+	if !c.CancelSearch(token) {
+		t.Error("expected the search to be canceled")
+	}
+	if ctx.Err() != context.Canceled {
+		t.Errorf("expected a canceled context, got %v", ctx.Err())
+	}
+	done()
+	if c.CancelSearch(token) {
+		t.Error("expected no search to cancel once canceled")
+	}
+
+	// Once done, the search is deregistered and the token may be reused.
+	_, done, err = c.RegisterSearch(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+	if c.CancelSearch(token) {
+		t.Error("expected no search to cancel once done")
+	}
+
+	for _, token := range []string{"short", "0123456789abcdef */", string(make([]byte, maxCancelTokenLen+1))} {
+		if _, _, err := c.RegisterSearch(context.Background(), token); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%q: expected an invalid token error, got %v", token, err)
+		}
+	}
+}
+
+// cancelingWriter cancels the search of its token on its first write, and
+// waits for the context of the search to be done.
+type cancelingWriter struct {
+	c      *DBClient
+	ctx    context.Context
+	token  string
+	writes int
+}
+
+func (w *cancelingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes == 1 {
+		w.c.CancelSearch(w.token)
+		<-w.ctx.Done()
+		// The rows of the search are closed asynchronously.
+		time.Sleep(100 * time.Millisecond)
+	}
+	return len(p), nil
+}
+
+func TestCancelInFlightSearch(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		insertTestEvent(t, c, now.Add(time.Duration(i)*time.Second), bucket)
+	}
+
+	const token = "test-cancel-token-0001"
+	ctx, done, err := c.RegisterSearch(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	sq := SearchQuery{Query: reqInfoQ, ExportFormat: "ndjson", FParams: bucketFilter(reqInfoQ, bucket)}
+	w := &cancelingWriter{c: c, ctx: ctx, token: token}
+	if err := c.Search(ctx, &sq, w); err == nil {
+		t.Fatal("expected the canceled search to fail")
+	}
+	if w.writes >= 5 {
+		t.Errorf("expected the search to stop once canceled, got %d writes", w.writes)
+	}
+}
@@ -0,0 +1,158 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// OperationCategoryOther is the operation category of the APIs missing from
+// the operation categories mapping.
+const OperationCategoryOther = "Other"
+
+// operationCategoryGroup is the pseudo-column to group records by operation
+// category in aggregations.
+const operationCategoryGroup = "operation_category"
+
+// DefaultOperationCategories maps S3 API names, as found in the audit logs, to
+// broad operation categories. It is used by clients without their own
+// OperationCategories mapping.
+var DefaultOperationCategories = map[string]string{
+	"GetObject":           "Read",
+	"HeadObject":          "Read",
+	"SelectObjectContent": "Read",
+	"GetObjectTagging":    "Read",
+	"GetObjectRetention":  "Read",
+	"GetObjectLegalHold":  "Read",
+	"GetObjectACL":        "Read",
+
+	"PutObject":               "Write",
+	"CopyObject":              "Write",
+	"PostPolicyBucket":        "Write",
+	"DeleteObject":            "Write",
+	"DeleteMultipleObjects":   "Write",
+	"NewMultipartUpload":      "Write",
+	"PutObjectPart":           "Write",
+	"CopyObjectPart":          "Write",
+	"CompleteMultipartUpload": "Write",
+	"AbortMultipartUpload":    "Write",
+	"PutObjectTagging":        "Write",
+	"DeleteObjectTagging":     "Write",
+	"PutObjectRetention":      "Write",
+	"PutObjectLegalHold":      "Write",
+
+	"ListBuckets":          "List",
+	"ListObjectsV1":        "List",
+	"ListObjectsV2":        "List",
+	"ListObjectVersions":   "List",
+	"ListMultipartUploads": "List",
+	"ListObjectParts":      "List",
+
+	"PutBucket":                  "Admin",
+	"DeleteBucket":               "Admin",
+	"HeadBucket":                 "Admin",
+	"GetBucketLocation":          "Admin",
+	"GetBucketPolicy":            "Admin",
+	"PutBucketPolicy":            "Admin",
+	"DeleteBucketPolicy":         "Admin",
+	"GetBucketLifecycle":         "Admin",
+	"PutBucketLifecycle":         "Admin",
+	"DeleteBucketLifecycle":      "Admin",
+	"GetBucketVersioning":        "Admin",
+	"PutBucketVersioning":        "Admin",
+	"GetBucketNotification":      "Admin",
+	"PutBucketNotification":      "Admin",
+	"GetBucketEncryption":        "Admin",
+	"PutBucketEncryption":        "Admin",
+	"DeleteBucketEncryption":     "Admin",
+	"GetBucketReplicationConfig": "Admin",
+	"PutBucketReplicationConfig": "Admin",
+	"GetBucketTagging":           "Admin",
+	"PutBucketTagging":           "Admin",
+	"DeleteBucketTagging":        "Admin",
+}
+
+// operationCategories returns the mapping of API names to operation
+// categories used by the client.
+func (c *DBClient) operationCategories() map[string]string {
+	if c.OperationCategories != nil {
+		return c.OperationCategories
+	}
+	return DefaultOperationCategories
+}
+
+// operationCategory returns the operation category of the given API.
+func (c *DBClient) operationCategory(apiName string) string {
+	if category, ok := c.operationCategories()[apiName]; ok {
+		return category
+	}
+	return OperationCategoryOther
+}
+
+// categoryFilterClause returns a where-clause predicate matching the records
+// whose API, in the apiNameCol column, belongs to any of the given operation
+// categories, using positional arguments starting at dollarStart. There is no
+// predicate when categories is empty.
+func (c *DBClient) categoryFilterClause(apiNameCol fParam, categories []string, dollarStart int) (clauses []string, args []interface{}, dollarEnd int, err error) {
+	if len(categories) == 0 {
+		return nil, nil, dollarStart, nil
+	}
+
+	mapping := c.operationCategories()
+	apisByCategory := make(map[string][]string)
+	var allAPIs []string
+	for api, category := range mapping {
+		apisByCategory[category] = append(apisByCategory[category], api)
+		allAPIs = append(allAPIs, api)
+	}
+
+	placeholders := func(apis []string) string {
+		// Sort so that the generated query is deterministic.
+		sort.Strings(apis)
+		ps := make([]string, len(apis))
+		for i, api := range apis {
+			ps[i] = fmt.Sprintf("$%d", dollarStart)
+			args = append(args, api)
+			dollarStart++
+		}
+		return strings.Join(ps, ", ")
+	}
+
+	var preds []string
+	for _, category := range categories {
+		apis, ok := apisByCategory[category]
+		switch {
+		case category == OperationCategoryOther:
+			if len(allAPIs) == 0 {
+				return nil, nil, dollarStart, nil
+			}
+			// Records without an API name, e.g. raw logs missing it,
+			// are in the Other category too.
+			preds = append(preds, fmt.Sprintf("COALESCE(%s, '') NOT IN (%s)", apiNameCol, placeholders(allAPIs)))
+		case ok:
+			preds = append(preds, fmt.Sprintf("%s IN (%s)", apiNameCol, placeholders(apis)))
+		default:
+			return nil, nil, dollarStart, invalidQueryErrorf("Unknown operation category: %s", category)
+		}
+	}
+	if len(preds) == 1 {
+		return preds, args, dollarStart, nil
+	}
+	return []string{fmt.Sprintf("(%s)", strings.Join(preds, " OR "))}, args, dollarStart, nil
+}
@@ -0,0 +1,165 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testOperationCategories = map[string]string{
+	"GetObject":     "Read",
+	"HeadObject":    "Read",
+	"PutObject":     "Write",
+	"ListObjectsV2": "List",
+}
+
+func TestCategoryFilterClause(t *testing.T) {
+	c := &DBClient{OperationCategories: testOperationCategories}
+
+	testCases := []struct {
+		categories      []string
+		expectedClauses []string
+		expectedArgs    []interface{}
+		expectErr       bool
+	}{
+		{nil, nil, nil, false},
+		{[]string{"Read"}, []string{"api_name IN ($3, $4)"}, []interface{}{"GetObject", "HeadObject"}, false},
+		{
+			[]string{"Write", "List"},
+			[]string{"(api_name IN ($3) OR api_name IN ($4))"},
+			[]interface{}{"PutObject", "ListObjectsV2"},
+			false,
+		},
+		{
+			[]string{"Other"},
+			[]string{"COALESCE(api_name, '') NOT IN ($3, $4, $5, $6)"},
+			[]interface{}{"GetObject", "HeadObject", "ListObjectsV2", "PutObject"},
+			false,
+		},
+		{[]string{"Admin"}, nil, nil, true},
+	}
+	for i, testCase := range testCases {
+		clauses, args, dollarEnd, err := c.categoryFilterClause("api_name", testCase.categories, 3)
+		if testCase.expectErr {
+			if err == nil {
+				t.Errorf("Test %d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(clauses, testCase.expectedClauses) {
+			t.Errorf("Test %d: got clauses %v, expected %v", i, clauses, testCase.expectedClauses)
+		}
+		if !reflect.DeepEqual(args, testCase.expectedArgs) {
+			t.Errorf("Test %d: got args %v, expected %v", i, args, testCase.expectedArgs)
+		}
+		if expected := 3 + len(testCase.expectedArgs); dollarEnd != expected {
+			t.Errorf("Test %d: got dollarEnd %d, expected %d", i, dollarEnd, expected)
+		}
+	}
+}
+
+func TestCategoryFilterWhereClauses(t *testing.T) {
+	c := &DBClient{OperationCategories: testOperationCategories}
+
+	sq := &SearchQuery{Query: rawQ, CategoryFilter: []string{"Write"}}
+	where, args, _, err := c.rawWhereClause(sq, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "WHERE log->'api'->>'name' IN ($1)"; where != expected {
+		t.Errorf("got %q, expected %q", where, expected)
+	}
+	if expected := []interface{}{"PutObject"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+
+	sq = &SearchQuery{Query: reqInfoQ, CategoryFilter: []string{"Write"}}
+	where, args, _, err = c.reqInfoWhereClause(sq, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "WHERE api_name IN ($1)"; where != expected {
+		t.Errorf("got %q, expected %q", where, expected)
+	}
+	if expected := []interface{}{"PutObject"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+}
+
+func TestOperationCategories(t *testing.T) {
+	c := newTestDBClient(t)
+	c.OperationCategories = testOperationCategories
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	now := time.Now()
+	seed := map[string]int{"GetObject": 3, "HeadObject": 2, "PutObject": 2, "ListObjectsV2": 1, "DeleteBucket": 1}
+	for api, n := range seed {
+		for i := 0; i < n; i++ {
+			ev := newTestEvent(now, bucket)
+			ev["api"].(map[string]interface{})["name"] = api
+			insertTestEventMap(t, c, ev)
+		}
+	}
+	// An event without an API name is in the Other category.
+	ev := newTestEvent(now, bucket)
+	delete(ev["api"].(map[string]interface{}), "name")
+	insertTestEventMap(t, c, ev)
+
+	// Filtering
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		sq := SearchQuery{
+			Query:          q,
+			PageSize:       100,
+			FParams:        bucketFilter(q, bucket),
+			CategoryFilter: []string{"Read", "Other"},
+		}
+		var buf bytes.Buffer
+		if err := c.Search(ctx, &sq, &buf); err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		var rows []json.RawMessage
+		if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 7 {
+			t.Errorf("%s: got %d records, expected 7", q, len(rows))
+		}
+	}
+
+	// Grouping
+	sq := SearchQuery{
+		Query:   reqInfoQ,
+		FParams: map[fParam][]string{"bucket": {bucket}},
+	}
+	groups, err := c.CountByGroup(ctx, &sq, "operation_category", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []GroupCount{{"Read", 5}, {"Other", 2}, {"Write", 2}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("got %v, expected %v", groups, expected)
+	}
+}
@@ -0,0 +1,128 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultColdSinkQueueSize is the number of events queued for the cold sink
+// when DBClient.ColdSinkQueueSize is not set.
+const DefaultColdSinkQueueSize = 1000
+
+// ColdSink is a secondary store of audit events, e.g. an object store
+// appender, used for long-term archival alongside the DB.
+type ColdSink interface {
+	// Append stores the audit event received at the given time.
+	Append(ctx context.Context, eventTime time.Time, event []byte) error
+}
+
+// archivedEvent is an event queued for the cold sink.
+type archivedEvent struct {
+	time  time.Time
+	bytes []byte
+}
+
+// queueArchive queues the event for the cold sink, without waiting for it to
+// be archived by the background archiver, which is started on first use.
+// When the queue is full, e.g. because the cold sink is slow, the event is
+// dropped, counted in ColdSinkDropped and logged, so that archival never
+// blocks inserts. The events inserted by Close, when flushing the ingest
+// buffer, are archived right away, as the archiver is stopped.
+func (c *DBClient) queueArchive(eventTime time.Time, eventBytes []byte) {
+	queue := c.archiveQueue()
+	if queue == nil {
+		c.archiveEvent(context.Background(), eventTime, eventBytes)
+		return
+	}
+	// The caller may reuse eventBytes once the insert returns.
+	ev := archivedEvent{time: eventTime, bytes: append([]byte(nil), eventBytes...)}
+	select {
+	case queue <- ev:
+	default:
+		c.coldSinkMu.Lock()
+		c.coldSinkDropped++
+		c.coldSinkMu.Unlock()
+		c.logger().Errorf("audit event not archived: %s (cause: cold sink queue full)", string(eventBytes))
+	}
+}
+
+// ColdSinkDropped returns the number of events dropped because the cold sink
+// queue was full.
+func (c *DBClient) ColdSinkDropped() int {
+	c.coldSinkMu.Lock()
+	defer c.coldSinkMu.Unlock()
+	return c.coldSinkDropped
+}
+
+// archiveQueue returns the queue of the events to archive, starting the
+// background archiver if needed, or nil once the client is closed.
+func (c *DBClient) archiveQueue() chan<- archivedEvent {
+	if c.checkOpen() != nil {
+		return nil
+	}
+	c.coldSinkMu.Lock()
+	defer c.coldSinkMu.Unlock()
+	if c.coldSinkQueue != nil {
+		return c.coldSinkQueue
+	}
+
+	size := c.ColdSinkQueueSize
+	if size <= 0 {
+		size = DefaultColdSinkQueueSize
+	}
+	queue := make(chan archivedEvent, size)
+	if !c.runInBackground(func(ctx context.Context) { c.runArchiver(ctx, queue) }) {
+		return nil
+	}
+	c.coldSinkQueue = queue
+	return queue
+}
+
+// runArchiver archives the queued events until ctx is done. The events still
+// queued when the client is closed are logged as not archived.
+func (c *DBClient) runArchiver(ctx context.Context, queue chan archivedEvent) {
+	for {
+		select {
+		case ev := <-queue:
+			c.archiveEvent(ctx, ev.time, ev.bytes)
+		case <-ctx.Done():
+			for {
+				select {
+				case ev := <-queue:
+					c.logger().Errorf("audit event not archived: %s (cause: %v)", string(ev.bytes), ErrClientClosed)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// archiveEvent appends the event to the cold sink, retrying any failure
+// according to c.ColdSinkRetry. Failures are only logged, so that archival
+// never fails an insert.
+func (c *DBClient) archiveEvent(ctx context.Context, eventTime time.Time, eventBytes []byte) {
+	retryAll := func(error) bool { return true }
+	err := retry(ctx, c.ColdSinkRetry, retryAll, func() error {
+		return c.ColdSink.Append(ctx, eventTime, eventBytes)
+	})
+	if err != nil {
+		c.logger().Errorf("audit event not archived: %s (cause: %v)", string(eventBytes), err)
+	}
+}
@@ -0,0 +1,206 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeColdSink records the appended events, failing the first failures
+// calls.
+type fakeColdSink struct {
+	mu       sync.Mutex
+	failures int
+	calls    int
+	events   [][]byte
+}
+
+func (f *fakeColdSink) Append(ctx context.Context, eventTime time.Time, event []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls++
+	if f.calls <= f.failures {
+		return errors.New("cold sink unavailable")
+	}
+	f.events = append(f.events, event)
+	return nil
+}
+
+// counts returns the number of calls and of appended events.
+func (f *fakeColdSink) counts() (calls, events int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls, len(f.events)
+}
+
+// waitCalls waits for the events queued for the sink to be archived, i.e. for
+// at least calls calls to Append.
+func (f *fakeColdSink) waitCalls(t *testing.T, calls int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if n, _ := f.counts(); n >= calls {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d cold sink calls", calls)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// blockingColdSink blocks Append until unblock is closed, signaling started
+// on each call.
+type blockingColdSink struct {
+	fakeColdSink
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (b *blockingColdSink) Append(ctx context.Context, eventTime time.Time, event []byte) error {
+	b.started <- struct{}{}
+	<-b.unblock
+	return b.fakeColdSink.Append(ctx, eventTime, event)
+}
+
+func TestArchiveEvent(t *testing.T) {
+	retryPolicy := RetryPolicy{MaxRetries: 2, InitialBackoff: time.Millisecond}
+	event := []byte(`{"version":"1"}`)
+
+	testCases := []struct {
+		failures       int
+		expectedCalls  int
+		expectedEvents int
+	}{
+		{0, 1, 1},
+		{2, 3, 1},
+		{10, 3, 0},
+	}
+	for _, testCase := range testCases {
+		sink := &fakeColdSink{failures: testCase.failures}
+		c := &DBClient{ColdSink: sink, ColdSinkEnabled: true, ColdSinkRetry: retryPolicy}
+		c.archiveEvent(context.Background(), time.Now(), event)
+		if sink.calls != testCase.expectedCalls || len(sink.events) != testCase.expectedEvents {
+			t.Errorf("%d failures: got %d calls and %d events, expected %d and %d", testCase.failures,
+				sink.calls, len(sink.events), testCase.expectedCalls, testCase.expectedEvents)
+		}
+	}
+}
+
+func TestQueueArchiveFull(t *testing.T) {
+	sink := &blockingColdSink{started: make(chan struct{}, 10), unblock: make(chan struct{})}
+	c := &DBClient{ColdSink: sink, ColdSinkEnabled: true, ColdSinkQueueSize: 1}
+	defer func() {
+		for _, stop := range c.stopMaintainers {
+			stop()
+		}
+		c.maintainers.Wait()
+	}()
+
+	event := []byte(`{"version":"1"}`)
+	// The archiver blocks on the first event, the second one is queued and
+	// the third one is dropped, without blocking.
+	c.queueArchive(time.Now(), event)
+	<-sink.started
+	c.queueArchive(time.Now(), event)
+	c.queueArchive(time.Now(), event)
+	if dropped := c.ColdSinkDropped(); dropped != 1 {
+		t.Errorf("got %d dropped events, expected 1", dropped)
+	}
+
+	close(sink.unblock)
+	sink.waitCalls(t, 2)
+	if _, events := sink.counts(); events != 2 {
+		t.Errorf("got %d archived events, expected 2", events)
+	}
+}
+
+func TestInsertEventColdSink(t *testing.T) {
+	c := newTestDBClient(t)
+	c.ColdSinkEnabled = true
+	c.ColdSinkRetry = RetryPolicy{MaxRetries: 1, InitialBackoff: time.Millisecond}
+
+	for _, failures := range []int{0, 10} {
+		sink := &fakeColdSink{failures: failures}
+		c.ColdSink = sink
+
+		bucket := testBucketName()
+		buf, err := json.Marshal(newTestEvent(time.Now(), bucket))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A failing cold sink does not fail the insert.
+		if err := c.InsertEvent(context.Background(), buf); err != nil {
+			t.Fatalf("%d failures: insert failed: %v", failures, err)
+		}
+
+		sq := SearchQuery{
+			Query:   reqInfoQ,
+			FParams: map[fParam][]string{"bucket": {bucket}},
+		}
+		count, err := c.countRows(context.Background(), c, &sq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("%d failures: got %d records in the DB, expected 1", failures, count)
+		}
+		// The event is archived in the background, with one retry.
+		sink.waitCalls(t, map[bool]int{true: 1, false: 2}[failures == 0])
+		_, events := sink.counts()
+		if expected := map[bool]int{true: 1, false: 0}[failures == 0]; events != expected {
+			t.Errorf("%d failures: got %d archived events, expected %d", failures, events, expected)
+		}
+	}
+}
+
+func TestInsertEventColdSinkInsertFailure(t *testing.T) {
+	// sql.Open does not connect, and nothing listens on port 1, so that the
+	// inserts fail right away.
+	db, err := sql.Open("postgres", "postgres://localhost:1/test?sslmode=disable&connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &fakeColdSink{}
+	c := &DBClient{DB: db, ColdSink: sink, ColdSinkEnabled: true}
+	defer c.Close()
+
+	buf, err := json.Marshal(newTestEvent(time.Now(), testBucketName()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The events not inserted into the DB are not archived.
+	if err := c.InsertEvent(context.Background(), buf); err == nil {
+		t.Fatal("expected the insert to fail")
+	}
+	if err := c.InsertEvents(context.Background(), [][]byte{buf, buf}); err == nil {
+		t.Fatal("expected the batch insert to fail")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if calls, _ := sink.counts(); calls != 0 {
+		t.Errorf("got %d cold sink calls, expected none", calls)
+	}
+}
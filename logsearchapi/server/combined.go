@@ -0,0 +1,135 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// CombinedResult holds a page of request_info records along with the raw log
+// events of the same requests, as returned by SearchCombined.
+type CombinedResult struct {
+	ReqInfo []ReqInfoRow  `json:"reqinfo"`
+	Raw     []LogEventRow `json:"raw"`
+}
+
+// SearchCombined runs the reqInfoQ search s and returns its page of records
+// along with the raw log events of the same requests, correlated by request
+// ID, as two separate lists rather than the joined records of a joinedQ
+// search, for callers that need both without issuing two searches. The raw
+// log events are searched in the same time range as s, and are ordered by
+// time as per TimeAscending. Records without a request ID have no raw log
+// event.
+// Exports and the envelopes of pages are not supported, and the request IDs
+// may not be left out nor redacted.
+func (c *DBClient) SearchCombined(ctx context.Context, s *SearchQuery) (*CombinedResult, error) {
+	s = c.redactSearch(s)
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	if s.Query != reqInfoQ {
+		return nil, invalidQueryErrorf("Combined searches are only supported for %s queries", reqInfoQ)
+	}
+	if s.ExportFormat != "" || s.Envelope || s.DataEnvelope || s.SinceWatermark != "" || s.RowTransform != nil {
+		return nil, invalidQueryErrorf("Exports, envelopes, watermarks and row transforms are not supported by combined searches")
+	}
+	if len(s.Columns) > 0 && !containsString(s.Columns, "request_id") {
+		return nil, &ValidationError{Field: "Columns", Msg: "must have the request_id column in combined searches"}
+	}
+	if containsString(s.RedactColumns, "request_id") {
+		return nil, &ValidationError{Field: "RedactColumns", Msg: "may not have the request_id column in combined searches"}
+	}
+	if err := c.checkTimeBound(s); err != nil {
+		return nil, err
+	}
+	s, err := c.capSearch(s)
+	if err != nil {
+		return nil, err
+	}
+	if s.LastDuration != nil {
+		// Both searches must have the same time range, rather than ranges
+		// relative to the time each is run.
+		fixed := *s
+		start := time.Now().Add(-*s.LastDuration)
+		fixed.TimeStart, fixed.LastDuration = &start, nil
+		s = &fixed
+	}
+
+	res := &CombinedResult{ReqInfo: []ReqInfoRow{}, Raw: []LogEventRow{}}
+	it, err := c.SearchRows(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	requestIDs := make(map[string]bool)
+	var ids []string
+	for it.Next() {
+		row := it.ReqInfo()
+		res.ReqInfo = append(res.ReqInfo, row)
+		if row.RequestID != "" && !requestIDs[row.RequestID] {
+			requestIDs[row.RequestID] = true
+			ids = append(ids, row.RequestID)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return res, nil
+	}
+
+	raw := &SearchQuery{
+		Query:            rawQ,
+		TimeStart:        s.TimeStart,
+		TimeEnd:          s.TimeEnd,
+		TimeEndInclusive: s.TimeEndInclusive,
+		TimeAscending:    s.TimeAscending,
+		PageSize:         len(res.ReqInfo),
+		FParams:          map[fParam][]string{rawQRequestFieldsMap["request_id"]: ids},
+		AllowedBuckets:   s.AllowedBuckets,
+		RedactColumns:    s.RedactColumns,
+		TimeTruncate:     s.TimeTruncate,
+		DisplayTimeZone:  s.DisplayTimeZone,
+		TraceID:          s.TraceID,
+	}
+	it, err = c.SearchRows(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+	for it.Next() {
+		ev := it.LogEvent()
+		// Request IDs that look like glob patterns are matched with LIKE,
+		// which may select the logs of other requests.
+		if id, _ := ev.Log["requestID"].(string); requestIDs[id] {
+			res.Raw = append(res.Raw, ev)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// containsString returns whether list has s.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
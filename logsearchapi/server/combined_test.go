@@ -0,0 +1,98 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSearchCombinedErrors(t *testing.T) {
+	c := &DBClient{}
+	for _, sq := range []*SearchQuery{
+		{Query: rawQ, PageSize: 10},
+		{Query: joinedQ, PageSize: 10},
+		{Query: reqInfoQ, ExportFormat: "ndjson"},
+		{Query: reqInfoQ, PageSize: 10, DataEnvelope: true},
+		{Query: reqInfoQ, PageSize: 10, Columns: []string{"time", "bucket"}},
+		{Query: reqInfoQ, PageSize: 10, RedactColumns: []string{"request_id"}},
+	} {
+		if _, err := c.SearchCombined(context.Background(), sq); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%+v: got %v, expected an invalid query error", sq, err)
+		}
+	}
+}
+
+func TestSearchCombined(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	now := time.Now()
+	var requestIDs []string
+	for i := 0; i < 4; i++ {
+		event := newTestEvent(now.Add(time.Duration(i)*time.Second), bucket)
+		if i == 3 {
+			// A record of another API, which the search does not match.
+			event["api"].(map[string]interface{})["name"] = "GetObject"
+		}
+		insertTestEventMap(t, c, event)
+		requestIDs = append(requestIDs, event["requestID"].(string))
+	}
+	// A record of another bucket.
+	insertTestEvent(t, c, now, testBucketName())
+
+	last := time.Hour
+	sq := &SearchQuery{
+		Query:        reqInfoQ,
+		LastDuration: &last,
+		PageSize:     2,
+		FParams:      bucketFilter(reqInfoQ, bucket),
+		APINames:     []string{"PutObject"},
+	}
+	res, err := c.SearchCombined(ctx, sq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The page has the 2 most recent matching records, and the raw log
+	// events of the same requests, in the same order.
+	if len(res.ReqInfo) != 2 || len(res.Raw) != 2 {
+		t.Fatalf("got %d records and %d raw log events, expected 2 of each", len(res.ReqInfo), len(res.Raw))
+	}
+	for i, expected := range []string{requestIDs[2], requestIDs[1]} {
+		row, ev := res.ReqInfo[i], res.Raw[i]
+		if row.RequestID != expected || ev.Log["requestID"] != expected {
+			t.Errorf("%d: got request IDs %s and %v, expected %s", i, row.RequestID, ev.Log["requestID"], expected)
+		}
+		api := ev.Log["api"].(map[string]interface{})
+		if row.Bucket != bucket || api["bucket"] != bucket || row.APIName != "PutObject" || api["name"] != "PutObject" {
+			t.Errorf("%d: got %+v and %v, expected records of PutObject in %s", i, row, ev.Log, bucket)
+		}
+	}
+
+	// No raw log events are searched without records.
+	sq.APINames = []string{"DeleteObject"}
+	res, err = c.SearchCombined(ctx, sq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.ReqInfo) != 0 || len(res.Raw) != 0 {
+		t.Errorf("got %+v, expected no records", res)
+	}
+}
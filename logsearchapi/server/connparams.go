@@ -0,0 +1,285 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// sslModes are the sslmode values supported by the Postgres driver.
+var sslModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+// ConnParams are the structured parameters of a connection to Postgres.
+type ConnParams struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	DBName   string
+
+	// SSLMode is one of "disable", "require", "verify-ca" or
+	// "verify-full". When empty, the driver default ("require") applies.
+	SSLMode string
+	// SSLRootCert is the path of the CA certificate(s) file to verify the
+	// server certificate with, e.g. for "verify-full".
+	SSLRootCert string
+}
+
+// ConnString validates the parameters and returns the connection string
+// (a postgres:// URL) they describe, with all values escaped.
+func (p ConnParams) ConnString() (string, error) {
+	if p.Host == "" {
+		return "", fmt.Errorf("Invalid connection parameters: a host is required")
+	}
+	if p.Port < 0 || p.Port > 65535 {
+		return "", fmt.Errorf("Invalid connection parameters: invalid port %d", p.Port)
+	}
+	if p.SSLMode != "" && !isSSLMode(p.SSLMode) {
+		return "", fmt.Errorf("Invalid connection parameters: unsupported sslmode %q (must be one of %v)", p.SSLMode, sslModes)
+	}
+	if p.SSLRootCert != "" && p.SSLMode == "disable" {
+		return "", fmt.Errorf("Invalid connection parameters: sslrootcert may not be given with sslmode disable")
+	}
+
+	return p.url(), nil
+}
+
+// url returns the connection URL described by p.
+func (p ConnParams) url() string {
+	u := url.URL{
+		Scheme: "postgres",
+		Host:   p.Host,
+		Path:   "/" + p.DBName,
+	}
+	if p.Port != 0 {
+		u.Host = net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+	}
+	switch {
+	case p.Password != "":
+		u.User = url.UserPassword(p.User, p.Password)
+	case p.User != "":
+		u.User = url.User(p.User)
+	}
+	q := url.Values{}
+	if p.SSLMode != "" {
+		q.Set("sslmode", p.SSLMode)
+	}
+	if p.SSLRootCert != "" {
+		q.Set("sslrootcert", p.SSLRootCert)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// redactedPassword replaces passwords in the output of String and in
+// connection errors.
+const redactedPassword = "xxxxx"
+
+// String returns the connection string described by p, with its password
+// masked, for logging. Unlike ConnString, it does not validate p.
+func (p ConnParams) String() string {
+	if p.Password != "" {
+		p.Password = redactedPassword
+	}
+	return p.url()
+}
+
+// ParseConnString parses a connection string, either a postgres:// (or
+// postgresql://) URL or a list of keyword=value pairs as accepted by the
+// Postgres driver (e.g. "host=db user=logsearch password='p w'"), into the
+// parameters it sets. The parameters ConnParams does not model, such as
+// connect_timeout, are ignored. The returned errors never include the
+// password.
+func ParseConnString(connStr string) (ConnParams, error) {
+	values, err := connStringValues(connStr)
+	if err != nil {
+		return ConnParams{}, fmt.Errorf("Invalid connection string: %v", err)
+	}
+	p := ConnParams{
+		Host:        values["host"],
+		User:        values["user"],
+		Password:    values["password"],
+		DBName:      values["dbname"],
+		SSLMode:     values["sslmode"],
+		SSLRootCert: values["sslrootcert"],
+	}
+	if port := values["port"]; port != "" {
+		p.Port, err = strconv.Atoi(port)
+		if err != nil || p.Port < 0 || p.Port > 65535 {
+			return ConnParams{}, fmt.Errorf("Invalid connection string: invalid port %q", port)
+		}
+	}
+	return p, nil
+}
+
+// connStringValues returns the parameters set by the connection string
+// connStr, keyed by their keyword. When connStr is malformed, the parameters
+// preceding the error are returned along with it.
+func connStringValues(connStr string) (map[string]string, error) {
+	if isConnURL(connStr) {
+		return connURLValues(connStr)
+	}
+	return connKeywordValues(connStr)
+}
+
+// errMalformedConnURL is returned for connection URLs that do not parse. The
+// error of url.Parse is not returned, as it quotes parts of the URL, which
+// may be parts of the password, e.g. when it has an unescaped slash.
+var errMalformedConnURL = errors.New("malformed URL")
+
+// isConnURL returns true if connStr is a connection URL, rather than a list
+// of keyword=value pairs.
+func isConnURL(connStr string) bool {
+	return strings.HasPrefix(connStr, "postgres://") || strings.HasPrefix(connStr, "postgresql://")
+}
+
+// connURLValues returns the parameters set by the connection URL connStr.
+func connURLValues(connStr string) (map[string]string, error) {
+	u, err := url.Parse(connStr)
+	if err != nil {
+		return nil, errMalformedConnURL
+	}
+
+	values := map[string]string{
+		"host":   u.Hostname(),
+		"port":   u.Port(),
+		"dbname": strings.TrimPrefix(u.Path, "/"),
+	}
+	if u.User != nil {
+		values["user"] = u.User.Username()
+		values["password"], _ = u.User.Password()
+	}
+	for k, vs := range u.Query() {
+		if len(vs) > 0 {
+			values[k] = vs[len(vs)-1]
+		}
+	}
+	return values, nil
+}
+
+// connKeywordValues returns the parameters set by connStr, a list of
+// whitespace-separated keyword=value pairs, where values may be quoted with
+// single quotes and contain backslash-escaped characters.
+func connKeywordValues(connStr string) (map[string]string, error) {
+	values := make(map[string]string)
+	s := []rune(connStr)
+	for i := 0; ; {
+		for i < len(s) && isConnStringSpace(s[i]) {
+			i++
+		}
+		if i == len(s) {
+			return values, nil
+		}
+
+		start := i
+		for i < len(s) && s[i] != '=' && !isConnStringSpace(s[i]) {
+			i++
+		}
+		keyword := string(s[start:i])
+		for i < len(s) && isConnStringSpace(s[i]) {
+			i++
+		}
+		if i == len(s) || s[i] != '=' {
+			return values, fmt.Errorf("missing \"=\" after %q", keyword)
+		}
+		i++
+		for i < len(s) && isConnStringSpace(s[i]) {
+			i++
+		}
+
+		var value []rune
+		quoted := i < len(s) && s[i] == '\''
+		if quoted {
+			i++
+		}
+		for ; i < len(s); i++ {
+			r := s[i]
+			if quoted && r == '\'' || !quoted && isConnStringSpace(r) {
+				break
+			}
+			if r == '\\' && i+1 < len(s) {
+				i++
+				r = s[i]
+			}
+			value = append(value, r)
+		}
+		values[keyword] = string(value)
+		if quoted {
+			if i == len(s) {
+				return values, fmt.Errorf("unterminated quoted value of %q", keyword)
+			}
+			i++
+		}
+	}
+}
+
+func isConnStringSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\v' || r == '\f'
+}
+
+// redactConnError returns err, or an error with the same message but the
+// password of the connection string connStr masked, if the message includes
+// it, e.g. as the driver failed to parse connStr. Since the password of a
+// malformed URL is unknown, the error of the driver, which quotes the URL, is
+// then replaced altogether.
+func redactConnError(err error, connStr string) error {
+	if err == nil {
+		return nil
+	}
+	values, perr := connStringValues(connStr)
+	if perr == errMalformedConnURL {
+		return fmt.Errorf("Invalid connection string: %v", perr)
+	}
+	password := values["password"]
+	if password == "" {
+		return err
+	}
+	msg := err.Error()
+	redacted := msg
+	for _, p := range []string{password, url.QueryEscape(password), url.PathEscape(password)} {
+		redacted = strings.Replace(redacted, p, redactedPassword, -1)
+	}
+	if redacted == msg {
+		return err
+	}
+	return errors.New(redacted)
+}
+
+func isSSLMode(mode string) bool {
+	for _, m := range sslModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// NewDBClientFromParams is like NewDBClient, but connects with the given
+// structured parameters instead of a connection string.
+func NewDBClientFromParams(ctx context.Context, p ConnParams, opts ...DBClientOption) (*DBClient, error) {
+	connStr, err := p.ConnString()
+	if err != nil {
+		return nil, err
+	}
+	return NewDBClient(ctx, connStr, opts...)
+}
@@ -19,8 +19,58 @@ const (
 	QueryAuthTokenEnv = "MINIO_LOG_QUERY_AUTH_TOKEN"
 	// PgConnStrEnv environment variable
 	PgConnStrEnv = "LOGSEARCH_PG_CONN_STR"
+	// PgReplicaConnStrEnv environment variable
+	PgReplicaConnStrEnv = "LOGSEARCH_PG_REPLICA_CONN_STR"
+	// PgHostEnv environment variable
+	PgHostEnv = "LOGSEARCH_PG_HOST"
+	// PgPortEnv environment variable
+	PgPortEnv = "LOGSEARCH_PG_PORT"
+	// PgUserEnv environment variable
+	PgUserEnv = "LOGSEARCH_PG_USER"
+	// PgPasswordEnv environment variable
+	PgPasswordEnv = "LOGSEARCH_PG_PASSWORD"
+	// PgDBNameEnv environment variable
+	PgDBNameEnv = "LOGSEARCH_PG_DBNAME"
+	// PgSSLModeEnv environment variable
+	PgSSLModeEnv = "LOGSEARCH_PG_SSLMODE"
+	// PgSSLRootCertEnv environment variable
+	PgSSLRootCertEnv = "LOGSEARCH_PG_SSLROOTCERT"
 	// AuditAuthTokenEnv environment variable
 	AuditAuthTokenEnv = "LOGSEARCH_AUDIT_AUTH_TOKEN"
+	// AdminAuthTokenEnv environment variable
+	AdminAuthTokenEnv = "LOGSEARCH_ADMIN_AUTH_TOKEN"
 	// DiskCapacityEnv environment variable
 	DiskCapacityEnv = "LOGSEARCH_DISK_CAPACITY_GB"
+	// PartitionIntervalEnv environment variable
+	PartitionIntervalEnv = "LOGSEARCH_PARTITION_INTERVAL"
+	// PartitionModeEnv environment variable
+	PartitionModeEnv = "LOGSEARCH_PARTITION_MODE"
+	// TablePrefixEnv environment variable
+	TablePrefixEnv = "LOGSEARCH_TABLE_PREFIX"
+	// SchemaEnv environment variable
+	SchemaEnv = "LOGSEARCH_PG_SCHEMA"
+	// PartitionCreationWindowEnv environment variable
+	PartitionCreationWindowEnv = "LOGSEARCH_PARTITION_CREATION_WINDOW"
+	// PartitionTablespaceEnv environment variable
+	PartitionTablespaceEnv = "LOGSEARCH_PARTITION_TABLESPACE"
+	// MaxExportRowsEnv environment variable
+	MaxExportRowsEnv = "LOGSEARCH_MAX_EXPORT_ROWS"
+	// MaxResponseBytesEnv environment variable
+	MaxResponseBytesEnv = "LOGSEARCH_MAX_RESPONSE_BYTES"
+	// RequireTimeBoundEnv environment variable
+	RequireTimeBoundEnv = "LOGSEARCH_REQUIRE_TIME_BOUND"
+	// TagStatementsEnv environment variable
+	TagStatementsEnv = "LOGSEARCH_TAG_STATEMENTS"
+	// NotifyInsertsEnv environment variable
+	NotifyInsertsEnv = "LOGSEARCH_NOTIFY_INSERTS"
+	// StoreRawLogEnv environment variable
+	StoreRawLogEnv = "LOGSEARCH_STORE_RAW_LOG"
+	// IngestBufferSizeEnv environment variable
+	IngestBufferSizeEnv = "LOGSEARCH_INGEST_BUFFER_SIZE"
+	// IngestFlushIntervalEnv environment variable
+	IngestFlushIntervalEnv = "LOGSEARCH_INGEST_FLUSH_INTERVAL"
+	// IngestFilterEnv environment variable
+	IngestFilterEnv = "LOGSEARCH_INGEST_FILTER"
+	// RedactColumnsEnv environment variable
+	RedactColumnsEnv = "LOGSEARCH_REDACT_COLUMNS"
 )
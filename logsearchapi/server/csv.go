@@ -0,0 +1,201 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// csvWriter writes CSV records like csv.Writer does, except that some fields
+// may be quoted even when not required. This is used to have CSV consumers
+// that infer column types read such fields as strings.
+type csvWriter struct {
+	w   *bufio.Writer
+	out io.Writer
+
+	// Comma is the field delimiter, set to ',' by newCSVWriter.
+	Comma rune
+
+	// forceQuote[i] is true if the i-th field of each record is always
+	// quoted.
+	forceQuote []bool
+
+	// flushEvery, when positive, is the number of records after which the
+	// records are flushed, see CSVOptions.FlushEvery.
+	flushEvery int
+	records    int
+}
+
+func newCSVWriter(w io.Writer, forceQuote []bool) *csvWriter {
+	return &csvWriter{
+		w:          bufio.NewWriter(w),
+		out:        w,
+		Comma:      ',',
+		forceQuote: forceQuote,
+	}
+}
+
+// Write writes a single CSV record. Writes are buffered, so Flush must be
+// called to ensure the record is written to the underlying io.Writer, unless
+// flushEvery records were written since the last flush.
+func (cw *csvWriter) Write(record []string) error {
+	if err := cw.write(record); err != nil {
+		return err
+	}
+	cw.records++
+	if cw.flushEvery > 0 && cw.records%cw.flushEvery == 0 {
+		if err := cw.Flush(); err != nil {
+			return err
+		}
+		return flushWriter(cw.out)
+	}
+	return nil
+}
+
+func (cw *csvWriter) write(record []string) error {
+	for i, field := range record {
+		if i > 0 {
+			if _, err := cw.w.WriteRune(cw.Comma); err != nil {
+				return err
+			}
+		}
+
+		quote := i < len(cw.forceQuote) && cw.forceQuote[i]
+		if !quote && !fieldNeedsQuotes(field, cw.Comma) {
+			if _, err := cw.w.WriteString(field); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := cw.w.WriteByte('"'); err != nil {
+			return err
+		}
+		if _, err := cw.w.WriteString(strings.ReplaceAll(field, `"`, `""`)); err != nil {
+			return err
+		}
+		if err := cw.w.WriteByte('"'); err != nil {
+			return err
+		}
+	}
+	return cw.w.WriteByte('\n')
+}
+
+// Flush writes any buffered data to the underlying io.Writer.
+func (cw *csvWriter) Flush() error {
+	return cw.w.Flush()
+}
+
+// flushWriter flushes w, if it buffers what is written to it, e.g. an HTTP
+// response or a compressor.
+func flushWriter(w io.Writer) error {
+	switch f := w.(type) {
+	case interface{ Flush() error }:
+		return f.Flush()
+	case http.Flusher:
+		f.Flush()
+	}
+	return nil
+}
+
+// fieldNeedsQuotes reports whether field must be quoted, following the same
+// rules as csv.Writer.
+func fieldNeedsQuotes(field string, comma rune) bool {
+	if field == "" {
+		return false
+	}
+	if field == `\.` || strings.ContainsRune(field, comma) || strings.ContainsAny(field, "\"\r\n") {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(field)
+	return unicode.IsSpace(r)
+}
+
+// CSVOptions customize the csv and tsv exports of a search.
+type CSVOptions struct {
+	// IncludeHeader writes the column names as the first record.
+	IncludeHeader bool
+
+	// Delimiter is the field delimiter, one of csvDelimiters. Zero selects
+	// the delimiter of the export format, i.e. a comma for csv and a tab
+	// for tsv.
+	Delimiter rune
+
+	// FlushEvery, when positive, flushes the records written so far to the
+	// output, e.g. an HTTP response, every FlushEvery records, so that a
+	// large export streams out incrementally instead of being buffered,
+	// e.g. by a proxy. Zero flushes the records only at the end.
+	FlushEvery int
+}
+
+// csvDelimiters are the supported field delimiters. Other characters, e.g.
+// quotes, line breaks or alphanumerics, would make the output ambiguous.
+var csvDelimiters = []rune{',', '\t', '|', ';'}
+
+// isCSVDelimiter returns true if r is one of csvDelimiters.
+func isCSVDelimiter(r rune) bool {
+	for _, d := range csvDelimiters {
+		if r == d {
+			return true
+		}
+	}
+	return false
+}
+
+// csvOptions returns the options of the csv or tsv export of s, defaulting
+// to a header and the delimiter of its export format.
+func (s *SearchQuery) csvOptions() CSVOptions {
+	opts := CSVOptions{IncludeHeader: true}
+	if s.CSVOptions != nil {
+		opts = *s.CSVOptions
+	}
+	if opts.Delimiter == 0 {
+		opts.Delimiter = ','
+		if s.ExportFormat == "tsv" {
+			opts.Delimiter = '\t'
+		}
+	}
+	return opts
+}
+
+// writeCSV writes the header, unless opts leave it out, and then the records
+// written by writeRecords to w, as CSV with the field delimiter of opts.
+// forceQuote is as for newCSVWriter.
+func writeCSV(w io.Writer, opts CSVOptions, header []string, forceQuote []bool, writeRecords func(*csvWriter) error) error {
+	cw := newCSVWriter(w, forceQuote)
+	cw.Comma = opts.Delimiter
+
+	if opts.IncludeHeader {
+		if err := cw.Write(header); err != nil {
+			return &StreamWriteError{Err: err}
+		}
+	}
+	// The header does not count as a record.
+	cw.flushEvery, cw.records = opts.FlushEvery, 0
+	if err := writeRecords(cw); err != nil {
+		return err
+	}
+	if err := cw.Flush(); err != nil {
+		return &StreamWriteError{Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCSVWriter(t *testing.T) {
+	records := [][]string{
+		{"time", "bucket", "size"},
+		{"2022-03-07T00:00:00Z", "photos", "9007199254740993"},
+		{"", `a "quoted", name`, "1"},
+		{" leading space", "multi\nline", ""},
+	}
+
+	testCases := []struct {
+		forceQuote []bool
+		expected   string
+	}{
+		{
+			nil,
+			"time,bucket,size\n" +
+				"2022-03-07T00:00:00Z,photos,9007199254740993\n" +
+				",\"a \"\"quoted\"\", name\",1\n" +
+				"\" leading space\",\"multi\nline\",\n",
+		},
+		{
+			[]bool{false, false, true},
+			"time,bucket,\"size\"\n" +
+				"2022-03-07T00:00:00Z,photos,\"9007199254740993\"\n" +
+				",\"a \"\"quoted\"\", name\",\"1\"\n" +
+				"\" leading space\",\"multi\nline\",\"\"\n",
+		},
+	}
+	for i, testCase := range testCases {
+		var buf bytes.Buffer
+		cw := newCSVWriter(&buf, testCase.forceQuote)
+		for _, record := range records {
+			if err := cw.Write(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := cw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != testCase.expected {
+			t.Errorf("Test %d: got %q, expected %q", i, buf.String(), testCase.expected)
+		}
+
+		// The output must read back as the same records.
+		got, err := csv.NewReader(&buf).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, records) {
+			t.Errorf("Test %d: read back %q, expected %q", i, got, records)
+		}
+	}
+}
+
+func TestWriteCSVTabDelimited(t *testing.T) {
+	header := []string{"object", "user_agent"}
+	records := [][]string{
+		{"photos/a,b.jpg", "MinIO (linux; amd64) minio-go/v7.0.12, mc/2022"},
+		{"tab\there", "plain"},
+	}
+
+	var buf bytes.Buffer
+	err := writeCSV(&buf, (&SearchQuery{ExportFormat: "tsv"}).csvOptions(), header, nil, func(cw *csvWriter) error {
+		for _, record := range records {
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Commas need no quoting in TSV, but tabs do.
+	expected := "object\tuser_agent\n" +
+		"photos/a,b.jpg\tMinIO (linux; amd64) minio-go/v7.0.12, mc/2022\n" +
+		"\"tab\there\"\tplain\n"
+	if buf.String() != expected {
+		t.Errorf("got %q, expected %q", buf.String(), expected)
+	}
+
+	r := csv.NewReader(&buf)
+	r.Comma = '\t'
+	got, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := append([][]string{header}, records...); !reflect.DeepEqual(got, expected) {
+		t.Errorf("read back %q, expected %q", got, expected)
+	}
+}
+
+func TestWriteCSVOptions(t *testing.T) {
+	header := []string{"bucket", "object"}
+	records := [][]string{
+		{"photos", "a|b.jpg"},
+		{"videos", "c,d.mp4"},
+	}
+	testCases := []struct {
+		sq       SearchQuery
+		expected string
+	}{
+		{
+			SearchQuery{ExportFormat: "csv"},
+			"bucket,object\nphotos,a|b.jpg\nvideos,\"c,d.mp4\"\n",
+		},
+		{
+			// Pipes need quoting when delimiting fields, commas do not.
+			SearchQuery{ExportFormat: "csv", CSVOptions: &CSVOptions{Delimiter: '|'}},
+			"photos|\"a|b.jpg\"\nvideos|c,d.mp4\n",
+		},
+		{
+			SearchQuery{ExportFormat: "tsv", CSVOptions: &CSVOptions{IncludeHeader: true}},
+			"bucket\tobject\nphotos\ta|b.jpg\nvideos\tc,d.mp4\n",
+		},
+		{
+			SearchQuery{ExportFormat: "tsv", CSVOptions: &CSVOptions{Delimiter: ';'}},
+			"photos;a|b.jpg\nvideos;c,d.mp4\n",
+		},
+	}
+	for i, testCase := range testCases {
+		var buf bytes.Buffer
+		err := writeCSV(&buf, testCase.sq.csvOptions(), header, nil, func(cw *csvWriter) error {
+			for _, record := range records {
+				if err := cw.Write(record); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if buf.String() != testCase.expected {
+			t.Errorf("Test %d: got %q, expected %q", i, buf.String(), testCase.expected)
+		}
+	}
+}
+
+// flushRecorder is a writer recording what was written to it when flushed.
+type flushRecorder struct {
+	bytes.Buffer
+	flushed []string
+}
+
+func (fr *flushRecorder) Flush() error {
+	fr.flushed = append(fr.flushed, fr.String())
+	return nil
+}
+
+func TestWriteCSVFlushEvery(t *testing.T) {
+	header := []string{"bucket", "object"}
+	writeRecords := func(cw *csvWriter) error {
+		for i := 0; i < 5; i++ {
+			if err := cw.Write([]string{"photos", fmt.Sprintf("%d.jpg", i)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var fr flushRecorder
+	opts := CSVOptions{IncludeHeader: true, Delimiter: ',', FlushEvery: 2}
+	if err := writeCSV(&fr, opts, header, nil, writeRecords); err != nil {
+		t.Fatal(err)
+	}
+	// The header does not count as a record.
+	expected := []string{
+		"bucket,object\nphotos,0.jpg\nphotos,1.jpg\n",
+		"bucket,object\nphotos,0.jpg\nphotos,1.jpg\nphotos,2.jpg\nphotos,3.jpg\n",
+	}
+	if !reflect.DeepEqual(fr.flushed, expected) {
+		t.Errorf("got flushes %q, expected %q", fr.flushed, expected)
+	}
+	if !strings.HasSuffix(fr.String(), "photos,4.jpg\n") {
+		t.Errorf("got %q, expected all the records", fr.String())
+	}
+
+	// By default the records are flushed only at the end, to the buffer.
+	fr = flushRecorder{}
+	opts.FlushEvery = 0
+	if err := writeCSV(&fr, opts, header, nil, writeRecords); err != nil {
+		t.Fatal(err)
+	}
+	if len(fr.flushed) != 0 || strings.Count(fr.String(), "\n") != 6 {
+		t.Errorf("got flushes %q and output %q", fr.flushed, fr.String())
+	}
+
+	// Flushes go through the compressor of the output.
+	var buf bytes.Buffer
+	ew := &encodingWriter{w: &buf, encoding: EncodingGzip}
+	opts.FlushEvery = 2
+	err := writeCSV(ew, opts, header, nil, func(cw *csvWriter) error {
+		if err := cw.Write([]string{"photos", "0.jpg"}); err != nil {
+			return err
+		}
+		if err := cw.Write([]string{"photos", "1.jpg"}); err != nil {
+			return err
+		}
+		// The flushed records can be decompressed before the end.
+		zr, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return err
+		}
+		got, _ := io.ReadAll(zr)
+		if expected := "bucket,object\nphotos,0.jpg\nphotos,1.jpg\n"; string(got) != expected {
+			t.Errorf("got %q flushed, expected %q", got, expected)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,271 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// reqInfoImportBatchSize is the number of records ImportReqInfoCSV inserts
+// in each transaction.
+const reqInfoImportBatchSize = 1000
+
+// ImportRowsError is returned by ImportReqInfoCSV when some records of the
+// CSV are invalid. They are skipped, and the others are imported.
+type ImportRowsError struct {
+	// Failed is the number of records not imported.
+	Failed int
+	// Line is the line of the first of them, and Err its error.
+	Line int
+	Err  error
+}
+
+func (e *ImportRowsError) Error() string {
+	return fmt.Sprintf("%d records not imported, the first at line %d: %v", e.Failed, e.Line, e.Err)
+}
+
+func (e *ImportRowsError) Unwrap() error {
+	return e.Err
+}
+
+// ImportReqInfoCSV imports the request_info records of a CSV, as exported by
+// a reqinfo search with the csv export format and the default CSV options,
+// see ImportReqInfoCSVWithOptions.
+func (c *DBClient) ImportReqInfoCSV(ctx context.Context, r io.Reader) (int, error) {
+	return c.ImportReqInfoCSVWithOptions(ctx, r, nil, "")
+}
+
+// ImportReqInfoCSVWithOptions imports the request_info records of a CSV, as
+// exported by a reqinfo search with the given CSV options and NullAs, so
+// that exports may be edited and imported back, returning the number of
+// records imported. The header names the columns, which may be a subset of
+// the columns in any order, e.g. as exported with SearchQuery.Columns, but
+// must include the time. When opts leave the header out, the records must
+// have all the columns, in order. Fields equal to nullAs are imported as
+// NULL, except in the api_name and version columns, which are not nullable,
+// as are the columns missing from the header.
+//
+// Records that cannot be parsed are skipped, and reported by an
+// *ImportRowsError once the others are imported. The raw logs of the
+// records are not known, so only request_info is imported, and the
+// subscribers of inserts are not notified.
+func (c *DBClient) ImportReqInfoCSVWithOptions(ctx context.Context, r io.Reader, opts *CSVOptions, nullAs string) (int, error) {
+	if err := c.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+	header := reqInfoCSVHeader
+	if opts != nil && opts.Delimiter != 0 {
+		if !isCSVDelimiter(opts.Delimiter) {
+			return 0, fmt.Errorf("Unsupported CSV delimiter %q", opts.Delimiter)
+		}
+		cr.Comma = opts.Delimiter
+	}
+	if opts == nil || opts.IncludeHeader {
+		record, err := cr.Read()
+		if err != nil {
+			return 0, fmt.Errorf("Error reading the CSV header: %v", err)
+		}
+		header = append([]string(nil), record...)
+	}
+	indexes, err := reqInfoImportIndexes(header)
+	if err != nil {
+		return 0, err
+	}
+	cr.FieldsPerRecord = len(header)
+
+	var (
+		imported int
+		rowsErr  *ImportRowsError
+		batch    [][]interface{}
+	)
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		var (
+			line     int
+			parseErr *csv.ParseError
+		)
+		switch {
+		case errors.As(err, &parseErr):
+			line = parseErr.StartLine
+		case err != nil:
+			return imported, fmt.Errorf("Error reading the CSV: %v", err)
+		default:
+			line, _ = cr.FieldPos(0)
+			var values []interface{}
+			if values, err = reqInfoImportValues(record, indexes, nullAs); err == nil {
+				batch = append(batch, values)
+			}
+		}
+		if err != nil {
+			if rowsErr == nil {
+				rowsErr = &ImportRowsError{Line: line, Err: err}
+			}
+			rowsErr.Failed++
+		}
+
+		if len(batch) == reqInfoImportBatchSize {
+			if err := c.importReqInfoBatch(ctx, batch); err != nil {
+				return imported, err
+			}
+			imported += len(batch)
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := c.importReqInfoBatch(ctx, batch); err != nil {
+			return imported, err
+		}
+		imported += len(batch)
+	}
+	if rowsErr != nil {
+		return imported, rowsErr
+	}
+	return imported, nil
+}
+
+// reqInfoImportIndexes returns, for each of the reqInfoInsertColumns, the
+// index of its field in the records of the CSV with the given header, or -1
+// if it is missing.
+func reqInfoImportIndexes(header []string) ([]int, error) {
+	indexes := make([]int, len(reqInfoInsertColumns))
+	for i := range indexes {
+		indexes[i] = -1
+	}
+	for j, name := range header {
+		i := -1
+		for k, col := range reqInfoInsertColumns {
+			if col == name {
+				i = k
+				break
+			}
+		}
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid CSV header: unknown column %q", name)
+		}
+		if indexes[i] >= 0 {
+			return nil, fmt.Errorf("Invalid CSV header: duplicate column %q", name)
+		}
+		indexes[i] = j
+	}
+	if indexes[0] < 0 {
+		return nil, fmt.Errorf("Invalid CSV header: the %s column is required", reqInfoInsertColumns[0])
+	}
+	return indexes, nil
+}
+
+// reqInfoImportValues returns the values of the reqInfoInsertColumns of the
+// CSV record, whose fields are at the given indexes.
+func reqInfoImportValues(record []string, indexes []int, nullAs string) ([]interface{}, error) {
+	values := make([]interface{}, len(reqInfoInsertColumns))
+	for i, col := range reqInfoInsertColumns {
+		j := indexes[i]
+		switch {
+		case col == "api_name" || col == "version":
+			// The columns are not nullable.
+			values[i] = ""
+			if j >= 0 {
+				values[i] = record[j]
+			}
+		case j < 0 || record[j] == nullAs:
+			values[i] = nil
+		case col == "time":
+			t, err := time.Parse(time.RFC3339Nano, record[j])
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", col, record[j])
+			}
+			values[i] = t.Truncate(pgTimePrecision)
+		case reqInfoBigIntColumns[col]:
+			n, err := strconv.ParseUint(record[j], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", col, record[j])
+			}
+			values[i] = n
+		case col == "response_status_code":
+			n, err := strconv.Atoi(record[j])
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", col, record[j])
+			}
+			values[i] = n
+		default:
+			values[i] = record[j]
+		}
+	}
+	if values[0] == nil {
+		return nil, fmt.Errorf("missing %s", reqInfoInsertColumns[0])
+	}
+	return values, nil
+}
+
+// importReqInfoBatch inserts the request_info records of the values of the
+// reqInfoInsertColumns in a single transaction, creating the missing
+// partitions. Duplicates are skipped when DedupeRequestInfo is set.
+func (c *DBClient) importReqInfoBatch(ctx context.Context, batch [][]interface{}) error {
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Insert)
+	defer cancel()
+
+	times := make([]time.Time, len(batch))
+	for i, values := range batch {
+		times[i] = values[0].(time.Time)
+	}
+	err := c.insertCreatingPartitions(ctx, times, func() error {
+		tx, err := c.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = tx.Rollback() }()
+
+		if c.DedupeRequestInfo {
+			// COPY cannot skip duplicates.
+			stmts, err := c.getInsertStmts(ctx)
+			if err != nil {
+				return err
+			}
+			stmt := tx.StmtContext(ctx, stmts.requestInfo)
+			for _, values := range batch {
+				if _, err := stmt.ExecContext(ctx, values...); err != nil {
+					return err
+				}
+			}
+			return tx.Commit()
+		}
+		err = copyRows(ctx, tx, pq.CopyIn(c.reqInfoTable().Name, reqInfoInsertColumns...), len(batch), func(i int) []interface{} {
+			return batch[i]
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return &QueryError{Op: "inserting into", Err: err}
+	}
+	return nil
+}
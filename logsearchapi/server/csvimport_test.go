@@ -0,0 +1,151 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReqInfoImportIndexes(t *testing.T) {
+	indexes, err := reqInfoImportIndexes([]string{"bucket", "time", "api_name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexes[0] != 1 || indexes[1] != 2 || indexes[3] != 0 || indexes[2] != -1 {
+		t.Errorf("got indexes %v", indexes)
+	}
+
+	for _, header := range [][]string{
+		{"api_name", "bucket"},
+		{"time", "log"},
+		{"time", "bucket", "bucket"},
+	} {
+		if _, err := reqInfoImportIndexes(header); err == nil {
+			t.Errorf("%v: expected an invalid header error", header)
+		}
+	}
+}
+
+func TestReqInfoImportValues(t *testing.T) {
+	indexes, err := reqInfoImportIndexes(reqInfoCSVHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := []string{"2022-01-01T10:00:00.1234567+01:00", "PutObject", "NULL", "photos", "a.jpg", "1000", "10.0.0.1", "16C8A0F7", "", "OK", "200", "NULL", "1024", "1"}
+	values, err := reqInfoImportValues(record, indexes, "NULL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The time is truncated as when inserting events. The empty user agent
+	// is not NULL, as NULLs are exported as NULL.
+	expected := []interface{}{
+		time.Date(2022, 1, 1, 9, 0, 0, 123456000, time.UTC),
+		"PutObject", nil, "photos", "a.jpg", uint64(1000), "10.0.0.1", "16C8A0F7", "", "OK", 200, nil, uint64(1024), "1",
+	}
+	if !values[0].(time.Time).Equal(expected[0].(time.Time)) {
+		t.Errorf("got time %v, expected %v", values[0], expected[0])
+	}
+	if !reflect.DeepEqual(values[1:], expected[1:]) {
+		t.Errorf("got %v, expected %v", values[1:], expected[1:])
+	}
+
+	for _, field := range []int{0, 5, 10, 12} {
+		invalid := append([]string(nil), record...)
+		invalid[field] = "x"
+		if _, err := reqInfoImportValues(invalid, indexes, "NULL"); err == nil {
+			t.Errorf("expected invalid %s to fail", reqInfoCSVHeader[field])
+		}
+	}
+}
+
+func TestImportReqInfoCSV(t *testing.T) {
+	src := newTestDBClient(t)
+	const prefix = "csvimport_"
+	dst := newTestDBClient(t, WithTablePrefix(prefix))
+	ctx := context.Background()
+	defer func() {
+		for _, table := range []Table{dst.logEventsTable(), dst.reqInfoTable(), dst.migrationsTable(), dst.watermarksTable()} {
+			if _, err := dst.ExecContext(ctx, "DROP TABLE IF EXISTS "+table.Name); err != nil {
+				t.Errorf("dropping %s: %v", table.Name, err)
+			}
+		}
+	}()
+
+	bucket := testBucketName()
+	now := time.Now()
+	insertTestEvent(t, src, now, bucket)
+	ev := newTestEvent(now.Add(time.Second), bucket)
+	ev["requestHeader"] = map[string]interface{}{"Content-Length": "1024"}
+	insertTestEventMap(t, src, ev)
+
+	export := func(c *DBClient, columns []string) []byte {
+		t.Helper()
+		sq := SearchQuery{
+			Query:         reqInfoQ,
+			ExportFormat:  "csv",
+			TimeAscending: true,
+			FParams:       bucketFilter(reqInfoQ, bucket),
+			Columns:       columns,
+		}
+		var buf bytes.Buffer
+		if err := c.Search(ctx, &sq, &buf); err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	// The records are imported back as they were exported.
+	exported := export(src, nil)
+	n, err := dst.ImportReqInfoCSV(ctx, bytes.NewReader(exported))
+	if err != nil {
+		t.Fatalf("ImportReqInfoCSV failed: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("imported %d records, expected 2", n)
+	}
+	if reimported := export(dst, nil); !bytes.Equal(reimported, exported) {
+		t.Errorf("got %s, expected %s", reimported, exported)
+	}
+
+	// Partial columns are imported too, and invalid records are skipped.
+	if _, err := dst.ExecContext(ctx, "TRUNCATE "+dst.reqInfoTable().Name); err != nil {
+		t.Fatal(err)
+	}
+	columns := []string{"bucket", "time", "api_name"}
+	exported = export(src, columns)
+	n, err = dst.ImportReqInfoCSV(ctx, strings.NewReader(string(exported)+bucket+",yesterday,GetObject\n"))
+	var rowsErr *ImportRowsError
+	if !errors.As(err, &rowsErr) || rowsErr.Failed != 1 || rowsErr.Line != 4 {
+		t.Errorf("expected the invalid record at line 4 to be reported, got %v", err)
+	}
+	if n != 2 {
+		t.Errorf("imported %d records, expected 2", n)
+	}
+	if reimported := export(dst, columns); !bytes.Equal(reimported, exported) {
+		t.Errorf("got %s, expected %s", reimported, exported)
+	}
+
+	if _, err := dst.ImportReqInfoCSV(ctx, strings.NewReader("time,log\n")); err == nil {
+		t.Error("expected an invalid header to fail")
+	}
+}
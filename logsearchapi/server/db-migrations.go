@@ -19,7 +19,7 @@ package server
 import (
 	"context"
 	"fmt"
-	"log"
+	"strings"
 
 	"github.com/lib/pq"
 )
@@ -28,17 +28,72 @@ import (
 // Note: a migration func should be idempotent.
 type dbMigration func(ctx context.Context, c *DBClient) error
 
+// allMigrations lists all migrations in the order they are applied. The
+// schema version reached by applying a migration is its 1-based position in
+// this list, so migrations must only ever be appended.
 var allMigrations = []dbMigration{
 	addAccessKeyCol,
+	addContentLengthCols,
+	addVersionCol,
+	addReqInfoIDCol,
 
 	// Add new migrations here below
 }
 
-func (c *DBClient) runMigrations(ctx context.Context) error {
-	for _, migration := range allMigrations {
+var schemaMigrationsTable = Table{
+	Name: "schema_migrations",
+	CreateStatement: `CREATE TABLE IF NOT EXISTS %s (
+                                    version INT4 PRIMARY KEY,
+                                    applied_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+                                  );`,
+}
+
+// migrationsTable returns the schema_migrations table of the client, named
+// with its table prefix.
+func (c *DBClient) migrationsTable() Table {
+	return schemaMigrationsTable.withPrefix(c.tablePrefix)
+}
+
+// SchemaVersion returns the version of the DB schema, i.e. the number of
+// migrations applied to it. It returns 0 if no migrations were recorded.
+func (c *DBClient) SchemaVersion(ctx context.Context) (int, error) {
+	const maxVersion QTemplate = `SELECT COALESCE(MAX(version), 0) FROM %s;`
+	var version int
+	err := c.QueryRowContext(ctx, maxVersion.build(c.migrationsTable().Name)).Scan(&version)
+	return version, err
+}
+
+func (c *DBClient) recordSchemaVersion(ctx context.Context, version int) error {
+	const insertVersion QTemplate = `INSERT INTO %s (version) VALUES ($1) ON CONFLICT DO NOTHING;`
+	_, err := c.ExecContext(ctx, insertVersion.build(c.migrationsTable().Name), version)
+	return err
+}
+
+// MigrateSchema applies the migrations not yet recorded in the
+// schema_migrations table, recording the version reached after each of them.
+func (c *DBClient) MigrateSchema(ctx context.Context) error {
+	migrationsTable := c.migrationsTable()
+	if _, err := c.ExecContext(ctx, migrationsTable.getCreateStatement()); err != nil {
+		return err
+	}
+
+	current, err := c.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i, migration := range allMigrations {
+		version := i + 1
+		if version <= current {
+			continue
+		}
 		if err := migration(ctx, c); err != nil {
+			return fmt.Errorf("migration to schema version %d failed: %v", version, err)
+		}
+		if err := c.recordSchemaVersion(ctx, version); err != nil {
 			return err
 		}
+		c.logger().Infof("DB schema migrated to version %d", version)
 	}
 	return nil
 }
@@ -59,6 +114,15 @@ func duplicateTblErr(err error) bool {
 	return false
 }
 
+func overlappingPartitionErr(err error) bool {
+	if pqerr, ok := err.(*pq.Error); ok &&
+		pqerr.Code == "42P17" &&
+		strings.Contains(pqerr.Message, "would overlap") {
+		return true
+	}
+	return false
+}
+
 func (c *DBClient) runQueries(ctx context.Context, queries []string, ignoreErr func(error) bool) error {
 	for _, query := range queries {
 		if _, err := c.ExecContext(ctx, query); err != nil {
@@ -74,7 +138,7 @@ func (c *DBClient) runQueries(ctx context.Context, queries []string, ignoreErr f
 // updateAccessKeyCol updates request_info records which where created before
 // the introduction of access_key column.
 func updateAccessKeyCol(ctx context.Context, c *DBClient) {
-	updQ := `WITH req AS (
+	const updQTmpl QTemplate = `WITH req AS (
                              SELECT log->>'requestID' AS request_id,
                                     COALESCE(
                                        substring(
@@ -83,15 +147,16 @@ func updateAccessKeyCol(ctx context.Context, c *DBClient) {
                                        ),
                                        substring(log->'requestHeader'->>'Authorization', e'^AWS\\s+([^:]+)')
                                     ) AS access_key
-                               FROM audit_log_events AS a JOIN request_info AS b ON (a.event_time = b.time)
+                               FROM %[1]s AS a JOIN %[2]s AS b ON (a.event_time = b.time)
                               WHERE b.access_key IS NULL
                            ORDER BY event_time
                               LIMIT $1
                           )
-               UPDATE request_info
+               UPDATE %[2]s
                   SET access_key = req.access_key
                  FROM req
-                WHERE request_info.request_id = req.request_id`
+                WHERE %[2]s.request_id = req.request_id`
+	updQ := updQTmpl.build(c.logEventsTable().Name, c.reqInfoTable().Name)
 
 	for lim := 1000; ; {
 		select {
@@ -102,12 +167,12 @@ func updateAccessKeyCol(ctx context.Context, c *DBClient) {
 
 		res, err := c.ExecContext(ctx, updQ, lim)
 		if err != nil {
-			log.Printf("Failed to update access_key column in request_info: %v", err)
+			c.logger().Errorf("Failed to update access_key column in request_info: %v", err)
 			return
 		}
 
 		if rows, err := res.RowsAffected(); err != nil {
-			log.Printf("Failed to get rows affected: %v", err)
+			c.logger().Errorf("Failed to get rows affected: %v", err)
 			return
 		} else if rows < 1000 {
 			break
@@ -118,8 +183,9 @@ func updateAccessKeyCol(ctx context.Context, c *DBClient) {
 // addAccessKeyCol adds a new column access_key, to request_info table to store
 // API requests access key/user information wherever applicable.
 func addAccessKeyCol(ctx context.Context, c *DBClient) error {
+	const addCol QTemplate = `ALTER table %s ADD access_key text`
 	queries := []string{
-		`ALTER table request_info ADD access_key text`,
+		addCol.build(c.reqInfoTable().Name),
 	}
 	err := c.runQueries(ctx, queries, func(err error) bool {
 		if duplicateColErr(err) {
@@ -130,13 +196,83 @@ func addAccessKeyCol(ctx context.Context, c *DBClient) error {
 		}
 		return false
 	})
-	if err == nil {
-		go updateAccessKeyCol(ctx, c)
+	if err == nil && !c.skipRawLog {
+		// The update may take long, so it runs in the background,
+		// after the migration is recorded. It needs the raw logs.
+		c.runInBackground(func(ctx context.Context) {
+			updateAccessKeyCol(ctx, c)
+		})
 	}
 
 	return err
 }
 
+// addReqInfoIDCol adds the id column of request_info, output by the clients
+// with RequestInfoID set. The column is added without a default, which would
+// rewrite the whole table, and then defaults to the next value of a sequence,
+// so that only the records inserted afterwards are numbered: older records
+// have a NULL id.
+func addReqInfoIDCol(ctx context.Context, c *DBClient) error {
+	const (
+		createSeq  QTemplate = `CREATE SEQUENCE IF NOT EXISTS %s;`
+		addCol     QTemplate = `ALTER TABLE %s ADD COLUMN IF NOT EXISTS id INT8;`
+		setDefault QTemplate = `ALTER TABLE %s ALTER COLUMN id SET DEFAULT nextval('%s');`
+		ownSeq     QTemplate = `ALTER SEQUENCE %s OWNED BY %s.id;`
+	)
+	table := c.reqInfoTable().Name
+	seq := table + "_id_seq"
+	queries := []string{
+		createSeq.build(seq),
+		addCol.build(table),
+		setDefault.build(table, seq),
+		ownSeq.build(seq, table),
+	}
+	for _, q := range queries {
+		if _, err := c.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addContentLengthCols adds the request_content_length and
+// response_content_length columns to request_info tables created before they
+// were introduced, whose records are left with NULL content lengths.
+func addContentLengthCols(ctx context.Context, c *DBClient) error {
+	const addCols QTemplate = `ALTER TABLE %s ADD COLUMN IF NOT EXISTS request_content_length INT8,
+                                                  ADD COLUMN IF NOT EXISTS response_content_length INT8;`
+	_, err := c.ExecContext(ctx, addCols.build(c.reqInfoTable().Name))
+	return err
+}
+
+// addVersionCol adds the version column to request_info tables created
+// before it was introduced, whose records are left with an empty version.
+func addVersionCol(ctx context.Context, c *DBClient) error {
+	const addCol QTemplate = `ALTER TABLE %s ADD COLUMN IF NOT EXISTS version TEXT NOT NULL DEFAULT '';`
+	_, err := c.ExecContext(ctx, addCol.build(c.reqInfoTable().Name))
+	return err
+}
+
+// runInBackground runs fn in a goroutine, with a context cancelled when the
+// client is closed, which waits for fn to return. fn is not run, and false is
+// returned, if the client is already closed.
+func (c *DBClient) runInBackground(fn func(ctx context.Context)) bool {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closed {
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stopMaintainers = append(c.stopMaintainers, cancel)
+	c.maintainers.Add(1)
+
+	go func() {
+		defer c.maintainers.Done()
+		fn(ctx)
+	}()
+	return true
+}
+
 // CreateIndices creates table indexes for audit_log_events and request_info tables.
 // See auditLogIndices, reqInfoIndices functions for actual indices details.
 func (c *DBClient) CreateIndices(ctx context.Context) error {
@@ -145,16 +281,32 @@ func (c *DBClient) CreateIndices(ctx context.Context) error {
 		indices []indexOpts
 	}{
 		{
-			t:       auditLogEventsTable,
-			indices: auditLogIndices(),
+			t:       c.logEventsTable(),
+			indices: auditLogIndices(c.logEventsTable().Name),
 		},
 		{
-			t:       requestInfoTable,
-			indices: reqInfoIndices(),
+			t:       c.reqInfoTable(),
+			indices: reqInfoIndices(c.reqInfoTable().Name),
 		},
 	}
+	if c.skipRawLog {
+		tables = tables[1:]
+	}
 
+	hyper, err := c.hypertables(ctx)
+	if err != nil {
+		return err
+	}
 	for _, table := range tables {
+		if hyper {
+			// Indexes of hypertables are created on their chunks
+			// by TimescaleDB.
+			if err := c.CreateParentIndices(ctx, table.indices); err != nil {
+				return err
+			}
+			continue
+		}
+
 		// The following procedure creates indices on all partitions of
 		// this table. If an index was created on any of its partitions,
 		// it checks if newer partitions were created meanwhile, so as
@@ -218,17 +370,17 @@ func (c *DBClient) CreateParentIndices(ctx context.Context, optses []indexOpts)
 }
 
 // auditLogIndices is a slice of audit_log_events' table indices specified as
-// indexOpt values.
-func auditLogIndices() []indexOpts {
+// indexOpt values, for the table named tableName.
+func auditLogIndices(tableName string) []indexOpts {
 	return []indexOpts{
 		{
-			tableName:   "audit_log_events",
+			tableName:   tableName,
 			indexSuffix: "log",
 			col:         idxCol{name: `(log->>'requestID')`},
 			idxType:     "btree",
 		},
 		{
-			tableName: "audit_log_events",
+			tableName: tableName,
 			col: idxCol{
 				name:  "event_time",
 				order: colDesc,
@@ -237,16 +389,25 @@ func auditLogIndices() []indexOpts {
 	}
 }
 
-// reqInfoIndices is a slice of request_info's table indices specified as indexOpt values.
-func reqInfoIndices() []indexOpts {
+// reqInfoIndices is a slice of request_info's table indices specified as
+// indexOpt values, for the table named tableName.
+func reqInfoIndices(tableName string) []indexOpts {
 	var idxOpts []indexOpts
 	cols := []string{"access_key", "api_name", "bucket", "object", "request_id", "response_status", "time"}
 	for _, col := range cols {
 		idxOpts = append(idxOpts, indexOpts{
-			tableName: "request_info",
+			tableName: tableName,
 			col:       idxCol{name: col},
 		})
 	}
+	// The index is named after its shorter suffix, as the name derived
+	// from the column would exceed the maximum length of Postgres
+	// identifiers with a long table prefix (see maxTablePrefixLen).
+	idxOpts = append(idxOpts, indexOpts{
+		tableName:   tableName,
+		indexSuffix: "status_code",
+		col:         idxCol{name: "response_status_code"},
+	})
 	return idxOpts
 }
 
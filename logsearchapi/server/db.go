@@ -15,17 +15,20 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
-	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/georgysavva/scany/sqlscan"
+	"github.com/lib/pq"
 )
 
 // QTemplate is used to represent queries that involve string substitution as
@@ -40,10 +43,23 @@ func (t QTemplate) build(args ...interface{}) string {
 type Table struct {
 	Name            string
 	CreateStatement QTemplate
+	// TimeColumn, when set, is the column the table is partitioned by. The
+	// CreateStatement of such a table lacks the partitioning clause, which
+	// is added by getCreateStatement, and the final semicolon.
+	TimeColumn string
 }
 
 func (t *Table) getCreateStatement() string {
-	return t.CreateStatement.build(t.Name)
+	if t.TimeColumn == "" {
+		return t.CreateStatement.build(t.Name)
+	}
+	return fmt.Sprintf("%s PARTITION BY RANGE (%s);", t.CreateStatement.build(t.Name), t.TimeColumn)
+}
+
+// getCreateUnpartitionedStatement returns the statement creating the table
+// without partitions, e.g. to turn it into a hypertable.
+func (t *Table) getCreateUnpartitionedStatement() string {
+	return t.CreateStatement.build(t.Name) + ";"
 }
 
 var (
@@ -52,7 +68,8 @@ var (
 		CreateStatement: `CREATE TABLE IF NOT EXISTS %s (
                                     event_time TIMESTAMPTZ NOT NULL,
                                     log JSONB NOT NULL
-                                  ) PARTITION BY RANGE (event_time);`,
+                                  )`,
+		TimeColumn: "event_time",
 	}
 	requestInfoTable = Table{
 		Name: "request_info",
@@ -69,87 +86,648 @@ var (
                                     response_status TEXT,
                                     response_status_code INT8,
                                     request_content_length INT8,
-                                    response_content_length INT8
-                                  ) PARTITION BY RANGE (time);`,
+                                    response_content_length INT8,
+                                    version TEXT NOT NULL DEFAULT ''
+                                  )`,
+		TimeColumn: "time",
 	}
-
-	// Allows iterating on all tables
-	allTables = []Table{auditLogEventsTable, requestInfoTable}
 )
 
+// withPrefix returns the table with its name prefixed by prefix.
+func (t Table) withPrefix(prefix string) Table {
+	t.Name = prefix + t.Name
+	return t
+}
+
+// logEventsTable returns the audit_log_events table of the client, named with
+// its table prefix.
+func (c *DBClient) logEventsTable() Table {
+	return auditLogEventsTable.withPrefix(c.tablePrefix)
+}
+
+// reqInfoTable returns the request_info table of the client, named with its
+// table prefix.
+func (c *DBClient) reqInfoTable() Table {
+	return requestInfoTable.withPrefix(c.tablePrefix)
+}
+
+// tables returns all the tables of the client, for iterating on them. The
+// audit_log_events table is left out when the raw logs are not stored.
+func (c *DBClient) tables() []Table {
+	if c.skipRawLog {
+		return []Table{c.reqInfoTable()}
+	}
+	return []Table{c.logEventsTable(), c.reqInfoTable()}
+}
+
+// maxTablePrefixLen bounds the length of table prefixes, so that the names
+// derived from the table names, the longest of which is the name of an index
+// on a daily partition of request_info (e.g.
+// request_info_d2006_01_02_response_status_index), fit in the 63 bytes of
+// a Postgres identifier. Longer names would be truncated by Postgres, which
+// could make distinct names collide.
+const maxTablePrefixLen = 14
+
+var tablePrefixRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// validateTablePrefix checks that prefix, when not empty, can be used
+// unquoted at the start of table names.
+func validateTablePrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	if !tablePrefixRegexp.MatchString(prefix) {
+		return fmt.Errorf("Invalid table prefix %q: it must consist of lowercase letters, digits and underscores, and not start with a digit", prefix)
+	}
+	if len(prefix) > maxTablePrefixLen {
+		return fmt.Errorf("Invalid table prefix %q: it must be at most %d characters long", prefix, maxTablePrefixLen)
+	}
+	return nil
+}
+
+// WithTablePrefix prefixes the names of the tables of the client, e.g. with
+// "env1_" for the tables env1_audit_log_events and env1_request_info, so that
+// clients with distinct prefixes, e.g. of different environments, may share a
+// database without their tables or partitions colliding. The prefix is
+// validated by NewDBClient.
+func WithTablePrefix(prefix string) DBClientOption {
+	return func(c *DBClient) {
+		c.tablePrefix = prefix
+	}
+}
+
+// WithStoreRawLog selects whether the events are stored in the
+// audit_log_events table, as they are by default, besides their
+// request_info records. When store is false, the audit_log_events table is
+// neither created nor inserted into, which saves the storage of the full
+// JSON events, and searches needing the raw logs fail with
+// ErrRawLogDisabled.
+func WithStoreRawLog(store bool) DBClientOption {
+	return func(c *DBClient) {
+		c.skipRawLog = !store
+	}
+}
+
+// WithRequireTimeBound sets the RequireTimeBound of the client.
+func WithRequireTimeBound(require bool) DBClientOption {
+	return func(c *DBClient) {
+		c.RequireTimeBound = require
+	}
+}
+
+// WithMaxResponseBytes sets the MaxResponseBytes of the client.
+func WithMaxResponseBytes(n int64) DBClientOption {
+	return func(c *DBClient) {
+		c.MaxResponseBytes = n
+	}
+}
+
+// WithPartitionCreationWindow sets the PartitionCreationWindow of the client.
+func WithPartitionCreationWindow(d time.Duration) DBClientOption {
+	return func(c *DBClient) {
+		c.PartitionCreationWindow = d
+	}
+}
+
 // DBClient is a client object that makes requests to the DB.
 type DBClient struct {
 	*sql.DB
+
+	// PartitionInterval is the span of time covered by each newly created
+	// table partition. Existing partitions created with a different interval
+	// remain attached to their tables and readable.
+	PartitionInterval PartitionInterval
+
+	// PrecreatePrevious and PrecreateNext are the numbers of partitions
+	// before and after the current one that are created along with the
+	// tables, e.g. so that a script can insert the logs of the last month.
+	// NewDBClient sets them to DefaultPrecreatePartitions. Negative numbers
+	// count as zero.
+	PrecreatePrevious int
+	PrecreateNext     int
+
+	// PartitionCreationWindow is how far before or after now the time of
+	// an inserted event may be for its missing partition to be created by
+	// the insert (see insertCreatingPartitions), so that events with a
+	// bogus time do not create partitions far in the past or future.
+	// NewDBClient sets it to DefaultPartitionCreationWindow. Zero or
+	// negative durations do not limit the times of the created partitions.
+	PartitionCreationWindow time.Duration
+
+	// Timeouts bounds the duration of the operations of the client.
+	Timeouts Timeouts
+
+	// InsertRetry configures retries of inserts failing due to transient
+	// errors, e.g. during a database failover.
+	InsertRetry RetryPolicy
+
+	// OperationCategories maps API names to operation categories, for
+	// filtering and grouping records by category. APIs missing from it are in
+	// the OperationCategoryOther category. DefaultOperationCategories is used
+	// when it is nil.
+	OperationCategories map[string]string
+
+	// ColdSink receives a copy of every inserted event, for long-term
+	// archival, when ColdSinkEnabled is set. The events are archived in the
+	// background, from a queue of ColdSinkQueueSize events
+	// (DefaultColdSinkQueueSize when zero): events are dropped when it is
+	// full, see ColdSinkDropped. Failures to archive an event are retried
+	// according to ColdSinkRetry and logged, but do not fail the insert into
+	// the DB. Events are only archived once inserted into the DB, so that
+	// the cold sink does not hold events missing from the DB.
+	ColdSink          ColdSink
+	ColdSinkEnabled   bool
+	ColdSinkRetry     RetryPolicy
+	ColdSinkQueueSize int
+
+	// DedupeRequestInfo skips inserting events whose (non-empty) request ID
+	// is already recorded, e.g. events re-sent by MinIO on retries. It
+	// relies on a unique index on the request_id column of each request_info
+	// partition, so duplicates are detected only within a partition, and
+	// only in partitions created while it is set. It must be set before the
+	// first insert.
+	DedupeRequestInfo bool
+
+	// PreserveRawEvent stores the events in the log column of
+	// audit_log_events as received, instead of re-encoding the parsed
+	// events, which drops the fields the parser does not model and
+	// truncates the time to microseconds. Postgres still normalizes the
+	// JSONB it stores, i.e. whitespace, key order and duplicate keys are
+	// not preserved, but all the fields and values are.
+	PreserveRawEvent bool
+
+	// DefaultEventVersion is stored as the version of the request_info
+	// records of events without a version, i.e. of the audit format
+	// produced by MinIO, so that the records can be told apart from those
+	// of later formats.
+	DefaultEventVersion string
+
+	// RequestInfoID has searches of reqinfo records and GetByRequestID
+	// output the id of the records, set from a sequence on insert, and
+	// InsertEventID return it. As request_info is partitioned, the
+	// uniqueness of ids is not enforced, and (time, id) should be used as
+	// the key of the records, which is the order of searches sorted by
+	// time. The records inserted before the id column was added by the
+	// schema migrations have no id, output as 0.
+	RequestInfoID bool
+
+	// MaxPageSize caps the PageSize of searches returning a page of
+	// results, which are buffered and encoded in memory, unlike exports
+	// which stream the results. PageSizePolicy selects what happens to
+	// searches exceeding it. Zero disables the cap; NewDBClient sets it to
+	// DefaultMaxPageSize.
+	MaxPageSize    int
+	PageSizePolicy PageSizePolicy
+
+	// MaxLastDuration caps the LastDuration of searches, as a relative
+	// time range as long as a year scans about as many partitions as an
+	// unbounded search. LastDurationPolicy selects what happens to searches
+	// exceeding it. Zero, the default, disables the cap.
+	MaxLastDuration    time.Duration
+	LastDurationPolicy LastDurationPolicy
+
+	// RequireTimeBound fails the searches that would scan all the
+	// partitions of the tables with ErrUnboundedQuery, i.e. those having
+	// neither a time bound (TimeStart, TimeEnd, LastDuration or
+	// SinceWatermark) nor an exact request ID filter, so that a mistaken
+	// query does not load a shared DB. It is not set by default.
+	RequireTimeBound bool
+
+	// RedactColumns are the columns and log fields redacted from the
+	// records of all the searches of the client, including the lookups of
+	// GetByRequestID, in addition to the RedactColumns of each search, e.g.
+	// for deployments whose viewers may not see access keys. Aggregations
+	// outputting the values of a redacted column, e.g. grouping by it, fail
+	// with an invalid query error. See SearchQuery.RedactColumns.
+	RedactColumns []string
+
+	// TagStatements prefixes the statements of searches with a comment
+	// naming their query type and the TraceID of the search, if any, e.g.
+	// `/* logsearch:reqinfo trace=8f2c... */`, so that they can be told
+	// apart in pg_stat_activity and in the logs of the DB.
+	TagStatements bool
+
+	// MaxExportRows, when positive, bounds the number of records written
+	// by exports, so that a runaway export does not load the DB for long.
+	// An ndjson export of more records ends with a `{"truncated":true}`
+	// record instead of the extra records, while the other export formats
+	// fail with an *ExportLimitError once MaxExportRows records are
+	// written. Zero, the default, means no limit.
+	MaxExportRows int
+
+	// MaxResponseBytes, when positive, bounds the size of the JSON output
+	// of searches returning a page of results, before any compression, as
+	// a few records with huge logs can make a large response even with a
+	// bounded PageSize. Such searches fail with an *ResponseTooLargeError
+	// instead of writing a result exceeding it. Exports, which stream the
+	// results, are not limited. Zero, the default, means no limit.
+	MaxResponseBytes int64
+
+	// IngestFilter lists the rules of the events that are not stored by
+	// inserts, e.g. the requests of health probes, which are skipped like
+	// empty events.
+	IngestFilter []IngestRule
+
+	// EventSanitizer, when set, is called by inserts with each parsed
+	// event before it is encoded, to remove or redact the data that must
+	// not be stored, e.g. the signatures of presigned URLs in object names.
+	// The stored log and the archived event are then encoded from the
+	// sanitized event, even with PreserveRawEvent set.
+	// SanitizerErrorPolicy selects what happens to the events for which it
+	// fails.
+	EventSanitizer       func(*Event) error
+	SanitizerErrorPolicy SanitizerErrorPolicy
+
+	// RetentionPolicy selects the tables whose old partitions are dropped
+	// by EnforceRetention, and after how long.
+	RetentionPolicy RetentionPolicy
+
+	// TailPollInterval is the interval between the polls of Tail for new
+	// records. Zero means DefaultTailPollInterval.
+	TailPollInterval time.Duration
+
+	// TailPollLimit is the maximum number of records selected by a poll of
+	// Tail. Zero means DefaultTailPollLimit.
+	TailPollLimit int
+
+	// NotifyInserts has the inserts of events notify the subscribers of
+	// their request_info records, see Subscribe.
+	NotifyInserts bool
+
+	// Metrics, when set, receives measurements of inserts, searches and
+	// partition creations.
+	Metrics Metrics
+
+	// Logger, when set, receives the log messages of the client, which are
+	// otherwise logged by StdLogger. See WithLogger to set it from
+	// NewDBClient on.
+	Logger Logger
+
+	// BaseFilter is ANDed into the where-clause of every search, regardless
+	// of the filters of the search query.
+	BaseFilter BaseFilter
+
+	// pool is the connection pool configuration applied by NewDBClient.
+	pool PoolConfig
+	// searchSlots holds a value for each running search, when their number
+	// is bounded by pool.MaxSearches.
+	searchSlots chan struct{}
+
+	// healMu guards lastHeal, the time the pool was last healed after a
+	// connection error by healPool.
+	healMu   sync.Mutex
+	lastHeal time.Time
+
+	// connStr is the connection string of the client, for the connections
+	// opened outside of its pool, e.g. by Subscribe.
+	connStr string
+
+	// replica is the connection pool of the read replica of clients created
+	// with NewDBClientWithReplica, see reader, and replicaConnStr its
+	// connection string, set by WithReadReplica.
+	replica        *sql.DB
+	replicaConnStr string
+
+	// schema is the schema of the tables, set by WithSchema. The default
+	// schema is used when it is empty.
+	schema string
+
+	// buffer holds the events queued with QueueEvent, when enabled by
+	// WithIngestBuffer.
+	buffer *ingestBuffer
+
+	// coldSinkQueue holds the events to archive to the cold sink, see
+	// queueArchive, and coldSinkDropped counts the events dropped when it is
+	// full.
+	coldSinkMu      sync.Mutex
+	coldSinkQueue   chan archivedEvent
+	coldSinkDropped int
+
+	// partitionMode is set by WithPartitionMode, and resolved, e.g. by
+	// detecting TimescaleDB, into resolvedPartitionMode by hypertables.
+	partitionMode         PartitionMode
+	partitionModeMu       sync.Mutex
+	resolvedPartitionMode PartitionMode
+
+	// tablePrefix prefixes the names of all the tables of the client, and
+	// so of their partitions and indexes, as set by WithTablePrefix.
+	tablePrefix string
+
+	// partitionTablespace is the tablespace of the partitions created by
+	// the client, and of their indexes, as set by WithPartitionTablespace.
+	// The default tablespace is used when it is empty.
+	partitionTablespace string
+
+	// skipRawLog is set by WithStoreRawLog(false).
+	skipRawLog bool
+
+	// insertStmts are prepared on the first insert.
+	insertStmtsMu sync.Mutex
+	insertStmts   *insertStmts
+
+	// cancels holds the functions canceling the searches registered by
+	// RegisterSearch, by token.
+	cancelsMu sync.Mutex
+	cancels   map[string]context.CancelFunc
+
+	// closed is set by Close, which also stops the partition maintainers
+	// and other background workers with stopMaintainers and waits for
+	// them with maintainers.
+	closeMu         sync.Mutex
+	closed          bool
+	stopMaintainers []context.CancelFunc
+	maintainers     sync.WaitGroup
+}
+
+// DefaultPrecreatePartitions is the PrecreatePrevious and PrecreateNext of
+// clients created with NewDBClient.
+const DefaultPrecreatePartitions = 1
+
+// DefaultPartitionCreationWindow is the PartitionCreationWindow of clients
+// created with NewDBClient.
+const DefaultPartitionCreationWindow = 7 * 24 * time.Hour
+
+// DefaultMaxPageSize is the MaxPageSize of clients created with NewDBClient.
+const DefaultMaxPageSize = 10000
+
+// PageSizePolicy selects how searches with a PageSize above
+// DBClient.MaxPageSize are handled.
+type PageSizePolicy int
+
+const (
+	// PageSizeClamp reduces the page size to the maximum.
+	PageSizeClamp PageSizePolicy = iota
+	// PageSizeReject fails the search with a *ValidationError.
+	PageSizeReject
+)
+
+// LastDurationPolicy selects how searches with a LastDuration above
+// DBClient.MaxLastDuration are handled.
+type LastDurationPolicy int
+
+const (
+	// LastDurationClamp reduces the duration to the maximum.
+	LastDurationClamp LastDurationPolicy = iota
+	// LastDurationReject fails the search with a *ValidationError.
+	LastDurationReject
+)
+
+// checkTimeBound returns ErrUnboundedQuery if the client has
+// RequireTimeBound set and s is not bounded in time nor selects the records
+// of given request IDs.
+func (c *DBClient) checkTimeBound(s *SearchQuery) error {
+	if !c.RequireTimeBound {
+		return nil
+	}
+	if s.TimeStart != nil || s.TimeEnd != nil || s.LastDuration != nil || s.SinceWatermark != "" {
+		return nil
+	}
+	requestIDs := s.FParams[fParam("request_id")]
+	if s.Query == rawQ {
+		requestIDs = s.FParams[rawQRequestFieldsMap["request_id"]]
+	}
+	for _, v := range requestIDs {
+		if v == "" || isGlobPattern(v) {
+			return ErrUnboundedQuery
+		}
+	}
+	if len(requestIDs) == 0 {
+		return ErrUnboundedQuery
+	}
+	return nil
+}
+
+// capPageSize returns the search query to run for s, as per the maximum page
+// size of the client. Exports are not paginated and so are returned as is.
+func (c *DBClient) capPageSize(s *SearchQuery) (*SearchQuery, error) {
+	if c.MaxPageSize <= 0 || s.ExportFormat != "" {
+		return s, nil
+	}
+	size, field := s.PageSize, "PageSize"
+	if s.Limit != nil {
+		size, field = *s.Limit, "Limit"
+	}
+	if size <= c.MaxPageSize {
+		return s, nil
+	}
+	if c.PageSizePolicy == PageSizeReject {
+		return nil, &ValidationError{
+			Field: field,
+			Msg:   fmt.Sprintf("%d exceeds the maximum of %d (use an export format to retrieve more results)", size, c.MaxPageSize),
+		}
+	}
+	capped := *s
+	if s.Limit != nil {
+		limit := c.MaxPageSize
+		capped.Limit = &limit
+	} else {
+		capped.PageSize = c.MaxPageSize
+	}
+	return &capped, nil
+}
+
+// capLastDuration returns the search query to run for s, as per the maximum
+// LastDuration of the client.
+func (c *DBClient) capLastDuration(s *SearchQuery) (*SearchQuery, error) {
+	if c.MaxLastDuration <= 0 || s.LastDuration == nil || *s.LastDuration <= c.MaxLastDuration {
+		return s, nil
+	}
+	if c.LastDurationPolicy == LastDurationReject {
+		return nil, &ValidationError{
+			Field: "LastDuration",
+			Msg:   fmt.Sprintf("%s exceeds the maximum of %s", *s.LastDuration, c.MaxLastDuration),
+		}
+	}
+	capped := *s
+	last := c.MaxLastDuration
+	capped.LastDuration = &last
+	return &capped, nil
 }
 
-// NewDBClient creates a new DBClient.
-func NewDBClient(ctx context.Context, connStr string) (*DBClient, error) {
-	db, err := sql.Open("postgres", connStr)
+// capSearch returns the search query to run for s, applying the page size
+// and LastDuration caps of the client.
+func (c *DBClient) capSearch(s *SearchQuery) (*SearchQuery, error) {
+	s, err := c.capPageSize(s)
 	if err != nil {
 		return nil, err
 	}
-	if err := db.PingContext(ctx); err != nil {
+	return c.capLastDuration(s)
+}
+
+// NewDBClient creates a new DBClient, customized by the given options.
+func NewDBClient(ctx context.Context, connStr string, opts ...DBClientOption) (*DBClient, error) {
+	c := &DBClient{
+		connStr:       withApplicationName(connStr),
+		Timeouts:      DefaultTimeouts,
+		InsertRetry:   DefaultInsertRetryPolicy,
+		ColdSinkRetry: DefaultInsertRetryPolicy,
+		MaxPageSize:   DefaultMaxPageSize,
+		pool:          DefaultPoolConfig,
+
+		PrecreatePrevious:       DefaultPrecreatePartitions,
+		PrecreateNext:           DefaultPrecreatePartitions,
+		PartitionCreationWindow: DefaultPartitionCreationWindow,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if err := validateTablePrefix(c.tablePrefix); err != nil {
+		return nil, err
+	}
+	if err := validateSchema(c.schema); err != nil {
+		return nil, err
+	}
+	if err := validateTablespace(c.partitionTablespace); err != nil {
 		return nil, err
 	}
-	log.Print("Connected to db.")
+	if c.buffer != nil {
+		if err := c.buffer.cfg.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := c.openDB(c.connStr)
+	if err != nil {
+		return nil, redactConnError(err, connStr)
+	}
+	c.DB = db
+	c.pool.apply(db)
+	c.searchSlots = c.pool.newSearchSlots()
 
-	return &DBClient{db}, nil
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, redactConnError(err, connStr)
+	}
+	c.logger().Infof("Connected to db.")
+	if c.replicaConnStr != "" {
+		if err := c.openReplica(ctx); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if c.buffer != nil {
+		c.startFlusher()
+	}
+	return c, nil
 }
 
+// checkTableExists returns true if the table, which may be schema-qualified,
+// exists. Unqualified tables are looked up in the schemas of the search_path,
+// i.e. the schema of the client if set.
 func (c *DBClient) checkTableExists(ctx context.Context, table string) (bool, error) {
-	const existsQuery QTemplate = `SELECT 1 FROM %s WHERE false;`
-	_, err := c.QueryContext(ctx, existsQuery.build(table))
-	if err != nil {
-		// check for table does not exist error
-		if strings.Contains(err.Error(), fmt.Sprintf(`relation "%s" does not exist`, table)) {
-			return false, nil
-		}
+	const existsQuery = `SELECT to_regclass($1) IS NOT NULL;`
+	var exists bool
+	if err := c.QueryRowContext(ctx, existsQuery, table).Scan(&exists); err != nil {
 		return false, err
 	}
-	return true, nil
+	return exists, nil
 }
 
-func (c *DBClient) checkPartitionTableExists(ctx context.Context, table string, givenTime time.Time) (bool, error) {
+func (c *DBClient) checkPartitionTableExists(ctx context.Context, table Table, givenTime time.Time) (bool, error) {
 	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
 
-	p := newPartitionTimeRange(givenTime)
-	partitionTable := fmt.Sprintf("%s_%s", table, p.getPartnameSuffix())
-	return c.checkTableExists(ctx, partitionTable)
+	p := newPartitionTimeRange(givenTime, c.PartitionInterval)
+	return c.checkTableExists(ctx, table.getPartitionName(p))
 }
 
 func (c *DBClient) createTablePartition(ctx context.Context, table Table, givenTime time.Time) error {
-	partTimeRange := newPartitionTimeRange(givenTime)
-	_, err := c.ExecContext(ctx, table.getCreatePartitionStatement(partTimeRange))
-	return err
+	partTimeRange := newPartitionTimeRange(givenTime, c.PartitionInterval)
+	_, err := c.ExecContext(ctx, table.getCreatePartitionStatement(partTimeRange, c.partitionTablespace))
+	if overlappingPartitionErr(err) {
+		// The time range is (at least partly) covered by a partition
+		// created with a different partition interval.
+		c.logger().Warnf("Partition %s not created: %v", table.getPartitionName(partTimeRange), err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	partition := table.getPartitionName(partTimeRange)
+	if c.DedupeRequestInfo && table.Name == c.reqInfoTable().Name {
+		// Without the index duplicates are inserted, so do not fail
+		// e.g. when the partition already has duplicates.
+		if err := c.createRequestIDUniqueIndex(ctx, partition); err != nil {
+			c.logger().Warnf("Request IDs in partition %s will not be deduplicated: %v", partition, err)
+		}
+	}
+	return nil
+}
+
+const createRequestIDUniqueIndex QTemplate = `CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (request_id)%s WHERE request_id <> '';`
+
+// createRequestIDUniqueIndex creates a unique index on the non-empty request
+// IDs of the request_info partition, unless it already exists.
+func (c *DBClient) createRequestIDUniqueIndex(ctx context.Context, partition string) error {
+	indexName := fmt.Sprintf("%s_request_id_uniq", partition)
+	if _, err := c.ExecContext(ctx, createRequestIDUniqueIndex.build(indexName, partition, tablespaceClause(c.partitionTablespace))); err != nil {
+		return fmt.Errorf("Error creating index %s: %v", indexName, err)
+	}
+	return nil
+}
+
+// partitionStatements returns the statements creating the partition of the
+// table for p along with its indexes, as createTablePartition does, to be run
+// in a batch.
+func (c *DBClient) partitionStatements(table Table, p partitionTimeRange) []string {
+	partition := table.getPartitionName(p)
+	stmts := []string{table.getCreatePartitionStatement(p, c.partitionTablespace)}
+	if c.DedupeRequestInfo && table.Name == c.reqInfoTable().Name {
+		indexName := fmt.Sprintf("%s_request_id_uniq", partition)
+		stmts = append(stmts, createRequestIDUniqueIndex.build(indexName, partition, tablespaceClause(c.partitionTablespace)))
+	}
+	return stmts
 }
 
 func (c *DBClient) createTableAndPartition(ctx context.Context, table Table) error {
+	hyper, err := c.hypertables(ctx)
+	if err != nil {
+		return err
+	}
+	if hyper {
+		// TimescaleDB creates the chunks of the table as needed.
+		return c.createHypertable(ctx, table)
+	}
+
 	if _, err := c.ExecContext(ctx, table.getCreateStatement()); err != nil {
 		return err
 	}
 
-	// Tables are partitioned such that there are 4 partitions per month. At
-	// startup we create the partitions for the current time along with the
-	// "previous" and next "partitions". The partition for the past is created
-	// only to enable some amount of manual data insertion via a script.
-	now := time.Now()
-	partitionNow := newPartitionTimeRange(now)
-	partitionTimes := []time.Time{
-		partitionNow.previous().StartDate,
-		now,
-		partitionNow.next().StartDate,
-	}
-	for _, pt := range partitionTimes {
-		if err := c.createTablePartition(ctx, table, pt); err != nil {
+	// Tables are partitioned according to c.PartitionInterval. At startup we
+	// create the partitions for the current time along with the "previous"
+	// and "next" partitions. The partitions for the past are created only to
+	// enable some amount of manual data insertion via a script.
+	for _, p := range c.precreatedPartitions(time.Now()) {
+		if err := c.createTablePartition(ctx, table, p.StartDate); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// precreatedPartitions returns the partitions created along with the tables
+// at the given time: the current one, with PrecreatePrevious partitions
+// before it and PrecreateNext partitions after it, in order.
+func (c *DBClient) precreatedPartitions(now time.Time) []partitionTimeRange {
+	current := newPartitionTimeRange(now, c.PartitionInterval)
+	p := current
+	for i := 0; i < c.PrecreatePrevious; i++ {
+		p = p.previous()
+	}
+	partitions := []partitionTimeRange{p}
+	for p.StartDate.Before(current.StartDate) {
+		p = p.next()
+		partitions = append(partitions, p)
+	}
+	for i := 0; i < c.PrecreateNext; i++ {
+		p = p.next()
+		partitions = append(partitions, p)
+	}
+	return partitions
+}
+
 func (c *DBClient) createTables(ctx context.Context) error {
-	for _, table := range allTables {
+	for _, table := range c.tables() {
 		if err := c.createTableAndPartition(ctx, table); err != nil {
 			return err
 		}
@@ -157,102 +735,658 @@ func (c *DBClient) createTables(ctx context.Context) error {
 	return nil
 }
 
-// InitDBTables Creates tables in the DB.
+// InitDBTables Creates tables in the DB, and brings the tables created by
+// previous versions up to date by applying the missing migrations (see
+// MigrateSchema). Concurrent calls, e.g. by replicas starting at the same
+// time, are serialized with an advisory lock, so that they do not race on
+// creating the same tables and partitions, or on migrating them.
 func (c *DBClient) InitDBTables(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Init)
 	defer cancel()
 
-	return c.createTables(ctx)
+	return c.withAdvisoryLock(ctx, initLockKey, func() error {
+		if err := c.createSchema(ctx); err != nil {
+			return err
+		}
+		if err := c.createTables(ctx); err != nil {
+			return err
+		}
+		if err := c.MigrateSchema(ctx); err != nil {
+			return err
+		}
+		watermarksTable := c.watermarksTable()
+		_, err := c.ExecContext(ctx, watermarksTable.getCreateStatement())
+		return err
+	})
 }
 
-// InsertEvent inserts audit event in the DB.
-func (c *DBClient) InsertEvent(ctx context.Context, eventBytes []byte) (err error) {
-	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+// HealthCheck verifies that the DB is reachable and that the audit log tables
+// and their partitions for the current time exist, returning an error naming
+// the first missing object. It does not modify the DB, so it is suitable for a
+// readiness probe. Partitions are not checked for hypertables, whose chunks
+// are created on insert.
+func (c *DBClient) HealthCheck(ctx context.Context) error {
+	if err := c.checkOpen(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
 
-	if isEmptyEvent(eventBytes) {
-		return nil
+	if err := c.PingContext(ctx); err != nil {
+		return fmt.Errorf("Error connecting to db: %v", err)
 	}
 
-	// Log the event-data if we are unable to save it in db for some reason.
-	defer func() {
+	hyper, err := c.hypertables(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, table := range c.tables() {
+		exists, err := c.checkTableExists(ctx, table.Name)
+		if err != nil {
+			return fmt.Errorf("Error checking table %s: %v", table.Name, err)
+		}
+		if !exists {
+			return fmt.Errorf("Table %s does not exist", table.Name)
+		}
+		if hyper {
+			continue
+		}
+
+		exists, err = c.checkPartitionTableExists(ctx, table, now)
 		if err != nil {
-			log.Printf("audit event not saved: %s (cause: %v)", string(eventBytes), err)
+			return fmt.Errorf("Error checking current partition of %s: %v", table.Name, err)
+		}
+		if !exists {
+			p := newPartitionTimeRange(now, c.PartitionInterval)
+			return fmt.Errorf("Partition %s does not exist", table.getPartitionName(p))
 		}
+	}
+	return nil
+}
+
+// InsertEvent inserts audit event in the DB. Events matching the
+// IngestFilter are skipped.
+func (c *DBClient) InsertEvent(ctx context.Context, eventBytes []byte) error {
+	_, err := c.InsertEventID(ctx, eventBytes)
+	return err
+}
+
+// InsertEventID is like InsertEvent, but also returns the id of the
+// request_info record of the event when the client has RequestInfoID set.
+// The id is 0 when no record is inserted, e.g. for events matching the
+// IngestFilter or duplicates skipped as per DedupeRequestInfo.
+func (c *DBClient) InsertEventID(ctx context.Context, eventBytes []byte) (id int64, err error) {
+	if err := c.checkOpen(); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	defer func() {
+		c.metrics().ObserveInsert(time.Since(start), err)
 	}()
 
+	if isEmptyEvent(eventBytes) {
+		return 0, nil
+	}
+
 	event, err := parseJSONEvent(eventBytes)
 	if err != nil {
+		// Log the event-data as we are unable to save it in db.
+		c.logUnsavedEvent(eventBytes, err)
+		return 0, err
+	}
+	return c.insertParsedEvent(ctx, event, eventBytes)
+}
+
+// InsertParsedEvent is like InsertEvent, but inserts an already parsed audit
+// event, e.g. received from a channel of events, which saves encoding it to
+// JSON only for InsertEvent to parse it again. The event is not modified.
+func (c *DBClient) InsertParsedEvent(ctx context.Context, event *Event) (err error) {
+	if err := c.checkOpen(); err != nil {
 		return err
 	}
+	start := time.Now()
+	defer func() {
+		c.metrics().ObserveInsert(time.Since(start), err)
+	}()
 
-	const (
-		insertAuditLogEvent QTemplate = `INSERT INTO %s (event_time, log) VALUES ($1, $2);`
-		insertRequestInfo   QTemplate = `INSERT INTO %s (time,
-                                                                 api_name,
-                                                                 access_key,
-                                                                 bucket,
-                                                                 object,
-                                                                 time_to_response_ns,
-                                                                 remote_host,
-                                                                 request_id,
-                                                                 user_agent,
-                                                                 response_status,
-                                                                 response_status_code,
-                                                                 request_content_length,
-                                                                 response_content_length)
-                                                   VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13);`
-	)
+	_, err = c.insertParsedEvent(ctx, event, nil)
+	return err
+}
 
-	// Start a database transaction
-	tx, err := c.BeginTx(ctx, nil)
+// insertParsedEvent inserts the parsed audit event, archiving it in the cold
+// sink once inserted, and logs it if it cannot be inserted. eventBytes is the JSON of the
+// event as received, if any, which is stored, archived and logged instead of
+// the encoded event when set, unless the event is sanitized. It returns the id
+// of the request_info record, as InsertEventID.
+func (c *DBClient) insertParsedEvent(ctx context.Context, event *Event, eventBytes []byte) (id int64, err error) {
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Insert)
+	defer cancel()
+
+	ev, err := c.encodeParsedEvent(event, eventBytes)
 	if err != nil {
-		return err
+		c.logUnsavedEvent(eventBytes, err)
+		if c.skipsUnsanitized(err) {
+			return 0, nil
+		}
+		return 0, err
 	}
-	defer func() { _ = tx.Rollback() }()
-
-	// NOTE: Timestamps are nanosecond resolution from MinIO, however we are
-	// using storing it with only microsecond precision in PG for simplicity
-	// as that is the maximum precision supported by it.
-	eventJSON, errJSON := json.Marshal(event)
-	if errJSON != nil {
-		return errJSON
+	if eventBytes == nil || c.EventSanitizer != nil {
+		eventBytes = ev.JSON
 	}
-	_, err = tx.ExecContext(ctx, insertAuditLogEvent.build(auditLogEventsTable.Name), event.Time, eventJSON)
+	if c.ignoredEvent(ev.Event) {
+		return 0, nil
+	}
+
+	err = c.insertCreatingPartitions(ctx, []time.Time{ev.Time}, func() (err error) {
+		id, err = c.insertEventTx(ctx, ev)
+		return err
+	})
 	if err != nil {
+		// Log the event-data as we are unable to save it in db.
+		c.logUnsavedEvent(eventBytes, err)
+		return id, err
+	}
+	if c.ColdSinkEnabled && c.ColdSink != nil {
+		c.queueArchive(ev.Time, eventBytes)
+	}
+	return id, nil
+}
+
+// missingPartitionErr returns true if the error is from inserting a row in a
+// partitioned table without a partition for the time of the row.
+func missingPartitionErr(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) &&
+		pqErr.Code == "23514" && // check_violation
+		strings.HasPrefix(pqErr.Message, "no partition of relation")
+}
+
+// insertCreatingPartitions runs insert, retrying it on transient errors, and
+// healing the pool first on connection errors (see healPool). If
+// it fails because there is no partition for one of the given event times,
+// e.g. after a clock skew or when the partitions maintenance is late, the
+// partitions of the times are created and insert is run once more, so that
+// the events are not lost. No partition is created, and the error is
+// returned, if one of the times is further from now than the
+// PartitionCreationWindow of the client.
+func (c *DBClient) insertCreatingPartitions(ctx context.Context, times []time.Time, insert func() error) error {
+	insert = c.healing(insert)
+	err := retryTransient(ctx, c.InsertRetry, insert)
+	if !missingPartitionErr(err) {
 		return err
 	}
+	if t, ok := c.outsidePartitionCreationWindow(times, time.Now()); ok {
+		return fmt.Errorf("not creating the partition of event time %s, more than %s from now: %w",
+			t.Format(time.RFC3339), c.PartitionCreationWindow, err)
+	}
+	c.logger().Warnf("Creating the missing partitions of the inserted events: %v", err)
 
-	var reqLen *uint64
-	rqlen, err := event.getRequestContentLength()
-	if err == nil {
-		reqLen = &rqlen
+	starts := make(map[time.Time]bool)
+	for _, t := range times {
+		starts[newPartitionTimeRange(t, c.PartitionInterval).StartDate] = true
 	}
-	var respLen *uint64
-	rsplen, err := event.getResponseContentLength()
-	if err == nil {
-		respLen = &rsplen
+	for _, table := range c.tables() {
+		for start := range starts {
+			if err := c.createTablePartition(ctx, table, start); err != nil {
+				return err
+			}
+		}
 	}
+	return retryTransient(ctx, c.InsertRetry, insert)
+}
 
-	_, err = tx.ExecContext(ctx, insertRequestInfo.build(requestInfoTable.Name),
-		event.Time,
-		event.API.Name,
-		event.API.AccessKey,
-		event.API.Bucket,
-		event.API.Object,
-		event.API.TimeToResponse,
-		event.RemoteHost,
-		event.RequestID,
-		event.UserAgent,
-		event.API.Status,
-		event.API.StatusCode,
-		reqLen,
-		respLen)
-	if err != nil {
-		return err
+// outsidePartitionCreationWindow returns the first of the times further from
+// now than the PartitionCreationWindow of the client, if any.
+func (c *DBClient) outsidePartitionCreationWindow(times []time.Time, now time.Time) (time.Time, bool) {
+	if c.PartitionCreationWindow <= 0 {
+		return time.Time{}, false
 	}
+	earliest, latest := now.Add(-c.PartitionCreationWindow), now.Add(c.PartitionCreationWindow)
+	for _, t := range times {
+		if t.Before(earliest) || t.After(latest) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
 
-	return tx.Commit()
+// encodedEvent is an audit event ready to be inserted.
+type encodedEvent struct {
+	*Event
+	// JSON is stored in the log column of audit_log_events.
+	JSON []byte
+	// version is stored in the version column of request_info.
+	version string
+}
+
+// encodeEvent parses the audit event eventBytes for inserting it.
+func (c *DBClient) encodeEvent(eventBytes []byte) (encodedEvent, error) {
+	event, err := parseJSONEvent(eventBytes)
+	if err != nil {
+		return encodedEvent{}, err
+	}
+	return c.encodeParsedEvent(event, eventBytes)
+}
+
+// encodeParsedEvent returns a copy of the parsed audit event ready for
+// inserting it, sanitized by the EventSanitizer of the client, if any.
+// eventBytes is the JSON it was parsed from, if any, which is stored when
+// PreserveRawEvent is set and the event is not sanitized.
+func (c *DBClient) encodeParsedEvent(event *Event, eventBytes []byte) (encodedEvent, error) {
+	// NOTE: Timestamps are nanosecond resolution from MinIO, however we are
+	// using storing it with only microsecond precision in PG for simplicity
+	// as that is the maximum precision supported by it. The time is
+	// truncated explicitly, as PG would otherwise round it, and so that the
+	// time in the stored log matches the time column.
+	ev := *event
+	if c.EventSanitizer != nil {
+		if err := c.sanitizeEvent(&ev); err != nil {
+			return encodedEvent{}, err
+		}
+		// eventBytes holds the data removed by the sanitizer.
+		eventBytes = nil
+	}
+	ev.Time = ev.Time.Truncate(pgTimePrecision)
+	// eventBytes is valid JSON, as it was parsed.
+	eventJSON := eventBytes
+	if !c.PreserveRawEvent || eventBytes == nil {
+		var err error
+		eventJSON, err = json.Marshal(&ev)
+		if err != nil {
+			return encodedEvent{}, err
+		}
+	}
+	version := ev.Version
+	if version == "" {
+		version = c.DefaultEventVersion
+	}
+	return encodedEvent{Event: &ev, JSON: eventJSON, version: version}, nil
+}
+
+// reqInfoInsertColumns are the request_info columns set by inserts, in the
+// order of insertRequestInfo.
+var reqInfoInsertColumns = []string{
+	"time",
+	"api_name",
+	"access_key",
+	"bucket",
+	"object",
+	"time_to_response_ns",
+	"remote_host",
+	"request_id",
+	"user_agent",
+	"response_status",
+	"response_status_code",
+	"request_content_length",
+	"response_content_length",
+	"version",
+}
+
+// reqInfoValues returns the values of the request_info columns of the event,
+// in the order of reqInfoInsertColumns.
+func (ev encodedEvent) reqInfoValues() []interface{} {
+	var reqLen *uint64
+	rqlen, err := ev.getRequestContentLength()
+	if err == nil {
+		reqLen = &rqlen
+	}
+	var respLen *uint64
+	rsplen, err := ev.getResponseContentLength()
+	if err == nil {
+		respLen = &rsplen
+	}
+
+	return []interface{}{
+		ev.Time,
+		ev.API.Name,
+		ev.API.AccessKey,
+		ev.API.Bucket,
+		ev.API.Object,
+		ev.API.TimeToResponse,
+		ev.RemoteHost,
+		ev.RequestID,
+		ev.UserAgent,
+		ev.API.Status,
+		ev.API.StatusCode,
+		reqLen,
+		respLen,
+		ev.version,
+	}
+}
+
+// insertEventTx inserts the event into all tables in a single transaction.
+func (c *DBClient) insertEventTx(ctx context.Context, ev encodedEvent) (int64, error) {
+	stmts, err := c.getInsertStmts(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// Start a database transaction
+	tx, err := c.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	id, inserted, err := stmts.insert(ctx, tx, ev, c.DedupeRequestInfo)
+	if err != nil {
+		return 0, err
+	}
+	if inserted && c.NotifyInserts {
+		if err := c.notifyInserted(ctx, tx, []encodedEvent{ev}); err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+// insert inserts the event into all tables within the transaction tx,
+// returning whether it was inserted, and the id of its request_info record
+// if the statements return it. When dedupe is set, duplicate events, i.e.
+// whose request_info record is not inserted, are skipped.
+func (stmts *insertStmts) insert(ctx context.Context, tx *sql.Tx, ev encodedEvent, dedupe bool) (id int64, inserted bool, err error) {
+	stmt := tx.StmtContext(ctx, stmts.requestInfo)
+	if stmts.returningID {
+		err := stmt.QueryRowContext(ctx, ev.reqInfoValues()...).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			// The event is a duplicate - do not insert its log either.
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+	} else {
+		res, err := stmt.ExecContext(ctx, ev.reqInfoValues()...)
+		if err != nil {
+			return 0, false, err
+		}
+		if dedupe {
+			n, err := res.RowsAffected()
+			if err != nil {
+				return 0, false, err
+			}
+			if n == 0 {
+				// The event is a duplicate - do not insert its log either.
+				return 0, false, nil
+			}
+		}
+	}
+
+	if stmts.auditLogEvent == nil {
+		// The raw logs are not stored.
+		return id, true, nil
+	}
+	_, err = tx.StmtContext(ctx, stmts.auditLogEvent).ExecContext(ctx, ev.Time, ev.JSON)
+	return id, err == nil, err
+}
+
+// InsertEvents inserts a batch of audit events in the DB, in a single
+// transaction using COPY, which is much cheaper than inserting the events one
+// by one. Events that cannot be parsed are logged and skipped, and events
+// matching the IngestFilter are skipped. If the batch cannot be inserted, its
+// events are logged and the error is returned. Events for which the
+// EventSanitizer fails are handled as per the SanitizerErrorPolicy.
+//
+// COPY cannot skip duplicates, so when DedupeRequestInfo is set the events
+// are inserted with INSERT statements, still in a single transaction.
+func (c *DBClient) InsertEvents(ctx context.Context, events [][]byte) error {
+	if err := c.checkOpen(); err != nil {
+		return err
+	}
+	return c.insertBatch(ctx, events)
+}
+
+func (c *DBClient) insertBatch(ctx context.Context, events [][]byte) error {
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Insert)
+	defer cancel()
+
+	var (
+		batch      []encodedEvent
+		batchBytes [][]byte
+	)
+	for _, eventBytes := range events {
+		if isEmptyEvent(eventBytes) {
+			continue
+		}
+		ev, err := c.encodeEvent(eventBytes)
+		if err != nil {
+			c.logUnsavedEvent(eventBytes, err)
+			var sErr *SanitizerError
+			if errors.As(err, &sErr) && c.SanitizerErrorPolicy == SanitizerFailInsert {
+				return err
+			}
+			continue
+		}
+		if c.EventSanitizer != nil {
+			eventBytes = ev.JSON
+		}
+		if c.ignoredEvent(ev.Event) {
+			continue
+		}
+		batch = append(batch, ev)
+		batchBytes = append(batchBytes, eventBytes)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	times := make([]time.Time, len(batch))
+	for i, ev := range batch {
+		times[i] = ev.Time
+	}
+	err := c.insertCreatingPartitions(ctx, times, func() error {
+		return c.insertBatchTx(ctx, batch)
+	})
+	if err != nil {
+		for _, eventBytes := range batchBytes {
+			c.logUnsavedEvent(eventBytes, err)
+		}
+		return err
+	}
+	if c.ColdSinkEnabled && c.ColdSink != nil {
+		for i, eventBytes := range batchBytes {
+			c.queueArchive(batch[i].Time, eventBytes)
+		}
+	}
+	return nil
+}
+
+// insertBatchTx inserts the events into all tables in a single transaction.
+func (c *DBClient) insertBatchTx(ctx context.Context, batch []encodedEvent) error {
+	tx, err := c.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if c.DedupeRequestInfo {
+		stmts, err := c.getInsertStmts(ctx)
+		if err != nil {
+			return err
+		}
+		var inserted []encodedEvent
+		for _, ev := range batch {
+			_, ok, err := stmts.insert(ctx, tx, ev, true)
+			if err != nil {
+				return err
+			}
+			if ok {
+				inserted = append(inserted, ev)
+			}
+		}
+		if c.NotifyInserts {
+			if err := c.notifyInserted(ctx, tx, inserted); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+
+	err = copyRows(ctx, tx, pq.CopyIn(c.reqInfoTable().Name, reqInfoInsertColumns...), len(batch), func(i int) []interface{} {
+		return batch[i].reqInfoValues()
+	})
+	if err != nil {
+		return err
+	}
+	if !c.skipRawLog {
+		err = copyRows(ctx, tx, pq.CopyIn(c.logEventsTable().Name, "event_time", "log"), len(batch), func(i int) []interface{} {
+			// The JSON is passed as text, as COPY would encode
+			// bytes as bytea.
+			return []interface{}{batch[i].Time, string(batch[i].JSON)}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if c.NotifyInserts {
+		if err := c.notifyInserted(ctx, tx, batch); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// copyRows runs the COPY statement copyStmt within tx, for n rows whose
+// values are returned by row.
+func copyRows(ctx context.Context, tx *sql.Tx, copyStmt string, n int, row func(i int) []interface{}) error {
+	stmt, err := tx.PrepareContext(ctx, copyStmt)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i := 0; i < n; i++ {
+		if _, err := stmt.ExecContext(ctx, row(i)...); err != nil {
+			return err
+		}
+	}
+	// Flush the copied rows.
+	_, err = stmt.ExecContext(ctx)
+	return err
+}
+
+// insertStmts are the prepared statements inserting an event into the tables.
+type insertStmts struct {
+	// auditLogEvent is nil when the raw logs are not stored.
+	auditLogEvent *sql.Stmt
+	requestInfo   *sql.Stmt
+	// returningID is set when requestInfo returns the id of the record.
+	returningID bool
+}
+
+// getInsertStmts returns the prepared statements for inserting events,
+// preparing them on first use. The statements depend on DedupeRequestInfo and
+// RequestInfoID as set at that time.
+func (c *DBClient) getInsertStmts(ctx context.Context) (*insertStmts, error) {
+	const (
+		insertAuditLogEvent QTemplate = `INSERT INTO %s (event_time, log) VALUES ($1, $2);`
+		insertRequestInfo   QTemplate = `INSERT INTO %s (time,
+                                                                 api_name,
+                                                                 access_key,
+                                                                 bucket,
+                                                                 object,
+                                                                 time_to_response_ns,
+                                                                 remote_host,
+                                                                 request_id,
+                                                                 user_agent,
+                                                                 response_status,
+                                                                 response_status_code,
+                                                                 request_content_length,
+                                                                 response_content_length,
+                                                                 version)
+                                                   VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+                                              %s;`
+	)
+
+	c.insertStmtsMu.Lock()
+	defer c.insertStmtsMu.Unlock()
+
+	if c.insertStmts != nil {
+		return c.insertStmts, nil
+	}
+
+	onConflict := ""
+	if c.DedupeRequestInfo {
+		onConflict = "ON CONFLICT DO NOTHING"
+	}
+	if c.RequestInfoID {
+		onConflict += " RETURNING id"
+	}
+
+	var auditLogEvent *sql.Stmt
+	if !c.skipRawLog {
+		stmt, err := c.PrepareContext(ctx, insertAuditLogEvent.build(c.logEventsTable().Name))
+		if err != nil {
+			return nil, err
+		}
+		auditLogEvent = stmt
+	}
+	requestInfo, err := c.PrepareContext(ctx, insertRequestInfo.build(c.reqInfoTable().Name, onConflict))
+	if err != nil {
+		if auditLogEvent != nil {
+			auditLogEvent.Close()
+		}
+		return nil, err
+	}
+	c.insertStmts = &insertStmts{auditLogEvent: auditLogEvent, requestInfo: requestInfo, returningID: c.RequestInfoID}
+	return c.insertStmts, nil
+}
+
+// Close stops the partition maintainer and the ingest buffer worker, flushes
+// the queued events, closes the prepared statements of the client and then
+// the DB, which waits for the queries in progress to finish. Afterwards, the
+// methods of the client fail with ErrClientClosed. Closing the client again
+// does nothing.
+func (c *DBClient) Close() error {
+	c.closeMu.Lock()
+	if c.closed {
+		c.closeMu.Unlock()
+		return nil
+	}
+	c.closed = true
+	for _, stop := range c.stopMaintainers {
+		stop()
+	}
+	c.stopMaintainers = nil
+	c.closeMu.Unlock()
+	c.maintainers.Wait()
+
+	flushErr := c.Flush(context.Background())
+
+	c.insertStmtsMu.Lock()
+	if c.insertStmts != nil {
+		if c.insertStmts.auditLogEvent != nil {
+			c.insertStmts.auditLogEvent.Close()
+		}
+		c.insertStmts.requestInfo.Close()
+		c.insertStmts = nil
+	}
+	c.insertStmtsMu.Unlock()
+
+	if c.replica != nil {
+		if err := c.replica.Close(); err != nil {
+			return err
+		}
+	}
+	if c.DB == nil {
+		return flushErr
+	}
+	if err := c.DB.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// checkOpen returns ErrClientClosed if the client is closed.
+func (c *DBClient) checkOpen() error {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closed {
+		return ErrClientClosed
+	}
+	return nil
 }
 
 type logEventRawRow struct {
@@ -260,14 +1394,28 @@ type logEventRawRow struct {
 	Log       string
 }
 
+// decodeJSONLog decodes the JSON log of a record into v for output. Numbers
+// are decoded as json.Number, so that integers above 2^53, e.g. byte counts,
+// are output as stored instead of rounded to a float64.
+func decodeJSONLog(log string, v *map[string]interface{}) error {
+	dec := json.NewDecoder(strings.NewReader(log))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("Error decoding json log: %v", err)
+	}
+	return nil
+}
+
 // LogEventRow holds a raw log record
 type LogEventRow struct {
 	EventTime time.Time              `json:"event_time"`
 	Log       map[string]interface{} `json:"log"`
 }
 
-// ReqInfoRow holds a structured log record
+// ReqInfoRow holds a structured log record. ID is only set, and output, when
+// the client has RequestInfoID set.
 type ReqInfoRow struct {
+	ID                    int64     `json:"id,omitempty"`
 	Time                  time.Time `json:"time"`
 	APIName               string    `json:"api_name"`
 	AccessKey             string    `json:"access_key"`
@@ -281,301 +1429,1316 @@ type ReqInfoRow struct {
 	ResponseStatusCode    int       `json:"response_status_code"`
 	RequestContentLength  *uint64   `json:"request_content_length"`
 	ResponseContentLength *uint64   `json:"response_content_length"`
+	Version               string    `json:"version"`
+}
+
+// reqInfoRowStringInts is a ReqInfoRow with its 64-bit integer fields encoded
+// as JSON strings, for consumers that cannot represent integers above 2^53.
+type reqInfoRowStringInts struct {
+	ID                    int64     `json:"id,omitempty,string"`
+	Time                  time.Time `json:"time"`
+	APIName               string    `json:"api_name"`
+	AccessKey             string    `json:"access_key"`
+	Bucket                string    `json:"bucket"`
+	Object                string    `json:"object"`
+	TimeToResponseNs      uint64    `json:"time_to_response_ns,string"`
+	RemoteHost            string    `json:"remote_host"`
+	RequestID             string    `json:"request_id"`
+	UserAgent             string    `json:"user_agent"`
+	ResponseStatus        string    `json:"response_status"`
+	ResponseStatusCode    int       `json:"response_status_code"`
+	RequestContentLength  *uint64   `json:"request_content_length,string"`
+	ResponseContentLength *uint64   `json:"response_content_length,string"`
+	Version               string    `json:"version"`
+}
+
+// reqInfoRowOmitEmpty is a ReqInfoRow encoded with its empty fields left
+// out, for SearchQuery.OmitEmpty.
+type reqInfoRowOmitEmpty struct {
+	ID                    int64     `json:"id,omitempty"`
+	Time                  time.Time `json:"time"`
+	APIName               string    `json:"api_name,omitempty"`
+	AccessKey             string    `json:"access_key,omitempty"`
+	Bucket                string    `json:"bucket,omitempty"`
+	Object                string    `json:"object,omitempty"`
+	TimeToResponseNs      uint64    `json:"time_to_response_ns,omitempty"`
+	RemoteHost            string    `json:"remote_host,omitempty"`
+	RequestID             string    `json:"request_id,omitempty"`
+	UserAgent             string    `json:"user_agent,omitempty"`
+	ResponseStatus        string    `json:"response_status,omitempty"`
+	ResponseStatusCode    int       `json:"response_status_code,omitempty"`
+	RequestContentLength  *uint64   `json:"request_content_length,omitempty"`
+	ResponseContentLength *uint64   `json:"response_content_length,omitempty"`
+	Version               string    `json:"version,omitempty"`
 }
 
-func iPtrToStr(i *uint64) string {
+// reqInfoRowStringIntsOmitEmpty is a reqInfoRowStringInts encoded with its
+// empty fields left out.
+type reqInfoRowStringIntsOmitEmpty struct {
+	ID                    int64     `json:"id,omitempty,string"`
+	Time                  time.Time `json:"time"`
+	APIName               string    `json:"api_name,omitempty"`
+	AccessKey             string    `json:"access_key,omitempty"`
+	Bucket                string    `json:"bucket,omitempty"`
+	Object                string    `json:"object,omitempty"`
+	TimeToResponseNs      uint64    `json:"time_to_response_ns,omitempty,string"`
+	RemoteHost            string    `json:"remote_host,omitempty"`
+	RequestID             string    `json:"request_id,omitempty"`
+	UserAgent             string    `json:"user_agent,omitempty"`
+	ResponseStatus        string    `json:"response_status,omitempty"`
+	ResponseStatusCode    int       `json:"response_status_code,omitempty"`
+	RequestContentLength  *uint64   `json:"request_content_length,omitempty,string"`
+	ResponseContentLength *uint64   `json:"response_content_length,omitempty,string"`
+	Version               string    `json:"version,omitempty"`
+}
+
+// logEventRowOmitEmpty is a LogEventRow encoded without its log when empty.
+type logEventRowOmitEmpty struct {
+	EventTime time.Time              `json:"event_time"`
+	Log       map[string]interface{} `json:"log,omitempty"`
+}
+
+// reqInfoBigIntColumns are the request_info columns holding 64-bit integers,
+// which are output as strings when SearchQuery.IntsAsStrings is set.
+var reqInfoBigIntColumns = map[string]bool{
+	"time_to_response_ns":     true,
+	"request_content_length":  true,
+	"response_content_length": true,
+}
+
+// iPtrToStr returns i formatted as a decimal, or null if i is nil.
+func iPtrToStr(i *uint64, null string) string {
 	if i == nil {
-		return ""
+		return null
 	}
 	return fmt.Sprintf("%d", *i)
 }
 
-// Search executes a search query on the db.
-func (c *DBClient) Search(ctx context.Context, s *SearchQuery, w io.Writer) error {
-	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
-	defer cancel()
+// sPtrToStr returns the string pointed to by str, or null if str is nil.
+func sPtrToStr(str *string, null string) string {
+	if str == nil {
+		return null
+	}
+	return *str
+}
+
+// uPtrToValue returns the value pointed to by i, or nil.
+func uPtrToValue(i *uint64) interface{} {
+	if i == nil {
+		return nil
+	}
+	return *i
+}
+
+// reqInfoCSVHeader is the header of request_info records exported as CSV.
+var reqInfoCSVHeader = []string{
+	"time",
+	"api_name",
+	"access_key",
+	"bucket",
+	"object",
+	"time_to_response_ns",
+	"remote_host",
+	"request_id",
+	"user_agent",
+	"response_status",
+	"response_status_code",
+	"request_content_length",
+	"response_content_length",
+	"version",
+}
+
+// reqInfoCSVRow is a request_info record as scanned for CSV output. Unlike
+// in ReqInfoRow, its nullable text columns are pointers, so that NULL values
+// can be output as SearchQuery.NullAs.
+type reqInfoCSVRow struct {
+	Time                  time.Time
+	APIName               string
+	AccessKey             *string
+	Bucket                *string
+	Object                *string
+	TimeToResponseNs      uint64
+	RemoteHost            *string
+	RequestID             *string
+	UserAgent             *string
+	ResponseStatus        *string
+	ResponseStatusCode    int
+	RequestContentLength  *uint64
+	ResponseContentLength *uint64
+	Version               string
+}
+
+// reqInfoCSVRecord returns the CSV record of the request_info record i, with
+// the columns output by s.
+func (s *SearchQuery) reqInfoCSVRecord(i reqInfoCSVRow) []string {
+	record := []string{
+		s.outputTime(i.Time).Format(time.RFC3339Nano),
+		i.APIName,
+		sPtrToStr(i.AccessKey, s.NullAs),
+		sPtrToStr(i.Bucket, s.NullAs),
+		sPtrToStr(i.Object, s.NullAs),
+		fmt.Sprintf("%d", i.TimeToResponseNs),
+		sPtrToStr(i.RemoteHost, s.NullAs),
+		sPtrToStr(i.RequestID, s.NullAs),
+		sPtrToStr(i.UserAgent, s.NullAs),
+		sPtrToStr(i.ResponseStatus, s.NullAs),
+		fmt.Sprintf("%d", i.ResponseStatusCode),
+		iPtrToStr(i.RequestContentLength, s.NullAs),
+		iPtrToStr(i.ResponseContentLength, s.NullAs),
+		i.Version,
+	}
+	if len(s.Columns) == 0 {
+		return record
+	}
+	projected := make([]string, len(s.Columns))
+	for j, k := range s.reqInfoColumnIndexes() {
+		projected[j] = record[k]
+	}
+	return projected
+}
+
+// reqInfoRowValues returns the typed values of the columns of the
+// request_info record i output by s, as for reqInfoOutputParquetColumns, for
+// the binary export formats.
+func (s *SearchQuery) reqInfoRowValues(i ReqInfoRow) []interface{} {
+	values := []interface{}{
+		s.outputTime(i.Time),
+		i.APIName,
+		i.AccessKey,
+		i.Bucket,
+		i.Object,
+		i.TimeToResponseNs,
+		i.RemoteHost,
+		i.RequestID,
+		i.UserAgent,
+		i.ResponseStatus,
+		i.ResponseStatusCode,
+		uPtrToValue(i.RequestContentLength),
+		uPtrToValue(i.ResponseContentLength),
+		i.Version,
+	}
+	if len(s.Columns) == 0 {
+		return values
+	}
+	projected := make([]interface{}, len(s.Columns))
+	for j, k := range s.reqInfoColumnIndexes() {
+		projected[j] = values[k]
+	}
+	return projected
+}
+
+// reqInfoColumns returns the request_info columns selected and output by s,
+// i.e. SearchQuery.Columns, or all the columns if it is empty.
+func (s *SearchQuery) reqInfoColumns() []string {
+	if len(s.Columns) == 0 {
+		return reqInfoCSVHeader
+	}
+	return s.Columns
+}
+
+// reqInfoColumnIndexes returns the indexes in reqInfoCSVHeader of the
+// columns output by s.
+func (s *SearchQuery) reqInfoColumnIndexes() []int {
+	columns := s.reqInfoColumns()
+	indexes := make([]int, len(columns))
+	for i, col := range columns {
+		for j, h := range reqInfoCSVHeader {
+			if h == col {
+				indexes[i] = j
+				break
+			}
+		}
+	}
+	return indexes
+}
+
+// reqInfoOutputParquetColumns returns the Parquet columns of the request_info
+// records output by s.
+func (s *SearchQuery) reqInfoOutputParquetColumns() []parquetColumn {
+	if len(s.Columns) == 0 {
+		return reqInfoParquetColumns
+	}
+	columns := make([]parquetColumn, len(s.Columns))
+	for j, k := range s.reqInfoColumnIndexes() {
+		columns[j] = reqInfoParquetColumns[k]
+	}
+	return columns
+}
+
+// csvHeader returns the header of the csv and tsv exports of s, along with
+// whether each column is always quoted, if any is.
+func (s *SearchQuery) csvHeader() (header []string, forceQuote []bool) {
+	switch s.Query {
+	case rawQ:
+		return s.rawCSVHeader(), nil
+	case joinedQ:
+		return joinedCSVHeader, nil
+	}
+	header = s.reqInfoColumns()
+	if s.IntsAsStrings {
+		forceQuote = make([]bool, len(header))
+		for i, col := range header {
+			forceQuote[i] = reqInfoBigIntColumns[col]
+		}
+	}
+	return header, forceQuote
+}
+
+// xlsxHeader returns the header of the xlsx exports of s.
+func (s *SearchQuery) xlsxHeader() []string {
+	switch s.Query {
+	case rawQ:
+		return []string{"event_time", "log"}
+	case joinedQ:
+		return joinedCSVHeader
+	}
+	return s.reqInfoColumns()
+}
+
+// outputParquetColumns returns the columns of the parquet and arrow exports
+// of s.
+func (s *SearchQuery) outputParquetColumns() []parquetColumn {
+	switch s.Query {
+	case rawQ:
+		return logEventParquetColumns
+	case joinedQ:
+		return joinedParquetColumns
+	}
+	return s.reqInfoOutputParquetColumns()
+}
+
+// reqInfoJSONValue returns the value to encode as the JSON output of the
+// request_info record i: an object with the columns output by s.
+func (s *SearchQuery) reqInfoJSONValue(i ReqInfoRow) (interface{}, error) {
+	i.Time = s.outputTime(i.Time)
+	if s.RowTransform != nil {
+		v, err := s.transformRow(i)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := v.(ReqInfoRow)
+		if !ok {
+			return s.jsonValue(v)
+		}
+		i = r
+	}
+	var v interface{} = i
+	if s.IntsAsStrings {
+		v = reqInfoRowStringInts(i)
+	}
+	if len(s.Columns) == 0 {
+		return s.jsonValue(v)
+	}
+	if s.OmitEmpty {
+		v, _ = s.jsonValue(v)
+	}
+
+	// Encode the whole record, so that each field is output as usual, and
+	// keep only the selected fields, in their requested order. Empty fields
+	// left out with OmitEmpty are skipped.
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding output: %v", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return nil, fmt.Errorf("Error encoding output: %v", err)
+	}
+	var b bytes.Buffer
+	b.WriteByte('{')
+	n := 0
+	for _, col := range s.Columns {
+		field, ok := fields[col]
+		if !ok {
+			continue
+		}
+		if n > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(col)
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(field)
+		n++
+	}
+	b.WriteByte('}')
+	return json.RawMessage(b.Bytes()), nil
+}
+
+// transformRow returns the value to output for the record row, as returned
+// by the RowTransform of s, or row itself if it has none.
+func (s *SearchQuery) transformRow(row interface{}) (interface{}, error) {
+	if s.RowTransform == nil {
+		return row, nil
+	}
+	v, err := s.RowTransform(row)
+	if err != nil {
+		return nil, &RowTransformError{Err: err}
+	}
+	return v, nil
+}
+
+// recordJSONValue returns the value to encode as the JSON output of the
+// record row of a rawQ or joinedQ search, as transformed by RowTransform.
+func (s *SearchQuery) recordJSONValue(row interface{}) (interface{}, error) {
+	v, err := s.transformRow(row)
+	if err != nil {
+		return nil, err
+	}
+	return s.jsonValue(v)
+}
+
+// jsonValue returns the value to encode as the JSON output of the record v,
+// which is v itself unless s.OmitEmpty is set. Only the top-level fields of
+// records are left out when empty: the logs of rawQ and joinedQ records are
+// output whole.
+func (s *SearchQuery) jsonValue(v interface{}) (interface{}, error) {
+	if !s.OmitEmpty {
+		return v, nil
+	}
+	switch r := v.(type) {
+	case ReqInfoRow:
+		return reqInfoRowOmitEmpty(r), nil
+	case reqInfoRowStringInts:
+		return reqInfoRowStringIntsOmitEmpty(r), nil
+	case LogEventRow:
+		return logEventRowOmitEmpty(r), nil
+	case JoinedRow:
+		return joinedRowOmitEmpty{reqInfoRowOmitEmpty: reqInfoRowOmitEmpty(r.ReqInfoRow), Log: r.Log}, nil
+	}
+
+	// Other records, e.g. returned by RowTransform, are encoded once and
+	// their empty top-level fields dropped.
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding output: %v", err)
+	}
+	buf, err = omitEmptyFields(buf)
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding output: %v", err)
+	}
+	return json.RawMessage(buf), nil
+}
+
+// omitEmptyFields returns the JSON value v with the fields of its top-level
+// object that are empty strings, zero numbers or null left out. The other
+// fields keep their order, and are copied as is.
+func omitEmptyFields(v []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(v))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok != json.Delim('{') {
+		return v, nil
+	}
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for n := 0; dec.More(); {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var field json.RawMessage
+		if err := dec.Decode(&field); err != nil {
+			return nil, err
+		}
+		if isEmptyJSON(field) {
+			continue
+		}
+		if n > 0 {
+			b.WriteByte(',')
+		}
+		keyJSON, _ := json.Marshal(key)
+		b.Write(keyJSON)
+		b.WriteByte(':')
+		b.Write(field)
+		n++
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// isEmptyJSON returns true if the JSON value v is an empty string, a zero
+// number or null.
+func isEmptyJSON(v []byte) bool {
+	switch string(v) {
+	case `""`, "null":
+		return true
+	}
+	f, err := strconv.ParseFloat(string(v), 64)
+	return err == nil && f == 0
+}
+
+var (
+	logEventParquetColumns = []parquetColumn{
+		{Name: "event_time", Type: parquetTimestamp},
+		{Name: "log", Type: parquetJSON},
+	}
+	reqInfoParquetColumns = []parquetColumn{
+		{Name: "time", Type: parquetTimestamp},
+		{Name: "api_name", Type: parquetString},
+		{Name: "access_key", Type: parquetString},
+		{Name: "bucket", Type: parquetString},
+		{Name: "object", Type: parquetString},
+		{Name: "time_to_response_ns", Type: parquetUint64},
+		{Name: "remote_host", Type: parquetString},
+		{Name: "request_id", Type: parquetString},
+		{Name: "user_agent", Type: parquetString},
+		{Name: "response_status", Type: parquetString},
+		{Name: "response_status_code", Type: parquetInt64},
+		{Name: "request_content_length", Type: parquetUint64, Optional: true},
+		{Name: "response_content_length", Type: parquetUint64, Optional: true},
+		{Name: "version", Type: parquetString},
+	}
+)
+
+// SearchResult describes the output written by a search.
+type SearchResult struct {
+	// RowsWritten is the number of records written.
+	RowsWritten int64
+	// Format is the format the records were written in, i.e. the export
+	// format of the search, or "json" for a page of results.
+	Format string
+	// SkippedPartitions are the partitions that a BestEffort search could
+	// not read, whose records are missing from the output.
+	SkippedPartitions []string
+	// Encoding is the encoding the output was compressed with, for the
+	// Content-Encoding header of an HTTP response.
+	Encoding string
+}
 
-	var (
-		logEventCSVHeader = []string{"event_time", "log"}
-		reqInfoCSVHeader  = []string{
-			"time",
-			"api_name",
-			"access_key",
-			"bucket",
-			"object",
-			"time_to_response_ns",
-			"remote_host",
-			"request_id",
-			"user_agent",
-			"response_status",
-			"response_status_code",
-			"request_content_length",
-			"response_content_length",
-		}
-	)
+// searchStatement returns the query selecting the records of the search s,
+// in order and limited to its page, along with its positional arguments.
+func (c *DBClient) searchStatement(s *SearchQuery) (q string, sqlArgs []interface{}, err error) {
+	table, whereClause, sqlArgs, dollarStart, err := c.searchSource(s)
+	if err != nil {
+		return "", nil, err
+	}
+	return c.selectStatement(s, table, whereClause, sqlArgs, dollarStart)
+}
 
+// selectStatement returns the query selecting the records of the search s
+// from the given table with the where-clause of s, whose positional
+// arguments sqlArgs are numbered from 1 to dollarStart-1, along with all its
+// positional arguments.
+func (c *DBClient) selectStatement(s *SearchQuery, table, whereClause string, sqlArgs []interface{}, dollarStart int) (q string, args []interface{}, err error) {
 	const (
 		logEventSelect QTemplate = `SELECT event_time,
                                                    log
                                               FROM %s
                                              %s
-                                          ORDER BY event_time %s
+                                          ORDER BY %s
                                             %s;`
 
-		reqInfoSelect QTemplate = `SELECT time,
-                                                  api_name,
-                                                  access_key,
-                                                  bucket,
-                                                  object,
-                                                  time_to_response_ns,
-                                                  remote_host,
-                                                  request_id,
-                                                  user_agent,
-                                                  response_status,
-                                                  response_status_code,
-                                                  request_content_length,
-                                                  response_content_length
+		reqInfoSelect QTemplate = `SELECT %s
                                              FROM %s
                                             %s
-                                         	ORDER BY time %s
+                                         	ORDER BY %s
                                            	%s;`
+
+		joinedSelect QTemplate = `SELECT time,
+                                                 api_name,
+                                                 access_key,
+                                                 bucket,
+                                                 object,
+                                                 time_to_response_ns,
+                                                 remote_host,
+                                                 request_id,
+                                                 user_agent,
+                                                 response_status,
+                                                 response_status_code,
+                                                 request_content_length,
+                                                 response_content_length,
+                                                 version,
+                                                 log
+                                            FROM %s
+                                           %s
+                                        ORDER BY %s
+                                          %s;`
 	)
 
-	timeOrder := "DESC"
-	if s.TimeAscending {
-		timeOrder = "ASC"
+	orderBy, err := s.orderByClause()
+	if err != nil {
+		return "", nil, err
+	}
+
+	pagingClause, pagingArgs := s.pagingClause(dollarStart)
+	if s.ExportFormat != "" && c.MaxExportRows > 0 {
+		// One more record than the maximum is selected, to tell if the
+		// export is truncated.
+		pagingClause, pagingArgs = fmt.Sprintf("LIMIT $%d", dollarStart), []interface{}{c.MaxExportRows + 1}
+	}
+	args = append(sqlArgs, pagingArgs...)
+	switch s.Query {
+	case rawQ:
+		q = logEventSelect.build(table, whereClause, orderBy, pagingClause)
+	case reqInfoQ:
+		columns := strings.Join(s.reqInfoColumns(), ", ")
+		if c.RequestInfoID {
+			if len(s.Columns) == 0 {
+				// Older records have a NULL id.
+				columns = "COALESCE(id, 0) AS id, " + columns
+			}
+			// Records with the same values of the sort columns
+			// and time are ordered by id, so that the order is
+			// stable across pages.
+			if s.TimeAscending {
+				orderBy += ", id ASC"
+			} else {
+				orderBy += ", id DESC"
+			}
+		}
+		q = reqInfoSelect.build(columns, table, whereClause, orderBy, pagingClause)
+	case joinedQ:
+		q = joinedSelect.build(table, whereClause, orderBy, pagingClause)
 	}
+	return c.tagStatement(s, q), args, nil
+}
 
+// searchSource returns the table (or join) the records of the search s are
+// selected from, along with the where-clause selecting them and its
+// positional arguments, numbered from 1 to dollarEnd-1.
+func (c *DBClient) searchSource(s *SearchQuery) (table, whereClause string, sqlArgs []interface{}, dollarEnd int, err error) {
+	if c.skipRawLog && (s.Query == rawQ || s.Query == joinedQ) {
+		return "", "", nil, 0, ErrRawLogDisabled
+	}
 	switch s.Query {
 	case rawQ:
-		sqlArgs := []interface{}{}
-		dollarStart := 1
-		whereClauses := []string{}
-		// only filter by time if provided
-		if s.TimeStart != nil {
-			timeRangeClause := fmt.Sprintf("event_time >= $%d", dollarStart)
-			sqlArgs = append(sqlArgs, s.TimeStart.Format(time.RFC3339Nano))
-			whereClauses = append(whereClauses, timeRangeClause)
-			dollarStart++
-		}
-		if s.TimeEnd != nil {
-			timeRangeClause := fmt.Sprintf("event_time < $%d", dollarStart)
-			sqlArgs = append(sqlArgs, s.TimeEnd.Format(time.RFC3339Nano))
-			whereClauses = append(whereClauses, timeRangeClause)
-			dollarStart++
-		}
-		if s.LastDuration != nil {
-			// s.TimeEnd and s.TimeStart would be nil due to
-			// validation of s.
-			durationSeconds := int64(s.LastDuration.Seconds())
-			timeRangeClause := fmt.Sprintf("event_time >= CURRENT_TIMESTAMP - '%d seconds'::interval", durationSeconds)
-			whereClauses = append(whereClauses, timeRangeClause)
-		}
-
-		// Remaining dollar params are added for filter where clauses
-		filterClauses, filterArgs, dollarStart := generateFilterClauses(s.FParams, dollarStart)
-		whereClauses = append(whereClauses, filterClauses...)
-		sqlArgs = append(sqlArgs, filterArgs...)
-
-		whereClause := strings.Join(whereClauses, " AND ")
-		if len(whereClauses) > 0 {
-			whereClause = fmt.Sprintf("WHERE %s", whereClause)
-		}
-
-		pagingClause := ""
-		if s.ExportFormat == "" {
-			sqlArgs = append(sqlArgs, s.PageNumber*s.PageSize, s.PageSize)
-			pagingClause = fmt.Sprintf("OFFSET $%d LIMIT $%d", dollarStart, dollarStart+1)
-		}
-
-		q := logEventSelect.build(auditLogEventsTable.Name, whereClause, timeOrder, pagingClause)
-		rows, err := c.QueryContext(ctx, q, sqlArgs...)
+		table = c.logEventsTable().Name
+		whereClause, sqlArgs, dollarEnd, err = c.rawWhereClause(s, 1)
+	case reqInfoQ:
+		table = c.reqInfoTable().Name
+		whereClause, sqlArgs, dollarEnd, err = c.reqInfoWhereClause(s, 1)
+		if err == nil && s.DedupByRequestID {
+			table, whereClause = dedupByRequestIDSource(table, whereClause), ""
+		}
+	case joinedQ:
+		table = c.joinedTables()
+		whereClause, sqlArgs, dollarEnd, err = c.reqInfoWhereClause(s, 1)
 		if err != nil {
-			return fmt.Errorf("Error querying db: %v", err)
+			break
+		}
+		// Postgres does not infer the time range of the joined log events
+		// from the time range of the request_info records, so it is
+		// repeated for it to prune the audit_log_events partitions too.
+		timeClauses, timeArgs, end := s.timeRangeClauses(rawQColumns.time, dollarEnd)
+		if len(timeClauses) > 0 {
+			if whereClause == "" {
+				whereClause = "WHERE " + strings.Join(timeClauses, " AND ")
+			} else {
+				whereClause += " AND " + strings.Join(timeClauses, " AND ")
+			}
+			sqlArgs = append(sqlArgs, timeArgs...)
+			dollarEnd = end
 		}
-		defer rows.Close()
+	default:
+		err = invalidQueryErrorf("Invalid query name: %v", s.Query)
+	}
+	return table, whereClause, sqlArgs, dollarEnd, err
+}
 
-		switch s.ExportFormat {
-		case "ndjson":
-			jw := json.NewEncoder(w)
-			for rows.Next() {
-				var logEventRaw logEventRawRow
-				if err := sqlscan.ScanRow(&logEventRaw, rows); err != nil {
-					return fmt.Errorf("Error accessing db: %v", err)
-				}
-				var logEvent LogEventRow
-				logEvent.EventTime = logEventRaw.EventTime
-				logEvent.Log = make(map[string]interface{})
-				if err := json.Unmarshal([]byte(logEventRaw.Log), &logEvent.Log); err != nil {
-					return fmt.Errorf("Error decoding json log: %v", err)
-				}
-				if err := jw.Encode(logEvent); err != nil {
-					return fmt.Errorf("Error writing to output stream: %v", err)
-				}
+// dedupByRequestIDSource returns the subquery selecting, among the records of
+// table matching whereClause, the latest record of each request ID, along
+// with all the records without a request ID.
+func dedupByRequestIDSource(table, whereClause string) string {
+	const dedupSource QTemplate = `((SELECT DISTINCT ON (request_id) *
+                                            FROM %[1]s
+                                           %[2]s
+                                        ORDER BY request_id, time DESC)
+                                       UNION ALL
+                                         (SELECT *
+                                            FROM %[1]s
+                                           %[3]s)) AS deduped`
+
+	and := func(pred string) string {
+		if whereClause == "" {
+			return "WHERE " + pred
+		}
+		return whereClause + " AND " + pred
+	}
+	return dedupSource.build(table, and("request_id <> ''"), and("COALESCE(request_id, '') = ''"))
+}
+
+// countStatement returns the query counting the records matching s,
+// ignoring paging, along with its positional arguments.
+func (c *DBClient) countStatement(s *SearchQuery) (q string, sqlArgs []interface{}, err error) {
+	const countQuery QTemplate = `SELECT COUNT(*) FROM %s %s;`
+
+	table, whereClause, sqlArgs, _, err := c.searchSource(s)
+	if err != nil {
+		return "", nil, err
+	}
+	return c.tagStatement(s, countQuery.build(table, whereClause)), sqlArgs, nil
+}
+
+// BuildSearchSQL returns the SQL query Search runs to retrieve the records of
+// the search s, along with its positional arguments, without running it,
+// e.g. to debug a search or estimate its cost. For the "count" export format,
+// this is the query counting the matching records. Paging is applied as by
+// Search, including the page size and LastDuration caps of the client, and s
+// is rejected as by Search, e.g. when unbounded while the client has
+// RequireTimeBound set. The watermark of s, if any, is read from the DB to
+// resolve its time start, as by Search.
+func (c *DBClient) BuildSearchSQL(ctx context.Context, s *SearchQuery) (query string, args []interface{}, err error) {
+	if s, err = c.prepareSearch(s); err != nil {
+		return "", nil, err
+	}
+	if s, err = c.resolveWatermark(ctx, s); err != nil {
+		return "", nil, err
+	}
+	if s.ExportFormat == "count" {
+		return c.countStatement(s)
+	}
+	return c.searchStatement(s)
+}
+
+// Search executes a search query on the db.
+func (c *DBClient) Search(ctx context.Context, s *SearchQuery, w io.Writer) error {
+	var res SearchResult
+	return c.search(ctx, s, w, &res)
+}
+
+// SearchWithResult is like Search, but also returns a description of the
+// written output, e.g. to log the throughput of exports.
+func (c *DBClient) SearchWithResult(ctx context.Context, s *SearchQuery, w io.Writer) (SearchResult, error) {
+	res := SearchResult{Format: s.ExportFormat}
+	if res.Format == "" {
+		res.Format = "json"
+	}
+	err := c.search(ctx, s, w, &res)
+	return res, err
+}
+
+func (c *DBClient) search(ctx context.Context, s *SearchQuery, w io.Writer, res *SearchResult) (err error) {
+	s, err = c.prepareSearch(s)
+	if err != nil {
+		return err
+	}
+	run, err := c.startSearch(ctx, s, s.IncludeManifest)
+	if err != nil {
+		return err
+	}
+	defer func() { run.finish(res.RowsWritten, err) }()
+	ctx, s, db := run.ctx, run.s, run.db
+
+	res.Encoding = EncodingNone
+	if s.Encoding != "" && s.Encoding != EncodingNone {
+		// All the output goes through the compressor, which is closed
+		// once it is written.
+		ew := &encodingWriter{w: w, encoding: s.Encoding}
+		w = ew
+		res.Encoding = s.Encoding
+		defer func() {
+			if ferr := ew.finish(err != nil); ferr != nil && err == nil {
+				err = &StreamWriteError{Err: ferr}
 			}
+		}()
+	}
+
+	if s.ExportFormat == "count" {
+		return c.writeCount(ctx, db, s, w)
+	}
+	if s.ExportFormat == "xlsx" {
+		if err := c.checkXLSXRows(ctx, db, s); err != nil {
+			return err
+		}
+	}
 
-		case "csv":
-			cw := csv.NewWriter(w)
+	var rows *limitedRows
+	if s.BestEffort {
+		if rows, err = c.bestEffortRows(ctx, db, s, res); err != nil {
+			return err
+		}
+	} else {
+		q, sqlArgs, err := c.searchStatement(s)
+		if err != nil {
+			return err
+		}
+		sqlRows, err := db.QueryContext(ctx, q, sqlArgs...)
+		if err != nil {
+			return &QueryError{Op: "querying", Err: err}
+		}
+		rows = &limitedRows{Rows: sqlRows}
+	}
+	it := &RowIterator{
+		s:          s,
+		rows:       rows,
+		nullable:   s.ExportFormat == "csv" || s.ExportFormat == "tsv",
+		decodeLogs: s.ExportFormat == "" || s.ExportFormat == "ndjson",
+	}
+	defer it.Close()
+	// The manifest is only written once the search is running, so that
+	// nothing is written by searches failing to start.
+	if run.manifest != nil {
+		if err := json.NewEncoder(w).Encode(run.manifest); err != nil {
+			return &StreamWriteError{Err: err}
+		}
+	}
+	if s.ExportFormat != "" {
+		rows.max = int64(c.MaxExportRows)
+	}
 
-			// Write CSV header
-			if err := cw.Write(logEventCSVHeader); err != nil {
-				return fmt.Errorf("Error writing to output stream: %v", err)
+	switch s.ExportFormat {
+	case "ndjson":
+		jw := json.NewEncoder(w)
+		err = it.writeEach(&res.RowsWritten, func() error {
+			v, err := it.jsonValue()
+			if err != nil {
+				return err
+			}
+			if err := jw.Encode(v); err != nil {
+				return &StreamWriteError{Err: err}
 			}
+			return nil
+		})
 
-			// Write rows
-			for rows.Next() {
-				var logEventRaw logEventRawRow
-				if err := sqlscan.ScanRow(&logEventRaw, rows); err != nil {
-					return fmt.Errorf("Error accessing db: %v", err)
-				}
-				record := []string{
-					logEventRaw.EventTime.Format(time.RFC3339Nano),
-					logEventRaw.Log,
+	case "csv", "tsv":
+		header, forceQuote := s.csvHeader()
+		err = writeCSV(w, s.csvOptions(), header, forceQuote, func(cw *csvWriter) error {
+			return it.writeEach(&res.RowsWritten, func() error {
+				record, err := it.csvRecord()
+				if err != nil {
+					return err
 				}
 				if err := cw.Write(record); err != nil {
-					return fmt.Errorf("Error writing to output stream: %v", err)
+					return &StreamWriteError{Err: err}
 				}
-			}
-			cw.Flush()
-			if err := cw.Error(); err != nil {
-				return fmt.Errorf("Error writing to output stream: %v", err)
-			}
+				return nil
+			})
+		})
 
-		default:
-			// Send out one page of results in response.
-			var logEventsRaw []logEventRawRow
-			if err := sqlscan.ScanAll(&logEventsRaw, rows); err != nil {
-				return fmt.Errorf("Error accessing db: %v", err)
-			}
-			// parse the encoded json string stored in the db into a json
-			// object for output
-			logEvents := make([]LogEventRow, len(logEventsRaw))
-			for i, e := range logEventsRaw {
-				logEvents[i].EventTime = e.EventTime
-				logEvents[i].Log = make(map[string]interface{})
-				if err := json.Unmarshal([]byte(e.Log), &logEvents[i].Log); err != nil {
-					return fmt.Errorf("Error decoding json log: %v", err)
+	case "parquet":
+		err = writeParquet(w, s.outputParquetColumns(), func(pw *parquetWriter) error {
+			return it.writeEach(&res.RowsWritten, func() error {
+				if err := pw.Write(it.values()); err != nil {
+					return &StreamWriteError{Err: err}
 				}
+				return nil
+			})
+		})
+
+	case "arrow":
+		err = writeArrow(w, s.outputParquetColumns(), func(aw *arrowWriter) error {
+			return it.writeEach(&res.RowsWritten, func() error {
+				if err := aw.Write(it.values()); err != nil {
+					return &StreamWriteError{Err: err}
+				}
+				return nil
+			})
+		})
+
+	case "xlsx":
+		err = writeXLSX(w, s.xlsxHeader(), func(xw *xlsxWriter) error {
+			return it.writeEach(&res.RowsWritten, func() error {
+				return xw.Write(it.values())
+			})
+		})
+
+	default:
+		// Stream out one page of results in response.
+		err = c.writePage(ctx, db, s, w, func(aw *jsonArrayWriter) error {
+			var n int64
+			err := it.writeEach(&n, func() error {
+				v, err := it.jsonValue()
+				if err != nil {
+					return err
+				}
+				return aw.Write(v)
+			})
+			// The records past the page size of data envelopes are
+			// dropped by aw.
+			res.RowsWritten = int64(aw.n)
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	if rows.truncated {
+		if s.ExportFormat == "ndjson" {
+			if _, err := io.WriteString(w, "{\"truncated\":true}\n"); err != nil {
+				return &StreamWriteError{Err: err}
 			}
-			jw := json.NewEncoder(w)
-			if err := jw.Encode(logEvents); err != nil {
-				return fmt.Errorf("Error writing to output stream: %v", err)
-			}
+			return nil
 		}
+		return &ExportLimitError{MaxRows: c.MaxExportRows}
+	}
+	return nil
+}
 
-	case reqInfoQ:
-		sqlArgs := []interface{}{}
-		dollarStart := 1
-		whereClauses := []string{}
-		// only filter by time if provided
-		if s.TimeStart != nil {
-			timeRangeClause := fmt.Sprintf("time >= $%d", dollarStart)
-			sqlArgs = append(sqlArgs, s.TimeStart.Format(time.RFC3339Nano))
-			whereClauses = append(whereClauses, timeRangeClause)
-			dollarStart++
-		}
-		// only filter by time if provided
-		if s.TimeEnd != nil {
-			timeRangeClause := fmt.Sprintf("time < $%d", dollarStart)
-			sqlArgs = append(sqlArgs, s.TimeEnd.Format(time.RFC3339Nano))
-			whereClauses = append(whereClauses, timeRangeClause)
-			dollarStart++
-		}
-		if s.LastDuration != nil {
-			// s.TimeEnd and s.TimeStart would be nil due to
-			// validation of s.
-			durationSeconds := int64(s.LastDuration.Seconds())
-			timeRangeClause := fmt.Sprintf("event_time >= CURRENT_TIMESTAMP - '%d seconds'::interval", durationSeconds)
-			whereClauses = append(whereClauses, timeRangeClause)
-		}
-
-		// Remaining dollar params are added for filter where clauses
-		filterClauses, filterArgs, dollarStart := generateFilterClauses(s.FParams, dollarStart)
-		whereClauses = append(whereClauses, filterClauses...)
-		sqlArgs = append(sqlArgs, filterArgs...)
-
-		whereClause := strings.Join(whereClauses, " AND ")
-		if len(whereClauses) > 0 {
-			whereClause = fmt.Sprintf("WHERE %s", whereClause)
-		}
-
-		pagingClause := ""
-		if s.ExportFormat == "" {
-			sqlArgs = append(sqlArgs, s.PageNumber*s.PageSize, s.PageSize)
-			pagingClause = fmt.Sprintf("OFFSET $%d LIMIT $%d", dollarStart, dollarStart+1)
-		}
-
-		q := reqInfoSelect.build(requestInfoTable.Name, whereClause, timeOrder, pagingClause)
-		rows, err := c.QueryContext(ctx, q, sqlArgs...)
+// prepareSearch returns the search query to run for s: redacted as per the
+// client, validated, checked against RequireTimeBound and capped as per
+// capSearch. Every search, and BuildSearchSQL, starts with it.
+func (c *DBClient) prepareSearch(s *SearchQuery) (*SearchQuery, error) {
+	s = c.redactSearch(s)
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	if err := c.checkTimeBound(s); err != nil {
+		return nil, err
+	}
+	return c.capSearch(s)
+}
+
+// searchRun holds what a search started with startSearch runs with, until
+// finish is called.
+type searchRun struct {
+	c     *DBClient
+	start time.Time
+
+	// ctx is bounded by the timeout of the search, and s is the search
+	// with its watermark resolved.
+	ctx context.Context
+	s   *SearchQuery
+	// db runs the queries of the search (see searchQuerier).
+	db querier
+	// manifest is the export manifest of s, if requested from
+	// startSearch.
+	manifest *exportManifest
+
+	releases []func()
+}
+
+// startSearch starts running the prepared search s: it bounds ctx by the
+// timeout of the search, waits for a search slot (see acquireSearchSlot),
+// resolves the watermark of s and gets the querier of its queries. With
+// withManifest, the export manifest of s is built too, before the querier
+// holds a connection, as reading the schema version needs another one. The
+// search must be finished with finish once its rows are closed.
+func (c *DBClient) startSearch(ctx context.Context, s *SearchQuery, withManifest bool) (*searchRun, error) {
+	if err := c.checkOpen(); err != nil {
+		return nil, err
+	}
+	run := &searchRun{c: c, start: time.Now(), s: s}
+	ctx, cancel := withTimeout(ctx, c.Timeouts.searchTimeout(s))
+	run.ctx = ctx
+	run.releases = append(run.releases, cancel)
+
+	err := func() error {
+		release, err := c.acquireSearchSlot(ctx)
 		if err != nil {
-			return fmt.Errorf("Error querying db: %v", err)
+			return err
 		}
-		defer rows.Close()
+		run.releases = append(run.releases, release)
 
-		switch s.ExportFormat {
-		case "ndjson":
-			jw := json.NewEncoder(w)
-			for rows.Next() {
-				var reqInfo ReqInfoRow
-				if err := sqlscan.ScanRow(&reqInfo, rows); err != nil {
-					return fmt.Errorf("Error accessing db: %v", err)
-				}
-				if err := jw.Encode(reqInfo); err != nil {
-					return fmt.Errorf("Error writing to output stream: %v", err)
-				}
+		if run.s, err = c.resolveWatermark(ctx, s); err != nil {
+			return err
+		}
+		if withManifest {
+			if run.manifest, err = c.exportManifest(ctx, run.s); err != nil {
+				return err
 			}
+		}
+		db, releaseDB, err := c.searchQuerier(ctx)
+		if err != nil {
+			return err
+		}
+		run.db = db
+		run.releases = append(run.releases, releaseDB)
+		return nil
+	}()
+	if err != nil {
+		run.finish(0, err)
+		return nil, err
+	}
+	return run, nil
+}
 
-		case "csv":
-			cw := csv.NewWriter(w)
+// finish records the metrics of the search, which wrote rowsWritten records
+// and ended with err, if any, and releases what it ran with.
+func (run *searchRun) finish(rowsWritten int64, err error) {
+	run.c.metrics().ObserveSearch(string(run.s.Query), time.Since(run.start), rowsWritten, err)
+	run.c.healOnConnErr(err)
+	for i := len(run.releases) - 1; i >= 0; i-- {
+		run.releases[i]()
+	}
+	run.releases = nil
+}
 
-			// Write CSV header
-			if err := cw.Write(reqInfoCSVHeader); err != nil {
-				return fmt.Errorf("Error writing to output stream: %v", err)
-			}
+// limitedRows iterates on at most max (when positive) rows, noting if more
+// rows were available.
+type limitedRows struct {
+	*sql.Rows
+	max, n    int64
+	truncated bool
 
-			// Write rows
-			for rows.Next() {
-				var i ReqInfoRow
-				if err := sqlscan.ScanRow(&i, rows); err != nil {
-					return fmt.Errorf("Error accessing db: %v", err)
-				}
-				record := []string{
-					i.Time.Format(time.RFC3339Nano),
-					i.APIName,
-					i.AccessKey,
-					i.Bucket,
-					i.Object,
-					fmt.Sprintf("%d", i.TimeToResponseNs),
-					i.RemoteHost,
-					i.RequestID,
-					i.UserAgent,
-					i.ResponseStatus,
-					fmt.Sprintf("%d", i.ResponseStatusCode),
-					iPtrToStr(i.RequestContentLength),
-					iPtrToStr(i.ResponseContentLength),
-				}
-				if err := cw.Write(record); err != nil {
-					return fmt.Errorf("Error writing to output stream: %v", err)
-				}
-			}
-			cw.Flush()
-			if err := cw.Error(); err != nil {
-				return fmt.Errorf("Error writing to output stream: %v", err)
-			}
+	// next, when set, is called once the rows are exhausted, with their
+	// error if any, for the iteration to go on with the rows it returns,
+	// until it returns nil rows or an error, which is then returned by
+	// Err. See bestEffortRows.
+	next func(err error) (*sql.Rows, error)
+	done bool
+	err  error
+}
 
-		default:
-			// Send out one page of results in response
-			var reqInfos []ReqInfoRow
-			if err := sqlscan.ScanAll(&reqInfos, rows); err != nil {
-				return fmt.Errorf("Error accessing db: %v", err)
-			}
-			jw := json.NewEncoder(w)
-			if err := jw.Encode(reqInfos); err != nil {
-				return fmt.Errorf("Error writing to output stream: %v", err)
-			}
+func (r *limitedRows) Next() bool {
+	for !r.Rows.Next() {
+		if r.next == nil {
+			return false
+		}
+		err := r.Rows.Err()
+		r.Rows.Close()
+		rows, err := r.next(err)
+		if err != nil || rows == nil {
+			r.next, r.done, r.err = nil, true, err
+			return false
 		}
+		r.Rows = rows
+	}
+	if r.max > 0 && r.n >= r.max {
+		r.truncated = true
+		return false
+	}
+	r.n++
+	return true
+}
+
+// Err returns the error, if any, that ended the iteration.
+func (r *limitedRows) Err() error {
+	if r.done {
+		return r.err
+	}
+	return r.Rows.Err()
+}
+
+// accessErr returns the error, if any, that ended the iteration, as a
+// QueryError. The errors of the next rows of best-effort searches are
+// already QueryErrors.
+func (r *limitedRows) accessErr() error {
+	err := r.Err()
+	if err == nil {
+		return nil
+	}
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		return err
+	}
+	return &QueryError{Op: "accessing", Err: err}
+}
+
+// pageMetadata is the paging metadata following the results of a page, when
+// they are wrapped in an object as requested by SearchQuery.Envelope.
+type pageMetadata struct {
+	Page     int   `json:"page"`
+	PageSize int   `json:"pageSize"`
+	Total    int64 `json:"total"`
+}
+
+// dataPageMetadata is the paging metadata following the results of a page,
+// when they are wrapped in an object as requested by SearchQuery.DataEnvelope.
+type dataPageMetadata struct {
+	Page     int  `json:"page"`
+	PageSize int  `json:"pageSize"`
+	HasMore  bool `json:"hasMore"`
+}
+
+// jsonArrayWriter writes values to an io.Writer as the elements of a JSON
+// array, one at a time, so that the array is never held in memory.
+type jsonArrayWriter struct {
+	w io.Writer
+	n int
+
+	// limit, when positive, is the maximum number of elements written.
+	// Further values are dropped and recorded in truncated.
+	limit     int
+	truncated bool
+
+	// maxBytes, when positive, is the maximum number of bytes written to
+	// w, counted in written along with the bytes written to w before the
+	// array. Writing a value past it fails with a *ResponseTooLargeError.
+	maxBytes int64
+	written  int64
+
+	// nullIfEmpty has an empty array written as null.
+	nullIfEmpty bool
+}
+
+// Write writes v as the next element of the array.
+func (aw *jsonArrayWriter) Write(v interface{}) error {
+	if aw.limit > 0 && aw.n >= aw.limit {
+		aw.truncated = true
+		return nil
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("Error encoding output: %v", err)
+	}
+	sep := ","
+	if aw.n == 0 {
+		sep = "["
+	}
+	// The closing bracket must fit too.
+	if aw.maxBytes > 0 && aw.written+int64(len(sep)+len(buf)+1) > aw.maxBytes {
+		return &ResponseTooLargeError{MaxBytes: aw.maxBytes}
+	}
+	if err := aw.write([]byte(sep)); err != nil {
+		return err
+	}
+	if err := aw.write(buf); err != nil {
+		return err
+	}
+	aw.n++
+	return nil
+}
+
+// write writes p to w, counting the bytes written.
+func (aw *jsonArrayWriter) write(p []byte) error {
+	n, err := aw.w.Write(p)
+	aw.written += int64(n)
+	if err != nil {
+		return &StreamWriteError{Err: err}
+	}
+	return nil
+}
+
+// Close terminates the array.
+func (aw *jsonArrayWriter) Close() error {
+	end := "]"
+	switch {
+	case aw.n > 0:
+	case aw.nullIfEmpty:
+		end = "null"
 	default:
-		return fmt.Errorf("Invalid query name: %v", s.Query)
+		end = "[]"
+	}
+	return aw.write([]byte(end))
+}
+
+// writePage writes a page of search results to w as a JSON array, or wrapped
+// in an object along with paging metadata if requested by s. The results are
+// written by writeResults one at a time, failing once they exceed the
+// MaxResponseBytes of the client, which bounds the whole page, including the
+// envelope and its metadata. When limited in size, the page is buffered and
+// only written to w once complete, so that nothing is written when it turns
+// out too large, and the error can still be reported, e.g. with a 413 HTTP
+// status.
+func (c *DBClient) writePage(ctx context.Context, db querier, s *SearchQuery, w io.Writer, writeResults func(*jsonArrayWriter) error) error {
+	out := w
+	var buf *bytes.Buffer
+	if c.MaxResponseBytes > 0 {
+		buf = new(bytes.Buffer)
+		w = buf
+	}
+	aw := &jsonArrayWriter{w: w, maxBytes: c.MaxResponseBytes}
+	// Empty pages of reqinfo results have always been output as null,
+	// unless wrapped or with their integers as strings.
+	aw.nullIfEmpty = s.Query == reqInfoQ && !s.Envelope && !s.DataEnvelope && !s.IntsAsStrings
+	var start string
+	switch {
+	case s.Envelope:
+		start = `{"results":`
+	case s.DataEnvelope:
+		start = `{"data":`
+		// One more record than the page size is fetched to find out if
+		// there are more pages.
+		aw.limit = s.PageSize
+	}
+	if err := aw.write([]byte(start)); err != nil {
+		return err
+	}
+
+	if err := writeResults(aw); err != nil {
+		return err
+	}
+	if err := aw.Close(); err != nil {
+		return err
+	}
+
+	var metadata interface{}
+	switch {
+	case s.Envelope:
+		total, err := c.countRows(ctx, db, s)
+		if err != nil {
+			return err
+		}
+		metadata = pageMetadata{
+			Page:     s.PageNumber,
+			PageSize: s.PageSize,
+			Total:    total,
+		}
+	case s.DataEnvelope:
+		metadata = dataPageMetadata{
+			Page:     s.PageNumber,
+			PageSize: s.PageSize,
+			HasMore:  aw.truncated,
+		}
+	}
+
+	end := "\n"
+	if metadata != nil {
+		buf, err := json.Marshal(metadata)
+		if err != nil {
+			return fmt.Errorf("Error encoding output: %v", err)
+		}
+		// Splice the metadata fields into the envelope object.
+		end = "," + string(buf[1:]) + "\n"
+	}
+	if _, err := io.WriteString(w, end); err != nil {
+		return &StreamWriteError{Err: err}
+	}
+	if buf != nil {
+		// The results fit, but the end of the page may not.
+		if int64(buf.Len()) > c.MaxResponseBytes {
+			return &ResponseTooLargeError{MaxBytes: c.MaxResponseBytes}
+		}
+		if _, err := buf.WriteTo(out); err != nil {
+			return &StreamWriteError{Err: err}
+		}
+	}
+	return nil
+}
+
+// countRows returns the total number of records matching s, ignoring paging,
+// counted with db.
+func (c *DBClient) countRows(ctx context.Context, db querier, s *SearchQuery) (int64, error) {
+	q, sqlArgs, err := c.countStatement(s)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	if err := db.QueryRowContext(ctx, q, sqlArgs...).Scan(&count); err != nil {
+		return 0, &QueryError{Op: "querying", Err: err}
+	}
+	return count, nil
+}
+
+// writeCount writes the number of records matching s, as `{"count": n}`.
+func (c *DBClient) writeCount(ctx context.Context, db querier, s *SearchQuery, w io.Writer) error {
+	count, err := c.countRows(ctx, db, s)
+	if err != nil {
+		return err
+	}
+	out := struct {
+		Count int64 `json:"count"`
+	}{count}
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		return &StreamWriteError{Err: err}
 	}
 	return nil
 }
+
+// exportManifest is the record starting the ndjson exports of searches with
+// IncludeManifest.
+type exportManifest struct {
+	Manifest bool  `json:"_manifest"`
+	Query    qType `json:"query"`
+	// TimeStart and TimeEnd are the time range of the search, which are
+	// null when unbounded.
+	TimeStart     *time.Time   `json:"time_start"`
+	TimeEnd       *time.Time   `json:"time_end"`
+	Search        *SearchQuery `json:"search"`
+	GeneratedAt   time.Time    `json:"generated_at"`
+	SchemaVersion int          `json:"schema_version"`
+}
+
+// exportManifest returns the manifest of the export of s.
+func (c *DBClient) exportManifest(ctx context.Context, s *SearchQuery) (*exportManifest, error) {
+	version, err := c.SchemaVersion(ctx)
+	if err != nil {
+		return nil, &QueryError{Op: "querying", Err: err}
+	}
+	m := &exportManifest{
+		Manifest:      true,
+		Query:         s.Query,
+		TimeStart:     s.TimeStart,
+		TimeEnd:       s.TimeEnd,
+		Search:        s,
+		GeneratedAt:   time.Now().UTC(),
+		SchemaVersion: version,
+	}
+	if s.LastDuration != nil {
+		start := m.GeneratedAt.Add(-*s.LastDuration)
+		m.TimeStart = &start
+	}
+	return m, nil
+}
+
+// DeleteReqInfo deletes the request_info records matching s, e.g. to purge
+// the records of an access key, and returns the number of deleted records.
+// The audit_log_events records of the same requests, if stored, are deleted
+// along with them. As a safeguard against deleting everything, s must have at
+// least one filter besides its time range, other than filters matching any
+// value such as `*` patterns.
+func (c *DBClient) DeleteReqInfo(ctx context.Context, s *SearchQuery) (deleted int64, err error) {
+	if err := c.checkOpen(); err != nil {
+		return 0, err
+	}
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Search)
+	defer cancel()
+
+	const (
+		deleteQuery QTemplate = `DELETE FROM %s %s;`
+		// The raw logs of the deleted records are matched like in
+		// joinedTables.
+		deleteWithRawQuery QTemplate = `WITH deleted AS (DELETE FROM %[1]s %[3]s RETURNING time, request_id),
+                                                 deleted_raw AS (DELETE FROM %[2]s USING deleted
+                                                                  WHERE %[2]s.event_time = deleted.time
+                                                                    AND %[2]s.log->>'requestID' = deleted.request_id)
+                                            SELECT COUNT(*) FROM deleted;`
+	)
+
+	if !s.hasFilters() {
+		return 0, invalidQueryErrorf("Refusing to delete records without a filter")
+	}
+	whereClause, sqlArgs, _, err := c.reqInfoWhereClause(s, 1)
+	if err != nil {
+		return 0, err
+	}
+	if whereClause == "" {
+		return 0, invalidQueryErrorf("Refusing to delete records without a filter")
+	}
+
+	if !c.skipRawLog {
+		q := deleteWithRawQuery.build(c.reqInfoTable().Name, c.logEventsTable().Name, whereClause)
+		if err := c.QueryRowContext(ctx, q, sqlArgs...).Scan(&deleted); err != nil {
+			return 0, fmt.Errorf("Error deleting records: %v", err)
+		}
+		return deleted, nil
+	}
+	res, err := c.ExecContext(ctx, deleteQuery.build(c.reqInfoTable().Name, whereClause), sqlArgs...)
+	if err != nil {
+		return 0, fmt.Errorf("Error deleting records: %v", err)
+	}
+	return res.RowsAffected()
+}
+
+// DeleteByTimeRange deletes the records of the table, one of the tables of
+// the client, whose time is in [start, end), e.g. the records of a bad import
+// spanning an hour, and returns the number of deleted records. Both bounds
+// are required, as a safeguard against deleting everything; old partitions
+// are better dropped whole, see EnforceRetention.
+func (c *DBClient) DeleteByTimeRange(ctx context.Context, table Table, start, end time.Time) (deleted int64, err error) {
+	if err := c.checkOpen(); err != nil {
+		return 0, err
+	}
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Search)
+	defer cancel()
+
+	const deleteQuery QTemplate = `DELETE FROM %s WHERE %s >= $1 AND %s < $2;`
+
+	known := false
+	for _, t := range c.tables() {
+		known = known || t.Name == table.Name
+	}
+	switch {
+	case !known && c.skipRawLog && table.Name == c.logEventsTable().Name:
+		return 0, ErrRawLogDisabled
+	case !known || table.TimeColumn == "":
+		return 0, invalidQueryErrorf("Unknown table: %s", table.Name)
+	case start.IsZero() || end.IsZero():
+		return 0, invalidQueryErrorf("Refusing to delete records without both time bounds")
+	case !start.Before(end):
+		return 0, invalidQueryErrorf("Invalid time range: %s -> %s", start.Format(time.RFC3339Nano), end.Format(time.RFC3339Nano))
+	}
+
+	q := deleteQuery.build(table.Name, table.TimeColumn, table.TimeColumn)
+	res, err := c.ExecContext(ctx, q, pgTimeArg(start), pgTimeEndArg(end, false))
+	if err != nil {
+		return 0, fmt.Errorf("Error deleting records: %v", err)
+	}
+	return res.RowsAffected()
+}
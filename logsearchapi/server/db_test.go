@@ -0,0 +1,3314 @@
+//
+// This file is part of MinIO Operator
+// Copyright (C) 2022, MinIO, Inc.
+//
+// This code is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License, version 3,
+// as published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License, version 3,
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+//
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// testPgConnStrEnv names the environment variable holding the connection
+// string of a scratch PostgreSQL database. Tests that need a database are
+// skipped when it is not set.
+const testPgConnStrEnv = "LOGSEARCH_TEST_PG_CONN_STR"
+
+func newTestDBClient(t *testing.T, opts ...DBClientOption) *DBClient {
+	t.Helper()
+
+	connStr := os.Getenv(testPgConnStrEnv)
+	if connStr == "" {
+		t.Skipf("%s is not set - skipping test needing a database", testPgConnStrEnv)
+	}
+
+	// Tests rely on native partitioning unless they select another mode.
+	opts = append([]DBClientOption{WithPartitionMode(PartitionModeNative)}, opts...)
+	c, err := NewDBClient(context.Background(), connStr, opts...)
+	if err != nil {
+		t.Fatalf("Unable to connect to db: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	if err := c.InitDBTables(context.Background()); err != nil {
+		t.Fatalf("Unable to initialize tables: %v", err)
+	}
+	return c
+}
+
+// testConnStrWithParam returns the connection string of the test database
+// with the given run-time parameter of the sessions added.
+func testConnStrWithParam(name, value string) string {
+	connStr := os.Getenv(testPgConnStrEnv)
+	if strings.HasPrefix(connStr, "postgres://") || strings.HasPrefix(connStr, "postgresql://") {
+		sep := "?"
+		if strings.Contains(connStr, "?") {
+			sep = "&"
+		}
+		return connStr + sep + name + "=" + url.QueryEscape(value)
+	}
+	return connStr + " " + name + "=" + value
+}
+
+// testBucketName returns a bucket name unique to a test run, so that tests can
+// filter out records inserted by other tests.
+func testBucketName() string {
+	return fmt.Sprintf("test-bucket-%d", rand.Int63())
+}
+
+// newTestEvent returns an audit event with the given time and bucket. Tests
+// may modify it before inserting it with insertTestEventMap.
+func newTestEvent(eventTime time.Time, bucket string) map[string]interface{} {
+	return map[string]interface{}{
+		"version":   "1",
+		"time":      eventTime.Format(time.RFC3339Nano),
+		"requestID": fmt.Sprintf("%X", rand.Int63()),
+		"api": map[string]interface{}{
+			"name":           "PutObject",
+			"bucket":         bucket,
+			"object":         "object",
+			"status":         "OK",
+			"statusCode":     200,
+			"timeToResponse": "1000ns",
+		},
+	}
+}
+
+// bucketFilter returns the filter params of a q query selecting the records
+// of the given bucket.
+func bucketFilter(q qType, bucket string) map[fParam][]string {
+	key, err := stringToFParam(q, "bucket")
+	if err != nil {
+		panic(err)
+	}
+	return map[fParam][]string{key: {bucket}}
+}
+
+func insertTestEventMap(t *testing.T, c *DBClient, event map[string]interface{}) {
+	t.Helper()
+
+	buf, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.InsertEvent(context.Background(), buf); err != nil {
+		t.Fatalf("Unable to insert event: %v", err)
+	}
+}
+
+// insertTestEvent inserts an audit event with the given time and bucket.
+func insertTestEvent(t *testing.T, c *DBClient, eventTime time.Time, bucket string) {
+	t.Helper()
+	insertTestEventMap(t, c, newTestEvent(eventTime, bucket))
+}
+
+func TestSearchTimeTruncate(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	eventTime := time.Now().UTC().Truncate(time.Minute).Add(42*time.Second + 123456*time.Microsecond)
+	insertTestEvent(t, c, eventTime, bucket)
+
+	for _, truncate := range []time.Duration{time.Second, time.Minute} {
+		// The time filter uses full precision: the event is excluded when
+		// the range starts a microsecond after it.
+		for _, timeStart := range []time.Time{eventTime, eventTime.Add(time.Microsecond)} {
+			sq := SearchQuery{
+				Query:        reqInfoQ,
+				TimeStart:    &timeStart,
+				PageSize:     10,
+				FParams:      map[fParam][]string{"bucket": {bucket}},
+				TimeTruncate: truncate,
+			}
+			var buf bytes.Buffer
+			if err := c.Search(context.Background(), &sq, &buf); err != nil {
+				t.Fatalf("Search failed: %v", err)
+			}
+			var rows []ReqInfoRow
+			if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+				t.Fatal(err)
+			}
+
+			if timeStart.After(eventTime) {
+				if len(rows) != 0 {
+					t.Errorf("Expected no rows for time start %s, got %d", timeStart, len(rows))
+				}
+				continue
+			}
+			if len(rows) != 1 {
+				t.Fatalf("Expected 1 row, got %d", len(rows))
+			}
+			if expected := eventTime.Truncate(truncate); !rows[0].Time.Equal(expected) {
+				t.Errorf("Expected output time %s, got %s", expected, rows[0].Time)
+			}
+		}
+	}
+}
+
+func TestSearchDisplayTimeZone(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	eventTime := time.Now().UTC().Truncate(time.Second)
+	insertTestEvent(t, c, eventTime, bucket)
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := eventTime.In(newYork).Format(time.RFC3339Nano)
+
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		// The time range is still in UTC.
+		timeStart := eventTime
+		for _, format := range []string{"ndjson", "csv"} {
+			sq := SearchQuery{
+				Query:           q,
+				TimeStart:       &timeStart,
+				ExportFormat:    format,
+				FParams:         bucketFilter(q, bucket),
+				DisplayTimeZone: "America/New_York",
+			}
+			var buf bytes.Buffer
+			if err := c.Search(ctx, &sq, &buf); err != nil {
+				t.Fatalf("%s %s: Search failed: %v", q, format, err)
+			}
+			if !strings.Contains(buf.String(), expected) {
+				t.Errorf("%s %s: expected the time %s in %q", q, format, expected, buf.String())
+			}
+		}
+	}
+}
+
+func TestMigrateSchema(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	if err := c.MigrateSchema(ctx); err != nil {
+		t.Fatalf("Unexpected migration error: %v", err)
+	}
+	version, err := c.SchemaVersion(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != len(allMigrations) {
+		t.Fatalf("Expected schema version %d, got %d", len(allMigrations), version)
+	}
+
+	// A new migration advances the version exactly once.
+	var runs int
+	defer func(migrations []dbMigration) {
+		allMigrations = migrations
+		const deleteVersions QTemplate = `DELETE FROM %s WHERE version > $1;`
+		if _, err := c.ExecContext(ctx, deleteVersions.build(schemaMigrationsTable.Name), len(migrations)); err != nil {
+			t.Errorf("Unable to clean up test migration: %v", err)
+		}
+	}(allMigrations)
+	allMigrations = append(allMigrations, func(ctx context.Context, c *DBClient) error {
+		runs++
+		return nil
+	})
+	for i := 0; i < 2; i++ {
+		if err := c.MigrateSchema(ctx); err != nil {
+			t.Fatalf("Unexpected migration error: %v", err)
+		}
+	}
+	if runs != 1 {
+		t.Errorf("Expected new migration to run once, ran %d times", runs)
+	}
+	if version, err = c.SchemaVersion(ctx); err != nil {
+		t.Fatal(err)
+	} else if version != len(allMigrations) {
+		t.Errorf("Expected schema version %d, got %d", len(allMigrations), version)
+	}
+}
+
+func TestMigrateOldSchema(t *testing.T) {
+	ctx := context.Background()
+	setup := newTestDBClient(t)
+
+	// Create the tables of an old version, without the access key and
+	// content length columns.
+	const prefix = "oldschema_"
+	reqInfo := prefix + requestInfoTable.Name
+	logEvents := auditLogEventsTable.withPrefix(prefix)
+	for _, q := range []string{
+		logEvents.getCreateStatement(),
+		`CREATE TABLE ` + reqInfo + ` (
+                   time TIMESTAMPTZ NOT NULL,
+                   api_name TEXT NOT NULL,
+                   bucket TEXT,
+                   object TEXT,
+                   time_to_response_ns INT8,
+                   remote_host TEXT,
+                   request_id TEXT,
+                   user_agent TEXT,
+                   response_status TEXT,
+                   response_status_code INT8
+                 ) PARTITION BY RANGE (time);`,
+	} {
+		if _, err := setup.ExecContext(ctx, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, table := range []string{logEvents.Name, reqInfo, prefix + schemaMigrationsTable.Name} {
+			if _, err := setup.ExecContext(ctx, "DROP TABLE IF EXISTS "+table); err != nil {
+				t.Errorf("dropping %s: %v", table, err)
+			}
+		}
+	})
+
+	c := newTestDBClient(t, WithTablePrefix(prefix))
+	var n int
+	const countCols = `SELECT COUNT(*) FROM information_schema.columns
+                            WHERE table_name = $1
+                              AND column_name IN ('access_key', 'request_content_length', 'response_content_length', 'version');`
+	if err := c.QueryRowContext(ctx, countCols, reqInfo).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("got %d of the new columns, expected 4", n)
+	}
+	if version, err := c.SchemaVersion(ctx); err != nil || version != len(allMigrations) {
+		t.Errorf("got schema version %d, %v, expected %d", version, err, len(allMigrations))
+	}
+
+	// Inserts into the migrated tables succeed, and initializing them
+	// again is a no-op.
+	insertTestEvent(t, c, time.Now(), testBucketName())
+	if err := c.InitDBTables(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSearchEnvelope(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		insertTestEvent(t, c, now, bucket)
+	}
+
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		key, err := stringToFParam(q, "bucket")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sq := SearchQuery{
+			Query:    q,
+			PageSize: 2,
+			FParams:  map[fParam][]string{key: {bucket}},
+			Envelope: true,
+		}
+		var buf bytes.Buffer
+		if err := c.Search(context.Background(), &sq, &buf); err != nil {
+			t.Fatalf("%s: search failed: %v", q, err)
+		}
+
+		var envelope struct {
+			Results  []json.RawMessage `json:"results"`
+			Page     *int              `json:"page"`
+			PageSize *int              `json:"pageSize"`
+			Total    *int64            `json:"total"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &envelope); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		if len(envelope.Results) != 2 || envelope.Page == nil || *envelope.Page != 0 ||
+			envelope.PageSize == nil || *envelope.PageSize != 2 || envelope.Total == nil || *envelope.Total != 3 {
+			t.Errorf("%s: unexpected envelope: %s", q, buf.String())
+		}
+	}
+}
+
+func TestSearchCount(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	for i := 0; i < 3; i++ {
+		insertTestEvent(t, c, time.Now(), bucket)
+	}
+
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		sq := SearchQuery{
+			Query:        q,
+			ExportFormat: "count",
+			FParams:      bucketFilter(q, bucket),
+		}
+		var buf bytes.Buffer
+		if err := c.Search(context.Background(), &sq, &buf); err != nil {
+			t.Fatalf("%s: search failed: %v", q, err)
+		}
+		if expected := "{\"count\":3}\n"; buf.String() != expected {
+			t.Errorf("%s: got %q, expected %q", q, buf.String(), expected)
+		}
+	}
+}
+
+func TestSearchAllowedBuckets(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket, other := testBucketName(), testBucketName()
+	insertTestEvent(t, c, time.Now(), bucket)
+	insertTestEvent(t, c, time.Now(), other)
+
+	for _, q := range []qType{rawQ, reqInfoQ, joinedQ} {
+		for _, tc := range []struct {
+			fparams  map[fParam][]string
+			expected string
+		}{
+			{bucketFilter(q, bucket), "{\"count\":1}\n"},
+			// Filtering on a bucket that is not allowed returns nothing.
+			{bucketFilter(q, other), "{\"count\":0}\n"},
+		} {
+			sq := SearchQuery{
+				Query:          q,
+				ExportFormat:   "count",
+				FParams:        tc.fparams,
+				AllowedBuckets: []string{bucket},
+			}
+			var buf bytes.Buffer
+			if err := c.Search(context.Background(), &sq, &buf); err != nil {
+				t.Fatalf("%s: search failed: %v", q, err)
+			}
+			if buf.String() != tc.expected {
+				t.Errorf("%s %v: got %q, expected %q", q, tc.fparams, buf.String(), tc.expected)
+			}
+		}
+	}
+}
+
+func TestSearchWithResult(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	for i := 0; i < 3; i++ {
+		insertTestEvent(t, c, time.Now(), bucket)
+	}
+
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		for _, format := range []string{"", "csv", "ndjson", "parquet", "arrow"} {
+			sq := SearchQuery{
+				Query:        q,
+				ExportFormat: format,
+				FParams:      bucketFilter(q, bucket),
+			}
+			if format == "" {
+				sq.PageSize = 2
+			}
+			var buf, resBuf bytes.Buffer
+			if err := c.Search(context.Background(), &sq, &buf); err != nil {
+				t.Fatalf("%s %s: search failed: %v", q, format, err)
+			}
+			res, err := c.SearchWithResult(context.Background(), &sq, &resBuf)
+			if err != nil {
+				t.Fatalf("%s %s: search failed: %v", q, format, err)
+			}
+			expected := SearchResult{RowsWritten: 3, Format: format, Encoding: EncodingNone}
+			if format == "" {
+				expected = SearchResult{RowsWritten: 2, Format: "json", Encoding: EncodingNone}
+			}
+			if !reflect.DeepEqual(res, expected) {
+				t.Errorf("%s %s: got %+v, expected %+v", q, format, res, expected)
+			}
+			if format != "parquet" && !bytes.Equal(buf.Bytes(), resBuf.Bytes()) {
+				t.Errorf("%s %s: output differs from Search: %q vs %q", q, format, resBuf.String(), buf.String())
+			}
+		}
+	}
+}
+
+func TestSearchNonUTCTimeBounds(t *testing.T) {
+	c := newTestDBClient(t)
+
+	// A session in another time zone than the bounds must compare them
+	// the same way.
+	connStr := testConnStrWithParam("timezone", "America/New_York")
+	nyc, err := NewDBClient(context.Background(), connStr, WithPartitionMode(PartitionModeNative))
+	if err != nil {
+		t.Fatalf("Unable to connect to db: %v", err)
+	}
+	t.Cleanup(func() { nyc.Close() })
+
+	bucket := testBucketName()
+	eventTime := time.Now().UTC().Truncate(time.Second)
+	insertTestEvent(t, c, eventTime, bucket)
+
+	ist := time.FixedZone("IST", 5*3600+1800)
+	testCases := []struct {
+		timeStart, timeEnd time.Time
+		inclusive          bool
+		expected           int
+	}{
+		{eventTime.In(ist), eventTime.Add(time.Second).In(ist), false, 1},
+		{eventTime.Add(time.Microsecond).In(ist), eventTime.Add(time.Second).In(ist), false, 0},
+		{eventTime.Add(-time.Second).In(ist), eventTime.In(ist), false, 0},
+		{eventTime.Add(-time.Second).In(ist), eventTime.In(ist), true, 1},
+	}
+	for _, client := range []*DBClient{c, nyc} {
+		for i, testCase := range testCases {
+			sq := SearchQuery{
+				Query:            reqInfoQ,
+				TimeStart:        &testCase.timeStart,
+				TimeEnd:          &testCase.timeEnd,
+				TimeEndInclusive: testCase.inclusive,
+				ExportFormat:     "count",
+				FParams:          bucketFilter(reqInfoQ, bucket),
+			}
+			var buf bytes.Buffer
+			if err := client.Search(context.Background(), &sq, &buf); err != nil {
+				t.Fatalf("Test %d: search failed: %v", i, err)
+			}
+			if expected := fmt.Sprintf("{\"count\":%d}\n", testCase.expected); buf.String() != expected {
+				t.Errorf("Test %d: got %q, expected %q", i, buf.String(), expected)
+			}
+		}
+	}
+}
+
+func TestSearchPartitionBoundary(t *testing.T) {
+	c := newTestDBClient(t)
+
+	// The current and previous partitions are created by InitDBTables.
+	boundary := newPartitionTimeRange(time.Now(), c.PartitionInterval).StartDate
+	bucket := testBucketName()
+	for _, d := range []time.Duration{-time.Microsecond, 0, time.Microsecond} {
+		insertTestEvent(t, c, boundary.Add(d), bucket)
+	}
+
+	search := func(q qType, timeStart, timeEnd time.Time, inclusive bool) int {
+		sq := SearchQuery{
+			Query:            q,
+			TimeStart:        &timeStart,
+			TimeEnd:          &timeEnd,
+			TimeEndInclusive: inclusive,
+			PageSize:         10,
+			FParams:          bucketFilter(q, bucket),
+		}
+		var buf bytes.Buffer
+		if err := c.Search(context.Background(), &sq, &buf); err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		var rows []json.RawMessage
+		if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+			t.Fatal(err)
+		}
+		return len(rows)
+	}
+
+	before, after := boundary.Add(-time.Hour), boundary.Add(time.Hour)
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		// Adjacent half-open ranges return each event exactly once.
+		if n := search(q, before, boundary, false); n != 1 {
+			t.Errorf("%s: expected 1 event before the boundary, got %d", q, n)
+		}
+		if n := search(q, boundary, after, false); n != 2 {
+			t.Errorf("%s: expected 2 events from the boundary, got %d", q, n)
+		}
+		if n := search(q, before, after, false); n != 3 {
+			t.Errorf("%s: expected 3 events across the boundary, got %d", q, n)
+		}
+		if n := search(q, before, boundary, true); n != 2 {
+			t.Errorf("%s: expected 2 events up to and including the boundary, got %d", q, n)
+		}
+	}
+}
+
+func TestSearchSubMicrosecondTime(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	eventTime := time.Now().Truncate(time.Microsecond).Add(999 * time.Nanosecond)
+	insertTestEvent(t, c, eventTime, bucket)
+
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		sq := SearchQuery{
+			Query:            q,
+			TimeStart:        &eventTime,
+			TimeEnd:          &eventTime,
+			TimeEndInclusive: true,
+			PageSize:         10,
+			FParams:          bucketFilter(q, bucket),
+		}
+		var buf bytes.Buffer
+		if err := c.Search(context.Background(), &sq, &buf); err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		var rows []json.RawMessage
+		if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 1 {
+			t.Errorf("%s: expected the event at exactly %s, got %d rows", q, eventTime.Format(time.RFC3339Nano), len(rows))
+		}
+	}
+}
+
+func TestSearchLogContains(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	needle := fmt.Sprintf("agent-%X", rand.Int63())
+	event := newTestEvent(time.Now(), bucket)
+	event["userAgent"] = "MinIO (linux; amd64) " + needle + " 100%_done"
+	insertTestEventMap(t, c, event)
+	insertTestEvent(t, c, time.Now(), bucket)
+
+	testCases := []struct {
+		logContains string
+		expected    int
+	}{
+		{"", 2},
+		{needle, 1},
+		{strings.ToLower(needle), 1},
+		{needle + " 100%_done", 1},
+		// '%' and '_' match literally.
+		{needle + " 100%%done", 0},
+		{needle + " 100__done", 0},
+		// Keys of the log JSON are matched too.
+		{`"userAgent"`, 1},
+	}
+	for _, testCase := range testCases {
+		sq := SearchQuery{
+			Query:       rawQ,
+			PageSize:    10,
+			FParams:     bucketFilter(rawQ, bucket),
+			LogContains: testCase.logContains,
+		}
+		var buf bytes.Buffer
+		if err := c.Search(context.Background(), &sq, &buf); err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		var rows []json.RawMessage
+		if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != testCase.expected {
+			t.Errorf("%q: expected %d rows, got %d", testCase.logContains, testCase.expected, len(rows))
+		}
+	}
+}
+
+func TestDecodeJSONLog(t *testing.T) {
+	const log = `{"api":{"ratio":0.5,"rx":9007199254740993},"tags":{"size":18446744073709551615}}`
+	var v map[string]interface{}
+	if err := decodeJSONLog(log, &v); err != nil {
+		t.Fatal(err)
+	}
+	if rx := v["api"].(map[string]interface{})["rx"]; rx != json.Number("9007199254740993") {
+		t.Errorf("got %#v, expected the exact number", rx)
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != log {
+		t.Errorf("got %s, expected %s", buf, log)
+	}
+	if err := decodeJSONLog(`{"api":`, &v); err == nil {
+		t.Errorf("expected an error decoding a truncated log")
+	}
+}
+
+func TestSearchRawLargeNumbers(t *testing.T) {
+	c := newTestDBClient(t)
+	// The tags are only stored with the raw events.
+	c.PreserveRawEvent = true
+
+	bucket := testBucketName()
+	event := newTestEvent(time.Now(), bucket)
+	// Above 2^53, so not representable exactly as a float64.
+	const size = "9007199254740993"
+	event["tags"] = map[string]interface{}{"size": json.Number(size)}
+	insertTestEventMap(t, c, event)
+
+	for _, format := range []string{"", "ndjson"} {
+		sq := SearchQuery{
+			Query:        rawQ,
+			PageSize:     10,
+			FParams:      bucketFilter(rawQ, bucket),
+			ExportFormat: format,
+		}
+		var buf bytes.Buffer
+		if err := c.Search(context.Background(), &sq, &buf); err != nil {
+			t.Fatalf("%q: Search failed: %v", format, err)
+		}
+		if !strings.Contains(buf.String(), `"size":`+size) {
+			t.Errorf("%q: expected the exact size %s in %s", format, size, buf.String())
+		}
+	}
+}
+
+func TestSearchJSONPathPresence(t *testing.T) {
+	c := newTestDBClient(t)
+	// The tags are only stored with the raw events.
+	c.PreserveRawEvent = true
+
+	bucket := testBucketName()
+	event := newTestEvent(time.Now(), bucket)
+	event["tags"] = map[string]interface{}{"objectErasureMap": nil}
+	event["api"].(map[string]interface{})["timeToFirstByte"] = "500ns"
+	insertTestEventMap(t, c, event)
+	event = newTestEvent(time.Now(), bucket)
+	event["tags"] = nil
+	insertTestEventMap(t, c, event)
+	insertTestEvent(t, c, time.Now(), bucket)
+
+	testCases := []struct {
+		exists, missing []string
+		expected        int
+	}{
+		{nil, nil, 3},
+		// A field holding a JSON null is present.
+		{[]string{"tags"}, nil, 2},
+		{nil, []string{"tags"}, 1},
+		{[]string{"api.timeToFirstByte"}, nil, 1},
+		{nil, []string{"api.timeToFirstByte"}, 2},
+		{[]string{"tags"}, []string{"api.timeToFirstByte"}, 1},
+		{[]string{"requestID", "api.bucket"}, nil, 3},
+		{nil, []string{"requestClaims"}, 3},
+	}
+	for _, testCase := range testCases {
+		sq := SearchQuery{
+			Query:           rawQ,
+			PageSize:        10,
+			FParams:         bucketFilter(rawQ, bucket),
+			JSONPathExists:  testCase.exists,
+			JSONPathMissing: testCase.missing,
+		}
+		var buf bytes.Buffer
+		if err := c.Search(context.Background(), &sq, &buf); err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		var rows []json.RawMessage
+		if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != testCase.expected {
+			t.Errorf("%v %v: expected %d rows, got %d", testCase.exists, testCase.missing, testCase.expected, len(rows))
+		}
+	}
+}
+
+func TestSearchContainsFilter(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	event := newTestEvent(time.Now(), bucket)
+	event["userAgent"] = "curl/7.79.1 100%_done"
+	insertTestEventMap(t, c, event)
+	insertTestEvent(t, c, time.Now(), bucket)
+
+	testCases := []struct {
+		userAgent string
+		expected  int
+	}{
+		{"CURL", 1},
+		{"7.79", 1},
+		{"100%_done", 1},
+		// '%' and '_' match literally.
+		{"100%%done", 0},
+		{"100__done", 0},
+		{"wget", 0},
+	}
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		key, err := stringToFParam(q, "user_agent")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, testCase := range testCases {
+			sq := SearchQuery{
+				Query:           q,
+				PageSize:        10,
+				FParams:         bucketFilter(q, bucket),
+				FParamsContains: map[fParam][]string{key: {testCase.userAgent}},
+			}
+			var buf bytes.Buffer
+			if err := c.Search(context.Background(), &sq, &buf); err != nil {
+				t.Fatalf("Search failed: %v", err)
+			}
+			var rows []json.RawMessage
+			if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != testCase.expected {
+				t.Errorf("%s %q: expected %d rows, got %d", q, testCase.userAgent, testCase.expected, len(rows))
+			}
+		}
+	}
+}
+
+func TestSearchPrefixFilter(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	for _, accessKey := range []string{"svc-backup", "svc_backup", "my-svc-backup"} {
+		event := newTestEvent(time.Now(), bucket)
+		event["requestHeader"] = map[string]interface{}{
+			"Authorization": "AWS4-HMAC-SHA256 Credential=" + accessKey + "/20220101/us-east-1/s3/aws4_request",
+		}
+		insertTestEventMap(t, c, event)
+	}
+
+	testCases := []struct {
+		prefix   string
+		expected int
+	}{
+		{"svc-", 1},
+		{"svc", 2},
+		// The prefix matches only at the start, and '_' literally.
+		{"my-", 1},
+		{"backup", 0},
+		{"svc_", 1},
+		{"SVC", 0},
+	}
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		key, err := stringToFParam(q, "access_key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, testCase := range testCases {
+			sq := SearchQuery{
+				Query:         q,
+				ExportFormat:  "count",
+				FParams:       bucketFilter(q, bucket),
+				FParamsPrefix: map[fParam][]string{key: {testCase.prefix}},
+			}
+			var buf bytes.Buffer
+			if err := c.Search(context.Background(), &sq, &buf); err != nil {
+				t.Fatalf("Search failed: %v", err)
+			}
+			if expected := fmt.Sprintf("{\"count\":%d}\n", testCase.expected); buf.String() != expected {
+				t.Errorf("%s %q: got %q, expected %q", q, testCase.prefix, buf.String(), expected)
+			}
+		}
+	}
+}
+
+func TestSearchSuffixFilter(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	for _, object := range []string{"clip.mp4", "photo.jpg", "clip.mp4.jpg", "backup.tar.gz", "mp4"} {
+		event := newTestEvent(time.Now(), bucket)
+		event["api"].(map[string]interface{})["object"] = object
+		insertTestEventMap(t, c, event)
+	}
+
+	testCases := []struct {
+		suffixes []string
+		expected int
+	}{
+		{[]string{".mp4"}, 1},
+		{[]string{".jpg"}, 2},
+		{[]string{".mp4", ".jpg"}, 3},
+		{[]string{".gz"}, 1},
+		{[]string{".tar.gz"}, 1},
+		{[]string{"mp4"}, 2},
+		{[]string{".MP4"}, 0},
+	}
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		key, err := stringToFParam(q, "object")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, testCase := range testCases {
+			sq := SearchQuery{
+				Query:         q,
+				ExportFormat:  "count",
+				FParams:       bucketFilter(q, bucket),
+				FParamsSuffix: map[fParam][]string{key: testCase.suffixes},
+			}
+			var buf bytes.Buffer
+			if err := c.Search(context.Background(), &sq, &buf); err != nil {
+				t.Fatalf("Search failed: %v", err)
+			}
+			if expected := fmt.Sprintf("{\"count\":%d}\n", testCase.expected); buf.String() != expected {
+				t.Errorf("%s %q: got %q, expected %q", q, testCase.suffixes, buf.String(), expected)
+			}
+		}
+	}
+}
+
+func TestSearchCIDRFilter(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	for _, host := range []string{"10.2.3.4", "10.3.0.1", "2001:db8::1", "2001:db9::1", "example.com", "999.1.1.1", ""} {
+		event := newTestEvent(time.Now(), bucket)
+		event["remotehost"] = host
+		insertTestEventMap(t, c, event)
+	}
+
+	testCases := []struct {
+		cidrs    []string
+		expected int
+	}{
+		{[]string{"10.2.0.0/16"}, 1},
+		{[]string{"10.0.0.0/8"}, 2},
+		{[]string{"2001:db8::/32"}, 1},
+		{[]string{"10.2.0.0/16", "2001:db8::/32"}, 2},
+		{[]string{"0.0.0.0/0"}, 2},
+		{[]string{"192.168.0.0/16"}, 0},
+	}
+	for _, testCase := range testCases {
+		sq := SearchQuery{
+			Query:           reqInfoQ,
+			ExportFormat:    "count",
+			FParams:         bucketFilter(reqInfoQ, bucket),
+			RemoteHostCIDRs: testCase.cidrs,
+		}
+		var buf bytes.Buffer
+		// Records whose remote host is not an IP address are excluded
+		// without failing the search.
+		if err := c.Search(context.Background(), &sq, &buf); err != nil {
+			t.Fatalf("%v: search failed: %v", testCase.cidrs, err)
+		}
+		if expected := fmt.Sprintf("{\"count\":%d}\n", testCase.expected); buf.String() != expected {
+			t.Errorf("%v: got %q, expected %q", testCase.cidrs, buf.String(), expected)
+		}
+	}
+}
+
+func TestReqInfoRowStringInts(t *testing.T) {
+	const big = uint64(1)<<53 + 1
+	length := big
+	row := ReqInfoRow{
+		TimeToResponseNs:     big,
+		ResponseStatusCode:   200,
+		RequestContentLength: &length,
+	}
+
+	buf, err := json.Marshal(reqInfoRowStringInts(row))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"time_to_response_ns":     "9007199254740993",
+		"response_status_code":    float64(200),
+		"request_content_length":  "9007199254740993",
+		"response_content_length": nil,
+	}
+	for k, v := range expected {
+		if got[k] != v {
+			t.Errorf("%s: got %#v, expected %#v", k, got[k], v)
+		}
+	}
+}
+
+func TestSearchIntsAsStrings(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	event := newTestEvent(time.Now(), bucket)
+	event["api"].(map[string]interface{})["timeToResponse"] = "9007199254740993ns"
+	insertTestEventMap(t, c, event)
+
+	const expected = "9007199254740993"
+	for _, format := range []string{"", "ndjson", "csv"} {
+		sq := SearchQuery{
+			Query:         reqInfoQ,
+			PageSize:      10,
+			ExportFormat:  format,
+			FParams:       bucketFilter(reqInfoQ, bucket),
+			IntsAsStrings: true,
+		}
+		var buf bytes.Buffer
+		if err := c.Search(context.Background(), &sq, &buf); err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+
+		var got string
+		switch format {
+		case "":
+			var rows []map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != 1 {
+				t.Fatalf("Expected 1 row, got %d", len(rows))
+			}
+			got, _ = rows[0]["time_to_response_ns"].(string)
+		case "ndjson":
+			var row map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &row); err != nil {
+				t.Fatal(err)
+			}
+			got, _ = row["time_to_response_ns"].(string)
+		case "csv":
+			if !strings.Contains(buf.String(), `,"`+expected+`",`) {
+				t.Errorf("csv: expected a quoted %s in %q", expected, buf.String())
+			}
+			continue
+		}
+		if got != expected {
+			t.Errorf("%q: got time_to_response_ns %q, expected %q", format, got, expected)
+		}
+	}
+}
+
+func TestPartitionIndexes(t *testing.T) {
+	c := newTestDBClient(t)
+
+	const listIndexes = `SELECT indexname FROM pg_indexes WHERE tablename = $1`
+
+	for _, pt := range []time.Time{time.Now(), time.Now().AddDate(0, 1, 0)} {
+		if err := c.createTablePartition(context.Background(), requestInfoTable, pt); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.CreateIndices(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		partition := requestInfoTable.getPartitionName(newPartitionTimeRange(pt, c.PartitionInterval))
+
+		rows, err := c.QueryContext(context.Background(), listIndexes, partition)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexes := make(map[string]bool)
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				t.Fatal(err)
+			}
+			indexes[name] = true
+		}
+		if err := rows.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, col := range []string{"bucket", "api_name", "access_key", "request_id", "status_code"} {
+			if name := fmt.Sprintf("%s_%s_index", partition, col); !indexes[name] {
+				t.Errorf("Index %s not found in %v", name, indexes)
+			}
+		}
+	}
+}
+
+func TestMissingPartitionErr(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected bool
+	}{
+		{&pq.Error{Code: "23514", Message: `no partition of relation "request_info" found for row`}, true},
+		{fmt.Errorf("inserting: %w", &pq.Error{Code: "23514", Message: `no partition of relation "audit_log_events" found for row`}), true},
+		{&pq.Error{Code: "23514", Message: `new row for relation "request_info" violates check constraint`}, false},
+		{&pq.Error{Code: "08006"}, false},
+		{nil, false},
+	}
+	for _, testCase := range testCases {
+		if got := missingPartitionErr(testCase.err); got != testCase.expected {
+			t.Errorf("%v: got %v, expected %v", testCase.err, got, testCase.expected)
+		}
+	}
+}
+
+func TestOutsidePartitionCreationWindow(t *testing.T) {
+	now := time.Date(2022, time.June, 15, 12, 0, 0, 0, time.UTC)
+	c := &DBClient{PartitionCreationWindow: 24 * time.Hour}
+	testCases := []struct {
+		times    []time.Time
+		expected bool
+	}{
+		{nil, false},
+		{[]time.Time{now, now.Add(-24 * time.Hour), now.Add(24 * time.Hour)}, false},
+		{[]time.Time{now, now.Add(-25 * time.Hour)}, true},
+		{[]time.Time{now.Add(25 * time.Hour), now}, true},
+	}
+	for i, testCase := range testCases {
+		if _, got := c.outsidePartitionCreationWindow(testCase.times, now); got != testCase.expected {
+			t.Errorf("case %d: got %v, expected %v", i, got, testCase.expected)
+		}
+	}
+
+	c.PartitionCreationWindow = 0
+	if _, got := c.outsidePartitionCreationWindow([]time.Time{now.AddDate(-20, 0, 0)}, now); got {
+		t.Error("Expected no window with a zero PartitionCreationWindow")
+	}
+}
+
+func TestInsertCreatesMissingPartition(t *testing.T) {
+	c := newTestDBClient(t, WithTablePrefix("partguard_"))
+	ctx := context.Background()
+	defer func() {
+		for _, table := range []Table{c.logEventsTable(), c.reqInfoTable(), c.migrationsTable(), c.watermarksTable()} {
+			if _, err := c.ExecContext(ctx, "DROP TABLE IF EXISTS "+table.Name); err != nil {
+				t.Errorf("dropping %s: %v", table.Name, err)
+			}
+		}
+	}()
+
+	// No partitions are created ahead for these times, which are outside of
+	// the default partition creation window.
+	bucket := testBucketName()
+	old, err := json.Marshal(newTestEvent(time.Date(2001, time.July, 1, 12, 0, 0, 0, time.UTC), bucket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.InsertEvents(ctx, [][]byte{old}); !missingPartitionErr(err) {
+		t.Fatalf("got %v, expected a missing partition error outside of the window", err)
+	}
+	c.PartitionCreationWindow = 0
+	insertTestEvent(t, c, time.Date(2001, time.July, 1, 12, 0, 0, 0, time.UTC), bucket)
+	var events [][]byte
+	for _, eventTime := range []time.Time{
+		time.Date(2002, time.March, 1, 12, 0, 0, 0, time.UTC),
+		time.Date(2002, time.May, 1, 12, 0, 0, 0, time.UTC),
+	} {
+		buf, err := json.Marshal(newTestEvent(eventTime, bucket))
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, buf)
+	}
+	if err := c.InsertEvents(ctx, events); err != nil {
+		t.Fatalf("InsertEvents failed: %v", err)
+	}
+
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		sq := SearchQuery{Query: q, ExportFormat: "count", FParams: bucketFilter(q, bucket)}
+		var buf bytes.Buffer
+		if err := c.Search(ctx, &sq, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if expected := "{\"count\":3}\n"; buf.String() != expected {
+			t.Errorf("%s: got %q, expected %q", q, buf.String(), expected)
+		}
+	}
+}
+
+func TestDedupeRequestInfo(t *testing.T) {
+	c := newTestDBClient(t)
+	c.DedupeRequestInfo = true
+	ctx := context.Background()
+
+	now := time.Now()
+	if err := c.createTablePartition(ctx, requestInfoTable, now); err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := testBucketName()
+	event := newTestEvent(now, bucket)
+	insertTestEventMap(t, c, event)
+	insertTestEventMap(t, c, event)
+	// Events without a request ID are never deduplicated.
+	noID := newTestEvent(now, bucket)
+	delete(noID, "requestID")
+	insertTestEventMap(t, c, noID)
+	insertTestEventMap(t, c, noID)
+
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		sq := SearchQuery{Query: q, PageSize: 10, FParams: bucketFilter(q, bucket)}
+		var buf bytes.Buffer
+		if err := c.Search(ctx, &sq, &buf); err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		var rows []json.RawMessage
+		if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 3 {
+			t.Errorf("%s: expected 3 rows, got %d", q, len(rows))
+		}
+	}
+}
+
+func TestRequestInfoID(t *testing.T) {
+	c := newTestDBClient(t, WithTablePrefix("reqid_"))
+	ctx := context.Background()
+	defer func() {
+		for _, table := range []Table{c.logEventsTable(), c.reqInfoTable(), c.migrationsTable(), c.watermarksTable()} {
+			if _, err := c.ExecContext(ctx, "DROP TABLE IF EXISTS "+table.Name); err != nil {
+				t.Errorf("dropping %s: %v", table.Name, err)
+			}
+		}
+	}()
+
+	c.RequestInfoID = true
+	// The migration adding the column may run again.
+	if err := addReqInfoIDCol(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+
+	insertTestEventID := func(event map[string]interface{}) int64 {
+		buf, err := json.Marshal(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := c.InsertEventID(ctx, buf)
+		if err != nil {
+			t.Fatalf("Unable to insert event: %v", err)
+		}
+		return id
+	}
+
+	bucket := testBucketName()
+	now := time.Now()
+	// A record inserted before the column was added has a NULL id.
+	event := newTestEvent(now.Add(-time.Second), bucket)
+	insertTestEventID(event)
+	const clearID QTemplate = `UPDATE %s SET id = NULL WHERE request_id = $1`
+	if _, err := c.ExecContext(ctx, clearID.build(c.reqInfoTable().Name), event["requestID"]); err != nil {
+		t.Fatal(err)
+	}
+
+	requestIDs := make([]string, 3)
+	ids := make([]int64, 3)
+	for i := range requestIDs {
+		event := newTestEvent(now, bucket)
+		requestIDs[i] = event["requestID"].(string)
+		ids[i] = insertTestEventID(event)
+	}
+
+	search := func(timeAscending bool) []ReqInfoRow {
+		sq := SearchQuery{Query: reqInfoQ, PageSize: 10, TimeAscending: timeAscending, FParams: bucketFilter(reqInfoQ, bucket)}
+		var buf bytes.Buffer
+		if err := c.Search(ctx, &sq, &buf); err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		var rows []ReqInfoRow
+		if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 4 {
+			t.Fatalf("expected 4 rows, got %d", len(rows))
+		}
+		return rows
+	}
+
+	rows := search(true)
+	if rows[0].ID != 0 {
+		t.Errorf("got id %d for the record inserted before the column", rows[0].ID)
+	}
+	// Records with the same time are in insertion order, with the ids
+	// returned by the inserts.
+	for i, row := range rows[1:] {
+		if row.RequestID != requestIDs[i] {
+			t.Errorf("row %d: got request ID %s, expected %s", i+1, row.RequestID, requestIDs[i])
+		}
+		if row.ID != ids[i] || row.ID <= rows[i].ID {
+			t.Errorf("row %d: got id %d after id %d, expected %d", i+1, row.ID, rows[i].ID, ids[i])
+		}
+	}
+	desc := search(false)
+	for i, row := range desc {
+		if expected := rows[len(rows)-1-i].ID; row.ID != expected {
+			t.Errorf("row %d: got id %d in descending order, expected %d", i, row.ID, expected)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := c.GetByRequestID(ctx, &SearchQuery{Query: reqInfoQ}, requestIDs[1], &buf); err != nil {
+		t.Fatal(err)
+	}
+	var found []ReqInfoRow
+	if err := json.Unmarshal(buf.Bytes(), &found); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].ID != rows[2].ID {
+		t.Errorf("got %+v, expected the record with id %d", found, rows[2].ID)
+	}
+}
+
+// newBenchDBClient returns a client of the test database with its tables
+// initialized, skipping the benchmark if there is none.
+func newBenchDBClient(b *testing.B) *DBClient {
+	connStr := os.Getenv(testPgConnStrEnv)
+	if connStr == "" {
+		b.Skipf("%s is not set - skipping benchmark needing a database", testPgConnStrEnv)
+	}
+	c, err := NewDBClient(context.Background(), connStr)
+	if err != nil {
+		b.Fatalf("Unable to connect to db: %v", err)
+	}
+	b.Cleanup(func() { c.Close() })
+	if err := c.InitDBTables(context.Background()); err != nil {
+		b.Fatalf("Unable to initialize tables: %v", err)
+	}
+	return c
+}
+
+func BenchmarkInsertEvent(b *testing.B) {
+	c := newBenchDBClient(b)
+
+	event, err := json.Marshal(newTestEvent(time.Now(), testBucketName()))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.InsertEvent(context.Background(), event); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInsertParsedEvent(b *testing.B) {
+	c := newBenchDBClient(b)
+
+	event, err := testParsedEvent(time.Now(), testBucketName())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.InsertParsedEvent(context.Background(), event); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// testParsedEvent returns a test event parsed like by InsertEvent.
+func testParsedEvent(eventTime time.Time, bucket string) (*Event, error) {
+	buf, err := json.Marshal(newTestEvent(eventTime, bucket))
+	if err != nil {
+		return nil, err
+	}
+	return parseJSONEvent(buf)
+}
+
+// BenchmarkEncodeEvent and BenchmarkEncodeParsedEvent compare the work done
+// by InsertEvent and InsertParsedEvent for the same event before inserting
+// it into the DB. InsertEvent parses the JSON of the event, which a caller
+// holding a parsed event would also have to encode first.
+func BenchmarkEncodeEvent(b *testing.B) {
+	c := &DBClient{}
+	buf, err := json.Marshal(newTestEvent(time.Now(), testBucketName()))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.encodeEvent(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeParsedEvent(b *testing.B) {
+	c := &DBClient{}
+	event, err := testParsedEvent(time.Now(), testBucketName())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.encodeParsedEvent(event, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	c := newTestDBClient(t)
+
+	if err := c.HealthCheck(context.Background()); err != nil {
+		t.Fatalf("Unexpected health check error: %v", err)
+	}
+
+	c.DB.Close()
+	if err := c.HealthCheck(context.Background()); err == nil {
+		t.Errorf("Expected a health check error with a closed db")
+	}
+}
+
+func TestWritePage(t *testing.T) {
+	c := &DBClient{}
+	rows := []ReqInfoRow{
+		{Time: time.Date(2022, time.March, 7, 1, 2, 3, 0, time.UTC), APIName: "GetObject", Bucket: "a<b>"},
+		{Time: time.Date(2022, time.March, 7, 1, 2, 4, 0, time.UTC), APIName: "PutObject", ResponseStatusCode: 200},
+		{APIName: "HeadObject"},
+	}
+
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		for n := 0; n <= len(rows); n++ {
+			var buf bytes.Buffer
+			err := c.writePage(context.Background(), c, &SearchQuery{Query: q}, &buf, func(aw *jsonArrayWriter) error {
+				for _, row := range rows[:n] {
+					if err := aw.Write(row); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The output must be the same as when encoding the whole
+			// page at once, which is null for an empty page of reqinfo
+			// results.
+			page := []ReqInfoRow{}
+			if q == reqInfoQ {
+				page = nil
+			}
+			var expected bytes.Buffer
+			if err := json.NewEncoder(&expected).Encode(append(page, rows[:n]...)); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != expected.String() {
+				t.Errorf("%s, %d rows: got %q, expected %q", q, n, buf.String(), expected.String())
+			}
+		}
+	}
+}
+
+func TestWritePageDataEnvelope(t *testing.T) {
+	c := &DBClient{}
+	sq := SearchQuery{PageSize: 10, PageNumber: 2, DataEnvelope: true}
+
+	for _, n := range []int{0, 9, 10, 11} {
+		var buf bytes.Buffer
+		err := c.writePage(context.Background(), c, &sq, &buf, func(aw *jsonArrayWriter) error {
+			// The search fetches at most one record more than the page
+			// size.
+			for i := 0; i < n; i++ {
+				if err := aw.Write(ReqInfoRow{APIName: fmt.Sprintf("api-%d", i)}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var page struct {
+			Data     []ReqInfoRow `json:"data"`
+			Page     int          `json:"page"`
+			PageSize int          `json:"pageSize"`
+			HasMore  bool         `json:"hasMore"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &page); err != nil {
+			t.Fatalf("%d rows: %v (output: %s)", n, err, buf.String())
+		}
+		expectedLen := n
+		if expectedLen > sq.PageSize {
+			expectedLen = sq.PageSize
+		}
+		if len(page.Data) != expectedLen {
+			t.Errorf("%d rows: got %d results, expected %d", n, len(page.Data), expectedLen)
+		}
+		if expected := n > sq.PageSize; page.HasMore != expected {
+			t.Errorf("%d rows: got hasMore %t, expected %t", n, page.HasMore, expected)
+		}
+		if page.Page != 2 || page.PageSize != 10 {
+			t.Errorf("%d rows: got page %d and page size %d", n, page.Page, page.PageSize)
+		}
+	}
+}
+
+func TestWritePageMaxResponseBytes(t *testing.T) {
+	small := ReqInfoRow{APIName: "GetObject"}
+	large := ReqInfoRow{APIName: "PutObject", Object: strings.Repeat("x", 1000)}
+	write := func(c *DBClient, sq *SearchQuery, rows ...ReqInfoRow) (string, error) {
+		var buf bytes.Buffer
+		err := c.writePage(context.Background(), c, sq, &buf, func(aw *jsonArrayWriter) error {
+			for _, row := range rows {
+				if err := aw.Write(row); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return buf.String(), err
+	}
+
+	// The limit is exact, including the envelope and its metadata, and
+	// the null of empty pages.
+	testCases := []struct {
+		sq   *SearchQuery
+		rows []ReqInfoRow
+	}{
+		{&SearchQuery{}, []ReqInfoRow{small, small}},
+		{&SearchQuery{Query: reqInfoQ}, nil},
+		{&SearchQuery{DataEnvelope: true, PageSize: 10}, []ReqInfoRow{small}},
+		{&SearchQuery{DataEnvelope: true, PageSize: 10}, nil},
+	}
+	for _, tc := range testCases {
+		out, err := write(&DBClient{}, tc.sq, tc.rows...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &DBClient{MaxResponseBytes: int64(len(out))}
+		if _, err := write(c, tc.sq, tc.rows...); err != nil {
+			t.Errorf("%+v: got error %v, expected none", tc.sq, err)
+		}
+		c.MaxResponseBytes--
+		got, err := write(c, tc.sq, tc.rows...)
+		var tooLarge *ResponseTooLargeError
+		if !errors.As(err, &tooLarge) || !errors.Is(err, ErrResponseTooLarge) || tooLarge.MaxBytes != c.MaxResponseBytes {
+			t.Errorf("%+v: got error %v, expected a *ResponseTooLargeError", tc.sq, err)
+		}
+		if got != "" {
+			t.Errorf("%+v: got output %q, expected nothing to be written", tc.sq, got)
+		}
+	}
+
+	// An oversized record fails the page, even the first one, without
+	// anything being written, so that the error can still be reported.
+	c := &DBClient{MaxResponseBytes: 500}
+	for _, sq := range []*SearchQuery{{}, {Envelope: true}, {DataEnvelope: true, PageSize: 10}} {
+		for _, rows := range [][]ReqInfoRow{{large}, {small, large, small}} {
+			out, err := write(c, sq, rows...)
+			if !errors.Is(err, ErrResponseTooLarge) {
+				t.Errorf("%+v: got error %v, expected ErrResponseTooLarge", sq, err)
+			}
+			if out != "" {
+				t.Errorf("%+v: got output %q, expected nothing to be written", sq, out)
+			}
+		}
+	}
+}
+
+func TestSearchDataEnvelope(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	now := time.Now()
+	for i := 0; i < 15; i++ {
+		insertTestEvent(t, c, now.Add(time.Duration(i)*time.Millisecond), bucket)
+	}
+
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		for pageNumber, expectedHasMore := range []bool{true, false} {
+			sq := SearchQuery{
+				Query:        q,
+				PageSize:     10,
+				PageNumber:   pageNumber,
+				FParams:      bucketFilter(q, bucket),
+				DataEnvelope: true,
+			}
+			var buf bytes.Buffer
+			if err := c.Search(context.Background(), &sq, &buf); err != nil {
+				t.Fatalf("Search failed: %v", err)
+			}
+			var page struct {
+				Data    []json.RawMessage `json:"data"`
+				HasMore bool              `json:"hasMore"`
+			}
+			if err := json.Unmarshal(buf.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			if expected := []int{10, 5}[pageNumber]; len(page.Data) != expected {
+				t.Errorf("%s page %d: got %d results, expected %d", q, pageNumber, len(page.Data), expected)
+			}
+			if page.HasMore != expectedHasMore {
+				t.Errorf("%s page %d: got hasMore %t, expected %t", q, pageNumber, page.HasMore, expectedHasMore)
+			}
+		}
+	}
+}
+
+func TestDeleteReqInfoRequiresFilter(t *testing.T) {
+	c := &DBClient{}
+	timeStart := time.Now().Add(-time.Hour)
+	for _, sq := range []SearchQuery{
+		{Query: reqInfoQ},
+		{Query: reqInfoQ, TimeStart: &timeStart},
+		{Query: reqInfoQ, TimeStart: &timeStart, FParams: map[fParam][]string{"access_key": {}}},
+		{Query: reqInfoQ, FParams: map[fParam][]string{"access_key": {"*"}}},
+		{Query: reqInfoQ, FParams: map[fParam][]string{"bucket": {"photos", "**"}}},
+		{Query: reqInfoQ, FParamsContains: map[fParam][]string{"object": {""}}},
+		{Query: reqInfoQ, FilterGroups: []map[fParam][]string{{"bucket": {"photos"}}, {"bucket": {"*"}}}},
+	} {
+		if _, err := c.DeleteReqInfo(context.Background(), &sq); err == nil {
+			t.Errorf("Expected an error deleting with %+v", sq)
+		}
+	}
+}
+
+func TestDeleteByTimeRangeErrors(t *testing.T) {
+	c := &DBClient{}
+	ctx := context.Background()
+	start := time.Date(2022, time.March, 7, 10, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+
+	testCases := []struct {
+		name       string
+		table      Table
+		start, end time.Time
+	}{
+		{"no start", c.reqInfoTable(), time.Time{}, end},
+		{"no end", c.reqInfoTable(), start, time.Time{}},
+		{"empty range", c.reqInfoTable(), start, start},
+		{"reversed range", c.logEventsTable(), end, start},
+		{"unpartitioned table", c.migrationsTable(), start, end},
+		{"unknown table", Table{Name: "pg_class", TimeColumn: "time"}, start, end},
+	}
+	for _, testCase := range testCases {
+		if _, err := c.DeleteByTimeRange(ctx, testCase.table, testCase.start, testCase.end); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%s: got %v, expected an invalid query error", testCase.name, err)
+		}
+	}
+
+	c = &DBClient{skipRawLog: true}
+	if _, err := c.DeleteByTimeRange(ctx, c.logEventsTable(), start, end); !errors.Is(err, ErrRawLogDisabled) {
+		t.Errorf("got %v, expected %v", err, ErrRawLogDisabled)
+	}
+}
+
+func TestDeleteByTimeRange(t *testing.T) {
+	c := newTestDBClient(t, WithTablePrefix("deltest_"))
+	ctx := context.Background()
+	defer func() {
+		for _, table := range []Table{c.logEventsTable(), c.reqInfoTable(), c.migrationsTable(), c.watermarksTable()} {
+			if _, err := c.ExecContext(ctx, "DROP TABLE IF EXISTS "+table.Name); err != nil {
+				t.Errorf("dropping %s: %v", table.Name, err)
+			}
+		}
+	}()
+
+	bucket := testBucketName()
+	start := time.Date(2001, time.July, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		insertTestEvent(t, c, start.Add(time.Duration(i)*30*time.Minute), bucket)
+	}
+
+	// The range of a bad import, from 10:30 to 11:30 excluded.
+	for _, table := range c.tables() {
+		deleted, err := c.DeleteByTimeRange(ctx, table, start.Add(30*time.Minute), start.Add(90*time.Minute))
+		if err != nil {
+			t.Fatalf("%s: %v", table.Name, err)
+		}
+		if deleted != 2 {
+			t.Errorf("%s: deleted %d records, expected 2", table.Name, deleted)
+		}
+	}
+
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		timeStart := start.Add(-time.Hour)
+		sq := SearchQuery{Query: q, TimeStart: &timeStart, TimeAscending: true, ExportFormat: "ndjson", FParams: bucketFilter(q, bucket)}
+		var buf bytes.Buffer
+		if err := c.Search(ctx, &sq, &buf); err != nil {
+			t.Fatal(err)
+		}
+		var times []time.Time
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var row struct {
+				Time      time.Time `json:"time"`
+				EventTime time.Time `json:"event_time"`
+			}
+			if err := dec.Decode(&row); err != nil {
+				t.Fatal(err)
+			}
+			if q == rawQ {
+				row.Time = row.EventTime
+			}
+			times = append(times, row.Time.UTC())
+		}
+		expected := []time.Time{start, start.Add(90 * time.Minute)}
+		if len(times) != 2 || !times[0].Equal(expected[0]) || !times[1].Equal(expected[1]) {
+			t.Errorf("%s: got records at %v, expected %v", q, times, expected)
+		}
+	}
+}
+
+func TestDeleteReqInfo(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	now := time.Now()
+	for _, accessKey := range []string{"alice", "alice", "bob"} {
+		ev := newTestEvent(now, bucket)
+		ev["requestHeader"] = map[string]string{
+			"Authorization": "AWS " + accessKey + ":signature",
+		}
+		insertTestEventMap(t, c, ev)
+	}
+
+	sq := SearchQuery{
+		Query:   reqInfoQ,
+		FParams: map[fParam][]string{"bucket": {bucket}, "access_key": {"alice"}},
+	}
+	deleted, err := c.DeleteReqInfo(ctx, &sq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Errorf("Deleted %d records, expected 2", deleted)
+	}
+
+	sq = SearchQuery{
+		Query:   reqInfoQ,
+		FParams: map[fParam][]string{"bucket": {bucket}},
+	}
+	remaining, err := c.countRows(ctx, c, &sq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 1 {
+		t.Errorf("%d records remain, expected 1", remaining)
+	}
+
+	// The raw logs of the deleted records are deleted too.
+	sq = SearchQuery{
+		Query:   rawQ,
+		FParams: bucketFilter(rawQ, bucket),
+	}
+	remaining, err = c.countRows(ctx, c, &sq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 1 {
+		t.Errorf("%d raw logs remain, expected 1", remaining)
+	}
+}
+
+func TestCapPageSize(t *testing.T) {
+	c := &DBClient{MaxPageSize: 100}
+
+	sq := &SearchQuery{Query: reqInfoQ, PageSize: 1000, PageNumber: 3}
+	got, err := c.capPageSize(sq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PageSize != 100 || got.PageNumber != 3 {
+		t.Errorf("got page size %d and page %d, expected 100 and 3", got.PageSize, got.PageNumber)
+	}
+	if sq.PageSize != 1000 {
+		t.Errorf("the given search query was modified")
+	}
+
+	for _, sq := range []*SearchQuery{
+		{Query: reqInfoQ, PageSize: 100},
+		{Query: reqInfoQ, PageSize: 1000, ExportFormat: "ndjson"},
+	} {
+		if got, err := c.capPageSize(sq); err != nil || got != sq {
+			t.Errorf("expected %+v to be left as is, got %+v, %v", sq, got, err)
+		}
+	}
+
+	if got, err := (&DBClient{}).capPageSize(sq); err != nil || got != sq {
+		t.Errorf("expected no cap with a zero MaxPageSize, got %+v, %v", got, err)
+	}
+
+	limit := 1000
+	got, err = c.capPageSize(&SearchQuery{Query: reqInfoQ, Limit: &limit})
+	if err != nil || *got.Limit != 100 || limit != 1000 {
+		t.Errorf("got %v, %v, expected the limit to be capped to 100", got, err)
+	}
+
+	c.PageSizePolicy = PageSizeReject
+	_, err = c.capPageSize(sq)
+	var vErr *ValidationError
+	if !errors.As(err, &vErr) || vErr.Field != "PageSize" {
+		t.Errorf("got %v, expected a PageSize validation error", err)
+	}
+}
+
+func TestCapLastDuration(t *testing.T) {
+	c := &DBClient{MaxLastDuration: 24 * time.Hour}
+
+	last := 8760 * time.Hour
+	sq := &SearchQuery{Query: reqInfoQ, LastDuration: &last}
+	got, err := c.capLastDuration(sq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got.LastDuration != 24*time.Hour {
+		t.Errorf("got last duration %s, expected 24h", *got.LastDuration)
+	}
+	if *sq.LastDuration != 8760*time.Hour {
+		t.Errorf("the given search query was modified")
+	}
+
+	q, _, err := c.BuildSearchSQL(context.Background(), sq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(q, "CURRENT_TIMESTAMP - '86400 seconds'::interval") {
+		t.Errorf("expected the clamped duration in the query, got %s", q)
+	}
+
+	short := time.Hour
+	for _, sq := range []*SearchQuery{
+		{Query: reqInfoQ, LastDuration: &short},
+		{Query: reqInfoQ},
+	} {
+		if got, err := c.capLastDuration(sq); err != nil || got != sq {
+			t.Errorf("expected %+v to be left as is, got %+v, %v", sq, got, err)
+		}
+	}
+
+	if got, err := (&DBClient{}).capLastDuration(sq); err != nil || got != sq {
+		t.Errorf("expected no cap with a zero MaxLastDuration, got %+v, %v", got, err)
+	}
+
+	c.LastDurationPolicy = LastDurationReject
+	_, err = c.capLastDuration(sq)
+	var vErr *ValidationError
+	if !errors.As(err, &vErr) || vErr.Field != "LastDuration" || !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got %v, expected a LastDuration validation error", err)
+	}
+	if _, _, err := c.BuildSearchSQL(context.Background(), sq); !errors.As(err, &vErr) {
+		t.Errorf("got %v, expected BuildSearchSQL to reject the search", err)
+	}
+	if got, err := c.capLastDuration(&SearchQuery{Query: reqInfoQ, LastDuration: &short}); err != nil || *got.LastDuration != short {
+		t.Errorf("got %v, %v, expected a duration below the maximum to be accepted", got, err)
+	}
+}
+
+func TestCheckTimeBound(t *testing.T) {
+	c := &DBClient{RequireTimeBound: true}
+	now := time.Now()
+	last := time.Hour
+
+	bounded := []*SearchQuery{
+		{Query: reqInfoQ, TimeStart: &now},
+		{Query: reqInfoQ, TimeEnd: &now},
+		{Query: rawQ, LastDuration: &last},
+		{Query: reqInfoQ, SinceWatermark: "nightly"},
+		{Query: reqInfoQ, FParams: map[fParam][]string{"request_id": {"16D8B3E5F0A1B000", "16D8B3E5F0A1B001"}}},
+		{Query: rawQ, FParams: map[fParam][]string{rawQRequestFieldsMap["request_id"]: {"16D8B3E5F0A1B000"}}},
+		{Query: joinedQ, FParams: map[fParam][]string{"request_id": {"16D8B3E5F0A1B000"}}},
+	}
+	for i, sq := range bounded {
+		if err := c.checkTimeBound(sq); err != nil {
+			t.Errorf("Test %d: got error %v, expected none", i, err)
+		}
+	}
+
+	unbounded := []*SearchQuery{
+		{Query: reqInfoQ},
+		{Query: reqInfoQ, FParams: map[fParam][]string{"bucket": {"photos"}}},
+		{Query: reqInfoQ, FParams: map[fParam][]string{"request_id": {"16D8*"}}},
+		{Query: reqInfoQ, FParams: map[fParam][]string{"request_id": {"16D8B3E5F0A1B000", ""}}},
+		{Query: rawQ, FParams: map[fParam][]string{"request_id": {"16D8B3E5F0A1B000"}}},
+	}
+	for i, sq := range unbounded {
+		if err := c.checkTimeBound(sq); err != ErrUnboundedQuery {
+			t.Errorf("Test %d: got error %v, expected ErrUnboundedQuery", i, err)
+		}
+		// Searches fail before accessing the DB.
+		if err := c.Search(context.Background(), sq, io.Discard); !errors.Is(err, ErrUnboundedQuery) || !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("Test %d: got search error %v, expected ErrUnboundedQuery", i, err)
+		}
+		if _, err := c.SearchRows(context.Background(), sq); !errors.Is(err, ErrUnboundedQuery) {
+			t.Errorf("Test %d: got SearchRows error %v, expected ErrUnboundedQuery", i, err)
+		}
+		// Unbounded searches are allowed by default.
+		if err := (&DBClient{}).checkTimeBound(sq); err != nil {
+			t.Errorf("Test %d: got error %v without RequireTimeBound", i, err)
+		}
+	}
+}
+
+func TestReqInfoCSVRecordNullAs(t *testing.T) {
+	bucket := ""
+	row := reqInfoCSVRow{APIName: "ListBuckets", Bucket: &bucket}
+
+	for _, nullAs := range []string{"", `\N`} {
+		sq := SearchQuery{Query: reqInfoQ, NullAs: nullAs}
+		record := sq.reqInfoCSVRecord(row)
+		// The empty bucket is output as is, unlike the NULL access key
+		// and content lengths.
+		if record[2] != nullAs || record[3] != "" || record[11] != nullAs || record[12] != nullAs {
+			t.Errorf("NullAs %q: got %q", nullAs, record)
+		}
+	}
+}
+
+func TestOmitEmpty(t *testing.T) {
+	row := ReqInfoRow{
+		Time:               time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+		APIName:            "ListObjectsV2",
+		Bucket:             "photos",
+		TimeToResponseNs:   1500,
+		ResponseStatusCode: 200,
+	}
+	testCases := []struct {
+		sq       SearchQuery
+		expected string
+	}{
+		{
+			SearchQuery{Query: reqInfoQ, OmitEmpty: true},
+			`{"time":"2021-03-04T05:06:07Z","api_name":"ListObjectsV2","bucket":"photos","time_to_response_ns":1500,"response_status_code":200}`,
+		},
+		{
+			SearchQuery{Query: reqInfoQ, OmitEmpty: true, Columns: []string{"object", "bucket", "request_content_length"}},
+			`{"bucket":"photos"}`,
+		},
+		{
+			SearchQuery{Query: reqInfoQ, OmitEmpty: true, IntsAsStrings: true},
+			`{"time":"2021-03-04T05:06:07Z","api_name":"ListObjectsV2","bucket":"photos","time_to_response_ns":"1500","response_status_code":200}`,
+		},
+		{
+			// The default encoding has all the fields.
+			SearchQuery{Query: reqInfoQ, Columns: []string{"object", "request_content_length"}},
+			`{"object":"","request_content_length":null}`,
+		},
+	}
+	for i, testCase := range testCases {
+		v, err := testCase.sq.reqInfoJSONValue(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != testCase.expected {
+			t.Errorf("Test %d: got %s, expected %s", i, buf, testCase.expected)
+		}
+	}
+
+	// Logs are output whole.
+	sq := SearchQuery{Query: rawQ, OmitEmpty: true}
+	logEvent := LogEventRow{
+		EventTime: row.Time,
+		Log: map[string]interface{}{
+			"api":        map[string]interface{}{"name": "GetObject", "object": "", "rx": 0, "tx": 0.5},
+			"remotehost": nil,
+			"tags":       []interface{}{"", 0},
+		},
+	}
+	v, err := sq.jsonValue(logEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"event_time":"2021-03-04T05:06:07Z","log":{"api":{"name":"GetObject","object":"","rx":0,"tx":0.5},"remotehost":null,"tags":["",0]}}`; string(buf) != expected {
+		t.Errorf("got %s, expected %s", buf, expected)
+	}
+
+	// Only the top-level empty fields of other records are left out.
+	v, err = sq.jsonValue(map[string]interface{}{"count": 0, "group": map[string]interface{}{"name": ""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, err = json.Marshal(v); err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"group":{"name":""}}`; string(buf) != expected {
+		t.Errorf("got %s, expected %s", buf, expected)
+	}
+}
+
+func TestReqInfoColumns(t *testing.T) {
+	length := uint64(1) << 60
+	row := ReqInfoRow{
+		Time:                 time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+		APIName:              "PutObject",
+		Bucket:               "photos",
+		RequestContentLength: &length,
+	}
+	sq := SearchQuery{
+		Query:         reqInfoQ,
+		Columns:       []string{"request_content_length", "bucket", "time"},
+		IntsAsStrings: true,
+	}
+
+	v, err := sq.reqInfoJSONValue(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"request_content_length":"1152921504606846976","bucket":"photos","time":"2021-03-04T05:06:07Z"}`; string(buf) != expected {
+		t.Errorf("got %s, expected %s", buf, expected)
+	}
+
+	values := sq.reqInfoRowValues(row)
+	if expected := []interface{}{length, "photos", row.Time}; !reflect.DeepEqual(values, expected) {
+		t.Errorf("got values %v, expected %v", values, expected)
+	}
+	var names []string
+	for _, col := range sq.reqInfoOutputParquetColumns() {
+		names = append(names, col.Name)
+	}
+	if !reflect.DeepEqual(names, sq.Columns) {
+		t.Errorf("got parquet columns %v, expected %v", names, sq.Columns)
+	}
+
+	bucket := "photos"
+	record := sq.reqInfoCSVRecord(reqInfoCSVRow{Bucket: &bucket, Time: row.Time})
+	if expected := []string{"", "photos", "2021-03-04T05:06:07Z"}; !reflect.DeepEqual(record, expected) {
+		t.Errorf("got record %q, expected %q", record, expected)
+	}
+}
+
+// sizeClass is a RowTransform of reqInfoQ searches injecting a derived
+// size_class field into the records.
+func sizeClass(row interface{}) (interface{}, error) {
+	r, ok := row.(ReqInfoRow)
+	if !ok {
+		return nil, fmt.Errorf("unexpected row %T", row)
+	}
+	class := "small"
+	if r.RequestContentLength != nil && *r.RequestContentLength >= 1<<20 {
+		class = "large"
+	}
+	return struct {
+		ReqInfoRow
+		SizeClass string `json:"size_class"`
+	}{r, class}, nil
+}
+
+func TestRowTransform(t *testing.T) {
+	length := uint64(1) << 30
+	row := ReqInfoRow{
+		Time:                 time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+		APIName:              "PutObject",
+		Bucket:               "photos",
+		RequestContentLength: &length,
+	}
+	sq := SearchQuery{Query: reqInfoQ, RowTransform: sizeClass}
+	v, err := sq.reqInfoJSONValue(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["size_class"] != "large" || got["bucket"] != "photos" {
+		t.Errorf("got %s, expected the record with a large size_class", buf)
+	}
+
+	// A returned ReqInfoRow is output as usual.
+	sq = SearchQuery{
+		Query:   reqInfoQ,
+		Columns: []string{"bucket"},
+		RowTransform: func(row interface{}) (interface{}, error) {
+			r := row.(ReqInfoRow)
+			r.Bucket = strings.ToUpper(r.Bucket)
+			return r, nil
+		},
+	}
+	if v, err = sq.reqInfoJSONValue(row); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err = json.Marshal(v); err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"bucket":"PHOTOS"}`; string(buf) != expected {
+		t.Errorf("got %s, expected %s", buf, expected)
+	}
+
+	// Errors are wrapped.
+	errBoom := errors.New("boom")
+	sq = SearchQuery{Query: rawQ, RowTransform: func(interface{}) (interface{}, error) { return nil, errBoom }}
+	_, err = sq.recordJSONValue(LogEventRow{})
+	var rtErr *RowTransformError
+	if !errors.As(err, &rtErr) || !errors.Is(err, errBoom) {
+		t.Errorf("got %v, expected a *RowTransformError wrapping the error", err)
+	}
+
+	// The tabular export formats are not supported.
+	for _, format := range []string{"", "ndjson", "count", "csv", "parquet"} {
+		sq := SearchQuery{Query: reqInfoQ, ExportFormat: format, RowTransform: sizeClass}
+		err := sq.Validate()
+		if expectErr := format == "csv" || format == "parquet"; (err != nil) != expectErr {
+			t.Errorf("%q: got error %v, expected error: %v", format, err, expectErr)
+		}
+	}
+}
+
+func TestSearchColumns(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	insertTestEvent(t, c, time.Now(), bucket)
+
+	columns := []string{"bucket", "api_name"}
+	for _, format := range []string{"", "csv"} {
+		sq := SearchQuery{
+			Query:        reqInfoQ,
+			PageSize:     10,
+			ExportFormat: format,
+			FParams:      bucketFilter(reqInfoQ, bucket),
+			Columns:      columns,
+		}
+		var buf bytes.Buffer
+		if err := c.Search(context.Background(), &sq, &buf); err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+
+		switch format {
+		case "":
+			var rows []map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+				t.Fatal(err)
+			}
+			expected := []map[string]interface{}{{"bucket": bucket, "api_name": "PutObject"}}
+			if !reflect.DeepEqual(rows, expected) {
+				t.Errorf("got %v, expected %v", rows, expected)
+			}
+		case "csv":
+			records, err := csv.NewReader(&buf).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := [][]string{columns, {bucket, "PutObject"}}
+			if !reflect.DeepEqual(records, expected) {
+				t.Errorf("got %q, expected %q", records, expected)
+			}
+		}
+	}
+
+	sq := SearchQuery{Query: reqInfoQ, Columns: []string{"log"}}
+	if err := c.Search(context.Background(), &sq, &bytes.Buffer{}); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got %v, expected an invalid query error", err)
+	}
+}
+
+func TestSearchRowTransform(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	event := newTestEvent(time.Now(), bucket)
+	event["requestHeader"] = map[string]string{"Content-Length": "2097152"}
+	insertTestEventMap(t, c, event)
+	insertTestEvent(t, c, time.Now(), bucket)
+
+	for _, format := range []string{"", "ndjson"} {
+		sq := SearchQuery{
+			Query:         reqInfoQ,
+			PageSize:      10,
+			ExportFormat:  format,
+			FParams:       bucketFilter(reqInfoQ, bucket),
+			TimeAscending: true,
+			RowTransform:  sizeClass,
+		}
+		var buf bytes.Buffer
+		if err := c.Search(context.Background(), &sq, &buf); err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		var rows []map[string]interface{}
+		if format == "" {
+			if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			dec := json.NewDecoder(&buf)
+			for dec.More() {
+				var row map[string]interface{}
+				if err := dec.Decode(&row); err != nil {
+					t.Fatal(err)
+				}
+				rows = append(rows, row)
+			}
+		}
+		var classes []interface{}
+		for _, row := range rows {
+			classes = append(classes, row["size_class"])
+		}
+		if expected := []interface{}{"large", "small"}; !reflect.DeepEqual(classes, expected) {
+			t.Errorf("%q: got size classes %v, expected %v", format, classes, expected)
+		}
+	}
+
+	// The search fails with the error of the transform.
+	errBoom := errors.New("boom")
+	sq := SearchQuery{
+		Query:        rawQ,
+		PageSize:     10,
+		FParams:      bucketFilter(rawQ, bucket),
+		RowTransform: func(interface{}) (interface{}, error) { return nil, errBoom },
+	}
+	if err := c.Search(context.Background(), &sq, io.Discard); !errors.Is(err, errBoom) {
+		t.Errorf("got %v, expected the error of the transform", err)
+	}
+}
+
+func TestSearchCSVNullAs(t *testing.T) {
+	c := newTestDBClient(t)
+
+	event := newTestEvent(time.Now(), testBucketName())
+	insertTestEventMap(t, c, event)
+	requestID := event["requestID"].(string)
+	if _, err := c.Exec(`UPDATE request_info SET bucket = NULL WHERE request_id = $1`, requestID); err != nil {
+		t.Fatal(err)
+	}
+
+	sq := SearchQuery{
+		Query:        reqInfoQ,
+		ExportFormat: "csv",
+		FParams:      map[fParam][]string{"request_id": {requestID}},
+		NullAs:       `\N`,
+	}
+	var buf bytes.Buffer
+	if err := c.Search(context.Background(), &sq, &buf); err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected a header and a record, got %q", records)
+	}
+	if got := records[1][3]; got != `\N` {
+		t.Errorf("got bucket %q, expected \\N", got)
+	}
+}
+
+func TestClose(t *testing.T) {
+	// sql.Open does not connect, and nothing listens on port 1, so that
+	// partition maintenance fails right away.
+	db, err := sql.Open("postgres", "postgres://localhost:1/test?sslmode=disable&connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &DBClient{DB: db}
+	c.StartPartitionMaintainer(context.Background(), time.Hour)
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Closing again failed: %v", err)
+	}
+
+	if err := c.InsertEvent(context.Background(), []byte(`{}`)); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("got %v inserting, expected ErrClientClosed", err)
+	}
+	if err := c.Search(context.Background(), &SearchQuery{Query: reqInfoQ}, &bytes.Buffer{}); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("got %v searching, expected ErrClientClosed", err)
+	}
+	if _, err := c.DistinctValues(context.Background(), "bucket", &SearchQuery{Query: reqInfoQ}, 10); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("got %v querying distinct values, expected ErrClientClosed", err)
+	}
+
+	// A maintainer started after closing does not run.
+	c.StartPartitionMaintainer(context.Background(), time.Hour)
+	if len(c.stopMaintainers) != 0 {
+		t.Errorf("expected no maintainer to be started")
+	}
+}
+
+func TestSearchLimit(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		insertTestEvent(t, c, now.Add(time.Duration(i)*time.Second), bucket)
+	}
+
+	limit := 2
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		sq := SearchQuery{
+			Query:   q,
+			Limit:   &limit,
+			FParams: bucketFilter(q, bucket),
+		}
+		var buf bytes.Buffer
+		if err := c.Search(context.Background(), &sq, &buf); err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		var rows []json.RawMessage
+		if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != limit {
+			t.Errorf("%s: expected %d rows, got %d", q, limit, len(rows))
+		}
+	}
+}
+
+func TestValidateTablePrefix(t *testing.T) {
+	for _, prefix := range []string{"", "env1_", "_", "a", "env_0123456789"} {
+		if err := validateTablePrefix(prefix); err != nil {
+			t.Errorf("%q: unexpected error: %v", prefix, err)
+		}
+	}
+	for _, prefix := range []string{"1env_", "Env1_", "env-1_", "env1; DROP TABLE request_info; --", "env_01234567890"} {
+		if err := validateTablePrefix(prefix); err == nil {
+			t.Errorf("%q: expected an error", prefix)
+		}
+	}
+}
+
+func TestTablePrefixNames(t *testing.T) {
+	c := &DBClient{tablePrefix: "env1_", PartitionInterval: PartitionDaily}
+
+	p := newPartitionTimeRange(time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC), c.PartitionInterval)
+	reqInfo := c.reqInfoTable()
+	if expected := "env1_request_info_d2021_03_04"; reqInfo.getPartitionName(p) != expected {
+		t.Errorf("got partition %q, expected %q", reqInfo.getPartitionName(p), expected)
+	}
+	if expected := "CREATE TABLE IF NOT EXISTS env1_request_info_d2021_03_04 PARTITION OF env1_request_info"; !strings.HasPrefix(reqInfo.getCreatePartitionStatement(p, ""), expected) {
+		t.Errorf("got %q, expected it to start with %q", reqInfo.getCreatePartitionStatement(p, ""), expected)
+	}
+	pt, err := getPartitionTimeRangeForTable(reqInfo.getPartitionName(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pt.StartDate.Equal(p.StartDate) || pt.Interval != p.Interval {
+		t.Errorf("got time range %+v, expected %+v", pt, p)
+	}
+
+	// unprefixed returns true if q refers to a table without the prefix.
+	unprefixed := func(q string) bool {
+		for _, name := range []string{"audit_log_events", "request_info"} {
+			if strings.Count(q, name) != strings.Count(q, "env1_"+name) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, table := range c.tables() {
+		if unprefixed(table.Name) || unprefixed(table.getCreateStatement()) {
+			t.Errorf("table %s is not prefixed", table.Name)
+		}
+		for _, stmt := range c.partitionStatements(table, p) {
+			if unprefixed(stmt) {
+				t.Errorf("statement %q does not use the prefixed table name", stmt)
+			}
+		}
+	}
+	if joined := c.joinedTables(); unprefixed(joined) {
+		t.Errorf("joined tables %q are not prefixed", joined)
+	}
+	if name := c.migrationsTable().Name; name != "env1_schema_migrations" {
+		t.Errorf("got migrations table %q", name)
+	}
+
+	// The longest derived name fits in a Postgres identifier.
+	c.tablePrefix = strings.Repeat("x", maxTablePrefixLen)
+	reqInfo = c.reqInfoTable()
+	longest := fmt.Sprintf("%s_%s_index", reqInfo.getPartitionName(p), "response_status")
+	if len(longest) > 63 {
+		t.Errorf("%s is longer than 63 bytes", longest)
+	}
+}
+
+func TestTablePrefixes(t *testing.T) {
+	const prefix1, prefix2 = "logtest1_", "logtest2_"
+	c1 := newTestDBClient(t, WithTablePrefix(prefix1))
+	c2 := newTestDBClient(t, WithTablePrefix(prefix2))
+	dropTables := func() {
+		for _, c := range []*DBClient{c1, c2} {
+			for _, table := range append(c.tables(), c.migrationsTable(), c.watermarksTable()) {
+				if _, err := c.ExecContext(context.Background(), fmt.Sprintf("DROP TABLE IF EXISTS %s", table.Name)); err != nil {
+					t.Errorf("dropping %s: %v", table.Name, err)
+				}
+			}
+		}
+	}
+	t.Cleanup(dropTables)
+	for _, c := range []*DBClient{c1, c2} {
+		if err := c.MigrateSchema(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bucket := testBucketName()
+	now := time.Now()
+	insertTestEvent(t, c1, now, bucket)
+	insertTestEvent(t, c2, now, bucket)
+	insertTestEvent(t, c2, now.Add(time.Second), bucket)
+
+	for c, expected := range map[*DBClient]string{c1: "{\"count\":1}\n", c2: "{\"count\":2}\n"} {
+		for _, q := range []qType{rawQ, reqInfoQ, joinedQ} {
+			sq := SearchQuery{Query: q, ExportFormat: "count", FParams: bucketFilter(q, bucket)}
+			var buf bytes.Buffer
+			if err := c.Search(context.Background(), &sq, &buf); err != nil {
+				t.Fatalf("%s%s: search failed: %v", c.tablePrefix, q, err)
+			}
+			if buf.String() != expected {
+				t.Errorf("%s%s: got %q, expected %q", c.tablePrefix, q, buf.String(), expected)
+			}
+		}
+	}
+
+	// Each client has its own partitions, which the other does not see.
+	for _, c := range []*DBClient{c1, c2} {
+		if err := c.HealthCheck(context.Background()); err != nil {
+			t.Errorf("%s: %v", c.tablePrefix, err)
+		}
+		for _, table := range c.tables() {
+			partitions, err := c.getExistingPartitions(context.Background(), table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(partitions) == 0 {
+				t.Errorf("%s: no partitions", table.Name)
+			}
+			for _, partition := range partitions {
+				if !strings.HasPrefix(partition, table.Name+"_") {
+					t.Errorf("%s: unexpected partition %s", table.Name, partition)
+				}
+			}
+		}
+	}
+}
+
+func TestStoreRawLogTables(t *testing.T) {
+	c := &DBClient{}
+	if tables := c.tables(); len(tables) != 2 || tables[0].Name != "audit_log_events" {
+		t.Errorf("got tables %v, expected both tables", tables)
+	}
+	WithStoreRawLog(false)(c)
+	if tables := c.tables(); len(tables) != 1 || tables[0].Name != "request_info" {
+		t.Errorf("got tables %v, expected only request_info", tables)
+	}
+
+	for _, q := range []qType{rawQ, joinedQ} {
+		sq := SearchQuery{Query: q, PageSize: 10}
+		_, _, err := c.BuildSearchSQL(context.Background(), &sq)
+		if !errors.Is(err, ErrRawLogDisabled) || !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%s: got %v, expected %v", q, err, ErrRawLogDisabled)
+		}
+	}
+	if _, _, err := c.BuildSearchSQL(context.Background(), &SearchQuery{Query: reqInfoQ, PageSize: 10}); err != nil {
+		t.Errorf("reqinfo: %v", err)
+	}
+}
+
+func TestStoreRawLog(t *testing.T) {
+	const prefix = "rawlogtest_"
+	for _, store := range []bool{true, false} {
+		c := newTestDBClient(t, WithTablePrefix(prefix), WithStoreRawLog(store))
+		dropTables := func() {
+			for _, table := range []Table{c.logEventsTable(), c.reqInfoTable(), c.migrationsTable(), c.watermarksTable()} {
+				if _, err := c.ExecContext(context.Background(), fmt.Sprintf("DROP TABLE IF EXISTS %s", table.Name)); err != nil {
+					t.Errorf("dropping %s: %v", table.Name, err)
+				}
+			}
+		}
+		dropTables()
+		if err := c.InitDBTables(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		exists, err := c.checkTableExists(context.Background(), c.logEventsTable().Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != store {
+			t.Errorf("store %v: got audit_log_events existing %v", store, exists)
+		}
+
+		// Events are inserted both one by one and in batches.
+		bucket := testBucketName()
+		insertTestEvent(t, c, time.Now(), bucket)
+		batch := make([][]byte, 2)
+		for i := range batch {
+			batch[i], err = json.Marshal(newTestEvent(time.Now(), bucket))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := c.InsertEvents(context.Background(), batch); err != nil {
+			t.Fatalf("store %v: %v", store, err)
+		}
+		if err := c.HealthCheck(context.Background()); err != nil {
+			t.Errorf("store %v: %v", store, err)
+		}
+
+		for _, q := range []qType{rawQ, reqInfoQ, joinedQ} {
+			sq := SearchQuery{Query: q, ExportFormat: "count", FParams: bucketFilter(q, bucket)}
+			var buf bytes.Buffer
+			err := c.Search(context.Background(), &sq, &buf)
+			if q != reqInfoQ && !store {
+				if !errors.Is(err, ErrRawLogDisabled) {
+					t.Errorf("store %v, %s: got %v, expected %v", store, q, err, ErrRawLogDisabled)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("store %v, %s: search failed: %v", store, q, err)
+			}
+			if expected := "{\"count\":3}\n"; buf.String() != expected {
+				t.Errorf("store %v, %s: got %q, expected %q", store, q, buf.String(), expected)
+			}
+		}
+
+		dropTables()
+		c.Close()
+	}
+}
+
+func TestPreserveRawEvent(t *testing.T) {
+	c := newTestDBClient(t)
+
+	for _, preserve := range []bool{false, true} {
+		c.PreserveRawEvent = preserve
+
+		// A field not modeled by the parser, and a nanosecond time.
+		event := newTestEvent(time.Date(2021, 3, 4, 5, 6, 7, 123456789, time.UTC), testBucketName())
+		event["tags"] = map[string]interface{}{"objectLockRetentionReason": "legal hold"}
+		eventBytes, err := json.Marshal(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.InsertEvent(context.Background(), eventBytes); err != nil {
+			t.Fatalf("Unable to insert event: %v", err)
+		}
+
+		var stored string
+		err = c.QueryRowContext(context.Background(),
+			fmt.Sprintf("SELECT log::text FROM %s WHERE log->>'requestID' = $1", c.logEventsTable().Name),
+			event["requestID"]).Scan(&stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var original, got map[string]interface{}
+		if err := json.Unmarshal(eventBytes, &original); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(stored), &got); err != nil {
+			t.Fatal(err)
+		}
+		if equal := reflect.DeepEqual(got, original); equal != preserve {
+			t.Errorf("PreserveRawEvent=%v: stored %s for %s", preserve, stored, eventBytes)
+		}
+	}
+}
+
+func TestEncodeParsedEvent(t *testing.T) {
+	c := &DBClient{}
+
+	eventTime := time.Date(2021, 3, 4, 5, 6, 7, 123456789, time.UTC)
+	buf, err := json.Marshal(newTestEvent(eventTime, testBucketName()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := c.encodeEvent(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := parseJSONEvent(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev, err := c.encodeParsedEvent(event, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ev, expected) {
+		t.Errorf("got %+v, expected %+v", ev, expected)
+	}
+	// The time is truncated in a copy of the event.
+	if !event.Time.Equal(eventTime) || ev.Event == event {
+		t.Errorf("the parsed event was modified: %v", event.Time)
+	}
+
+	// Without the received JSON, the encoded event is stored even when
+	// PreserveRawEvent is set.
+	c.PreserveRawEvent = true
+	ev, err = c.encodeParsedEvent(event, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ev.JSON, expected.JSON) {
+		t.Errorf("got %s, expected %s", ev.JSON, expected.JSON)
+	}
+}
+
+func TestEncodeEventVersion(t *testing.T) {
+	c := &DBClient{DefaultEventVersion: "0"}
+
+	for _, testCase := range []struct {
+		version, expected string
+	}{
+		{"1", "1"},
+		{"", "0"},
+	} {
+		event := newTestEvent(time.Now(), testBucketName())
+		event["version"] = testCase.version
+		buf, err := json.Marshal(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ev, err := c.encodeEvent(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := ev.reqInfoValues()
+		if got := values[len(values)-1]; got != testCase.expected {
+			t.Errorf("%q: got version %v, expected %q", testCase.version, got, testCase.expected)
+		}
+		// The default is not stored in the log.
+		if ev.Version != testCase.version {
+			t.Errorf("%q: got event version %q", testCase.version, ev.Version)
+		}
+	}
+}
+
+func TestInsertParsedEvent(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	event, err := testParsedEvent(time.Now(), bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.InsertParsedEvent(ctx, event); err != nil {
+		t.Fatalf("Unable to insert event: %v", err)
+	}
+
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		sq := SearchQuery{Query: q, FParams: bucketFilter(q, bucket)}
+		count, err := c.countRows(ctx, c, &sq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("%s: got %d records, expected 1", q, count)
+		}
+	}
+	sq := SearchQuery{Query: reqInfoQ, PageSize: 10, FParams: bucketFilter(reqInfoQ, bucket)}
+	var buf bytes.Buffer
+	if err := c.Search(ctx, &sq, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var rows []ReqInfoRow
+	if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].RequestID != event.RequestID || rows[0].APIName != event.API.Name {
+		t.Errorf("got %+v, expected the record of %+v", rows, event)
+	}
+}
+
+func TestBuildSearchSQL(t *testing.T) {
+	c := &DBClient{MaxPageSize: 100}
+	timeStart := time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	limit := 1000
+
+	testCases := []struct {
+		sq           SearchQuery
+		expected     string
+		expectedArgs []interface{}
+	}{
+		{
+			SearchQuery{
+				Query:      rawQ,
+				TimeStart:  &timeStart,
+				FParams:    map[fParam][]string{rawQRequestFieldsMap["bucket"]: {"photos"}},
+				PageNumber: 2,
+				PageSize:   10,
+			},
+			"SELECT event_time, log FROM audit_log_events " +
+				"WHERE event_time >= $1 AND log->'api'->>'bucket' = $2 " +
+				"ORDER BY event_time DESC OFFSET $3 LIMIT $4;",
+			[]interface{}{timeStart, "photos", 20, 10},
+		},
+		{
+			SearchQuery{
+				Query:         reqInfoQ,
+				FParams:       map[fParam][]string{"api_name": {"Put*"}},
+				TimeAscending: true,
+				Limit:         &limit,
+			},
+			"SELECT time, api_name, access_key, bucket, object, time_to_response_ns, remote_host, request_id, " +
+				"user_agent, response_status, response_status_code, request_content_length, response_content_length, version " +
+				"FROM request_info WHERE api_name LIKE $1 ORDER BY time ASC LIMIT $2;",
+			// The limit is capped to the maximum page size.
+			[]interface{}{"Put%", 100},
+		},
+		{
+			SearchQuery{Query: reqInfoQ, ExportFormat: "csv", FParamsNot: map[fParam][]string{"bucket": {"photos"}}},
+			"SELECT time, api_name, access_key, bucket, object, time_to_response_ns, remote_host, request_id, " +
+				"user_agent, response_status, response_status_code, request_content_length, response_content_length, version " +
+				"FROM request_info WHERE bucket <> $1 ORDER BY time DESC ;",
+			[]interface{}{"photos"},
+		},
+		{
+			SearchQuery{Query: reqInfoQ, PageSize: 10, Columns: []string{"bucket", "time"}},
+			"SELECT bucket, time FROM request_info ORDER BY time DESC OFFSET $1 LIMIT $2;",
+			[]interface{}{0, 10},
+		},
+		{
+			SearchQuery{Query: rawQ, ExportFormat: "count", TimeStart: &timeStart},
+			"SELECT COUNT(*) FROM audit_log_events WHERE event_time >= $1;",
+			[]interface{}{timeStart},
+		},
+		{
+			// The time range applies to both joined tables.
+			SearchQuery{Query: joinedQ, ExportFormat: "count", TimeStart: &timeStart, FParams: map[fParam][]string{"bucket": {"photos"}}},
+			"SELECT COUNT(*) FROM request_info JOIN audit_log_events ON audit_log_events.event_time = request_info.time " +
+				"AND audit_log_events.log->>'requestID' = request_info.request_id " +
+				"WHERE time >= $1 AND bucket = $2 AND event_time >= $3;",
+			[]interface{}{timeStart, "photos", timeStart},
+		},
+		{
+			// The arguments of the where-clause are shared by both
+			// parts of the deduplicated records.
+			SearchQuery{Query: reqInfoQ, ExportFormat: "count", DedupByRequestID: true, FParams: map[fParam][]string{"bucket": {"photos"}}},
+			"SELECT COUNT(*) FROM ((SELECT DISTINCT ON (request_id) * FROM request_info " +
+				"WHERE bucket = $1 AND request_id <> '' ORDER BY request_id, time DESC) " +
+				"UNION ALL (SELECT * FROM request_info WHERE bucket = $1 AND COALESCE(request_id, '') = '')) AS deduped ;",
+			[]interface{}{"photos"},
+		},
+	}
+	for i, tc := range testCases {
+		q, args, err := c.BuildSearchSQL(context.Background(), &tc.sq)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		// Compare the queries ignoring their indentation.
+		if q = strings.Join(strings.Fields(q), " "); q != tc.expected {
+			t.Errorf("%d: got %q, expected %q", i, q, tc.expected)
+		}
+		if !reflect.DeepEqual(args, tc.expectedArgs) {
+			t.Errorf("%d: got args %#v, expected %#v", i, args, tc.expectedArgs)
+		}
+	}
+
+	// Exports select one more record than the maximum, if any.
+	c.MaxExportRows = 1000
+	q, args, err := c.BuildSearchSQL(context.Background(), &SearchQuery{Query: rawQ, ExportFormat: "ndjson"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(q, "LIMIT $1;") || !reflect.DeepEqual(args, []interface{}{1001}) {
+		t.Errorf("got %q with args %v, expected a limit of 1001", q, args)
+	}
+
+	if _, _, err := c.BuildSearchSQL(context.Background(), &SearchQuery{Query: "bogus"}); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got %v, expected an invalid query error", err)
+	}
+
+	// The searches rejected by Search are rejected.
+	c.RequireTimeBound = true
+	if _, _, err := c.BuildSearchSQL(context.Background(), &SearchQuery{Query: rawQ}); err != ErrUnboundedQuery {
+		t.Errorf("got %v, expected ErrUnboundedQuery", err)
+	}
+	c.RedactColumns = []string{"access_key"}
+	sq := SearchQuery{Query: reqInfoQ, TimeStart: &timeStart, FParams: map[fParam][]string{"access_key": {"AKIAEXAMPLE"}}}
+	if _, _, err := c.BuildSearchSQL(context.Background(), &sq); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got %v, expected an invalid query error filtering on a redacted column", err)
+	}
+}
+
+func TestSearchOnlyErrors(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	start := time.Now().Add(-time.Minute)
+	for i, code := range []int{200, 204, 304, 403, 404, 503} {
+		event := newTestEvent(start.Add(time.Duration(i)*time.Second), bucket)
+		event["api"].(map[string]interface{})["statusCode"] = code
+		insertTestEventMap(t, c, event)
+	}
+
+	end := start.Add(4500 * time.Millisecond)
+	sq := SearchQuery{
+		Query:         reqInfoQ,
+		PageSize:      10,
+		TimeStart:     &start,
+		TimeEnd:       &end,
+		TimeAscending: true,
+		FParams:       bucketFilter(reqInfoQ, bucket),
+		OnlyErrors:    true,
+	}
+	var buf bytes.Buffer
+	if err := c.Search(context.Background(), &sq, &buf); err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	var rows []ReqInfoRow
+	if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	// The 503 is out of the time range.
+	var codes []int
+	for _, row := range rows {
+		codes = append(codes, row.ResponseStatusCode)
+	}
+	if expected := []int{403, 404}; !reflect.DeepEqual(codes, expected) {
+		t.Errorf("got status codes %v, expected %v", codes, expected)
+	}
+}
+
+func TestSearchObjectPresence(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	start := time.Now().Add(-time.Minute)
+	for i, object := range []string{"photo.jpg", "", "video.mp4", ""} {
+		event := newTestEvent(start.Add(time.Duration(i)*time.Second), bucket)
+		event["api"].(map[string]interface{})["object"] = object
+		insertTestEventMap(t, c, event)
+	}
+	// Records may also have a NULL object, which is only counted below as
+	// it cannot be output in a ReqInfoRow.
+	event := newTestEvent(start.Add(4*time.Second), bucket)
+	insertTestEventMap(t, c, event)
+	const nullObject QTemplate = `UPDATE %s SET object = NULL WHERE request_id = $1;`
+	if _, err := c.ExecContext(ctx, nullObject.build(c.reqInfoTable().Name), event["requestID"]); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		presence ObjectPresence
+		objects  []string
+		count    int
+	}{
+		{ObjectAny, []string{"photo.jpg", "", "video.mp4", ""}, 5},
+		{ObjectEmpty, []string{"", ""}, 3},
+		{ObjectNonEmpty, []string{"photo.jpg", "video.mp4"}, 2},
+	}
+	for _, testCase := range testCases {
+		end := start.Add(3500 * time.Millisecond)
+		sq := SearchQuery{
+			Query:          reqInfoQ,
+			PageSize:       10,
+			TimeStart:      &start,
+			TimeEnd:        &end,
+			TimeAscending:  true,
+			FParams:        bucketFilter(reqInfoQ, bucket),
+			ObjectPresence: testCase.presence,
+		}
+		var buf bytes.Buffer
+		if err := c.Search(ctx, &sq, &buf); err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		var rows []ReqInfoRow
+		if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+			t.Fatal(err)
+		}
+		var objects []string
+		for _, row := range rows {
+			objects = append(objects, row.Object)
+		}
+		if !reflect.DeepEqual(objects, testCase.objects) {
+			t.Errorf("%d: got objects %q, expected %q", testCase.presence, objects, testCase.objects)
+		}
+
+		end = start.Add(5 * time.Second)
+		sq.ExportFormat = "count"
+		buf.Reset()
+		if err := c.Search(ctx, &sq, &buf); err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		if expected := fmt.Sprintf(`{"count":%d}`+"\n", testCase.count); buf.String() != expected {
+			t.Errorf("%d: got %q, expected %q", testCase.presence, buf.String(), expected)
+		}
+	}
+}
+
+func TestSearchAPINames(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	start := time.Now().Add(-time.Minute)
+	for i, api := range []string{"PutObject", "GetObject", "CopyObject", "DeleteObject", "PutObject"} {
+		event := newTestEvent(start.Add(time.Duration(i)*time.Second), bucket)
+		event["api"].(map[string]interface{})["name"] = api
+		insertTestEventMap(t, c, event)
+	}
+
+	end := start.Add(3500 * time.Millisecond)
+	sq := SearchQuery{
+		Query:         reqInfoQ,
+		PageSize:      10,
+		TimeStart:     &start,
+		TimeEnd:       &end,
+		TimeAscending: true,
+		FParams:       bucketFilter(reqInfoQ, bucket),
+		APINames:      []string{"PutObject", "CopyObject"},
+	}
+	var buf bytes.Buffer
+	if err := c.Search(context.Background(), &sq, &buf); err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	var rows []ReqInfoRow
+	if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	// The last PutObject is out of the time range.
+	var apis []string
+	for _, row := range rows {
+		apis = append(apis, row.APIName)
+	}
+	if expected := []string{"PutObject", "CopyObject"}; !reflect.DeepEqual(apis, expected) {
+		t.Errorf("got APIs %v, expected %v", apis, expected)
+	}
+}
+
+func TestSearchVersions(t *testing.T) {
+	c := newTestDBClient(t)
+	c.DefaultEventVersion = "0"
+
+	bucket := testBucketName()
+	start := time.Now().Add(-time.Minute)
+	for i, version := range []string{"1", "2", "", "1"} {
+		event := newTestEvent(start.Add(time.Duration(i)*time.Second), bucket)
+		event["version"] = version
+		insertTestEventMap(t, c, event)
+	}
+
+	search := func(versions ...string) []string {
+		t.Helper()
+		sq := SearchQuery{
+			Query:         reqInfoQ,
+			PageSize:      10,
+			TimeAscending: true,
+			FParams:       bucketFilter(reqInfoQ, bucket),
+			Versions:      versions,
+		}
+		var buf bytes.Buffer
+		if err := c.Search(context.Background(), &sq, &buf); err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		var rows []ReqInfoRow
+		if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, row := range rows {
+			got = append(got, row.Version)
+		}
+		return got
+	}
+	if got, expected := search(), []string{"1", "2", "0", "1"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("got versions %v, expected %v", got, expected)
+	}
+	if got, expected := search("1", "0"), []string{"1", "0", "1"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("got versions %v, expected %v", got, expected)
+	}
+}
+
+func TestSearchDedupByRequestID(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	now := time.Now().Truncate(time.Millisecond)
+	// Two requests logged three times each, and two records without a
+	// request ID.
+	var latest []ReqInfoRow
+	for i := 0; i < 2; i++ {
+		requestID := fmt.Sprintf("%X", rand.Int63())
+		for j := 0; j < 3; j++ {
+			event := newTestEvent(now.Add(time.Duration(10*i+j)*time.Millisecond), bucket)
+			event["requestID"] = requestID
+			event["api"].(map[string]interface{})["statusCode"] = 500 + j
+			insertTestEventMap(t, c, event)
+		}
+		latest = append(latest, ReqInfoRow{RequestID: requestID, ResponseStatusCode: 502})
+	}
+	for i := 0; i < 2; i++ {
+		event := newTestEvent(now.Add(time.Duration(i)*time.Millisecond), bucket)
+		delete(event, "requestID")
+		insertTestEventMap(t, c, event)
+	}
+
+	search := func(sq SearchQuery) []ReqInfoRow {
+		t.Helper()
+		sq.Query, sq.DedupByRequestID, sq.FParams = reqInfoQ, true, bucketFilter(reqInfoQ, bucket)
+		var buf bytes.Buffer
+		if err := c.Search(ctx, &sq, &buf); err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		var rows []ReqInfoRow
+		if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+			t.Fatal(err)
+		}
+		return rows
+	}
+
+	rows := search(SearchQuery{PageSize: 10})
+	if len(rows) != 4 {
+		t.Fatalf("expected 4 rows, got %d", len(rows))
+	}
+	// The latest record of each request comes first, in descending time
+	// order.
+	for i, expected := range []ReqInfoRow{latest[1], latest[0]} {
+		if rows[i].RequestID != expected.RequestID || rows[i].ResponseStatusCode != expected.ResponseStatusCode {
+			t.Errorf("row %d: got request %s with status %d, expected request %s with status %d", i,
+				rows[i].RequestID, rows[i].ResponseStatusCode, expected.RequestID, expected.ResponseStatusCode)
+		}
+	}
+	for _, row := range rows[2:] {
+		if row.RequestID != "" {
+			t.Errorf("got request %s, expected a record without a request ID", row.RequestID)
+		}
+	}
+
+	// Paging and the filters apply to the deduplicated records.
+	rows = search(SearchQuery{PageSize: 1, PageNumber: 1, TimeAscending: true})
+	if len(rows) != 1 || rows[0].RequestID != "" {
+		t.Errorf("got %+v, expected the second record without a request ID", rows)
+	}
+	rows = search(SearchQuery{PageSize: 10, NumericFilters: []NumericFilter{
+		{Column: "response_status_code", Op: ">=", Value: 500},
+		{Column: "response_status_code", Op: "<", Value: 502},
+	}})
+	if len(rows) != 2 || rows[0].ResponseStatusCode != 501 || rows[1].ResponseStatusCode != 501 {
+		t.Errorf("got %+v, expected the records with status 501", rows)
+	}
+
+	sq := SearchQuery{Query: reqInfoQ, ExportFormat: "count", DedupByRequestID: true, FParams: bucketFilter(reqInfoQ, bucket)}
+	var buf bytes.Buffer
+	if err := c.Search(ctx, &sq, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != `{"count":4}`+"\n" {
+		t.Errorf("got %q, expected a count of 4", got)
+	}
+}
+
+func TestSearchIncludeManifest(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	now := time.Now()
+	insertTestEvent(t, c, now.Add(-time.Second), bucket)
+	insertTestEvent(t, c, now, bucket)
+
+	last := time.Hour
+	for _, q := range []qType{rawQ, reqInfoQ, joinedQ} {
+		sq := SearchQuery{
+			Query:           q,
+			LastDuration:    &last,
+			ExportFormat:    "ndjson",
+			FParams:         bucketFilter(q, bucket),
+			IncludeManifest: true,
+		}
+		var buf bytes.Buffer
+		if err := c.Search(ctx, &sq, &buf); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		if len(lines) != 3 {
+			t.Fatalf("%s: expected a manifest and 2 records, got %q", q, buf.String())
+		}
+
+		var manifest struct {
+			Manifest      bool       `json:"_manifest"`
+			Query         string     `json:"query"`
+			TimeStart     *time.Time `json:"time_start"`
+			TimeEnd       *time.Time `json:"time_end"`
+			GeneratedAt   time.Time  `json:"generated_at"`
+			SchemaVersion int        `json:"schema_version"`
+		}
+		if err := json.Unmarshal([]byte(lines[0]), &manifest); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		if !manifest.Manifest || manifest.Query != string(q) || manifest.SchemaVersion != len(allMigrations) {
+			t.Errorf("%s: got manifest %s", q, lines[0])
+		}
+		if manifest.TimeStart == nil || !manifest.TimeStart.Equal(manifest.GeneratedAt.Add(-last)) || manifest.TimeEnd != nil {
+			t.Errorf("%s: got the time range %v - %v, expected the last hour", q, manifest.TimeStart, manifest.TimeEnd)
+		}
+		// The records are not marked.
+		for _, line := range lines[1:] {
+			if strings.Contains(line, "_manifest") {
+				t.Errorf("%s: got a marked record %s", q, line)
+			}
+		}
+	}
+}
+
+func TestSearchMaxExportRows(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		insertTestEvent(t, c, now.Add(time.Duration(i)*time.Second), bucket)
+	}
+
+	for _, q := range []qType{rawQ, reqInfoQ, joinedQ} {
+		for _, tc := range []struct {
+			max       int
+			truncated bool
+		}{{0, false}, {2, true}, {3, false}} {
+			c.MaxExportRows = tc.max
+
+			sq := SearchQuery{Query: q, ExportFormat: "ndjson", FParams: bucketFilter(q, bucket)}
+			var buf bytes.Buffer
+			res, err := c.SearchWithResult(context.Background(), &sq, &buf)
+			if err != nil {
+				t.Fatalf("%s: search failed: %v", q, err)
+			}
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			last := lines[len(lines)-1]
+			if tc.truncated {
+				if len(lines) != tc.max+1 || last != `{"truncated":true}` || res.RowsWritten != int64(tc.max) {
+					t.Errorf("%s, max %d: got %d records ending with %s, expected %d and a truncation marker", q, tc.max, res.RowsWritten, last, tc.max)
+				}
+			} else if len(lines) != 3 || strings.Contains(last, "truncated") {
+				t.Errorf("%s, max %d: got %q, expected 3 records", q, tc.max, buf.String())
+			}
+
+			sq.ExportFormat = "csv"
+			buf.Reset()
+			res, err = c.SearchWithResult(context.Background(), &sq, &buf)
+			var limitErr *ExportLimitError
+			if tc.truncated {
+				if !errors.As(err, &limitErr) || limitErr.MaxRows != tc.max || res.RowsWritten != int64(tc.max) {
+					t.Errorf("%s, max %d: got %v after %d records, expected an export limit error", q, tc.max, err, res.RowsWritten)
+				}
+			} else if err != nil {
+				t.Errorf("%s, max %d: %v", q, tc.max, err)
+			}
+		}
+	}
+}
+
+func TestSearchSortNulls(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	now := time.Now()
+	// The event without a Content-Length header has a NULL
+	// request_content_length.
+	insertTestEvent(t, c, now, bucket)
+	for i, length := range []string{"10", "20"} {
+		ev := newTestEvent(now.Add(time.Duration(i+1)*time.Second), bucket)
+		ev["requestHeader"] = map[string]interface{}{"Content-Length": length}
+		insertTestEventMap(t, c, ev)
+	}
+
+	for _, tc := range []struct {
+		descending bool
+		expected   []interface{}
+	}{
+		{false, []interface{}{10.0, 20.0, nil}},
+		{true, []interface{}{20.0, 10.0, nil}},
+	} {
+		sq := SearchQuery{
+			Query:    reqInfoQ,
+			PageSize: 10,
+			FParams:  bucketFilter(reqInfoQ, bucket),
+			SortBy:   []SortField{{"request_content_length", tc.descending}},
+		}
+		var buf bytes.Buffer
+		if err := c.Search(context.Background(), &sq, &buf); err != nil {
+			t.Fatalf("search failed: %v", err)
+		}
+		var rows []map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+			t.Fatal(err)
+		}
+		var got []interface{}
+		for _, row := range rows {
+			got = append(got, row["request_content_length"])
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("descending=%v: got %v, expected %v", tc.descending, got, tc.expected)
+		}
+	}
+
+	// The time column, which is always sorted on, cannot be NULL.
+	q := fmt.Sprintf("INSERT INTO %s (time, api_name) VALUES (NULL, 'PutObject')", c.reqInfoTable().Name)
+	if _, err := c.ExecContext(context.Background(), q); err == nil {
+		t.Error("expected inserting a NULL time to fail")
+	}
+}
+
+func TestSearchExportSortedByBucket(t *testing.T) {
+	c := newTestDBClient(t)
+
+	prefix := testBucketName()
+	now := time.Now()
+	// The events of bucket -a are ordered by descending time.
+	for i, suffix := range []string{"-b", "-a", "-c", "-a"} {
+		insertTestEvent(t, c, now.Add(time.Duration(i)*time.Second), prefix+suffix)
+	}
+
+	key, err := stringToFParam(reqInfoQ, "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sq := SearchQuery{
+		Query:           reqInfoQ,
+		ExportFormat:    "csv",
+		FParams:         map[fParam][]string{key: {prefix + "-*"}},
+		SortBy:          []SortField{{"bucket", false}},
+		Columns:         []string{"time", "bucket"},
+		DisplayTimeZone: "UTC",
+	}
+	var buf bytes.Buffer
+	if err := c.Search(context.Background(), &sq, &buf); err != nil {
+		t.Fatalf("search failed: %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 {
+		t.Fatalf("expected a header and 4 records, got %v", records)
+	}
+	var buckets []string
+	for _, record := range records[1:] {
+		buckets = append(buckets, strings.TrimPrefix(record[1], prefix))
+	}
+	if expected := []string{"-a", "-a", "-b", "-c"}; !reflect.DeepEqual(buckets, expected) {
+		t.Errorf("got buckets %v, expected %v", buckets, expected)
+	}
+	if records[1][0] <= records[2][0] {
+		t.Errorf("expected the records of a bucket in descending time, got %v", records[1:3])
+	}
+}
+
+func TestSearchBestEffort(t *testing.T) {
+	const prefix = "besteffort_"
+	c := newTestDBClient(t, WithTablePrefix(prefix))
+	c.PartitionInterval = PartitionDaily
+	ctx := context.Background()
+	defer func() {
+		for _, table := range []Table{c.logEventsTable(), c.reqInfoTable(), c.migrationsTable(), c.watermarksTable()} {
+			if _, err := c.ExecContext(ctx, "DROP TABLE IF EXISTS "+table.Name); err != nil {
+				t.Errorf("dropping %s: %v", table.Name, err)
+			}
+		}
+	}()
+
+	// An event in each of 3 daily partitions far in the past.
+	bucket := testBucketName()
+	day := func(d int) time.Time { return time.Date(2001, time.June, d, 12, 0, 0, 0, time.UTC) }
+	for _, table := range c.tables() {
+		if err := c.EnsurePartitionsForRange(ctx, table, day(1), day(4)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for d := 1; d <= 3; d++ {
+		insertTestEvent(t, c, day(d), bucket)
+	}
+
+	// The searching client gives up on locked partitions quickly.
+	searcher, err := NewDBClient(ctx, testConnStrWithParam("lock_timeout", "200"), WithTablePrefix(prefix), WithPartitionMode(PartitionModeNative))
+	if err != nil {
+		t.Fatalf("Unable to connect to db: %v", err)
+	}
+	defer searcher.Close()
+
+	timeStart, timeEnd := day(1).Add(-time.Hour), day(3).Add(time.Hour)
+	search := func(q qType, bestEffort bool) (SearchResult, []string, error) {
+		sq := SearchQuery{
+			Query:        q,
+			TimeStart:    &timeStart,
+			TimeEnd:      &timeEnd,
+			ExportFormat: "ndjson",
+			FParams:      bucketFilter(q, bucket),
+			BestEffort:   bestEffort,
+		}
+		var buf bytes.Buffer
+		res, err := searcher.SearchWithResult(ctx, &sq, &buf)
+		return res, strings.Fields(buf.String()), err
+	}
+
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		table := searcher.searchTable(&SearchQuery{Query: q})
+		locked := table.getPartitionName(newPartitionTimeRange(day(2), PartitionDaily))
+		tx, err := c.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.ExecContext(ctx, "LOCK TABLE "+locked+" IN ACCESS EXCLUSIVE MODE"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := search(q, false); err == nil {
+			t.Errorf("%s: expected the strict search to fail on the locked partition", q)
+		}
+		res, lines, err := search(q, true)
+		if err != nil {
+			t.Fatalf("%s: best-effort search failed: %v", q, err)
+		}
+		if len(lines) != 2 || res.RowsWritten != 2 {
+			t.Errorf("%s: got %d records (%d written), expected 2", q, len(lines), res.RowsWritten)
+		}
+		if !reflect.DeepEqual(res.SkippedPartitions, []string{locked}) {
+			t.Errorf("%s: got skipped partitions %v, expected %v", q, res.SkippedPartitions, []string{locked})
+		}
+
+		if err := tx.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+		res, lines, err = search(q, true)
+		if err != nil {
+			t.Fatalf("%s: best-effort search failed: %v", q, err)
+		}
+		if len(lines) != 3 || len(res.SkippedPartitions) != 0 {
+			t.Errorf("%s: got %d records and skipped partitions %v, expected 3 records", q, len(lines), res.SkippedPartitions)
+		}
+		// The records are in order across partitions, most recent first.
+		var times []string
+		for _, line := range lines {
+			var m map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &m); err != nil {
+				t.Fatal(err)
+			}
+			ts, _ := m["time"].(string)
+			if q == rawQ {
+				ts, _ = m["event_time"].(string)
+			}
+			times = append(times, ts)
+		}
+		for i := 1; i < len(times); i++ {
+			if times[i] >= times[i-1] {
+				t.Errorf("%s: records out of order: %v", q, times)
+				break
+			}
+		}
+	}
+}
+
+func TestLimitedRowsAccessErr(t *testing.T) {
+	rows := &limitedRows{done: true}
+	if err := rows.accessErr(); err != nil {
+		t.Errorf("got %v, expected no error", err)
+	}
+
+	// The errors ending the iteration are QueryErrors, wrapped only once.
+	failure := errors.New("canceling statement due to statement timeout")
+	for _, err := range []error{failure, &QueryError{Op: "accessing", Err: failure}} {
+		rows = &limitedRows{done: true, err: err}
+		got := rows.accessErr()
+		var queryErr *QueryError
+		if !errors.As(got, &queryErr) || queryErr.Err != failure {
+			t.Errorf("got %v, expected a QueryError wrapping %v", got, failure)
+		}
+	}
+}
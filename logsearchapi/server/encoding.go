@@ -0,0 +1,158 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encodings of the output of searches, see SearchQuery.Encoding.
+const (
+	EncodingNone = "none"
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// encodings are the supported encodings, in decreasing order of preference
+// when a client accepts several of them equally: zstd compresses the JSON of
+// the records much better than gzip.
+var encodings = []string{EncodingZstd, EncodingGzip, EncodingNone}
+
+func isEncoding(encoding string) bool {
+	for _, e := range encodings {
+		if e == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// NegotiateEncoding returns the supported encoding most preferred by the
+// given Accept-Encoding header value, e.g. "zstd" for "gzip, zstd" or "gzip"
+// for "gzip;q=1.0, zstd;q=0.5", or EncodingNone if none is accepted.
+func NegotiateEncoding(acceptEncoding string) string {
+	type accepted struct {
+		encoding string
+		q        float64
+		rank     int
+	}
+	var candidates []accepted
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.TrimSpace(k) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = f
+				}
+			}
+		}
+		for rank, encoding := range encodings[:len(encodings)-1] {
+			if name == encoding && q > 0 {
+				candidates = append(candidates, accepted{encoding, q, rank})
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return EncodingNone
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].q != candidates[j].q {
+			return candidates[i].q > candidates[j].q
+		}
+		return candidates[i].rank < candidates[j].rank
+	})
+	return candidates[0].encoding
+}
+
+// encodingWriter compresses the output written to w with an encoding. The
+// compressor is created by the first write, so that nothing is written to w
+// by a search failing before writing any output, which may then be answered
+// with an uncompressed error.
+type encodingWriter struct {
+	w        io.Writer
+	encoding string
+	zw       io.WriteCloser
+	closed   bool
+}
+
+func (ew *encodingWriter) start() error {
+	if ew.zw != nil {
+		return nil
+	}
+	switch ew.encoding {
+	case EncodingGzip:
+		ew.zw = gzip.NewWriter(ew.w)
+	case EncodingZstd:
+		zw, err := zstd.NewWriter(ew.w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		ew.zw = zw
+	default:
+		ew.zw = nopWriteCloser{ew.w}
+	}
+	return nil
+}
+
+func (ew *encodingWriter) Write(p []byte) (int, error) {
+	if err := ew.start(); err != nil {
+		return 0, err
+	}
+	return ew.zw.Write(p)
+}
+
+// Flush writes the output compressed so far to w, and flushes w.
+func (ew *encodingWriter) Flush() error {
+	if f, ok := ew.zw.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return flushWriter(ew.w)
+}
+
+// finish ends the compressed stream, writing its last bytes to w. If failed
+// is set and nothing was written, nothing is written to w. Only the first
+// call does anything.
+func (ew *encodingWriter) finish(failed bool) error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	if ew.zw == nil && failed {
+		return nil
+	}
+	if err := ew.start(); err != nil {
+		return err
+	}
+	return ew.zw.Close()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
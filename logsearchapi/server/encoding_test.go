@@ -0,0 +1,174 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// decodeTestOutput decompresses the output of a search with the encoding.
+func decodeTestOutput(t *testing.T, encoding string, b []byte) []byte {
+	t.Helper()
+
+	var r io.Reader
+	switch encoding {
+	case EncodingGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gr
+	case EncodingZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return b
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s: %v", encoding, err)
+	}
+	return out
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	testCases := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", EncodingNone},
+		{"identity", EncodingNone},
+		{"br, deflate", EncodingNone},
+		{"gzip", EncodingGzip},
+		{"GZIP, deflate", EncodingGzip},
+		{"gzip, zstd", EncodingZstd},
+		{"gzip;q=1.0, zstd;q=0.5", EncodingGzip},
+		{"gzip; q=0.2, zstd ; q=0.8", EncodingZstd},
+		{"zstd;q=0, gzip", EncodingGzip},
+		{"zstd;q=0", EncodingNone},
+	}
+	for _, testCase := range testCases {
+		if got := NegotiateEncoding(testCase.acceptEncoding); got != testCase.expected {
+			t.Errorf("%q: got %s, expected %s", testCase.acceptEncoding, got, testCase.expected)
+		}
+	}
+}
+
+func TestEncodingWriter(t *testing.T) {
+	data := strings.Repeat(`{"api_name":"GetObject","bucket":"photos"}`+"\n", 100)
+	for _, encoding := range []string{EncodingGzip, EncodingZstd, EncodingNone} {
+		var buf bytes.Buffer
+		ew := &encodingWriter{w: &buf, encoding: encoding}
+		if _, err := io.WriteString(ew, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := ew.finish(false); err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		n := buf.Len()
+		// Only the first call closes the compressor.
+		if err := ew.finish(false); err != nil || buf.Len() != n {
+			t.Errorf("%s: finishing again wrote %d bytes, err %v", encoding, buf.Len()-n, err)
+		}
+		if got := decodeTestOutput(t, encoding, buf.Bytes()); string(got) != data {
+			t.Errorf("%s: got %q after a round-trip", encoding, got)
+		}
+		if encoding != EncodingNone && n >= len(data) {
+			t.Errorf("%s: %d bytes not compressed, got %d bytes", encoding, len(data), n)
+		}
+
+		// An empty output is a valid empty stream.
+		buf.Reset()
+		ew = &encodingWriter{w: &buf, encoding: encoding}
+		if err := ew.finish(false); err != nil {
+			t.Fatal(err)
+		}
+		if got := decodeTestOutput(t, encoding, buf.Bytes()); len(got) != 0 {
+			t.Errorf("%s: got %q, expected an empty output", encoding, got)
+		}
+
+		// Nothing is written when failing before any output.
+		buf.Reset()
+		ew = &encodingWriter{w: &buf, encoding: encoding}
+		if err := ew.finish(true); err != nil || buf.Len() != 0 {
+			t.Errorf("%s: got %d bytes and err %v for a failed search", encoding, buf.Len(), err)
+		}
+	}
+}
+
+func TestSearchQueryEncoding(t *testing.T) {
+	sq := SearchQuery{Query: reqInfoQ, Encoding: "br"}
+	var vErr *ValidationError
+	if err := sq.Validate(); !errors.As(err, &vErr) || vErr.Field != "Encoding" {
+		t.Errorf("got %v, expected a validation error for the Encoding field", err)
+	}
+}
+
+func TestSearchEncoding(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		insertTestEvent(t, c, now.Add(time.Duration(i)*time.Millisecond), bucket)
+	}
+
+	for _, format := range []string{"", "ndjson", "csv", "count"} {
+		sq := SearchQuery{Query: reqInfoQ, PageSize: 100, ExportFormat: format, FParams: bucketFilter(reqInfoQ, bucket)}
+		var plain bytes.Buffer
+		if err := c.Search(ctx, &sq, &plain); err != nil {
+			t.Fatal(err)
+		}
+		for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+			sq.Encoding = encoding
+			var buf bytes.Buffer
+			res, err := c.SearchWithResult(ctx, &sq, &buf)
+			if err != nil {
+				t.Fatalf("%q %s: %v", format, encoding, err)
+			}
+			if res.Encoding != encoding {
+				t.Errorf("%q %s: got encoding %s", format, encoding, res.Encoding)
+			}
+			if got := decodeTestOutput(t, encoding, buf.Bytes()); !bytes.Equal(got, plain.Bytes()) {
+				t.Errorf("%q %s: got %q, expected %q", format, encoding, got, plain.String())
+			}
+		}
+	}
+
+	// A search failing before any output writes nothing.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	sq := SearchQuery{Query: reqInfoQ, Encoding: EncodingGzip, ExportFormat: "ndjson", FParams: bucketFilter(reqInfoQ, bucket)}
+	var buf bytes.Buffer
+	if err := c.Search(cctx, &sq, &buf); err == nil || buf.Len() != 0 {
+		t.Errorf("got %v and %d bytes, expected an error and no output", err, buf.Len())
+	}
+}
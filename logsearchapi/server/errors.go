@@ -0,0 +1,199 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidQuery is matched (with errors.Is) by the errors returned for
+// invalid search queries, such as an unknown query name or an unsupported
+// filter. These are errors of the request rather than of the server.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// ErrClientClosed is returned by the methods of a DBClient after it is closed.
+var ErrClientClosed = errors.New("DB client closed")
+
+// ErrBusy is returned by searches that could not start within the
+// SearchAcquireTimeout of the PoolConfig of the client, as the maximum number
+// of concurrent searches were running. The search may be retried later.
+var ErrBusy = errors.New("too many concurrent searches")
+
+// ErrRawLogDisabled is returned by searches needing the raw logs, i.e. rawQ
+// and joinedQ searches, on clients created with WithStoreRawLog(false). It
+// matches ErrInvalidQuery.
+var ErrRawLogDisabled error = &invalidQueryError{msg: "raw log storage disabled"}
+
+// ErrUnboundedQuery is returned by searches without a time range nor a
+// request ID filter on clients with RequireTimeBound set. It matches
+// ErrInvalidQuery.
+var ErrUnboundedQuery error = &invalidQueryError{msg: "unbounded query: a time range or a request ID filter is required"}
+
+// invalidQueryError is an error message matching ErrInvalidQuery.
+type invalidQueryError struct {
+	msg string
+}
+
+func (e *invalidQueryError) Error() string { return e.msg }
+
+func (e *invalidQueryError) Is(target error) bool { return target == ErrInvalidQuery }
+
+// invalidQueryErrorf returns an error with the formatted message that matches
+// ErrInvalidQuery.
+func invalidQueryErrorf(format string, a ...interface{}) error {
+	return &invalidQueryError{msg: fmt.Sprintf(format, a...)}
+}
+
+// ValidationError is returned by SearchQuery.Validate for a field of the
+// search query having an invalid value. It matches ErrInvalidQuery.
+type ValidationError struct {
+	// Field is the name of the invalid SearchQuery field.
+	Field string
+	Msg   string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Invalid search query field %s: %s", e.Field, e.Msg)
+}
+
+func (e *ValidationError) Is(target error) bool { return target == ErrInvalidQuery }
+
+// ParamError is returned by ParseSearchQuery for a query parameter having an
+// invalid value. It matches ErrInvalidQuery.
+type ParamError struct {
+	// Param is the name of the invalid query parameter, e.g. "timeStart".
+	Param string
+	Err   error
+}
+
+func (e *ParamError) Error() string { return e.Err.Error() }
+
+func (e *ParamError) Unwrap() error { return e.Err }
+
+func (e *ParamError) Is(target error) bool { return target == ErrInvalidQuery }
+
+// paramErrorf returns a *ParamError for param with the formatted message.
+func paramErrorf(param, format string, a ...interface{}) error {
+	return &ParamError{Param: param, Err: fmt.Errorf(format, a...)}
+}
+
+// ColumnError is returned for a column that an operation, such as
+// CountDistinct, does not support. It matches ErrInvalidQuery.
+type ColumnError struct {
+	Column string
+	// Op is the operation, e.g. "count distinct".
+	Op string
+}
+
+func (e *ColumnError) Error() string {
+	return fmt.Sprintf("Invalid %s column: %q", e.Op, e.Column)
+}
+
+func (e *ColumnError) Is(target error) bool { return target == ErrInvalidQuery }
+
+// QueryError is returned when a query to the DB fails.
+type QueryError struct {
+	// Op is what failed, e.g. "querying" or "accessing" (the results).
+	Op  string
+	Err error
+}
+
+func (e *QueryError) Error() string { return fmt.Sprintf("Error %s db: %v", e.Op, e.Err) }
+
+func (e *QueryError) Unwrap() error { return e.Err }
+
+// ExportLimitError is returned by exports stopped after writing the maximum
+// number of records of DBClient.MaxExportRows.
+type ExportLimitError struct {
+	MaxRows int
+}
+
+func (e *ExportLimitError) Error() string {
+	return fmt.Sprintf("Export truncated after the maximum of %d records, narrow the search (e.g. its time range) to export all its results", e.MaxRows)
+}
+
+// ErrCancelTokenInUse is returned by RegisterSearch for a token another
+// search is registered with. It matches ErrInvalidQuery.
+var ErrCancelTokenInUse error = &invalidQueryError{msg: "cancel token already in use"}
+
+// ErrResponseTooLarge is matched (with errors.Is) by the
+// *ResponseTooLargeError returned by searches whose page of results exceeds
+// the MaxResponseBytes of the client.
+var ErrResponseTooLarge = errors.New("response too large")
+
+// ResponseTooLargeError is returned by searches returning a page of results
+// that would exceed DBClient.MaxResponseBytes. It matches ErrResponseTooLarge.
+type ResponseTooLargeError struct {
+	MaxBytes int64
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("Response exceeds the maximum of %d bytes, narrow the search (e.g. with a smaller page size) or use an export format to stream its results", e.MaxBytes)
+}
+
+func (e *ResponseTooLargeError) Is(target error) bool { return target == ErrResponseTooLarge }
+
+// StreamWriteError is returned when writing results to the output stream
+// fails, e.g. because the client went away.
+type StreamWriteError struct {
+	Err error
+}
+
+func (e *StreamWriteError) Error() string {
+	return fmt.Sprintf("Error writing to output stream: %v", e.Err)
+}
+
+func (e *StreamWriteError) Unwrap() error { return e.Err }
+
+// RowTransformError is returned by searches whose SearchQuery.RowTransform
+// fails.
+type RowTransformError struct {
+	Err error
+}
+
+func (e *RowTransformError) Error() string {
+	return fmt.Sprintf("Error transforming row: %v", e.Err)
+}
+
+func (e *RowTransformError) Unwrap() error { return e.Err }
+
+// UploadError is returned by ExportToObject when uploading the export fails.
+type UploadError struct {
+	Err error
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("Error uploading export: %v", e.Err)
+}
+
+func (e *UploadError) Unwrap() error { return e.Err }
+
+// SanitizerError is returned by inserts when the DBClient.EventSanitizer
+// fails for an event and the SanitizerErrorPolicy of the client is
+// SanitizerFailInsert.
+type SanitizerError struct {
+	// RequestID is the request ID of the event.
+	RequestID string
+	Err       error
+}
+
+func (e *SanitizerError) Error() string {
+	return fmt.Sprintf("Error sanitizing audit event of request %s: %v", e.RequestID, e.Err)
+}
+
+func (e *SanitizerError) Unwrap() error { return e.Err }
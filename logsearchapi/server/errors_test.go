@@ -0,0 +1,64 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+func TestSearchErrors(t *testing.T) {
+	c := &DBClient{}
+
+	testCases := []*SearchQuery{
+		{Query: "bogus"},
+		{Query: reqInfoQ, SortBy: []SortField{{Column: "log"}}},
+		{Query: rawQ, NumericFilters: []NumericFilter{{"response_status_code", ">=", 400}}},
+		{Query: reqInfoQ, CategoryFilter: []string{"Bogus"}},
+		{Query: rawQ, PageSize: -1},
+	}
+	for i, sq := range testCases {
+		err := c.Search(context.Background(), sq, ioutil.Discard)
+		if !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("Test %d: got %v, expected an invalid query error", i, err)
+		}
+	}
+
+	err := writeCSV(failingWriter{}, CSVOptions{IncludeHeader: true, Delimiter: ','}, []string{"a"}, nil, func(*csvWriter) error { return nil })
+	var swErr *StreamWriteError
+	if !errors.As(err, &swErr) || !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("got %v, expected a stream write error", err)
+	}
+	if errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("stream write error %v should not be an invalid query error", err)
+	}
+
+	err = &QueryError{Op: "querying", Err: context.DeadlineExceeded}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, expected it to wrap the cause", err)
+	}
+	if expected := "Error querying db: context deadline exceeded"; err.Error() != expected {
+		t.Errorf("got %q, expected %q", err.Error(), expected)
+	}
+}
@@ -0,0 +1,57 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+)
+
+// Explain runs the search s under EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON) and
+// returns the resulting plan. The statement explained is the one Search runs
+// for s, so that the plan reflects the real query. As ANALYZE executes the
+// statement, this costs as much as the search itself; it is meant for
+// diagnosing slow searches and is only exposed to admin callers by the HTTP
+// server. The "count" export format is not supported.
+func (c *DBClient) Explain(ctx context.Context, s *SearchQuery) (string, error) {
+	if err := s.Validate(); err != nil {
+		return "", err
+	}
+	if s.ExportFormat == "count" {
+		return "", invalidQueryErrorf("The count export format is not supported when explaining a search")
+	}
+	s, err := c.capSearch(s)
+	if err != nil {
+		return "", err
+	}
+	if err := c.checkOpen(); err != nil {
+		return "", err
+	}
+
+	q, sqlArgs, err := c.searchStatement(s)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := withTimeout(ctx, c.Timeouts.searchTimeout(s))
+	defer cancel()
+
+	var plan string
+	err = c.reader().QueryRowContext(ctx, "EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON) "+q, sqlArgs...).Scan(&plan)
+	if err != nil {
+		return "", &QueryError{Op: "querying", Err: err}
+	}
+	return plan, nil
+}
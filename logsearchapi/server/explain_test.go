@@ -0,0 +1,138 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExplainErrors(t *testing.T) {
+	c := &DBClient{}
+	for _, sq := range []*SearchQuery{
+		{Query: "bogus"},
+		{Query: reqInfoQ, ExportFormat: "count"},
+	} {
+		if _, err := c.Explain(context.Background(), sq); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%+v: got %v, expected an invalid query error", sq, err)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	insertTestEvent(t, c, time.Now(), bucket)
+
+	for _, q := range []qType{rawQ, reqInfoQ, joinedQ} {
+		sq := &SearchQuery{
+			Query:    q,
+			PageSize: 10,
+			FParams:  bucketFilter(q, bucket),
+		}
+		plan, err := c.Explain(context.Background(), sq)
+		if err != nil {
+			t.Fatalf("%s: Explain failed: %v", q, err)
+		}
+		var res []struct {
+			Plan          map[string]interface{}
+			ExecutionTime float64 `json:"Execution Time"`
+		}
+		if err := json.Unmarshal([]byte(plan), &res); err != nil {
+			t.Fatalf("%s: decoding plan %q: %v", q, plan, err)
+		}
+		if len(res) != 1 || res[0].Plan["Node Type"] != "Limit" {
+			t.Errorf("%s: expected a plan limited to the page, got %s", q, plan)
+		}
+	}
+}
+
+// planRelations returns the names of the relations scanned by the nodes of
+// the plan, as decoded from the JSON output of EXPLAIN.
+func planRelations(plan map[string]interface{}) []string {
+	var names []string
+	if name, ok := plan["Relation Name"].(string); ok {
+		names = append(names, name)
+	}
+	subplans, _ := plan["Plans"].([]interface{})
+	for _, sub := range subplans {
+		if sub, ok := sub.(map[string]interface{}); ok {
+			names = append(names, planRelations(sub)...)
+		}
+	}
+	return names
+}
+
+func TestExplainPartitionPruning(t *testing.T) {
+	c := newTestDBClient(t)
+	c.PartitionInterval = PartitionDaily
+	ctx := context.Background()
+
+	// Partitions for a few days, of which a search of a couple of hours
+	// of a single day should scan only one.
+	rangeStart := time.Date(2001, 2, 1, 0, 0, 0, 0, time.UTC)
+	for _, table := range []Table{c.reqInfoTable(), c.logEventsTable()} {
+		if err := c.EnsurePartitionsForRange(ctx, table, rangeStart, rangeStart.AddDate(0, 0, 5)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	timeStart := rangeStart.AddDate(0, 0, 2).Add(10 * time.Hour)
+	timeEnd := timeStart.Add(2 * time.Hour)
+	p := newPartitionTimeRange(timeStart, PartitionDaily)
+
+	for _, q := range []qType{rawQ, reqInfoQ, joinedQ} {
+		sq := &SearchQuery{Query: q, PageSize: 10, TimeStart: &timeStart, TimeEnd: &timeEnd}
+		plan, err := c.Explain(ctx, sq)
+		if err != nil {
+			t.Fatalf("%s: Explain failed: %v", q, err)
+		}
+		var res []struct {
+			Plan map[string]interface{}
+		}
+		if err := json.Unmarshal([]byte(plan), &res); err != nil || len(res) != 1 {
+			t.Fatalf("%s: decoding plan %q: %v", q, plan, err)
+		}
+
+		var tables []Table
+		switch q {
+		case rawQ:
+			tables = []Table{c.logEventsTable()}
+		case reqInfoQ:
+			tables = []Table{c.reqInfoTable()}
+		case joinedQ:
+			tables = []Table{c.reqInfoTable(), c.logEventsTable()}
+		}
+		relations := planRelations(res[0].Plan)
+		for _, table := range tables {
+			expected := table.getPartitionName(p)
+			var scanned []string
+			for _, name := range relations {
+				if strings.HasPrefix(name, table.Name+"_") {
+					scanned = append(scanned, name)
+				}
+			}
+			if len(scanned) != 1 || scanned[0] != expected {
+				t.Errorf("%s: scanned %v of %s, expected only %s", q, scanned, table.Name, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// defaultMaxIdleConns is the database/sql default of the maximum number of
+// idle connections, used when PoolConfig.MaxIdleConns is not set.
+const defaultMaxIdleConns = 2
+
+// healPingTimeout bounds the ping re-establishing a connection when the pool
+// is healed.
+const healPingTimeout = 2 * time.Second
+
+// minHealInterval is the minimum time between heals of the pool, so that the
+// failures of concurrent operations during an outage do not each flush the
+// pool.
+var minHealInterval = time.Second
+
+// healPool closes the idle connections of the pool, which are likely stale
+// after a connection error, e.g. once the database is back after a restart or
+// a failover, and pings the database to open a fresh one. Otherwise, every
+// stale connection would fail the next operation using it. The pool is
+// healed at most once every minHealInterval.
+func (c *DBClient) healPool() {
+	if c.DB == nil {
+		return
+	}
+	c.healMu.Lock()
+	if time.Since(c.lastHeal) < minHealInterval {
+		c.healMu.Unlock()
+		return
+	}
+	c.lastHeal = time.Now()
+	c.healMu.Unlock()
+
+	maxIdle := c.pool.MaxIdleConns
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdleConns
+	}
+	c.DB.SetMaxIdleConns(0)
+	c.DB.SetMaxIdleConns(maxIdle)
+	if c.replica != nil {
+		// The error may come from either pool.
+		c.replica.SetMaxIdleConns(0)
+		c.replica.SetMaxIdleConns(maxIdle)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healPingTimeout)
+	defer cancel()
+	if err := c.PingContext(ctx); err != nil {
+		c.logger().Warnf("Database still unreachable after a connection error: %v", err)
+		return
+	}
+	c.logger().Infof("Reconnected to the database after a connection error")
+}
+
+// healOnConnErr heals the pool when err is a connection error.
+func (c *DBClient) healOnConnErr(err error) {
+	if isConnErr(err) {
+		c.healPool()
+	}
+}
+
+// healing returns op, healing the pool when it fails with a connection
+// error, so that its retries run on fresh connections.
+func (c *DBClient) healing(op func() error) func() error {
+	return func() error {
+		err := op()
+		c.healOnConnErr(err)
+		return err
+	}
+}
@@ -0,0 +1,234 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// outageServer simulates a database server going through outages. The
+// connections opened before a restart are stale: they fail once and are
+// then invalid, like the connections of lib/pq.
+type outageServer struct {
+	mu       sync.Mutex
+	down     bool
+	restarts int
+	execs    int
+}
+
+func (s *outageServer) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down && !down {
+		s.restarts++
+	}
+	s.down = down
+}
+
+func (s *outageServer) Connect(context.Context) (driver.Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return nil, syscall.ECONNREFUSED
+	}
+	return &outageConn{server: s, restarts: s.restarts}, nil
+}
+
+func (s *outageServer) Driver() driver.Driver { return outageDriver{s} }
+
+type outageDriver struct {
+	server *outageServer
+}
+
+func (d outageDriver) Open(string) (driver.Conn, error) {
+	return d.server.Connect(context.Background())
+}
+
+type outageConn struct {
+	server   *outageServer
+	restarts int
+	bad      bool
+}
+
+func (c *outageConn) check() error {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if c.server.down || c.restarts != c.server.restarts {
+		c.bad = true
+		return io.EOF
+	}
+	return nil
+}
+
+func (c *outageConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	c.server.mu.Lock()
+	c.server.execs++
+	c.server.mu.Unlock()
+	return driver.RowsAffected(1), nil
+}
+
+func (c *outageConn) Ping(context.Context) error { return c.check() }
+
+func (c *outageConn) IsValid() bool { return !c.bad }
+
+func (c *outageConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *outageConn) Close() error { return nil }
+
+func (c *outageConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+// newOutageDB returns a DB of a new outageServer with idle connections
+// opened.
+func newOutageDB(t *testing.T, idle int) (*sql.DB, *outageServer) {
+	t.Helper()
+	server := &outageServer{}
+	db := sql.OpenDB(server)
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxIdleConns(idle)
+
+	ctx := context.Background()
+	var conns []*sql.Conn
+	for i := 0; i < idle; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if got := db.Stats().Idle; got != idle {
+		t.Fatalf("got %d idle connections, expected %d", got, idle)
+	}
+	return db, server
+}
+
+func TestIsConnErr(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected bool
+	}{
+		{nil, false},
+		{io.EOF, true},
+		{&QueryError{Op: "querying", Err: syscall.ECONNRESET}, true},
+		{driver.ErrBadConn, true},
+		{&pq.Error{Code: "08006"}, true},
+		{&pq.Error{Code: "57P01"}, true},
+		{&pq.Error{Code: "40001"}, false},
+		{&pq.Error{Code: "23505"}, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("bad event"), false},
+	}
+	for i, testCase := range testCases {
+		if got := isConnErr(testCase.err); got != testCase.expected {
+			t.Errorf("Test %d: got %t for %v, expected %t", i, got, testCase.err, testCase.expected)
+		}
+	}
+	if !isTransientErr(&pq.Error{Code: "40001"}) {
+		t.Errorf("serialization failures are not transient")
+	}
+}
+
+func TestHealPool(t *testing.T) {
+	defer func(interval time.Duration) { minHealInterval = interval }(minHealInterval)
+	minHealInterval = 0
+	ctx := context.Background()
+
+	const idle = 3
+	db, server := newOutageDB(t, idle)
+	logger := &recordingLogger{}
+	c := &DBClient{DB: db, Logger: logger, pool: PoolConfig{MaxIdleConns: idle}}
+	exec := c.healing(func() error {
+		_, err := c.ExecContext(ctx, "INSERT")
+		return err
+	})
+
+	// During the outage, the operations fail and the pool cannot be
+	// healed.
+	server.setDown(true)
+	if err := exec(); !isConnErr(err) {
+		t.Fatalf("got %v, expected a connection error during the outage", err)
+	}
+	if len(logger.messages["warn"]) != 1 {
+		t.Errorf("got log messages %v, expected a warning", logger.messages)
+	}
+	server.setDown(false)
+	if err := exec(); err != nil {
+		t.Fatalf("got %v after the outage", err)
+	}
+
+	// After a restart, only the first operation fails on a stale
+	// connection, as the other idle connections are closed by the heal.
+	server.setDown(true)
+	server.setDown(false)
+	if err := exec(); !isConnErr(err) {
+		t.Fatalf("got %v, expected a connection error on a stale connection", err)
+	}
+	for i := 0; i < idle; i++ {
+		if err := exec(); err != nil {
+			t.Fatalf("got %v after the heal", err)
+		}
+	}
+}
+
+func TestHealPoolRetries(t *testing.T) {
+	defer func(interval time.Duration) { minHealInterval = interval }(minHealInterval)
+	minHealInterval = 0
+
+	const idle = 3
+	db, server := newOutageDB(t, idle)
+	c := &DBClient{DB: db, Logger: &recordingLogger{}, pool: PoolConfig{MaxIdleConns: idle}}
+	server.setDown(true)
+	server.setDown(false)
+
+	// A single retry rides through the restart, although all the idle
+	// connections are stale.
+	policy := RetryPolicy{MaxRetries: 1, InitialBackoff: time.Millisecond}
+	attempts := 0
+	err := retryTransient(context.Background(), policy, c.healing(func() error {
+		attempts++
+		_, err := c.ExecContext(context.Background(), "INSERT")
+		return err
+	}))
+	if err != nil {
+		t.Fatalf("got %v, expected the retry to succeed", err)
+	}
+	if attempts != 2 {
+		t.Errorf("got %d attempts, expected 2", attempts)
+	}
+	if server.execs != 1 {
+		t.Errorf("got %d execs, expected 1", server.execs)
+	}
+}
@@ -0,0 +1,140 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"fmt"
+)
+
+// PartitionMode selects how the audit log tables are split by time.
+type PartitionMode int
+
+const (
+	// PartitionModeAuto uses TimescaleDB hypertables when the timescaledb
+	// extension is installed in the database, unless the tables already
+	// exist with native partitioning, and native partitioning otherwise.
+	// This is the default mode.
+	PartitionModeAuto PartitionMode = iota
+	// PartitionModeNative creates and maintains range partitions of the
+	// tables, according to DBClient.PartitionInterval.
+	PartitionModeNative
+	// PartitionModeHypertable creates the tables as TimescaleDB
+	// hypertables, which TimescaleDB splits into chunks as rows are
+	// inserted. It requires the timescaledb extension.
+	PartitionModeHypertable
+)
+
+// ParsePartitionMode parses the name of a partition mode.
+func ParsePartitionMode(s string) (PartitionMode, error) {
+	switch s {
+	case "auto", "":
+		return PartitionModeAuto, nil
+	case "native":
+		return PartitionModeNative, nil
+	case "hypertable":
+		return PartitionModeHypertable, nil
+	}
+	return PartitionModeAuto, fmt.Errorf("Unknown partition mode: %s (must be one of auto, native or hypertable)", s)
+}
+
+func (m PartitionMode) String() string {
+	switch m {
+	case PartitionModeNative:
+		return "native"
+	case PartitionModeHypertable:
+		return "hypertable"
+	}
+	return "auto"
+}
+
+// WithPartitionMode selects how the client partitions its tables, instead of
+// detecting it (see PartitionModeAuto).
+func WithPartitionMode(m PartitionMode) DBClientOption {
+	return func(c *DBClient) {
+		c.partitionMode = m
+	}
+}
+
+// chunkInterval returns the TimescaleDB chunk interval matching the
+// partition interval. Months are approximated, as chunk intervals must
+// have a fixed length.
+func (i PartitionInterval) chunkInterval() string {
+	switch i {
+	case PartitionDaily:
+		return "1 day"
+	case PartitionMonthly:
+		return "30 days"
+	}
+	return "7 days"
+}
+
+// hypertables returns true if the tables of the client are TimescaleDB
+// hypertables, as per its partition mode. In PartitionModeAuto, the mode is
+// detected on the first call, and remembered.
+func (c *DBClient) hypertables(ctx context.Context) (bool, error) {
+	c.partitionModeMu.Lock()
+	defer c.partitionModeMu.Unlock()
+	if c.resolvedPartitionMode != PartitionModeAuto {
+		return c.resolvedPartitionMode == PartitionModeHypertable, nil
+	}
+
+	const timescaleStatus = `SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb'),
+                                        EXISTS (SELECT 1 FROM pg_partitioned_table WHERE partrelid = to_regclass($1));`
+
+	mode := c.partitionMode
+	if mode != PartitionModeNative {
+		// Whether the tables are partitioned is told by the first
+		// one, which is request_info when the raw logs are not stored.
+		var installed, partitioned bool
+		err := c.QueryRowContext(ctx, timescaleStatus, c.tables()[0].Name).Scan(&installed, &partitioned)
+		if err != nil {
+			return false, fmt.Errorf("Error detecting the timescaledb extension: %v", err)
+		}
+		switch {
+		case mode == PartitionModeHypertable && !installed:
+			return false, fmt.Errorf("Partition mode %s requires the timescaledb extension, which is not installed", mode)
+		case mode == PartitionModeAuto && installed && !partitioned:
+			mode = PartitionModeHypertable
+		case mode == PartitionModeAuto:
+			mode = PartitionModeNative
+		}
+		c.logger().Infof("Using %s partitioning", mode)
+	}
+	c.resolvedPartitionMode = mode
+	return mode == PartitionModeHypertable, nil
+}
+
+const createHypertable QTemplate = `SELECT create_hypertable('%s', '%s', chunk_time_interval => INTERVAL '%s', if_not_exists => TRUE);`
+
+// createHypertable creates the table as a hypertable chunked by its time
+// column. Its indexes are created by CreateIndices, which TimescaleDB then
+// creates on every chunk.
+func (c *DBClient) createHypertable(ctx context.Context, table Table) error {
+	if _, err := c.ExecContext(ctx, table.getCreateUnpartitionedStatement()); err != nil {
+		return err
+	}
+	q := createHypertable.build(table.Name, table.TimeColumn, c.PartitionInterval.chunkInterval())
+	if _, err := c.ExecContext(ctx, q); err != nil {
+		return fmt.Errorf("Error creating hypertable %s: %v", table.Name, err)
+	}
+	if c.DedupeRequestInfo && table.Name == c.reqInfoTable().Name {
+		// Unique indexes of hypertables must include the time column.
+		c.logger().Warnf("Request IDs in hypertable %s will not be deduplicated", table.Name)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePartitionMode(t *testing.T) {
+	for _, m := range []PartitionMode{PartitionModeAuto, PartitionModeNative, PartitionModeHypertable} {
+		got, err := ParsePartitionMode(m.String())
+		if err != nil || got != m {
+			t.Errorf("%s: got %v, %v", m, got, err)
+		}
+	}
+	if got, err := ParsePartitionMode(""); err != nil || got != PartitionModeAuto {
+		t.Errorf("got %v, %v, expected the auto mode", got, err)
+	}
+	if _, err := ParsePartitionMode("timescale"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestCreateUnpartitionedStatement(t *testing.T) {
+	for _, table := range []Table{auditLogEventsTable, requestInfoTable} {
+		partitioned := table.getCreateStatement()
+		if !strings.HasSuffix(partitioned, fmt.Sprintf(") PARTITION BY RANGE (%s);", table.TimeColumn)) {
+			t.Errorf("%s: unexpected statement %q", table.Name, partitioned)
+		}
+		unpartitioned := table.getCreateUnpartitionedStatement()
+		if strings.Contains(unpartitioned, "PARTITION") || !strings.HasSuffix(unpartitioned, ");") {
+			t.Errorf("%s: unexpected statement %q", table.Name, unpartitioned)
+		}
+	}
+	// Tables that are not partitioned are created as they are.
+	if q := schemaMigrationsTable.getCreateStatement(); strings.Contains(q, "PARTITION") {
+		t.Errorf("unexpected statement %q", q)
+	}
+}
+
+func TestHypertables(t *testing.T) {
+	native := newTestDBClient(t)
+	var installed bool
+	err := native.QueryRowContext(context.Background(), `SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb');`).Scan(&installed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hyper, err := native.hypertables(context.Background()); err != nil || hyper {
+		t.Errorf("got %v, %v, expected native partitioning", hyper, err)
+	}
+	if !installed {
+		c, err := NewDBClient(context.Background(), os.Getenv(testPgConnStrEnv), WithPartitionMode(PartitionModeHypertable))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if err := c.InitDBTables(context.Background()); err == nil {
+			t.Error("expected an error without the timescaledb extension")
+		}
+		t.Skip("timescaledb is not installed - skipping hypertable tests")
+	}
+
+	c := newTestDBClient(t, WithTablePrefix("hypertest_"), WithPartitionMode(PartitionModeHypertable))
+	t.Cleanup(func() {
+		for _, table := range c.tables() {
+			if _, err := native.ExecContext(context.Background(), fmt.Sprintf("DROP TABLE IF EXISTS %s", table.Name)); err != nil {
+				t.Errorf("dropping %s: %v", table.Name, err)
+			}
+		}
+	})
+	for _, table := range c.tables() {
+		var n int
+		err := c.QueryRowContext(context.Background(), `SELECT COUNT(*) FROM timescaledb_information.hypertables WHERE hypertable_name = $1;`, table.Name).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("%s is not a hypertable", table.Name)
+		}
+	}
+
+	bucket := testBucketName()
+	insertTestEvent(t, c, time.Now(), bucket)
+	// An event far in the past is inserted in a chunk created for it.
+	insertTestEvent(t, c, time.Now().AddDate(-1, 0, 0), bucket)
+	for _, q := range []qType{rawQ, reqInfoQ, joinedQ} {
+		sq := SearchQuery{Query: q, ExportFormat: "count", FParams: bucketFilter(q, bucket)}
+		var buf bytes.Buffer
+		if err := c.Search(context.Background(), &sq, &buf); err != nil {
+			t.Fatalf("%s: search failed: %v", q, err)
+		}
+		if expected := "{\"count\":2}\n"; buf.String() != expected {
+			t.Errorf("%s: got %q, expected %q", q, buf.String(), expected)
+		}
+	}
+	if err := c.HealthCheck(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
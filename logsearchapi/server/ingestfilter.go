@@ -0,0 +1,94 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// IngestRule matches audit events that are not stored, e.g. the requests of
+// health probes. An event matches when all the non-empty fields of the rule
+// match it: APIName, Bucket and Object match the same fields of the event
+// exactly, while UserAgent matches the user agents starting with it, so that
+// e.g. "kube-probe/" matches all the versions of the probe.
+type IngestRule struct {
+	APIName   string `json:"api,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	Object    string `json:"object,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+}
+
+func (r IngestRule) matches(ev *Event) bool {
+	return r != (IngestRule{}) &&
+		(r.APIName == "" || r.APIName == ev.API.Name) &&
+		(r.Bucket == "" || r.Bucket == ev.API.Bucket) &&
+		(r.Object == "" || r.Object == ev.API.Object) &&
+		(r.UserAgent == "" || strings.HasPrefix(ev.UserAgent, r.UserAgent))
+}
+
+// ParseIngestRules parses a list of ingest rules separated by semicolons,
+// each rule being a list of comma-separated field=value pairs with the fields
+// api, bucket, object and userAgent, e.g.
+// "api=HeadObject,object=health/sentinel;userAgent=kube-probe/". An empty
+// string has no rules.
+func ParseIngestRules(s string) ([]IngestRule, error) {
+	var rules []IngestRule
+	for _, ruleStr := range strings.Split(s, ";") {
+		ruleStr = strings.TrimSpace(ruleStr)
+		if ruleStr == "" {
+			continue
+		}
+		var rule IngestRule
+		for _, pair := range strings.Split(ruleStr, ",") {
+			field, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || value == "" {
+				return nil, fmt.Errorf("invalid ingest rule %q: expected field=value, got %q", ruleStr, pair)
+			}
+			var dst *string
+			switch field {
+			case "api":
+				dst = &rule.APIName
+			case "bucket":
+				dst = &rule.Bucket
+			case "object":
+				dst = &rule.Object
+			case "userAgent":
+				dst = &rule.UserAgent
+			default:
+				return nil, fmt.Errorf("invalid ingest rule %q: unknown field %q", ruleStr, field)
+			}
+			if *dst != "" {
+				return nil, fmt.Errorf("invalid ingest rule %q: duplicate field %q", ruleStr, field)
+			}
+			*dst = value
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// ignoredEvent returns whether the event matches a rule of the IngestFilter
+// of the client, and is not to be stored.
+func (c *DBClient) ignoredEvent(ev *Event) bool {
+	for _, rule := range c.IngestFilter {
+		if rule.matches(ev) {
+			return true
+		}
+	}
+	return false
+}
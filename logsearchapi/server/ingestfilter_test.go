@@ -0,0 +1,133 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseIngestRules(t *testing.T) {
+	testCases := []struct {
+		s        string
+		expected []IngestRule
+	}{
+		{"", nil},
+		{" ; ", nil},
+		{
+			"api=HeadObject,object=health/sentinel; userAgent=kube-probe/",
+			[]IngestRule{{APIName: "HeadObject", Object: "health/sentinel"}, {UserAgent: "kube-probe/"}},
+		},
+		{"bucket=probes, api=GetObject", []IngestRule{{APIName: "GetObject", Bucket: "probes"}}},
+		// Values may contain equal signs.
+		{"object=a=b", []IngestRule{{Object: "a=b"}}},
+	}
+	for _, testCase := range testCases {
+		rules, err := ParseIngestRules(testCase.s)
+		if err != nil {
+			t.Errorf("%q: %v", testCase.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(rules, testCase.expected) {
+			t.Errorf("%q: got %+v, expected %+v", testCase.s, rules, testCase.expected)
+		}
+	}
+
+	for _, s := range []string{"api", "api=", "api=HeadObject,", "method=HEAD", "api=HeadObject,api=GetObject"} {
+		if _, err := ParseIngestRules(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestIgnoredEvent(t *testing.T) {
+	c := &DBClient{IngestFilter: []IngestRule{
+		{APIName: "HeadObject", Object: "health/sentinel"},
+		{UserAgent: "kube-probe/"},
+		{},
+	}}
+	event := func(api, object, userAgent string) *Event {
+		return &Event{API: API{Name: api, Bucket: "photos", Object: object}, UserAgent: userAgent}
+	}
+	testCases := []struct {
+		ev      *Event
+		ignored bool
+	}{
+		{event("HeadObject", "health/sentinel", "MinIO (linux; amd64)"), true},
+		{event("GetObject", "health/sentinel", "MinIO (linux; amd64)"), false},
+		{event("HeadObject", "health/other", "MinIO (linux; amd64)"), false},
+		{event("PutObject", "cat.png", "kube-probe/1.25"), true},
+		{event("PutObject", "cat.png", "Mozilla/5.0 kube-probe/1.25"), false},
+		// The empty rule matches no event.
+		{event("", "", ""), false},
+	}
+	for _, testCase := range testCases {
+		if ignored := c.ignoredEvent(testCase.ev); ignored != testCase.ignored {
+			t.Errorf("%+v: got ignored %v, expected %v", testCase.ev, ignored, testCase.ignored)
+		}
+	}
+}
+
+func TestIngestFilter(t *testing.T) {
+	c := newTestDBClient(t)
+	c.IngestFilter = []IngestRule{
+		{APIName: "HeadObject", Object: "health/sentinel"},
+		{UserAgent: "kube-probe/"},
+	}
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	now := time.Now()
+	probe := newTestEvent(now, bucket)
+	probe["api"].(map[string]interface{})["name"] = "HeadObject"
+	probe["api"].(map[string]interface{})["object"] = "health/sentinel"
+	kubeProbe := newTestEvent(now, bucket)
+	kubeProbe["userAgent"] = "kube-probe/1.25"
+	// Another object of the same API is stored.
+	head := newTestEvent(now, bucket)
+	head["api"].(map[string]interface{})["name"] = "HeadObject"
+
+	for _, ev := range []map[string]interface{}{probe, kubeProbe, head} {
+		insertTestEventMap(t, c, ev)
+	}
+	var events [][]byte
+	for _, ev := range []map[string]interface{}{probe, kubeProbe, newTestEvent(now, bucket)} {
+		buf, err := json.Marshal(ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, buf)
+	}
+	if err := c.InsertEvents(ctx, events); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		sq := SearchQuery{Query: q, ExportFormat: "count", FParams: bucketFilter(q, bucket)}
+		var buf bytes.Buffer
+		if err := c.Search(ctx, &sq, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if expected := "{\"count\":2}\n"; buf.String() != expected {
+			t.Errorf("%s: got %q, expected %q", q, buf.String(), expected)
+		}
+	}
+}
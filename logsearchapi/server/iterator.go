@@ -0,0 +1,269 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+
+	"github.com/georgysavva/scany/sqlscan"
+)
+
+// RowIterator iterates over the records of a search, as typed rows, while
+// they are read from the DB. Close must be called when done with it, unless
+// Next returned false.
+type RowIterator struct {
+	s    *SearchQuery
+	rows *limitedRows
+	// run, when set, is finished by Close (see SearchRows).
+	run *searchRun
+
+	// nullable has the reqInfoQ and joinedQ records scanned with their
+	// NULL values, for csv output.
+	nullable bool
+	// decodeLogs has the logs of rawQ and joinedQ records decoded, for
+	// LogEvent and JSON output.
+	decodeLogs bool
+
+	// The current record, as scanned and redacted: reqInfo, or reqInfoCSV
+	// when nullable, for reqInfoQ and joinedQ records, and raw, along with
+	// its decoded log, for rawQ and joinedQ records.
+	reqInfo    ReqInfoRow
+	reqInfoCSV reqInfoCSVRow
+	raw        logEventRawRow
+	log        map[string]interface{}
+
+	n      int64
+	err    error
+	closed bool
+}
+
+// SearchRows runs the search s and returns an iterator over its records,
+// for callers handling the records themselves rather than having Search
+// write them out. Paging is as for Search: a page of records is returned
+// unless ExportFormat is set, in which case all the matching records are
+// returned, whatever the format. The "count" export format is not supported.
+// The search holds one of the search slots of the client (see PoolConfig)
+// until the iterator is closed.
+func (c *DBClient) SearchRows(ctx context.Context, s *SearchQuery) (*RowIterator, error) {
+	s, err := c.prepareSearch(s)
+	if err != nil {
+		return nil, err
+	}
+	if s.ExportFormat == "count" {
+		return nil, invalidQueryErrorf("The count export format is not supported when iterating over rows")
+	}
+	run, err := c.startSearch(ctx, s, false)
+	if err != nil {
+		return nil, err
+	}
+
+	q, sqlArgs, err := c.searchStatement(run.s)
+	if err != nil {
+		run.finish(0, err)
+		return nil, err
+	}
+	rows, err := run.db.QueryContext(run.ctx, q, sqlArgs...)
+	if err != nil {
+		err = &QueryError{Op: "querying", Err: err}
+		run.finish(0, err)
+		return nil, err
+	}
+	return &RowIterator{s: run.s, rows: &limitedRows{Rows: rows}, run: run, decodeLogs: true}, nil
+}
+
+// Next reads the next record, returning false when there are no more
+// records or on error, which is then returned by Err. The iterator is closed
+// when Next returns false.
+func (it *RowIterator) Next() bool {
+	if it.closed {
+		return false
+	}
+	if !it.rows.Next() {
+		it.err = it.rows.accessErr()
+		it.Close()
+		return false
+	}
+	if err := it.scan(); err != nil {
+		it.err = err
+		it.Close()
+		return false
+	}
+	it.n++
+	return true
+}
+
+func (it *RowIterator) scan() error {
+	// The rows are scanned into new records, as the columns left out of
+	// the search are not scanned.
+	var row interface{}
+	switch {
+	case it.s.Query == rawQ:
+		it.raw = logEventRawRow{}
+		row = &it.raw
+	case it.s.Query == reqInfoQ && it.nullable:
+		it.reqInfoCSV = reqInfoCSVRow{}
+		row = &it.reqInfoCSV
+	case it.s.Query == reqInfoQ:
+		it.reqInfo = ReqInfoRow{}
+		row = &it.reqInfo
+	case it.nullable:
+		row = &joinedCSVRow{}
+	default:
+		row = &joinedRawRow{}
+	}
+	if err := sqlscan.ScanRow(row, it.rows.Rows); err != nil {
+		return &QueryError{Op: "accessing", Err: err}
+	}
+	if err := it.s.redact(row); err != nil {
+		return err
+	}
+	switch r := row.(type) {
+	case *joinedCSVRow:
+		it.reqInfoCSV = r.reqInfoCSVRow
+		it.raw = logEventRawRow{EventTime: r.Time, Log: r.Log}
+	case *joinedRawRow:
+		it.reqInfo = r.ReqInfoRow
+		it.raw = logEventRawRow{EventTime: r.Time, Log: r.Log}
+	}
+
+	if it.decodeLogs && it.s.Query != reqInfoQ {
+		it.log = nil
+		if err := decodeJSONLog(it.raw.Log, &it.log); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEach calls write for each of the remaining records of it, counting
+// the records in *n, until write fails.
+func (it *RowIterator) writeEach(n *int64, write func() error) error {
+	for it.Next() {
+		if err := write(); err != nil {
+			return err
+		}
+		*n++
+	}
+	return it.Err()
+}
+
+// ReqInfo returns the current record of a reqInfoQ (or joinedQ) search.
+func (it *RowIterator) ReqInfo() ReqInfoRow {
+	row := it.reqInfo
+	row.Time = it.s.outputTime(row.Time)
+	return row
+}
+
+// LogEvent returns the current record of a rawQ search, or the raw log of
+// the current record of a joinedQ search.
+func (it *RowIterator) LogEvent() LogEventRow {
+	return LogEventRow{EventTime: it.s.outputTime(it.raw.EventTime), Log: it.log}
+}
+
+// jsonValue returns the value to encode as the JSON output of the current
+// record.
+func (it *RowIterator) jsonValue() (interface{}, error) {
+	switch it.s.Query {
+	case rawQ:
+		return it.s.recordJSONValue(it.LogEvent())
+	case reqInfoQ:
+		return it.s.reqInfoJSONValue(it.reqInfo)
+	}
+	return it.s.recordJSONValue(JoinedRow{ReqInfoRow: it.ReqInfo(), Log: it.log})
+}
+
+// csvRecord returns the csv record of the current record, matching the
+// csvHeader of the search.
+func (it *RowIterator) csvRecord() ([]string, error) {
+	switch it.s.Query {
+	case rawQ:
+		return it.s.rawCSVRecord(it.raw)
+	case reqInfoQ:
+		return it.s.reqInfoCSVRecord(it.reqInfoCSV), nil
+	}
+	return append(it.s.reqInfoCSVRecord(it.reqInfoCSV), it.raw.Log), nil
+}
+
+// values returns the typed values of the current record for the binary
+// export formats, matching the outputParquetColumns of the search, or its
+// xlsxHeader.
+func (it *RowIterator) values() []interface{} {
+	switch it.s.Query {
+	case rawQ:
+		return []interface{}{it.s.outputTime(it.raw.EventTime), it.raw.Log}
+	case reqInfoQ:
+		return it.s.reqInfoRowValues(it.reqInfo)
+	}
+	return append(it.s.reqInfoRowValues(it.reqInfo), it.raw.Log)
+}
+
+// Err returns the error that ended the iteration, if any.
+func (it *RowIterator) Err() error {
+	return it.err
+}
+
+// Close releases the rows of the search, and its search slot. It may be
+// called more than once.
+func (it *RowIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	err := it.rows.Close()
+	if it.run != nil {
+		it.run.finish(it.n, it.err)
+	}
+	return err
+}
+
+// StreamRow is a record of a search streamed by StreamSearch. It mirrors the
+// Row message of proto/logsearch.proto, for transports such as gRPC to
+// convert it field by field: ReqInfo is set for reqInfoQ records, LogEvent
+// for rawQ records, and both for joinedQ records.
+type StreamRow struct {
+	ReqInfo  *ReqInfoRow
+	LogEvent *LogEventRow
+}
+
+// StreamSearch runs the search s like SearchRows and calls send with each of
+// its records, in order, while they are read from the DB, so that the
+// transport streaming the records is decoupled from the query. A StreamRow
+// is not reused, so send may keep it. StreamSearch stops at the first error
+// returned by send, which it returns as is.
+func (c *DBClient) StreamSearch(ctx context.Context, s *SearchQuery, send func(*StreamRow) error) error {
+	it, err := c.SearchRows(ctx, s)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	for it.Next() {
+		var row StreamRow
+		if it.s.Query != rawQ {
+			reqInfo := it.ReqInfo()
+			row.ReqInfo = &reqInfo
+		}
+		if it.s.Query != reqInfoQ {
+			logEvent := it.LogEvent()
+			row.LogEvent = &logEvent
+		}
+		if err := send(&row); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
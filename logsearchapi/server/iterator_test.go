@@ -0,0 +1,141 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSearchRowsErrors(t *testing.T) {
+	c := &DBClient{}
+	for _, sq := range []*SearchQuery{
+		{Query: "bogus"},
+		{Query: reqInfoQ, ExportFormat: "count"},
+	} {
+		if _, err := c.SearchRows(context.Background(), sq); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%+v: got %v, expected an invalid query error", sq, err)
+		}
+		err := c.StreamSearch(context.Background(), sq, func(*StreamRow) error {
+			t.Errorf("%+v: send called", sq)
+			return nil
+		})
+		if !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%+v: got %v from StreamSearch, expected an invalid query error", sq, err)
+		}
+	}
+}
+
+func TestSearchRows(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	now := time.Now()
+	insertTestEvent(t, c, now, bucket)
+	insertTestEvent(t, c, now.Add(time.Second), bucket)
+
+	for _, q := range []qType{rawQ, reqInfoQ, joinedQ} {
+		sq := &SearchQuery{
+			Query:    q,
+			PageSize: 10,
+			FParams:  bucketFilter(q, bucket),
+		}
+		it, err := c.SearchRows(context.Background(), sq)
+		if err != nil {
+			t.Fatalf("%s: SearchRows failed: %v", q, err)
+		}
+		var n int
+		for it.Next() {
+			n++
+			if q != rawQ && it.ReqInfo().Bucket != bucket {
+				t.Errorf("%s: got request info %+v", q, it.ReqInfo())
+			}
+			if q != reqInfoQ && it.LogEvent().Log["requestID"] == nil {
+				t.Errorf("%s: got log event %+v", q, it.LogEvent())
+			}
+		}
+		if err := it.Err(); err != nil {
+			t.Errorf("%s: %v", q, err)
+		}
+		if n != 2 {
+			t.Errorf("%s: expected 2 rows, got %d", q, n)
+		}
+		if err := it.Close(); err != nil {
+			t.Errorf("%s: closing again failed: %v", q, err)
+		}
+	}
+}
+
+func TestStreamSearch(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		insertTestEvent(t, c, now.Add(time.Duration(i)*time.Second), bucket)
+	}
+
+	for _, q := range []qType{rawQ, reqInfoQ, joinedQ} {
+		sq := &SearchQuery{
+			Query:        q,
+			ExportFormat: "ndjson",
+			FParams:      bucketFilter(q, bucket),
+		}
+		var rows []*StreamRow
+		err := c.StreamSearch(ctx, sq, func(row *StreamRow) error {
+			rows = append(rows, row)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: StreamSearch failed: %v", q, err)
+		}
+		if len(rows) != 3 {
+			t.Fatalf("%s: send called %d times, expected 3", q, len(rows))
+		}
+		for i, row := range rows {
+			if (row.ReqInfo != nil) != (q != rawQ) || (row.LogEvent != nil) != (q != reqInfoQ) {
+				t.Errorf("%s: row %d: got %+v", q, i, row)
+				continue
+			}
+			if row.ReqInfo != nil && row.ReqInfo.Bucket != bucket {
+				t.Errorf("%s: row %d: got request info %+v", q, i, row.ReqInfo)
+			}
+			if row.LogEvent != nil && row.LogEvent.Log["requestID"] == nil {
+				t.Errorf("%s: row %d: got log event %+v", q, i, row.LogEvent)
+			}
+		}
+		// The rows kept by send are distinct.
+		if q != rawQ && rows[0].ReqInfo.RequestID == rows[1].ReqInfo.RequestID {
+			t.Errorf("%s: rows 0 and 1 have the same request ID", q)
+		}
+	}
+
+	// An error of send stops the stream.
+	sendErr := errors.New("stream closed")
+	calls := 0
+	sq := &SearchQuery{Query: reqInfoQ, ExportFormat: "ndjson", FParams: bucketFilter(reqInfoQ, bucket)}
+	err := c.StreamSearch(ctx, sq, func(row *StreamRow) error {
+		calls++
+		return sendErr
+	})
+	if err != sendErr || calls != 1 {
+		t.Errorf("got %v after %d calls, expected %v after 1 call", err, calls, sendErr)
+	}
+}
@@ -0,0 +1,60 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+// joinedTables joins each request_info record to the audit_log_events record
+// of the same request. Both are inserted from the same event, so they have
+// the same time, which lets Postgres join matching partitions only.
+const joinedTables QTemplate = `%[1]s
+                        JOIN %[2]s
+                          ON %[2]s.event_time = %[1]s.time
+                         AND %[2]s.log->>'requestID' = %[1]s.request_id`
+
+// joinedTables returns the FROM item of joinedQ queries on the tables of the
+// client.
+func (c *DBClient) joinedTables() string {
+	return joinedTables.build(c.reqInfoTable().Name, c.logEventsTable().Name)
+}
+
+// JoinedRow holds a structured log record along with the raw log of the same
+// request.
+type JoinedRow struct {
+	ReqInfoRow
+	Log map[string]interface{} `json:"log"`
+}
+
+// joinedRowOmitEmpty is a JoinedRow encoded with its empty fields left out.
+type joinedRowOmitEmpty struct {
+	reqInfoRowOmitEmpty
+	Log map[string]interface{} `json:"log,omitempty"`
+}
+
+type joinedRawRow struct {
+	ReqInfoRow
+	Log string
+}
+
+// joinedCSVRow is a joinedQ record as scanned for CSV output.
+type joinedCSVRow struct {
+	reqInfoCSVRow
+	Log string
+}
+
+var (
+	joinedCSVHeader      = append(append([]string{}, reqInfoCSVHeader...), "log")
+	joinedParquetColumns = append(append([]parquetColumn{}, reqInfoParquetColumns...), parquetColumn{Name: "log", Type: parquetJSON})
+)
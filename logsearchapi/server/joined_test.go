@@ -0,0 +1,106 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestJoinedSearchQueryFromRequest(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=joined&fp=bucket:photos&nf=response_status_code>=400&sort=api_name", nil)
+	sq, err := searchQueryFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sq.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if orderBy, err := sq.orderByClause(); err != nil || orderBy != "api_name ASC, time DESC" {
+		t.Errorf("got order by %q, %v", orderBy, err)
+	}
+
+	for _, query := range []string{
+		"q=joined&logContains=foo",
+		"q=joined&jp=api.name:PutObject",
+		"q=joined&intsAsStrings",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/query?"+query, nil)
+		if _, err := searchQueryFromRequest(r); err == nil {
+			t.Errorf("%s: expected an error", query)
+		}
+	}
+}
+
+func TestSearchJoined(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	now := time.Now()
+	insertTestEvent(t, c, now, bucket)
+	insertTestEvent(t, c, now.Add(time.Second), bucket)
+
+	sq := SearchQuery{
+		Query:    joinedQ,
+		PageSize: 10,
+		FParams:  bucketFilter(joinedQ, bucket),
+	}
+	var buf bytes.Buffer
+	if err := c.Search(context.Background(), &sq, &buf); err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	var rows []JoinedRow
+	if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(rows))
+	}
+	for _, row := range rows {
+		if row.Bucket != bucket || row.Log["requestID"] != row.RequestID {
+			t.Errorf("got a row of bucket %s with request ID %s and log %v", row.Bucket, row.RequestID, row.Log)
+		}
+	}
+
+	sq.ExportFormat = "csv"
+	buf.Reset()
+	if err := c.Search(context.Background(), &sq, &buf); err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || len(records[0]) != len(joinedCSVHeader) {
+		t.Errorf("expected a header and 2 records of %d fields, got %v", len(joinedCSVHeader), records)
+	}
+
+	sq.ExportFormat = "count"
+	buf.Reset()
+	if err := c.Search(context.Background(), &sq, &buf); err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if got := buf.String(); got != "{\"count\":2}\n" {
+		t.Errorf("got %q, expected a count of 2", got)
+	}
+}
@@ -0,0 +1,62 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"time"
+)
+
+// initLockKey is the key of the advisory lock serializing the initialization
+// of the tables by concurrently starting replicas.
+const initLockKey int64 = 0x6c6f677365617263 // "logsearc" in ASCII
+
+// advisoryUnlockTimeout bounds the release of an advisory lock, which must be
+// attempted even when the context of the locked operation is done.
+const advisoryUnlockTimeout = 5 * time.Second
+
+// withAdvisoryLock runs fn while holding the session-level Postgres advisory
+// lock with the given key, waiting for other sessions to release it first.
+// The lock is held by a dedicated connection, while fn may use any
+// connection of the pool. The lock is released whether fn succeeds or not.
+func (c *DBClient) withAdvisoryLock(ctx context.Context, key int64, fn func() error) (err error) {
+	conn, err := c.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, key); err != nil {
+		return fmt.Errorf("Error acquiring advisory lock: %v", err)
+	}
+	defer func() {
+		unlockCtx, cancel := context.WithTimeout(context.Background(), advisoryUnlockTimeout)
+		defer cancel()
+		if _, uerr := conn.ExecContext(unlockCtx, `SELECT pg_advisory_unlock($1)`, key); uerr != nil {
+			// The lock lives as long as the session, so discard the
+			// connection rather than return it to the pool.
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+			if err == nil {
+				err = fmt.Errorf("Error releasing advisory lock: %v", uerr)
+			}
+		}
+	}()
+
+	return fn()
+}
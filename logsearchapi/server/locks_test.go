@@ -0,0 +1,78 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWithAdvisoryLock(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	// The lock is exclusive: no two holders overlap.
+	var holders, maxHolders int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := c.withAdvisoryLock(ctx, initLockKey+1, func() error {
+				n := atomic.AddInt32(&holders, 1)
+				defer atomic.AddInt32(&holders, -1)
+				for {
+					m := atomic.LoadInt32(&maxHolders)
+					if n <= m || atomic.CompareAndSwapInt32(&maxHolders, m, n) {
+						break
+					}
+				}
+				time.Sleep(50 * time.Millisecond)
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if maxHolders != 1 {
+		t.Errorf("got %d concurrent lock holders, expected 1", maxHolders)
+	}
+}
+
+func TestConcurrentInitDBTables(t *testing.T) {
+	c := newTestDBClient(t)
+
+	// Clients of separate replicas do not share connections.
+	other := newTestDBClient(t)
+
+	var wg sync.WaitGroup
+	for _, client := range []*DBClient{c, other, c, other} {
+		wg.Add(1)
+		go func(client *DBClient) {
+			defer wg.Done()
+			if err := client.InitDBTables(context.Background()); err != nil {
+				t.Errorf("InitDBTables failed: %v", err)
+			}
+		}(client)
+	}
+	wg.Wait()
+}
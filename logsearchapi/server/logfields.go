@@ -0,0 +1,108 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// validateLogFields checks the LogFields of s: they are only supported for
+// CSV and TSV exports of rawQ searches, and each must be one of the
+// rawJSONPaths, given once.
+func (s *SearchQuery) validateLogFields() error {
+	if len(s.LogFields) == 0 {
+		return nil
+	}
+	if s.Query != rawQ {
+		return &ValidationError{Field: "LogFields", Msg: fmt.Sprintf("only supported for %s queries", rawQ)}
+	}
+	if s.ExportFormat != "csv" && s.ExportFormat != "tsv" {
+		return &ValidationError{Field: "LogFields", Msg: "only supported with the csv and tsv export formats"}
+	}
+	seen := make(map[string]bool, len(s.LogFields))
+	for _, path := range s.LogFields {
+		if !rawJSONPaths[path] {
+			return &ValidationError{Field: "LogFields", Msg: fmt.Sprintf("unknown log field %q", path)}
+		}
+		if seen[path] {
+			return &ValidationError{Field: "LogFields", Msg: fmt.Sprintf("duplicate log field %q", path)}
+		}
+		seen[path] = true
+	}
+	return nil
+}
+
+// rawCSVHeader returns the header of CSV and TSV exports of rawQ searches:
+// the event time followed by either the whole log or the LogFields of s.
+func (s *SearchQuery) rawCSVHeader() []string {
+	if len(s.LogFields) == 0 {
+		return []string{"event_time", "log"}
+	}
+	return append([]string{"event_time"}, s.LogFields...)
+}
+
+// rawCSVRecord returns the fields of the CSV record of the raw log event r,
+// matching rawCSVHeader.
+func (s *SearchQuery) rawCSVRecord(r logEventRawRow) ([]string, error) {
+	eventTime := s.outputTime(r.EventTime).Format(time.RFC3339Nano)
+	if len(s.LogFields) == 0 {
+		return []string{eventTime, r.Log}, nil
+	}
+	var v map[string]interface{}
+	if err := decodeJSONLog(r.Log, &v); err != nil {
+		return nil, err
+	}
+	record := make([]string, 0, 1+len(s.LogFields))
+	record = append(record, eventTime)
+	for _, path := range s.LogFields {
+		record = append(record, logFieldText(v, strings.Split(path, ".")))
+	}
+	return record, nil
+}
+
+// logFieldText returns, as text, the field of the decoded JSON object v at
+// the path of keys. Missing and null fields are empty, and objects and
+// arrays are given as JSON.
+func logFieldText(v map[string]interface{}, keys []string) string {
+	field, ok := v[keys[0]]
+	if !ok || field == nil {
+		return ""
+	}
+	if len(keys) > 1 {
+		obj, ok := field.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		return logFieldText(obj, keys[1:])
+	}
+	switch f := field.(type) {
+	case string:
+		return f
+	case json.Number:
+		return f.String()
+	case bool:
+		return fmt.Sprint(f)
+	}
+	b, err := json.Marshal(field)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
@@ -0,0 +1,125 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidateLogFields(t *testing.T) {
+	testCases := []struct {
+		sq    SearchQuery
+		valid bool
+	}{
+		{SearchQuery{Query: rawQ, ExportFormat: "csv", LogFields: []string{"api.name", "api.statusCode"}}, true},
+		{SearchQuery{Query: rawQ, ExportFormat: "tsv", LogFields: []string{"requestID"}}, true},
+		{SearchQuery{Query: rawQ, ExportFormat: "ndjson", LogFields: []string{"api.name"}}, false},
+		{SearchQuery{Query: reqInfoQ, ExportFormat: "csv", LogFields: []string{"api.name"}}, false},
+		{SearchQuery{Query: rawQ, ExportFormat: "csv", LogFields: []string{"requestHeader.Authorization"}}, false},
+		{SearchQuery{Query: rawQ, ExportFormat: "csv", LogFields: []string{"api.name", "api.name"}}, false},
+	}
+	for i, testCase := range testCases {
+		err := testCase.sq.validateLogFields()
+		if testCase.valid && err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+		}
+		var verr *ValidationError
+		if !testCase.valid && !errors.As(err, &verr) {
+			t.Errorf("case %d: expected a validation error, got %v", i, err)
+		}
+	}
+
+	if _, err := ParseSearchQuery(url.Values{"q": {"raw"}, "export": {"ndjson"}, "logFields": {"api.name"}}); err == nil {
+		t.Error("expected logFields to be rejected for ndjson exports")
+	}
+}
+
+func TestRawCSVRecord(t *testing.T) {
+	eventTime := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+	row := logEventRawRow{
+		EventTime: eventTime,
+		Log:       `{"requestID":"16C8A0F7","api":{"name":"GetObject","statusCode":200,"timeToResponse":"1000ns"}}`,
+	}
+
+	sq := SearchQuery{Query: rawQ, ExportFormat: "csv", DisplayTimeZone: "UTC"}
+	if got := sq.rawCSVHeader(); !reflect.DeepEqual(got, []string{"event_time", "log"}) {
+		t.Errorf("got header %v", got)
+	}
+	record, err := sq.rawCSVRecord(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"2022-01-01T10:00:00Z", row.Log}; !reflect.DeepEqual(record, want) {
+		t.Errorf("got %v, want %v", record, want)
+	}
+
+	// The missing bucket is left empty.
+	sq.LogFields = []string{"requestID", "api.statusCode", "api.bucket", "api.name"}
+	if got, want := sq.rawCSVHeader(), []string{"event_time", "requestID", "api.statusCode", "api.bucket", "api.name"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got header %v, want %v", got, want)
+	}
+	record, err = sq.rawCSVRecord(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"2022-01-01T10:00:00Z", "16C8A0F7", "200", "", "GetObject"}; !reflect.DeepEqual(record, want) {
+		t.Errorf("got %v, want %v", record, want)
+	}
+
+	if _, err := sq.rawCSVRecord(logEventRawRow{EventTime: eventTime, Log: "{"}); err == nil {
+		t.Error("expected an error decoding an invalid log")
+	}
+}
+
+func TestSearchLogFields(t *testing.T) {
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	ev := newTestEvent(time.Now(), bucket)
+	insertTestEventMap(t, c, ev)
+
+	sq := SearchQuery{
+		Query:        rawQ,
+		ExportFormat: "csv",
+		FParams:      bucketFilter(rawQ, bucket),
+		LogFields:    []string{"api.bucket", "api.statusCode", "userAgent"},
+	}
+	var buf bytes.Buffer
+	if err := c.Search(context.Background(), &sq, &buf); err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected a header and a record, got %v", records)
+	}
+	if want := []string{"event_time", "api.bucket", "api.statusCode", "userAgent"}; !reflect.DeepEqual(records[0], want) {
+		t.Errorf("got header %v, want %v", records[0], want)
+	}
+	if got, want := records[1][1:], []string{bucket, "200", ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
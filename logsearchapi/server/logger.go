@@ -0,0 +1,68 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import "log"
+
+// Logger receives the log messages of a DBClient, at a level, e.g. to
+// forward them to zap or logrus, whose sugared loggers implement it. Its
+// methods take a format and arguments like fmt.Printf, and must be safe for
+// concurrent use.
+type Logger interface {
+	// Debugf logs messages of interest when troubleshooting, e.g. that a
+	// background worker exits.
+	Debugf(format string, args ...interface{})
+	// Infof logs the normal operations, e.g. partitions being created.
+	Infof(format string, args ...interface{})
+	// Warnf logs unexpected conditions that the client recovers from.
+	Warnf(format string, args ...interface{})
+	// Errorf logs failures, e.g. audit events that could not be saved.
+	Errorf(format string, args ...interface{})
+}
+
+// StdLogger logs the messages of all the levels with the standard logger of
+// the log package, without their level. It is used when DBClient.Logger is
+// nil.
+type StdLogger struct{}
+
+// Debugf implements Logger.
+func (StdLogger) Debugf(format string, args ...interface{}) { log.Printf(format, args...) }
+
+// Infof implements Logger.
+func (StdLogger) Infof(format string, args ...interface{}) { log.Printf(format, args...) }
+
+// Warnf implements Logger.
+func (StdLogger) Warnf(format string, args ...interface{}) { log.Printf(format, args...) }
+
+// Errorf implements Logger.
+func (StdLogger) Errorf(format string, args ...interface{}) { log.Printf(format, args...) }
+
+// WithLogger has the client log its messages with l instead of the standard
+// logger, from NewDBClient on.
+func WithLogger(l Logger) DBClientOption {
+	return func(c *DBClient) {
+		c.Logger = l
+	}
+}
+
+// logger returns the Logger of the client.
+func (c *DBClient) logger() Logger {
+	if c.Logger == nil {
+		return StdLogger{}
+	}
+	return c.Logger
+}
@@ -0,0 +1,107 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/georgysavva/scany/sqlscan"
+)
+
+// GetByRequestID writes the request_info records of the request with the
+// given ID matching s to w, as a JSON array ordered by time. Unlike searches,
+// no time range is needed: the lookup relies on the request_id index of each
+// partition (see reqInfoIndices). An empty array is written when
+// there is no such request. The base filter of the client and the filters of
+// s, in particular its AllowedBuckets, apply as for searches, and the
+// columns redacted by s or by the client are redacted.
+func (c *DBClient) GetByRequestID(ctx context.Context, s *SearchQuery, requestID string, w io.Writer) error {
+	const lookupQuery QTemplate = `SELECT %stime,
+                                              api_name,
+                                              access_key,
+                                              bucket,
+                                              object,
+                                              time_to_response_ns,
+                                              remote_host,
+                                              request_id,
+                                              user_agent,
+                                              response_status,
+                                              response_status_code,
+                                              request_content_length,
+                                              response_content_length,
+                                              version
+                                         FROM %s
+                                       %s
+                                     ORDER BY %s;`
+
+	if requestID == "" {
+		return invalidQueryErrorf("A request ID is required")
+	}
+	s = c.redactSearch(s)
+	if err := s.validateRedactColumns(); err != nil {
+		return err
+	}
+	if err := c.checkOpen(); err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Search)
+	defer cancel()
+
+	whereClause, sqlArgs, dollarStart, err := c.reqInfoWhereClause(s, 1)
+	if err != nil {
+		return err
+	}
+	requestIDClause := fmt.Sprintf("request_id = $%d", dollarStart)
+	if whereClause == "" {
+		whereClause = "WHERE " + requestIDClause
+	} else {
+		whereClause += " AND " + requestIDClause
+	}
+	sqlArgs = append(sqlArgs, requestID)
+
+	idColumn, orderBy := "", "time"
+	if c.RequestInfoID {
+		idColumn, orderBy = "COALESCE(id, 0) AS id, ", "time, id"
+	}
+	q := lookupQuery.build(idColumn, c.reqInfoTable().Name, whereClause, orderBy)
+	rows, err := c.reader().QueryContext(ctx, q, sqlArgs...)
+	if err != nil {
+		return &QueryError{Op: "querying", Err: err}
+	}
+	defer rows.Close()
+
+	aw := &jsonArrayWriter{w: w}
+	for rows.Next() {
+		var reqInfo ReqInfoRow
+		if err := sqlscan.ScanRow(&reqInfo, rows); err != nil {
+			return &QueryError{Op: "accessing", Err: err}
+		}
+		if err := s.redact(&reqInfo); err != nil {
+			return err
+		}
+		if err := aw.Write(reqInfo); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return &QueryError{Op: "accessing", Err: err}
+	}
+	return aw.Close()
+}
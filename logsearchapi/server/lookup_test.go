@@ -0,0 +1,84 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGetByRequestID(t *testing.T) {
+	if err := (&DBClient{}).GetByRequestID(context.Background(), &SearchQuery{Query: reqInfoQ}, "", &bytes.Buffer{}); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got %v, expected an invalid query error for an empty request ID", err)
+	}
+
+	c := newTestDBClient(t)
+
+	bucket := testBucketName()
+	event := newTestEvent(time.Now(), bucket)
+	insertTestEventMap(t, c, event)
+	insertTestEvent(t, c, time.Now(), bucket)
+
+	sq := SearchQuery{Query: reqInfoQ}
+	var buf bytes.Buffer
+	if err := c.GetByRequestID(context.Background(), &sq, event["requestID"].(string), &buf); err != nil {
+		t.Fatal(err)
+	}
+	var rows []ReqInfoRow
+	if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].RequestID != event["requestID"] || rows[0].Bucket != bucket {
+		t.Errorf("got %+v, expected the record of request %s", rows, event["requestID"])
+	}
+
+	buf.Reset()
+	if err := c.GetByRequestID(context.Background(), &sq, "no-such-request", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "[]" {
+		t.Errorf("got %q, expected an empty array", got)
+	}
+
+	// The request is not found outside of the allowed buckets.
+	sq.AllowedBuckets = []string{testBucketName()}
+	buf.Reset()
+	if err := c.GetByRequestID(context.Background(), &sq, event["requestID"].(string), &buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "[]" {
+		t.Errorf("got %q, expected an empty array outside of the allowed buckets", got)
+	}
+	// The columns redacted by the client are redacted.
+	c.RedactColumns = []string{"access_key"}
+	sq = SearchQuery{Query: reqInfoQ}
+	buf.Reset()
+	if err := c.GetByRequestID(context.Background(), &sq, event["requestID"].(string), &buf); err != nil {
+		t.Fatal(err)
+	}
+	rows = nil
+	if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].AccessKey != RedactedValue || rows[0].Bucket != bucket {
+		t.Errorf("got %+v, expected the record with a redacted access key", rows)
+	}
+}
@@ -0,0 +1,56 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import "time"
+
+// Metrics receives measurements of the DB operations of a DBClient, e.g. to
+// export them to Prometheus. Its methods are called synchronously from the
+// operations, so they must be fast and safe for concurrent use.
+type Metrics interface {
+	// ObserveInsert is called after every InsertEvent call, with its
+	// duration (including retries) and error, if any.
+	ObserveInsert(d time.Duration, err error)
+	// ObserveSearch is called after every search, with the query type
+	// (e.g. "raw" or "reqinfo"), its duration, the number of records
+	// written and its error, if any.
+	ObserveSearch(queryType string, d time.Duration, rows int64, err error)
+	// PartitionCreated is called after the missing partition of the table
+	// is created by the partition maintainer or EnsurePartitionsForRange.
+	PartitionCreated(table, partition string)
+}
+
+// NopMetrics discards all measurements. It is used when DBClient.Metrics is
+// nil.
+type NopMetrics struct{}
+
+// ObserveInsert implements Metrics.
+func (NopMetrics) ObserveInsert(time.Duration, error) {}
+
+// ObserveSearch implements Metrics.
+func (NopMetrics) ObserveSearch(string, time.Duration, int64, error) {}
+
+// PartitionCreated implements Metrics.
+func (NopMetrics) PartitionCreated(string, string) {}
+
+// metrics returns the Metrics of the client.
+func (c *DBClient) metrics() Metrics {
+	if c.Metrics == nil {
+		return NopMetrics{}
+	}
+	return c.Metrics
+}
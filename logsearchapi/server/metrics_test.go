@@ -0,0 +1,105 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingMetrics struct {
+	mu         sync.Mutex
+	inserts    []error
+	searches   []string
+	searchErrs []error
+	partitions []string
+}
+
+func (m *recordingMetrics) ObserveInsert(d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inserts = append(m.inserts, err)
+}
+
+func (m *recordingMetrics) ObserveSearch(queryType string, d time.Duration, rows int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.searches = append(m.searches, queryType)
+	m.searchErrs = append(m.searchErrs, err)
+}
+
+func (m *recordingMetrics) PartitionCreated(table, partition string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.partitions = append(m.partitions, partition)
+}
+
+func TestMetrics(t *testing.T) {
+	if _, ok := (&DBClient{}).metrics().(NopMetrics); !ok {
+		t.Errorf("expected NopMetrics when Metrics is unset")
+	}
+
+	m := &recordingMetrics{}
+	c := &DBClient{Metrics: m}
+
+	if err := c.InsertEvent(context.Background(), []byte(`not json`)); err == nil {
+		t.Fatal("expected an error inserting an invalid event")
+	}
+	if len(m.inserts) != 1 || m.inserts[0] == nil {
+		t.Errorf("expected a failed insert to be observed, got %v", m.inserts)
+	}
+
+	sq := &SearchQuery{Query: reqInfoQ, SortBy: []SortField{{Column: "log"}}}
+	err := c.Search(context.Background(), sq, ioutil.Discard)
+	if !errors.Is(err, ErrInvalidQuery) {
+		t.Fatalf("got %v, expected an invalid query error", err)
+	}
+	if len(m.searches) != 1 || m.searches[0] != "reqinfo" || m.searchErrs[0] != err {
+		t.Errorf("expected the failed search to be observed, got %v %v", m.searches, m.searchErrs)
+	}
+}
+
+func TestMetricsPartitionCreated(t *testing.T) {
+	c := newTestDBClient(t)
+	c.PartitionInterval = PartitionMonthly
+	m := &recordingMetrics{}
+	c.Metrics = m
+	ctx := context.Background()
+
+	// A range far in the past, that no other test uses.
+	start := time.Date(1999, time.June, 1, 0, 0, 0, 0, time.UTC)
+	partition := requestInfoTable.getPartitionName(newPartitionTimeRange(start, c.PartitionInterval))
+	dropPartition := func() {
+		if _, err := c.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s;", partition)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dropPartition()
+	defer dropPartition()
+
+	if err := c.EnsurePartitionsForRange(ctx, requestInfoTable, start, start.AddDate(0, 1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.partitions) != 1 || m.partitions[0] != partition {
+		t.Errorf("got created partitions %v, expected %s", m.partitions, partition)
+	}
+}
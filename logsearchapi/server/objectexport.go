@@ -0,0 +1,60 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ExportToObject runs the search s like Search, but streams its output to
+// putFn instead of a writer, e.g. to upload the export of a scheduled job to
+// an object store with a multipart upload of unknown size, such as the
+// PutObject of minio-go with a size of -1. The output is piped to putFn
+// while the search runs, so it is not buffered in full.
+//
+// When the search fails, reading from the reader of putFn returns the error
+// of the search, which putFn must return without completing the upload. When
+// putFn fails, the search is canceled and an *UploadError is returned.
+func (c *DBClient) ExportToObject(ctx context.Context, s *SearchQuery, putFn func(io.Reader) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	putErrs := make(chan error, 1)
+	go func() {
+		err := putFn(pr)
+		if err != nil {
+			// Fail the writes of the search, which may not
+			// notice the cancellation while writing.
+			pr.CloseWithError(err)
+			cancel()
+		} else {
+			pr.CloseWithError(io.ErrClosedPipe)
+		}
+		putErrs <- err
+	}()
+
+	searchErr := c.Search(ctx, s, pw)
+	pw.CloseWithError(searchErr)
+	putErr := <-putErrs
+	if putErr != nil && (searchErr == nil || !errors.Is(putErr, searchErr)) {
+		return &UploadError{Err: putErr}
+	}
+	return searchErr
+}
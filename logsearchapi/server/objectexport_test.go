@@ -0,0 +1,108 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// memoryPutter uploads objects to memory, failing after failAfter bytes if
+// it is positive.
+type memoryPutter struct {
+	failAfter int64
+	object    bytes.Buffer
+	completed bool
+}
+
+var errUploadFailed = errors.New("upload failed")
+
+func (p *memoryPutter) put(r io.Reader) error {
+	if p.failAfter > 0 {
+		if _, err := io.CopyN(&p.object, r, p.failAfter); err != nil {
+			return err
+		}
+		return errUploadFailed
+	}
+	if _, err := io.Copy(&p.object, r); err != nil {
+		return err
+	}
+	p.completed = true
+	return nil
+}
+
+func TestExportToObjectSearchError(t *testing.T) {
+	c := &DBClient{}
+
+	// The upload is aborted with the error of the search.
+	var p memoryPutter
+	err := c.ExportToObject(context.Background(), &SearchQuery{Query: "bogus"}, p.put)
+	if !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got %v, expected an invalid query error", err)
+	}
+	var uploadErr *UploadError
+	if errors.As(err, &uploadErr) {
+		t.Errorf("got upload error %v for a failed search", err)
+	}
+	if p.completed {
+		t.Errorf("upload completed for a failed search")
+	}
+}
+
+func TestExportToObject(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	start := time.Now().Add(-time.Minute)
+	for i := 0; i < 100; i++ {
+		insertTestEvent(t, c, start.Add(time.Duration(i)*time.Millisecond), bucket)
+	}
+	end := start.Add(time.Second)
+	sq := SearchQuery{
+		Query:         reqInfoQ,
+		TimeStart:     &start,
+		TimeEnd:       &end,
+		TimeAscending: true,
+		FParams:       bucketFilter(reqInfoQ, bucket),
+		ExportFormat:  "csv",
+	}
+
+	var expected bytes.Buffer
+	if err := c.Search(ctx, &sq, &expected); err != nil {
+		t.Fatal(err)
+	}
+	var p memoryPutter
+	if err := c.ExportToObject(ctx, &sq, p.put); err != nil {
+		t.Fatal(err)
+	}
+	if !p.completed || !bytes.Equal(p.object.Bytes(), expected.Bytes()) {
+		t.Errorf("got object %q, expected %q", p.object.String(), expected.String())
+	}
+
+	// A failed upload stops the search.
+	p = memoryPutter{failAfter: 10}
+	err := c.ExportToObject(ctx, &sq, p.put)
+	var uploadErr *UploadError
+	if !errors.As(err, &uploadErr) || !errors.Is(err, errUploadFailed) {
+		t.Errorf("got %v, expected an upload error", err)
+	}
+}
@@ -0,0 +1,505 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// This file implements a minimal Parquet writer supporting flat schemas of
+// the column types needed for exporting search results. Values are PLAIN
+// encoded without compression, with one data page per column chunk.
+
+// parquetRowGroupSize is the number of rows buffered in memory before they
+// are written out as a row group.
+const parquetRowGroupSize = 10000
+
+// parquetColumnType is the type of a parquet column, as output by the
+// writer. It determines the Go type of the values of the column.
+type parquetColumnType int
+
+const (
+	// parquetString columns hold string values.
+	parquetString parquetColumnType = iota
+	// parquetJSON columns hold string values of JSON documents.
+	parquetJSON
+	// parquetInt64 columns hold int64 or int values.
+	parquetInt64
+	// parquetUint64 columns hold uint64 values.
+	parquetUint64
+	// parquetTimestamp columns hold time.Time values, stored with
+	// microsecond precision.
+	parquetTimestamp
+)
+
+// Parquet physical types, converted types, encodings and other enum values,
+// as defined in parquet.thrift.
+const (
+	parquetTypeInt64     = 2
+	parquetTypeByteArray = 6
+
+	parquetConvertedUTF8            = 0
+	parquetConvertedTimestampMicros = 10
+	parquetConvertedUint64          = 14
+	parquetConvertedJSON            = 19
+
+	parquetRepetitionRequired = 0
+	parquetRepetitionOptional = 1
+
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+
+	parquetCodecUncompressed = 0
+	parquetPageTypeData      = 0
+)
+
+var parquetMagic = []byte("PAR1")
+
+// parquetColumn describes a column of a parquet file.
+type parquetColumn struct {
+	Name string
+	Type parquetColumnType
+	// Optional columns may hold nil values.
+	Optional bool
+}
+
+func (pc parquetColumn) physicalType() int32 {
+	switch pc.Type {
+	case parquetString, parquetJSON:
+		return parquetTypeByteArray
+	default:
+		return parquetTypeInt64
+	}
+}
+
+func (pc parquetColumn) convertedType() (int32, bool) {
+	switch pc.Type {
+	case parquetString:
+		return parquetConvertedUTF8, true
+	case parquetJSON:
+		return parquetConvertedJSON, true
+	case parquetUint64:
+		return parquetConvertedUint64, true
+	case parquetTimestamp:
+		return parquetConvertedTimestampMicros, true
+	default:
+		return 0, false
+	}
+}
+
+// parquetColumnBuffer holds the values of a column of the row group being
+// written.
+type parquetColumnBuffer struct {
+	// present holds whether each value is not nil. It is used only for
+	// optional columns.
+	present []bool
+	// values holds the PLAIN encoded non-nil values.
+	values bytes.Buffer
+}
+
+// parquetColumnChunk is the metadata of a column chunk written out.
+type parquetColumnChunk struct {
+	offset    int64
+	size      int64
+	numValues int64
+}
+
+// parquetRowGroup is the metadata of a row group written out.
+type parquetRowGroup struct {
+	chunks  []parquetColumnChunk
+	numRows int64
+}
+
+// parquetWriter writes rows to an io.Writer in the Parquet format. Rows are
+// buffered and written out in row groups; Close must be called to write out
+// the remaining rows and the file footer.
+type parquetWriter struct {
+	w       io.Writer
+	offset  int64
+	columns []parquetColumn
+
+	buffers   []parquetColumnBuffer
+	numRows   int64
+	rowGroups []parquetRowGroup
+	closed    bool
+}
+
+func newParquetWriter(w io.Writer, columns []parquetColumn) (*parquetWriter, error) {
+	pw := &parquetWriter{
+		w:       w,
+		columns: columns,
+		buffers: make([]parquetColumnBuffer, len(columns)),
+	}
+	if err := pw.write(parquetMagic); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+func (pw *parquetWriter) write(p []byte) error {
+	n, err := pw.w.Write(p)
+	pw.offset += int64(n)
+	return err
+}
+
+// Write buffers a row, holding a value for each column, and writes out a
+// row group when enough rows are buffered.
+func (pw *parquetWriter) Write(row []interface{}) error {
+	if len(row) != len(pw.columns) {
+		return fmt.Errorf("parquet: got %d values for %d columns", len(row), len(pw.columns))
+	}
+	for i, v := range row {
+		if err := pw.appendValue(i, v); err != nil {
+			return err
+		}
+	}
+	pw.numRows++
+	if pw.numRows >= parquetRowGroupSize {
+		return pw.flushRowGroup()
+	}
+	return nil
+}
+
+func (pw *parquetWriter) appendValue(i int, v interface{}) error {
+	col, buf := pw.columns[i], &pw.buffers[i]
+	if v == nil {
+		if !col.Optional {
+			return fmt.Errorf("parquet: nil value for required column %s", col.Name)
+		}
+		buf.present = append(buf.present, false)
+		return nil
+	}
+	if col.Optional {
+		buf.present = append(buf.present, true)
+	}
+
+	var b [8]byte
+	switch x := v.(type) {
+	case string:
+		if col.physicalType() != parquetTypeByteArray {
+			break
+		}
+		binary.LittleEndian.PutUint32(b[:4], uint32(len(x)))
+		buf.values.Write(b[:4])
+		buf.values.WriteString(x)
+		return nil
+	case int:
+		if col.Type != parquetInt64 {
+			break
+		}
+		binary.LittleEndian.PutUint64(b[:], uint64(x))
+		buf.values.Write(b[:])
+		return nil
+	case int64:
+		if col.Type != parquetInt64 {
+			break
+		}
+		binary.LittleEndian.PutUint64(b[:], uint64(x))
+		buf.values.Write(b[:])
+		return nil
+	case uint64:
+		if col.Type != parquetUint64 {
+			break
+		}
+		binary.LittleEndian.PutUint64(b[:], x)
+		buf.values.Write(b[:])
+		return nil
+	case time.Time:
+		if col.Type != parquetTimestamp {
+			break
+		}
+		binary.LittleEndian.PutUint64(b[:], uint64(x.UnixMicro()))
+		buf.values.Write(b[:])
+		return nil
+	}
+	return fmt.Errorf("parquet: invalid value of type %T for column %s", v, col.Name)
+}
+
+// flushRowGroup writes out the buffered rows as a row group.
+func (pw *parquetWriter) flushRowGroup() error {
+	if pw.numRows == 0 {
+		return nil
+	}
+
+	rg := parquetRowGroup{numRows: pw.numRows}
+	for i, col := range pw.columns {
+		buf := &pw.buffers[i]
+
+		var page bytes.Buffer
+		if col.Optional {
+			// Definition levels, preceded by their length.
+			levels := encodeParquetBitPackedLevels(buf.present)
+			var b [4]byte
+			binary.LittleEndian.PutUint32(b[:], uint32(len(levels)))
+			page.Write(b[:])
+			page.Write(levels)
+		}
+		page.Write(buf.values.Bytes())
+
+		var header thriftCompactWriter
+		header.writeI32Field(1, parquetPageTypeData)
+		header.writeI32Field(2, int32(page.Len()))
+		header.writeI32Field(3, int32(page.Len()))
+		header.beginStructField(5)
+		header.writeI32Field(1, int32(pw.numRows))
+		header.writeI32Field(2, parquetEncodingPlain)
+		header.writeI32Field(3, parquetEncodingRLE)
+		header.writeI32Field(4, parquetEncodingRLE)
+		header.endStruct()
+		header.endStruct()
+
+		chunk := parquetColumnChunk{offset: pw.offset, numValues: pw.numRows}
+		if err := pw.write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := pw.write(page.Bytes()); err != nil {
+			return err
+		}
+		chunk.size = pw.offset - chunk.offset
+		rg.chunks = append(rg.chunks, chunk)
+
+		buf.present = buf.present[:0]
+		buf.values.Reset()
+	}
+	pw.rowGroups = append(pw.rowGroups, rg)
+	pw.numRows = 0
+	return nil
+}
+
+// Close writes out the buffered rows and the file footer. It does not close
+// the underlying io.Writer. Calling Close more than once has no effect.
+func (pw *parquetWriter) Close() error {
+	if pw.closed {
+		return nil
+	}
+	pw.closed = true
+
+	if err := pw.flushRowGroup(); err != nil {
+		return err
+	}
+
+	var totalRows int64
+	for _, rg := range pw.rowGroups {
+		totalRows += rg.numRows
+	}
+
+	// FileMetaData
+	var meta thriftCompactWriter
+	meta.writeI32Field(1, 1)
+	meta.beginListField(2, thriftTypeStruct, len(pw.columns)+1)
+	meta.beginStruct()
+	meta.writeStringField(4, "schema")
+	meta.writeI32Field(5, int32(len(pw.columns)))
+	meta.endStruct()
+	for _, col := range pw.columns {
+		meta.beginStruct()
+		meta.writeI32Field(1, col.physicalType())
+		repetition := int32(parquetRepetitionRequired)
+		if col.Optional {
+			repetition = parquetRepetitionOptional
+		}
+		meta.writeI32Field(3, repetition)
+		meta.writeStringField(4, col.Name)
+		if ct, ok := col.convertedType(); ok {
+			meta.writeI32Field(6, ct)
+		}
+		meta.endStruct()
+	}
+	meta.writeI64Field(3, totalRows)
+	meta.beginListField(4, thriftTypeStruct, len(pw.rowGroups))
+	for _, rg := range pw.rowGroups {
+		var totalSize int64
+		for _, chunk := range rg.chunks {
+			totalSize += chunk.size
+		}
+		meta.beginStruct()
+		meta.beginListField(1, thriftTypeStruct, len(rg.chunks))
+		for i, chunk := range rg.chunks {
+			col := pw.columns[i]
+			encodings := []int32{parquetEncodingPlain}
+			if col.Optional {
+				encodings = append(encodings, parquetEncodingRLE)
+			}
+
+			// ColumnChunk
+			meta.beginStruct()
+			meta.writeI64Field(2, chunk.offset)
+			// ColumnMetaData
+			meta.beginStructField(3)
+			meta.writeI32Field(1, col.physicalType())
+			meta.beginListField(2, thriftTypeI32, len(encodings))
+			for _, e := range encodings {
+				meta.writeI32(e)
+			}
+			meta.beginListField(3, thriftTypeBinary, 1)
+			meta.writeString(col.Name)
+			meta.writeI32Field(4, parquetCodecUncompressed)
+			meta.writeI64Field(5, chunk.numValues)
+			meta.writeI64Field(6, chunk.size)
+			meta.writeI64Field(7, chunk.size)
+			meta.writeI64Field(9, chunk.offset)
+			meta.endStruct()
+			meta.endStruct()
+		}
+		meta.writeI64Field(2, totalSize)
+		meta.writeI64Field(3, rg.numRows)
+		meta.endStruct()
+	}
+	meta.writeStringField(6, "MinIO logsearchapi")
+	meta.endStruct()
+
+	if err := pw.write(meta.buf.Bytes()); err != nil {
+		return err
+	}
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(meta.buf.Len()))
+	if err := pw.write(b[:]); err != nil {
+		return err
+	}
+	return pw.write(parquetMagic)
+}
+
+// writeParquet writes the rows written by writeRows to w as a parquet file
+// with the given columns. The file footer is written even when writeRows
+// fails, so that the rows written before the failure are readable.
+func writeParquet(w io.Writer, columns []parquetColumn, writeRows func(*parquetWriter) error) error {
+	pw, err := newParquetWriter(w, columns)
+	if err != nil {
+		return &StreamWriteError{Err: err}
+	}
+	err = writeRows(pw)
+	if cerr := pw.Close(); cerr != nil && err == nil {
+		err = &StreamWriteError{Err: cerr}
+	}
+	return err
+}
+
+// encodeParquetBitPackedLevels encodes definition levels with a maximum of 1
+// using the RLE/bit-packing hybrid encoding, as a single bit-packed run.
+func encodeParquetBitPackedLevels(present []bool) []byte {
+	groups := (len(present) + 7) / 8
+	var header [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], uint64(groups)<<1|1)
+
+	out := make([]byte, n+groups)
+	copy(out, header[:n])
+	for i, p := range present {
+		if p {
+			out[n+i/8] |= 1 << (i % 8)
+		}
+	}
+	return out
+}
+
+// Thrift compact protocol types.
+const (
+	thriftTypeI32    = 5
+	thriftTypeI64    = 6
+	thriftTypeBinary = 8
+	thriftTypeList   = 9
+	thriftTypeStruct = 12
+)
+
+// thriftCompactWriter encodes thrift structs using the compact protocol, as
+// needed for the parquet metadata. The outermost struct is implicitly begun.
+type thriftCompactWriter struct {
+	buf bytes.Buffer
+	// lastField holds the last field id written in each enclosing struct.
+	lastField []int16
+	cur       int16
+}
+
+func (t *thriftCompactWriter) fieldHeader(id int16, typ byte) {
+	if delta := id - t.cur; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.writeVarint(int64(id))
+	}
+	t.cur = id
+}
+
+func (t *thriftCompactWriter) writeVarint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], v)
+	t.buf.Write(b[:n])
+}
+
+func (t *thriftCompactWriter) writeI32(v int32) {
+	t.writeVarint(int64(v))
+}
+
+func (t *thriftCompactWriter) writeString(s string) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], uint64(len(s)))
+	t.buf.Write(b[:n])
+	t.buf.WriteString(s)
+}
+
+func (t *thriftCompactWriter) writeI32Field(id int16, v int32) {
+	t.fieldHeader(id, thriftTypeI32)
+	t.writeI32(v)
+}
+
+func (t *thriftCompactWriter) writeI64Field(id int16, v int64) {
+	t.fieldHeader(id, thriftTypeI64)
+	t.writeVarint(v)
+}
+
+func (t *thriftCompactWriter) writeStringField(id int16, s string) {
+	t.fieldHeader(id, thriftTypeBinary)
+	t.writeString(s)
+}
+
+// beginListField begins a list field, whose n elements must be written
+// next.
+func (t *thriftCompactWriter) beginListField(id int16, elemType byte, n int) {
+	t.fieldHeader(id, thriftTypeList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | elemType)
+		return
+	}
+	t.buf.WriteByte(0xf0 | elemType)
+	var b [binary.MaxVarintLen64]byte
+	m := binary.PutUvarint(b[:], uint64(n))
+	t.buf.Write(b[:m])
+}
+
+// beginStruct begins a struct that is an element of a list.
+func (t *thriftCompactWriter) beginStruct() {
+	t.lastField = append(t.lastField, t.cur)
+	t.cur = 0
+}
+
+func (t *thriftCompactWriter) beginStructField(id int16) {
+	t.fieldHeader(id, thriftTypeStruct)
+	t.beginStruct()
+}
+
+// endStruct ends the current struct, which is the outermost one when no
+// struct was begun.
+func (t *thriftCompactWriter) endStruct() {
+	t.buf.WriteByte(0)
+	if n := len(t.lastField); n > 0 {
+		t.cur = t.lastField[n-1]
+		t.lastField = t.lastField[:n-1]
+	}
+}
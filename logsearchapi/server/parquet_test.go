@@ -0,0 +1,226 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// thriftCompactReader decodes thrift structs encoded with the compact
+// protocol into maps from field ids to values, for checking the parquet
+// metadata.
+type thriftCompactReader struct {
+	t   *testing.T
+	buf []byte
+	pos int
+}
+
+func (r *thriftCompactReader) byte() byte {
+	if r.pos >= len(r.buf) {
+		r.t.Fatalf("thrift: unexpected end of data")
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *thriftCompactReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		r.t.Fatalf("thrift: invalid varint at %d", r.pos)
+	}
+	r.pos += n
+	return v
+}
+
+func (r *thriftCompactReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftTypeI32, thriftTypeI64:
+		v, n := binary.Varint(r.buf[r.pos:])
+		if n <= 0 {
+			r.t.Fatalf("thrift: invalid varint at %d", r.pos)
+		}
+		r.pos += n
+		return v
+	case thriftTypeBinary:
+		n := int(r.uvarint())
+		s := string(r.buf[r.pos : r.pos+n])
+		r.pos += n
+		return s
+	case thriftTypeList:
+		h := r.byte()
+		n, elemType := int(h>>4), h&0x0f
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		l := make([]interface{}, n)
+		for i := range l {
+			l[i] = r.value(elemType)
+		}
+		return l
+	case thriftTypeStruct:
+		return r.readStruct()
+	}
+	r.t.Fatalf("thrift: unexpected type %d", typ)
+	return nil
+}
+
+func (r *thriftCompactReader) readStruct() map[int]interface{} {
+	m := make(map[int]interface{})
+	last := 0
+	for {
+		h := r.byte()
+		if h == 0 {
+			return m
+		}
+		id := last + int(h>>4)
+		if h>>4 == 0 {
+			v, n := binary.Varint(r.buf[r.pos:])
+			r.pos += n
+			id = int(v)
+		}
+		m[id] = r.value(h & 0x0f)
+		last = id
+	}
+}
+
+// readParquetFooter checks the framing of a parquet file and returns its
+// decoded FileMetaData.
+func readParquetFooter(t *testing.T, file []byte) map[int]interface{} {
+	t.Helper()
+
+	if !bytes.HasPrefix(file, parquetMagic) || !bytes.HasSuffix(file, parquetMagic) {
+		t.Fatalf("Missing parquet magic bytes")
+	}
+	footerLen := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	footerStart := len(file) - 8 - footerLen
+	r := &thriftCompactReader{t: t, buf: file[:len(file)-8], pos: footerStart}
+	meta := r.readStruct()
+	if r.pos != len(file)-8 {
+		t.Fatalf("Footer decoded up to %d, expected %d", r.pos, len(file)-8)
+	}
+	return meta
+}
+
+func TestParquetWriter(t *testing.T) {
+	columns := []parquetColumn{
+		{Name: "time", Type: parquetTimestamp},
+		{Name: "bucket", Type: parquetString},
+		{Name: "status_code", Type: parquetInt64},
+		{Name: "length", Type: parquetUint64, Optional: true},
+	}
+	ts := time.Date(2022, time.March, 7, 1, 2, 3, 4000, time.UTC)
+	numRows := parquetRowGroupSize + 5
+
+	var buf bytes.Buffer
+	err := writeParquet(&buf, columns, func(pw *parquetWriter) error {
+		for i := 0; i < numRows; i++ {
+			var length interface{}
+			if i%2 == 0 {
+				length = uint64(i)
+			}
+			if err := pw.Write([]interface{}{ts, "photos", 200, length}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := buf.Bytes()
+	meta := readParquetFooter(t, file)
+	if rows := meta[3].(int64); rows != int64(numRows) {
+		t.Errorf("Got %d rows, expected %d", rows, numRows)
+	}
+	schema := meta[2].([]interface{})
+	if len(schema) != len(columns)+1 {
+		t.Fatalf("Got %d schema elements, expected %d", len(schema), len(columns)+1)
+	}
+	for i, col := range columns {
+		if name := schema[i+1].(map[int]interface{})[4]; name != col.Name {
+			t.Errorf("Got column name %v, expected %s", name, col.Name)
+		}
+	}
+
+	rowGroups := meta[4].([]interface{})
+	if len(rowGroups) != 2 {
+		t.Fatalf("Got %d row groups, expected 2", len(rowGroups))
+	}
+	rg := rowGroups[1].(map[int]interface{})
+	if rows := rg[3].(int64); rows != 5 {
+		t.Errorf("Got %d rows in the last row group, expected 5", rows)
+	}
+
+	// Check the first column chunk of the last row group, holding 5
+	// timestamps.
+	chunk := rg[1].([]interface{})[0].(map[int]interface{})
+	chunkMeta := chunk[3].(map[int]interface{})
+	r := &thriftCompactReader{t: t, buf: file, pos: int(chunkMeta[9].(int64))}
+	pageHeader := r.readStruct()
+	pageSize := int(pageHeader[3].(int64))
+	if pageSize != 5*8 {
+		t.Fatalf("Got page size %d, expected %d", pageSize, 5*8)
+	}
+	for i := 0; i < 5; i++ {
+		micros := int64(binary.LittleEndian.Uint64(file[r.pos+8*i:]))
+		if !time.UnixMicro(micros).Equal(ts) {
+			t.Errorf("Got time %s, expected %s", time.UnixMicro(micros), ts)
+		}
+	}
+
+	// Invalid values are rejected.
+	for _, row := range [][]interface{}{
+		{ts, "photos", 200},
+		{ts, nil, 200, nil},
+		{ts, "photos", "200", nil},
+	} {
+		pw, err := newParquetWriter(&bytes.Buffer{}, columns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pw.Write(row); err == nil {
+			t.Errorf("Expected an error writing %v", row)
+		}
+	}
+}
+
+func TestWriteParquetFailure(t *testing.T) {
+	columns := []parquetColumn{{Name: "bucket", Type: parquetString}}
+
+	// The footer is written even if writing the rows fails.
+	var buf bytes.Buffer
+	failure := errors.New("scan failed")
+	err := writeParquet(&buf, columns, func(pw *parquetWriter) error {
+		if err := pw.Write([]interface{}{"photos"}); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("Got error %v, expected %v", err, failure)
+	}
+	meta := readParquetFooter(t, buf.Bytes())
+	if rows := meta[3].(int64); rows != 1 {
+		t.Errorf("Got %d rows, expected 1", rows)
+	}
+}
@@ -20,7 +20,8 @@ package server
 import (
 	"context"
 	"fmt"
-	"log"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/georgysavva/scany/sqlscan"
@@ -28,17 +29,79 @@ import (
 
 const (
 	createTablePartition QTemplate = `CREATE TABLE IF NOT EXISTS %s PARTITION OF %s
-                                            FOR VALUES FROM ('%s') TO ('%s');`
+                                            FOR VALUES FROM ('%s') TO ('%s')%s;`
 )
 
 const (
 	partitionsPerMonth = 4
 )
 
-func (t *Table) getCreatePartitionStatement(p partitionTimeRange) string {
-	partitionName := fmt.Sprintf("%s_%s", t.Name, p.getPartnameSuffix())
+// PartitionInterval specifies the span of time covered by each table
+// partition.
+type PartitionInterval int
+
+const (
+	// PartitionWeekly splits every month into partitionsPerMonth
+	// partitions. This is the default scheme.
+	PartitionWeekly PartitionInterval = iota
+	// PartitionDaily creates one partition per day. Suitable for high volume
+	// deployments.
+	PartitionDaily
+	// PartitionMonthly creates one partition per month. Suitable for low
+	// volume deployments.
+	PartitionMonthly
+)
+
+// ParsePartitionInterval parses the name of a partition interval.
+func ParsePartitionInterval(s string) (PartitionInterval, error) {
+	switch s {
+	case "weekly", "":
+		return PartitionWeekly, nil
+	case "daily":
+		return PartitionDaily, nil
+	case "monthly":
+		return PartitionMonthly, nil
+	}
+	return PartitionWeekly, fmt.Errorf("Unknown partition interval: %s (must be one of weekly, daily or monthly)", s)
+}
+
+func (i PartitionInterval) String() string {
+	switch i {
+	case PartitionDaily:
+		return "daily"
+	case PartitionMonthly:
+		return "monthly"
+	}
+	return "weekly"
+}
+
+// suffixLayout returns the time layout used for names of partitions created
+// with this interval. The layouts are distinct so that partitions created
+// under different intervals never share a name.
+func (i PartitionInterval) suffixLayout() string {
+	switch i {
+	case PartitionDaily:
+		return "d2006_01_02"
+	case PartitionMonthly:
+		return "m2006_01"
+	}
+	return "2006_01_02"
+}
+
+// Intervals are listed in the order their partition name layouts need to be
+// tried when parsing a partition name.
+var allPartitionIntervals = []PartitionInterval{PartitionDaily, PartitionMonthly, PartitionWeekly}
+
+func (t *Table) getPartitionName(p partitionTimeRange) string {
+	return fmt.Sprintf("%s_%s", t.Name, p.getPartnameSuffix())
+}
+
+// getCreatePartitionStatement returns the statement creating the partition
+// of the table for p, in the given tablespace, or the default one if it is
+// empty.
+func (t *Table) getCreatePartitionStatement(p partitionTimeRange, tablespace string) string {
 	start, end := p.getRangeArgs()
-	return createTablePartition.build(partitionName, t.Name, start, end)
+	return createTablePartition.build(t.getPartitionName(p), t.Name, start, end, tablespaceClause(tablespace))
 }
 
 // partitionTimeRange is created from a given time by `newPartitionTimeRange`.
@@ -47,11 +110,17 @@ func (t *Table) getCreatePartitionStatement(p partitionTimeRange) string {
 type partitionTimeRange struct {
 	GivenTime          time.Time
 	StartDate, EndDate time.Time
+	Interval           PartitionInterval
 }
 
-// newPartitionTimeRange computes the partitionTimeRange including the
-// givenTime. For a fixed value of partitionsPerMonth, the days in a month are
-// always partitioned in the same way regardless of the given time.
+// newPartitionTimeRange computes the partitionTimeRange of the given interval
+// including the givenTime. The ranges are aligned on calendar boundaries in
+// UTC, whatever the time zone of givenTime: they start at midnight, on the
+// first day of a month for PartitionMonthly, and they never span two months,
+// so that the range of any time within a range is that range. For
+// PartitionWeekly, the days in a month are always partitioned in the same way
+// regardless of the given time, rather than in weeks starting on a given
+// weekday, which would span two months.
 //
 // Using partitionsPerMonth = 4:
 //
@@ -60,40 +129,52 @@ type partitionTimeRange struct {
 // - the partitions for a 30 day month have number of days: [8,8,7,7]
 //
 // - the partitions for a 31 day month have number of days: [8,8,8,7]
-func newPartitionTimeRange(givenTime time.Time) partitionTimeRange {
+func newPartitionTimeRange(givenTime time.Time, interval PartitionInterval) partitionTimeRange {
 	// Convert to UTC and zero out the time.
 	t := givenTime.In(time.UTC)
 	t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
 
-	// Find the number of days in the month.
-	lastDateOfMonth := t.AddDate(0, 1, -t.Day())
-	daysInMonth := lastDateOfMonth.Day()
-
-	quot := daysInMonth / partitionsPerMonth
-	remDays := daysInMonth % partitionsPerMonth
-	rangeStart := t.AddDate(0, 0, 1-t.Day())
-	var rangeEnd time.Time
-	for {
-		rangeDays := quot
-		if remDays > 0 {
-			rangeDays++
-			remDays--
-		}
-		rangeEnd = rangeStart.AddDate(0, 0, rangeDays)
-		if t.Before(rangeEnd) {
-			break
+	var rangeStart, rangeEnd time.Time
+	switch interval {
+	case PartitionDaily:
+		rangeStart = t
+		rangeEnd = t.AddDate(0, 0, 1)
+
+	case PartitionMonthly:
+		rangeStart = t.AddDate(0, 0, 1-t.Day())
+		rangeEnd = rangeStart.AddDate(0, 1, 0)
+
+	default:
+		// Find the number of days in the month.
+		lastDateOfMonth := t.AddDate(0, 1, -t.Day())
+		daysInMonth := lastDateOfMonth.Day()
+
+		quot := daysInMonth / partitionsPerMonth
+		remDays := daysInMonth % partitionsPerMonth
+		rangeStart = t.AddDate(0, 0, 1-t.Day())
+		for {
+			rangeDays := quot
+			if remDays > 0 {
+				rangeDays++
+				remDays--
+			}
+			rangeEnd = rangeStart.AddDate(0, 0, rangeDays)
+			if t.Before(rangeEnd) {
+				break
+			}
+			rangeStart = rangeEnd
 		}
-		rangeStart = rangeEnd
 	}
 	return partitionTimeRange{
 		GivenTime: givenTime,
 		StartDate: rangeStart,
 		EndDate:   rangeEnd,
+		Interval:  interval,
 	}
 }
 
 func (p *partitionTimeRange) getPartnameSuffix() string {
-	return p.StartDate.Format("2006_01_02")
+	return p.StartDate.Format(p.Interval.suffixLayout())
 }
 
 func (p *partitionTimeRange) getRangeArgs() (string, string) {
@@ -110,15 +191,17 @@ func (p *partitionTimeRange) isSame(q *partitionTimeRange) bool {
 }
 
 func (p *partitionTimeRange) previous() partitionTimeRange {
-	return newPartitionTimeRange(p.StartDate.Add(-time.Second))
+	return newPartitionTimeRange(p.StartDate.Add(-time.Second), p.Interval)
 }
 
 func (p *partitionTimeRange) next() partitionTimeRange {
-	return newPartitionTimeRange(p.EndDate)
+	return newPartitionTimeRange(p.EndDate, p.Interval)
 }
 
+// getPartitionTimeRangeForTable parses the partition time range from the name
+// of a partition table. The partition interval is inferred from the format of
+// the name suffix, so partitions created under any interval can be parsed.
 func getPartitionTimeRangeForTable(name string) (partitionTimeRange, error) {
-	fmtStr := []rune("2006_01_02")
 	runes := []rune(name)
 
 	errFn := func(msg string) error {
@@ -130,17 +213,26 @@ func getPartitionTimeRangeForTable(name string) (partitionTimeRange, error) {
 		return fmt.Errorf("%s%s", title, s)
 	}
 
-	if len(runes) <= len(fmtStr) {
-		return partitionTimeRange{}, errFn("too short")
+	var partSuffix string
+	for _, interval := range allPartitionIntervals {
+		fmtStr := []rune(interval.suffixLayout())
+		if len(runes) <= len(fmtStr) {
+			continue
+		}
+
+		// Split out the date part of the table name
+		partSuffix = string(runes[len(runes)-len(fmtStr):])
+		startTime, err := time.Parse(string(fmtStr), partSuffix)
+		if err != nil {
+			continue
+		}
+		return newPartitionTimeRange(startTime, interval), nil
 	}
 
-	// Split out the date part of the table name
-	partSuffix := string(runes[len(runes)-len(fmtStr):])
-	startTime, err := time.Parse(string(fmtStr), partSuffix)
-	if err != nil {
-		return partitionTimeRange{}, errFn("bad time value: " + partSuffix)
+	if partSuffix == "" {
+		return partitionTimeRange{}, errFn("too short")
 	}
-	return newPartitionTimeRange(startTime), nil
+	return partitionTimeRange{}, errFn("bad time value: " + partSuffix)
 }
 
 type childTableInfo struct {
@@ -163,7 +255,7 @@ func (c *DBClient) getExistingPartitions(ctx context.Context, t Table) (tableNam
                                                    JOIN pg_class child             ON pg_inherits.inhrelid   = child.oid
                                                    JOIN pg_namespace nmsp_parent   ON nmsp_parent.oid  = parent.relnamespace
                                                    JOIN pg_namespace nmsp_child    ON nmsp_child.oid   = child.relnamespace
-                                             WHERE parent.relname='%s'
+                                             WHERE parent.oid = to_regclass('%s')
                                           ORDER BY child.relname ASC;`
 	)
 
@@ -184,6 +276,79 @@ func (c *DBClient) getExistingPartitions(ctx context.Context, t Table) (tableNam
 	return tableNames, nil
 }
 
+// PartitionInfo describes a partition of a table, see ListPartitions.
+type PartitionInfo struct {
+	Name      string    `json:"name"`
+	StartDate time.Time `json:"start_date"`
+	EndDate   time.Time `json:"end_date"`
+	// ApproxRows is the number of rows of the partition estimated by
+	// Postgres when it was last vacuumed or analyzed. It is -1 (or 0
+	// before Postgres 14) if the partition never was.
+	ApproxRows int64 `json:"approx_rows"`
+}
+
+// ListPartitions returns the partitions of the table, sorted by time range,
+// along with their approximate row counts, which are read from the planner
+// statistics rather than counted, so that listing is cheap even for large
+// partitions. It is not supported for hypertables, whose chunks are listed
+// by the timescaledb_information.chunks view.
+func (c *DBClient) ListPartitions(ctx context.Context, table Table) ([]PartitionInfo, error) {
+	const listPartitions = `SELECT child.relname   AS name,
+                                       child.reltuples AS rel_tuples
+                                  FROM pg_inherits
+                                       JOIN pg_class parent ON pg_inherits.inhparent = parent.oid
+                                       JOIN pg_class child  ON pg_inherits.inhrelid  = child.oid
+                                 WHERE parent.oid = to_regclass($1);`
+
+	if err := c.checkOpen(); err != nil {
+		return nil, err
+	}
+	if hyper, err := c.hypertables(ctx); err != nil {
+		return nil, err
+	} else if hyper {
+		return nil, fmt.Errorf("Listing the partitions of %s is not supported for hypertables", table.Name)
+	}
+
+	rows, err := c.QueryContext(ctx, listPartitions, table.Name)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing partitions for %s: %v", table.Name, err)
+	}
+	var partitions []struct {
+		Name      string
+		RelTuples float64
+	}
+	if err := sqlscan.ScanAll(&partitions, rows); err != nil {
+		return nil, fmt.Errorf("Error accessing db: %v", err)
+	}
+
+	infos := make([]PartitionInfo, 0, len(partitions))
+	for _, p := range partitions {
+		pt, err := getPartitionTimeRangeForTable(p.Name)
+		if err != nil {
+			return nil, err
+		}
+		approxRows := int64(p.RelTuples)
+		if approxRows < 0 {
+			// Postgres 14+ sets reltuples to -1 until the first
+			// VACUUM or ANALYZE.
+			approxRows = -1
+		}
+		infos = append(infos, PartitionInfo{
+			Name:       p.Name,
+			StartDate:  pt.StartDate,
+			EndDate:    pt.EndDate,
+			ApproxRows: approxRows,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if !infos[i].StartDate.Equal(infos[j].StartDate) {
+			return infos[i].StartDate.Before(infos[j].StartDate)
+		}
+		return infos[i].EndDate.Before(infos[j].EndDate)
+	})
+	return infos, nil
+}
+
 func (c *DBClient) getTableDiskUsage(ctx context.Context, tableName string) (int64, error) {
 	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
@@ -199,13 +364,125 @@ func (c *DBClient) getTableDiskUsage(ctx context.Context, tableName string) (int
 	return size, err
 }
 
+// TableSizes returns the disk usage, in bytes, of the audit log tables,
+// including their indexes and TOAST data, keyed by table name. The usage of
+// each partition of the tables is returned as well, keyed by partition name,
+// the usage of a table being the total of its partitions. Hypertables are
+// only given as a whole, as their chunks are not named after them.
+func (c *DBClient) TableSizes(ctx context.Context) (map[string]int64, error) {
+	const hypertableSize QTemplate = `SELECT hypertable_size('%s');`
+
+	if err := c.checkOpen(); err != nil {
+		return nil, err
+	}
+	hyper, err := c.hypertables(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[string]int64)
+	for _, table := range c.tables() {
+		if hyper {
+			var size int64
+			if err := c.QueryRowContext(ctx, hypertableSize.build(table.Name)).Scan(&size); err != nil {
+				return nil, fmt.Errorf("Error getting the size of %s: %v", table.Name, err)
+			}
+			sizes[table.Name] = size
+			continue
+		}
+
+		partitions, err := c.getExistingPartitions(ctx, table)
+		if err != nil {
+			return nil, err
+		}
+		// A partitioned table has no storage of its own.
+		var total int64
+		for _, partition := range partitions {
+			size, err := c.getTableDiskUsage(ctx, partition)
+			if err != nil {
+				return nil, fmt.Errorf("Error getting the size of %s: %v", partition, err)
+			}
+			sizes[partition] = size
+			total += size
+		}
+		sizes[table.Name] = total
+	}
+	return sizes, nil
+}
+
 func (c *DBClient) deleteChildTable(ctx context.Context, table, reason string) error {
 	q := fmt.Sprintf("DROP TABLE %s;", table)
 	_, err := c.ExecContext(ctx, q)
 	if err != nil {
 		return fmt.Errorf("Table deletion error for %s: %v (attempted for reason: %s)", table, err, reason)
 	}
-	log.Printf("Deleted table `%s` (%s)", table, reason)
+	c.logger().Infof("Deleted table `%s` (%s)", table, reason)
+	return nil
+}
+
+// vacuumAnalyzeTimeout bounds the time taken by VacuumAnalyze. Vacuuming
+// large tables may take long, so this is much longer than the timeouts of
+// other queries.
+const vacuumAnalyzeTimeout = 1 * time.Hour
+
+// VacuumAnalyze runs `VACUUM (ANALYZE)` on the audit log tables, reclaiming
+// space held by dead tuples and refreshing the planner statistics. On a
+// partitioned table this processes all its partitions as well. It is meant to
+// be run periodically, e.g. after dropping old partitions.
+func (c *DBClient) VacuumAnalyze(ctx context.Context) error {
+	var tables []string
+	for _, table := range c.tables() {
+		tables = append(tables, table.Name)
+	}
+	return c.vacuumAnalyzeTables(ctx, tables)
+}
+
+// VacuumAnalyzePartitions is like VacuumAnalyze, but runs `VACUUM (ANALYZE)`
+// on each existing partition separately, so that a failure (e.g. due to a
+// partition dropped concurrently) does not prevent processing the others.
+func (c *DBClient) VacuumAnalyzePartitions(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, vacuumAnalyzeTimeout)
+	defer cancel()
+
+	if hyper, err := c.hypertables(ctx); err != nil {
+		return err
+	} else if hyper {
+		// The chunks of hypertables are not named after them, and
+		// vacuuming a hypertable processes its chunks anyway.
+		return c.VacuumAnalyze(ctx)
+	}
+
+	var tables []string
+	for _, table := range c.tables() {
+		partitions, err := c.getExistingPartitions(ctx, table)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, partitions...)
+	}
+	return c.vacuumAnalyzeTables(ctx, tables)
+}
+
+func (c *DBClient) vacuumAnalyzeTables(ctx context.Context, tables []string) error {
+	ctx, cancel := context.WithTimeout(ctx, vacuumAnalyzeTimeout)
+	defer cancel()
+
+	const vacuumAnalyze QTemplate = `VACUUM (ANALYZE) %s;`
+
+	// VACUUM cannot run inside a transaction block, so each statement is
+	// run directly on the pool.
+	var errs []string
+	for _, table := range tables {
+		if _, err := c.ExecContext(ctx, vacuumAnalyze.build(table)); err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("Error vacuuming %s: %v", table, err)
+			}
+			errs = append(errs, fmt.Sprintf("%s: %v", table, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Error vacuuming tables: %s", strings.Join(errs, "; "))
+	}
 	return nil
 }
 
@@ -219,8 +496,8 @@ func calculateHiLoWaterMarks(totalCap uint64) (hi, lo float64) {
 
 // getEarliestPartitionStartTime - finds the earliest start time of all existing
 // table partitions - this is the minimum start time over the first existing
-// partitions for each parent table.
-func getEarliestPartitionStartTime(tables map[Table][]string, indices []int) (time.Time, error) {
+// partitions for each parent table of allTables.
+func getEarliestPartitionStartTime(allTables []Table, tables map[Table][]string, indices []int) (time.Time, error) {
 	var earliestStartTime time.Time
 	isSet := false
 	for i, table := range allTables {
@@ -239,7 +516,24 @@ func getEarliestPartitionStartTime(tables map[Table][]string, indices []int) (ti
 	return earliestStartTime, nil
 }
 
+// partitionsContain returns true if one of the partitions at indices of the
+// tables starting at startTime, as found by getEarliestPartitionStartTime,
+// has a time range including t.
+func partitionsContain(allTables []Table, tables map[Table][]string, indices []int, startTime, t time.Time) (bool, error) {
+	for i, table := range allTables {
+		pt, err := getPartitionTimeRangeForTable(tables[table][indices[i]])
+		if err != nil {
+			return false, err
+		}
+		if pt.StartDate.Equal(startTime) && !t.Before(pt.StartDate) && t.Before(pt.EndDate) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (c *DBClient) maintainLowWatermarkUsage(ctx context.Context, diskCapacityGBs int) (err error) {
+	allTables := c.tables()
 	tables := make(map[Table][]string, len(allTables))
 	du := make(map[Table]map[string]int64, len(allTables))
 	var totalUsage int64
@@ -274,7 +568,7 @@ func (c *DBClient) maintainLowWatermarkUsage(ctx context.Context, diskCapacityGB
 	// Print out disk usage after deletes - we defer this call because we could
 	// exit this func due to an error.
 	defer func() {
-		log.Printf("Current tables disk usage: %.1f GB", float64(totalUsage)/float64(1024*1024*1024))
+		c.logger().Infof("Current tables disk usage: %.1f GB", float64(totalUsage)/float64(1024*1024*1024))
 	}()
 
 	// Delete oldest child tables in each parent table, until usage is below
@@ -286,15 +580,20 @@ func (c *DBClient) maintainLowWatermarkUsage(ctx context.Context, diskCapacityGB
 	// parent table to ensure we only delete the oldest tables.
 	indices := make([]int, len(allTables))
 	for float64(totalUsage) >= lo {
-		earliestStartTime, err := getEarliestPartitionStartTime(tables, indices)
+		earliestStartTime, err := getEarliestPartitionStartTime(allTables, tables, indices)
 		if err != nil {
 			return err
 		}
 
 		// Quit without deleting the current partition even if we are over the
-		// highwater mark!
-		currentPartStartTime := newPartitionTimeRange(time.Now()).StartDate
-		if earliestStartTime.Equal(currentPartStartTime) {
+		// highwater mark! The partitions may have been created with another
+		// interval than the current one, so the time ranges parsed from
+		// their names are checked.
+		current, err := partitionsContain(allTables, tables, indices, earliestStartTime, time.Now())
+		if err != nil {
+			return err
+		}
+		if current {
 			type ctinfo struct {
 				Name string
 				Size int64
@@ -307,7 +606,7 @@ func (c *DBClient) maintainLowWatermarkUsage(ctx context.Context, diskCapacityGB
 				total += du[table][name]
 			}
 
-			log.Printf("WARNING: highwater mark reached: no non-current tables exist to delete!"+
+			c.logger().Warnf("WARNING: highwater mark reached: no non-current tables exist to delete!"+
 				" Please increase the value of "+DiskCapacityEnv+" and ensure disk capacity for PostgreSQL!"+
 				" Candidate tables and sizes: %v (total usage: %d)", ct, total)
 			break
@@ -344,52 +643,158 @@ func (c *DBClient) vacuumData(ctx context.Context, diskCapacityGBs int) {
 	for {
 		select {
 		case <-timer.C:
+			if hyper, err := c.hypertables(ctx); err == nil && hyper {
+				c.logger().Infof("Disk usage is not limited for hypertables, a TimescaleDB retention policy may be used instead.")
+				return
+			}
 
 			err := c.maintainLowWatermarkUsage(ctx, diskCapacityGBs)
 			if err != nil {
-				log.Printf("Error maintaining high-water mark disk usage: %v (retrying in %s)", err, retryInterval)
+				c.logger().Errorf("Error maintaining high-water mark disk usage: %v (retrying in %s)", err, retryInterval)
 				timer.Reset(retryInterval)
 				continue
 			}
 			timer.Reset(normalInterval)
 
 		case <-ctx.Done():
-			log.Println("Vacuum thread exiting.")
+			c.logger().Debugf("Vacuum thread exiting.")
 			return
 		}
 	}
 }
 
-func (c *DBClient) partitionTables(ctx context.Context) {
-	checkInterval := 1 * time.Hour
-
-	timer := time.NewTimer(checkInterval)
-	defer timer.Stop()
+// EnsurePartitionsForRange creates the partitions of the table covering the
+// time range [start, end) that do not exist yet, e.g. before importing
+// historical audit logs. The missing partitions are created along with their
+// indexes in a single round-trip; time ranges (partly) covered by existing
+// partitions, e.g. created with a different partition interval, are skipped.
+// It does nothing for hypertables, whose chunks are created by TimescaleDB.
+func (c *DBClient) EnsurePartitionsForRange(ctx context.Context, table Table, start, end time.Time) error {
+	if !start.Before(end) {
+		return fmt.Errorf("Invalid partition range: %s -> %s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+	}
+	if hyper, err := c.hypertables(ctx); err != nil || hyper {
+		// TimescaleDB creates the chunks of hypertables as needed.
+		return err
+	}
 
-	for {
-		select {
-		case <-timer.C:
-			timer.Reset(checkInterval)
-			// Check if the partition table to store audit logs 48hrs from now exists
-			later := time.Now().Add(48 * time.Hour)
-			for _, table := range allTables {
-				partitionExists, err := c.checkPartitionTableExists(ctx, table.Name, later)
-				if err != nil {
-					log.Printf("Error while checking if partition for %s exists %s", table.Name, err)
-				}
+	existing, err := c.getExistingPartitions(ctx, table)
+	if err != nil {
+		return err
+	}
+	var existingRanges []partitionTimeRange
+	for _, name := range existing {
+		pt, err := getPartitionTimeRangeForTable(name)
+		if err != nil {
+			return err
+		}
+		existingRanges = append(existingRanges, pt)
+	}
 
-				if partitionExists {
-					continue
-				}
+	var missing []partitionTimeRange
+	for p := newPartitionTimeRange(start, c.PartitionInterval); p.StartDate.Before(end); p = p.next() {
+		if !overlapsAny(p, existingRanges) {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
 
-				if err := c.createTablePartition(ctx, table, later); err != nil {
-					log.Printf("Error while creating partition for %s", table.Name)
-				}
+	var stmts []string
+	for _, p := range missing {
+		stmts = append(stmts, c.partitionStatements(table, p)...)
+	}
+	if _, err := c.ExecContext(ctx, strings.Join(stmts, "\n")); err != nil {
+		// E.g. a partition was created concurrently with a different
+		// interval - fall back to creating the partitions one by one.
+		c.logger().Warnf("Error creating partitions of %s in a batch, creating them one by one: %v", table.Name, err)
+		for _, p := range missing {
+			if err := c.createTablePartition(ctx, table, p.StartDate); err != nil {
+				return err
 			}
+			c.metrics().PartitionCreated(table.Name, table.getPartitionName(p))
+		}
+		return nil
+	}
+	for _, p := range missing {
+		c.metrics().PartitionCreated(table.Name, table.getPartitionName(p))
+	}
+	c.logger().Infof("Created %d partitions of %s from %s to %s", len(missing), table.Name,
+		missing[0].StartDate.Format(time.RFC3339), missing[len(missing)-1].EndDate.Format(time.RFC3339))
+	return nil
+}
 
-		case <-ctx.Done():
-			log.Println("Table partitioner thread exiting.")
-			return
+// overlapsAny returns true if p overlaps any of the given time ranges.
+func overlapsAny(p partitionTimeRange, ranges []partitionTimeRange) bool {
+	for _, r := range ranges {
+		if p.StartDate.Before(r.EndDate) && r.StartDate.Before(p.EndDate) {
+			return true
 		}
 	}
+	return false
+}
+
+// ensurePartitions creates the partitions for the current and the next time
+// ranges of every table, unless they already exist. It is safe to call
+// concurrently with inserts, as partitions are created with `IF NOT EXISTS`.
+// It does nothing for hypertables.
+func (c *DBClient) ensurePartitions(ctx context.Context) error {
+	if hyper, err := c.hypertables(ctx); err != nil || hyper {
+		return err
+	}
+	now := time.Now()
+	current := newPartitionTimeRange(now, c.PartitionInterval)
+	for _, table := range c.tables() {
+		for _, pt := range []time.Time{now, current.next().StartDate} {
+			exists, err := c.checkPartitionTableExists(ctx, table, pt)
+			if err != nil {
+				return fmt.Errorf("Error checking if partition for %s exists: %v", table.Name, err)
+			}
+			if exists {
+				continue
+			}
+			if err := c.createTablePartition(ctx, table, pt); err != nil {
+				return fmt.Errorf("Error creating partition for %s: %v", table.Name, err)
+			}
+			partition := table.getPartitionName(newPartitionTimeRange(pt, c.PartitionInterval))
+			c.logger().Infof("Created partition %s", partition)
+			c.metrics().PartitionCreated(table.Name, partition)
+		}
+	}
+	return nil
+}
+
+// StartPartitionMaintainer starts a goroutine that creates the partitions for
+// the current and the next time ranges of every table, if they are missing,
+// right away and then every interval, so that inserts do not fail for want of
+// a partition. It stops when ctx is cancelled or the client is closed.
+func (c *DBClient) StartPartitionMaintainer(ctx context.Context, interval time.Duration) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closed {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c.stopMaintainers = append(c.stopMaintainers, cancel)
+	c.maintainers.Add(1)
+
+	go func() {
+		defer c.maintainers.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := c.ensurePartitions(ctx); err != nil && ctx.Err() == nil {
+				c.logger().Errorf("Partition maintenance failed: %v", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				c.logger().Debugf("Partition maintainer exiting.")
+				return
+			}
+		}
+	}()
 }
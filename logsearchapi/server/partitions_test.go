@@ -18,7 +18,10 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"math/rand"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -77,7 +80,7 @@ func TestNewPartitionTimeRange(t *testing.T) {
 	}
 
 	for i, testCase := range testCases {
-		got := newPartitionTimeRange(testCase.givenTime)
+		got := newPartitionTimeRange(testCase.givenTime, PartitionWeekly)
 		if got != testCase.expectedPartitionTimeRange {
 			t.Errorf("%v:\ngot: %#v\nexpected: %#v", i+1, got, testCase.expectedPartitionTimeRange)
 		}
@@ -93,13 +96,52 @@ func randomTime() time.Time {
 	return time.Unix(r, 0)
 }
 
+func TestNewPartitionTimeRangeIntervals(t *testing.T) {
+	given := time.Date(2022, time.February, 24, 11, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		interval         PartitionInterval
+		start, end       time.Time
+		expectedPartName string
+	}{
+		{
+			interval:         PartitionWeekly,
+			start:            time.Date(2022, time.February, 22, 0, 0, 0, 0, time.UTC),
+			end:              time.Date(2022, time.March, 1, 0, 0, 0, 0, time.UTC),
+			expectedPartName: "2022_02_22",
+		},
+		{
+			interval:         PartitionDaily,
+			start:            time.Date(2022, time.February, 24, 0, 0, 0, 0, time.UTC),
+			end:              time.Date(2022, time.February, 25, 0, 0, 0, 0, time.UTC),
+			expectedPartName: "d2022_02_24",
+		},
+		{
+			interval:         PartitionMonthly,
+			start:            time.Date(2022, time.February, 1, 0, 0, 0, 0, time.UTC),
+			end:              time.Date(2022, time.March, 1, 0, 0, 0, 0, time.UTC),
+			expectedPartName: "m2022_02",
+		},
+	}
+
+	for i, testCase := range testCases {
+		got := newPartitionTimeRange(given, testCase.interval)
+		if !got.StartDate.Equal(testCase.start) || !got.EndDate.Equal(testCase.end) {
+			t.Errorf("%d: got %s, expected %s -> %s", i+1, got.String(), testCase.start, testCase.end)
+		}
+		if suffix := got.getPartnameSuffix(); suffix != testCase.expectedPartName {
+			t.Errorf("%d: got suffix %s, expected %s", i+1, suffix, testCase.expectedPartName)
+		}
+	}
+}
+
 func TestPartitionTimeRangeNextPrev(t *testing.T) {
 	rand.Seed(time.Now().UnixNano())
 
 	// For some randomly generated times, test some properties.
 	for i := 0; i < 1000; i++ {
 		r := randomTime()
-		p1 := newPartitionTimeRange(r)
+		p1 := newPartitionTimeRange(r, allPartitionIntervals[i%len(allPartitionIntervals)])
 		p0, p2 := p1.previous(), p1.next()
 
 		p0next := p0.next()
@@ -122,11 +164,11 @@ func TestPartitionTimeRangeNextPrev(t *testing.T) {
 			t.Errorf("Test %d: r=%v p0=%s p2=%s (p2.previous().previous() != p0)", i, r, p0.String(), p2.String())
 		}
 
-		if p := newPartitionTimeRange(p1.StartDate); !p.isSame(&p1) {
+		if p := newPartitionTimeRange(p1.StartDate, p1.Interval); !p.isSame(&p1) {
 			t.Errorf("Test %d: r=%v p1=%s p=%s (newPartitionTimeRange(p1.StartTime) != p1)", i, r, p1.String(), p.String())
 		}
 
-		if p := newPartitionTimeRange(p1.EndDate); !p.isSame(&p2) {
+		if p := newPartitionTimeRange(p1.EndDate, p1.Interval); !p.isSame(&p2) {
 			t.Errorf("Test %d: r=%v p1=%s p2=%s p=%s (newPartitionTimeRange(p1.EndDate) != p2)", i, r, p1.String(), p2.String(), p.String())
 		}
 	}
@@ -137,7 +179,7 @@ func TestPartitionNameParsing(t *testing.T) {
 
 	for i := 0; i < 1000; i++ {
 		r := randomTime()
-		p1 := newPartitionTimeRange(r)
+		p1 := newPartitionTimeRange(r, allPartitionIntervals[i%len(allPartitionIntervals)])
 
 		name := "table_" + p1.getPartnameSuffix()
 
@@ -145,8 +187,372 @@ func TestPartitionNameParsing(t *testing.T) {
 		if err != nil {
 			t.Errorf("Test %d: r=%v unexpected err: %v", i, r, err)
 		}
-		if !res.isSame(&p1) {
+		if !res.isSame(&p1) || res.Interval != p1.Interval {
 			t.Errorf("Test %d: r=%v, expected: %v got %v", i, r, p1.String(), res.String())
 		}
 	}
 }
+
+func TestPartitionsContain(t *testing.T) {
+	now := time.Date(2022, 3, 16, 12, 0, 0, 0, time.UTC)
+	events, reqInfo := Table{Name: "audit_log_events"}, Table{Name: "request_info"}
+	allTables := []Table{events, reqInfo}
+
+	// The monthly partitions of a previous interval include now, unlike the
+	// daily partition starting on the same day as the current weekly one.
+	monthly := newPartitionTimeRange(now, PartitionMonthly)
+	daily := newPartitionTimeRange(newPartitionTimeRange(now, PartitionWeekly).StartDate, PartitionDaily)
+	testCases := []struct {
+		p        partitionTimeRange
+		expected bool
+	}{
+		{monthly, true},
+		{newPartitionTimeRange(now, PartitionWeekly), true},
+		{newPartitionTimeRange(now, PartitionDaily), true},
+		{daily, false},
+		{monthly.previous(), false},
+	}
+	for i, testCase := range testCases {
+		tables := map[Table][]string{
+			events:  {events.getPartitionName(testCase.p)},
+			reqInfo: {reqInfo.getPartitionName(testCase.p)},
+		}
+		got, err := partitionsContain(allTables, tables, []int{0, 0}, testCase.p.StartDate, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != testCase.expected {
+			t.Errorf("Test %d: %s: got %v, expected %v", i, testCase.p.String(), got, testCase.expected)
+		}
+	}
+}
+
+func TestPartitionTimeRangeBoundaries(t *testing.T) {
+	pst, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatalf("Could not load loc: %v", err)
+	}
+
+	midnight := time.Date(2022, time.March, 9, 0, 0, 0, 0, time.UTC)
+	monthEnd := time.Date(2022, time.February, 1, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		givenTime  time.Time
+		interval   PartitionInterval
+		start, end time.Time
+	}{
+		// Around midnight.
+		{midnight.Add(-time.Nanosecond), PartitionDaily, midnight.AddDate(0, 0, -1), midnight},
+		{midnight, PartitionDaily, midnight, midnight.AddDate(0, 0, 1)},
+		{midnight.Add(-time.Nanosecond), PartitionWeekly, time.Date(2022, time.March, 1, 0, 0, 0, 0, time.UTC), time.Date(2022, time.March, 9, 0, 0, 0, 0, time.UTC)},
+		{midnight, PartitionWeekly, time.Date(2022, time.March, 9, 0, 0, 0, 0, time.UTC), time.Date(2022, time.March, 17, 0, 0, 0, 0, time.UTC)},
+		// The time is taken in UTC: 16:30 in Los Angeles is past midnight.
+		{time.Date(2022, time.March, 8, 16, 30, 0, 0, pst), PartitionDaily, midnight, midnight.AddDate(0, 0, 1)},
+		// Around the end of a month.
+		{monthEnd.Add(-time.Nanosecond), PartitionDaily, time.Date(2022, time.January, 31, 0, 0, 0, 0, time.UTC), monthEnd},
+		{monthEnd.Add(-time.Nanosecond), PartitionWeekly, time.Date(2022, time.January, 25, 0, 0, 0, 0, time.UTC), monthEnd},
+		{monthEnd.Add(-time.Nanosecond), PartitionMonthly, time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC), monthEnd},
+		{monthEnd, PartitionWeekly, monthEnd, time.Date(2022, time.February, 8, 0, 0, 0, 0, time.UTC)},
+		{monthEnd, PartitionMonthly, monthEnd, time.Date(2022, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		// The end of a leap February and of a year.
+		{time.Date(2024, time.February, 29, 23, 59, 59, 0, time.UTC), PartitionWeekly, time.Date(2024, time.February, 23, 0, 0, 0, 0, time.UTC), time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2022, time.December, 31, 23, 59, 59, 0, time.UTC), PartitionMonthly, time.Date(2022, time.December, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for i, testCase := range testCases {
+		p := newPartitionTimeRange(testCase.givenTime, testCase.interval)
+		if !p.StartDate.Equal(testCase.start) || !p.EndDate.Equal(testCase.end) {
+			t.Errorf("%d: got %s, expected %s -> %s", i+1, p.String(), testCase.start, testCase.end)
+		}
+		// The partition checked for and inserted into is the same for
+		// any time of the range, and is named after its range.
+		for _, tm := range []time.Time{p.StartDate, p.EndDate.Add(-time.Nanosecond)} {
+			if q := newPartitionTimeRange(tm, testCase.interval); !q.isSame(&p) {
+				t.Errorf("%d: got %s for %v, expected %s", i+1, q.String(), tm, p.String())
+			}
+		}
+		q, err := getPartitionTimeRangeForTable("table_" + p.getPartnameSuffix())
+		if err != nil || !q.isSame(&p) {
+			t.Errorf("%d: got %s (%v) for the name of %s", i+1, q.String(), err, p.String())
+		}
+	}
+}
+
+func TestVacuumAnalyze(t *testing.T) {
+	c := newTestDBClient(t)
+
+	if err := c.VacuumAnalyze(context.Background()); err != nil {
+		t.Errorf("VacuumAnalyze failed: %v", err)
+	}
+	if err := c.VacuumAnalyzePartitions(context.Background()); err != nil {
+		t.Errorf("VacuumAnalyzePartitions failed: %v", err)
+	}
+}
+
+func TestEnsurePartitions(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	// Drop the next partition, which holds no data yet.
+	current := newPartitionTimeRange(time.Now(), c.PartitionInterval)
+	next := current.next()
+	partition := requestInfoTable.getPartitionName(next)
+	if _, err := c.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s;", partition)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.ensurePartitions(ctx); err != nil {
+		t.Fatalf("ensurePartitions failed: %v", err)
+	}
+	exists, err := c.checkPartitionTableExists(ctx, requestInfoTable, next.StartDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Errorf("Partition %s was not created", partition)
+	}
+
+	// Running it again is a no-op.
+	if err := c.ensurePartitions(ctx); err != nil {
+		t.Fatalf("ensurePartitions failed: %v", err)
+	}
+}
+
+func TestPrecreatedPartitions(t *testing.T) {
+	now := time.Date(2022, time.March, 9, 12, 0, 0, 0, time.UTC)
+	day := func(d int) time.Time { return time.Date(2022, time.March, d, 0, 0, 0, 0, time.UTC) }
+	testCases := []struct {
+		previous, next int
+		expected       []time.Time
+	}{
+		{1, 1, []time.Time{day(8), day(9), day(10)}},
+		{3, 2, []time.Time{day(6), day(7), day(8), day(9), day(10), day(11)}},
+		{0, 0, []time.Time{day(9)}},
+		{-1, 0, []time.Time{day(9)}},
+	}
+	for i, testCase := range testCases {
+		c := &DBClient{PartitionInterval: PartitionDaily, PrecreatePrevious: testCase.previous, PrecreateNext: testCase.next}
+		var starts []time.Time
+		for _, p := range c.precreatedPartitions(now) {
+			starts = append(starts, p.StartDate)
+		}
+		if !reflect.DeepEqual(starts, testCase.expected) {
+			t.Errorf("Test %d: got partitions starting at %v, expected %v", i, starts, testCase.expected)
+		}
+	}
+
+	// The partitions are contiguous across month boundaries.
+	c := &DBClient{PartitionInterval: PartitionDaily, PrecreatePrevious: 31, PrecreateNext: 1}
+	partitions := c.precreatedPartitions(now)
+	if len(partitions) != 33 || !partitions[0].StartDate.Equal(time.Date(2022, time.February, 6, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %d partitions from %s, expected 33 from 2022-02-06", len(partitions), partitions[0].String())
+	}
+	for i := 1; i < len(partitions); i++ {
+		if !partitions[i].StartDate.Equal(partitions[i-1].EndDate) {
+			t.Errorf("partition %s does not follow %s", partitions[i].String(), partitions[i-1].String())
+		}
+	}
+}
+
+func TestPrecreatePartitions(t *testing.T) {
+	c := newTestDBClient(t, WithTablePrefix("precreatetest_"))
+	ctx := context.Background()
+	defer func() {
+		for _, table := range []Table{c.logEventsTable(), c.reqInfoTable(), c.migrationsTable(), c.watermarksTable()} {
+			if _, err := c.ExecContext(ctx, "DROP TABLE IF EXISTS "+table.Name); err != nil {
+				t.Errorf("dropping %s: %v", table.Name, err)
+			}
+		}
+	}()
+
+	c.PartitionInterval = PartitionDaily
+	c.PrecreatePrevious, c.PrecreateNext = 5, 2
+	if err := c.InitDBTables(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range c.tables() {
+		for _, p := range c.precreatedPartitions(time.Now()) {
+			exists, err := c.checkPartitionTableExists(ctx, table, p.StartDate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !exists {
+				t.Errorf("Partition %s was not created", table.getPartitionName(p))
+			}
+		}
+	}
+}
+
+func TestOverlapsAny(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2022, time.March, d, 12, 0, 0, 0, time.UTC) }
+	weekly := []partitionTimeRange{
+		newPartitionTimeRange(day(1), PartitionWeekly),
+		newPartitionTimeRange(day(20), PartitionWeekly),
+	}
+	testCases := []struct {
+		p        partitionTimeRange
+		expected bool
+	}{
+		{newPartitionTimeRange(day(3), PartitionDaily), true},
+		{newPartitionTimeRange(day(9), PartitionDaily), false},
+		{newPartitionTimeRange(day(9), PartitionWeekly), false},
+		{newPartitionTimeRange(day(9), PartitionMonthly), true},
+		{newPartitionTimeRange(day(9).AddDate(0, 1, 0), PartitionMonthly), false},
+	}
+	for i, testCase := range testCases {
+		if got := overlapsAny(testCase.p, weekly); got != testCase.expected {
+			t.Errorf("Test %d: %s: got %v, expected %v", i, testCase.p.String(), got, testCase.expected)
+		}
+	}
+}
+
+func TestEnsurePartitionsForRange(t *testing.T) {
+	c := newTestDBClient(t)
+	c.PartitionInterval = PartitionMonthly
+	ctx := context.Background()
+
+	// A range far in the past, that no other test uses.
+	start := time.Date(2001, time.January, 15, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2001, time.April, 1, 0, 0, 0, 0, time.UTC)
+	var partitions []string
+	for _, month := range []time.Month{time.January, time.February, time.March} {
+		p := newPartitionTimeRange(time.Date(2001, month, 1, 0, 0, 0, 0, time.UTC), c.PartitionInterval)
+		partitions = append(partitions, requestInfoTable.getPartitionName(p))
+	}
+	dropPartitions := func() {
+		for _, partition := range partitions {
+			if _, err := c.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s;", partition)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	dropPartitions()
+	defer dropPartitions()
+
+	for i := 0; i < 2; i++ {
+		if err := c.EnsurePartitionsForRange(ctx, requestInfoTable, start, end); err != nil {
+			t.Fatalf("EnsurePartitionsForRange failed: %v", err)
+		}
+	}
+	existing, err := c.getExistingPartitions(ctx, requestInfoTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, name := range existing {
+		found[name] = true
+	}
+	for _, partition := range partitions {
+		if !found[partition] {
+			t.Errorf("Partition %s was not created", partition)
+		}
+	}
+	aprilPartition := requestInfoTable.getPartitionName(newPartitionTimeRange(end, c.PartitionInterval))
+	if found[aprilPartition] {
+		t.Errorf("Partition %s beyond the range was created", aprilPartition)
+	}
+
+	if err := c.EnsurePartitionsForRange(ctx, requestInfoTable, end, start); err == nil {
+		t.Errorf("Expected an error for an empty range")
+	}
+}
+
+func TestListPartitions(t *testing.T) {
+	c := newTestDBClient(t, WithTablePrefix("listparttest_"))
+	ctx := context.Background()
+	if err := c.InitDBTables(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, table := range []Table{c.logEventsTable(), c.reqInfoTable(), c.migrationsTable(), c.watermarksTable()} {
+			if _, err := c.ExecContext(ctx, "DROP TABLE IF EXISTS "+table.Name); err != nil {
+				t.Errorf("dropping %s: %v", table.Name, err)
+			}
+		}
+	}()
+
+	// Partitions of different intervals, created out of order.
+	table := c.reqInfoTable()
+	month := func(m time.Month) time.Time { return time.Date(2001, m, 1, 0, 0, 0, 0, time.UTC) }
+	for _, p := range []partitionTimeRange{
+		newPartitionTimeRange(month(time.March), PartitionMonthly),
+		newPartitionTimeRange(month(time.February), PartitionDaily),
+		newPartitionTimeRange(month(time.January), PartitionMonthly),
+	} {
+		c.PartitionInterval = p.Interval
+		if err := c.EnsurePartitionsForRange(ctx, table, p.StartDate, p.EndDate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		insertTestEvent(t, c, month(time.January).Add(time.Duration(i)*time.Hour), testBucketName())
+	}
+	if _, err := c.ExecContext(ctx, "ANALYZE "+table.getPartitionName(newPartitionTimeRange(month(time.January), PartitionMonthly))); err != nil {
+		t.Fatal(err)
+	}
+
+	partitions, err := c.ListPartitions(ctx, table)
+	if err != nil {
+		t.Fatalf("ListPartitions failed: %v", err)
+	}
+	if len(partitions) < 3 {
+		t.Fatalf("got %d partitions, expected at least 3", len(partitions))
+	}
+	for i := 1; i < len(partitions); i++ {
+		if partitions[i].StartDate.Before(partitions[i-1].StartDate) {
+			t.Errorf("Partitions not sorted by time: %s before %s", partitions[i-1].Name, partitions[i].Name)
+		}
+	}
+	expected := []PartitionInfo{
+		{Name: table.Name + "_m2001_01", StartDate: month(time.January), EndDate: month(time.February), ApproxRows: 3},
+		{Name: table.Name + "_d2001_02_01", StartDate: month(time.February), EndDate: month(time.February).AddDate(0, 0, 1)},
+		{Name: table.Name + "_m2001_03", StartDate: month(time.March), EndDate: month(time.April)},
+	}
+	for i, p := range expected {
+		got := partitions[i]
+		if got.Name != p.Name || !got.StartDate.Equal(p.StartDate) || !got.EndDate.Equal(p.EndDate) {
+			t.Errorf("Partition %d: got %+v, expected %+v", i, got, p)
+		}
+		if p.ApproxRows > 0 && got.ApproxRows != p.ApproxRows {
+			t.Errorf("Partition %d: got %d rows, expected %d", i, got.ApproxRows, p.ApproxRows)
+		}
+	}
+}
+
+func TestTableSizes(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	insertTestEvent(t, c, now, testBucketName())
+
+	sizes, err := c.TableSizes(ctx)
+	if err != nil {
+		t.Fatalf("TableSizes failed: %v", err)
+	}
+	for name, size := range sizes {
+		if size < 0 {
+			t.Errorf("got negative size %d for %s", size, name)
+		}
+	}
+	for _, table := range c.tables() {
+		total, ok := sizes[table.Name]
+		if !ok {
+			t.Fatalf("no size for %s in %v", table.Name, sizes)
+		}
+		// The partition of the event is not empty.
+		partition := table.getPartitionName(newPartitionTimeRange(now, c.PartitionInterval))
+		if sizes[partition] <= 0 {
+			t.Errorf("expected a positive size for %s, got %v", partition, sizes)
+		}
+		partitions, err := c.getExistingPartitions(ctx, table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sum int64
+		for _, p := range partitions {
+			sum += sizes[p]
+		}
+		if sum != total {
+			t.Errorf("%s: got total %d, expected the sum of its partitions %d", table.Name, total, sum)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PoolConfig sizes the connection pool of the underlying *sql.DB. A zero (or
+// negative) value leaves the corresponding database/sql default in place,
+// i.e. unlimited open connections, 2 idle connections and connections that
+// are never closed for their age or idleness.
+type PoolConfig struct {
+	// MaxOpenConns bounds the number of open connections. It should leave
+	// enough headroom below the max_connections setting of Postgres for the
+	// other clients of the database.
+	MaxOpenConns int
+	// MaxIdleConns bounds the number of idle connections kept for reuse. It
+	// is capped by MaxOpenConns.
+	MaxIdleConns int
+	// ConnMaxLifetime closes connections older than it, so that connections
+	// are eventually re-established, e.g. after a failover.
+	ConnMaxLifetime time.Duration
+	// ConnMaxIdleTime closes connections idle for longer than it, releasing
+	// the connections opened during a burst of requests.
+	ConnMaxIdleTime time.Duration
+
+	// MaxSearches bounds the number of searches (by Search,
+	// SearchWithResult, SearchRows, StreamSearch or SearchCombined) running
+	// concurrently, so that searches, which may each hold a connection for
+	// long, do not exhaust the pool, e.g. for inserts. The iterators of
+	// SearchRows hold their slot until closed. It should be below
+	// MaxOpenConns.
+	MaxSearches int
+	// SearchAcquireTimeout bounds the time a search waits for one of the
+	// MaxSearches slots to be released, failing with ErrBusy after it,
+	// instead of waiting until its context is done.
+	SearchAcquireTimeout time.Duration
+}
+
+// DefaultPoolConfig is the pool configuration of clients created with
+// NewDBClient. Inserts hold a connection for a short transaction each, while
+// searches and exports may hold one for much longer, so the pool allows a
+// few dozen connections and keeps enough of them idle to absorb the steady
+// stream of inserts without reconnecting.
+var DefaultPoolConfig = PoolConfig{
+	MaxOpenConns:    25,
+	MaxIdleConns:    10,
+	ConnMaxLifetime: 30 * time.Minute,
+	ConnMaxIdleTime: 5 * time.Minute,
+}
+
+// apply sets the pool configuration on db.
+func (p PoolConfig) apply(db *sql.DB) {
+	if p.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(p.MaxOpenConns)
+	}
+	if p.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(p.MaxIdleConns)
+	}
+	if p.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(p.ConnMaxLifetime)
+	}
+	if p.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(p.ConnMaxIdleTime)
+	}
+}
+
+// newSearchSlots returns the semaphore bounding the number of concurrent
+// searches to MaxSearches, or nil when they are not bounded.
+func (p PoolConfig) newSearchSlots() chan struct{} {
+	if p.MaxSearches <= 0 {
+		return nil
+	}
+	return make(chan struct{}, p.MaxSearches)
+}
+
+// acquireSearchSlot waits for one of the MaxSearches slots of searches,
+// returning the function releasing it. It fails with ErrBusy when no slot is
+// released within SearchAcquireTimeout.
+func (c *DBClient) acquireSearchSlot(ctx context.Context) (release func(), err error) {
+	if c.searchSlots == nil {
+		return func() {}, nil
+	}
+	release = func() { <-c.searchSlots }
+	select {
+	case c.searchSlots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if c.pool.SearchAcquireTimeout > 0 {
+		timer := time.NewTimer(c.pool.SearchAcquireTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case c.searchSlots <- struct{}{}:
+		return release, nil
+	case <-timeout:
+		return nil, ErrBusy
+	case <-ctx.Done():
+		return nil, &QueryError{Op: "querying", Err: ctx.Err()}
+	}
+}
+
+// WithPoolConfig sets the connection pool configuration of the client,
+// instead of DefaultPoolConfig.
+func WithPoolConfig(p PoolConfig) DBClientOption {
+	return func(c *DBClient) {
+		c.pool = p
+	}
+}
@@ -0,0 +1,183 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoolConfigApply(t *testing.T) {
+	// sql.Open does not connect, so no database is needed.
+	db, err := sql.Open("postgres", "postgres://localhost/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	PoolConfig{}.apply(db)
+	if got := db.Stats().MaxOpenConnections; got != 0 {
+		t.Errorf("got max open connections %d, expected unlimited for a zero config", got)
+	}
+
+	DefaultPoolConfig.apply(db)
+	if got := db.Stats().MaxOpenConnections; got != DefaultPoolConfig.MaxOpenConns {
+		t.Errorf("got max open connections %d, expected %d", got, DefaultPoolConfig.MaxOpenConns)
+	}
+
+	c := &DBClient{pool: DefaultPoolConfig}
+	p := PoolConfig{MaxOpenConns: 5, ConnMaxLifetime: time.Minute}
+	WithPoolConfig(p)(c)
+	if c.pool != p {
+		t.Errorf("got %+v, expected %+v", c.pool, p)
+	}
+}
+
+func TestAcquireSearchSlot(t *testing.T) {
+	ctx := context.Background()
+
+	// Searches are not bounded by default.
+	c := &DBClient{}
+	for i := 0; i < 3; i++ {
+		if _, err := c.acquireSearchSlot(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c = &DBClient{pool: PoolConfig{MaxSearches: 2, SearchAcquireTimeout: 20 * time.Millisecond}}
+	c.searchSlots = c.pool.newSearchSlots()
+	release1, err := c.acquireSearchSlot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2, err := c.acquireSearchSlot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := c.acquireSearchSlot(ctx); !errors.Is(err, ErrBusy) {
+		t.Errorf("got %v, expected ErrBusy", err)
+	}
+	if d := time.Since(start); d < c.pool.SearchAcquireTimeout {
+		t.Errorf("gave up after %s, before the acquire timeout", d)
+	}
+
+	// A slot released while waiting is acquired.
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		release1()
+	}()
+	c.pool.SearchAcquireTimeout = time.Minute
+	release3, err := c.acquireSearchSlot(ctx)
+	if err != nil {
+		t.Fatalf("got %v, expected a released slot", err)
+	}
+
+	// The context bounds the wait too.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.acquireSearchSlot(cctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, expected context.Canceled", err)
+	}
+	release2()
+	release3()
+}
+
+func TestSearchBusy(t *testing.T) {
+	c := newTestDBClient(t, WithPoolConfig(PoolConfig{
+		MaxOpenConns:         2,
+		MaxSearches:          1,
+		SearchAcquireTimeout: 50 * time.Millisecond,
+	}))
+	ctx := context.Background()
+	bucket := testBucketName()
+	insertTestEvent(t, c, time.Now(), bucket)
+	search := func() error {
+		sq := SearchQuery{Query: reqInfoQ, ExportFormat: "count", FParams: bucketFilter(reqInfoQ, bucket)}
+		var buf bytes.Buffer
+		return c.Search(ctx, &sq, &buf)
+	}
+
+	// While a search holds the only slot, concurrent searches fail fast.
+	release, err := c.acquireSearchSlot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = search()
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if !errors.Is(err, ErrBusy) {
+			t.Errorf("search %d: got %v, expected ErrBusy", i, err)
+		}
+	}
+
+	// Inserts do not use the slots of searches.
+	insertTestEvent(t, c, time.Now(), bucket)
+
+	release()
+	if err := search(); err != nil {
+		t.Errorf("search failed once the slot was released: %v", err)
+	}
+}
+
+func TestSearchRowsBusy(t *testing.T) {
+	c := newTestDBClient(t, WithPoolConfig(PoolConfig{
+		MaxOpenConns:         2,
+		MaxSearches:          1,
+		SearchAcquireTimeout: 50 * time.Millisecond,
+	}))
+	ctx := context.Background()
+	bucket := testBucketName()
+	insertTestEvent(t, c, time.Now(), bucket)
+	sq := SearchQuery{Query: reqInfoQ, PageSize: 10, FParams: bucketFilter(reqInfoQ, bucket)}
+
+	// An open iterator holds the only slot.
+	it, err := c.SearchRows(ctx, &sq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.SearchRows(ctx, &sq); !errors.Is(err, ErrBusy) {
+		t.Errorf("got SearchRows error %v, expected ErrBusy", err)
+	}
+	if err := c.StreamSearch(ctx, &sq, func(*StreamRow) error { return nil }); !errors.Is(err, ErrBusy) {
+		t.Errorf("got StreamSearch error %v, expected ErrBusy", err)
+	}
+	if _, err := c.SearchCombined(ctx, &sq); !errors.Is(err, ErrBusy) {
+		t.Errorf("got SearchCombined error %v, expected ErrBusy", err)
+	}
+
+	// Closing the iterator releases the slot.
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.SearchCombined(ctx, &sq); err != nil {
+		t.Errorf("SearchCombined failed once the slot was released: %v", err)
+	}
+}
@@ -15,13 +15,17 @@
 package server
 
 import (
-	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 type qType string
@@ -29,25 +33,212 @@ type qType string
 const (
 	rawQ     qType = "raw"
 	reqInfoQ qType = "reqinfo"
+	// joinedQ queries return request_info records along with the raw log of
+	// the same request. They support the filters of reqInfoQ queries.
+	joinedQ qType = "joined"
 )
 
 type fParam string
 
 var rawQRequestFieldsMap = map[fParam]fParam{
-	"bucket":          "log->'api'->>'bucket'",
-	"object":          "log->'api'->>'object'",
-	"api_name":        "log->'api'->>'name'",
-	"access_key":      "log->'api'->>'accessKey'",
-	"request_id":      "log->>'requestID'",
-	"user_agent":      "log->>'userAgent'",
-	"response_status": "log->'api'->>'status'",
+	"bucket":               "log->'api'->>'bucket'",
+	"object":               "log->'api'->>'object'",
+	"api_name":             "log->'api'->>'name'",
+	"access_key":           "log->'api'->>'accessKey'",
+	"request_id":           "log->>'requestID'",
+	"user_agent":           "log->>'userAgent'",
+	"remote_host":          "log->>'remotehost'",
+	"response_status":      "log->'api'->>'status'",
+	"response_status_code": "log->'api'->>'statusCode'",
+}
+
+// rawJSONPaths are the fields of the log column of audit_log_events, given as
+// dotted paths, that JSON path filters may match on.
+var rawJSONPaths = map[string]bool{
+	"version":        true,
+	"deploymentid":   true,
+	"api.name":       true,
+	"api.accessKey":  true,
+	"api.bucket":     true,
+	"api.object":     true,
+	"api.status":     true,
+	"api.statusCode": true,
+	"remotehost":     true,
+	"requestID":      true,
+	"userAgent":      true,
+}
+
+// jsonPathFParam returns the expression extracting, as text, the field of the
+// log column at the given dotted path, which must be one of rawJSONPaths.
+func jsonPathFParam(path string) (fParam, error) {
+	if !rawJSONPaths[path] {
+		return "", invalidQueryErrorf("Unknown JSON path filter param: %s", path)
+	}
+	return fParam(fmt.Sprintf("log #>> '{%s}'", strings.Replace(path, ".", ",", -1))), nil
+}
+
+// rawJSONObjectPaths are the fields of the log column holding durations or
+// JSON objects, that may only be tested for presence.
+var rawJSONObjectPaths = map[string]bool{
+	"api.timeToFirstByte": true,
+	"api.timeToResponse":  true,
+	"requestClaims":       true,
+	"requestQuery":        true,
+	"requestHeader":       true,
+	"responseHeader":      true,
+	"tags":                true,
+}
+
+// jsonPathPresenceClause returns the predicate selecting the records whose
+// log column has (or, when present is false, lacks) the field at the given
+// dotted path, which must be one of rawJSONPaths or rawJSONObjectPaths. The
+// key names of the path are bound as the positional argument dollar.
+func jsonPathPresenceClause(path string, present bool, dollar int) (string, interface{}, error) {
+	if !rawJSONPaths[path] && !rawJSONObjectPaths[path] {
+		return "", nil, invalidQueryErrorf("Unknown JSON path presence param: %s", path)
+	}
+	keys := strings.Split(path, ".")
+	if len(keys) == 1 {
+		// The ? operator may use a GIN index on the log column.
+		if present {
+			return fmt.Sprintf("log ? $%d", dollar), path, nil
+		}
+		return fmt.Sprintf("NOT (log ? $%d)", dollar), path, nil
+	}
+	if present {
+		return fmt.Sprintf("log #> $%d::text[] IS NOT NULL", dollar), pq.Array(keys), nil
+	}
+	return fmt.Sprintf("log #> $%d::text[] IS NULL", dollar), pq.Array(keys), nil
+}
+
+// containsFParams are filter params on free-form text fields, that support
+// case-insensitive substring matching.
+var containsFParams = map[string]bool{
+	"object":      true,
+	"user_agent":  true,
+	"remote_host": true,
+}
+
+// prefixFParams are filter params on identifier fields, that support
+// (case-sensitive) prefix matching.
+var prefixFParams = map[string]bool{
+	"access_key": true,
+}
+
+// suffixFParams are filter params on fields that support (case-sensitive)
+// suffix matching, e.g. by object name extension.
+var suffixFParams = map[string]bool{
+	"object": true,
+}
+
+// numericFParams are filter params on integer valued fields. They support
+// only exact matches.
+var numericFParams = map[string]bool{
+	"response_status_code": true,
+}
+
+// reqInfoNumericColumns are the request_info columns that numeric filters may
+// be applied to.
+var reqInfoNumericColumns = map[string]bool{
+	"time_to_response_ns":     true,
+	"response_status_code":    true,
+	"request_content_length":  true,
+	"response_content_length": true,
+}
+
+// numericFilterOps are the comparison operators allowed in numeric filters.
+// Two-character operators are listed first for parsing.
+var numericFilterOps = []string{"<=", ">=", "<", ">", "="}
+
+// NumericFilter compares a numeric column of the request_info table with a
+// value, e.g. `response_status_code >= 400`.
+type NumericFilter struct {
+	Column string
+	Op     string
+	Value  int64
+}
+
+func (f NumericFilter) validate() error {
+	if !reqInfoNumericColumns[f.Column] {
+		return invalidQueryErrorf("Unknown numeric filter column: %s", f.Column)
+	}
+	for _, op := range numericFilterOps {
+		if f.Op == op {
+			return nil
+		}
+	}
+	return invalidQueryErrorf("Invalid numeric filter operator: %s", f.Op)
 }
 
+// parseNumericFilter parses a numeric filter of the form `column<op>value`,
+// e.g. `response_content_length>5242880`.
+func parseNumericFilter(s string) (f NumericFilter, err error) {
+	i := strings.IndexAny(s, "<>=")
+	if i < 0 {
+		return f, fmt.Errorf("Invalid numeric filter: %s", s)
+	}
+	f.Column = s[:i]
+	for _, op := range numericFilterOps {
+		if strings.HasPrefix(s[i:], op) {
+			f.Op = op
+			break
+		}
+	}
+	valStr := s[i+len(f.Op):]
+	f.Value, err = strconv.ParseInt(valStr, 10, 64)
+	if err != nil {
+		return f, fmt.Errorf("Invalid value in numeric filter: %s", s)
+	}
+	return f, f.validate()
+}
+
+// ObjectPresence selects the request_info records by whether they are of an
+// object, as opposed to bucket-level or service-level operations (e.g.
+// ListBuckets), whose object is empty or NULL.
+type ObjectPresence int
+
+const (
+	// ObjectAny does not filter records by object.
+	ObjectAny ObjectPresence = iota
+	// ObjectEmpty selects the records without an object.
+	ObjectEmpty
+	// ObjectNonEmpty selects the records with an object.
+	ObjectNonEmpty
+)
+
+// objectPresenceNames are the names of the ObjectPresence values in query
+// parameters.
+var objectPresenceNames = map[string]ObjectPresence{
+	"any":      ObjectAny,
+	"empty":    ObjectEmpty,
+	"nonempty": ObjectNonEmpty,
+}
+
+// clause returns the where-clause predicate of p, which is empty for
+// ObjectAny.
+func (p ObjectPresence) clause() (string, error) {
+	switch p {
+	case ObjectAny:
+		return "", nil
+	case ObjectEmpty:
+		return "(object IS NULL OR object = '')", nil
+	case ObjectNonEmpty:
+		return "object <> ''", nil
+	}
+	return "", invalidQueryErrorf("Invalid object presence: %d", p)
+}
+
+// filterParamNames are the keys of filter params, which may also be given as
+// query parameters of their own, e.g. `bucket=photos`.
+var filterParamNames = []string{"bucket", "object", "api_name", "access_key", "request_id", "user_agent", "remote_host", "response_status", "response_status_code"}
+
 func stringToFParam(q qType, s string) (f fParam, err error) {
 	f = fParam(s)
-	switch f {
-	case "bucket", "object", "api_name", "access_key", "request_id", "user_agent", "response_status":
-	default:
+	known := false
+	for _, name := range filterParamNames {
+		known = known || name == s
+	}
+	if !known {
 		return "", fmt.Errorf("Unknown filter param: %s", s)
 	}
 	if q == rawQ {
@@ -62,56 +253,825 @@ func stringToFParam(q qType, s string) (f fParam, err error) {
 
 // SearchQuery represents a search query.
 type SearchQuery struct {
-	Query         qType
-	TimeStart     *time.Time
-	TimeEnd       *time.Time
-	LastDuration  *time.Duration
+	Query        qType
+	TimeStart    *time.Time
+	TimeEnd      *time.Time
+	LastDuration *time.Duration
+
+	// SortBy lists the columns to order the results by, in pages as well
+	// as in exports. When empty, the results are ordered by time, as per
+	// TimeAscending; otherwise, unless it has the time column, the results
+	// are finally ordered by time as per TimeAscending.
+	SortBy []SortField
+
+	// TimeEndInclusive makes TimeEnd an inclusive bound. By default the
+	// time range is half-open: records at exactly TimeEnd are excluded, so
+	// that consecutive ranges (e.g. the ranges of table partitions) do not
+	// overlap.
+	TimeEndInclusive bool
+
+	// SinceWatermark, when set, searches the records after the time of the
+	// named watermark (see DBClient.SetWatermark), for incremental exports,
+	// or all the records if the watermark was never set. It may not be set
+	// along with TimeStart or LastDuration, and is only supported by
+	// DBClient.Search and the methods sharing its output, e.g.
+	// SearchWithResult.
+	SinceWatermark string
+
 	TimeAscending bool
 	PageNumber    int
 	PageSize      int
-	ExportFormat  string
-	FParams       map[fParam]string
+
+	// Limit, when set, returns only the first Limit records (by default
+	// the most recent ones), instead of a page given by PageNumber and
+	// PageSize, which must then be zero. It is not supported with
+	// ExportFormat, Envelope or DataEnvelope, and is capped like PageSize
+	// by DBClient.MaxPageSize.
+	Limit *int
+
+	// ExportFormat, when not empty, selects the format to write all the
+	// matching records in, without pagination: "csv", "tsv", "ndjson",
+	// "parquet", "arrow" (an Arrow IPC stream) or "xlsx" (a workbook with a
+	// single sheet, which holds at most a million records). The "count"
+	// format writes only the number of matching records, as `{"count": n}`.
+	ExportFormat string
+
+	FParams    map[fParam][]string
+	FParamsNot map[fParam][]string
+
+	// FilterGroups restricts the results to the records matching any of
+	// the groups, a record matching a group when it matches all of its
+	// filters, e.g. `(bucket = X AND api_name = PutObject) OR (bucket = Y
+	// AND api_name = DeleteObject)`. Within a group, filters are matched
+	// like FParams. The groups are ANDed with the other filters.
+	FilterGroups []map[fParam][]string
+
+	// FParamsContains are filters matching the records whose field contains
+	// any of the given values, case-insensitively. The values are matched
+	// literally, i.e. they are not glob patterns. Only the params in
+	// containsFParams are supported.
+	FParamsContains map[fParam][]string
+
+	// FParamsPrefix are filters matching the records whose field starts
+	// with any of the given values, e.g. the access keys of the service
+	// accounts named `svc-*`. The values are matched literally, i.e. they
+	// are not glob patterns. Only the params in prefixFParams are
+	// supported.
+	FParamsPrefix map[fParam][]string
+
+	// FParamsSuffix are filters matching the records whose field ends with
+	// any of the given values, e.g. the objects with a `.mp4` extension.
+	// The values are matched literally and may not be empty. Records with
+	// no value for the field never match. Only the params in suffixFParams
+	// are supported.
+	FParamsSuffix map[fParam][]string
+
+	// JSONPathFilters are filters on fields of the log JSON of rawQ
+	// records, keyed by the dotted path of the field (e.g. "api.name"),
+	// which must be one of rawJSONPaths. Values are matched like those of
+	// FParams.
+	JSONPathFilters map[string][]string
+
+	// JSONPathExists and JSONPathMissing restrict rawQ results to the
+	// records whose log JSON has, respectively lacks, a field at each of the
+	// given dotted paths. A field holding a JSON null is present. The paths
+	// must be one of rawJSONPaths or rawJSONObjectPaths.
+	JSONPathExists  []string
+	JSONPathMissing []string
+
+	// StatusClasses restricts reqInfoQ results to the records whose HTTP
+	// response status code is in any of the given classes, given by their
+	// first digit (e.g. 5 for 5xx status codes), from 1 to 5.
+	StatusClasses []int
+
+	// OnlyErrors restricts reqInfoQ results to the records of failed
+	// requests, i.e. with a response status code of 400 or more. It
+	// combines with StatusClasses like any other filter.
+	OnlyErrors bool
+
+	// ObjectPresence restricts reqInfoQ results to the records with or
+	// without an object, e.g. to bucket-level operations.
+	ObjectPresence ObjectPresence
+
+	// RemoteHostCIDRs restricts reqInfoQ results to the records whose
+	// remote host is an IP address in any of the given CIDR ranges (e.g.
+	// "10.2.0.0/16" or "2001:db8::/32"). Records whose remote host is not
+	// an IP address are excluded.
+	RemoteHostCIDRs []string
+
+	// APINames restricts the results to the records of any of the given
+	// APIs (e.g. "PutObject" or "CopyObject"), matched exactly. It is empty
+	// when the results are not restricted by API.
+	APINames []string
+
+	// Versions restricts the results to the records of events of any of
+	// the given versions of the audit format (e.g. "1"), matched exactly.
+	// For raw queries, the version is the one in the log. It is empty when
+	// the results are not restricted by version.
+	Versions []string
+
+	// CategoryFilter restricts the results to the records of APIs in any of
+	// the given operation categories (e.g. "Read" or "Write"), as mapped by
+	// DBClient.OperationCategories.
+	CategoryFilter []string
+
+	// NumericFilters are comparisons on numeric columns. They are
+	// supported only by reqInfoQ queries.
+	NumericFilters []NumericFilter
+
+	// Envelope wraps a page of results (i.e. when ExportFormat is empty) in
+	// an object along with the page number, page size and total number of
+	// matching records, instead of returning a bare JSON array.
+	Envelope bool
+
+	// DataEnvelope is like Envelope, but wraps a page of results in an
+	// object of the form `{"data": [...], "page": n, "pageSize": m,
+	// "hasMore": b}`, where hasMore tells if there are further pages. This
+	// is cheaper than Envelope, as it does not count all matching records.
+	DataEnvelope bool
+
+	// LogContains, when not empty, restricts rawQ queries to the records
+	// whose log, as JSON text, contains it (case-insensitively). This is a
+	// full scan of the log column and is slow on large tables, unless a
+	// trigram index exists on `log::text`. Note that characters escaped in
+	// JSON strings (such as quotes) must be given escaped.
+	LogContains string
+
+	// IntsAsStrings outputs the 64-bit integer fields of reqInfoQ records
+	// (latency and content lengths) as strings, in JSON as well as CSV
+	// (where they are always quoted), so that consumers that cannot
+	// represent integers above 2^53 do not lose precision.
+	IntsAsStrings bool
+
+	// OmitEmpty leaves the fields that are empty strings, zero numbers or
+	// null out of the records output as JSON, i.e. in ndjson exports and
+	// pages of results, to cut their size. Only the top-level fields are
+	// left out: the logs of rawQ (and joinedQ) records are output whole. By
+	// default all the fields are output.
+	OmitEmpty bool
+
+	// RowTransform, when set, is called with each record of the pages of
+	// results and ndjson exports of Search, and of Tail, after redaction,
+	// and the value it returns is output instead, e.g. to add a derived
+	// field or rename one. The record is a LogEventRow, ReqInfoRow or
+	// JoinedRow as per the query. A returned ReqInfoRow is still output as
+	// per Columns and IntsAsStrings, while values of other types are
+	// encoded as they are. The search fails with a *RowTransformError if it
+	// returns an error. It is called in the hot path of searches, so it
+	// should be cheap.
+	//
+	// Its scope is limited to JSON output: as the csv, tsv, parquet, arrow
+	// and xlsx export formats have fixed columns, searches with them fail
+	// with an ErrInvalidQuery error, like SearchCombined. It is not
+	// applied to the records returned by SearchRows, which callers may
+	// transform themselves, nor to aggregations.
+	RowTransform func(row interface{}) (interface{}, error)
+
+	// IncludeManifest has ndjson exports start with a manifest record
+	// describing the export, marked with a `"_manifest": true` field so
+	// that consumers may tell it from the records, e.g. to archive the
+	// search along with its results.
+	IncludeManifest bool
+
+	// NullAs is output in CSV and TSV exports of reqInfoQ (and joinedQ)
+	// records for NULL columns, e.g. `\N` to re-import them with the
+	// COPY command of Postgres. By default NULL columns are output as empty
+	// fields, like empty strings.
+	NullAs string
+
+	// CSVOptions, when set, customize the csv and tsv exports, e.g. to
+	// leave out the header or to delimit fields with pipes. By default
+	// the exports have a header and are delimited by the delimiter of their
+	// format.
+	CSVOptions *CSVOptions
+
+	// BestEffort has an export read the partitions of the searched table
+	// one by one, skipping those that fail to be read, e.g. as they are
+	// dropped or corrupt, instead of failing. The skipped partitions are
+	// reported in SearchResult.SkippedPartitions. It is only supported for
+	// rawQ and reqInfoQ exports in the ndjson, csv, tsv, parquet and arrow
+	// formats, ordered by time, and not with hypertables.
+	BestEffort bool
+
+	// DedupByRequestID keeps only the latest of the reqInfoQ records
+	// matching the search for each request ID, since a request may be
+	// logged more than once, e.g. by retries. Records without a request ID
+	// are all kept. The paging and ordering of the search apply to the
+	// remaining records. Aggregations and deletions ignore it.
+	DedupByRequestID bool
+
+	// TimeTruncate, when positive, rounds down the timestamps of the output
+	// records to a multiple of it (e.g. a second or a minute). It does not
+	// affect the time range filters.
+	TimeTruncate time.Duration
+
+	// Encoding, when not empty, is the encoding the output is compressed
+	// with, whatever its format: EncodingGzip or EncodingZstd, or
+	// EncodingNone for no compression. NegotiateEncoding selects it from
+	// the Accept-Encoding header of an HTTP request.
+	Encoding string
+
+	// DisplayTimeZone, when not empty, is the IANA name of the time zone
+	// (e.g. "America/New_York") the timestamps of the output records are
+	// converted to, in JSON as well as in the CSV, TSV and xlsx exports,
+	// instead of UTC. Only the presentation changes: the time range
+	// filters are unaffected, and so are the parquet and arrow exports,
+	// whose timestamps are instants.
+	DisplayTimeZone string
+
+	// AllowedBuckets, when not empty, restricts the search to the records
+	// of the given buckets, whatever the filters of the search: the
+	// restriction is ANDed to the where-clause, so that a tenant limited to
+	// its own buckets cannot see other buckets by omitting or spoofing a
+	// bucket filter. Unlike filter values, the buckets are matched exactly.
+	// It is meant to be set by the server, not from user input.
+	AllowedBuckets []string
+
+	// Columns, when not empty, are the only request_info columns selected
+	// and output by reqInfoQ queries, in the given order, in JSON as well
+	// as in the export formats. Each must be one of the columns of the
+	// request_info table. Records returned by SearchRows have the fields
+	// of the other columns left zero.
+	Columns []string
+
+	// RedactColumns are the request_info columns, among the text columns
+	// but the time, whose values are replaced with RedactedValue in the
+	// output records, in all formats, e.g. access_key for viewers who may
+	// not see access keys. The redaction is applied to the records once
+	// scanned, and the search may not filter, sort or select them. For
+	// rawQ and joinedQ searches, the fields of the logs holding the values
+	// of the columns are redacted, and other fields of the logs may be
+	// redacted by giving their dotted paths, e.g.
+	// `requestHeader.Authorization`. Empty and NULL values are left as they
+	// are. Like AllowedBuckets, it is meant to be set by the server, not
+	// from user input; DBClient.RedactColumns adds to it.
+	RedactColumns []string
+
+	// LogFields, when not empty, are the fields of the logs, given as
+	// dotted paths among the rawJSONPaths, e.g. `api.statusCode`, output as
+	// separate columns of CSV and TSV exports of rawQ searches in place of
+	// the whole log, in the given order. The header has the paths as the
+	// names of the columns, and fields missing from a log are left empty.
+	LogFields []string
+
+	// TraceID identifies the search in the comment tagging its statements
+	// on clients with TagStatements set. It may only have letters, digits,
+	// dashes and underscores. It is meant to be set by the server, e.g.
+	// with NewTraceID, not from user input.
+	TraceID string
+}
+
+// SortField is a column to order search results by.
+type SortField struct {
+	Column     string
+	Descending bool
+}
+
+// reqInfoSortColumns are the request_info columns results may be sorted by.
+var reqInfoSortColumns = map[string]bool{
+	"time":                    true,
+	"api_name":                true,
+	"access_key":              true,
+	"bucket":                  true,
+	"object":                  true,
+	"time_to_response_ns":     true,
+	"remote_host":             true,
+	"request_id":              true,
+	"user_agent":              true,
+	"response_status":         true,
+	"response_status_code":    true,
+	"request_content_length":  true,
+	"response_content_length": true,
+	"version":                 true,
+}
+
+// exportFormats are the supported values of SearchQuery.ExportFormat.
+var exportFormats = []string{"csv", "tsv", "ndjson", "parquet", "arrow", "xlsx", "count"}
+
+func isExportFormat(format string) bool {
+	for _, f := range exportFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the fields of the search query that the where-clause
+// builders rely on, returning a *ValidationError for the first invalid field.
+func (s *SearchQuery) Validate() error {
+	if s.Query != rawQ && s.Query != reqInfoQ && s.Query != joinedQ {
+		return &ValidationError{Field: "Query", Msg: fmt.Sprintf("unknown query name %q", s.Query)}
+	}
+	if err := validateTraceID(s.TraceID); err != nil {
+		return &ValidationError{Field: "TraceID", Msg: err.Error()}
+	}
+	if s.LastDuration != nil {
+		if s.TimeStart != nil || s.TimeEnd != nil {
+			return &ValidationError{Field: "LastDuration", Msg: "may not be set along with TimeStart or TimeEnd"}
+		}
+		if *s.LastDuration < 0 {
+			return &ValidationError{Field: "LastDuration", Msg: "must not be negative"}
+		}
+	}
+	if s.SinceWatermark != "" && (s.TimeStart != nil || s.LastDuration != nil) {
+		return &ValidationError{Field: "SinceWatermark", Msg: "may not be set along with TimeStart or LastDuration"}
+	}
+	if s.RowTransform != nil && s.ExportFormat != "" && s.ExportFormat != "ndjson" && s.ExportFormat != "count" {
+		return &ValidationError{Field: "RowTransform", Msg: fmt.Sprintf("not supported by the %s export format", s.ExportFormat)}
+	}
+	if s.PageSize < 0 {
+		return &ValidationError{Field: "PageSize", Msg: "must not be negative"}
+	}
+	if s.PageNumber < 0 {
+		return &ValidationError{Field: "PageNumber", Msg: "must not be negative"}
+	}
+	if s.Limit != nil {
+		switch {
+		case *s.Limit < 1:
+			return &ValidationError{Field: "Limit", Msg: "must be positive"}
+		case s.PageNumber != 0 || s.PageSize != 0:
+			return &ValidationError{Field: "Limit", Msg: "may not be set along with PageNumber or PageSize"}
+		case s.ExportFormat != "":
+			return &ValidationError{Field: "Limit", Msg: "may not be set along with ExportFormat"}
+		case s.Envelope || s.DataEnvelope:
+			return &ValidationError{Field: "Limit", Msg: "may not be set along with Envelope or DataEnvelope"}
+		}
+	}
+	for i, group := range s.FilterGroups {
+		if len(group) == 0 {
+			// An empty group would match every record.
+			return &ValidationError{Field: fmt.Sprintf("FilterGroups[%d]", i), Msg: "has no filters"}
+		}
+		for k, vs := range group {
+			if len(vs) == 0 {
+				return &ValidationError{Field: fmt.Sprintf("FilterGroups[%d]", i), Msg: fmt.Sprintf("has no values for %s", k)}
+			}
+		}
+	}
+	if len(s.Columns) > 0 {
+		if s.Query != reqInfoQ {
+			return &ValidationError{Field: "Columns", Msg: fmt.Sprintf("only supported for %s queries", reqInfoQ)}
+		}
+		seen := make(map[string]bool, len(s.Columns))
+		for _, col := range s.Columns {
+			if !reqInfoSortColumns[col] {
+				return &ValidationError{Field: "Columns", Msg: fmt.Sprintf("unknown column %q", col)}
+			}
+			if seen[col] {
+				return &ValidationError{Field: "Columns", Msg: fmt.Sprintf("duplicate column %q", col)}
+			}
+			seen[col] = true
+		}
+	}
+	for k, vs := range s.FParamsSuffix {
+		for _, v := range vs {
+			if v == "" {
+				// An empty suffix would match every record.
+				return &ValidationError{Field: "FParamsSuffix", Msg: fmt.Sprintf("has an empty value for %s", k)}
+			}
+		}
+	}
+	if err := s.validateRedactColumns(); err != nil {
+		return err
+	}
+	if err := s.validateLogFields(); err != nil {
+		return err
+	}
+	if s.OmitEmpty && s.ExportFormat != "" && s.ExportFormat != "ndjson" {
+		return &ValidationError{Field: "OmitEmpty", Msg: "only supported with the ndjson export format"}
+	}
+	if s.IncludeManifest && s.ExportFormat != "ndjson" {
+		return &ValidationError{Field: "IncludeManifest", Msg: "only supported with the ndjson export format"}
+	}
+	if s.CSVOptions != nil {
+		if s.ExportFormat != "csv" && s.ExportFormat != "tsv" {
+			return &ValidationError{Field: "CSVOptions", Msg: "only supported with the csv and tsv export formats"}
+		}
+		if d := s.CSVOptions.Delimiter; d != 0 && !isCSVDelimiter(d) {
+			return &ValidationError{Field: "CSVOptions", Msg: fmt.Sprintf("unsupported delimiter %q", d)}
+		}
+		if s.CSVOptions.FlushEvery < 0 {
+			return &ValidationError{Field: "CSVOptions", Msg: fmt.Sprintf("negative FlushEvery %d", s.CSVOptions.FlushEvery)}
+		}
+	}
+	if s.BestEffort {
+		switch {
+		case s.Query == joinedQ:
+			return &ValidationError{Field: "BestEffort", Msg: fmt.Sprintf("not supported for %s queries", joinedQ)}
+		case s.ExportFormat == "" || s.ExportFormat == "count" || s.ExportFormat == "xlsx":
+			return &ValidationError{Field: "BestEffort", Msg: "only supported with the ndjson, csv, tsv, parquet and arrow export formats"}
+		case len(s.SortBy) > 0:
+			return &ValidationError{Field: "BestEffort", Msg: "may not be set along with SortBy"}
+		}
+	}
+	if s.DedupByRequestID {
+		switch {
+		case s.Query != reqInfoQ:
+			return &ValidationError{Field: "DedupByRequestID", Msg: fmt.Sprintf("only supported for %s queries", reqInfoQ)}
+		case s.BestEffort:
+			return &ValidationError{Field: "DedupByRequestID", Msg: "may not be set along with BestEffort"}
+		}
+	}
+	if s.Encoding != "" && !isEncoding(s.Encoding) {
+		return &ValidationError{Field: "Encoding", Msg: fmt.Sprintf("unsupported encoding %q (must be one of %s)", s.Encoding, strings.Join(encodings, ", "))}
+	}
+	if s.DisplayTimeZone != "" {
+		if _, err := displayLocation(s.DisplayTimeZone); err != nil {
+			return &ValidationError{Field: "DisplayTimeZone", Msg: fmt.Sprintf("unknown time zone %q", s.DisplayTimeZone)}
+		}
+	}
+	if s.ExportFormat != "" && !isExportFormat(s.ExportFormat) {
+		return &ValidationError{Field: "ExportFormat", Msg: fmt.Sprintf("unsupported format %q (must be one of %s)", s.ExportFormat, strings.Join(exportFormats, ", "))}
+	}
+	return nil
+}
+
+// sortColumn returns the SQL expression to sort results of q queries by the
+// given column.
+func sortColumn(q qType, column string) (string, error) {
+	switch q {
+	case rawQ:
+		if column == "event_time" || column == "time" {
+			return "event_time", nil
+		}
+		if expr, ok := rawQRequestFieldsMap[fParam(column)]; ok {
+			return string(expr), nil
+		}
+	case reqInfoQ, joinedQ:
+		if reqInfoSortColumns[column] {
+			return column, nil
+		}
+	}
+	return "", invalidQueryErrorf("Invalid sort column for %s query: %s", q, column)
+}
+
+// orderByClause returns the list of expressions to order the results of s by.
+func (s *SearchQuery) orderByClause() (string, error) {
+	timeCol := "time"
+	if s.Query == rawQ {
+		timeCol = "event_time"
+	}
+	timeOrder := timeCol + " DESC"
+	if s.TimeAscending {
+		timeOrder = timeCol + " ASC"
+	}
+	if len(s.SortBy) == 0 {
+		return timeOrder, nil
+	}
+
+	exprs := make([]string, len(s.SortBy), len(s.SortBy)+1)
+	sortedByTime := false
+	for i, f := range s.SortBy {
+		col, err := sortColumn(s.Query, f.Column)
+		if err != nil {
+			return "", err
+		}
+		sortedByTime = sortedByTime || col == timeCol
+		dir := "ASC"
+		if f.Descending {
+			dir = "DESC"
+		}
+		if f.Descending && col != "time" && col != "event_time" {
+			// Records missing a field come last, as they do by
+			// default in ascending order. The time columns are NOT
+			// NULL, and their ordering is left as is so that it
+			// matches their indexes.
+			dir += " NULLS LAST"
+		}
+		exprs[i] = col + " " + dir
+	}
+	if !sortedByTime {
+		// Records with the same values of the sort columns are
+		// ordered by time, so that pages and exports are stable.
+		exprs = append(exprs, timeOrder)
+	}
+	return strings.Join(exprs, ", "), nil
+}
+
+// parseSortField parses a sort field of the form `column` or
+// `column:asc|desc`.
+func parseSortField(v string) (SortField, error) {
+	ps := strings.SplitN(v, ":", 2)
+	f := SortField{Column: ps[0]}
+	if len(ps) == 2 {
+		switch strings.ToLower(ps[1]) {
+		case "asc":
+		case "desc":
+			f.Descending = true
+		default:
+			return f, fmt.Errorf("Invalid sort direction: %s", ps[1])
+		}
+	}
+	return f, nil
+}
+
+// isMatchAllPattern returns true if the filter value v is a glob pattern
+// matching any value, such as `*`.
+func isMatchAllPattern(v string) bool {
+	return v != "" && strings.Trim(v, "*") == ""
+}
+
+// paramsFilter returns true if any param of m filters records, i.e. has
+// values, none of which matches any value as told by matchesAll.
+func paramsFilter(m map[fParam][]string, matchesAll func(v string) bool) bool {
+	for _, vs := range m {
+		filters := len(vs) > 0
+		for _, v := range vs {
+			filters = filters && !matchesAll(v)
+		}
+		if filters {
+			return true
+		}
+	}
+	return false
+}
+
+// hasFilters returns true if s has any filter besides its time range. Params
+// matching any value, with a `*` pattern or an empty substring, prefix or
+// suffix, are not filters.
+func (s *SearchQuery) hasFilters() bool {
+	isEmpty := func(v string) bool { return v == "" }
+	never := func(v string) bool { return false }
+	if paramsFilter(s.FParams, isMatchAllPattern) || paramsFilter(s.FParamsNot, never) ||
+		paramsFilter(s.FParamsContains, isEmpty) || paramsFilter(s.FParamsPrefix, isEmpty) || paramsFilter(s.FParamsSuffix, isEmpty) {
+		return true
+	}
+	for _, vs := range s.JSONPathFilters {
+		if len(vs) > 0 {
+			return true
+		}
+	}
+	if len(s.JSONPathExists) > 0 || len(s.JSONPathMissing) > 0 {
+		return true
+	}
+	if len(s.FilterGroups) > 0 {
+		// The groups are alternatives, so all of them must filter.
+		groupsFilter := true
+		for _, group := range s.FilterGroups {
+			groupsFilter = groupsFilter && paramsFilter(group, isMatchAllPattern)
+		}
+		if groupsFilter {
+			return true
+		}
+	}
+	return len(s.NumericFilters) > 0 || len(s.APINames) > 0 || len(s.Versions) > 0 || len(s.CategoryFilter) > 0 || len(s.StatusClasses) > 0 || s.OnlyErrors || s.ObjectPresence != ObjectAny || len(s.RemoteHostCIDRs) > 0
+}
+
+// pageLimit returns the number of records to fetch for a page of results.
+func (s *SearchQuery) pageLimit() int {
+	if s.DataEnvelope {
+		// Fetch an extra record to find out if there are more pages.
+		return s.PageSize + 1
+	}
+	return s.PageSize
+}
+
+// pagingClause returns the clause selecting the records of the page of s,
+// along with its positional arguments numbered from dollarStart. It is empty
+// for exports, which are not paginated.
+func (s *SearchQuery) pagingClause(dollarStart int) (clause string, args []interface{}) {
+	switch {
+	case s.ExportFormat != "":
+		return "", nil
+	case s.Limit != nil:
+		return fmt.Sprintf("LIMIT $%d", dollarStart), []interface{}{*s.Limit}
+	}
+	return fmt.Sprintf("OFFSET $%d LIMIT $%d", dollarStart, dollarStart+1), []interface{}{s.PageNumber * s.PageSize, s.pageLimit()}
+}
+
+// outputTime returns t as it must be presented in the search results.
+func (s *SearchQuery) outputTime(t time.Time) time.Time {
+	if s.TimeTruncate > 0 {
+		t = t.Truncate(s.TimeTruncate)
+	}
+	if s.DisplayTimeZone != "" {
+		// The time zone is checked by Validate.
+		if loc, err := displayLocation(s.DisplayTimeZone); err == nil {
+			t = t.In(loc)
+		}
+	}
+	return t
+}
+
+// displayLocations caches the locations of the DisplayTimeZone of searches,
+// as time.LoadLocation reads the time zone database on every call.
+var displayLocations sync.Map
+
+// displayLocation returns the location of the IANA time zone name. The
+// "Local" zone of the server is not accepted.
+func displayLocation(name string) (*time.Location, error) {
+	if loc, ok := displayLocations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	if name == "Local" {
+		return nil, fmt.Errorf("unknown time zone %s", name)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	displayLocations.Store(name, loc)
+	return loc, nil
 }
 
-// searchQueryFromRequest creates a SearchQuery from the search parameters of a
-// HTTP request. The query parameters are:
+// ParseSearchQuery creates a SearchQuery from the given URL query parameters,
+// such as those of a search HTTP request, and validates it. An invalid query
+// parameter is reported with a *ParamError naming it. The query parameters
+// are:
 //
-// "q" - name of the query (a qType string constant). Required.
+// "q" - name of the query (a qType string constant). Required. `joined`
+// queries return `reqinfo` records along with the raw log of the request.
 //
 // "timeStart" - A timestamp bound for the first result to be returned.
-// Optional, defaults to current server time. Format is time.RFC3339Nano
+// Optional, no lower bound is applied when it is omitted (unless "last" or
+// "sinceWatermark" is given). Format is time.RFC3339Nano
+//
+// "timeEnd" - A timestamp bound for the last result to be returned. Results
+// at exactly this time are excluded, unless "timeEndInclusive" is given.
+// Optional. Format is time.RFC3339Nano
+//
+// "timeEndInclusive" - A flag (value is IGNORED) to include results at exactly
+// "timeEnd". Optional.
+//
+// "sinceWatermark" - The name of a watermark set by the scheduled exports, to
+// return the results after its time, or all the results if it was never set.
+// Optional, may not be specified with "timeStart" or "last".
+//
+// "limit" - The number of (most recent, by default) results to return,
+// instead of a page given by "pageSize" and "pageStart". Optional.
 //
 // "timeAsc" or "timeDesc" - A flag (value is IGNORED) that specifies the
 // ordering of results as ASCENDING time or DESCENDING time. Optional, defaults
 // to DESCENDING ordering. At most one of these must be specified.
 //
+// "sort" - Repeatable parameter to order results by a column, given as
+// `column:asc` or `column:desc` (the direction defaults to ascending). The
+// results are ordered by the first column, then by the second, and so on, and
+// finally by descending time unless a time column is given, in pages as well
+// as in exports. May not be specified with "timeAsc" or "timeDesc".
+//
 // "pageSize" - Maximum number of result records to return in a request.
-// Optional, defaults to 10. Allowed range is 10 to 1000.
+// Optional, defaults to 10. Allowed range is 10 to DefaultMaxPageSize, and
+// the search fails if it exceeds the MaxPageSize of the client.
+//
+// "pageStart" - 0-based page number of results. Optional, defaults to 0.
+//
+// "envelope" - A flag (value is IGNORED) to return a page of results in an
+// object of the form `{"results": [...], "page": n, "pageSize": m, "total":
+// t}`. Optional, a bare JSON array of results is returned by default.
+//
+// "dataEnvelope" - A flag (value is IGNORED) to return a page of results in an
+// object of the form `{"data": [...], "page": n, "pageSize": m, "hasMore":
+// b}`. Optional, may not be given with "envelope".
+//
+// "export" - Format to return all matching results in, without pagination:
+// one of `csv`, `tsv`, `ndjson`, `parquet`, `arrow` or `xlsx`. The `count`
+// format returns only the number of matching results, as `{"count": n}`.
+// Optional.
 //
-// "pageNo" - 0-based page number of results. Optional, defaults to 0.
+// "timeTruncate" - A duration (e.g. `1s` or `1m`) to round down the timestamps
+// of the returned records to. Optional, timestamps are not rounded by default.
+//
+// "timeZone" - The IANA name of the time zone (e.g. `America/New_York`) to
+// present the timestamps of the returned records in. Optional, timestamps are
+// in UTC by default. The time range parameters are not affected.
+//
+// "intsAsStrings" - A flag (value is IGNORED) to output the 64-bit integer
+// fields of `reqinfo` records as (quoted) strings, in JSON, CSV and TSV output.
+// Optional.
+//
+// "manifest" - A flag (value is IGNORED) to start `ndjson` exports with a
+// manifest record describing the export, such as its search parameters and
+// time range, marked with a `"_manifest": true` field. Optional.
+//
+// "omitEmpty" - A flag (value is IGNORED) to leave the empty fields (empty
+// strings, zero numbers and nulls) out of the records output as JSON, in pages
+// of results and `ndjson` exports. Optional.
+//
+// "logContains" - Text to search for anywhere in the log of `raw` queries,
+// case-insensitively. Optional. This is a slow full scan on large tables.
 //
 // "fp" - Repeatable parameter to specify key-value match filters. The format is
 // `key:value-pattern`, where key is the name of a field to match on, and
 // value-pattern is a glob expression using `.` to signify a single character
 // match and a `*` to match any text. For example, `bucket:photos-*` matches any
 // bucket with a "photos-" prefix. To match a literal '.' or '*' prefix with
-// '\'. To match a literal '\', just double it: '\\'.
-func searchQueryFromRequest(r *http.Request) (*SearchQuery, error) {
-	values, err := url.ParseQuery(r.URL.RawQuery)
-	if err != nil {
-		return nil, err
-	}
+// '\'. To match a literal '\', just double it: '\\'. When the same key is
+// given more than once, records matching any of the given values are returned.
+// Prefixing the key with '!' (e.g. `!api_name:DeleteObject`) negates the
+// filter, so that only records NOT matching any of its values are returned.
+// Prefixing the key with '~' (e.g. `~user_agent:curl`) matches the records
+// whose field contains the value, case-insensitively; this is supported for
+// the `object`, `user_agent` and `remote_host` keys only. Prefixing the key
+// with '^' (e.g. `^access_key:svc-`) matches the records whose field starts
+// with the value, which is matched literally; this is supported for the
+// `access_key` key only. Prefixing the key with '$' (e.g. `$object:.mp4`)
+// matches the records whose field ends with the (non-empty) value, which is
+// matched literally; this is supported for the `object` key only.
+//
+// "bucket", "object", "api_name", "access_key", "request_id", "user_agent",
+// "remote_host", "response_status", "response_status_code" - Repeatable
+// parameters to specify key-value match filters like "fp", e.g.
+// `bucket=photos&bucket=videos` is the same as
+// `fp=bucket:photos&fp=bucket:videos`.
+//
+// "fg" - Repeatable parameter to specify groups of filters, such that records
+// matching all the filters of any of the groups are returned. The format is
+// `group:key:value-pattern`, where group is a label naming the group of the
+// filter (e.g. `1` or `a`) and `key:value-pattern` is matched like for "fp",
+// except that it may not be negated nor match substrings. For example,
+// `fg=1:bucket:photos&fg=1:api_name:PutObject&fg=2:api_name:DeleteObject`
+// returns the uploads to the photos bucket along with all the deletions.
+//
+// "apiName" - Repeatable parameter to select the records of the given API,
+// such as `PutObject`. When given more than once, records of any of the APIs
+// are returned.
+//
+// "version" - Repeatable parameter to select the records of events of the
+// given version of the audit format, such as `1`. When given more than once,
+// records of any of the versions are returned.
+//
+// "category" - Repeatable parameter to select the records of APIs in the given
+// operation category, such as `Read`, `Write`, `List`, `Admin` or `Other`.
+// When given more than once, records in any of the categories are returned.
+//
+// "jp" - Repeatable parameter to specify filters on fields of the log JSON of
+// `raw` queries. The format is `path:value-pattern`, where path is the dotted
+// path of the field (e.g. `api.name` or `requestID`) and value-pattern is
+// matched like for "fp". Only a fixed set of paths is supported.
+//
+// "jpExists", "jpMissing" - Repeatable parameters selecting the records of
+// `raw` queries whose log JSON has, respectively lacks, a field at the given
+// dotted path (e.g. `tags` or `api.timeToFirstByte`). The paths supported by
+// "jp" are accepted, along with a few fields holding objects or durations.
+//
+// "columns" - A comma-separated list of the columns of `reqinfo` records to
+// return, in order, e.g. `time,api_name,bucket`. Optional, all the columns are
+// returned by default.
+//
+// "logFields" - A comma-separated list of the dotted paths of fields of the
+// logs output as columns of `csv` and `tsv` exports of `raw` queries in place
+// of the whole log, e.g. `api.name,api.statusCode`. Optional.
+//
+// "nullAs" - The value to output for NULL columns in `csv` and `tsv` exports
+// of `reqinfo` and `joined` records, e.g. `\N`. Optional, defaults to an
+// empty field.
+//
+// "noHeader" - A flag (value is IGNORED) to leave the header out of `csv` and
+// `tsv` exports. Optional.
+//
+// "delimiter" - The field delimiter of `csv` and `tsv` exports: one of `,`,
+// `|`, `;` or a tab. Optional, defaults to a comma for `csv` and a tab for
+// `tsv`.
+//
+// "flushEvery" - A number of records after which the records of `csv` and
+// `tsv` exports are flushed to the response, so that large exports stream out
+// incrementally. Optional, records are flushed only at the end by default.
+//
+// "bestEffort" - A flag (value is IGNORED) to skip the partitions that fail
+// to be read in `ndjson`, `csv`, `tsv`, `parquet` and `arrow` exports of `raw`
+// and `reqinfo` records ordered by time, instead of failing. The skipped
+// partitions are listed in the `X-Skipped-Partitions` trailer of the
+// response. Optional.
+//
+// "dedup" - A flag (value is IGNORED) to return only the latest `reqinfo`
+// record of each request ID among the matching records. Optional.
+//
+// "statusClass" - Repeatable parameter to select the `reqinfo` (or `joined`)
+// records with a response status code in the given class, such as `4xx` or
+// `5xx`. When given more than once, records in any of the classes are
+// returned.
+//
+// "onlyErrors" - A flag (value is IGNORED) to select the `reqinfo` (or
+// `joined`) records with a response status code of 400 or more. Optional.
+//
+// "objectPresence" - Selects the `reqinfo` (or `joined`) records by whether
+// they have an object: `empty` for the bucket-level and service-level
+// operations (e.g. `ListBuckets`), `nonempty` for the object-level ones, or
+// `any`. Optional, `any` by default.
+//
+// "cidr" - Repeatable parameter to select the `reqinfo` (or `joined`) records
+// whose remote host is an IP address in the given CIDR range, such as
+// `10.2.0.0/16` or `2001:db8::/32`. When given more than once, records in any
+// of the ranges are returned.
+//
+// "nf" - Repeatable parameter to specify numeric comparison filters for
+// `reqinfo` and `joined` queries. The format is `column<op>value` where op is
+// one of `<`, `<=`, `>`, `>=` or `=`. For example, `response_status_code>=400`.
+func ParseSearchQuery(values url.Values) (*SearchQuery, error) {
+	var err error
 
 	q := qType(values.Get("q"))
-	if q != rawQ && q != reqInfoQ {
-		return nil, fmt.Errorf("Invalid query name: %s", string(q))
+	if q != rawQ && q != reqInfoQ && q != joinedQ {
+		return nil, paramErrorf("q", "Invalid query name: %s", string(q))
 	}
 
 	var timeStart *time.Time
 	if timeParam := values.Get("timeStart"); timeParam != "" {
 		ts, err := parseSQTimeString(timeParam)
 		if err != nil {
-			return nil, fmt.Errorf("Invalid start date (must be RFC3339 format): %s", timeParam)
+			return nil, paramErrorf("timeStart", "Invalid start date (must be RFC3339 format): %s", timeParam)
 		}
 		timeStart = &ts
 	}
@@ -120,27 +1080,52 @@ func searchQueryFromRequest(r *http.Request) (*SearchQuery, error) {
 	if timeParam := values.Get("timeEnd"); timeParam != "" {
 		ts, err := parseSQTimeString(timeParam)
 		if err != nil {
-			return nil, fmt.Errorf("Invalid start date (must be RFC3339 format): %s", timeParam)
+			return nil, paramErrorf("timeEnd", "Invalid end date (must be RFC3339 format): %s", timeParam)
 		}
 		timeEnd = &ts
 	}
 
+	_, timeEndInclusive := values["timeEndInclusive"]
+	if timeEndInclusive && timeEnd == nil {
+		return nil, paramErrorf("timeEndInclusive", "`timeEndInclusive` may only be specified with `timeEnd`")
+	}
+
 	var last *time.Duration
 	if lastDuration := values.Get("last"); lastDuration != "" {
 		d, err := time.ParseDuration(lastDuration)
 		if err != nil {
-			return nil, fmt.Errorf("Invalid `last` parameter: %s (Use for example `24h` or `90m`)", lastDuration)
+			return nil, paramErrorf("last", "Invalid `last` parameter: %s (Use for example `24h` or `90m`)", lastDuration)
 		}
 		if timeEnd != nil || timeStart != nil {
-			return nil, fmt.Errorf("`last` parameter cannot be specified with `timeStart` or `timeEnd`")
+			return nil, paramErrorf("last", "`last` parameter cannot be specified with `timeStart` or `timeEnd`")
 		}
 		last = &d
 	}
 
+	sinceWatermark := values.Get("sinceWatermark")
+	if sinceWatermark != "" && (timeStart != nil || last != nil) {
+		return nil, paramErrorf("sinceWatermark", "`sinceWatermark` parameter cannot be specified with `timeStart` or `last`")
+	}
+
+	var timeTruncate time.Duration
+	if truncParam := values.Get("timeTruncate"); truncParam != "" {
+		timeTruncate, err = time.ParseDuration(truncParam)
+		if err != nil || timeTruncate <= 0 {
+			return nil, paramErrorf("timeTruncate", "Invalid `timeTruncate` parameter: %s (Use for example `1s` or `1m`)", truncParam)
+		}
+	}
+
+	displayTimeZone := values.Get("timeZone")
+	if displayTimeZone != "" {
+		if _, err := displayLocation(displayTimeZone); err != nil {
+			return nil, paramErrorf("timeZone", "Invalid `timeZone` parameter: %s (Use an IANA time zone name, e.g. `America/New_York`)", displayTimeZone)
+		}
+	}
+
 	export := ""
 	if exportParam := values.Get("export"); exportParam != "" {
-		if exportParam != "csv" && exportParam != "ndjson" {
-			return nil, fmt.Errorf("Only `csv` and `ndjson` export formats are supported")
+		if !isExportFormat(exportParam) {
+			return nil, paramErrorf("export", "Only `csv`, `tsv`, `ndjson`, `parquet`, `arrow`, `xlsx` and `count` export formats are supported")
 		}
 		export = exportParam
 	}
@@ -148,69 +1133,425 @@ func searchQueryFromRequest(r *http.Request) (*SearchQuery, error) {
 	pageSize := 10
 	if psParam := values.Get("pageSize"); psParam != "" {
 		if export != "" {
-			return nil, fmt.Errorf("`pageSize` may not be specified with `export`")
+			return nil, paramErrorf("pageSize", "`pageSize` may not be specified with `export`")
 		}
 
 		pageSize, err = strconv.Atoi(psParam)
 		if err != nil {
-			return nil, fmt.Errorf("Invalid pageSize parameter: %s", psParam)
+			return nil, paramErrorf("pageSize", "Invalid pageSize parameter: %s", psParam)
 		}
-		if pageSize < 10 || pageSize > 10000 {
-			return nil, fmt.Errorf("pageSize must be between 10 and 10000, got: %d", pageSize)
+		if pageSize < 10 || pageSize > DefaultMaxPageSize {
+			return nil, paramErrorf("pageSize", "pageSize must be between 10 and %d, got: %d", DefaultMaxPageSize, pageSize)
 		}
 	}
 
 	var pageNumber int
 	if pnParam := values.Get("pageStart"); pnParam != "" {
 		if export != "" {
-			return nil, fmt.Errorf("`pageStart` may not be specified with `export`")
+			return nil, paramErrorf("pageStart", "`pageStart` may not be specified with `export`")
 		}
 
 		pageNumber, err = strconv.Atoi(pnParam)
 		if err != nil {
-			return nil, fmt.Errorf("Invalid pageStart parameter: %s", pnParam)
+			return nil, paramErrorf("pageStart", "Invalid pageStart parameter: %s", pnParam)
 		}
 	}
 
+	var limit *int
+	if limitParam := values.Get("limit"); limitParam != "" {
+		if export != "" || values.Get("pageSize") != "" || values.Get("pageStart") != "" {
+			return nil, paramErrorf("limit", "`limit` may not be specified with `export`, `pageSize` or `pageStart`")
+		}
+		n, err := strconv.Atoi(limitParam)
+		if err != nil || n < 1 || n > DefaultMaxPageSize {
+			return nil, paramErrorf("limit", "limit must be between 1 and %d, got: %s", DefaultMaxPageSize, limitParam)
+		}
+		limit = &n
+		pageSize = 0
+	}
+
 	m := map[string][]string(values)
 
 	_, isTimeAsc := m["timeAsc"]
 	_, isTimeDesc := m["timeDesc"]
 	if isTimeDesc && isTimeAsc {
-		return nil, errors.New("both timeasc and timedesc may not be specified")
+		return nil, paramErrorf("timeAsc", "both timeasc and timedesc may not be specified")
 	}
 	var timeAscending bool
 	if isTimeAsc {
 		timeAscending = true
 	}
 
-	var fParams map[fParam]string
+	var sortBy []SortField
+	for _, v := range m["sort"] {
+		if isTimeAsc || isTimeDesc {
+			return nil, paramErrorf("sort", "sort may not be specified with timeasc or timedesc")
+		}
+		f, err := parseSortField(v)
+		if err != nil {
+			return nil, &ParamError{Param: "sort", Err: err}
+		}
+		if _, err := sortColumn(q, f.Column); err != nil {
+			return nil, &ParamError{Param: "sort", Err: err}
+		}
+		sortBy = append(sortBy, f)
+	}
+
+	_, envelope := m["envelope"]
+	if envelope && export != "" {
+		return nil, paramErrorf("envelope", "`envelope` may not be specified with `export`")
+	}
+	_, dataEnvelope := m["dataEnvelope"]
+	if dataEnvelope && export != "" {
+		return nil, paramErrorf("dataEnvelope", "`dataEnvelope` may not be specified with `export`")
+	}
+	if dataEnvelope && envelope {
+		return nil, paramErrorf("dataEnvelope", "`dataEnvelope` and `envelope` may not both be specified")
+	}
+
+	var fParams, fParamsNot, fParamsContains, fParamsPrefix, fParamsSuffix map[fParam][]string
 	if vs, ok := m["fp"]; ok {
-		fParams = make(map[fParam]string)
+		fParams = make(map[fParam][]string)
+		fParamsNot = make(map[fParam][]string)
+		fParamsContains = make(map[fParam][]string)
+		fParamsPrefix = make(map[fParam][]string)
+		fParamsSuffix = make(map[fParam][]string)
 		for _, v := range vs {
 			ps := strings.SplitN(v, ":", 2)
 			if len(ps) != 2 {
-				return nil, fmt.Errorf("Invalid filter parameter: %s", v)
+				return nil, paramErrorf("fp", "Invalid filter parameter: %s", v)
+			}
+			name, negate, contains, prefix, suffix := ps[0], false, false, false, false
+			if strings.HasPrefix(name, "!") {
+				name, negate = name[1:], true
+			} else if strings.HasPrefix(name, "~") {
+				name, contains = name[1:], true
+				if !containsFParams[name] {
+					return nil, paramErrorf("fp", "Substring matching is not supported for filter param: %s", name)
+				}
+			} else if strings.HasPrefix(name, "^") {
+				name, prefix = name[1:], true
+				if !prefixFParams[name] {
+					return nil, paramErrorf("fp", "Prefix matching is not supported for filter param: %s", name)
+				}
+			} else if strings.HasPrefix(name, "$") {
+				name, suffix = name[1:], true
+				if !suffixFParams[name] {
+					return nil, paramErrorf("fp", "Suffix matching is not supported for filter param: %s", name)
+				}
+				if ps[1] == "" {
+					return nil, paramErrorf("fp", "Empty suffix for filter param: %s", name)
+				}
+			}
+			key, err := stringToFParam(q, name)
+			if err != nil {
+				return nil, &ParamError{Param: "fp", Err: err}
+			}
+			if numericFParams[name] {
+				if _, err := strconv.ParseInt(ps[1], 10, 64); err != nil {
+					return nil, paramErrorf("fp", "Invalid value for numeric filter param %s: %s", name, ps[1])
+				}
 			}
-			key, err := stringToFParam(q, ps[0])
+			if negate {
+				fParamsNot[key] = append(fParamsNot[key], ps[1])
+			} else if contains {
+				fParamsContains[key] = append(fParamsContains[key], ps[1])
+			} else if prefix {
+				fParamsPrefix[key] = append(fParamsPrefix[key], ps[1])
+			} else if suffix {
+				fParamsSuffix[key] = append(fParamsSuffix[key], ps[1])
+			} else {
+				fParams[key] = append(fParams[key], ps[1])
+			}
+		}
+	}
+	for _, name := range filterParamNames {
+		for _, v := range m[name] {
+			key, err := stringToFParam(q, name)
 			if err != nil {
-				return nil, err
+				return nil, &ParamError{Param: name, Err: err}
+			}
+			if numericFParams[name] {
+				if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+					return nil, paramErrorf(name, "Invalid value for numeric filter param %s: %s", name, v)
+				}
+			}
+			if fParams == nil {
+				fParams = make(map[fParam][]string)
+			}
+			fParams[key] = append(fParams[key], v)
+		}
+	}
+
+	var filterGroups []map[fParam][]string
+	groupIndex := make(map[string]int)
+	for _, v := range m["fg"] {
+		ps := strings.SplitN(v, ":", 3)
+		if len(ps) != 3 || ps[0] == "" {
+			return nil, paramErrorf("fg", "Invalid filter group parameter: %s", v)
+		}
+		key, err := stringToFParam(q, ps[1])
+		if err != nil {
+			return nil, &ParamError{Param: "fg", Err: err}
+		}
+		if numericFParams[ps[1]] {
+			if _, err := strconv.ParseInt(ps[2], 10, 64); err != nil {
+				return nil, paramErrorf("fg", "Invalid value for numeric filter param %s: %s", ps[1], ps[2])
+			}
+		}
+		i, ok := groupIndex[ps[0]]
+		if !ok {
+			i = len(filterGroups)
+			groupIndex[ps[0]] = i
+			filterGroups = append(filterGroups, make(map[fParam][]string))
+		}
+		filterGroups[i][key] = append(filterGroups[i][key], ps[2])
+	}
+
+	_, intsAsStrings := m["intsAsStrings"]
+	if intsAsStrings && q != reqInfoQ {
+		return nil, paramErrorf("intsAsStrings", "`intsAsStrings` is only supported for %s queries", reqInfoQ)
+	}
+
+	_, omitEmpty := m["omitEmpty"]
+	_, includeManifest := m["manifest"]
+	if includeManifest && export != "ndjson" {
+		return nil, paramErrorf("manifest", "`manifest` is only supported with the `ndjson` export format")
+	}
+	if omitEmpty && export != "" && export != "ndjson" {
+		return nil, paramErrorf("omitEmpty", "`omitEmpty` is only supported with the `ndjson` export format")
+	}
+
+	var columns []string
+	if columnsParam := values.Get("columns"); columnsParam != "" {
+		if q != reqInfoQ {
+			return nil, paramErrorf("columns", "`columns` is only supported for %s queries", reqInfoQ)
+		}
+		columns = strings.Split(columnsParam, ",")
+	}
+
+	var logFields []string
+	if logFieldsParam := values.Get("logFields"); logFieldsParam != "" {
+		if q != rawQ {
+			return nil, paramErrorf("logFields", "`logFields` is only supported for %s queries", rawQ)
+		}
+		if export != "csv" && export != "tsv" {
+			return nil, paramErrorf("logFields", "`logFields` is only supported with the `csv` and `tsv` export formats")
+		}
+		logFields = strings.Split(logFieldsParam, ",")
+	}
+
+	nullAs := values.Get("nullAs")
+	if _, ok := values["nullAs"]; ok {
+		if export != "csv" && export != "tsv" {
+			return nil, paramErrorf("nullAs", "`nullAs` is only supported with the `csv` and `tsv` export formats")
+		}
+		if q == rawQ {
+			return nil, paramErrorf("nullAs", "`nullAs` is not supported for %s queries", rawQ)
+		}
+	}
+
+	var csvOptions *CSVOptions
+	_, noHeader := values["noHeader"]
+	_, hasDelimiter := values["delimiter"]
+	_, hasFlushEvery := values["flushEvery"]
+	if noHeader || hasDelimiter || hasFlushEvery {
+		if export != "csv" && export != "tsv" {
+			param := "delimiter"
+			if noHeader {
+				param = "noHeader"
+			} else if hasFlushEvery {
+				param = "flushEvery"
+			}
+			return nil, paramErrorf(param, "`%s` is only supported with the `csv` and `tsv` export formats", param)
+		}
+		csvOptions = &CSVOptions{IncludeHeader: !noHeader}
+		if hasDelimiter {
+			delimiter := []rune(values.Get("delimiter"))
+			if len(delimiter) != 1 || !isCSVDelimiter(delimiter[0]) {
+				return nil, paramErrorf("delimiter", "Invalid delimiter: %q", values.Get("delimiter"))
+			}
+			csvOptions.Delimiter = delimiter[0]
+		}
+		if hasFlushEvery {
+			flushEvery, err := strconv.Atoi(values.Get("flushEvery"))
+			if err != nil || flushEvery < 0 {
+				return nil, paramErrorf("flushEvery", "Invalid `flushEvery` parameter: %s (Use a number of records)", values.Get("flushEvery"))
+			}
+			csvOptions.FlushEvery = flushEvery
+		}
+	}
+
+	_, bestEffort := values["bestEffort"]
+
+	_, dedup := values["dedup"]
+	if dedup && q != reqInfoQ {
+		return nil, paramErrorf("dedup", "`dedup` is only supported for %s queries", reqInfoQ)
+	}
+
+	logContains := values.Get("logContains")
+	if logContains != "" && q != rawQ {
+		return nil, paramErrorf("logContains", "`logContains` is only supported for %s queries", rawQ)
+	}
+
+	var apiNames []string
+	for _, v := range m["apiName"] {
+		if v == "" {
+			return nil, paramErrorf("apiName", "Empty API name")
+		}
+		apiNames = append(apiNames, v)
+	}
+
+	var versions []string
+	for _, v := range m["version"] {
+		if v == "" {
+			return nil, paramErrorf("version", "Empty version")
+		}
+		versions = append(versions, v)
+	}
+
+	categoryFilter := m["category"]
+
+	var jsonPathFilters map[string][]string
+	for _, v := range m["jp"] {
+		if q != rawQ {
+			return nil, paramErrorf("jp", "JSON path filters are only supported for %s queries", rawQ)
+		}
+		ps := strings.SplitN(v, ":", 2)
+		if len(ps) != 2 {
+			return nil, paramErrorf("jp", "Invalid JSON path filter parameter: %s", v)
+		}
+		if _, err := jsonPathFParam(ps[0]); err != nil {
+			return nil, &ParamError{Param: "jp", Err: err}
+		}
+		if jsonPathFilters == nil {
+			jsonPathFilters = make(map[string][]string)
+		}
+		jsonPathFilters[ps[0]] = append(jsonPathFilters[ps[0]], ps[1])
+	}
+
+	for _, param := range []string{"jpExists", "jpMissing"} {
+		for _, v := range m[param] {
+			if q != rawQ {
+				return nil, paramErrorf(param, "JSON path presence filters are only supported for %s queries", rawQ)
 			}
-			fParams[key] = ps[1]
+			if _, _, err := jsonPathPresenceClause(v, true, 1); err != nil {
+				return nil, &ParamError{Param: param, Err: err}
+			}
+		}
+	}
+
+	var statusClasses []int
+	for _, v := range m["statusClass"] {
+		if q == rawQ {
+			return nil, paramErrorf("statusClass", "Status class filters are not supported for %s queries", rawQ)
+		}
+		class, err := parseStatusClass(v)
+		if err != nil {
+			return nil, &ParamError{Param: "statusClass", Err: err}
+		}
+		statusClasses = append(statusClasses, class)
+	}
+
+	_, onlyErrors := values["onlyErrors"]
+	if onlyErrors && q == rawQ {
+		return nil, paramErrorf("onlyErrors", "`onlyErrors` is not supported for %s queries", rawQ)
+	}
+
+	var objectPresence ObjectPresence
+	if presenceParam := values.Get("objectPresence"); presenceParam != "" {
+		var ok bool
+		objectPresence, ok = objectPresenceNames[presenceParam]
+		if !ok {
+			return nil, paramErrorf("objectPresence", "Invalid object presence: %s (must be `any`, `empty` or `nonempty`)", presenceParam)
+		}
+		if objectPresence != ObjectAny && q == rawQ {
+			return nil, paramErrorf("objectPresence", "`objectPresence` is not supported for %s queries", rawQ)
+		}
+	}
+
+	var remoteHostCIDRs []string
+	for _, v := range m["cidr"] {
+		if q == rawQ {
+			return nil, paramErrorf("cidr", "CIDR filters are not supported for %s queries", rawQ)
+		}
+		if _, _, err := net.ParseCIDR(v); err != nil {
+			return nil, paramErrorf("cidr", "Invalid CIDR: %s (use for example `10.2.0.0/16`)", v)
 		}
+		remoteHostCIDRs = append(remoteHostCIDRs, v)
+	}
+
+	var numericFilters []NumericFilter
+	for _, v := range m["nf"] {
+		if q == rawQ {
+			return nil, paramErrorf("nf", "Numeric filters are not supported for %s queries", rawQ)
+		}
+		f, err := parseNumericFilter(v)
+		if err != nil {
+			return nil, &ParamError{Param: "nf", Err: err}
+		}
+		numericFilters = append(numericFilters, f)
+	}
+
+	sq := &SearchQuery{
+		Query:            q,
+		TimeStart:        timeStart,
+		TimeEnd:          timeEnd,
+		TimeEndInclusive: timeEndInclusive,
+		SinceWatermark:   sinceWatermark,
+		LastDuration:     last,
+		TimeAscending:    timeAscending,
+		SortBy:           sortBy,
+		PageSize:         pageSize,
+		PageNumber:       pageNumber,
+		Limit:            limit,
+		ExportFormat:     export,
+		FParams:          fParams,
+		FParamsNot:       fParamsNot,
+		FParamsContains:  fParamsContains,
+		FParamsPrefix:    fParamsPrefix,
+		FParamsSuffix:    fParamsSuffix,
+		FilterGroups:     filterGroups,
+		JSONPathFilters:  jsonPathFilters,
+		JSONPathExists:   m["jpExists"],
+		JSONPathMissing:  m["jpMissing"],
+		APINames:         apiNames,
+		Versions:         versions,
+		CategoryFilter:   categoryFilter,
+		NumericFilters:   numericFilters,
+		StatusClasses:    statusClasses,
+		OnlyErrors:       onlyErrors,
+		ObjectPresence:   objectPresence,
+		RemoteHostCIDRs:  remoteHostCIDRs,
+		Envelope:         envelope,
+		DataEnvelope:     dataEnvelope,
+		TimeTruncate:     timeTruncate,
+		DisplayTimeZone:  displayTimeZone,
+		LogContains:      logContains,
+		IntsAsStrings:    intsAsStrings,
+		OmitEmpty:        omitEmpty,
+		IncludeManifest:  includeManifest,
+		NullAs:           nullAs,
+		CSVOptions:       csvOptions,
+		BestEffort:       bestEffort,
+		DedupByRequestID: dedup,
+		Columns:          columns,
+		LogFields:        logFields,
+	}
+	if err := sq.Validate(); err != nil {
+		return nil, err
 	}
+	return sq, nil
+}
 
-	return &SearchQuery{
-		Query:         q,
-		TimeStart:     timeStart,
-		TimeEnd:       timeEnd,
-		LastDuration:  last,
-		TimeAscending: timeAscending,
-		PageSize:      pageSize,
-		PageNumber:    pageNumber,
-		ExportFormat:  export,
-		FParams:       fParams,
-	}, nil
+// searchQueryFromRequest creates a SearchQuery from the query parameters of a
+// HTTP request with ParseSearchQuery.
+func searchQueryFromRequest(r *http.Request) (*SearchQuery, error) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSearchQuery(values)
 }
 
 func parseSQTimeString(s string) (r time.Time, err error) {
@@ -229,18 +1570,594 @@ func parseSQTimeString(s string) (r time.Time, err error) {
 	return
 }
 
-func generateFilterClauses(m map[fParam]string, dollarStart int) (clauses []string, args []interface{}, dollarEnd int) {
-	for k, v := range m {
-		arg, op := v, "="
-		if strings.Contains(v, ".") || strings.Contains(v, "*") {
-			arg = strings.Replace(arg, ".", "_", -1)
-			arg = strings.Replace(arg, "*", "%", -1)
-			op = "LIKE"
+func isGlobPattern(v string) bool {
+	return strings.Contains(v, ".") || strings.Contains(v, "*")
+}
+
+func globToLikePattern(v string) string {
+	v = strings.Replace(v, ".", "_", -1)
+	return strings.Replace(v, "*", "%", -1)
+}
+
+// generateFilterClauses returns a where-clause predicate for each filter
+// param in m, using positional arguments starting at dollarStart. A param with
+// several values matches any of them - exact values are matched with an `IN`
+// list and glob patterns with `LIKE`. Params with no values are ignored.
+func generateFilterClauses(m map[fParam][]string, dollarStart int) (clauses []string, args []interface{}, dollarEnd int) {
+	return generateFilterClausesWithMode(m, matchEqual, dollarStart)
+}
+
+// generateFilterGroupsClauses returns the where-clause predicate matching the
+// records that match all the filters of any of the groups, i.e. the
+// predicates of each group, as generated by generateFilterClauses, ANDed
+// together, and the groups ORed. The values are bound as positional
+// arguments starting at dollarStart, in the order of the groups.
+func generateFilterGroupsClauses(groups []map[fParam][]string, dollarStart int) (clauses []string, args []interface{}, dollarEnd int) {
+	var groupClauses []string
+	for _, group := range groups {
+		preds, predArgs, end := generateFilterClauses(group, dollarStart)
+		if len(preds) == 0 {
+			continue
+		}
+		groupClauses = append(groupClauses, fmt.Sprintf("(%s)", strings.Join(preds, " AND ")))
+		args = append(args, predArgs...)
+		dollarStart = end
+	}
+	if len(groupClauses) > 0 {
+		clauses = append(clauses, fmt.Sprintf("(%s)", strings.Join(groupClauses, " OR ")))
+	}
+	return clauses, args, dollarStart
+}
+
+// generateNegatedFilterClauses is like generateFilterClauses, but the
+// predicate for each param matches only when none of its values match.
+func generateNegatedFilterClauses(m map[fParam][]string, dollarStart int) (clauses []string, args []interface{}, dollarEnd int) {
+	return generateFilterClausesWithMode(m, matchNotEqual, dollarStart)
+}
+
+// generateContainsFilterClauses is like generateFilterClauses, but the
+// predicate for each param matches when the field contains any of its values,
+// case-insensitively. The values are bound as positional arguments with their
+// LIKE wildcards escaped, so they are matched literally.
+func generateContainsFilterClauses(m map[fParam][]string, dollarStart int) (clauses []string, args []interface{}, dollarEnd int) {
+	return generateFilterClausesWithMode(m, matchContains, dollarStart)
+}
+
+// generatePrefixFilterClauses is like generateFilterClauses, but the
+// predicate for each param matches when the field starts with any of its
+// values. The values are bound as positional arguments with their LIKE
+// wildcards escaped, and the wildcard matching the rest of the field is
+// appended in SQL, so that the match is always anchored at the start.
+func generatePrefixFilterClauses(m map[fParam][]string, dollarStart int) (clauses []string, args []interface{}, dollarEnd int) {
+	return generateFilterClausesWithMode(m, matchPrefix, dollarStart)
+}
+
+// generateSuffixFilterClauses is like generatePrefixFilterClauses, but the
+// predicate for each param matches when the field ends with any of its values.
+// The predicate also requires the field to be non-null, so that records without
+// a value for it are excluded explicitly.
+func generateSuffixFilterClauses(m map[fParam][]string, dollarStart int) (clauses []string, args []interface{}, dollarEnd int) {
+	return generateFilterClausesWithMode(m, matchSuffix, dollarStart)
+}
+
+// filterMatchMode selects how the values of filter params are matched.
+type filterMatchMode int
+
+const (
+	matchEqual filterMatchMode = iota
+	matchNotEqual
+	matchContains
+	matchPrefix
+	matchSuffix
+)
+
+func generateFilterClausesWithMode(m map[fParam][]string, mode filterMatchMode, dollarStart int) (clauses []string, args []interface{}, dollarEnd int) {
+	eqOp, inOp, likeOp, joinOp := "=", "IN", "LIKE", " OR "
+	if mode == matchNotEqual {
+		eqOp, inOp, likeOp, joinOp = "<>", "NOT IN", "NOT LIKE", " AND "
+	}
+
+	// Sort keys so that the generated query is deterministic.
+	keys := make([]fParam, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	for _, k := range keys {
+		var exact, patterns, substrings, prefixes, suffixes []string
+		for _, v := range m[k] {
+			if mode == matchContains {
+				substrings = append(substrings, escapeLikePattern(v))
+			} else if mode == matchPrefix {
+				prefixes = append(prefixes, escapeLikePattern(v))
+			} else if mode == matchSuffix {
+				suffixes = append(suffixes, escapeLikePattern(v))
+			} else if isGlobPattern(v) {
+				patterns = append(patterns, globToLikePattern(v))
+			} else {
+				exact = append(exact, v)
+			}
+		}
+
+		var preds []string
+		switch len(exact) {
+		case 0:
+		case 1:
+			preds = append(preds, fmt.Sprintf("%s %s $%d", k, eqOp, dollarStart))
+			args = append(args, exact[0])
+			dollarStart++
+		default:
+			placeholders := make([]string, len(exact))
+			for i, v := range exact {
+				placeholders[i] = fmt.Sprintf("$%d", dollarStart)
+				args = append(args, v)
+				dollarStart++
+			}
+			preds = append(preds, fmt.Sprintf("%s %s (%s)", k, inOp, strings.Join(placeholders, ", ")))
+		}
+		for _, p := range patterns {
+			preds = append(preds, fmt.Sprintf("%s %s $%d", k, likeOp, dollarStart))
+			args = append(args, p)
+			dollarStart++
+		}
+		for _, v := range substrings {
+			preds = append(preds, fmt.Sprintf("%s ILIKE '%%' || $%d || '%%'", k, dollarStart))
+			args = append(args, v)
+			dollarStart++
+		}
+		for _, v := range prefixes {
+			preds = append(preds, fmt.Sprintf("%s LIKE $%d || '%%'", k, dollarStart))
+			args = append(args, v)
+			dollarStart++
+		}
+		for _, v := range suffixes {
+			preds = append(preds, fmt.Sprintf("%s LIKE '%%' || $%d", k, dollarStart))
+			args = append(args, v)
+			dollarStart++
+		}
+		if mode == matchSuffix && len(preds) > 0 {
+			clauses = append(clauses, fmt.Sprintf("(%s IS NOT NULL AND (%s))", k, strings.Join(preds, joinOp)))
+			continue
+		}
+
+		switch len(preds) {
+		case 0:
+		case 1:
+			clauses = append(clauses, preds[0])
+		default:
+			clauses = append(clauses, fmt.Sprintf("(%s)", strings.Join(preds, joinOp)))
+		}
+	}
+	dollarEnd = dollarStart
+	return
+}
+
+// BaseFilter holds filter params that are applied to every search, e.g. to
+// scope all searches to a tenant's buckets. Keys are the filter param names
+// accepted by the `fp` query parameter and values are matched like the values
+// of SearchQuery.FParams. The values are always bound as positional SQL
+// arguments.
+type BaseFilter map[string][]string
+
+// Validate checks that all keys of the filter are valid filter params.
+func (b BaseFilter) Validate() error {
+	for k := range b {
+		if _, err := stringToFParam(reqInfoQ, k); err != nil {
+			return fmt.Errorf("Invalid base filter: %v", err)
+		}
+	}
+	return nil
+}
+
+// generateClauses returns the where-clause predicates of the filter for
+// queries of type q.
+func (b BaseFilter) generateClauses(q qType, dollarStart int) (clauses []string, args []interface{}, dollarEnd int, err error) {
+	m := make(map[fParam][]string, len(b))
+	for k, vs := range b {
+		key, err := stringToFParam(q, k)
+		if err != nil {
+			return nil, nil, dollarStart, fmt.Errorf("Invalid base filter: %v", err)
+		}
+		if len(vs) == 0 {
+			// A filter without values would match nothing if it
+			// were not ignored - refuse it rather than silently
+			// not scoping the search.
+			return nil, nil, dollarStart, fmt.Errorf("Invalid base filter: no values for %s", k)
+		}
+		m[key] = vs
+	}
+	clauses, args, dollarEnd = generateFilterClauses(m, dollarStart)
+	return clauses, args, dollarEnd, nil
+}
+
+// inListClauses returns the where-clause predicate restricting the column
+// col to the given values, if any, using positional arguments starting at
+// dollarStart.
+func inListClauses(col fParam, values []string, dollarStart int) (clauses []string, args []interface{}, dollarEnd int) {
+	if len(values) == 0 {
+		return nil, nil, dollarStart
+	}
+	dollars := make([]string, len(values))
+	for i, v := range values {
+		dollars[i] = fmt.Sprintf("$%d", dollarStart)
+		args = append(args, v)
+		dollarStart++
+	}
+	clauses = append(clauses, fmt.Sprintf("%s IN (%s)", col, strings.Join(dollars, ", ")))
+	return clauses, args, dollarStart
+}
+
+// searchColumns are the columns of the table searched by a query that its
+// common predicates (see commonWhereClauses) apply to.
+type searchColumns struct {
+	query   qType
+	time    string
+	bucket  fParam
+	apiName fParam
+	version fParam
+}
+
+var (
+	rawQColumns = searchColumns{
+		query:   rawQ,
+		time:    "event_time",
+		bucket:  rawQRequestFieldsMap["bucket"],
+		apiName: rawQRequestFieldsMap["api_name"],
+		version: "log->>'version'",
+	}
+	reqInfoQColumns = searchColumns{
+		query:   reqInfoQ,
+		time:    "time",
+		bucket:  "bucket",
+		apiName: "api_name",
+		version: "version",
+	}
+)
+
+// commonWhereClauses returns the where-clause predicates of s supported by
+// all queries: the base filter of the client, the allowed buckets, the time
+// range and the field filters of s, applied to the columns cols, along with
+// their positional arguments numbered from dollarStart. Both rawWhereClause
+// and reqInfoWhereClause build on them, so that the queries do not diverge.
+func (c *DBClient) commonWhereClauses(s *SearchQuery, cols searchColumns, dollarStart int) (clauses []string, args []interface{}, dollarEnd int, err error) {
+	if s.SinceWatermark != "" {
+		// Search resolves the watermark into TimeStart beforehand.
+		return nil, nil, dollarStart, invalidQueryErrorf("Watermarks are only supported by searches")
+	}
+	clauses, args, dollarStart, err = c.BaseFilter.generateClauses(cols.query, dollarStart)
+	if err != nil {
+		return nil, nil, dollarStart, err
+	}
+	bucketClauses, bucketArgs, dollarStart := inListClauses(cols.bucket, s.AllowedBuckets, dollarStart)
+	clauses = append(clauses, bucketClauses...)
+	args = append(args, bucketArgs...)
+	timeClauses, timeArgs, dollarStart := s.timeRangeClauses(cols.time, dollarStart)
+	clauses = append(clauses, timeClauses...)
+	args = append(args, timeArgs...)
+
+	// Remaining dollar params are added for filter where clauses
+	filterClauses, filterArgs, dollarStart := generateFilterClauses(s.FParams, dollarStart)
+	clauses = append(clauses, filterClauses...)
+	args = append(args, filterArgs...)
+	filterClauses, filterArgs, dollarStart = generateNegatedFilterClauses(s.FParamsNot, dollarStart)
+	clauses = append(clauses, filterClauses...)
+	args = append(args, filterArgs...)
+	filterClauses, filterArgs, dollarStart = generateContainsFilterClauses(s.FParamsContains, dollarStart)
+	clauses = append(clauses, filterClauses...)
+	args = append(args, filterArgs...)
+	filterClauses, filterArgs, dollarStart = generatePrefixFilterClauses(s.FParamsPrefix, dollarStart)
+	clauses = append(clauses, filterClauses...)
+	args = append(args, filterArgs...)
+	filterClauses, filterArgs, dollarStart = generateSuffixFilterClauses(s.FParamsSuffix, dollarStart)
+	clauses = append(clauses, filterClauses...)
+	args = append(args, filterArgs...)
+	filterClauses, filterArgs, dollarStart = generateFilterGroupsClauses(s.FilterGroups, dollarStart)
+	clauses = append(clauses, filterClauses...)
+	args = append(args, filterArgs...)
+	filterClauses, filterArgs, dollarStart = inListClauses(cols.apiName, s.APINames, dollarStart)
+	clauses = append(clauses, filterClauses...)
+	args = append(args, filterArgs...)
+	filterClauses, filterArgs, dollarStart = inListClauses(cols.version, s.Versions, dollarStart)
+	clauses = append(clauses, filterClauses...)
+	args = append(args, filterArgs...)
+	filterClauses, filterArgs, dollarStart, err = c.categoryFilterClause(cols.apiName, s.CategoryFilter, dollarStart)
+	if err != nil {
+		return nil, nil, dollarStart, err
+	}
+	clauses = append(clauses, filterClauses...)
+	args = append(args, filterArgs...)
+	return clauses, args, dollarStart, nil
+}
+
+// rawWhereClause returns the where-clause selecting the audit_log_events
+// records matching s, along with its positional arguments numbered from
+// dollarStart. The base filter of the client and the allowed buckets of s
+// are always included. The where-clause is empty when there are no
+// predicates.
+func (c *DBClient) rawWhereClause(s *SearchQuery, dollarStart int) (whereClause string, sqlArgs []interface{}, dollarEnd int, err error) {
+	if len(s.NumericFilters) > 0 {
+		return "", nil, dollarStart, invalidQueryErrorf("Numeric filters are only supported for %s queries", reqInfoQ)
+	}
+	if len(s.StatusClasses) > 0 {
+		return "", nil, dollarStart, invalidQueryErrorf("Status class filters are only supported for %s queries", reqInfoQ)
+	}
+	if s.OnlyErrors {
+		return "", nil, dollarStart, invalidQueryErrorf("Error filters are only supported for %s queries", reqInfoQ)
+	}
+	if s.ObjectPresence != ObjectAny {
+		return "", nil, dollarStart, invalidQueryErrorf("Object presence filters are only supported for %s queries", reqInfoQ)
+	}
+	if len(s.RemoteHostCIDRs) > 0 {
+		return "", nil, dollarStart, invalidQueryErrorf("CIDR filters are only supported for %s queries", reqInfoQ)
+	}
+
+	whereClauses, sqlArgs, dollarStart, err := c.commonWhereClauses(s, rawQColumns, dollarStart)
+	if err != nil {
+		return "", nil, dollarStart, err
+	}
+	jsonPathFParams := make(map[fParam][]string, len(s.JSONPathFilters))
+	for path, vs := range s.JSONPathFilters {
+		key, err := jsonPathFParam(path)
+		if err != nil {
+			return "", nil, dollarStart, err
+		}
+		jsonPathFParams[key] = vs
+	}
+	filterClauses, filterArgs, dollarStart := generateFilterClauses(jsonPathFParams, dollarStart)
+	whereClauses = append(whereClauses, filterClauses...)
+	sqlArgs = append(sqlArgs, filterArgs...)
+
+	for _, p := range []struct {
+		paths   []string
+		present bool
+	}{{s.JSONPathExists, true}, {s.JSONPathMissing, false}} {
+		for _, path := range p.paths {
+			clause, arg, err := jsonPathPresenceClause(path, p.present, dollarStart)
+			if err != nil {
+				return "", nil, dollarStart, err
+			}
+			whereClauses = append(whereClauses, clause)
+			sqlArgs = append(sqlArgs, arg)
+			dollarStart++
+		}
+	}
+
+	if s.LogContains != "" {
+		whereClauses = append(whereClauses, fmt.Sprintf("log::text ILIKE $%d", dollarStart))
+		sqlArgs = append(sqlArgs, "%"+escapeLikePattern(s.LogContains)+"%")
+		dollarStart++
+	}
+
+	if len(whereClauses) > 0 {
+		whereClause = fmt.Sprintf("WHERE %s", strings.Join(whereClauses, " AND "))
+	}
+	return whereClause, sqlArgs, dollarStart, nil
+}
+
+// escapeLikePattern escapes the characters of v that are special in a LIKE
+// pattern, so that the pattern matches v literally.
+func escapeLikePattern(v string) string {
+	return likePatternEscaper.Replace(v)
+}
+
+var likePatternEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// reqInfoWhereClause returns the where-clause selecting the request_info
+// records matching s, along with its positional arguments numbered from
+// dollarStart. The base filter of the client and the allowed buckets of s
+// are always included. The where-clause is empty when there are no
+// predicates.
+func (c *DBClient) reqInfoWhereClause(s *SearchQuery, dollarStart int) (whereClause string, sqlArgs []interface{}, dollarEnd int, err error) {
+	if s.LogContains != "" {
+		return "", nil, dollarStart, invalidQueryErrorf("Log text search is only supported for %s queries", rawQ)
+	}
+	if len(s.JSONPathFilters) > 0 {
+		return "", nil, dollarStart, invalidQueryErrorf("JSON path filters are only supported for %s queries", rawQ)
+	}
+	if len(s.JSONPathExists) > 0 || len(s.JSONPathMissing) > 0 {
+		return "", nil, dollarStart, invalidQueryErrorf("JSON path presence filters are only supported for %s queries", rawQ)
+	}
+
+	whereClauses, sqlArgs, dollarStart, err := c.commonWhereClauses(s, reqInfoQColumns, dollarStart)
+	if err != nil {
+		return "", nil, dollarStart, err
+	}
+	filterClauses, filterArgs, dollarStart, err := generateNumericFilterClauses(s.NumericFilters, dollarStart)
+	if err != nil {
+		return "", nil, dollarStart, err
+	}
+	whereClauses = append(whereClauses, filterClauses...)
+	sqlArgs = append(sqlArgs, filterArgs...)
+	filterClauses, filterArgs, dollarStart, err = generateStatusClassClause(s.StatusClasses, dollarStart)
+	if err != nil {
+		return "", nil, dollarStart, err
+	}
+	whereClauses = append(whereClauses, filterClauses...)
+	sqlArgs = append(sqlArgs, filterArgs...)
+	if s.OnlyErrors {
+		whereClauses = append(whereClauses, "response_status_code >= 400")
+	}
+	objectClause, err := s.ObjectPresence.clause()
+	if err != nil {
+		return "", nil, dollarStart, err
+	}
+	if objectClause != "" {
+		whereClauses = append(whereClauses, objectClause)
+	}
+	filterClauses, filterArgs, dollarStart, err = generateCIDRClause("remote_host", s.RemoteHostCIDRs, dollarStart)
+	if err != nil {
+		return "", nil, dollarStart, err
+	}
+	whereClauses = append(whereClauses, filterClauses...)
+	sqlArgs = append(sqlArgs, filterArgs...)
+
+	if len(whereClauses) > 0 {
+		whereClause = fmt.Sprintf("WHERE %s", strings.Join(whereClauses, " AND "))
+	}
+	return whereClause, sqlArgs, dollarStart, nil
+}
+
+// pgTimePrecision is the precision of the timestamps stored in PG.
+const pgTimePrecision = time.Microsecond
+
+// pgTimeArg returns t as a timestamp argument of a query, in UTC and
+// truncated to the precision of the stored timestamps like InsertEvent does,
+// so that comparisons with a stored timestamp are exact: the time of an event
+// as received from MinIO, at nanosecond precision, matches its stored time.
+// It is bound as a time.Time, which the driver sends along with its UTC
+// offset, so that it does not depend on the time zone of the DB session.
+func pgTimeArg(t time.Time) time.Time {
+	return t.Truncate(pgTimePrecision).UTC()
+}
+
+// pgTimeEndArg returns the end bound t of a time range like pgTimeArg, except
+// that an exclusive end is rounded up to the precision of the stored
+// timestamps instead, so that the stored timestamps before t stay in range,
+// e.g. 10:00:00.000001 with an end at 10:00:00.0000015.
+func pgTimeEndArg(t time.Time, inclusive bool) time.Time {
+	end := t.Truncate(pgTimePrecision)
+	if !inclusive && !end.Equal(t) {
+		end = end.Add(pgTimePrecision)
+	}
+	return end.UTC()
+}
+
+// timeRangeClauses returns the where-clause predicates restricting the given
+// time column to the time range of s, using positional arguments starting at
+// dollarStart.
+//
+// The range is half-open, i.e. [TimeStart, TimeEnd), like the ranges of the
+// table partitions, so that an event exactly at the boundary of two adjacent
+// ranges is returned by exactly one of them. The end bound is inclusive only
+// if TimeEndInclusive is set.
+//
+// The predicates compare the partition key column itself, so that Postgres
+// prunes the partitions outside of the time range. The bounds are bound as
+// timestamps in UTC (see pgTimeArg and pgTimeEndArg), and are known when planning, as the
+// queries are not prepared in advance.
+// The bound of LastDuration, relative to CURRENT_TIMESTAMP, is only known
+// when running the query, which still prunes the partitions at its start.
+func (s *SearchQuery) timeRangeClauses(timeCol string, dollarStart int) (clauses []string, args []interface{}, dollarEnd int) {
+	// only filter by time if provided
+	if s.TimeStart != nil {
+		clauses = append(clauses, fmt.Sprintf("%s >= $%d", timeCol, dollarStart))
+		args = append(args, pgTimeArg(*s.TimeStart))
+		dollarStart++
+	}
+	if s.TimeEnd != nil {
+		op := "<"
+		if s.TimeEndInclusive {
+			op = "<="
+		}
+		clauses = append(clauses, fmt.Sprintf("%s %s $%d", timeCol, op, dollarStart))
+		args = append(args, pgTimeEndArg(*s.TimeEnd, s.TimeEndInclusive))
+		dollarStart++
+	}
+	if s.LastDuration != nil {
+		// s.TimeEnd and s.TimeStart would be nil due to
+		// validation of s (see SearchQuery.Validate).
+		durationSeconds := int64(s.LastDuration.Seconds())
+		clauses = append(clauses, fmt.Sprintf("%s >= CURRENT_TIMESTAMP - '%d seconds'::interval", timeCol, durationSeconds))
+	}
+	return clauses, args, dollarStart
+}
+
+// generateStatusClassClause returns a where-clause predicate matching the
+// response status codes in any of the given classes (e.g. 4 for 4xx), using
+// positional arguments starting at dollarStart. No predicate is returned when
+// classes is empty.
+func generateStatusClassClause(classes []int, dollarStart int) (clauses []string, args []interface{}, dollarEnd int, err error) {
+	var preds []string
+	for _, class := range classes {
+		if class < 1 || class > 5 {
+			return nil, nil, dollarStart, invalidQueryErrorf("Invalid status class: %d (must be from 1 to 5)", class)
+		}
+		preds = append(preds, fmt.Sprintf("response_status_code BETWEEN $%d AND $%d", dollarStart, dollarStart+1))
+		args = append(args, class*100, class*100+99)
+		dollarStart += 2
+	}
+	if len(preds) > 0 {
+		clauses = []string{fmt.Sprintf("(%s)", strings.Join(preds, " OR "))}
+	}
+	return clauses, args, dollarStart, nil
+}
+
+// ipAddressPattern is a regular expression, valid in Go and in Postgres,
+// matching the IPv4 and IPv6 addresses (without a zone or prefix length)
+// that Postgres casts to inet. The IPv6 forms are those of RFC 3986.
+var ipAddressPattern = func() string {
+	const (
+		octet = `(25[0-5]|2[0-4][0-9]|1[0-9][0-9]|[1-9]?[0-9])`
+		h16   = `[0-9a-fA-F]{1,4}`
+	)
+	ipv4 := fmt.Sprintf(`(%[1]s\.){3}%[1]s`, octet)
+	ls32 := fmt.Sprintf(`(%[1]s:%[1]s|%[2]s)`, h16, ipv4)
+	// head returns the optional group of at most n+1 h16 separated by
+	// colons, preceding "::".
+	head := func(n int) string {
+		if n == 0 {
+			return fmt.Sprintf(`(%s)?`, h16)
+		}
+		return fmt.Sprintf(`((%[1]s:){0,%[2]d}%[1]s)?`, h16, n)
+	}
+	ipv6 := []string{
+		fmt.Sprintf(`(%s:){6}%s`, h16, ls32),
+		fmt.Sprintf(`::(%s:){5}%s`, h16, ls32),
+		fmt.Sprintf(`%s::(%s:){4}%s`, head(0), h16, ls32),
+		fmt.Sprintf(`%s::(%s:){3}%s`, head(1), h16, ls32),
+		fmt.Sprintf(`%s::(%s:){2}%s`, head(2), h16, ls32),
+		fmt.Sprintf(`%s::%s:%s`, head(3), h16, ls32),
+		fmt.Sprintf(`%s::%s`, head(4), ls32),
+		fmt.Sprintf(`%s::%s`, head(5), h16),
+		fmt.Sprintf(`%s::`, head(6)),
+	}
+	return fmt.Sprintf(`^(%s|%s)$`, ipv4, strings.Join(ipv6, "|"))
+}()
+
+// generateCIDRClause returns a where-clause predicate matching the records
+// whose column, holding IP addresses as text, is in any of the given CIDR
+// ranges, using positional arguments starting at dollarStart. The column is
+// cast to inet only when it holds an IP address, so that the other values,
+// e.g. host names, are not matched rather than failing the query. No
+// predicate is returned when cidrs is empty.
+func generateCIDRClause(col string, cidrs []string, dollarStart int) (clauses []string, args []interface{}, dollarEnd int, err error) {
+	if len(cidrs) == 0 {
+		return nil, nil, dollarStart, nil
+	}
+	preds := make([]string, len(cidrs))
+	args = []interface{}{ipAddressPattern}
+	for i, v := range cidrs {
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, nil, dollarStart, invalidQueryErrorf("Invalid CIDR: %s (use for example `10.2.0.0/16`)", v)
 		}
+		preds[i] = fmt.Sprintf("%s::inet <<= $%d::inet", col, dollarStart+1+i)
+		args = append(args, ipNet.String())
+	}
+	clause := fmt.Sprintf("CASE WHEN %s ~ $%d THEN %s ELSE false END", col, dollarStart, strings.Join(preds, " OR "))
+	return []string{clause}, args, dollarStart + 1 + len(cidrs), nil
+}
 
-		clause := fmt.Sprintf("%s %s $%d", k, op, dollarStart)
-		clauses = append(clauses, clause)
-		args = append(args, arg)
+// parseStatusClass parses a status class given as its first digit, optionally
+// followed by "xx" (e.g. "5" or "5xx").
+func parseStatusClass(v string) (int, error) {
+	class, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(v), "xx"))
+	if err != nil || class < 1 || class > 5 {
+		return 0, fmt.Errorf("Invalid status class: %s (use for example `5xx`)", v)
+	}
+	return class, nil
+}
+
+// generateNumericFilterClauses returns a where-clause predicate for each
+// numeric filter, using positional arguments starting at dollarStart.
+func generateNumericFilterClauses(filters []NumericFilter, dollarStart int) (clauses []string, args []interface{}, dollarEnd int, err error) {
+	for _, f := range filters {
+		if err = f.validate(); err != nil {
+			return nil, nil, dollarStart, err
+		}
+		clauses = append(clauses, fmt.Sprintf("%s %s $%d", f.Column, f.Op, dollarStart))
+		args = append(args, f.Value)
 		dollarStart++
 	}
 	dollarEnd = dollarStart
@@ -0,0 +1,1614 @@
+//
+// This file is part of MinIO Operator
+// Copyright (C) 2022, MinIO, Inc.
+//
+// This code is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License, version 3,
+// as published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License, version 3,
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+//
+
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestGenerateFilterClauses(t *testing.T) {
+	testCases := []struct {
+		name            string
+		fParams         map[fParam][]string
+		expectedClauses []string
+		expectedArgs    []interface{}
+		expectedDollar  int
+	}{
+		{
+			name:            "one value",
+			fParams:         map[fParam][]string{"bucket": {"photos"}},
+			expectedClauses: []string{"bucket = $3"},
+			expectedArgs:    []interface{}{"photos"},
+			expectedDollar:  4,
+		},
+		{
+			name:            "several values",
+			fParams:         map[fParam][]string{"bucket": {"a", "b", "c"}},
+			expectedClauses: []string{"bucket IN ($3, $4, $5)"},
+			expectedArgs:    []interface{}{"a", "b", "c"},
+			expectedDollar:  6,
+		},
+		{
+			name:            "values and patterns",
+			fParams:         map[fParam][]string{"api_name": {"PutObject", "Get*"}, "bucket": {"a", "b"}},
+			expectedClauses: []string{"(api_name = $3 OR api_name LIKE $4)", "bucket IN ($5, $6)"},
+			expectedArgs:    []interface{}{"PutObject", "Get%", "a", "b"},
+			expectedDollar:  7,
+		},
+		{
+			name:           "empty value list",
+			fParams:        map[fParam][]string{"bucket": {}},
+			expectedDollar: 3,
+		},
+	}
+
+	for _, testCase := range testCases {
+		clauses, args, dollarEnd := generateFilterClauses(testCase.fParams, 3)
+		if !reflect.DeepEqual(clauses, testCase.expectedClauses) {
+			t.Errorf("%s: got clauses %v, expected %v", testCase.name, clauses, testCase.expectedClauses)
+		}
+		if !reflect.DeepEqual(args, testCase.expectedArgs) {
+			t.Errorf("%s: got args %v, expected %v", testCase.name, args, testCase.expectedArgs)
+		}
+		if dollarEnd != testCase.expectedDollar {
+			t.Errorf("%s: got dollarEnd %d, expected %d", testCase.name, dollarEnd, testCase.expectedDollar)
+		}
+	}
+}
+
+func TestGenerateNegatedFilterClauses(t *testing.T) {
+	clauses, args, dollar := generateFilterClauses(map[fParam][]string{"api_name": {"PutObject"}}, 1)
+	negClauses, negArgs, dollar := generateNegatedFilterClauses(map[fParam][]string{
+		"response_status_code": {"200"},
+		"bucket":               {"a", "b", "tmp-*"},
+	}, dollar)
+	clauses = append(clauses, negClauses...)
+	args = append(args, negArgs...)
+
+	expectedClauses := []string{
+		"api_name = $1",
+		"(bucket NOT IN ($2, $3) AND bucket NOT LIKE $4)",
+		"response_status_code <> $5",
+	}
+	expectedArgs := []interface{}{"PutObject", "a", "b", "tmp-%", "200"}
+	if !reflect.DeepEqual(clauses, expectedClauses) {
+		t.Errorf("got clauses %v, expected %v", clauses, expectedClauses)
+	}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("got args %v, expected %v", args, expectedArgs)
+	}
+	if dollar != 6 {
+		t.Errorf("got dollarEnd %d, expected 6", dollar)
+	}
+}
+
+func TestGenerateContainsFilterClauses(t *testing.T) {
+	clauses, args, dollar := generateContainsFilterClauses(map[fParam][]string{
+		"user_agent": {"curl", "50%_off'; DROP TABLE request_info; --"},
+		"object":     {`dir\file*`},
+	}, 2)
+
+	expectedClauses := []string{
+		"object ILIKE '%' || $2 || '%'",
+		"(user_agent ILIKE '%' || $3 || '%' OR user_agent ILIKE '%' || $4 || '%')",
+	}
+	expectedArgs := []interface{}{`dir\\file*`, "curl", `50\%\_off'; DROP TABLE request\_info; --`}
+	if !reflect.DeepEqual(clauses, expectedClauses) {
+		t.Errorf("got clauses %v, expected %v", clauses, expectedClauses)
+	}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("got args %v, expected %v", args, expectedArgs)
+	}
+	if dollar != 5 {
+		t.Errorf("got dollarEnd %d, expected 5", dollar)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=raw&fp=~user_agent:CURL&fp=bucket:photos", nil)
+	sq, err := searchQueryFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &DBClient{}
+	where, args, _, err := c.rawWhereClause(sq, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "WHERE log->'api'->>'bucket' = $1 AND log->>'userAgent' ILIKE '%' || $2 || '%'"; where != expected {
+		t.Errorf("got %q, expected %q", where, expected)
+	}
+	if expected := []interface{}{"photos", "CURL"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&fp=~bucket:photos", nil)
+	if _, err := searchQueryFromRequest(r); err == nil {
+		t.Errorf("expected an error for substring matching on bucket")
+	}
+}
+
+func TestGeneratePrefixFilterClauses(t *testing.T) {
+	clauses, args, dollar := generatePrefixFilterClauses(map[fParam][]string{
+		"access_key": {"svc-", "svc_%"},
+	}, 3)
+
+	// The prefixes are bound with their wildcards escaped, and the match is
+	// anchored at the start of the field.
+	expectedClauses := []string{"(access_key LIKE $3 || '%' OR access_key LIKE $4 || '%')"}
+	expectedArgs := []interface{}{"svc-", `svc\_\%`}
+	if !reflect.DeepEqual(clauses, expectedClauses) {
+		t.Errorf("got clauses %v, expected %v", clauses, expectedClauses)
+	}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("got args %v, expected %v", args, expectedArgs)
+	}
+	if dollar != 5 {
+		t.Errorf("got dollarEnd %d, expected 5", dollar)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&fp=^access_key:svc-&fp=bucket:photos", nil)
+	sq, err := searchQueryFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &DBClient{}
+	where, args, _, err := c.reqInfoWhereClause(sq, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "WHERE bucket = $1 AND access_key LIKE $2 || '%'"; where != expected {
+		t.Errorf("got %q, expected %q", where, expected)
+	}
+	if expected := []interface{}{"photos", "svc-"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&fp=^bucket:photos", nil)
+	if _, err := searchQueryFromRequest(r); err == nil {
+		t.Errorf("expected an error for prefix matching on bucket")
+	}
+}
+
+func TestSearchQueryFromRequestNamedFilters(t *testing.T) {
+	testCases := []struct {
+		url           string
+		expectErr     bool
+		expected      map[fParam][]string
+		expectedWhere string
+	}{
+		{
+			url:           "/api/query?q=reqinfo&bucket=a",
+			expected:      map[fParam][]string{"bucket": {"a"}},
+			expectedWhere: "WHERE bucket = $1",
+		},
+		{
+			url:           "/api/query?q=reqinfo&bucket=a&bucket=b&fp=bucket:c",
+			expected:      map[fParam][]string{"bucket": {"c", "a", "b"}},
+			expectedWhere: "WHERE bucket IN ($1, $2, $3)",
+		},
+		{
+			url:           "/api/query?q=raw&bucket=a&bucket=b&response_status_code=404",
+			expected:      map[fParam][]string{"log->'api'->>'bucket'": {"a", "b"}, "log->'api'->>'statusCode'": {"404"}},
+			expectedWhere: "WHERE log->'api'->>'bucket' IN ($1, $2) AND log->'api'->>'statusCode' = $3",
+		},
+		{
+			url:       "/api/query?q=reqinfo&response_status_code=4*",
+			expectErr: true,
+		},
+	}
+
+	c := &DBClient{}
+	for i, testCase := range testCases {
+		r := httptest.NewRequest(http.MethodGet, testCase.url, nil)
+		sq, err := searchQueryFromRequest(r)
+		if testCase.expectErr {
+			var pe *ParamError
+			if !errors.As(err, &pe) || pe.Param != "response_status_code" {
+				t.Errorf("%d: expected an error for response_status_code, got %v", i+1, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i+1, err)
+			continue
+		}
+		if !reflect.DeepEqual(sq.FParams, testCase.expected) {
+			t.Errorf("%d: got %v, expected %v", i+1, sq.FParams, testCase.expected)
+		}
+		var where string
+		if sq.Query == rawQ {
+			where, _, _, err = c.rawWhereClause(sq, 1)
+		} else {
+			where, _, _, err = c.reqInfoWhereClause(sq, 1)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if where != testCase.expectedWhere {
+			t.Errorf("%d: got %q, expected %q", i+1, where, testCase.expectedWhere)
+		}
+	}
+}
+
+func TestSearchQueryFromRequestNegatedFilters(t *testing.T) {
+	testCases := []struct {
+		url         string
+		expectErr   bool
+		expected    map[fParam][]string
+		expectedNot map[fParam][]string
+	}{
+		{
+			url:         "/api/query?q=reqinfo&fp=api_name:PutObject&fp=!response_status_code:200",
+			expected:    map[fParam][]string{"api_name": {"PutObject"}},
+			expectedNot: map[fParam][]string{"response_status_code": {"200"}},
+		},
+		{
+			url:         "/api/query?q=raw&fp=!api_name:DeleteObject",
+			expected:    map[fParam][]string{},
+			expectedNot: map[fParam][]string{"log->'api'->>'name'": {"DeleteObject"}},
+		},
+		{
+			url:       "/api/query?q=reqinfo&fp=!no_such_column:x",
+			expectErr: true,
+		},
+		{
+			url:       "/api/query?q=reqinfo&fp=!response_status_code:2*",
+			expectErr: true,
+		},
+	}
+
+	for i, testCase := range testCases {
+		r := httptest.NewRequest(http.MethodGet, testCase.url, nil)
+		sq, err := searchQueryFromRequest(r)
+		if testCase.expectErr {
+			if err == nil {
+				t.Errorf("%d: expected an error", i+1)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i+1, err)
+			continue
+		}
+		if !reflect.DeepEqual(sq.FParams, testCase.expected) || !reflect.DeepEqual(sq.FParamsNot, testCase.expectedNot) {
+			t.Errorf("%d: got %v / %v, expected %v / %v", i+1, sq.FParams, sq.FParamsNot, testCase.expected, testCase.expectedNot)
+		}
+	}
+}
+
+func TestSearchQueryOutputTime(t *testing.T) {
+	given := time.Date(2022, time.March, 3, 10, 21, 42, 987654321, time.UTC)
+	testCases := []struct {
+		truncate time.Duration
+		expected time.Time
+	}{
+		{0, given},
+		{time.Second, time.Date(2022, time.March, 3, 10, 21, 42, 0, time.UTC)},
+		{time.Minute, time.Date(2022, time.March, 3, 10, 21, 0, 0, time.UTC)},
+	}
+	for _, testCase := range testCases {
+		sq := SearchQuery{TimeTruncate: testCase.truncate}
+		if got := sq.outputTime(given); !got.Equal(testCase.expected) {
+			t.Errorf("truncate %s: got %s, expected %s", testCase.truncate, got, testCase.expected)
+		}
+	}
+}
+
+func TestSearchQueryDisplayTimeZone(t *testing.T) {
+	given := time.Date(2022, time.March, 3, 10, 21, 42, 987654321, time.UTC)
+	sq := SearchQuery{Query: rawQ, DisplayTimeZone: "America/New_York", TimeTruncate: time.Second}
+	if err := sq.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	got := sq.outputTime(given)
+	if expected := "2022-03-03T05:21:42-05:00"; got.Format(time.RFC3339Nano) != expected {
+		t.Errorf("got %s, expected %s", got.Format(time.RFC3339Nano), expected)
+	}
+
+	for _, zone := range []string{"Mars/Olympus_Mons", "Local", "../../etc/passwd"} {
+		sq := SearchQuery{Query: rawQ, DisplayTimeZone: zone}
+		var vErr *ValidationError
+		if err := sq.Validate(); !errors.As(err, &vErr) || vErr.Field != "DisplayTimeZone" {
+			t.Errorf("%q: got %v, expected a validation error for the DisplayTimeZone field", zone, err)
+		}
+	}
+}
+
+func TestTimeRangeClauses(t *testing.T) {
+	start := time.Date(2022, time.March, 7, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 7)
+	startArg, endArg := start, end
+
+	testCases := []struct {
+		sq              SearchQuery
+		expectedClauses []string
+		expectedArgs    []interface{}
+	}{
+		{SearchQuery{}, nil, nil},
+		{SearchQuery{TimeStart: &start}, []string{"time >= $3"}, []interface{}{startArg}},
+		{SearchQuery{TimeEnd: &end}, []string{"time < $3"}, []interface{}{endArg}},
+		{
+			SearchQuery{TimeStart: &start, TimeEnd: &end},
+			[]string{"time >= $3", "time < $4"},
+			[]interface{}{startArg, endArg},
+		},
+		{
+			SearchQuery{TimeStart: &start, TimeEnd: &end, TimeEndInclusive: true},
+			[]string{"time >= $3", "time <= $4"},
+			[]interface{}{startArg, endArg},
+		},
+	}
+	for i, testCase := range testCases {
+		clauses, args, dollarEnd := testCase.sq.timeRangeClauses("time", 3)
+		if !reflect.DeepEqual(clauses, testCase.expectedClauses) {
+			t.Errorf("Test %d: got clauses %v, expected %v", i, clauses, testCase.expectedClauses)
+		}
+		if !reflect.DeepEqual(args, testCase.expectedArgs) {
+			t.Errorf("Test %d: got args %v, expected %v", i, args, testCase.expectedArgs)
+		}
+		if expected := 3 + len(testCase.expectedArgs); dollarEnd != expected {
+			t.Errorf("Test %d: got dollarEnd %d, expected %d", i, dollarEnd, expected)
+		}
+	}
+
+	// Bounds are truncated to the precision of the stored timestamps.
+	nanoStart := start.Add(1234567 * time.Nanosecond)
+	sq := SearchQuery{TimeStart: &nanoStart}
+	if _, args, _ := sq.timeRangeClauses("time", 1); args[0] != time.Date(2022, time.March, 7, 0, 0, 0, 1234000, time.UTC) {
+		t.Errorf("got start arg %v, expected it truncated to microseconds", args[0])
+	}
+	// An exclusive end is rounded up instead.
+	sq = SearchQuery{TimeEnd: &nanoStart}
+	if _, args, _ := sq.timeRangeClauses("time", 1); args[0] != time.Date(2022, time.March, 7, 0, 0, 0, 1235000, time.UTC) {
+		t.Errorf("got end arg %v, expected it rounded up to microseconds", args[0])
+	}
+	sq = SearchQuery{TimeEnd: &nanoStart, TimeEndInclusive: true}
+	if _, args, _ := sq.timeRangeClauses("time", 1); args[0] != time.Date(2022, time.March, 7, 0, 0, 0, 1234000, time.UTC) {
+		t.Errorf("got inclusive end arg %v, expected it truncated to microseconds", args[0])
+	}
+
+	// Bounds in other locations are converted to UTC.
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+	parisStart := start.In(paris)
+	sq = SearchQuery{TimeStart: &parisStart}
+	if _, args, _ := sq.timeRangeClauses("time", 1); args[0] != start {
+		t.Errorf("got start arg %v, expected %v", args[0], start)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&timeStart=2022-03-07&timeEndInclusive", nil)
+	if _, err := searchQueryFromRequest(r); err == nil {
+		t.Errorf("Expected an error for timeEndInclusive without timeEnd")
+	}
+}
+
+func TestNumericFilters(t *testing.T) {
+	testCases := []struct {
+		s         string
+		expected  NumericFilter
+		expectErr bool
+	}{
+		{s: "response_status_code>=400", expected: NumericFilter{"response_status_code", ">=", 400}},
+		{s: "response_content_length>5242880", expected: NumericFilter{"response_content_length", ">", 5242880}},
+		{s: "request_content_length=0", expected: NumericFilter{"request_content_length", "=", 0}},
+		{s: "response_status_code<500", expected: NumericFilter{"response_status_code", "<", 500}},
+		{s: "time_to_response_ns>500000000", expected: NumericFilter{"time_to_response_ns", ">", 500000000}},
+		{s: "bucket>1", expectErr: true},
+		{s: "response_status_code<>1", expectErr: true},
+		{s: "response_status_code>=abc", expectErr: true},
+		{s: "response_status_code", expectErr: true},
+	}
+	for _, testCase := range testCases {
+		f, err := parseNumericFilter(testCase.s)
+		if testCase.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", testCase.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", testCase.s, err)
+		} else if f != testCase.expected {
+			t.Errorf("%s: got %v, expected %v", testCase.s, f, testCase.expected)
+		}
+	}
+
+	clauses, args, dollar, err := generateNumericFilterClauses([]NumericFilter{
+		{"response_status_code", ">=", 400},
+		{"response_content_length", ">", 5242880},
+	}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"response_status_code >= $2", "response_content_length > $3"}; !reflect.DeepEqual(clauses, expected) {
+		t.Errorf("got clauses %v, expected %v", clauses, expected)
+	}
+	if expected := []interface{}{int64(400), int64(5242880)}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+	if dollar != 4 {
+		t.Errorf("got dollarEnd %d, expected 4", dollar)
+	}
+
+	if _, _, _, err := generateNumericFilterClauses([]NumericFilter{{"object; DROP TABLE x", ">", 1}}, 1); err == nil {
+		t.Errorf("expected an error for a non-numeric column")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=raw&nf=response_status_code>=400", nil)
+	if _, err := searchQueryFromRequest(r); err == nil {
+		t.Errorf("expected an error for numeric filters on a raw query")
+	}
+
+	// Slow requests, slowest first.
+	r = httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&nf=time_to_response_ns>500000000&sort=time_to_response_ns:desc", nil)
+	sq, err := searchQueryFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	where, args, _, err := (&DBClient{}).reqInfoWhereClause(sq, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "WHERE time_to_response_ns > $1"; where != expected || !reflect.DeepEqual(args, []interface{}{int64(500000000)}) {
+		t.Errorf("got %q %v, expected %q", where, args, expected)
+	}
+	if orderBy, err := sq.orderByClause(); err != nil || orderBy != "time_to_response_ns DESC NULLS LAST, time DESC" {
+		t.Errorf("got order by %q, %v", orderBy, err)
+	}
+	if _, _, _, err := (&DBClient{}).rawWhereClause(&SearchQuery{Query: rawQ, NumericFilters: sq.NumericFilters}, 1); err == nil {
+		t.Errorf("expected an error for numeric filters on a raw query")
+	}
+}
+
+func TestBaseFilter(t *testing.T) {
+	c := &DBClient{BaseFilter: BaseFilter{"bucket": {"tenant1-*"}}}
+
+	// The caller filtering on the same key only narrows the results further.
+	sq := SearchQuery{
+		Query:   reqInfoQ,
+		FParams: map[fParam][]string{"bucket": {"tenant2-photos"}},
+	}
+	where, args, dollar, err := c.reqInfoWhereClause(&sq, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "WHERE bucket LIKE $1 AND bucket = $2"; where != expected {
+		t.Errorf("got %q, expected %q", where, expected)
+	}
+	if expected := []interface{}{"tenant1-%", "tenant2-photos"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+	if dollar != 3 {
+		t.Errorf("got dollarEnd %d, expected 3", dollar)
+	}
+
+	// The base filter applies even without any search filters.
+	where, _, _, err = c.reqInfoWhereClause(&SearchQuery{Query: reqInfoQ}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "WHERE bucket LIKE $1"; where != expected {
+		t.Errorf("got %q, expected %q", where, expected)
+	}
+
+	clauses, _, _, err := c.BaseFilter.generateClauses(rawQ, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"log->'api'->>'bucket' LIKE $1"}; !reflect.DeepEqual(clauses, expected) {
+		t.Errorf("got %v, expected %v", clauses, expected)
+	}
+
+	for _, invalid := range []BaseFilter{{"bucket = '' OR 1=1 --": {"x"}}, {"bucket": nil}} {
+		c.BaseFilter = invalid
+		if _, _, _, err := c.reqInfoWhereClause(&sq, 1); err == nil {
+			t.Errorf("expected an error for base filter %v", invalid)
+		}
+	}
+}
+
+func TestFilterGroups(t *testing.T) {
+	c := &DBClient{}
+
+	sq := &SearchQuery{
+		Query:   reqInfoQ,
+		FParams: map[fParam][]string{"access_key": {"minio"}},
+		FilterGroups: []map[fParam][]string{
+			{"bucket": {"photos"}, "api_name": {"PutObject"}},
+			{"bucket": {"videos-*"}, "api_name": {"DeleteObject", "DeleteMultipleObjects"}},
+		},
+	}
+	where, args, dollar, err := c.reqInfoWhereClause(sq, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "WHERE access_key = $1 AND " +
+		"((api_name = $2 AND bucket = $3) OR (api_name IN ($4, $5) AND bucket LIKE $6))"
+	if where != expected {
+		t.Errorf("got %q, expected %q", where, expected)
+	}
+	expectedArgs := []interface{}{"minio", "PutObject", "photos", "DeleteObject", "DeleteMultipleObjects", "videos-%"}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("got args %v, expected %v", args, expectedArgs)
+	}
+	if dollar != 7 {
+		t.Errorf("got dollarEnd %d, expected 7", dollar)
+	}
+
+	// Groups given as query parameters, in the order of their labels.
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=raw&fg=b:bucket:photos&fg=a:api_name:DeleteObject&fg=b:api_name:PutObject", nil)
+	sq, err = searchQueryFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	where, args, _, err = c.rawWhereClause(sq, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "WHERE ((log->'api'->>'bucket' = $1 AND log->'api'->>'name' = $2) OR (log->'api'->>'name' = $3))"
+	if where != expected {
+		t.Errorf("got %q, expected %q", where, expected)
+	}
+	if expectedArgs := []interface{}{"photos", "PutObject", "DeleteObject"}; !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("got args %v, expected %v", args, expectedArgs)
+	}
+
+	for _, params := range []string{"fg=bucket:photos", "fg=:bucket:photos", "fg=1:bogus:x", "fg=1:response_status_code:OK"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&"+params, nil)
+		if _, err := searchQueryFromRequest(r); err == nil {
+			t.Errorf("%s: expected an error", params)
+		}
+	}
+
+	for _, groups := range [][]map[fParam][]string{{{}}, {{"bucket": {"photos"}}, {"bucket": nil}}} {
+		sq := &SearchQuery{Query: reqInfoQ, FilterGroups: groups}
+		var verr *ValidationError
+		if err := sq.Validate(); !errors.As(err, &verr) {
+			t.Errorf("%v: got %v, expected a validation error", groups, err)
+		}
+	}
+}
+
+func TestAllowedBuckets(t *testing.T) {
+	c := &DBClient{}
+	allowed := []string{"tenant1-photos", "tenant1-*"}
+
+	testCases := []struct {
+		sq           SearchQuery
+		expected     string
+		expectedArgs []interface{}
+	}{
+		// Without any filters.
+		{
+			SearchQuery{Query: reqInfoQ},
+			"WHERE bucket IN ($1, $2)",
+			[]interface{}{"tenant1-photos", "tenant1-*"},
+		},
+		// A spoofed bucket filter cannot widen the search.
+		{
+			SearchQuery{Query: reqInfoQ, FParams: map[fParam][]string{"bucket": {"tenant2-photos"}}},
+			"WHERE bucket IN ($1, $2) AND bucket = $3",
+			[]interface{}{"tenant1-photos", "tenant1-*", "tenant2-photos"},
+		},
+		{
+			SearchQuery{Query: reqInfoQ, FParamsNot: map[fParam][]string{"bucket": {"tenant1-photos"}}},
+			"WHERE bucket IN ($1, $2) AND bucket <> $3",
+			[]interface{}{"tenant1-photos", "tenant1-*", "tenant1-photos"},
+		},
+		{
+			SearchQuery{Query: rawQ, FParams: map[fParam][]string{rawQRequestFieldsMap["bucket"]: {"*"}}},
+			"WHERE log->'api'->>'bucket' IN ($1, $2) AND log->'api'->>'bucket' LIKE $3",
+			[]interface{}{"tenant1-photos", "tenant1-*", "%"},
+		},
+	}
+	for _, tc := range testCases {
+		sq := tc.sq
+		sq.AllowedBuckets = allowed
+		whereClause := c.reqInfoWhereClause
+		if sq.Query == rawQ {
+			whereClause = c.rawWhereClause
+		}
+		where, args, dollar, err := whereClause(&sq, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if where != tc.expected {
+			t.Errorf("got %q, expected %q", where, tc.expected)
+		}
+		if !reflect.DeepEqual(args, tc.expectedArgs) {
+			t.Errorf("got args %v, expected %v", args, tc.expectedArgs)
+		}
+		if dollar != len(tc.expectedArgs)+1 {
+			t.Errorf("got dollarEnd %d, expected %d", dollar, len(tc.expectedArgs)+1)
+		}
+	}
+
+	// Without allowed buckets, the search is not restricted.
+	where, _, _, err := c.reqInfoWhereClause(&SearchQuery{Query: reqInfoQ, AllowedBuckets: []string{}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if where != "" {
+		t.Errorf("got %q, expected no where-clause", where)
+	}
+}
+
+func TestLogContains(t *testing.T) {
+	c := &DBClient{}
+
+	testCases := []struct {
+		logContains string
+		expectedArg string
+	}{
+		{"deadbeef", "%deadbeef%"},
+		{"50%_off", `%50\%\_off%`},
+		{`C:\temp`, `%C:\\temp%`},
+	}
+	for _, testCase := range testCases {
+		sq := SearchQuery{
+			Query:       rawQ,
+			FParams:     map[fParam][]string{rawQRequestFieldsMap["bucket"]: {"photos"}},
+			LogContains: testCase.logContains,
+		}
+		where, args, dollar, err := c.rawWhereClause(&sq, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "WHERE log->'api'->>'bucket' = $1 AND log::text ILIKE $2"; where != expected {
+			t.Errorf("got %q, expected %q", where, expected)
+		}
+		if expected := []interface{}{"photos", testCase.expectedArg}; !reflect.DeepEqual(args, expected) {
+			t.Errorf("got args %v, expected %v", args, expected)
+		}
+		if dollar != 3 {
+			t.Errorf("got dollarEnd %d, expected 3", dollar)
+		}
+	}
+
+	sq := &SearchQuery{Query: reqInfoQ, LogContains: "deadbeef"}
+	if _, _, _, err := c.reqInfoWhereClause(sq, 1); err == nil {
+		t.Errorf("expected an error for a reqinfo query")
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&logContains=deadbeef", nil)
+	if _, err := searchQueryFromRequest(r); err == nil {
+		t.Errorf("expected an error for a reqinfo query")
+	}
+	r = httptest.NewRequest(http.MethodGet, "/api/query?q=raw&logContains=dead%25beef", nil)
+	sq, err := searchQueryFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sq.LogContains != "dead%beef" {
+		t.Errorf("got %q, expected %q", sq.LogContains, "dead%beef")
+	}
+}
+
+func TestOrderByClause(t *testing.T) {
+	testCases := []struct {
+		sq       SearchQuery
+		expected string
+	}{
+		{SearchQuery{Query: reqInfoQ}, "time DESC"},
+		{SearchQuery{Query: rawQ, TimeAscending: true}, "event_time ASC"},
+		{
+			SearchQuery{Query: reqInfoQ, SortBy: []SortField{{"bucket", false}, {"time", true}}},
+			"bucket ASC, time DESC",
+		},
+		{
+			SearchQuery{Query: rawQ, SortBy: []SortField{{"api_name", true}, {"event_time", false}}},
+			"log->'api'->>'name' DESC NULLS LAST, event_time ASC",
+		},
+		// The time is appended as a tiebreaker.
+		{
+			SearchQuery{Query: reqInfoQ, SortBy: []SortField{{"request_id", false}}},
+			"request_id ASC, time DESC",
+		},
+		{
+			SearchQuery{Query: rawQ, TimeAscending: true, SortBy: []SortField{{"bucket", true}}},
+			"log->'api'->>'bucket' DESC NULLS LAST, event_time ASC",
+		},
+	}
+	for i, testCase := range testCases {
+		got, err := testCase.sq.orderByClause()
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if got != testCase.expected {
+			t.Errorf("case %d: got %q, expected %q", i, got, testCase.expected)
+		}
+	}
+
+	sq := SearchQuery{Query: reqInfoQ, SortBy: []SortField{{"time; DROP TABLE x", false}}}
+	if _, err := sq.orderByClause(); err == nil {
+		t.Errorf("expected an error for an invalid sort column")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&sort=bucket&sort=time:desc", nil)
+	got, err := searchQueryFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []SortField{{"bucket", false}, {"time", true}}; !reflect.DeepEqual(got.SortBy, expected) {
+		t.Errorf("got %v, expected %v", got.SortBy, expected)
+	}
+	for _, u := range []string{
+		"/api/query?q=reqinfo&sort=time:sideways",
+		"/api/query?q=reqinfo&sort=nope",
+		"/api/query?q=reqinfo&sort=bucket&timeAsc",
+	} {
+		r := httptest.NewRequest(http.MethodGet, u, nil)
+		if _, err := searchQueryFromRequest(r); err == nil {
+			t.Errorf("%s: expected an error", u)
+		}
+	}
+}
+
+func TestJSONPathFilters(t *testing.T) {
+	c := &DBClient{}
+
+	sq := &SearchQuery{
+		Query: rawQ,
+		JSONPathFilters: map[string][]string{
+			"api.name":  {"PutObject", "Get*"},
+			"requestID": {"16F0D2CB5B3E3C27"},
+		},
+	}
+	where, args, dollar, err := c.rawWhereClause(sq, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "WHERE (log #>> '{api,name}' = $1 OR log #>> '{api,name}' LIKE $2) AND log #>> '{requestID}' = $3"
+	if where != expected {
+		t.Errorf("got %q, expected %q", where, expected)
+	}
+	if expected := []interface{}{"PutObject", "Get%", "16F0D2CB5B3E3C27"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+	if dollar != 4 {
+		t.Errorf("got dollarEnd %d, expected 4", dollar)
+	}
+
+	for _, path := range []string{"api.name}' OR '1", "requestClaims.sub", ""} {
+		sq := &SearchQuery{Query: rawQ, JSONPathFilters: map[string][]string{path: {"x"}}}
+		if _, _, _, err := c.rawWhereClause(sq, 1); err == nil {
+			t.Errorf("%q: expected an error for an unknown path", path)
+		}
+	}
+	sq = &SearchQuery{Query: reqInfoQ, JSONPathFilters: map[string][]string{"api.name": {"x"}}}
+	if _, _, _, err := c.reqInfoWhereClause(sq, 1); err == nil {
+		t.Errorf("expected an error for a reqinfo query")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=raw&jp=api.bucket:photos&jp=api.bucket:videos", nil)
+	sq, err = searchQueryFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string][]string{"api.bucket": {"photos", "videos"}}; !reflect.DeepEqual(sq.JSONPathFilters, expected) {
+		t.Errorf("got %v, expected %v", sq.JSONPathFilters, expected)
+	}
+	for _, u := range []string{
+		"/api/query?q=reqinfo&jp=api.bucket:photos",
+		"/api/query?q=raw&jp=api.secret:x",
+		"/api/query?q=raw&jp=api.bucket",
+	} {
+		r := httptest.NewRequest(http.MethodGet, u, nil)
+		if _, err := searchQueryFromRequest(r); err == nil {
+			t.Errorf("%s: expected an error", u)
+		}
+	}
+}
+
+func TestJSONPathPresenceFilters(t *testing.T) {
+	c := &DBClient{}
+
+	sq := &SearchQuery{
+		Query:           rawQ,
+		JSONPathExists:  []string{"tags", "api.timeToFirstByte"},
+		JSONPathMissing: []string{"requestClaims", "api.accessKey"},
+	}
+	where, args, dollar, err := c.rawWhereClause(sq, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "WHERE log ? $1 AND log #> $2::text[] IS NOT NULL AND NOT (log ? $3) AND log #> $4::text[] IS NULL"
+	if where != expected {
+		t.Errorf("got %q, expected %q", where, expected)
+	}
+	expectedArgs := []interface{}{"tags", pq.Array([]string{"api", "timeToFirstByte"}), "requestClaims", pq.Array([]string{"api", "accessKey"})}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("got args %v, expected %v", args, expectedArgs)
+	}
+	if dollar != 5 {
+		t.Errorf("got dollarEnd %d, expected 5", dollar)
+	}
+
+	for _, path := range []string{"tags' OR '1", "requestClaims.sub", "api", ""} {
+		sq := &SearchQuery{Query: rawQ, JSONPathMissing: []string{path}}
+		if _, _, _, err := c.rawWhereClause(sq, 1); err == nil {
+			t.Errorf("%q: expected an error for an unknown path", path)
+		}
+	}
+	sq = &SearchQuery{Query: reqInfoQ, JSONPathExists: []string{"tags"}}
+	if _, _, _, err := c.reqInfoWhereClause(sq, 1); err == nil {
+		t.Errorf("expected an error for a reqinfo query")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=raw&jpExists=tags&jpMissing=requestID&jpMissing=api.object", nil)
+	sq, err = searchQueryFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sq.JSONPathExists, []string{"tags"}) || !reflect.DeepEqual(sq.JSONPathMissing, []string{"requestID", "api.object"}) {
+		t.Errorf("got %v and %v", sq.JSONPathExists, sq.JSONPathMissing)
+	}
+	for _, u := range []string{
+		"/api/query?q=reqinfo&jpExists=tags",
+		"/api/query?q=raw&jpExists=api.secret",
+		"/api/query?q=raw&jpMissing=",
+	} {
+		r := httptest.NewRequest(http.MethodGet, u, nil)
+		if _, err := searchQueryFromRequest(r); err == nil {
+			t.Errorf("%s: expected an error", u)
+		}
+	}
+}
+
+func TestSearchQueryFromRequestExport(t *testing.T) {
+	for _, format := range []string{"csv", "tsv", "ndjson", "parquet", "arrow", "xlsx", "count"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&export="+format, nil)
+		sq, err := searchQueryFromRequest(r)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if sq.ExportFormat != format {
+			t.Errorf("got export format %q, expected %q", sq.ExportFormat, format)
+		}
+	}
+	r := httptest.NewRequest(http.MethodGet, `/api/query?q=reqinfo&export=tsv&nullAs=\N`, nil)
+	if sq, err := searchQueryFromRequest(r); err != nil || sq.NullAs != `\N` {
+		t.Errorf("got %+v, %v, expected NullAs to be \\N", sq, err)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&export=csv&columns=time,bucket", nil)
+	if sq, err := searchQueryFromRequest(r); err != nil || !reflect.DeepEqual(sq.Columns, []string{"time", "bucket"}) {
+		t.Errorf("got %+v, %v, expected the time and bucket columns", sq, err)
+	}
+	for _, u := range []string{
+		"/api/query?q=raw&columns=time",
+		"/api/query?q=reqinfo&export=xml",
+		"/api/query?q=raw&export=count&pageSize=10",
+		"/api/query?q=reqinfo&export=ndjson&nullAs=null",
+		"/api/query?q=raw&export=csv&nullAs=null",
+	} {
+		r := httptest.NewRequest(http.MethodGet, u, nil)
+		if _, err := searchQueryFromRequest(r); err == nil {
+			t.Errorf("%s: expected an error", u)
+		}
+	}
+}
+
+func TestStatusClasses(t *testing.T) {
+	c := &DBClient{}
+
+	sq := &SearchQuery{
+		Query:         reqInfoQ,
+		FParams:       map[fParam][]string{"bucket": {"photos"}},
+		StatusClasses: []int{4, 5},
+	}
+	where, args, dollar, err := c.reqInfoWhereClause(sq, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "WHERE bucket = $1 AND (response_status_code BETWEEN $2 AND $3 OR response_status_code BETWEEN $4 AND $5)"
+	if where != expected {
+		t.Errorf("got %q, expected %q", where, expected)
+	}
+	if expected := []interface{}{"photos", 400, 499, 500, 599}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+	if dollar != 6 {
+		t.Errorf("got dollarEnd %d, expected 6", dollar)
+	}
+
+	for _, class := range []int{0, 6, -4} {
+		sq := &SearchQuery{Query: reqInfoQ, StatusClasses: []int{class}}
+		if _, _, _, err := c.reqInfoWhereClause(sq, 1); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("class %d: got %v, expected an invalid query error", class, err)
+		}
+	}
+	sq = &SearchQuery{Query: rawQ, StatusClasses: []int{5}}
+	if _, _, _, err := c.rawWhereClause(sq, 1); err == nil {
+		t.Errorf("expected an error for a raw query")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&statusClass=4xx&statusClass=5", nil)
+	sq, err = searchQueryFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{4, 5}; !reflect.DeepEqual(sq.StatusClasses, expected) {
+		t.Errorf("got %v, expected %v", sq.StatusClasses, expected)
+	}
+	for _, u := range []string{
+		"/api/query?q=reqinfo&statusClass=6xx",
+		"/api/query?q=reqinfo&statusClass=50x",
+		"/api/query?q=raw&statusClass=5xx",
+	} {
+		r := httptest.NewRequest(http.MethodGet, u, nil)
+		if _, err := searchQueryFromRequest(r); err == nil {
+			t.Errorf("%s: expected an error", u)
+		}
+	}
+}
+
+func TestOnlyErrors(t *testing.T) {
+	c := &DBClient{}
+
+	sq := &SearchQuery{
+		Query:         reqInfoQ,
+		FParams:       map[fParam][]string{"bucket": {"photos"}},
+		StatusClasses: []int{5},
+		OnlyErrors:    true,
+	}
+	where, args, _, err := c.reqInfoWhereClause(sq, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "WHERE bucket = $1 AND (response_status_code BETWEEN $2 AND $3) AND response_status_code >= 400"
+	if where != expected {
+		t.Errorf("got %q, expected %q", where, expected)
+	}
+	if expected := []interface{}{"photos", 500, 599}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+	sq = &SearchQuery{Query: rawQ, OnlyErrors: true}
+	if _, _, _, err := c.rawWhereClause(sq, 1); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got %v, expected an invalid query error for a raw query", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=joined&onlyErrors", nil)
+	sq, err = searchQueryFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sq.OnlyErrors {
+		t.Errorf("OnlyErrors not set")
+	}
+	r = httptest.NewRequest(http.MethodGet, "/api/query?q=raw&onlyErrors", nil)
+	if _, err := searchQueryFromRequest(r); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got %v, expected an invalid query error for a raw query", err)
+	}
+}
+
+func TestObjectPresence(t *testing.T) {
+	c := &DBClient{}
+
+	testCases := []struct {
+		presence ObjectPresence
+		expected string
+	}{
+		{ObjectAny, "WHERE bucket = $1"},
+		{ObjectEmpty, "WHERE bucket = $1 AND (object IS NULL OR object = '')"},
+		{ObjectNonEmpty, "WHERE bucket = $1 AND object <> ''"},
+	}
+	for _, testCase := range testCases {
+		sq := &SearchQuery{
+			Query:          reqInfoQ,
+			FParams:        map[fParam][]string{"bucket": {"photos"}},
+			ObjectPresence: testCase.presence,
+		}
+		where, args, _, err := c.reqInfoWhereClause(sq, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if where != testCase.expected {
+			t.Errorf("%d: got %q, expected %q", testCase.presence, where, testCase.expected)
+		}
+		if expected := []interface{}{"photos"}; !reflect.DeepEqual(args, expected) {
+			t.Errorf("%d: got args %v, expected %v", testCase.presence, args, expected)
+		}
+	}
+	sq := &SearchQuery{Query: reqInfoQ, ObjectPresence: ObjectPresence(7)}
+	if _, _, _, err := c.reqInfoWhereClause(sq, 1); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got %v, expected an invalid query error for an unknown presence", err)
+	}
+	sq = &SearchQuery{Query: rawQ, ObjectPresence: ObjectEmpty}
+	if _, _, _, err := c.rawWhereClause(sq, 1); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got %v, expected an invalid query error for a raw query", err)
+	}
+
+	for param, expected := range map[string]ObjectPresence{"any": ObjectAny, "empty": ObjectEmpty, "nonempty": ObjectNonEmpty} {
+		r := httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&objectPresence="+param, nil)
+		sq, err := searchQueryFromRequest(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sq.ObjectPresence != expected {
+			t.Errorf("%s: got %d, expected %d", param, sq.ObjectPresence, expected)
+		}
+	}
+	for _, u := range []string{"/api/query?q=reqinfo&objectPresence=some", "/api/query?q=raw&objectPresence=empty"} {
+		r := httptest.NewRequest(http.MethodGet, u, nil)
+		if _, err := searchQueryFromRequest(r); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%s: got %v, expected an invalid query error", u, err)
+		}
+	}
+}
+
+func TestAPINames(t *testing.T) {
+	c := &DBClient{}
+	timeStart := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	timeEnd := timeStart.Add(time.Hour)
+
+	testCases := []struct {
+		apiNames      []string
+		expectedWhere string
+		expectedArgs  []interface{}
+	}{
+		{
+			expectedWhere: "WHERE time >= $1 AND time < $2",
+			expectedArgs:  []interface{}{timeStart, timeEnd},
+		},
+		{
+			apiNames:      []string{"PutObject"},
+			expectedWhere: "WHERE time >= $1 AND time < $2 AND api_name IN ($3)",
+			expectedArgs:  []interface{}{timeStart, timeEnd, "PutObject"},
+		},
+		{
+			apiNames:      []string{"PutObject", "CompleteMultipartUpload", "CopyObject"},
+			expectedWhere: "WHERE time >= $1 AND time < $2 AND api_name IN ($3, $4, $5)",
+			expectedArgs:  []interface{}{timeStart, timeEnd, "PutObject", "CompleteMultipartUpload", "CopyObject"},
+		},
+	}
+	for i, testCase := range testCases {
+		sq := &SearchQuery{
+			Query:     reqInfoQ,
+			TimeStart: &timeStart,
+			TimeEnd:   &timeEnd,
+			APINames:  testCase.apiNames,
+		}
+		where, args, dollar, err := c.reqInfoWhereClause(sq, 1)
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if where != testCase.expectedWhere {
+			t.Errorf("Test %d: got %q, expected %q", i, where, testCase.expectedWhere)
+		}
+		if !reflect.DeepEqual(args, testCase.expectedArgs) {
+			t.Errorf("Test %d: got args %v, expected %v", i, args, testCase.expectedArgs)
+		}
+		if dollar != len(testCase.expectedArgs)+1 {
+			t.Errorf("Test %d: got dollarEnd %d, expected %d", i, dollar, len(testCase.expectedArgs)+1)
+		}
+	}
+
+	sq := &SearchQuery{Query: rawQ, APINames: []string{"PutObject", "CopyObject"}}
+	where, _, _, err := c.rawWhereClause(sq, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "WHERE log->'api'->>'name' IN ($1, $2)"; where != expected {
+		t.Errorf("got %q, expected %q", where, expected)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&apiName=PutObject&apiName=CopyObject", nil)
+	sq, err = searchQueryFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"PutObject", "CopyObject"}; !reflect.DeepEqual(sq.APINames, expected) {
+		t.Errorf("got %v, expected %v", sq.APINames, expected)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&apiName=", nil)
+	if _, err := searchQueryFromRequest(r); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got %v, expected an invalid query error for an empty API name", err)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	c := &DBClient{}
+
+	sq := &SearchQuery{Query: reqInfoQ, APINames: []string{"PutObject"}, Versions: []string{"1", "2"}}
+	where, args, _, err := c.reqInfoWhereClause(sq, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "WHERE api_name IN ($1) AND version IN ($2, $3)"; where != expected {
+		t.Errorf("got %q, expected %q", where, expected)
+	}
+	if expected := []interface{}{"PutObject", "1", "2"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+
+	sq = &SearchQuery{Query: rawQ, Versions: []string{"1"}}
+	if where, _, _, err = c.rawWhereClause(sq, 1); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "WHERE log->>'version' IN ($1)"; where != expected {
+		t.Errorf("got %q, expected %q", where, expected)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&version=1&version=2", nil)
+	if sq, err = searchQueryFromRequest(r); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"1", "2"}; !reflect.DeepEqual(sq.Versions, expected) {
+		t.Errorf("got %v, expected %v", sq.Versions, expected)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&version=", nil)
+	if _, err := searchQueryFromRequest(r); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got %v, expected an invalid query error for an empty version", err)
+	}
+}
+
+func TestCIDRFilter(t *testing.T) {
+	c := &DBClient{}
+
+	sq := &SearchQuery{
+		Query:           reqInfoQ,
+		FParams:         map[fParam][]string{"bucket": {"photos"}},
+		RemoteHostCIDRs: []string{"10.2.3.4/16", "2001:db8::/32"},
+	}
+	where, args, dollar, err := c.reqInfoWhereClause(sq, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "WHERE bucket = $1 AND CASE WHEN remote_host ~ $2 THEN " +
+		"remote_host::inet <<= $3::inet OR remote_host::inet <<= $4::inet ELSE false END"
+	if where != expected {
+		t.Errorf("got %q, expected %q", where, expected)
+	}
+	// The ranges are bound in their canonical form.
+	if expected := []interface{}{"photos", ipAddressPattern, "10.2.0.0/16", "2001:db8::/32"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+	if dollar != 5 {
+		t.Errorf("got dollarEnd %d, expected 5", dollar)
+	}
+
+	for _, cidr := range []string{"10.2.0.0", "10.2.0.0/33", "example.com/8", "'; DROP TABLE request_info; --"} {
+		sq := &SearchQuery{Query: reqInfoQ, RemoteHostCIDRs: []string{cidr}}
+		if _, _, _, err := c.reqInfoWhereClause(sq, 1); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%q: got %v, expected an invalid query error", cidr, err)
+		}
+	}
+	sq = &SearchQuery{Query: rawQ, RemoteHostCIDRs: []string{"10.0.0.0/8"}}
+	if _, _, _, err := c.rawWhereClause(sq, 1); err == nil {
+		t.Errorf("expected an error for a raw query")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=joined&cidr=10.0.0.0/8&cidr=fd00::/8", nil)
+	sq, err = searchQueryFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"10.0.0.0/8", "fd00::/8"}; !reflect.DeepEqual(sq.RemoteHostCIDRs, expected) {
+		t.Errorf("got %v, expected %v", sq.RemoteHostCIDRs, expected)
+	}
+	for _, u := range []string{"/api/query?q=reqinfo&cidr=10.0.0.0", "/api/query?q=raw&cidr=10.0.0.0/8"} {
+		r := httptest.NewRequest(http.MethodGet, u, nil)
+		if _, err := searchQueryFromRequest(r); err == nil {
+			t.Errorf("%s: expected an error", u)
+		}
+	}
+}
+
+func TestIPAddressPattern(t *testing.T) {
+	re := regexp.MustCompile(ipAddressPattern)
+	for _, v := range []string{
+		"10.2.3.4", "0.0.0.0", "255.255.255.255", "::", "::1", "2001:db8::1", "fe80::1:2:3:4",
+		"1:2:3:4:5:6:7:8", "1::8", "1:2:3:4:5:6:7::", "::ffff:10.2.3.4", "64:ff9b::192.0.2.33", "2001:DB8::A",
+	} {
+		if !re.MatchString(v) || net.ParseIP(v) == nil {
+			t.Errorf("%s: expected an IP address", v)
+		}
+	}
+	for _, v := range []string{
+		"", "example.com", "10.2.3", "256.1.1.1", "10.2.3.4/16", "10.2.3.4:9000", "1:2:3:4:5:6:7:8:9",
+		"1::2::3", ":::", "12345::", "fe80::1%eth0", "[::1]", "::10.2.3",
+	} {
+		if re.MatchString(v) {
+			t.Errorf("%q: unexpectedly matched", v)
+		}
+	}
+}
+
+func TestSearchQueryValidate(t *testing.T) {
+	now := time.Now()
+	hour := time.Hour
+	negative := -time.Hour
+	hundred, zero := 100, 0
+
+	testCases := []struct {
+		sq    SearchQuery
+		field string
+	}{
+		{SearchQuery{Query: rawQ}, ""},
+		{SearchQuery{Query: reqInfoQ, LastDuration: &hour, PageSize: 10, PageNumber: 2}, ""},
+		{SearchQuery{Query: reqInfoQ, TimeStart: &now, TimeEnd: &now, ExportFormat: "parquet"}, ""},
+		{SearchQuery{}, "Query"},
+		{SearchQuery{Query: "bogus"}, "Query"},
+		{SearchQuery{Query: rawQ, LastDuration: &hour, TimeStart: &now}, "LastDuration"},
+		{SearchQuery{Query: rawQ, LastDuration: &hour, TimeEnd: &now}, "LastDuration"},
+		{SearchQuery{Query: rawQ, LastDuration: &negative}, "LastDuration"},
+		{SearchQuery{Query: rawQ, PageSize: -1}, "PageSize"},
+		{SearchQuery{Query: rawQ, PageNumber: -1}, "PageNumber"},
+		{SearchQuery{Query: rawQ, ExportFormat: "xml"}, "ExportFormat"},
+		{SearchQuery{Query: rawQ, Limit: &hundred}, ""},
+		{SearchQuery{Query: rawQ, Limit: &zero}, "Limit"},
+		{SearchQuery{Query: rawQ, Limit: &hundred, PageSize: 10}, "Limit"},
+		{SearchQuery{Query: rawQ, Limit: &hundred, PageNumber: 1}, "Limit"},
+		{SearchQuery{Query: rawQ, Limit: &hundred, ExportFormat: "csv"}, "Limit"},
+		{SearchQuery{Query: rawQ, Limit: &hundred, DataEnvelope: true}, "Limit"},
+		{SearchQuery{Query: reqInfoQ, Columns: []string{"bucket", "time"}}, ""},
+		{SearchQuery{Query: reqInfoQ, Columns: []string{"bucket", "log"}}, "Columns"},
+		{SearchQuery{Query: reqInfoQ, Columns: []string{"bucket", "bucket"}}, "Columns"},
+		{SearchQuery{Query: joinedQ, Columns: []string{"bucket"}}, "Columns"},
+	}
+	for i, testCase := range testCases {
+		err := testCase.sq.Validate()
+		if testCase.field == "" {
+			if err != nil {
+				t.Errorf("Test %d: unexpected error: %v", i, err)
+			}
+			continue
+		}
+		var vErr *ValidationError
+		if !errors.As(err, &vErr) {
+			t.Errorf("Test %d: got %v, expected a validation error", i, err)
+			continue
+		}
+		if vErr.Field != testCase.field {
+			t.Errorf("Test %d: got an error for field %s, expected %s", i, vErr.Field, testCase.field)
+		}
+		if !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("Test %d: expected %v to be an invalid query error", i, err)
+		}
+	}
+}
+
+func TestCommonWhereClauses(t *testing.T) {
+	// The raw and reqinfo queries of the same search must select the same
+	// requests: their where-clauses only differ in the names of the
+	// columns.
+	cols := make([]fParam, 0, len(rawQRequestFieldsMap))
+	for col := range rawQRequestFieldsMap {
+		cols = append(cols, col)
+	}
+	// Longer expressions first, as one may be a prefix of another.
+	sort.Slice(cols, func(i, j int) bool {
+		return len(rawQRequestFieldsMap[cols[i]]) > len(rawQRequestFieldsMap[cols[j]])
+	})
+	rawToReqInfo := []string{"event_time", "time"}
+	for _, col := range cols {
+		rawToReqInfo = append(rawToReqInfo, string(rawQRequestFieldsMap[col]), string(col))
+	}
+	columnRenamer := strings.NewReplacer(rawToReqInfo...)
+
+	c := &DBClient{BaseFilter: BaseFilter{"access_key": {"tenant"}}}
+	testCases := []string{
+		"",
+		"timeStart=2022-03-07T10:00:00Z&timeEnd=2022-03-08T10:00:00%2B02:00",
+		"timeStart=2022-03-07&timeEnd=2022-03-08&timeEndInclusive",
+		"last=1h",
+		"fp=bucket:photos&fp=!api_name:GetObject&fp=~user_agent:curl&fp=^access_key:svc-",
+		"fg=a:bucket:photos&fg=b:api_name:PutObject",
+		"category=Write&timeStart=2022-03-07",
+	}
+	for i, params := range testCases {
+		var wheres []string
+		var args [][]interface{}
+		for _, q := range []qType{rawQ, reqInfoQ} {
+			r := httptest.NewRequest(http.MethodGet, "/api/query?q="+string(q)+"&"+params, nil)
+			sq, err := searchQueryFromRequest(r)
+			if err != nil {
+				t.Fatalf("Test %d: %v", i, err)
+			}
+			sq.AllowedBuckets = []string{"photos", "videos"}
+			whereClause := c.reqInfoWhereClause
+			if q == rawQ {
+				whereClause = c.rawWhereClause
+			}
+			where, whereArgs, _, err := whereClause(sq, 1)
+			if err != nil {
+				t.Fatalf("Test %d: %v", i, err)
+			}
+			wheres = append(wheres, where)
+			args = append(args, whereArgs)
+		}
+		if raw := columnRenamer.Replace(wheres[0]); raw != wheres[1] {
+			t.Errorf("Test %d: raw where-clause %q differs from reqinfo where-clause %q", i, raw, wheres[1])
+		}
+		if !reflect.DeepEqual(args[0], args[1]) {
+			t.Errorf("Test %d: raw args %v differ from reqinfo args %v", i, args[0], args[1])
+		}
+	}
+}
+
+func TestCSVOptions(t *testing.T) {
+	testCases := []struct {
+		params    string
+		expectErr bool
+		expected  *CSVOptions
+	}{
+		{"export=csv", false, nil},
+		{"export=csv&noHeader&delimiter=|", false, &CSVOptions{Delimiter: '|'}},
+		{"export=tsv&noHeader", false, &CSVOptions{}},
+		{"export=csv&delimiter=%09", false, &CSVOptions{IncludeHeader: true, Delimiter: '\t'}},
+		{"export=csv&delimiter=%22", true, nil},
+		{"export=csv&delimiter=||", true, nil},
+		{"export=csv&delimiter=", true, nil},
+		{"export=ndjson&noHeader", true, nil},
+		{"delimiter=%3B", true, nil},
+		{"export=csv&delimiter=%3B", false, &CSVOptions{IncludeHeader: true, Delimiter: ';'}},
+	}
+	for i, testCase := range testCases {
+		r := httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&"+testCase.params, nil)
+		sq, err := searchQueryFromRequest(r)
+		if testCase.expectErr {
+			if !errors.Is(err, ErrInvalidQuery) {
+				t.Errorf("Test %d: expected an invalid query error, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(sq.CSVOptions, testCase.expected) {
+			t.Errorf("Test %d: got %+v, expected %+v", i, sq.CSVOptions, testCase.expected)
+		}
+	}
+
+	for _, sq := range []SearchQuery{
+		{Query: reqInfoQ, ExportFormat: "csv", CSVOptions: &CSVOptions{Delimiter: 'x'}},
+		{Query: reqInfoQ, ExportFormat: "parquet", CSVOptions: &CSVOptions{IncludeHeader: true}},
+	} {
+		var verr *ValidationError
+		if err := sq.Validate(); !errors.As(err, &verr) || verr.Field != "CSVOptions" {
+			t.Errorf("%+v: expected a CSVOptions validation error, got %v", sq.CSVOptions, err)
+		}
+	}
+}
+
+func TestBestEffort(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=raw&export=csv&bestEffort", nil)
+	sq, err := searchQueryFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sq.BestEffort {
+		t.Errorf("BestEffort not set")
+	}
+
+	for _, params := range []string{
+		"q=joined&export=ndjson&bestEffort",
+		"q=reqinfo&bestEffort",
+		"q=reqinfo&export=count&bestEffort",
+		"q=reqinfo&export=xlsx&bestEffort",
+		"q=reqinfo&export=ndjson&sort=bucket:asc&bestEffort",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/query?"+params, nil)
+		if _, err := searchQueryFromRequest(r); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%s: expected an invalid query error, got %v", params, err)
+		}
+	}
+}
+
+func TestDedupByRequestID(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&dedup", nil)
+	sq, err := searchQueryFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sq.DedupByRequestID {
+		t.Errorf("DedupByRequestID not set")
+	}
+
+	for _, params := range []string{
+		"q=raw&dedup",
+		"q=joined&dedup",
+		"q=reqinfo&export=ndjson&bestEffort&dedup",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/query?"+params, nil)
+		if _, err := searchQueryFromRequest(r); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%s: expected an invalid query error, got %v", params, err)
+		}
+	}
+
+	sq = &SearchQuery{Query: reqInfoQ, DedupByRequestID: true}
+	if err := checkFollowQuery(sq, "Tail"); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got %v, expected an invalid query error for Tail", err)
+	}
+}
+
+func TestGenerateSuffixFilterClauses(t *testing.T) {
+	clauses, args, dollar := generateSuffixFilterClauses(map[fParam][]string{
+		"object": {".mp4", ".tar.gz"},
+	}, 2)
+
+	// The suffixes are bound as they are ('.' is no LIKE wildcard), and the
+	// match is anchored at the end of the field.
+	expectedClauses := []string{"(object IS NOT NULL AND (object LIKE '%' || $2 OR object LIKE '%' || $3))"}
+	expectedArgs := []interface{}{".mp4", ".tar.gz"}
+	if !reflect.DeepEqual(clauses, expectedClauses) {
+		t.Errorf("got clauses %v, expected %v", clauses, expectedClauses)
+	}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("got args %v, expected %v", args, expectedArgs)
+	}
+	if dollar != 4 {
+		t.Errorf("got dollarEnd %d, expected 4", dollar)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&fp=$object:.mp4&fp=bucket:videos", nil)
+	sq, err := searchQueryFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &DBClient{}
+	where, args, _, err := c.reqInfoWhereClause(sq, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "WHERE bucket = $1 AND (object IS NOT NULL AND (object LIKE '%' || $2))"; where != expected {
+		t.Errorf("got %q, expected %q", where, expected)
+	}
+	if expected := []interface{}{"videos", ".mp4"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+
+	for _, params := range []string{"q=reqinfo&fp=$bucket:videos", "q=reqinfo&fp=$object:"} {
+		r = httptest.NewRequest(http.MethodGet, "/api/query?"+params, nil)
+		if _, err := searchQueryFromRequest(r); err == nil {
+			t.Errorf("%s: expected an error", params)
+		}
+	}
+	sq = &SearchQuery{Query: reqInfoQ, FParamsSuffix: map[fParam][]string{"object": {""}}}
+	if err := sq.Validate(); err == nil {
+		t.Errorf("expected an error for an empty suffix")
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	sq, err := ParseSearchQuery(url.Values{
+		"q":         {"reqinfo"},
+		"timeStart": {"2022-03-01T10:00:00Z"},
+		"timeEnd":   {"2022-03-02"},
+		"pageSize":  {"50"},
+		"pageStart": {"2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	end := time.Date(2022, 3, 2, 0, 0, 0, 0, time.UTC)
+	if sq.Query != reqInfoQ || !sq.TimeStart.Equal(start) || !sq.TimeEnd.Equal(end) || sq.PageSize != 50 || sq.PageNumber != 2 {
+		t.Errorf("got %+v", sq)
+	}
+
+	testCases := []struct {
+		values        url.Values
+		expectedParam string
+	}{
+		{url.Values{"q": {"bogus"}}, "q"},
+		{url.Values{"q": {"raw"}, "timeStart": {"yesterday"}}, "timeStart"},
+		{url.Values{"q": {"raw"}, "timeEnd": {"2022-13-01T00:00:00Z"}}, "timeEnd"},
+		{url.Values{"q": {"raw"}, "last": {"1d"}}, "last"},
+		{url.Values{"q": {"raw"}, "last": {"1h"}, "timeStart": {"2022-03-01"}}, "last"},
+		{url.Values{"q": {"raw"}, "timeTruncate": {"-1m"}}, "timeTruncate"},
+		{url.Values{"q": {"raw"}, "timeZone": {"New York"}}, "timeZone"},
+		{url.Values{"q": {"raw"}, "export": {"csv"}, "flushEvery": {"-1"}}, "flushEvery"},
+		{url.Values{"q": {"raw"}, "export": {"ndjson"}, "flushEvery": {"100"}}, "flushEvery"},
+		{url.Values{"q": {"raw"}, "pageSize": {"ten"}}, "pageSize"},
+		{url.Values{"q": {"raw"}, "export": {"xml"}}, "export"},
+		{url.Values{"q": {"raw"}, "fp": {"bucket"}}, "fp"},
+		{url.Values{"q": {"reqinfo"}, "sort": {"log"}}, "sort"},
+	}
+	for i, testCase := range testCases {
+		_, err := ParseSearchQuery(testCase.values)
+		var pErr *ParamError
+		if !errors.As(err, &pErr) || pErr.Param != testCase.expectedParam {
+			t.Errorf("Test %d: got %v, expected an error for the %s parameter", i, err, testCase.expectedParam)
+			continue
+		}
+		if !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("Test %d: got %v, expected an invalid query error", i, err)
+		}
+	}
+
+	sq, err = ParseSearchQuery(url.Values{"q": {"raw"}, "export": {"ndjson"}, "omitEmpty": {""}})
+	if err != nil || !sq.OmitEmpty {
+		t.Errorf("got %+v, %v, expected OmitEmpty to be set", sq, err)
+	}
+	if _, err := ParseSearchQuery(url.Values{"q": {"raw"}, "export": {"csv"}, "omitEmpty": {""}}); err == nil {
+		t.Errorf("expected an error for omitEmpty with a csv export")
+	}
+
+	sq, err = ParseSearchQuery(url.Values{"q": {"reqinfo"}, "export": {"ndjson"}, "manifest": {""}})
+	if err != nil || !sq.IncludeManifest {
+		t.Errorf("got %+v, %v, expected IncludeManifest to be set", sq, err)
+	}
+	for _, export := range []string{"", "csv"} {
+		_, err := ParseSearchQuery(url.Values{"q": {"reqinfo"}, "export": {export}, "manifest": {""}})
+		var pErr *ParamError
+		if !errors.As(err, &pErr) || pErr.Param != "manifest" {
+			t.Errorf("export %q: got %v, expected an error for the manifest parameter", export, err)
+		}
+	}
+
+	_, err = ParseSearchQuery(url.Values{"q": {"reqinfo"}, "columns": {"time,time"}})
+	var vErr *ValidationError
+	if !errors.As(err, &vErr) || vErr.Field != "Columns" {
+		t.Errorf("got %v, expected a validation error for the Columns field", err)
+	}
+}
+
+func TestPagingClause(t *testing.T) {
+	limit := 100
+	testCases := []struct {
+		sq             SearchQuery
+		expectedClause string
+		expectedArgs   []interface{}
+	}{
+		{SearchQuery{PageNumber: 2, PageSize: 10}, "OFFSET $3 LIMIT $4", []interface{}{20, 10}},
+		{SearchQuery{PageNumber: 2, PageSize: 10, DataEnvelope: true}, "OFFSET $3 LIMIT $4", []interface{}{20, 11}},
+		{SearchQuery{Limit: &limit}, "LIMIT $3", []interface{}{100}},
+		{SearchQuery{ExportFormat: "csv"}, "", nil},
+	}
+	for i, testCase := range testCases {
+		clause, args := testCase.sq.pagingClause(3)
+		if clause != testCase.expectedClause || !reflect.DeepEqual(args, testCase.expectedArgs) {
+			t.Errorf("Test %d: got %q %v, expected %q %v", i, clause, args, testCase.expectedClause, testCase.expectedArgs)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&limit=100", nil)
+	sq, err := searchQueryFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sq.Limit == nil || *sq.Limit != 100 || sq.PageSize != 0 {
+		t.Errorf("got limit %v and page size %d, expected 100 and 0", sq.Limit, sq.PageSize)
+	}
+	if err := sq.Validate(); err != nil {
+		t.Error(err)
+	}
+	for _, u := range []string{
+		"/api/query?q=reqinfo&limit=0",
+		"/api/query?q=reqinfo&limit=100&pageSize=10",
+		"/api/query?q=reqinfo&limit=100&export=csv",
+	} {
+		r := httptest.NewRequest(http.MethodGet, u, nil)
+		if _, err := searchQueryFromRequest(r); err == nil {
+			t.Errorf("%s: expected an error", u)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// applicationName is the application_name of the connections of clients,
+// unless their connection string sets another one, so that they can be told
+// apart in pg_stat_activity.
+const applicationName = "logsearchapi"
+
+// withApplicationName returns the connection string connStr setting the
+// application_name of connections to applicationName, unless connStr sets
+// it already. connStr is returned as is when it is malformed, for the
+// driver to report the error.
+func withApplicationName(connStr string) string {
+	values, err := connStringValues(connStr)
+	if err != nil {
+		return connStr
+	}
+	if _, ok := values["application_name"]; ok {
+		return connStr
+	}
+	if !isConnURL(connStr) {
+		if strings.TrimSpace(connStr) == "" {
+			return "application_name=" + applicationName
+		}
+		return connStr + " application_name=" + applicationName
+	}
+	sep := "?"
+	if strings.Contains(connStr, "?") {
+		sep = "&"
+	}
+	return connStr + sep + "application_name=" + applicationName
+}
+
+// maxTraceIDLen is the maximum length of the trace ID of searches.
+const maxTraceIDLen = 64
+
+// validateTraceID checks that the trace ID of a search is made of letters,
+// digits, dashes and underscores only, as it is written in a SQL comment.
+func validateTraceID(id string) error {
+	if len(id) > maxTraceIDLen {
+		return fmt.Errorf("longer than %d characters", maxTraceIDLen)
+	}
+	for _, r := range id {
+		if !isIDChar(r) {
+			return fmt.Errorf("invalid character %q", r)
+		}
+	}
+	return nil
+}
+
+// isIDChar returns true if r is a letter, a digit, a dash or an underscore,
+// the characters of trace IDs and cancel tokens.
+func isIDChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_'
+}
+
+// NewTraceID returns a random trace ID for a search.
+func NewTraceID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// WithTagStatements sets the TagStatements of the client.
+func WithTagStatements(tag bool) DBClientOption {
+	return func(c *DBClient) {
+		c.TagStatements = tag
+	}
+}
+
+// tagStatement returns the statement q of the search s prefixed with a
+// comment naming the query type and the trace ID of s, e.g.
+// `/* logsearch:reqinfo trace=8f2c... */`, when the client tags its
+// statements. Both are validated by s.Validate, so that the comment cannot
+// be closed early.
+func (c *DBClient) tagStatement(s *SearchQuery, q string) string {
+	if !c.TagStatements {
+		return q
+	}
+	tag := "logsearch:" + string(s.Query)
+	if s.TraceID != "" {
+		tag += " trace=" + s.TraceID
+	}
+	return "/* " + tag + " */ " + q
+}
@@ -0,0 +1,93 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestWithApplicationName(t *testing.T) {
+	testCases := []struct {
+		connStr  string
+		expected string
+	}{
+		{"postgres://u:p@db:5432/logs", "postgres://u:p@db:5432/logs?application_name=logsearchapi"},
+		{"postgres://u:p@db/logs?sslmode=disable", "postgres://u:p@db/logs?sslmode=disable&application_name=logsearchapi"},
+		{"host=db user=u sslmode=disable", "host=db user=u sslmode=disable application_name=logsearchapi"},
+		{"", "application_name=logsearchapi"},
+		// The application name of the connection string is kept.
+		{"postgres://db/logs?application_name=audit", "postgres://db/logs?application_name=audit"},
+		{"host=db application_name='audit api'", "host=db application_name='audit api'"},
+		// Malformed connection strings are left to the driver.
+		{"host='db", "host='db"},
+	}
+	for _, testCase := range testCases {
+		if got := withApplicationName(testCase.connStr); got != testCase.expected {
+			t.Errorf("%q: got %q, want %q", testCase.connStr, got, testCase.expected)
+		}
+		if values, err := connStringValues(withApplicationName(testCase.connStr)); err == nil && values["application_name"] == "" {
+			t.Errorf("%q: no application name in %v", testCase.connStr, values)
+		}
+	}
+}
+
+func TestTagStatement(t *testing.T) {
+	c := &DBClient{MaxPageSize: 100}
+	sq := SearchQuery{Query: reqInfoQ, PageSize: 10, TraceID: "8f2c0d1e"}
+
+	q, _, err := c.BuildSearchSQL(context.Background(), &sq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(q, "/*") {
+		t.Errorf("expected no tag when not enabled, got %s", q)
+	}
+
+	c.TagStatements = true
+	q, _, err = c.BuildSearchSQL(context.Background(), &sq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(q, "/* logsearch:reqinfo trace=8f2c0d1e */ SELECT ") {
+		t.Errorf("expected a tagged statement, got %s", q)
+	}
+
+	sq = SearchQuery{Query: rawQ, ExportFormat: "count"}
+	q, _, err = c.BuildSearchSQL(context.Background(), &sq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(q, "/* logsearch:raw */ SELECT COUNT(*) ") {
+		t.Errorf("expected a tagged count statement, got %s", q)
+	}
+
+	// Trace IDs that could close the comment are rejected.
+	for _, id := range []string{"x */ DROP TABLE t; /*", "a b", strings.Repeat("a", maxTraceIDLen+1)} {
+		sq = SearchQuery{Query: reqInfoQ, PageSize: 10, TraceID: id}
+		var verr *ValidationError
+		if _, _, err := c.BuildSearchSQL(context.Background(), &sq); !errors.As(err, &verr) || verr.Field != "TraceID" {
+			t.Errorf("%q: expected a TraceID validation error, got %v", id, err)
+		}
+	}
+
+	if id := NewTraceID(); len(id) != 16 || validateTraceID(id) != nil {
+		t.Errorf("got invalid trace ID %q", id)
+	}
+}
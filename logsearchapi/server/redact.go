@@ -0,0 +1,330 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// RedactedValue replaces the values of the columns and log fields redacted
+// with SearchQuery.RedactColumns.
+const RedactedValue = "***"
+
+// WithRedactColumns sets the RedactColumns of the client, as parsed e.g. by
+// ParseRedactColumns.
+func WithRedactColumns(columns []string) DBClientOption {
+	return func(c *DBClient) {
+		c.RedactColumns = columns
+	}
+}
+
+// redactLogPaths are the request_info columns that may be redacted, with the
+// dotted paths of the fields of the logs holding their values, or values they
+// are parsed from, e.g. the Authorization header with the access key.
+var redactLogPaths = map[string][]string{
+	"api_name":        {"api.name"},
+	"access_key":      {"api.accessKey", "requestHeader.Authorization"},
+	"bucket":          {"api.bucket"},
+	"object":          {"api.object"},
+	"remote_host":     {"remotehost", "requestHeader.X-Forwarded-For", "requestHeader.X-Real-Ip"},
+	"request_id":      {"requestID", "responseHeader.X-Amz-Request-Id"},
+	"user_agent":      {"userAgent", "requestHeader.User-Agent"},
+	"response_status": {"api.status"},
+}
+
+// validateRedactColumn checks that col is a request_info column of
+// redactLogPaths or, when logPaths is true, the dotted path of a field of the
+// logs.
+func validateRedactColumn(col string, logPaths bool) error {
+	if _, ok := redactLogPaths[col]; ok {
+		return nil
+	}
+	if !logPaths {
+		return fmt.Errorf("unknown column %q", col)
+	}
+	for _, key := range strings.Split(col, ".") {
+		if key == "" {
+			return fmt.Errorf("invalid column or JSON path %q", col)
+		}
+	}
+	return nil
+}
+
+// ParseRedactColumns parses a comma-separated list of the columns and log
+// fields to redact from all searches, as set in DBClient.RedactColumns, e.g.
+// `access_key,requestHeader.X-Amz-Security-Token`.
+func ParseRedactColumns(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	cols := strings.Split(s, ",")
+	for i, col := range cols {
+		cols[i] = strings.TrimSpace(col)
+		if err := validateRedactColumn(cols[i], true); err != nil {
+			return nil, err
+		}
+	}
+	return cols, nil
+}
+
+// validateRedactColumns checks the RedactColumns of s: request_info columns
+// of redactLogPaths, or, for rawQ and joinedQ searches, dotted paths of the
+// fields of the logs. As the redacted values are hidden, the search may not
+// filter, sort or select them, which would tell them apart.
+func (s *SearchQuery) validateRedactColumns() error {
+	for _, col := range s.RedactColumns {
+		if err := validateRedactColumn(col, s.Query != reqInfoQ); err != nil {
+			return &ValidationError{Field: "RedactColumns", Msg: err.Error()}
+		}
+	}
+	if len(s.RedactColumns) == 0 {
+		return nil
+	}
+
+	redactedCols := s.redactedColumns()
+	for _, f := range s.SortBy {
+		if redactedCols[f.Column] {
+			return &ValidationError{Field: "SortBy", Msg: fmt.Sprintf("may not have the redacted column %q", f.Column)}
+		}
+	}
+	for _, col := range s.Columns {
+		if redactedCols[col] {
+			return &ValidationError{Field: "Columns", Msg: fmt.Sprintf("may not have the redacted column %q", col)}
+		}
+	}
+
+	// The filters are keyed by column for reqInfoQ and joinedQ searches,
+	// and by the expression of the column for rawQ searches.
+	redactedParams := make(map[fParam]string, 2*len(redactedCols))
+	for col := range redactedCols {
+		redactedParams[fParam(col)] = col
+		redactedParams[rawQRequestFieldsMap[fParam(col)]] = col
+	}
+	filters := []struct {
+		field string
+		m     map[fParam][]string
+	}{
+		{"FParams", s.FParams},
+		{"FParamsNot", s.FParamsNot},
+		{"FParamsContains", s.FParamsContains},
+		{"FParamsPrefix", s.FParamsPrefix},
+		{"FParamsSuffix", s.FParamsSuffix},
+	}
+	for _, group := range s.FilterGroups {
+		filters = append(filters, struct {
+			field string
+			m     map[fParam][]string
+		}{"FilterGroups", group})
+	}
+	for _, filter := range filters {
+		for k := range filter.m {
+			if col, ok := redactedParams[k]; ok {
+				return &ValidationError{Field: filter.field, Msg: fmt.Sprintf("may not filter on the redacted column %q", col)}
+			}
+		}
+	}
+
+	redactedPaths := make(map[string]bool)
+	for _, path := range s.redactedLogPaths() {
+		redactedPaths[path] = true
+	}
+	for path := range s.JSONPathFilters {
+		if redactedPaths[path] {
+			return &ValidationError{Field: "JSONPathFilters", Msg: fmt.Sprintf("may not filter on the redacted field %q", path)}
+		}
+	}
+	return nil
+}
+
+// redactSearch returns the search query to run for s, also redacting the
+// RedactColumns of the client, so that they are redacted whatever the
+// search. The dotted paths of log fields only apply to rawQ and joinedQ
+// searches.
+func (c *DBClient) redactSearch(s *SearchQuery) *SearchQuery {
+	if len(c.RedactColumns) == 0 {
+		return s
+	}
+	redacted := *s
+	redacted.RedactColumns = append([]string(nil), s.RedactColumns...)
+	for _, col := range c.RedactColumns {
+		if _, ok := redactLogPaths[col]; !ok && s.Query == reqInfoQ {
+			continue
+		}
+		if !containsString(redacted.RedactColumns, col) {
+			redacted.RedactColumns = append(redacted.RedactColumns, col)
+		}
+	}
+	return &redacted
+}
+
+// checkAggregatedColumns returns an invalid query error if one of the
+// columns whose values are output by an aggregation of s, e.g. its group by
+// columns, is redacted by s or by the client, as aggregations output the
+// values as they are.
+func (c *DBClient) checkAggregatedColumns(s *SearchQuery, columns ...string) error {
+	redacted := c.redactSearch(s).redactedColumns()
+	for _, col := range columns {
+		if redacted[col] {
+			return invalidQueryErrorf("The redacted column %s may not be aggregated", col)
+		}
+	}
+	return nil
+}
+
+// redactedColumns returns the set of the request_info columns redacted by s.
+func (s *SearchQuery) redactedColumns() map[string]bool {
+	cols := make(map[string]bool)
+	for _, col := range s.RedactColumns {
+		if _, ok := redactLogPaths[col]; ok {
+			cols[col] = true
+		}
+	}
+	return cols
+}
+
+// redactedLogPaths returns the dotted paths of the fields of the logs
+// redacted by s, including the fields holding the values of its redacted
+// columns.
+func (s *SearchQuery) redactedLogPaths() []string {
+	var paths []string
+	for _, col := range s.RedactColumns {
+		if logPaths, ok := redactLogPaths[col]; ok {
+			paths = append(paths, logPaths...)
+		} else {
+			paths = append(paths, col)
+		}
+	}
+	return paths
+}
+
+// redact replaces the values of the columns and log fields of the scanned
+// row redacted by s with RedactedValue, in place. Empty and NULL values are
+// left as they are. The row is one of the types scanned by searches; an
+// error is returned for any other type.
+func (s *SearchQuery) redact(row interface{}) (err error) {
+	if len(s.RedactColumns) == 0 {
+		return nil
+	}
+	switch r := row.(type) {
+	case *ReqInfoRow:
+		s.redactReqInfo(r)
+	case *reqInfoCSVRow:
+		s.redactReqInfoCSV(r)
+	case *logEventRawRow:
+		r.Log, err = s.redactLog(r.Log)
+	case *joinedRawRow:
+		s.redactReqInfo(&r.ReqInfoRow)
+		r.Log, err = s.redactLog(r.Log)
+	case *joinedCSVRow:
+		s.redactReqInfoCSV(&r.reqInfoCSVRow)
+		r.Log, err = s.redactLog(r.Log)
+	default:
+		return fmt.Errorf("Error redacting a row of unexpected type %T", row)
+	}
+	return err
+}
+
+func (s *SearchQuery) redactReqInfo(r *ReqInfoRow) {
+	fields := map[string]*string{
+		"api_name":        &r.APIName,
+		"access_key":      &r.AccessKey,
+		"bucket":          &r.Bucket,
+		"object":          &r.Object,
+		"remote_host":     &r.RemoteHost,
+		"request_id":      &r.RequestID,
+		"user_agent":      &r.UserAgent,
+		"response_status": &r.ResponseStatus,
+	}
+	for col := range s.redactedColumns() {
+		if *fields[col] != "" {
+			*fields[col] = RedactedValue
+		}
+	}
+}
+
+func (s *SearchQuery) redactReqInfoCSV(r *reqInfoCSVRow) {
+	fields := map[string]**string{
+		"access_key":      &r.AccessKey,
+		"bucket":          &r.Bucket,
+		"object":          &r.Object,
+		"remote_host":     &r.RemoteHost,
+		"request_id":      &r.RequestID,
+		"user_agent":      &r.UserAgent,
+		"response_status": &r.ResponseStatus,
+	}
+	for col := range s.redactedColumns() {
+		if col == "api_name" {
+			if r.APIName != "" {
+				r.APIName = RedactedValue
+			}
+			continue
+		}
+		if v := *fields[col]; v != nil && *v != "" {
+			redacted := RedactedValue
+			*fields[col] = &redacted
+		}
+	}
+}
+
+// redactLog returns the JSON log with the fields of the redacted log paths
+// of s replaced. The log is re-encoded only if a field is replaced.
+func (s *SearchQuery) redactLog(log string) (string, error) {
+	paths := s.redactedLogPaths()
+	if len(paths) == 0 {
+		return log, nil
+	}
+	var v map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(log))
+	// Numbers are kept as they are, whatever their precision.
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return "", fmt.Errorf("Error decoding json log: %v", err)
+	}
+	redacted := false
+	for _, path := range paths {
+		redacted = redactJSONPath(v, strings.Split(path, ".")) || redacted
+	}
+	if !redacted {
+		return log, nil
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", fmt.Errorf("Error encoding json log: %v", err)
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// redactJSONPath replaces the field of the decoded JSON object v at the path
+// of keys with RedactedValue, unless it is missing, null or an empty string,
+// returning whether it was replaced.
+func redactJSONPath(v map[string]interface{}, keys []string) bool {
+	field, ok := v[keys[0]]
+	if !ok || field == nil || field == "" {
+		return false
+	}
+	if len(keys) > 1 {
+		obj, ok := field.(map[string]interface{})
+		return ok && redactJSONPath(obj, keys[1:])
+	}
+	v[keys[0]] = RedactedValue
+	return true
+}
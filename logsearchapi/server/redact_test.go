@@ -0,0 +1,215 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedact(t *testing.T) {
+	sq := SearchQuery{Query: reqInfoQ, RedactColumns: []string{"access_key", "remote_host"}}
+
+	row := ReqInfoRow{APIName: "PutObject", AccessKey: "AKIAEXAMPLE", Bucket: "photos"}
+	if err := sq.redact(&row); err != nil {
+		t.Fatal(err)
+	}
+	// The empty remote host is left as is.
+	if row.AccessKey != RedactedValue || row.RemoteHost != "" || row.Bucket != "photos" {
+		t.Errorf("got %+v", row)
+	}
+
+	accessKey, remoteHost := "AKIAEXAMPLE", "10.0.0.1"
+	csvRow := reqInfoCSVRow{APIName: "PutObject", AccessKey: &accessKey, RemoteHost: &remoteHost}
+	if err := sq.redact(&csvRow); err != nil {
+		t.Fatal(err)
+	}
+	if *csvRow.AccessKey != RedactedValue || *csvRow.RemoteHost != RedactedValue || csvRow.Bucket != nil {
+		t.Errorf("got %+v", csvRow)
+	}
+	// The scanned values are not modified.
+	if accessKey != "AKIAEXAMPLE" {
+		t.Errorf("got access key %q", accessKey)
+	}
+
+	// The fields of logs holding the values of the columns are redacted,
+	// along with the given paths.
+	sq = SearchQuery{Query: rawQ, RedactColumns: []string{"access_key", "requestHeader.X-Amz-Security-Token"}}
+	logRow := logEventRawRow{Log: `{"api":{"accessKey":"AKIAEXAMPLE","bucket":"photos","rx":9007199254740993},` +
+		`"requestHeader":{"Authorization":"AWS4-HMAC-SHA256 Credential=AKIAEXAMPLE/20220101/us-east-1/s3/aws4_request","X-Amz-Security-Token":"secret"},"remotehost":"10.0.0.1"}`}
+	if err := sq.redact(&logRow); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"api":{"accessKey":"***","bucket":"photos","rx":9007199254740993},` +
+		`"remotehost":"10.0.0.1","requestHeader":{"Authorization":"***","X-Amz-Security-Token":"***"}}`
+	if logRow.Log != expected {
+		t.Errorf("got %s, expected %s", logRow.Log, expected)
+	}
+
+	// A log without the redacted fields is output as is.
+	logRow = logEventRawRow{Log: `{"api": {"name": "ListBuckets"}}`}
+	if err := sq.redact(&logRow); err != nil || logRow.Log != `{"api": {"name": "ListBuckets"}}` {
+		t.Errorf("got %s, %v", logRow.Log, err)
+	}
+
+	testCases := []SearchQuery{
+		{Query: reqInfoQ, RedactColumns: []string{"requestHeader.Authorization"}},
+		{Query: reqInfoQ, RedactColumns: []string{"time"}},
+		{Query: rawQ, RedactColumns: []string{"api..name"}},
+		// The redacted columns may not be filtered, sorted or selected.
+		{Query: reqInfoQ, RedactColumns: []string{"access_key"}, FParams: map[fParam][]string{"access_key": {"AKIA*"}}},
+		{Query: reqInfoQ, RedactColumns: []string{"access_key"}, FParamsNot: map[fParam][]string{"access_key": {"AKIAEXAMPLE"}}},
+		{Query: reqInfoQ, RedactColumns: []string{"remote_host"}, FilterGroups: []map[fParam][]string{{"remote_host": {"10.*"}}}},
+		{Query: rawQ, RedactColumns: []string{"access_key"}, FParams: map[fParam][]string{rawQRequestFieldsMap["access_key"]: {"AKIA*"}}},
+		{Query: rawQ, RedactColumns: []string{"access_key"}, JSONPathFilters: map[string][]string{"api.accessKey": {"AKIA*"}}},
+		{Query: reqInfoQ, RedactColumns: []string{"access_key"}, SortBy: []SortField{{Column: "access_key"}}},
+		{Query: reqInfoQ, RedactColumns: []string{"access_key"}, Columns: []string{"time", "access_key"}},
+	}
+	for i, testCase := range testCases {
+		if err := testCase.Validate(); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("Test %d: expected a validation error, got %v", i, err)
+		}
+	}
+
+	sq = SearchQuery{Query: reqInfoQ, RedactColumns: []string{"access_key"}, FParams: map[fParam][]string{"bucket": {"photos"}},
+		SortBy: []SortField{{Column: "bucket"}}, Columns: []string{"time", "bucket"}}
+	if err := sq.Validate(); err != nil {
+		t.Errorf("got %v", err)
+	}
+
+	if err := sq.redact(&LogEventRow{}); err == nil {
+		t.Error("expected an error redacting a row of unexpected type")
+	}
+}
+
+func TestRedactAggregations(t *testing.T) {
+	c := &DBClient{RedactColumns: []string{"access_key"}}
+	sq := &SearchQuery{Query: reqInfoQ, RedactColumns: []string{"object"}}
+
+	if _, _, err := c.countByColumnsQuery(sq, []string{"bucket", "access_key"}, 0); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("CountByColumns: expected an invalid query error, got %v", err)
+	}
+	if _, _, err := c.distinctValuesQuery("access_key", sq, 10); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("DistinctValues: expected an invalid query error, got %v", err)
+	}
+	if _, _, err := c.rateOffendersQuery(sq, time.Minute, 10); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("RateOffenders: expected an invalid query error, got %v", err)
+	}
+	if _, _, _, err := c.latencyPercentilesQuery(sq, "access_key", []float64{0.5}); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("LatencyPercentiles: expected an invalid query error, got %v", err)
+	}
+	if _, _, err := c.topObjectsQuery(sq, 10); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("TopObjects: expected an invalid query error, got %v", err)
+	}
+	if _, _, _, err := c.bytesTransferredQuery(sq, "access_key", time.Hour); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("BytesTransferred: expected an invalid query error, got %v", err)
+	}
+	if _, err := c.MedianRequestGaps(context.Background(), sq); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("MedianRequestGaps: expected an invalid query error, got %v", err)
+	}
+
+	// The columns not redacted may be aggregated.
+	if _, _, err := c.countByColumnsQuery(sq, []string{"bucket"}, 0); err != nil {
+		t.Errorf("got %v", err)
+	}
+	if _, _, err := c.distinctValuesQuery("api_name", sq, 10); err != nil {
+		t.Errorf("got %v", err)
+	}
+	if _, _, _, err := c.bytesTransferredQuery(sq, "", time.Hour); err != nil {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestParseRedactColumns(t *testing.T) {
+	cols, err := ParseRedactColumns("access_key, requestHeader.X-Amz-Security-Token")
+	if err != nil || !reflect.DeepEqual(cols, []string{"access_key", "requestHeader.X-Amz-Security-Token"}) {
+		t.Errorf("got %v, %v", cols, err)
+	}
+	if cols, err := ParseRedactColumns(""); err != nil || cols != nil {
+		t.Errorf("got %v, %v", cols, err)
+	}
+	if _, err := ParseRedactColumns("access_key,,bucket"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestRedactSearch(t *testing.T) {
+	c := &DBClient{RedactColumns: []string{"access_key", "requestHeader.X-Amz-Security-Token"}}
+
+	sq := &SearchQuery{Query: reqInfoQ, RedactColumns: []string{"remote_host", "access_key"}}
+	redacted := c.redactSearch(sq)
+	// The log fields do not apply to reqinfo searches, and the search is
+	// not modified.
+	if !reflect.DeepEqual(redacted.RedactColumns, []string{"remote_host", "access_key"}) || len(sq.RedactColumns) != 2 {
+		t.Errorf("got %v", redacted.RedactColumns)
+	}
+	sq = &SearchQuery{Query: rawQ}
+	if redacted := c.redactSearch(sq); !reflect.DeepEqual(redacted.RedactColumns, c.RedactColumns) {
+		t.Errorf("got %v", redacted.RedactColumns)
+	}
+
+	// A client redacting a column rejects the searches filtering on it.
+	sq = &SearchQuery{Query: reqInfoQ, FParams: map[fParam][]string{"access_key": {"AKIAEXAMPLE"}}}
+	var buf bytes.Buffer
+	if err := c.Search(context.Background(), sq, &buf); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("expected a validation error, got %v", err)
+	}
+}
+
+func TestSearchRedact(t *testing.T) {
+	c := newTestDBClient(t)
+	c.RedactColumns = []string{"access_key"}
+
+	bucket := testBucketName()
+	ev := newTestEvent(time.Now(), bucket)
+	setTestAccessKey(ev, "AKIAREDACTME")
+	insertTestEventMap(t, c, ev)
+
+	for _, q := range []qType{reqInfoQ, rawQ, joinedQ} {
+		for _, format := range []string{"csv", "ndjson", ""} {
+			sq := SearchQuery{
+				Query:        q,
+				ExportFormat: format,
+				PageSize:     10,
+				FParams:      bucketFilter(q, bucket),
+			}
+			if format != "" {
+				sq.PageSize = 0
+			}
+			var buf bytes.Buffer
+			if err := c.Search(context.Background(), &sq, &buf); err != nil {
+				t.Fatalf("%s %q: Search failed: %v", q, format, err)
+			}
+			out := buf.String()
+			if !strings.Contains(out, bucket) {
+				t.Errorf("%s %q: expected the record in %s", q, format, out)
+			}
+			if strings.Contains(out, "AKIAREDACTME") || !strings.Contains(out, RedactedValue) {
+				t.Errorf("%s %q: expected the access key to be redacted in %s", q, format, out)
+			}
+			if format == "" && !json.Valid(buf.Bytes()) {
+				t.Errorf("%s: got invalid JSON %s", q, out)
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// replayBatchSize is the number of events ReplayEvents inserts per
+	// transaction.
+	replayBatchSize = 500
+
+	// maxReplayLineSize bounds the size of the lines read by ReplayEvents.
+	maxReplayLineSize = 16 << 20
+)
+
+var (
+	// notSavedMarker precedes the events in the lines logged for the
+	// events that failed to be inserted, which are of the form `<date>
+	// <time> audit event not saved: <event> (cause: <error>)`.
+	notSavedMarker = []byte("audit event not saved: ")
+	causeMarker    = []byte(" (cause: ")
+)
+
+// replayLineEvent returns the event of a line read by ReplayEvents, which is
+// either the event itself or a line logged for an event that failed to be
+// inserted. It returns nil for a blank line.
+func replayLineEvent(line []byte) []byte {
+	line = bytes.TrimSpace(line)
+	if i := bytes.Index(line, notSavedMarker); i >= 0 {
+		line = line[i+len(notSavedMarker):]
+		if j := bytes.LastIndex(line, causeMarker); j >= 0 {
+			line = line[:j]
+		}
+	}
+	return line
+}
+
+// ReplayEvents inserts the audit events read from r, one per line, as
+// logged for the events that failed to be inserted (see replayLineEvent),
+// e.g. to salvage the events received during a database outage. Blank lines
+// and the events matching the IngestFilter are ignored, and lines that are not valid events are counted as failed
+// without stopping the replay. The events are inserted in batches like by
+// InsertEvents, after creating any missing partitions for their times, but
+// are not archived to the cold sink again. It returns the counts of inserted
+// and failed events, and stops at the first error reading r or inserting a
+// batch, whose events are then counted as failed.
+func (c *DBClient) ReplayEvents(ctx context.Context, r io.Reader) (inserted, failed int, err error) {
+	if err := c.checkOpen(); err != nil {
+		return 0, 0, err
+	}
+
+	var batch []encodedEvent
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := c.replayBatch(ctx, batch)
+		if err != nil {
+			failed += len(batch)
+		} else {
+			inserted += len(batch)
+		}
+		batch = batch[:0]
+		return err
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxReplayLineSize)
+	for scanner.Scan() {
+		eventBytes := replayLineEvent(scanner.Bytes())
+		if len(eventBytes) == 0 {
+			continue
+		}
+		if isEmptyEvent(eventBytes) {
+			failed++
+			continue
+		}
+		ev, err := c.encodeEvent(eventBytes)
+		if err != nil {
+			failed++
+			continue
+		}
+		if c.ignoredEvent(ev.Event) {
+			continue
+		}
+		batch = append(batch, ev)
+		if len(batch) >= replayBatchSize {
+			if err := flush(); err != nil {
+				return inserted, failed, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		failed += len(batch)
+		return inserted, failed, fmt.Errorf("Error reading events to replay: %v", err)
+	}
+	return inserted, failed, flush()
+}
+
+// replayBatch inserts the batch of events replayed by ReplayEvents, creating
+// the missing partitions for their time range first.
+func (c *DBClient) replayBatch(ctx context.Context, batch []encodedEvent) error {
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Insert)
+	defer cancel()
+
+	start, end := batch[0].Time, batch[0].Time
+	for _, ev := range batch[1:] {
+		if ev.Time.Before(start) {
+			start = ev.Time
+		}
+		if ev.Time.After(end) {
+			end = ev.Time
+		}
+	}
+	for _, table := range c.tables() {
+		if err := c.EnsurePartitionsForRange(ctx, table, start, end.Add(time.Nanosecond)); err != nil {
+			return err
+		}
+	}
+	return retryTransient(ctx, c.InsertRetry, func() error {
+		return c.insertBatchTx(ctx, batch)
+	})
+}
@@ -0,0 +1,97 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayLineEvent(t *testing.T) {
+	testCases := []struct {
+		line, expected string
+	}{
+		{"", ""},
+		{"   \t", ""},
+		{`{"version":"1"}`, `{"version":"1"}`},
+		{` {"version":"1"}` + "\r", `{"version":"1"}`},
+		{`2022/03/07 10:00:00 audit event not saved: {"version":"1"} (cause: pq: connection refused)`, `{"version":"1"}`},
+		{`2022/03/07 10:00:00 audit event not saved: {"version":"1"} (cause: ingest buffer full)`, `{"version":"1"}`},
+		// The event may hold the marker of the cause too.
+		{`audit event not saved: {"a":" (cause: "} (cause: x)`, `{"a":" (cause: "}`},
+		{`audit event not saved: {"a":"b"}`, `{"a":"b"}`},
+	}
+	for i, testCase := range testCases {
+		if got := string(replayLineEvent([]byte(testCase.line))); got != testCase.expected {
+			t.Errorf("Test %d: got %q, expected %q", i, got, testCase.expected)
+		}
+	}
+}
+
+func TestReplayEvents(t *testing.T) {
+	c := newTestDBClient(t, WithTablePrefix("replaytest_"))
+	ctx := context.Background()
+	defer func() {
+		for _, table := range []Table{c.logEventsTable(), c.reqInfoTable(), c.migrationsTable(), c.watermarksTable()} {
+			if _, err := c.ExecContext(ctx, "DROP TABLE IF EXISTS "+table.Name); err != nil {
+				t.Errorf("dropping %s: %v", table.Name, err)
+			}
+		}
+	}()
+
+	bucket := testBucketName()
+	event := func(eventTime time.Time) string {
+		buf, err := json.Marshal(newTestEvent(eventTime, bucket))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+	// The events of the past lack partitions, which are created.
+	lines := []string{
+		event(time.Now()),
+		"",
+		fmt.Sprintf("2022/03/07 10:00:00 audit event not saved: %s (cause: pq: connection refused)", event(time.Now())),
+		"not json",
+		"{}",
+		"2022/03/07 10:00:00 audit event not saved: {\"version\": (cause: ingest buffer full)",
+		event(time.Date(2001, time.July, 1, 12, 0, 0, 0, time.UTC)),
+	}
+	inserted, failed, err := c.ReplayEvents(ctx, strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatalf("ReplayEvents failed: %v", err)
+	}
+	if inserted != 3 || failed != 3 {
+		t.Errorf("got %d inserted and %d failed, expected 3 and 3", inserted, failed)
+	}
+
+	for _, q := range []qType{rawQ, reqInfoQ} {
+		sq := SearchQuery{Query: q, ExportFormat: "count", FParams: bucketFilter(q, bucket)}
+		var buf bytes.Buffer
+		if err := c.Search(ctx, &sq, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if expected := "{\"count\":3}\n"; buf.String() != expected {
+			t.Errorf("%s: got %q, expected %q", q, buf.String(), expected)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+)
+
+// NewDBClientWithReplica is like NewDBClient, but the reads of searches,
+// aggregations, counts, lookups and explains go to the read replica of
+// replicaConnStr, while inserts, schema changes and partition maintenance go
+// to the primary of primaryConnStr, so that heavy searches do not compete
+// with inserts.
+//
+// The replica is eventually consistent: records are only found by reads
+// once it has replayed their inserts, so recent records may be missing from
+// the results while the replica lags. Tails and subscriptions, which follow
+// the records as they are inserted, read from the primary.
+func NewDBClientWithReplica(ctx context.Context, primaryConnStr, replicaConnStr string, opts ...DBClientOption) (*DBClient, error) {
+	opts = append(append([]DBClientOption{}, opts...), WithReadReplica(replicaConnStr))
+	return NewDBClient(ctx, primaryConnStr, opts...)
+}
+
+// WithReadReplica has NewDBClient connect to the read replica of
+// replicaConnStr as well, like NewDBClientWithReplica. There is no replica
+// when replicaConnStr is empty.
+func WithReadReplica(replicaConnStr string) DBClientOption {
+	return func(c *DBClient) {
+		c.replicaConnStr = replicaConnStr
+	}
+}
+
+// openReplica opens the connection pool of the read replica of the client.
+func (c *DBClient) openReplica(ctx context.Context) error {
+	replica, err := c.openDB(withApplicationName(c.replicaConnStr))
+	if err != nil {
+		return redactConnError(err, c.replicaConnStr)
+	}
+	c.pool.apply(replica)
+	if err := replica.PingContext(ctx); err != nil {
+		replica.Close()
+		return redactConnError(err, c.replicaConnStr)
+	}
+	c.replica = replica
+	c.logger().Infof("Connected to the read replica.")
+	return nil
+}
+
+// reader returns the connection pool of the reads of searches: the replica,
+// if the client has one, or the primary.
+func (c *DBClient) reader() *sql.DB {
+	if c.replica != nil {
+		return c.replica
+	}
+	return c.DB
+}
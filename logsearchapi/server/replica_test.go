@@ -0,0 +1,105 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReader(t *testing.T) {
+	// Opening a pool does not connect to the database.
+	primary, err := sql.Open("postgres", "host=primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	replica, err := sql.Open("postgres", "host=replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+
+	c := &DBClient{DB: primary}
+	if c.reader() != primary {
+		t.Error("expected reads to go to the primary without a replica")
+	}
+
+	c.replica = replica
+	if c.reader() != replica {
+		t.Error("expected reads to go to the replica")
+	}
+	db, release, err := c.searchQuerier(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if db != replica {
+		t.Errorf("got %T, expected the searches to query the replica", db)
+	}
+}
+
+func TestNewDBClientWithReplica(t *testing.T) {
+	// The tables are created by the test client.
+	newTestDBClient(t)
+
+	const replicaName = "logsearch_replica_test"
+	ctx := context.Background()
+	c, err := NewDBClientWithReplica(ctx, os.Getenv(testPgConnStrEnv), testConnStrWithParam("application_name", replicaName), WithPartitionMode(PartitionModeNative))
+	if err != nil {
+		t.Fatalf("Unable to connect to db: %v", err)
+	}
+	defer c.Close()
+
+	for _, testCase := range []struct {
+		db       *sql.DB
+		expected string
+	}{
+		{c.DB, applicationName},
+		{c.reader(), replicaName},
+	} {
+		var name string
+		if err := testCase.db.QueryRowContext(ctx, "SELECT current_setting('application_name')").Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		if name != testCase.expected {
+			t.Errorf("got application_name %q, expected %q", name, testCase.expected)
+		}
+	}
+
+	bucket := testBucketName()
+	insertTestEvent(t, c, time.Now(), bucket)
+	sq := SearchQuery{Query: reqInfoQ, PageSize: 10, FParams: bucketFilter(reqInfoQ, bucket)}
+	var buf bytes.Buffer
+	if err := c.Search(ctx, &sq, &buf); err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+
+	// Once the replica is gone, reads fail while inserts still succeed.
+	c.replica.Close()
+	insertTestEvent(t, c, time.Now(), bucket)
+	if err := c.Search(ctx, &sq, &buf); err == nil {
+		t.Error("expected the search to fail without the replica")
+	}
+	if _, err := c.CountByGroup(ctx, &sq, "api_name", 0); err == nil {
+		t.Error("expected the aggregation to fail without the replica")
+	}
+}
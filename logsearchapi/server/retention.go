@@ -0,0 +1,110 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy maps the names of tables, without their table prefix
+// (i.e. "audit_log_events" or "request_info"), to the age beyond which
+// their records are dropped by EnforceRetention, e.g. to keep the raw logs
+// for less time than the request_info records. Tables missing from it are
+// kept indefinitely.
+type RetentionPolicy map[string]time.Duration
+
+// Validate checks that the keys of the policy are table names and that the
+// ages are positive.
+func (p RetentionPolicy) Validate() error {
+	for table, age := range p {
+		if table != auditLogEventsTable.Name && table != requestInfoTable.Name {
+			return fmt.Errorf("Invalid retention policy: unknown table %q", table)
+		}
+		if age <= 0 {
+			return fmt.Errorf("Invalid retention policy: non-positive age %s for %s", age, table)
+		}
+	}
+	return nil
+}
+
+// expiredPartitions returns the partitions, given by name, whose whole time
+// range is before cutoff.
+func expiredPartitions(partitions []string, cutoff time.Time) (expired []string, err error) {
+	for _, name := range partitions {
+		pt, err := getPartitionTimeRangeForTable(name)
+		if err != nil {
+			return nil, err
+		}
+		if !pt.EndDate.After(cutoff) {
+			expired = append(expired, name)
+		}
+	}
+	return expired, nil
+}
+
+// EnforceRetention drops the partitions of each table of the RetentionPolicy
+// of the client holding only records older than the age configured for the
+// table. Partitions are dropped whole, so records are kept until their whole
+// partition expires. For hypertables, the chunks are dropped likewise with
+// drop_chunks.
+//
+// It is meant to be run periodically, e.g. daily.
+func (c *DBClient) EnforceRetention(ctx context.Context) error {
+	const dropChunks QTemplate = `SELECT drop_chunks('%s', older_than => $1::timestamptz);`
+
+	if err := c.RetentionPolicy.Validate(); err != nil {
+		return err
+	}
+	hyper, err := c.hypertables(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, table := range c.tables() {
+		age, ok := c.RetentionPolicy[strings.TrimPrefix(table.Name, c.tablePrefix)]
+		if !ok {
+			continue
+		}
+		cutoff := now.Add(-age)
+
+		if hyper {
+			if _, err := c.ExecContext(ctx, dropChunks.build(table.Name), cutoff); err != nil {
+				return fmt.Errorf("Error dropping chunks of %s: %v", table.Name, err)
+			}
+			continue
+		}
+
+		partitions, err := c.getExistingPartitions(ctx, table)
+		if err != nil {
+			return err
+		}
+		expired, err := expiredPartitions(partitions, cutoff)
+		if err != nil {
+			return err
+		}
+		for _, partition := range expired {
+			if err := c.deleteChildTable(ctx, partition, fmt.Sprintf("older than the retention of %s", age)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicyValidate(t *testing.T) {
+	testCases := []struct {
+		policy    RetentionPolicy
+		expectErr bool
+	}{
+		{nil, false},
+		{RetentionPolicy{"audit_log_events": 7 * 24 * time.Hour, "request_info": 90 * 24 * time.Hour}, false},
+		{RetentionPolicy{"env1_request_info": time.Hour}, true},
+		{RetentionPolicy{"request_info": 0}, true},
+		{RetentionPolicy{"audit_log_events": -time.Hour}, true},
+	}
+	for i, testCase := range testCases {
+		if err := testCase.policy.Validate(); (err != nil) != testCase.expectErr {
+			t.Errorf("Test %d: got error %v, expected error: %v", i, err, testCase.expectErr)
+		}
+	}
+}
+
+func TestExpiredPartitions(t *testing.T) {
+	partitions := []string{
+		"request_info_m2022_01",
+		"request_info_w2022_02_01",
+		"request_info_d2022_02_10",
+		"request_info_d2022_02_11",
+	}
+	cutoff := time.Date(2022, time.February, 11, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		age      time.Duration
+		expected []string
+	}{
+		{0, partitions[:3]},
+		{24 * time.Hour, partitions[:2]},
+		{3 * 24 * time.Hour, partitions[:2]},
+		{4 * 24 * time.Hour, partitions[:1]},
+		{10 * 24 * time.Hour, partitions[:1]},
+		{11 * 24 * time.Hour, nil},
+	}
+	for i, testCase := range testCases {
+		expired, err := expiredPartitions(partitions, cutoff.Add(-testCase.age))
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(expired, testCase.expected) {
+			t.Errorf("Test %d: got %v, expected %v", i, expired, testCase.expected)
+		}
+	}
+
+	if _, err := expiredPartitions([]string{"request_info_bogus"}, cutoff); err == nil {
+		t.Errorf("Expected an error for an invalid partition name")
+	}
+}
+
+func TestEnforceRetention(t *testing.T) {
+	c := newTestDBClient(t, WithTablePrefix("retentiontest_"))
+	c.PartitionInterval = PartitionDaily
+	ctx := context.Background()
+	if err := c.InitDBTables(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, table := range []Table{c.logEventsTable(), c.reqInfoTable(), c.migrationsTable(), c.watermarksTable()} {
+			if _, err := c.ExecContext(ctx, "DROP TABLE IF EXISTS "+table.Name); err != nil {
+				t.Errorf("dropping %s: %v", table.Name, err)
+			}
+		}
+	}()
+
+	day := 24 * time.Hour
+	now := time.Now()
+	ages := []time.Duration{30 * day, 100 * day}
+	for _, table := range c.tables() {
+		for _, age := range ages {
+			start := now.Add(-age)
+			if err := c.EnsurePartitionsForRange(ctx, table, start, start.Add(time.Nanosecond)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The raw logs are kept 7 days and the request_info records 90 days.
+	c.RetentionPolicy = RetentionPolicy{"audit_log_events": 7 * day, "request_info": 90 * day}
+	if err := c.EnforceRetention(ctx); err != nil {
+		t.Fatalf("EnforceRetention failed: %v", err)
+	}
+
+	current := newPartitionTimeRange(now, c.PartitionInterval)
+	testCases := []struct {
+		table    Table
+		expected []bool // existence of the partitions of ages, then of the current one
+	}{
+		{c.logEventsTable(), []bool{false, false, true}},
+		{c.reqInfoTable(), []bool{true, false, true}},
+	}
+	for _, testCase := range testCases {
+		var times []time.Time
+		for _, age := range ages {
+			times = append(times, now.Add(-age))
+		}
+		times = append(times, current.StartDate)
+		for i, tm := range times {
+			exists, err := c.checkPartitionTableExists(ctx, testCase.table, tm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exists != testCase.expected[i] {
+				t.Errorf("%s: partition of %s: got existing %v, expected %v", testCase.table.Name, tm, exists, testCase.expected[i])
+			}
+		}
+	}
+
+	// Tables without a policy are left untouched.
+	c.RetentionPolicy = nil
+	if err := c.EnforceRetention(ctx); err != nil {
+		t.Fatalf("EnforceRetention failed: %v", err)
+	}
+	if exists, err := c.checkPartitionTableExists(ctx, c.reqInfoTable(), now.Add(-ages[0])); err != nil || !exists {
+		t.Errorf("Partition was dropped without a policy (err: %v)", err)
+	}
+}
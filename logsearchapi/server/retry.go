@@ -0,0 +1,136 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// RetryPolicy configures how operations failing with transient database
+// errors are retried.
+type RetryPolicy struct {
+	// MaxRetries is the number of retries after the first attempt; zero
+	// disables retries.
+	MaxRetries int
+	// InitialBackoff is the wait before the first retry; it doubles after
+	// every subsequent attempt.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between attempts.
+	MaxBackoff time.Duration
+}
+
+// DefaultInsertRetryPolicy is the retry policy used for inserts by clients
+// created with NewDBClient.
+var DefaultInsertRetryPolicy = RetryPolicy{
+	MaxRetries:     3,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+}
+
+// isTransientErr returns true if the error is likely to go away when the
+// operation is retried, e.g. a dropped connection or a serialization
+// failure.
+func isTransientErr(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", // serialization_failure
+			"40P01": // deadlock_detected
+			return true
+		}
+	}
+	return isConnErr(err)
+}
+
+// isConnErr returns true if the error is due to the connection to the
+// database, e.g. a connection dropped by a database restart, rather than to
+// the operation itself.
+func isConnErr(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		// Class 08 - Connection Exception
+		case pqErr.Code.Class() == "08":
+			return true
+		case pqErr.Code == "57P01", // admin_shutdown
+			pqErr.Code == "57P02", // crash_shutdown
+			pqErr.Code == "57P03": // cannot_connect_now
+			return true
+		}
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retryTransient runs op, retrying it with exponential backoff as long as it
+// fails with a transient error and the policy allows. It gives up early when
+// the next backoff would not complete before the context deadline.
+func retryTransient(ctx context.Context, p RetryPolicy, op func() error) error {
+	return retry(ctx, p, isTransientErr, op)
+}
+
+// retry is like retryTransient, but retries op when it fails with an error
+// for which retryable returns true.
+func retry(ctx context.Context, p RetryPolicy, retryable func(error) bool, op func() error) error {
+	backoff := p.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= p.MaxRetries || !retryable(err) {
+			return err
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import "errors"
+
+// SanitizerErrorPolicy selects how inserts handle the events for which the
+// DBClient.EventSanitizer fails.
+type SanitizerErrorPolicy int
+
+const (
+	// SanitizerSkipEvent logs the error and skips the event, like the
+	// events that cannot be parsed.
+	SanitizerSkipEvent SanitizerErrorPolicy = iota
+	// SanitizerFailInsert fails the insert with a *SanitizerError. For
+	// InsertEvents, none of the events of the batch are inserted.
+	SanitizerFailInsert
+)
+
+// sanitizeEvent applies the EventSanitizer of the client to ev, a copy of a
+// parsed event. Its maps are copied first, so that the sanitizer can modify
+// them without modifying the event of InsertParsedEvent.
+func (c *DBClient) sanitizeEvent(ev *Event) error {
+	if ev.ReqClaims != nil {
+		claims := make(map[string]interface{}, len(ev.ReqClaims))
+		for k, v := range ev.ReqClaims {
+			claims[k] = v
+		}
+		ev.ReqClaims = claims
+	}
+	ev.ReqQuery = cloneStringMap(ev.ReqQuery)
+	ev.ReqHeader = cloneStringMap(ev.ReqHeader)
+	ev.RespHeader = cloneStringMap(ev.RespHeader)
+	if err := c.EventSanitizer(ev); err != nil {
+		return &SanitizerError{RequestID: ev.RequestID, Err: err}
+	}
+	return nil
+}
+
+// cloneStringMap returns a copy of m, which is nil if m is nil.
+func cloneStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	clone := make(map[string]string, len(m))
+	for k, v := range m {
+		clone[k] = v
+	}
+	return clone
+}
+
+// skipsUnsanitized returns whether err, returned when encoding an event, is
+// a *SanitizerError for an event to be skipped as per the
+// SanitizerErrorPolicy of the client.
+func (c *DBClient) skipsUnsanitized(err error) bool {
+	var sErr *SanitizerError
+	return errors.As(err, &sErr) && c.SanitizerErrorPolicy == SanitizerSkipEvent
+}
+
+// logUnsavedEvent logs the event that could not be inserted because of err,
+// so that it can be replayed (see ReplayEvents). Events that could not be
+// sanitized are not logged, as they may hold the data that the
+// EventSanitizer removes.
+func (c *DBClient) logUnsavedEvent(eventBytes []byte, err error) {
+	var sErr *SanitizerError
+	if errors.As(err, &sErr) {
+		c.logger().Errorf("%v", err)
+		return
+	}
+	c.logger().Errorf("audit event not saved: %s (cause: %v)", string(eventBytes), err)
+}
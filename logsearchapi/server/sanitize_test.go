@@ -0,0 +1,170 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSignedObject = "photo.jpg?X-Amz-Signature=deadbeef"
+
+// stripSignature is an EventSanitizer removing the signature of presigned
+// URLs from the object name and query of the event.
+func stripSignature(ev *Event) error {
+	if ev.API.Object == "fail" {
+		return errors.New("cannot sanitize")
+	}
+	ev.API.Object, _, _ = strings.Cut(ev.API.Object, "?X-Amz-Signature=")
+	delete(ev.ReqQuery, "X-Amz-Signature")
+	return nil
+}
+
+// newSignedTestEvent returns an audit event whose object name and query hold
+// the signature of a presigned URL.
+func newSignedTestEvent(bucket string) map[string]interface{} {
+	ev := newTestEvent(time.Now(), bucket)
+	ev["api"].(map[string]interface{})["object"] = testSignedObject
+	ev["requestQuery"] = map[string]string{"X-Amz-Signature": "deadbeef", "versionId": "1"}
+	return ev
+}
+
+func TestEncodeSanitizedEvent(t *testing.T) {
+	c := &DBClient{EventSanitizer: stripSignature, PreserveRawEvent: true}
+
+	buf, err := json.Marshal(newSignedTestEvent(testBucketName()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := parseJSONEvent(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, eventBytes := range [][]byte{buf, nil} {
+		ev, err := c.encodeParsedEvent(event, eventBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.API.Object != "photo.jpg" || bytes.Contains(ev.JSON, []byte("deadbeef")) {
+			t.Errorf("got object %q and log %s, expected the signature to be removed", ev.API.Object, ev.JSON)
+		}
+		if ev.ReqQuery["versionId"] != "1" {
+			t.Errorf("got query %v, expected the other parameters to be kept", ev.ReqQuery)
+		}
+	}
+	// The parsed event is not modified.
+	if event.API.Object != testSignedObject || event.ReqQuery["X-Amz-Signature"] != "deadbeef" {
+		t.Errorf("the parsed event was modified: %+v", event)
+	}
+
+	event.API.Object = "fail"
+	_, err = c.encodeParsedEvent(event, nil)
+	var sErr *SanitizerError
+	if !errors.As(err, &sErr) || sErr.RequestID != event.RequestID {
+		t.Errorf("got %v, expected a *SanitizerError", err)
+	}
+}
+
+func TestEventSanitizer(t *testing.T) {
+	c := newTestDBClient(t)
+	c.EventSanitizer = stripSignature
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	signed := newSignedTestEvent(bucket)
+	failing := newTestEvent(time.Now(), bucket)
+	failing["api"].(map[string]interface{})["object"] = "fail"
+
+	// Failing events are skipped by default.
+	insertTestEventMap(t, c, signed)
+	insertTestEventMap(t, c, failing)
+	var events [][]byte
+	for _, ev := range []map[string]interface{}{newSignedTestEvent(bucket), failing} {
+		buf, err := json.Marshal(ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, buf)
+	}
+	if err := c.InsertEvents(ctx, events); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing else is inserted when failing the inserts.
+	c.SanitizerErrorPolicy = SanitizerFailInsert
+	var sErr *SanitizerError
+	failingBytes := events[1]
+	if err := c.InsertEvent(ctx, failingBytes); !errors.As(err, &sErr) {
+		t.Errorf("got %v, expected a *SanitizerError", err)
+	}
+	if err := c.InsertEvents(ctx, events); !errors.As(err, &sErr) {
+		t.Errorf("got %v, expected a *SanitizerError", err)
+	}
+
+	var objects []string
+	rows, err := c.QueryContext(ctx,
+		fmt.Sprintf("SELECT object FROM %s WHERE bucket = $1", c.reqInfoTable().Name), bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var object string
+		if err := rows.Scan(&object); err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, object)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || objects[0] != "photo.jpg" || objects[1] != "photo.jpg" {
+		t.Errorf("got objects %q, expected the 2 sanitized events", objects)
+	}
+
+	var logs []string
+	rows, err = c.QueryContext(ctx,
+		fmt.Sprintf("SELECT log::text FROM %s WHERE log->'api'->>'bucket' = $1", c.logEventsTable().Name), bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var log string
+		if err := rows.Scan(&log); err != nil {
+			t.Fatal(err)
+		}
+		logs = append(logs, log)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 {
+		t.Errorf("got %d logs, expected 2", len(logs))
+	}
+	for _, log := range logs {
+		if strings.Contains(log, "deadbeef") || !strings.Contains(log, "versionId") {
+			t.Errorf("got log %s, expected the signature to be removed", log)
+		}
+	}
+}
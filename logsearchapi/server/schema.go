@@ -0,0 +1,111 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// maxSchemaLen bounds the length of schemas, so that the names derived from
+// them, the longest of which is the name of the channel notified of inserts
+// (e.g. logsearch_prod.env1_request_info_inserts), fit in the 63 bytes of a
+// Postgres identifier.
+const maxSchemaLen = 28
+
+// validateSchema checks that schema, when not empty, can be used unquoted as
+// a schema name.
+func validateSchema(schema string) error {
+	if schema == "" {
+		return nil
+	}
+	if !tablePrefixRegexp.MatchString(schema) {
+		return fmt.Errorf("Invalid schema %q: it must consist of lowercase letters, digits and underscores, and not start with a digit", schema)
+	}
+	if len(schema) > maxSchemaLen {
+		return fmt.Errorf("Invalid schema %q: it must be at most %d characters long", schema, maxSchemaLen)
+	}
+	return nil
+}
+
+// WithSchema has the client keep its tables in the given Postgres schema,
+// e.g. "logsearch_prod", instead of the default schema of the database
+// user, so that clients with distinct schemas, e.g. of different
+// environments, may share a database. The search_path of all the
+// connections of the client is set to the schema, which is created by
+// InitDBTables if needed, followed by public, where the functions of
+// extensions such as TimescaleDB are usually installed. The schema is
+// validated by NewDBClient.
+func WithSchema(schema string) DBClientOption {
+	return func(c *DBClient) {
+		c.schema = schema
+	}
+}
+
+// schemaConnector opens connections with their search_path set to schema,
+// and then public.
+type schemaConnector struct {
+	driver.Connector
+	schema string
+}
+
+// Connect implements driver.Connector.
+func (sc schemaConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := sc.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("Setting the search_path is not supported by the driver")
+	}
+	if _, err := execer.ExecContext(ctx, "SET search_path TO "+pq.QuoteIdentifier(sc.schema)+", public", nil); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error setting the search_path to %s: %v", sc.schema, err)
+	}
+	return conn, nil
+}
+
+// openDB opens a connection pool of the client to the database of connStr.
+func (c *DBClient) openDB(connStr string) (*sql.DB, error) {
+	if c.schema == "" {
+		return sql.Open("postgres", connStr)
+	}
+	connector, err := pq.NewConnector(connStr)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(schemaConnector{Connector: connector, schema: c.schema}), nil
+}
+
+// createSchema creates the schema of the client, if set and missing.
+func (c *DBClient) createSchema(ctx context.Context) error {
+	const createSchema QTemplate = `CREATE SCHEMA IF NOT EXISTS %s;`
+
+	if c.schema == "" {
+		return nil
+	}
+	if _, err := c.ExecContext(ctx, createSchema.build(c.schema)); err != nil {
+		return fmt.Errorf("Error creating schema %s: %v", c.schema, err)
+	}
+	return nil
+}
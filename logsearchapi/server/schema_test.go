@@ -0,0 +1,160 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateSchema(t *testing.T) {
+	testCases := []struct {
+		schema    string
+		expectErr bool
+	}{
+		{"", false},
+		{"logsearch_prod", false},
+		{"_env2", false},
+		{"Prod", true},
+		{"2prod", true},
+		{"prod.logs", true},
+		{"prod; DROP TABLE x", true},
+		{strings.Repeat("s", maxSchemaLen), false},
+		{strings.Repeat("s", maxSchemaLen+1), true},
+	}
+	for i, testCase := range testCases {
+		if err := validateSchema(testCase.schema); (err != nil) != testCase.expectErr {
+			t.Errorf("Test %d: %q: got error %v, expected error: %v", i, testCase.schema, err, testCase.expectErr)
+		}
+	}
+
+	c := &DBClient{schema: "logsearch_prod", tablePrefix: "env1_"}
+	if channel := c.insertNotifyChannel(); len(channel) > 63 || !strings.HasPrefix(channel, "logsearch_prod.") {
+		t.Errorf("got insert notify channel %q", channel)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	const schema = "logsearch_test_schema"
+	defaultClient := newTestDBClient(t)
+	ctx := context.Background()
+	dropSchema := func() {
+		if _, err := defaultClient.ExecContext(ctx, "DROP SCHEMA IF EXISTS "+schema+" CASCADE"); err != nil {
+			t.Errorf("dropping schema: %v", err)
+		}
+	}
+	dropSchema()
+	defer dropSchema()
+
+	// The schema and its tables are created by InitDBTables.
+	c := newTestDBClient(t, WithSchema(schema))
+	for _, table := range c.tables() {
+		exists, err := defaultClient.checkTableExists(ctx, schema+"."+table.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Errorf("Table %s was not created in schema %s", table.Name, schema)
+		}
+	}
+	if exists, err := defaultClient.checkTableExists(ctx, schema+".missing_table"); err != nil || exists {
+		t.Errorf("got existing %v (err %v) for a missing schema-qualified table", exists, err)
+	}
+
+	// The records of the schema are not visible from the default schema.
+	bucket := testBucketName()
+	insertTestEvent(t, c, time.Now(), bucket)
+	for _, client := range []*DBClient{c, defaultClient} {
+		expected := "{\"count\":0}\n"
+		if client == c {
+			expected = "{\"count\":1}\n"
+		}
+		for _, q := range []qType{rawQ, reqInfoQ} {
+			sq := SearchQuery{Query: q, ExportFormat: "count", FParams: bucketFilter(q, bucket)}
+			var buf bytes.Buffer
+			if err := client.Search(ctx, &sq, &buf); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != expected {
+				t.Errorf("schema %q, %s: got %q, expected %q", client.schema, q, buf.String(), expected)
+			}
+		}
+	}
+
+	partitions, err := c.ListPartitions(ctx, c.reqInfoTable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partitions) == 0 {
+		t.Errorf("No partitions listed in schema %s", schema)
+	}
+	if err := c.HealthCheck(ctx); err != nil {
+		t.Errorf("HealthCheck failed: %v", err)
+	}
+}
+
+func TestSchemaHypertables(t *testing.T) {
+	const schema = "logsearch_test_hyper_schema"
+	defaultClient := newTestDBClient(t)
+	ctx := context.Background()
+	var installed bool
+	err := defaultClient.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb');`).Scan(&installed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !installed {
+		t.Skip("timescaledb is not installed - skipping hypertable tests")
+	}
+	dropSchema := func() {
+		if _, err := defaultClient.ExecContext(ctx, "DROP SCHEMA IF EXISTS "+schema+" CASCADE"); err != nil {
+			t.Errorf("dropping schema: %v", err)
+		}
+	}
+	dropSchema()
+	defer dropSchema()
+
+	// The functions of the extension, installed in public, are found from
+	// the schema.
+	c := newTestDBClient(t, WithSchema(schema), WithPartitionMode(PartitionModeHypertable))
+	for _, table := range c.tables() {
+		var n int
+		err := c.QueryRowContext(ctx, `SELECT COUNT(*) FROM timescaledb_information.hypertables WHERE hypertable_schema = $1 AND hypertable_name = $2;`, schema, table.Name).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("%s.%s is not a hypertable", schema, table.Name)
+		}
+	}
+
+	bucket := testBucketName()
+	insertTestEvent(t, c, time.Now(), bucket)
+	sq := SearchQuery{Query: reqInfoQ, ExportFormat: "count", FParams: bucketFilter(reqInfoQ, bucket)}
+	var buf bytes.Buffer
+	if err := c.Search(ctx, &sq, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "{\"count\":1}\n"; buf.String() != expected {
+		t.Errorf("got %q, expected %q", buf.String(), expected)
+	}
+	if err := c.EnforceRetention(ctx); err != nil {
+		t.Errorf("EnforceRetention failed: %v", err)
+	}
+}
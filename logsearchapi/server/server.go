@@ -16,15 +16,20 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 var (
@@ -37,20 +42,57 @@ type LogSearch struct {
 	// Configuration
 	PGConnStr                      string
 	AuditAuthToken, QueryAuthToken string
-	DiskCapacityGBs                int
+	// AdminAuthToken authenticates the diagnostic endpoints, which are
+	// not served when it is empty.
+	AdminAuthToken    string
+	DiskCapacityGBs   int
+	PartitionInterval PartitionInterval
+	// TablePrefix prefixes the names of the tables, see WithTablePrefix.
+	TablePrefix string
+	// Schema is the Postgres schema of the tables, see WithSchema.
+	Schema string
+	// IngestBuffer, when its Size is positive, enables buffering ingested
+	// events, see WithIngestBuffer.
+	IngestBuffer IngestBufferConfig
+	// PartitionMode selects between native partitioning and TimescaleDB
+	// hypertables, see WithPartitionMode.
+	PartitionMode PartitionMode
+	// MaxExportRows bounds the number of records of exports, see
+	// DBClient.MaxExportRows.
+	MaxExportRows int
+	// NotifyInserts has inserts notify the subscribers of new records, see
+	// DBClient.Subscribe.
+	NotifyInserts bool
+	// StoreRawLog selects whether the raw logs are stored, see
+	// WithStoreRawLog.
+	StoreRawLog bool
+	// IngestFilter lists the rules of the events that are not stored, see
+	// DBClient.IngestFilter.
+	IngestFilter []IngestRule
 
 	// Runtime
 	DBClient *DBClient
 	*http.ServeMux
 }
 
-// NewLogSearch creates a LogSearch
-func NewLogSearch(pgConnStr, auditAuthToken string, queryAuthToken string, diskCapacity int) (ls *LogSearch, err error) {
+// NewLogSearch creates a LogSearch. The other settings of its DBClient, such
+// as WithReadReplica or WithRedactColumns, are given as dbOpts.
+func NewLogSearch(pgConnStr, auditAuthToken string, queryAuthToken string, adminAuthToken string, diskCapacity int, partitionInterval PartitionInterval, tablePrefix string, ingestBuffer IngestBufferConfig, partitionMode PartitionMode, maxExportRows int, notifyInserts, storeRawLog bool, schema string, ingestFilter []IngestRule, dbOpts ...DBClientOption) (ls *LogSearch, err error) {
 	ls = &LogSearch{
-		PGConnStr:       pgConnStr,
-		AuditAuthToken:  auditAuthToken,
-		QueryAuthToken:  queryAuthToken,
-		DiskCapacityGBs: diskCapacity,
+		PGConnStr:         pgConnStr,
+		AuditAuthToken:    auditAuthToken,
+		QueryAuthToken:    queryAuthToken,
+		AdminAuthToken:    adminAuthToken,
+		DiskCapacityGBs:   diskCapacity,
+		PartitionInterval: partitionInterval,
+		TablePrefix:       tablePrefix,
+		IngestBuffer:      ingestBuffer,
+		PartitionMode:     partitionMode,
+		MaxExportRows:     maxExportRows,
+		NotifyInserts:     notifyInserts,
+		StoreRawLog:       storeRawLog,
+		Schema:            schema,
+		IngestFilter:      ingestFilter,
 	}
 
 	// Initialize global context
@@ -67,23 +109,26 @@ func NewLogSearch(pgConnStr, auditAuthToken string, queryAuthToken string, diskC
 	}()
 
 	// Initialize DB Client
-	ls.DBClient, err = NewDBClient(globalContext, ls.PGConnStr)
+	opts := []DBClientOption{WithTablePrefix(ls.TablePrefix), WithPartitionMode(ls.PartitionMode), WithStoreRawLog(ls.StoreRawLog), WithSchema(ls.Schema)}
+	if ls.IngestBuffer.Size > 0 {
+		opts = append(opts, WithIngestBuffer(ls.IngestBuffer))
+	}
+	opts = append(opts, dbOpts...)
+	ls.DBClient, err = NewDBClient(globalContext, ls.PGConnStr, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("Error connecting to db: %v", err)
 	}
+	ls.DBClient.PartitionInterval = ls.PartitionInterval
+	ls.DBClient.MaxExportRows = ls.MaxExportRows
+	ls.DBClient.NotifyInserts = ls.NotifyInserts
+	ls.DBClient.IngestFilter = ls.IngestFilter
 
-	// Initialize tables in db
+	// Initialize tables in db, running migrations
 	err = ls.DBClient.InitDBTables(globalContext)
 	if err != nil {
 		return nil, fmt.Errorf("Error initializing tables: %v", err)
 	}
 
-	// Run migrations on db
-	err = ls.DBClient.runMigrations(globalContext)
-	if err != nil {
-		return nil, fmt.Errorf("error running migrations: %v", err)
-	}
-
 	// Create indices on db
 	go func() {
 		err := ls.DBClient.CreateIndices(globalContext)
@@ -99,6 +144,12 @@ func NewLogSearch(pgConnStr, auditAuthToken string, queryAuthToken string, diskC
 	ls.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {})
 	ls.HandleFunc("/api/ingest", authorize(ls.ingestHandler, ls.AuditAuthToken))
 	ls.HandleFunc("/api/query", authorize(ls.queryHandler, ls.QueryAuthToken))
+	ls.HandleFunc("/api/tail", authorize(ls.tailHandler, ls.QueryAuthToken))
+	ls.HandleFunc("/api/cancel", authorize(ls.cancelHandler, ls.QueryAuthToken))
+	ls.HandleFunc("/api/combined", authorize(ls.combinedHandler, ls.QueryAuthToken))
+	if ls.AdminAuthToken != "" {
+		ls.HandleFunc("/api/explain", authorize(ls.explainHandler, ls.AdminAuthToken))
+	}
 
 	// Start vacuum thread
 	if ls.DiskCapacityGBs <= 0 {
@@ -108,7 +159,7 @@ func NewLogSearch(pgConnStr, auditAuthToken string, queryAuthToken string, diskC
 		go ls.DBClient.vacuumData(globalContext, ls.DiskCapacityGBs)
 	}
 
-	go ls.DBClient.partitionTables(globalContext)
+	ls.DBClient.StartPartitionMaintainer(globalContext, 1*time.Hour)
 
 	return ls, nil
 }
@@ -120,18 +171,26 @@ func (ls *LogSearch) StartServer() {
 		Handler: ls,
 	}
 
+	// Shutdown waits for the requests in progress to finish, after which
+	// the DB client is closed.
+	shutdown := make(chan struct{})
 	go func() {
+		defer close(shutdown)
 		<-globalContext.Done()
 		err := s.Shutdown(context.Background())
 		if err != nil {
 			log.Printf("HTTP server shutdown: %v\n", err)
 		}
+		if err := ls.DBClient.Close(); err != nil {
+			log.Printf("DB client close: %v\n", err)
+		}
 	}()
 
 	log.Println("Log Search API starting on Port :8080")
 	if err := s.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatalf("HTTP server ListenAndServe error: %v", err)
 	}
+	<-shutdown
 }
 
 func (ls *LogSearch) writeErrorResponse(w http.ResponseWriter, status int, msg string, err error) {
@@ -159,6 +218,11 @@ func (ls *LogSearch) ingestHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if ls.IngestBuffer.Size > 0 {
+		// The event is inserted later, failures being logged.
+		ls.DBClient.QueueEvent(buf)
+		return
+	}
 	err = ls.DBClient.InsertEvent(r.Context(), buf)
 	if err != nil {
 		ls.writeErrorResponse(w, 500, "Error writing to DB", err)
@@ -180,27 +244,273 @@ func (ls *LogSearch) queryHandler(w http.ResponseWriter, r *http.Request) {
 	switch sq.ExportFormat {
 	case "csv":
 		w.Header().Add("Content-Type", "text/csv")
-		w.Header().Add("Content-Disposition", "attachment; filename=logs-export.csv")
+	case "tsv":
+		w.Header().Add("Content-Type", "text/tab-separated-values")
 	case "ndjson":
 		// Ref: https://github.com/ndjson/ndjson-spec
 		w.Header().Add("Content-Type", "application/x-ndjson")
-		w.Header().Add("Content-Disposition", "attachment; filename=logs-export.ndjson")
+	case "parquet":
+		w.Header().Add("Content-Type", "application/vnd.apache.parquet")
+	case "arrow":
+		w.Header().Add("Content-Type", "application/vnd.apache.arrow.stream")
+	case "xlsx":
+		w.Header().Add("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
 	default:
 		w.Header().Add("Content-Type", "application/json")
 	}
-	err = ls.DBClient.Search(r.Context(), sq, w)
+	if filename := exportFilename(sq.ExportFormat); filename != "" {
+		w.Header().Add("Content-Disposition", "attachment; filename="+filename)
+	}
+
+	// The output is compressed with the encoding preferred by the client.
+	sq.Encoding = NegotiateEncoding(r.Header.Get("Accept-Encoding"))
+	w.Header().Add("Vary", "Accept-Encoding")
+	if sq.Encoding != EncodingNone {
+		w.Header().Set("Content-Encoding", sq.Encoding)
+	}
+
+	if sq.BestEffort {
+		// The skipped partitions are only known once the records are
+		// written.
+		w.Header().Set("Trailer", skippedPartitionsTrailer)
+	}
+
+	if ls.DBClient.TagStatements {
+		// The trace ID of the search is returned, to find its
+		// statements on the DB side.
+		sq.TraceID = NewTraceID()
+		w.Header().Set(traceIDHeader, sq.TraceID)
+	}
+
+	ctx := r.Context()
+	if token := r.URL.Query().Get("cancelToken"); token != "" {
+		var done func()
+		ctx, done, err = ls.DBClient.RegisterSearch(ctx, token)
+		if err != nil {
+			ls.writeErrorResponse(w, 400, "Bad params:", err)
+			return
+		}
+		defer done()
+	}
+
+	start := time.Now()
+	res, err := ls.DBClient.SearchWithResult(ctx, sq, w)
 	if err != nil {
 		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Encoding")
+		if errors.Is(ctx.Err(), context.Canceled) && r.Context().Err() == nil {
+			// The search was canceled with /api/cancel.
+			ls.writeErrorResponse(w, 409, "Search canceled:", err)
+			return
+		}
+		if errors.Is(err, ErrInvalidQuery) {
+			ls.writeErrorResponse(w, 400, "Bad params:", err)
+			return
+		}
+		if errors.Is(err, ErrBusy) {
+			w.Header().Set("Retry-After", "1")
+			ls.writeErrorResponse(w, 503, "Server busy:", err)
+			return
+		}
+		if errors.Is(err, ErrResponseTooLarge) {
+			ls.writeErrorResponse(w, 413, "Response too large:", err)
+			return
+		}
+		ls.writeErrorResponse(w, 500, "Unhandled error:", err)
+		return
+	}
+	if sq.ExportFormat != "" && sq.ExportFormat != "count" {
+		log.Printf("Exported %d %s records as %s in %s", res.RowsWritten, sq.Query, res.Format, time.Since(start))
+	}
+	if len(res.SkippedPartitions) > 0 {
+		w.Header().Set(skippedPartitionsTrailer, strings.Join(res.SkippedPartitions, ","))
+	}
+}
+
+// traceIDHeader is the HTTP header of the trace ID of a search, when the
+// statements of searches are tagged.
+const traceIDHeader = "X-Trace-Id"
+
+// skippedPartitionsTrailer is the HTTP trailer listing the partitions
+// skipped by a best-effort search.
+const skippedPartitionsTrailer = "X-Skipped-Partitions"
+
+// tailHandler handles:
+//
+//	GET /api/tail?token=xxx&q=reqinfo&...
+//
+// It takes the parameters of /api/query for reqinfo queries, without time
+// end, sorting, paging or export, and streams the matching records as they
+// are inserted, as ndjson, until the client goes away.
+func (ls *LogSearch) tailHandler(w http.ResponseWriter, r *http.Request) {
+	// Request is assumed to be authenticated at this point.
+
+	sq, err := searchQueryFromRequest(r)
+	if err != nil {
+		ls.writeErrorResponse(w, 400, "Bad params:", err)
+		return
+	}
+
+	// The tail is also stopped on shutdown, which waits for the requests
+	// in progress to finish.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-globalContext.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// Ref: https://github.com/ndjson/ndjson-spec
+	w.Header().Add("Content-Type", "application/x-ndjson")
+	if err := ls.DBClient.Tail(ctx, sq, w); err != nil {
+		w.Header().Del("Content-Type")
+		if errors.Is(err, ErrInvalidQuery) {
+			ls.writeErrorResponse(w, 400, "Bad params:", err)
+			return
+		}
+		ls.writeErrorResponse(w, 500, "Unhandled error:", err)
+	}
+}
+
+// cancelHandler handles:
+//
+//	POST /api/cancel?token=xxx&cancelToken=yyy
+//
+// It cancels the search of /api/query given the same cancelToken, which is
+// still running, responding with 204, or with 404 if there is none.
+func (ls *LogSearch) cancelHandler(w http.ResponseWriter, r *http.Request) {
+	// Request is assumed to be authenticated at this point.
+
+	if r.Method != "POST" {
+		ls.writeErrorResponse(w, 400, "Non post request", nil)
+		return
+	}
+	token := r.URL.Query().Get("cancelToken")
+	if token == "" {
+		ls.writeErrorResponse(w, 400, "Bad params:", errors.New("cancelToken is required"))
+		return
+	}
+	if !ls.DBClient.CancelSearch(token) {
+		http.Error(w, "No running search with this cancel token", 404)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// combinedHandler handles:
+//
+//	GET /api/combined?token=xxx&...
+//
+// It takes the parameters of /api/query for reqinfo queries, q being
+// optional, without export, and responds with a page of reqinfo records
+// along with the raw log events of the same requests, as a JSON object (see
+// DBClient.SearchCombined).
+func (ls *LogSearch) combinedHandler(w http.ResponseWriter, r *http.Request) {
+	// Request is assumed to be authenticated at this point.
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		ls.writeErrorResponse(w, 400, "Bad params:", err)
+		return
+	}
+	if values.Get("q") == "" {
+		values.Set("q", string(reqInfoQ))
+	}
+	sq, err := ParseSearchQuery(values)
+	if err != nil {
+		ls.writeErrorResponse(w, 400, "Bad params:", err)
+		return
+	}
+
+	res, err := ls.DBClient.SearchCombined(r.Context(), sq)
+	if err != nil {
+		if errors.Is(err, ErrInvalidQuery) {
+			ls.writeErrorResponse(w, 400, "Bad params:", err)
+			return
+		}
 		ls.writeErrorResponse(w, 500, "Unhandled error:", err)
+		return
 	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// explainHandler handles:
+//
+//	GET /api/explain?token=xxx&...
+//
+// It takes the same parameters as /api/query and responds with the plan of
+// the search, as JSON. The token is the admin token.
+func (ls *LogSearch) explainHandler(w http.ResponseWriter, r *http.Request) {
+	// Request is assumed to be authenticated at this point.
+
+	sq, err := searchQueryFromRequest(r)
+	if err != nil {
+		ls.writeErrorResponse(w, 400, "Bad params:", err)
+		return
+	}
+
+	plan, err := ls.DBClient.Explain(r.Context(), sq)
+	if err != nil {
+		if errors.Is(err, ErrInvalidQuery) {
+			ls.writeErrorResponse(w, 400, "Bad params:", err)
+			return
+		}
+		ls.writeErrorResponse(w, 500, "Unhandled error:", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	io.WriteString(w, plan)
+}
+
+// exportFilename returns the name suggested for the file downloaded by an
+// export in the given format, or "" if the format is not downloaded as a file.
+func exportFilename(format string) string {
+	switch format {
+	case "csv", "tsv", "ndjson", "parquet", "xlsx":
+		return "logs-export." + format
+	case "arrow":
+		return "logs-export.arrows"
+	}
+	return ""
+}
+
+// pgConnStrFromEnv returns the connection string given by PgConnStrEnv, or
+// else built from the individual connection parameters, starting with
+// PgHostEnv, e.g. so that the password may come from a distinct secret.
+func pgConnStrFromEnv() (string, error) {
+	if connStr := os.Getenv(PgConnStrEnv); connStr != "" {
+		return connStr, nil
+	}
+	p := ConnParams{
+		Host:        os.Getenv(PgHostEnv),
+		User:        os.Getenv(PgUserEnv),
+		Password:    os.Getenv(PgPasswordEnv),
+		DBName:      os.Getenv(PgDBNameEnv),
+		SSLMode:     os.Getenv(PgSSLModeEnv),
+		SSLRootCert: os.Getenv(PgSSLRootCertEnv),
+	}
+	if p.Host == "" {
+		return "", errors.New(PgConnStrEnv + " or " + PgHostEnv + " env variable is required.")
+	}
+	if port := os.Getenv(PgPortEnv); port != "" {
+		var err error
+		if p.Port, err = strconv.Atoi(port); err != nil {
+			return "", fmt.Errorf("Invalid %s env variable: %v", PgPortEnv, err)
+		}
+	}
+	return p.ConnString()
 }
 
 // LoadEnv loads environment variables and returns
 // a new LogSearch.
 func LoadEnv() (*LogSearch, error) {
-	pgConnStr := os.Getenv(PgConnStrEnv)
-	if pgConnStr == "" {
-		return nil, errors.New(PgConnStrEnv + " env variable is required.")
+	pgConnStr, err := pgConnStrFromEnv()
+	if err != nil {
+		return nil, err
 	}
 	auditAuthToken := os.Getenv(AuditAuthTokenEnv)
 	if auditAuthToken == "" {
@@ -210,10 +520,121 @@ func LoadEnv() (*LogSearch, error) {
 	if queryAuthToken == "" {
 		return nil, errors.New(QueryAuthTokenEnv + " env variable is required.")
 	}
+	// The admin token is optional, the diagnostic endpoints being disabled
+	// without it.
+	adminAuthToken := os.Getenv(AdminAuthTokenEnv)
 	diskCapacity, err := strconv.Atoi(os.Getenv(DiskCapacityEnv))
 	if err != nil {
 		return nil, errors.New(DiskCapacityEnv + " env variable is required and must be an integer.")
 	}
 
-	return NewLogSearch(pgConnStr, auditAuthToken, queryAuthToken, diskCapacity)
+	partitionInterval, err := ParsePartitionInterval(os.Getenv(PartitionIntervalEnv))
+	if err != nil {
+		return nil, errors.New(PartitionIntervalEnv + " env variable must be one of weekly, daily or monthly.")
+	}
+
+	partitionMode, err := ParsePartitionMode(os.Getenv(PartitionModeEnv))
+	if err != nil {
+		return nil, errors.New(PartitionModeEnv + " env variable must be one of auto, native or hypertable.")
+	}
+
+	// Exports are not limited by default.
+	var maxExportRows int
+	if v := os.Getenv(MaxExportRowsEnv); v != "" {
+		maxExportRows, err = strconv.Atoi(v)
+		if err != nil || maxExportRows < 0 {
+			return nil, errors.New(MaxExportRowsEnv + " env variable must be a non-negative integer.")
+		}
+	}
+
+	// Pages of results are not limited in size by default.
+	var maxResponseBytes int64
+	if v := os.Getenv(MaxResponseBytesEnv); v != "" {
+		maxResponseBytes, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxResponseBytes < 0 {
+			return nil, errors.New(MaxResponseBytesEnv + " env variable must be a non-negative integer.")
+		}
+	}
+
+	// Inserts do not notify subscribers by default.
+	var notifyInserts bool
+	if v := os.Getenv(NotifyInsertsEnv); v != "" {
+		notifyInserts, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.New(NotifyInsertsEnv + " env variable must be a boolean, e.g. true or false.")
+		}
+	}
+
+	// Searches without a time range are allowed by default.
+	var requireTimeBound bool
+	if v := os.Getenv(RequireTimeBoundEnv); v != "" {
+		requireTimeBound, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.New(RequireTimeBoundEnv + " env variable must be a boolean, e.g. true or false.")
+		}
+	}
+
+	// The statements of searches are not tagged by default.
+	var tagStatements bool
+	if v := os.Getenv(TagStatementsEnv); v != "" {
+		tagStatements, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.New(TagStatementsEnv + " env variable must be a boolean, e.g. true or false.")
+		}
+	}
+
+	// The raw logs are stored by default.
+	storeRawLog := true
+	if v := os.Getenv(StoreRawLogEnv); v != "" {
+		storeRawLog, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.New(StoreRawLogEnv + " env variable must be a boolean, e.g. true or false.")
+		}
+	}
+
+	// Buffering ingested events is optional.
+	var ingestBuffer IngestBufferConfig
+	if v := os.Getenv(IngestBufferSizeEnv); v != "" {
+		ingestBuffer = DefaultIngestBufferConfig
+		ingestBuffer.Size, err = strconv.Atoi(v)
+		if err != nil || ingestBuffer.Size < 0 {
+			return nil, errors.New(IngestBufferSizeEnv + " env variable must be a non-negative integer.")
+		}
+	}
+	if v := os.Getenv(IngestFlushIntervalEnv); v != "" {
+		ingestBuffer.FlushInterval, err = time.ParseDuration(v)
+		if err != nil || ingestBuffer.FlushInterval <= 0 {
+			return nil, errors.New(IngestFlushIntervalEnv + " env variable must be a positive duration, e.g. 1s.")
+		}
+	}
+
+	ingestFilter, err := ParseIngestRules(os.Getenv(IngestFilterEnv))
+	if err != nil {
+		return nil, fmt.Errorf("%s env variable is invalid: %v", IngestFilterEnv, err)
+	}
+
+	// No column is redacted by default.
+	redactColumns, err := ParseRedactColumns(os.Getenv(RedactColumnsEnv))
+	if err != nil {
+		return nil, fmt.Errorf("%s env variable is invalid: %v", RedactColumnsEnv, err)
+	}
+
+	dbOpts := []DBClientOption{
+		WithPartitionTablespace(os.Getenv(PartitionTablespaceEnv)),
+		WithMaxResponseBytes(maxResponseBytes),
+		WithRequireTimeBound(requireTimeBound),
+		WithTagStatements(tagStatements),
+		WithReadReplica(os.Getenv(PgReplicaConnStrEnv)),
+		WithRedactColumns(redactColumns),
+	}
+	// Partitions are created for events up to
+	// DefaultPartitionCreationWindow from now by default.
+	if v := os.Getenv(PartitionCreationWindowEnv); v != "" {
+		window, err := time.ParseDuration(v)
+		if err != nil || window < 0 {
+			return nil, errors.New(PartitionCreationWindowEnv + " env variable must be a non-negative duration, e.g. 168h.")
+		}
+		dbOpts = append(dbOpts, WithPartitionCreationWindow(window))
+	}
+	return NewLogSearch(pgConnStr, auditAuthToken, queryAuthToken, adminAuthToken, diskCapacity, partitionInterval, os.Getenv(TablePrefixEnv), ingestBuffer, partitionMode, maxExportRows, notifyInserts, storeRawLog, os.Getenv(SchemaEnv), ingestFilter, dbOpts...)
 }
@@ -0,0 +1,55 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryHandlerResponseTooLarge(t *testing.T) {
+	c := newTestDBClient(t)
+	c.MaxResponseBytes = 500
+	ls := &LogSearch{DBClient: c}
+
+	bucket := testBucketName()
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		ev := newTestEvent(now.Add(time.Duration(i)*time.Millisecond), bucket)
+		ev["api"].(map[string]interface{})["object"] = strings.Repeat("x", 200)
+		insertTestEventMap(t, c, ev)
+	}
+
+	values := url.Values{"q": {"reqinfo"}, "fp": {"bucket:" + bucket}, "pageSize": {"10"}}
+	r := httptest.NewRequest(http.MethodGet, "/api/query?"+values.Encode(), nil)
+	w := httptest.NewRecorder()
+	ls.queryHandler(w, r)
+
+	// The error is reported with its status, the records written before
+	// the page was found too large being discarded.
+	body := w.Body.String()
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d, expected 413", w.Code)
+	}
+	if !strings.HasPrefix(body, "Response too large:") || strings.Contains(body, "xxx") {
+		t.Errorf("got body %q, expected only the error", body)
+	}
+}
@@ -0,0 +1,228 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/georgysavva/scany/sqlscan"
+	"github.com/lib/pq"
+)
+
+// maxNotifyPayload bounds the payload of the notifications of inserts, below
+// the 8000 bytes limit of Postgres.
+const maxNotifyPayload = 7900
+
+// subscriptionBufferSize is the capacity of the channels returned by
+// Subscribe.
+const subscriptionBufferSize = 100
+
+// insertedKey identifies an inserted request_info record, which has no
+// primary key, by its time (as a pgTimeArg) and request ID.
+type insertedKey [2]string
+
+// insertNotifyChannel returns the name of the channel notified of the inserts
+// of request_info records. Channels are not scoped by schema, so the name is
+// qualified with the schema of the client, if set.
+func (c *DBClient) insertNotifyChannel() string {
+	if c.schema != "" {
+		return c.schema + "." + c.reqInfoTable().Name + "_inserts"
+	}
+	return c.reqInfoTable().Name + "_inserts"
+}
+
+// notifyInserted notifies the channel of insertNotifyChannel of the inserts
+// of evs within the transaction tx. Postgres delivers the notifications when
+// (and if) tx commits.
+func (c *DBClient) notifyInserted(ctx context.Context, tx *sql.Tx, evs []encodedEvent) error {
+	payloads, err := notifyPayloads(evs)
+	if err != nil {
+		return err
+	}
+	for _, payload := range payloads {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_notify($1, $2)`, c.insertNotifyChannel(), payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyPayloads returns the payloads of the notifications of the inserts of
+// evs: JSON arrays of their insertedKeys, of at most maxNotifyPayload bytes.
+func notifyPayloads(evs []encodedEvent) (payloads []string, err error) {
+	payload := []byte{'['}
+	for _, ev := range evs {
+		key, err := json.Marshal(insertedKey{pgTimeArg(ev.Time).Format(time.RFC3339Nano), ev.RequestID})
+		if err != nil {
+			return nil, err
+		}
+		if len(payload) > 1 && len(payload)+len(key)+2 > maxNotifyPayload {
+			payloads = append(payloads, string(append(payload, ']')))
+			payload = payload[:1]
+		}
+		if len(payload) > 1 {
+			payload = append(payload, ',')
+		}
+		payload = append(payload, key...)
+	}
+	if len(payload) > 1 {
+		payloads = append(payloads, string(append(payload, ']')))
+	}
+	return payloads, nil
+}
+
+// Subscribe delivers the reqInfoQ records matching s on the returned channel
+// as they are inserted. Unlike Tail, which polls for new records, Subscribe
+// listens to the Postgres notifications of the inserts, which are sent by the
+// clients inserting the records when their NotifyInserts is set, e.g. by the
+// server when LOGSEARCH_NOTIFY_INSERTS is set. Each notified record matching
+// s is then fetched and delivered, with a lower latency than Tail.
+//
+// The channel is closed when ctx is done or the client is closed. When the
+// listening connection drops, it is re-established, but the records inserted
+// meanwhile are not delivered. The search s is as for Tail, except that its
+// TimeStart and Columns are ignored.
+func (c *DBClient) Subscribe(ctx context.Context, s *SearchQuery) (<-chan ReqInfoRow, error) {
+	s = c.redactSearch(s)
+	if err := checkFollowQuery(s, "Subscribe"); err != nil {
+		return nil, err
+	}
+	if err := c.checkOpen(); err != nil {
+		return nil, err
+	}
+	ss := *s
+	ss.TimeStart = nil
+	// Invalid filters are reported right away.
+	if _, _, err := c.notifiedStatement(&ss, nil); err != nil {
+		return nil, err
+	}
+
+	listener := pq.NewListener(c.connStr, 100*time.Millisecond, 10*time.Second, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventDisconnected:
+			c.logger().Warnf("Subscription listener disconnected: %v", redactConnError(err, c.connStr))
+		case pq.ListenerEventReconnected:
+			c.logger().Warnf("Subscription listener reconnected, records inserted meanwhile are not delivered")
+		case pq.ListenerEventConnectionAttemptFailed:
+			c.logger().Errorf("Subscription listener failed to reconnect: %v", redactConnError(err, c.connStr))
+		}
+	})
+	if err := listener.Listen(c.insertNotifyChannel()); err != nil {
+		listener.Close()
+		return nil, &QueryError{Op: "listening to", Err: redactConnError(err, c.connStr)}
+	}
+
+	ch := make(chan ReqInfoRow, subscriptionBufferSize)
+	started := c.runInBackground(func(closing context.Context) {
+		defer close(ch)
+		defer listener.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-closing.Done():
+				return
+			case n := <-listener.Notify:
+				// A nil notification follows a reconnection.
+				if n == nil {
+					continue
+				}
+				rows, err := c.fetchNotified(ctx, &ss, n.Extra)
+				if err != nil {
+					if ctx.Err() == nil {
+						c.logger().Errorf("Subscription: %v", err)
+					}
+					continue
+				}
+				for _, row := range rows {
+					select {
+					case ch <- row:
+					case <-ctx.Done():
+						return
+					case <-closing.Done():
+						return
+					}
+				}
+			case <-time.After(90 * time.Second):
+				// Detect a dropped connection even when idle.
+				go listener.Ping()
+			}
+		}
+	})
+	if !started {
+		listener.Close()
+		return nil, ErrClientClosed
+	}
+	return ch, nil
+}
+
+// fetchNotified returns the records of the notification payload matching the
+// search s.
+func (c *DBClient) fetchNotified(ctx context.Context, s *SearchQuery, payload string) ([]ReqInfoRow, error) {
+	var keys []insertedKey
+	if err := json.Unmarshal([]byte(payload), &keys); err != nil {
+		return nil, fmt.Errorf("Invalid notification payload %q: %v", payload, err)
+	}
+	q, sqlArgs, err := c.notifiedStatement(s, keys)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Search)
+	defer cancel()
+	var rows []ReqInfoRow
+	if err := sqlscan.Select(ctx, c, &rows, q, sqlArgs...); err != nil {
+		return nil, &QueryError{Op: "querying", Err: err}
+	}
+	for i := range rows {
+		rows[i].Time = s.outputTime(rows[i].Time)
+		if err := s.redact(&rows[i]); err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// notifiedStatement returns the statement selecting the request_info records
+// with the given keys that match the search s, in time order.
+func (c *DBClient) notifiedStatement(s *SearchQuery, keys []insertedKey) (q string, sqlArgs []interface{}, err error) {
+	const notifiedSelect QTemplate = `SELECT %s
+                                            FROM %s
+                                           %s
+                                        ORDER BY time ASC;`
+
+	whereClause, filterArgs, _, err := c.reqInfoWhereClause(s, 3)
+	if err != nil {
+		return "", nil, err
+	}
+	keysClause := "(time, request_id) IN (SELECT * FROM unnest($1::timestamptz[], $2::text[]))"
+	if whereClause == "" {
+		whereClause = "WHERE " + keysClause
+	} else {
+		whereClause += " AND " + keysClause
+	}
+	times, requestIDs := make([]string, len(keys)), make([]string, len(keys))
+	for i, key := range keys {
+		times[i], requestIDs[i] = key[0], key[1]
+	}
+	sqlArgs = append([]interface{}{pq.Array(times), pq.Array(requestIDs)}, filterArgs...)
+	return notifiedSelect.build(strings.Join(reqInfoCSVHeader, ", "), c.reqInfoTable().Name, whereClause), sqlArgs, nil
+}
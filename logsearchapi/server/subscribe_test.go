@@ -0,0 +1,134 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestNotifyPayloads(t *testing.T) {
+	eventTime := time.Date(2022, 3, 1, 10, 0, 0, 123000, time.UTC)
+	evs := make([]encodedEvent, 200)
+	for i := range evs {
+		evs[i] = encodedEvent{Event: &Event{Time: eventTime, RequestID: fmt.Sprintf("16D8B3E5F0A1B%03d", i)}}
+	}
+
+	payloads, err := notifyPayloads(evs[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{`[["2022-03-01T10:00:00.000123Z","16D8B3E5F0A1B000"]]`}; !reflect.DeepEqual(payloads, expected) {
+		t.Errorf("got %v, expected %v", payloads, expected)
+	}
+
+	// The keys of many events are split between notifications.
+	payloads, err = notifyPayloads(evs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payloads) < 2 {
+		t.Fatalf("got %d payloads, expected several", len(payloads))
+	}
+	var n int
+	for _, payload := range payloads {
+		if len(payload) > maxNotifyPayload {
+			t.Errorf("got a payload of %d bytes", len(payload))
+		}
+		var keys []insertedKey
+		if err := json.Unmarshal([]byte(payload), &keys); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			if key[1] != evs[n].RequestID {
+				t.Errorf("got key %v, expected request ID %s", key, evs[n].RequestID)
+			}
+			n++
+		}
+	}
+	if n != len(evs) {
+		t.Errorf("got %d keys, expected %d", n, len(evs))
+	}
+
+	if payloads, err := notifyPayloads(nil); err != nil || len(payloads) != 0 {
+		t.Errorf("got %v, %v, expected no payloads", payloads, err)
+	}
+}
+
+func TestNotifiedStatement(t *testing.T) {
+	c := &DBClient{}
+	s := &SearchQuery{Query: reqInfoQ, FParams: map[fParam][]string{"bucket": {"photos"}}}
+	q, args, err := c.notifiedStatement(s, []insertedKey{{"2022-03-01T10:00:00Z", "abc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "SELECT " + strings.Join(reqInfoCSVHeader, ", ") + " FROM request_info WHERE bucket = $3 AND (time, request_id) IN (SELECT * FROM unnest($1::timestamptz[], $2::text[])) ORDER BY time ASC;"
+	if q = strings.Join(strings.Fields(q), " "); q != expected {
+		t.Errorf("got %q, expected %q", q, expected)
+	}
+	expectedArgs := []interface{}{pq.Array([]string{"2022-03-01T10:00:00Z"}), pq.Array([]string{"abc"}), "photos"}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("got args %v, expected %v", args, expectedArgs)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	c := newTestDBClient(t)
+	c.NotifyInserts = true
+
+	bucket := testBucketName()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := c.Subscribe(ctx, &SearchQuery{Query: reqInfoQ, FParams: bucketFilter(reqInfoQ, bucket)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Truncate(time.Second)
+	insertTestEvent(t, c, start, bucket)
+	// Records of other buckets are not delivered.
+	insertTestEvent(t, c, start, testBucketName())
+	insertTestEvent(t, c, start.Add(time.Second), bucket)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case row := <-ch:
+			if row.Bucket != bucket || !row.Time.Equal(start.Add(time.Duration(i)*time.Second)) {
+				t.Errorf("got record %+v", row)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for record %d", i)
+		}
+	}
+
+	cancel()
+	select {
+	case row, ok := <-ch:
+		if ok {
+			t.Errorf("got unexpected record %+v", row)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the channel to be closed")
+	}
+}
@@ -0,0 +1,153 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/georgysavva/scany/sqlscan"
+)
+
+// maxTablespaceLen is the maximum length of a Postgres identifier, and so of
+// tablespace names.
+const maxTablespaceLen = 63
+
+// validateTablespace checks that tablespace, when not empty, can be used
+// unquoted as a tablespace name.
+func validateTablespace(tablespace string) error {
+	if tablespace == "" {
+		return nil
+	}
+	if !tablePrefixRegexp.MatchString(tablespace) {
+		return fmt.Errorf("Invalid tablespace %q: it must consist of lowercase letters, digits and underscores, and not start with a digit", tablespace)
+	}
+	if len(tablespace) > maxTablespaceLen {
+		return fmt.Errorf("Invalid tablespace %q: it must be at most %d characters long", tablespace, maxTablespaceLen)
+	}
+	return nil
+}
+
+// tablespaceClause returns the TABLESPACE clause of the statements creating
+// a table or an index in tablespace, which is empty for the default
+// tablespace.
+func tablespaceClause(tablespace string) string {
+	if tablespace == "" {
+		return ""
+	}
+	return " TABLESPACE " + tablespace
+}
+
+// WithPartitionTablespace has the client create the partitions of its
+// tables, along with their indexes, in the given tablespace, e.g. on faster
+// storage than the default tablespace of the database. The tablespace must
+// exist, and is validated by NewDBClient. Existing partitions are left in
+// place; see MovePartitionTablespace to move them, e.g. to cheaper storage
+// as they age. It does not apply to hypertables.
+func WithPartitionTablespace(tablespace string) DBClientOption {
+	return func(c *DBClient) {
+		c.partitionTablespace = tablespace
+	}
+}
+
+// MovePartitionTablespace moves the partition of one of the tables of the
+// client, e.g. request_info_2021_03_01 (see ListPartitions), along with its
+// indexes, to the given tablespace, which must exist. The partition and its
+// indexes are rewritten, and locked until they are moved, so the inserts
+// and searches of the partition wait meanwhile. It is not supported for
+// hypertables.
+func (c *DBClient) MovePartitionTablespace(ctx context.Context, partition, tablespace string) error {
+	if err := c.checkOpen(); err != nil {
+		return err
+	}
+	if tablespace == "" {
+		return fmt.Errorf("Invalid tablespace: it must not be empty")
+	}
+	if err := validateTablespace(tablespace); err != nil {
+		return err
+	}
+	if !c.isPartition(partition) {
+		return fmt.Errorf("Invalid partition %q: it is not a partition of %s", partition, strings.Join(c.tableNames(), " or "))
+	}
+	if hyper, err := c.hypertables(ctx); err != nil {
+		return err
+	} else if hyper {
+		return fmt.Errorf("Moving the partitions of hypertables is not supported")
+	}
+
+	const (
+		partitionIndexes QTemplate = `SELECT indexrelid::regclass::text
+                                                FROM pg_index
+                                               WHERE indrelid = to_regclass($1);`
+		setTableTablespace QTemplate = `ALTER TABLE %s SET TABLESPACE %s;`
+		setIndexTablespace QTemplate = `ALTER INDEX %s SET TABLESPACE %s;`
+	)
+
+	tx, err := c.BeginTx(ctx, nil)
+	if err != nil {
+		return &QueryError{Op: "querying", Err: err}
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, partitionIndexes.build(), partition)
+	if err != nil {
+		return &QueryError{Op: "querying", Err: err}
+	}
+	var indexes []string
+	if err := sqlscan.ScanAll(&indexes, rows); err != nil {
+		return &QueryError{Op: "accessing", Err: err}
+	}
+
+	if _, err := tx.ExecContext(ctx, setTableTablespace.build(partition, tablespace)); err != nil {
+		return fmt.Errorf("Error moving partition %s to tablespace %s: %v", partition, tablespace, err)
+	}
+	for _, index := range indexes {
+		if _, err := tx.ExecContext(ctx, setIndexTablespace.build(index, tablespace)); err != nil {
+			return fmt.Errorf("Error moving index %s to tablespace %s: %v", index, tablespace, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return &QueryError{Op: "querying", Err: err}
+	}
+	c.logger().Infof("Moved partition %s and its %d indexes to tablespace %s", partition, len(indexes), tablespace)
+	return nil
+}
+
+// isPartition returns true if name is the name of a partition of one of the
+// tables of the client.
+func (c *DBClient) isPartition(name string) bool {
+	p, err := getPartitionTimeRangeForTable(name)
+	if err != nil {
+		return false
+	}
+	for _, table := range c.tables() {
+		if table.getPartitionName(p) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// tableNames returns the names of the tables of the client.
+func (c *DBClient) tableNames() []string {
+	var names []string
+	for _, table := range c.tables() {
+		names = append(names, table.Name)
+	}
+	return names
+}
@@ -0,0 +1,116 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateTablespace(t *testing.T) {
+	testCases := []struct {
+		tablespace string
+		expectErr  bool
+	}{
+		{"", false},
+		{"fast_ssd", false},
+		{"pg_default", false},
+		{"Fast", true},
+		{"1fast", true},
+		{"fast ssd", true},
+		{"fast; DROP TABLE x", true},
+		{strings.Repeat("t", maxTablespaceLen), false},
+		{strings.Repeat("t", maxTablespaceLen+1), true},
+	}
+	for i, testCase := range testCases {
+		if err := validateTablespace(testCase.tablespace); (err != nil) != testCase.expectErr {
+			t.Errorf("Test %d: %q: got error %v, expected error: %v", i, testCase.tablespace, err, testCase.expectErr)
+		}
+	}
+}
+
+func TestPartitionTablespaceStatements(t *testing.T) {
+	p := newPartitionTimeRange(time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC), PartitionDaily)
+
+	c := &DBClient{PartitionInterval: PartitionDaily, DedupeRequestInfo: true}
+	for _, stmt := range c.partitionStatements(c.reqInfoTable(), p) {
+		if strings.Contains(stmt, "TABLESPACE") {
+			t.Errorf("got %q, expected no tablespace", stmt)
+		}
+	}
+
+	WithPartitionTablespace("fast_ssd")(c)
+	stmts := c.partitionStatements(c.reqInfoTable(), p)
+	if !strings.HasSuffix(stmts[0], "TABLESPACE fast_ssd;") {
+		t.Errorf("got %q, expected the partition in tablespace fast_ssd", stmts[0])
+	}
+	for _, stmt := range stmts[1:] {
+		if strings.Contains(stmt, "WHERE") {
+			if !strings.Contains(stmt, "(request_id) TABLESPACE fast_ssd WHERE") {
+				t.Errorf("got %q, expected the index in tablespace fast_ssd", stmt)
+			}
+		} else if !strings.HasSuffix(stmt, ") TABLESPACE fast_ssd;") {
+			t.Errorf("got %q, expected the index in tablespace fast_ssd", stmt)
+		}
+	}
+}
+
+func TestMovePartitionTablespaceValidation(t *testing.T) {
+	c := &DBClient{tablePrefix: "env1_"}
+	ctx := context.Background()
+	testCases := []struct {
+		partition, tablespace string
+	}{
+		{"env1_request_info_d2021_03_04", ""},
+		{"env1_request_info_d2021_03_04", "Fast"},
+		{"env1_request_info", "fast_ssd"},
+		{"request_info_d2021_03_04", "fast_ssd"},
+		{"env1_request_info_x2021_03_04", "fast_ssd"},
+		{"env1_watermarks_d2021_03_04", "fast_ssd"},
+		{"env1_request_info_d2021_03_04; DROP TABLE x", "fast_ssd"},
+	}
+	for i, testCase := range testCases {
+		if err := c.MovePartitionTablespace(ctx, testCase.partition, testCase.tablespace); err == nil {
+			t.Errorf("Test %d: %q to %q: expected an error", i, testCase.partition, testCase.tablespace)
+		}
+	}
+	for _, partition := range []string{"env1_request_info_d2021_03_04", "env1_audit_log_events_m2021_03"} {
+		if !c.isPartition(partition) {
+			t.Errorf("%q: expected a partition", partition)
+		}
+	}
+}
+
+func TestMovePartitionTablespace(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	table := c.reqInfoTable()
+	now := time.Now()
+	if err := c.createTablePartition(ctx, table, now); err != nil {
+		t.Fatal(err)
+	}
+	partition := table.getPartitionName(newPartitionTimeRange(now, c.PartitionInterval))
+	if err := c.MovePartitionTablespace(ctx, partition, "pg_default"); err != nil {
+		t.Fatalf("MovePartitionTablespace failed: %v", err)
+	}
+	if err := c.MovePartitionTablespace(ctx, partition, "no_such_tablespace"); err == nil {
+		t.Errorf("expected an error moving to a nonexistent tablespace")
+	}
+}
@@ -0,0 +1,232 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/georgysavva/scany/sqlscan"
+)
+
+// DefaultTailPollInterval is the interval between the polls of Tail for new
+// records, unless DBClient.TailPollInterval is set.
+const DefaultTailPollInterval = time.Second
+
+// DefaultTailPollLimit is the maximum number of records selected by a poll
+// of Tail, unless DBClient.TailPollLimit is set.
+const DefaultTailPollLimit = 1000
+
+// Tail follows the search s like `tail -f`: it writes the reqInfoQ records
+// matching s as they are inserted, as ndjson, until ctx is done. The records
+// after s.TimeStart are written, or the records after the call if it is not
+// set, in time order.
+//
+// Tail polls the DB for the records with a time later than the last record
+// written, waiting DBClient.TailPollInterval between polls, rather than
+// being notified of the inserts (e.g. with LISTEN/NOTIFY). Thus a record
+// inserted after a later record was written is skipped, as is a record
+// sharing its time with the last record written but inserted after it.
+// A poll selects at most DBClient.TailPollLimit records, and Tail polls again
+// right away for the following ones when it selected as many, so that a
+// backlog of records, e.g. after a distant s.TimeStart, is written in pages.
+//
+// Tail returns nil when ctx is done. The search may not have a time end, a
+// sort order, paging or an export format.
+func (c *DBClient) Tail(ctx context.Context, s *SearchQuery, w io.Writer) error {
+	s = c.redactSearch(s)
+	if err := checkFollowQuery(s, "Tail"); err != nil {
+		return err
+	}
+	if err := c.checkOpen(); err != nil {
+		return err
+	}
+
+	after := time.Now()
+	if s.TimeStart != nil {
+		after = *s.TimeStart
+	}
+	// The time range of the polls is set by tailStatement.
+	ts := *s
+	ts.TimeStart = nil
+
+	interval := c.TailPollInterval
+	if interval <= 0 {
+		interval = DefaultTailPollInterval
+	}
+	limit := c.TailPollLimit
+	if limit <= 0 {
+		limit = DefaultTailPollLimit
+	}
+	// An http.ResponseWriter is flushed after each poll writing records,
+	// so that they are sent right away.
+	flusher, _ := w.(interface{ Flush() })
+	jw := json.NewEncoder(w)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+		}
+
+		n, more, err := c.tailPoll(ctx, &ts, &after, limit, jw)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n > 0 && flusher != nil {
+			flusher.Flush()
+		}
+		if more {
+			timer.Reset(0)
+		} else {
+			timer.Reset(interval)
+		}
+	}
+}
+
+// checkFollowQuery validates the search s followed by op (Tail or Subscribe)
+// as new records are inserted.
+func checkFollowQuery(s *SearchQuery, op string) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	switch {
+	case s.Query != reqInfoQ:
+		return invalidQueryErrorf("%s is only supported for %s queries", op, reqInfoQ)
+	case s.TimeEnd != nil || s.LastDuration != nil:
+		return invalidQueryErrorf("%s does not support a time end or a last duration", op)
+	case len(s.SortBy) > 0 || s.Limit != nil || s.PageNumber != 0:
+		return invalidQueryErrorf("%s does not support sorting or paging", op)
+	case s.ExportFormat != "" || s.Envelope || s.DataEnvelope:
+		return invalidQueryErrorf("%s does not support export formats or envelopes", op)
+	case s.DedupByRequestID:
+		return invalidQueryErrorf("%s does not support deduplicating records by request ID", op)
+	}
+	return nil
+}
+
+// tailPoll writes the records of the tail of s after *after with jw, at most
+// limit of them, advancing *after to the time of the last record written. It
+// returns the number of records written, and whether more records may follow
+// them, as limit records were selected.
+//
+// As the next poll selects the records after the last time written, the
+// records of a full page sharing the time of its last record are left for
+// the next poll rather than written, lest the records of that time beyond
+// the limit be skipped, unless all the records of the page share it.
+func (c *DBClient) tailPoll(ctx context.Context, s *SearchQuery, after *time.Time, limit int, jw *json.Encoder) (n int, more bool, err error) {
+	if err := c.checkOpen(); err != nil {
+		return 0, false, err
+	}
+	q, sqlArgs, err := c.tailStatement(s, *after, limit)
+	if err != nil {
+		return 0, false, err
+	}
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Search)
+	defer cancel()
+	rows, err := c.QueryContext(ctx, q, sqlArgs...)
+	if err != nil {
+		return 0, false, &QueryError{Op: "querying", Err: err}
+	}
+	defer rows.Close()
+
+	// The page is read before writing it, to know which records to leave
+	// for the next poll.
+	page := make([]ReqInfoRow, 0, limit)
+	for rows.Next() {
+		var reqInfo ReqInfoRow
+		if err := sqlscan.ScanRow(&reqInfo, rows); err != nil {
+			return 0, false, &QueryError{Op: "accessing", Err: err}
+		}
+		page = append(page, reqInfo)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, false, &QueryError{Op: "accessing", Err: err}
+	}
+	more = len(page) == limit
+	if more {
+		last := page[len(page)-1].Time
+		end := len(page)
+		for end > 0 && page[end-1].Time.Equal(last) {
+			end--
+		}
+		if end > 0 {
+			page = page[:end]
+		}
+	}
+
+	for _, reqInfo := range page {
+		if err := s.redact(&reqInfo); err != nil {
+			return n, false, err
+		}
+		*after = reqInfo.Time
+		reqInfo.Time = s.outputTime(reqInfo.Time)
+		v, err := s.reqInfoJSONValue(reqInfo)
+		if err != nil {
+			return n, false, err
+		}
+		if err := jw.Encode(v); err != nil {
+			return n, false, &StreamWriteError{Err: err}
+		}
+		n++
+	}
+	return n, more, nil
+}
+
+// tailStatement returns the statement selecting the first limit reqInfoQ
+// records of s with a time later than after, in time order. Rather than its
+// time range, after bounds the records selected, like a keyset: each poll of
+// Tail selects the records after the last one it has written.
+func (c *DBClient) tailStatement(s *SearchQuery, after time.Time, limit int) (q string, sqlArgs []interface{}, err error) {
+	const tailSelect QTemplate = `SELECT %s
+                                        FROM %s
+                                       %s
+                                    ORDER BY time ASC
+                                       LIMIT $%d;`
+
+	whereClause, filterArgs, dollarStart, err := c.reqInfoWhereClause(s, 2)
+	if err != nil {
+		return "", nil, err
+	}
+	if whereClause == "" {
+		whereClause = "WHERE time > $1"
+	} else {
+		whereClause += " AND time > $1"
+	}
+	sqlArgs = append([]interface{}{pgTimeArg(after)}, filterArgs...)
+	sqlArgs = append(sqlArgs, limit)
+
+	// The time of the records is selected even when not among the columns
+	// of s, to track the last record written.
+	columns := s.reqInfoColumns()
+	hasTime := false
+	for _, col := range columns {
+		hasTime = hasTime || col == "time"
+	}
+	if !hasTime {
+		columns = append(columns[:len(columns):len(columns)], "time")
+	}
+	return tailSelect.build(strings.Join(columns, ", "), c.reqInfoTable().Name, whereClause, dollarStart), sqlArgs, nil
+}
@@ -0,0 +1,181 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTailStatement(t *testing.T) {
+	c := &DBClient{}
+	after := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	s := &SearchQuery{Query: reqInfoQ, FParams: map[fParam][]string{"bucket": {"photos"}}, Columns: []string{"bucket", "object"}}
+	q, args, err := c.tailStatement(s, after, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The time is selected to track the last record, after the columns of
+	// the search.
+	expected := "SELECT bucket, object, time FROM request_info WHERE bucket = $2 AND time > $1 ORDER BY time ASC LIMIT $3;"
+	if q = strings.Join(strings.Fields(q), " "); q != expected {
+		t.Errorf("got %q, expected %q", q, expected)
+	}
+	if expected := []interface{}{pgTimeArg(after), "photos", 100}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("got args %v, expected %v", args, expected)
+	}
+
+	q, _, err = c.tailStatement(&SearchQuery{Query: reqInfoQ, Columns: []string{"time"}}, after, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "SELECT time FROM request_info WHERE time > $1 ORDER BY time ASC LIMIT $2;"
+	if q = strings.Join(strings.Fields(q), " "); q != expected {
+		t.Errorf("got %q, expected %q", q, expected)
+	}
+}
+
+func TestTailErrors(t *testing.T) {
+	c := &DBClient{}
+	end := time.Now()
+	testCases := []*SearchQuery{
+		{Query: rawQ},
+		{Query: reqInfoQ, TimeEnd: &end},
+		{Query: reqInfoQ, SortBy: []SortField{{Column: "time"}}},
+		{Query: reqInfoQ, ExportFormat: "csv"},
+	}
+	for i, sq := range testCases {
+		if err := c.Tail(context.Background(), sq, ioutil.Discard); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("Test %d: got %v, expected an invalid query error", i, err)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTail(t *testing.T) {
+	c := newTestDBClient(t)
+	c.TailPollInterval = 10 * time.Millisecond
+
+	bucket := testBucketName()
+	start := time.Now()
+	// Records before the start of the tail are not written.
+	insertTestEvent(t, c, start.Add(-time.Minute), bucket)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var out syncBuffer
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Tail(ctx, &SearchQuery{Query: reqInfoQ, TimeStart: &start, FParams: bucketFilter(reqInfoQ, bucket)}, &out)
+	}()
+
+	for i := 1; i <= 3; i++ {
+		insertTestEvent(t, c, start.Add(time.Duration(i)*time.Second), bucket)
+		// Records of other buckets are filtered out.
+		insertTestEvent(t, c, start.Add(time.Duration(i)*time.Second), testBucketName())
+		time.Sleep(50 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Tail failed: %v", err)
+	}
+
+	var times []time.Time
+	sc := bufio.NewScanner(bytes.NewBufferString(out.String()))
+	for sc.Scan() {
+		var row ReqInfoRow
+		if err := json.Unmarshal(sc.Bytes(), &row); err != nil {
+			t.Fatalf("decoding %q: %v", sc.Text(), err)
+		}
+		if row.Bucket != bucket {
+			t.Errorf("got a record of bucket %q", row.Bucket)
+		}
+		times = append(times, row.Time)
+	}
+	if len(times) != 3 {
+		t.Fatalf("got %d records, expected 3 (each written once): %s", len(times), out.String())
+	}
+	for i := 1; i < len(times); i++ {
+		if !times[i].After(times[i-1]) {
+			t.Errorf("records out of order: %v", times)
+		}
+	}
+}
+
+func TestTailPollPages(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	bucket := testBucketName()
+	start := time.Now().Add(-time.Hour)
+	// The second and third records share their time, which must not be
+	// split between polls.
+	for _, d := range []time.Duration{1, 2, 2, 3} {
+		insertTestEvent(t, c, start.Add(d*time.Second), bucket)
+	}
+
+	sq := SearchQuery{Query: reqInfoQ, FParams: bucketFilter(reqInfoQ, bucket)}
+	after := start
+	var out bytes.Buffer
+	jw := json.NewEncoder(&out)
+	var written []int
+	for i := 0; i < 5; i++ {
+		n, more, err := c.tailPoll(ctx, &sq, &after, 2, jw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, n)
+		if !more {
+			break
+		}
+	}
+	// The first page leaves the record sharing the time of its last record
+	// for the next one.
+	if expected := []int{1, 2, 1}; !reflect.DeepEqual(written, expected) {
+		t.Errorf("got pages of %v records, expected %v", written, expected)
+	}
+	if expected := pgTimeArg(start.Add(3 * time.Second)); !after.Equal(expected) {
+		t.Errorf("got last time %v, expected %v", after, expected)
+	}
+}
@@ -0,0 +1,136 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"time"
+)
+
+// Timeouts bounds the duration of DB operations. A zero timeout disables it,
+// so that the operation is bound only by the deadline of the caller's
+// context, if any.
+type Timeouts struct {
+	// Init bounds InitDBTables.
+	Init time.Duration
+	// Insert bounds InsertEvent, including its retries.
+	Insert time.Duration
+	// Search bounds searches returning a page of results, aggregations and
+	// deletions.
+	Search time.Duration
+	// Export bounds searches streaming all matching results in an export
+	// format, which may legitimately take much longer than paged searches.
+	Export time.Duration
+
+	// EnforceInDB has searches, including the iterators of SearchRows,
+	// set the statement_timeout of the connection running their queries to
+	// the time left before their deadline, so that Postgres itself aborts
+	// them once it passes, even when the cancellation requested by the
+	// client is lost, e.g. by a connection pooler. It has no effect on
+	// searches without a deadline.
+	EnforceInDB bool
+}
+
+// DefaultTimeouts are the timeouts of clients created with NewDBClient.
+var DefaultTimeouts = Timeouts{
+	Init:   2 * time.Second,
+	Insert: 15 * time.Second,
+	Search: 15 * time.Second,
+	Export: 10 * time.Minute,
+}
+
+// searchTimeout returns the timeout for the search s.
+func (t Timeouts) searchTimeout(s *SearchQuery) time.Duration {
+	if s.ExportFormat != "" {
+		return t.Export
+	}
+	return t.Search
+}
+
+// querier runs the queries of a search, on the connection pool of the client
+// or on one of its connections.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// resetTimeout bounds the reset of the statement_timeout of a connection
+// once a search is done with it.
+const resetTimeout = 5 * time.Second
+
+// searchQuerier returns the querier of the queries of a search bounded by the
+// deadline of ctx: the client itself, or its replica if any, or with
+// Timeouts.EnforceInDB, a connection of the reader of the client whose
+// statement_timeout is the time left before the deadline. release must be
+// called once the rows of the queries are closed, to return the connection
+// to the pool.
+func (c *DBClient) searchQuerier(ctx context.Context) (db querier, release func(), err error) {
+	deadline, ok := ctx.Deadline()
+	if !c.Timeouts.EnforceInDB || !ok {
+		if c.replica != nil {
+			return c.replica, func() {}, nil
+		}
+		return c, func() {}, nil
+	}
+
+	conn, err := c.reader().Conn(ctx)
+	if err != nil {
+		return nil, nil, &QueryError{Op: "querying", Err: err}
+	}
+	// The timeout is in milliseconds, rounded up since 0 disables it.
+	timeout := (time.Until(deadline) + time.Millisecond - 1).Milliseconds()
+	if timeout < 1 {
+		timeout = 1
+	}
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("SET statement_timeout = %d", timeout)); err != nil {
+		conn.Close()
+		return nil, nil, &QueryError{Op: "querying", Err: err}
+	}
+	return conn, func() {
+		// The connection is discarded if its timeout cannot be reset,
+		// rather than bounding the queries of its next users.
+		ctx, cancel := context.WithTimeout(context.Background(), resetTimeout)
+		defer cancel()
+		if _, err := conn.ExecContext(ctx, "RESET statement_timeout"); err != nil {
+			c.logger().Warnf("Discarding a connection whose statement_timeout was not reset: %v", err)
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}, nil
+}
+
+// withTimeout is like context.WithTimeout, but a zero (or negative) timeout
+// leaves the deadline of ctx as is.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// DBClientOption customizes a DBClient created with NewDBClient.
+type DBClientOption func(*DBClient)
+
+// WithTimeouts sets the timeouts of the client, instead of DefaultTimeouts.
+func WithTimeouts(t Timeouts) DBClientOption {
+	return func(c *DBClient) {
+		c.Timeouts = t
+	}
+}
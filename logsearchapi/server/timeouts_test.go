@@ -0,0 +1,227 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestWithTimeout(t *testing.T) {
+	ctx, cancel := withTimeout(context.Background(), 0)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("expected no deadline for a zero timeout")
+	}
+
+	parent, parentCancel := context.WithTimeout(context.Background(), time.Hour)
+	defer parentCancel()
+	ctx, cancel = withTimeout(parent, 0)
+	defer cancel()
+	if d, _ := ctx.Deadline(); !d.Equal(mustDeadline(t, parent)) {
+		t.Errorf("expected the deadline of the parent context")
+	}
+
+	ctx, cancel = withTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if d, ok := ctx.Deadline(); !ok || time.Until(d) > time.Minute {
+		t.Errorf("expected a deadline within a minute, got %v", d)
+	}
+}
+
+func mustDeadline(t *testing.T, ctx context.Context) time.Time {
+	t.Helper()
+	d, ok := ctx.Deadline()
+	if !ok {
+		t.Fatal("context has no deadline")
+	}
+	return d
+}
+
+func TestSearchTimeout(t *testing.T) {
+	timeouts := Timeouts{Search: time.Second, Export: 0}
+	if got := timeouts.searchTimeout(&SearchQuery{}); got != time.Second {
+		t.Errorf("got %v for a paged search, expected 1s", got)
+	}
+	if got := timeouts.searchTimeout(&SearchQuery{ExportFormat: "csv"}); got != 0 {
+		t.Errorf("got %v for an export, expected 0", got)
+	}
+
+	c := &DBClient{Timeouts: DefaultTimeouts}
+	WithTimeouts(timeouts)(c)
+	if c.Timeouts != timeouts {
+		t.Errorf("got %+v, expected %+v", c.Timeouts, timeouts)
+	}
+}
+
+func TestSearchQuerier(t *testing.T) {
+	c := &DBClient{Timeouts: Timeouts{EnforceInDB: true}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Without a deadline or EnforceInDB, the queries run on the pool.
+	for _, testCase := range []struct {
+		ctx         context.Context
+		enforceInDB bool
+	}{
+		{context.Background(), true},
+		{ctx, false},
+	} {
+		c.Timeouts.EnforceInDB = testCase.enforceInDB
+		db, release, err := c.searchQuerier(testCase.ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+		if db != c {
+			t.Errorf("got %T, expected the client", db)
+		}
+	}
+}
+
+func TestEnforceInDB(t *testing.T) {
+	c := newTestDBClient(t, WithPoolConfig(PoolConfig{MaxOpenConns: 1}))
+	c.Timeouts.EnforceInDB = true
+
+	var defaultTimeout string
+	if err := c.QueryRowContext(context.Background(), "SHOW statement_timeout").Scan(&defaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	db, release, err := c.searchQuerier(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The query runs without a deadline on the client side, so only the
+	// server can abort it.
+	var slept string
+	err = db.QueryRowContext(context.Background(), "SELECT pg_sleep(5)::text").Scan(&slept)
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "57014" {
+		t.Errorf("got %v, expected the query to be canceled by the statement timeout", err)
+	}
+	release()
+
+	// The connection is back in the pool with the default timeout.
+	var timeout string
+	if err := c.QueryRowContext(context.Background(), "SHOW statement_timeout").Scan(&timeout); err != nil {
+		t.Fatal(err)
+	}
+	if timeout != defaultTimeout {
+		t.Errorf("got statement_timeout %s after the search, expected %s", timeout, defaultTimeout)
+	}
+}
+
+func TestSearchRowsEnforceInDB(t *testing.T) {
+	c := newTestDBClient(t, WithPoolConfig(PoolConfig{MaxOpenConns: 1}))
+	c.Timeouts.EnforceInDB = true
+	ctx := context.Background()
+	bucket := testBucketName()
+	insertTestEvent(t, c, time.Now(), bucket)
+
+	var defaultTimeout string
+	if err := c.QueryRowContext(ctx, "SHOW statement_timeout").Scan(&defaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	sq := SearchQuery{Query: reqInfoQ, PageSize: 10, FParams: bucketFilter(reqInfoQ, bucket)}
+	it, err := c.SearchRows(ctx, &sq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The search runs on a connection with its statement_timeout set.
+	if _, ok := it.run.db.(*sql.Conn); !ok {
+		t.Errorf("got querier %T, expected a connection", it.run.db)
+	}
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if err := it.Err(); err != nil || n != 1 {
+		t.Fatalf("got %d records and error %v, expected 1 record", n, err)
+	}
+
+	// The iterator returned the connection to the pool, with the default
+	// timeout.
+	qctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var timeout string
+	if err := c.QueryRowContext(qctx, "SHOW statement_timeout").Scan(&timeout); err != nil {
+		t.Fatal(err)
+	}
+	if timeout != defaultTimeout {
+		t.Errorf("got statement_timeout %s after the search, expected %s", timeout, defaultTimeout)
+	}
+}
+
+// slowWriter sleeps before each write, so that the rows of a search are
+// read slower than Postgres sends them.
+type slowWriter struct {
+	delay time.Duration
+}
+
+func (w slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return len(p), nil
+}
+
+func TestExportStatementTimeout(t *testing.T) {
+	c := newTestDBClient(t)
+	c.Timeouts.EnforceInDB = true
+	c.Timeouts.Export = 300 * time.Millisecond
+
+	// The logs are large enough for the results not to fit in the socket
+	// buffers, so that the statement runs until the rows are read.
+	bucket := testBucketName()
+	now := time.Now()
+	events := make([][]byte, 3000)
+	for i := range events {
+		ev := newTestEvent(now.Add(-time.Duration(i)*time.Millisecond), bucket)
+		ev["requestHeader"] = map[string]string{"X-Padding": strings.Repeat("x", 8192)}
+		buf, err := json.Marshal(ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events[i] = buf
+	}
+	if err := c.insertBatch(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+
+	// The statement times out while the rows are written out, which fails
+	// the export rather than leaving it silently truncated.
+	for _, format := range []string{"ndjson", "csv"} {
+		sq := SearchQuery{Query: rawQ, ExportFormat: format, FParams: bucketFilter(rawQ, bucket)}
+		res, err := c.SearchWithResult(context.Background(), &sq, slowWriter{delay: time.Millisecond})
+		var queryErr *QueryError
+		if !errors.As(err, &queryErr) {
+			t.Errorf("%s: got %v after %d rows, expected a QueryError", format, err, res.RowsWritten)
+		}
+		if res.RowsWritten >= int64(len(events)) {
+			t.Errorf("%s: expected the export to time out, got all %d rows", format, res.RowsWritten)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// exportWatermarksTable records the watermarks of incremental exports (see
+// SetWatermark).
+var exportWatermarksTable = Table{
+	Name: "export_watermarks",
+	CreateStatement: `CREATE TABLE IF NOT EXISTS %s (
+                                    name TEXT PRIMARY KEY,
+                                    time TIMESTAMPTZ NOT NULL,
+                                    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+                                  );`,
+}
+
+// watermarksTable returns the export_watermarks table of the client, named
+// with its table prefix.
+func (c *DBClient) watermarksTable() Table {
+	return exportWatermarksTable.withPrefix(c.tablePrefix)
+}
+
+// GetWatermark returns the time of the watermark name, as last set by
+// SetWatermark, or the zero time if it was never set, e.g. on the first run
+// of an incremental export.
+func (c *DBClient) GetWatermark(ctx context.Context, name string) (time.Time, error) {
+	if err := c.checkOpen(); err != nil {
+		return time.Time{}, err
+	}
+	const getWatermark QTemplate = `SELECT time FROM %s WHERE name = $1;`
+
+	var t time.Time
+	err := c.QueryRowContext(ctx, getWatermark.build(c.watermarksTable().Name), name).Scan(&t)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, &QueryError{Op: "querying", Err: err}
+	}
+	return t.UTC(), nil
+}
+
+// SetWatermark sets the time of the watermark name, e.g. to the time of the
+// last record written by an incremental export once it succeeded, so that
+// the next export with SearchQuery.SinceWatermark set to name starts after
+// it. The time is stored with the precision of the record times.
+func (c *DBClient) SetWatermark(ctx context.Context, name string, t time.Time) error {
+	if err := c.checkOpen(); err != nil {
+		return err
+	}
+	if name == "" {
+		return &ValidationError{Field: "name", Msg: "must not be empty"}
+	}
+	const setWatermark QTemplate = `INSERT INTO %s (name, time) VALUES ($1, $2)
+                                     ON CONFLICT (name) DO UPDATE
+                                    SET time = EXCLUDED.time, updated_at = CURRENT_TIMESTAMP;`
+
+	if _, err := c.ExecContext(ctx, setWatermark.build(c.watermarksTable().Name), name, pgTimeArg(t)); err != nil {
+		return &QueryError{Op: "querying", Err: err}
+	}
+	return nil
+}
+
+// resolveWatermark returns the search query to run for s, which starts
+// after the time of its SinceWatermark watermark, if any. The records at
+// the time of the watermark are excluded, as they were exported by the
+// previous export. All the records are searched if the watermark was never
+// set.
+func (c *DBClient) resolveWatermark(ctx context.Context, s *SearchQuery) (*SearchQuery, error) {
+	if s.SinceWatermark == "" {
+		return s, nil
+	}
+	t, err := c.GetWatermark(ctx, s.SinceWatermark)
+	if err != nil {
+		return nil, err
+	}
+	resolved := *s
+	resolved.SinceWatermark = ""
+	if !t.IsZero() {
+		// The record times are stored with pgTimePrecision, so the
+		// records after t are at t+pgTimePrecision or later.
+		start := t.Add(pgTimePrecision)
+		resolved.TimeStart = &start
+	}
+	return &resolved, nil
+}
@@ -0,0 +1,180 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSinceWatermarkValidation(t *testing.T) {
+	c := &DBClient{}
+	now := time.Now()
+	last := time.Hour
+
+	for _, sq := range []*SearchQuery{
+		{Query: reqInfoQ, SinceWatermark: "daily", TimeStart: &now},
+		{Query: reqInfoQ, SinceWatermark: "daily", LastDuration: &last},
+	} {
+		var vErr *ValidationError
+		if err := sq.Validate(); !errors.As(err, &vErr) || vErr.Field != "SinceWatermark" {
+			t.Errorf("got %v, expected a validation error of SinceWatermark", err)
+		}
+	}
+	// The watermark is resolved by Search, before building the query.
+	sq := &SearchQuery{Query: reqInfoQ, SinceWatermark: "daily", TimeEnd: &now}
+	if err := sq.Validate(); err != nil {
+		t.Errorf("got %v, expected a watermark to be valid with TimeEnd", err)
+	}
+	if _, _, _, err := c.reqInfoWhereClause(sq, 1); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got %v, expected an invalid query error for an unresolved watermark", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/query?q=reqinfo&sinceWatermark=daily", nil)
+	sq, err := searchQueryFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sq.SinceWatermark != "daily" {
+		t.Errorf("got watermark %q, expected daily", sq.SinceWatermark)
+	}
+	for _, u := range []string{
+		"/api/query?q=reqinfo&sinceWatermark=daily&last=1h",
+		"/api/query?q=reqinfo&sinceWatermark=daily&timeStart=2021-03-04T00:00:00Z",
+	} {
+		r := httptest.NewRequest(http.MethodGet, u, nil)
+		if _, err := searchQueryFromRequest(r); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%s: got %v, expected an invalid query error", u, err)
+		}
+	}
+}
+
+func TestWatermarks(t *testing.T) {
+	c := newTestDBClient(t)
+	ctx := context.Background()
+
+	name := fmt.Sprintf("export-%X", rand.Int63())
+	wm, err := c.GetWatermark(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wm.IsZero() {
+		t.Errorf("got watermark %v, expected none", wm)
+	}
+	if err := c.SetWatermark(ctx, "", time.Now()); err == nil {
+		t.Errorf("expected an error setting a watermark without a name")
+	}
+
+	bucket := testBucketName()
+	start := time.Now().Add(-time.Minute)
+	// export runs an incremental export, returning the times of the
+	// exported records, and sets the watermark to the last one.
+	export := func() []time.Time {
+		t.Helper()
+		sq := SearchQuery{
+			Query:          reqInfoQ,
+			PageSize:       10,
+			SinceWatermark: name,
+			TimeAscending:  true,
+			FParams:        bucketFilter(reqInfoQ, bucket),
+		}
+		var buf bytes.Buffer
+		if err := c.Search(ctx, &sq, &buf); err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		var rows []ReqInfoRow
+		if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+			t.Fatal(err)
+		}
+		var times []time.Time
+		for _, row := range rows {
+			times = append(times, row.Time)
+		}
+		if len(times) > 0 {
+			if err := c.SetWatermark(ctx, name, times[len(times)-1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return times
+	}
+
+	// The first run exports all the records.
+	for i := 0; i < 3; i++ {
+		insertTestEvent(t, c, start.Add(time.Duration(i)*time.Second), bucket)
+	}
+	times := export()
+	if len(times) != 3 {
+		t.Fatalf("got %d records on the first run, expected 3", len(times))
+	}
+	wm, err = c.GetWatermark(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wm.Equal(times[2]) {
+		t.Errorf("got watermark %v, expected %v", wm, times[2])
+	}
+
+	// The next runs export the records after the watermark, including a
+	// record a microsecond after the last exported one.
+	insertTestEvent(t, c, times[2].Add(pgTimePrecision), bucket)
+	insertTestEvent(t, c, start.Add(5*time.Second), bucket)
+	if times := export(); len(times) != 2 || !times[0].Equal(wm.Add(pgTimePrecision)) {
+		t.Errorf("got %v on the second run, expected the 2 new records", times)
+	}
+	if times := export(); len(times) != 0 {
+		t.Errorf("got %v on the third run, expected no records", times)
+	}
+
+	// SearchRows and BuildSearchSQL resolve the watermark like Search.
+	sq := SearchQuery{Query: reqInfoQ, PageSize: 10, SinceWatermark: name, FParams: bucketFilter(reqInfoQ, bucket)}
+	it, err := c.SearchRows(ctx, &sq)
+	if err != nil {
+		t.Fatalf("SearchRows failed: %v", err)
+	}
+	for it.Next() {
+		t.Errorf("got record %+v after the watermark, expected none", it.ReqInfo())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	wm, err = c.GetWatermark(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, args, err := c.BuildSearchSQL(ctx, &sq)
+	if err != nil {
+		t.Fatalf("BuildSearchSQL failed: %v", err)
+	}
+	expected := pgTimeArg(wm.Add(pgTimePrecision))
+	found := false
+	for _, arg := range args {
+		if at, ok := arg.(time.Time); ok && at.Equal(expected) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("got args %v, expected the time after the watermark, %v", args, expected)
+	}
+}
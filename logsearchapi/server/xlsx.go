@@ -0,0 +1,184 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// xlsxMaxRows is the maximum number of rows of a sheet, including the
+	// header row.
+	xlsxMaxRows = 1 << 20
+	// xlsxMaxCellChars is the maximum number of characters of a cell;
+	// longer strings are truncated.
+	xlsxMaxCellChars = 32767
+)
+
+// The parts of a workbook with a single sheet, besides the sheet.
+var xlsxStaticParts = []struct {
+	name    string
+	content string
+}{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="logs" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+}
+
+// xlsxWriter writes rows to an io.Writer as the single sheet of an XLSX
+// workbook. The sheet is streamed, so Close must be called to terminate it
+// and the workbook.
+type xlsxWriter struct {
+	zw    *zip.Writer
+	sheet *bufio.Writer
+	rows  int
+}
+
+func newXLSXWriter(w io.Writer) (*xlsxWriter, error) {
+	zw := zip.NewWriter(w)
+	for _, part := range xlsxStaticParts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return nil, err
+		}
+	}
+	f, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	xw := &xlsxWriter{zw: zw, sheet: bufio.NewWriter(f)}
+	_, err = xw.sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return xw, err
+}
+
+// Write writes a row, holding a value for each column. Strings and times
+// are written as text and integers as numbers; nil values leave their cell
+// empty. It fails with an invalid query error once the sheet has xlsxMaxRows
+// rows, and with a *StreamWriteError when writing out fails.
+func (xw *xlsxWriter) Write(row []interface{}) error {
+	if xw.rows >= xlsxMaxRows {
+		return invalidQueryErrorf("More than %d records to export in the xlsx format", xlsxMaxRows-1)
+	}
+	xw.rows++
+	fmt.Fprintf(xw.sheet, `<row r="%d">`, xw.rows)
+	for i, v := range row {
+		ref := xlsxColumnName(i) + strconv.Itoa(xw.rows)
+		switch x := v.(type) {
+		case nil:
+			continue
+		case string:
+			xw.writeString(ref, x)
+		case time.Time:
+			xw.writeString(ref, x.Format(time.RFC3339Nano))
+		case int:
+			fmt.Fprintf(xw.sheet, `<c r="%s"><v>%d</v></c>`, ref, x)
+		case int64:
+			fmt.Fprintf(xw.sheet, `<c r="%s"><v>%d</v></c>`, ref, x)
+		case uint64:
+			fmt.Fprintf(xw.sheet, `<c r="%s"><v>%d</v></c>`, ref, x)
+		default:
+			return fmt.Errorf("xlsx: unsupported value type %T", v)
+		}
+	}
+	// Errors are sticky in the bufio.Writer, so checking the last write
+	// is enough.
+	if _, err := xw.sheet.WriteString("</row>"); err != nil {
+		return &StreamWriteError{Err: err}
+	}
+	return nil
+}
+
+func (xw *xlsxWriter) writeString(ref, s string) {
+	if utf8.RuneCountInString(s) > xlsxMaxCellChars {
+		s = string([]rune(s)[:xlsxMaxCellChars])
+	}
+	fmt.Fprintf(xw.sheet, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+	xml.EscapeText(xw.sheet, []byte(s))
+	xw.sheet.WriteString("</t></is></c>")
+}
+
+// Close terminates the sheet and the workbook.
+func (xw *xlsxWriter) Close() error {
+	if _, err := xw.sheet.WriteString("</sheetData></worksheet>"); err != nil {
+		return err
+	}
+	if err := xw.sheet.Flush(); err != nil {
+		return err
+	}
+	return xw.zw.Close()
+}
+
+// xlsxColumnName returns the name of the i-th (0-based) column, e.g. "A" or
+// "AB".
+func xlsxColumnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// checkXLSXRows returns an invalid query error if the records matching s do
+// not fit in a sheet, so that the export fails before anything is written.
+func (c *DBClient) checkXLSXRows(ctx context.Context, db querier, s *SearchQuery) error {
+	count, err := c.countRows(ctx, db, s)
+	if err != nil {
+		return err
+	}
+	if count > xlsxMaxRows-1 {
+		return invalidQueryErrorf("%d records match, more than the %d records of an xlsx export (narrow the search or use another export format)", count, xlsxMaxRows-1)
+	}
+	return nil
+}
+
+// writeXLSX writes the header and then the rows written by writeRows to w, as
+// an XLSX workbook.
+func writeXLSX(w io.Writer, header []string, writeRows func(*xlsxWriter) error) error {
+	xw, err := newXLSXWriter(w)
+	if err != nil {
+		return &StreamWriteError{Err: err}
+	}
+	headerRow := make([]interface{}, len(header))
+	for i, h := range header {
+		headerRow[i] = h
+	}
+	if err := xw.Write(headerRow); err != nil {
+		return err
+	}
+	err = writeRows(xw)
+	if cerr := xw.Close(); cerr != nil && err == nil {
+		err = &StreamWriteError{Err: cerr}
+	}
+	return err
+}
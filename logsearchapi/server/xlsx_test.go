@@ -0,0 +1,147 @@
+// This file is part of MinIO Operator
+// Copyright (c) 2022 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// xlsxTestSheet is the part of a sheet read back by the tests.
+type xlsxTestSheet struct {
+	Rows []struct {
+		R     int `xml:"r,attr"`
+		Cells []struct {
+			R      string `xml:"r,attr"`
+			T      string `xml:"t,attr"`
+			V      string `xml:"v"`
+			Inline string `xml:"is>t"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+func readXLSXTestSheet(t *testing.T, data []byte) xlsxTestSheet {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sheet xlsxTestSheet
+	found := map[string]bool{}
+	for _, f := range zr.File {
+		found[f.Name] = true
+		if f.Name != "xl/worksheets/sheet1.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := xml.Unmarshal(buf, &sheet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, part := range xlsxStaticParts {
+		if !found[part.name] {
+			t.Errorf("missing part %s", part.name)
+		}
+	}
+	return sheet
+}
+
+func TestWriteXLSX(t *testing.T) {
+	ts := time.Date(2022, 3, 4, 5, 6, 7, 8000, time.UTC)
+	var buf bytes.Buffer
+	err := writeXLSX(&buf, []string{"time", "api_name", "status_code", "length"}, func(xw *xlsxWriter) error {
+		if err := xw.Write([]interface{}{ts, "Put<Object> & co", 200, uint64(1) << 40}); err != nil {
+			return err
+		}
+		return xw.Write([]interface{}{ts, "", int64(-1), nil})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sheet := readXLSXTestSheet(t, buf.Bytes())
+	if len(sheet.Rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(sheet.Rows))
+	}
+	header := sheet.Rows[0].Cells
+	if len(header) != 4 || header[0].Inline != "time" || header[3].R != "D1" {
+		t.Errorf("unexpected header %+v", header)
+	}
+	row := sheet.Rows[1].Cells
+	if row[0].T != "inlineStr" || row[0].Inline != "2022-03-04T05:06:07.000008Z" {
+		t.Errorf("got time cell %+v", row[0])
+	}
+	if row[1].Inline != "Put<Object> & co" {
+		t.Errorf("got string cell %+v", row[1])
+	}
+	if row[2].T != "" || row[2].V != "200" || row[3].V != "1099511627776" {
+		t.Errorf("expected number cells, got %+v %+v", row[2], row[3])
+	}
+	if row := sheet.Rows[2]; row.R != 3 || len(row.Cells) != 3 || row.Cells[2].V != "-1" {
+		t.Errorf("expected the nil value to leave its cell empty, got %+v", row)
+	}
+
+	err = writeXLSX(&buf, nil, func(xw *xlsxWriter) error {
+		return xw.Write([]interface{}{1.5})
+	})
+	if err == nil {
+		t.Errorf("expected an error for an unsupported value type")
+	}
+}
+
+func TestXLSXLimits(t *testing.T) {
+	xw, err := newXLSXWriter(ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.rows = xlsxMaxRows
+	if err := xw.Write([]interface{}{"a"}); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got %v, expected an invalid query error past the row limit", err)
+	}
+
+	var buf bytes.Buffer
+	long := strings.Repeat("é", xlsxMaxCellChars+10)
+	if err := writeXLSX(&buf, []string{long}, func(*xlsxWriter) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	sheet := readXLSXTestSheet(t, buf.Bytes())
+	if got := []rune(sheet.Rows[0].Cells[0].Inline); len(got) != xlsxMaxCellChars {
+		t.Errorf("got a cell of %d characters, expected %d", len(got), xlsxMaxCellChars)
+	}
+}
+
+func TestXLSXColumnName(t *testing.T) {
+	for i, expected := range map[int]string{0: "A", 25: "Z", 26: "AA", 27: "AB", 701: "ZZ", 702: "AAA"} {
+		if got := xlsxColumnName(i); got != expected {
+			t.Errorf("column %d: got %s, expected %s", i, got, expected)
+		}
+	}
+}